@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	maddytls "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(&cli.Command{
+		Name:  "check-config",
+		Usage: "Verify the configuration file without starting the server",
+		Description: `Reads the configuration file and initializes all modules defined in it
+the same way 'maddy run' does, but does not bind listening sockets, deliver
+queued messages or start other background activities.
+
+Note that storage and table modules still open their databases, so the
+command should be run as the same user as the server.
+
+With --probe, additionally checks that the configured hostname resolves
+and that the TLS certificate for it is usable.
+
+Exit status is 0 if no problems were found, 1 otherwise.
+`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "probe",
+				Usage: "also check DNS records and TLS certificate for the configured hostname",
+			},
+		},
+		Action: checkConfig,
+	})
+}
+
+// configChecker collects problems found by check-config so all of them can
+// be reported at once instead of stopping at the first one.
+type configChecker struct {
+	problems int
+}
+
+func (c *configChecker) fail(format string, args ...interface{}) {
+	c.problems++
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+}
+
+func (c *configChecker) warn(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "warning: "+format+"\n", args...)
+}
+
+func checkConfig(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return cli.Exit(fmt.Sprintln("usage:", os.Args[0], "check-config [options]"), 2)
+	}
+
+	globals, endpoints, mods, err := registerDryRun(c)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+
+	checker := &configChecker{}
+	checker.initModules(globals, endpoints, mods)
+	if c.Bool("probe") {
+		checker.probe(globals)
+	}
+
+	if checker.problems != 0 {
+		return cli.Exit(fmt.Sprintf("%d problem(s) found", checker.problems), 1)
+	}
+	fmt.Fprintln(os.Stderr, "Configuration OK")
+	return nil
+}
+
+// registerDryRun reads the configuration file and registers all modules
+// defined in it with module.NoRun set. Modules are not initialized.
+func registerDryRun(c *cli.Context) (globals map[string]interface{}, endpoints, mods []ModInfo, err error) {
+	f, err := os.Open(c.Path("config"))
+	if err != nil {
+		return nil, nil, nil, cli.Exit(err.Error(), 2)
+	}
+	defer f.Close()
+
+	cfg, err := parser.Read(f, c.Path("config"))
+	if err != nil {
+		return nil, nil, nil, cli.Exit(err.Error(), 1)
+	}
+
+	globals, modBlocks, err := ReadGlobals(cfg)
+	if err != nil {
+		return nil, nil, nil, cli.Exit(err.Error(), 1)
+	}
+	// Make sure module messages end up on the terminal and not in the
+	// configured log.
+	log.DefaultLogger.Out = log.WriterOutput(os.Stderr, false)
+
+	if err := InitDirs(); err != nil {
+		return nil, nil, nil, cli.Exit(err.Error(), 1)
+	}
+
+	module.NoRun = true
+
+	endpoints, mods, err = RegisterModules(globals, modBlocks)
+	if err != nil {
+		return nil, nil, nil, cli.Exit(err.Error(), 1)
+	}
+	return globals, endpoints, mods, nil
+}
+
+func (c *configChecker) initModules(globals map[string]interface{}, endpoints, mods []ModInfo) {
+	for _, endp := range endpoints {
+		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+			c.fail("%v", err)
+			continue
+		}
+		if closer, ok := endp.Instance.(io.Closer); ok {
+			hooks.AddHook(hooks.EventShutdown, func() {
+				closer.Close()
+			})
+		}
+	}
+
+	// Blocks not referenced by any endpoint are rejected by 'maddy run'.
+	// Initialize them anyway to report errors in them too.
+	for _, inst := range mods {
+		if module.Initialized[inst.Instance.InstanceName()] {
+			continue
+		}
+
+		c.fail("%s:%d: unused configuration block %s (%s)",
+			inst.Cfg.File, inst.Cfg.Line, inst.Instance.InstanceName(), inst.Instance.Name())
+
+		if _, err := module.GetInstance(inst.Instance.InstanceName()); err != nil {
+			c.fail("%v", err)
+		}
+	}
+}
+
+func (c *configChecker) probe(globals map[string]interface{}) {
+	hostname, _ := globals["hostname"].(string)
+	if hostname == "" {
+		c.warn("hostname is not set, skipping DNS and TLS checks")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addrs, err := dns.DefaultResolver().LookupIPAddr(ctx, hostname)
+	if err != nil {
+		c.fail("hostname %s does not resolve: %v", hostname, err)
+	} else if len(addrs) == 0 {
+		c.fail("hostname %s has no A or AAAA records", hostname)
+	}
+
+	tlsCfg, _ := globals["tls"].(*tls.Config)
+	if tlsCfg == nil {
+		c.warn("global TLS configuration is not set, skipping TLS checks")
+		return
+	}
+	if err := maddytls.CheckCertificate(tlsCfg, hostname, 0); err != nil {
+		c.fail("TLS certificate for %s: %v", hostname, err)
+	}
+}
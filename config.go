@@ -21,11 +21,22 @@ package maddy
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/audit"
+	"github.com/foxcpp/maddy/internal/sandbox"
+	"github.com/foxcpp/maddy/internal/tracing"
 )
 
 /*
@@ -36,24 +47,63 @@ Config matchers for module interfaces.
 // configuration directive it was constructed from, allowing
 // dynamic reinitialization for purposes of log file rotation.
 type logOut struct {
-	args []string
+	args   []string
+	rotate log.RotateOptions
 	log.Output
 }
 
+func (l logOut) WriteEntry(e log.Entry) {
+	log.WriteEntry(l.Output, e)
+}
+
 func logOutput(_ *config.Map, node config.Node) (interface{}, error) {
 	if len(node.Args) == 0 {
 		return nil, config.NodeErr(node, "expected at least 1 argument")
 	}
+
+	var rotate log.RotateOptions
 	if len(node.Children) != 0 {
-		return nil, config.NodeErr(node, "can't declare block here")
+		cfg := config.NewMap(nil, node)
+		cfg.DataSize("rotate_size", false, false, 0, &rotate.MaxSize)
+		cfg.Duration("rotate_age", false, false, 0, &rotate.MaxAge)
+		cfg.Int("rotate_keep", false, false, 0, &rotate.Keep)
+		cfg.Bool("rotate_compress", false, false, &rotate.Compress)
+		if _, err := cfg.Process(); err != nil {
+			return nil, err
+		}
 	}
 
-	return LogOutputOption(node.Args)
+	out, err := logOutputWithOpts(node.Args, rotate)
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	return out, nil
 }
 
 func LogOutputOption(args []string) (log.Output, error) {
+	return logOutputWithOpts(args, log.RotateOptions{})
+}
+
+func logOutputWithOpts(args []string, rotate log.RotateOptions) (log.Output, error) {
 	outs := make([]log.Output, 0, len(args))
 	for i, arg := range args {
+		if strings.HasPrefix(arg, "json:") {
+			out, err := jsonLogOutput(args, i, rotate)
+			if err != nil {
+				return nil, err
+			}
+			outs = append(outs, out)
+			continue
+		}
+		if strings.HasPrefix(arg, "syslog+") {
+			out, err := remoteSyslogOutput(arg)
+			if err != nil {
+				return nil, err
+			}
+			outs = append(outs, out)
+			continue
+		}
+
 		switch arg {
 		case "stderr":
 			outs = append(outs, log.WriterOutput(os.Stderr, false))
@@ -71,30 +121,90 @@ func LogOutputOption(args []string) (log.Output, error) {
 			}
 			return log.NopOutput{}, nil
 		default:
-			// Log file paths are converted to absolute to make sure
-			// we will be able to recreate them in right location
-			// after changing working directory to the state dir.
-			absPath, err := filepath.Abs(arg)
-			if err != nil {
-				return nil, err
-			}
 			// We change the actual argument, so logOut object will
 			// keep the absolute path for reinitialization.
-			args[i] = absPath
-
-			w, err := os.OpenFile(absPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+			absPath, w, err := openLogFile(arg, rotate)
 			if err != nil {
-				return nil, fmt.Errorf("failed to create log file: %v", err)
+				return nil, err
 			}
+			args[i] = absPath
 
 			outs = append(outs, log.WriteCloserOutput(w, true))
 		}
 	}
 
 	if len(outs) == 1 {
-		return logOut{args, outs[0]}, nil
+		return logOut{args, rotate, outs[0]}, nil
+	}
+	return logOut{args, rotate, log.MultiOutput(outs...)}, nil
+}
+
+// openLogFile opens the log file for appending, rotating it if requested.
+func openLogFile(path string, rotate log.RotateOptions) (string, io.WriteCloser, error) {
+	// Log file paths are converted to absolute to make sure
+	// we will be able to recreate them in right location
+	// after changing working directory to the state dir.
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if rotate != (log.RotateOptions{}) {
+		rf, err := log.OpenRotatingFile(absPath, rotate)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create log file: %v", err)
+		}
+		return absPath, rf, nil
+	}
+
+	w, err := os.OpenFile(absPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create log file: %v", err)
+	}
+	return absPath, w, nil
+}
+
+// jsonLogOutput creates the output for json:stderr and json:PATH log targets.
+func jsonLogOutput(args []string, i int, rotate log.RotateOptions) (log.Output, error) {
+	target := strings.TrimPrefix(args[i], "json:")
+	switch target {
+	case "stderr":
+		return log.JSONWriterOutput(os.Stderr), nil
+	case "":
+		return nil, errors.New("json: log target is required")
+	}
+
+	absPath, w, err := openLogFile(target, rotate)
+	if err != nil {
+		return nil, err
+	}
+	args[i] = "json:" + absPath
+	return log.JSONOutput(w), nil
+}
+
+// remoteSyslogOutput creates the output for syslog+udp://, syslog+tcp://
+// and syslog+tls:// log targets.
+func remoteSyslogOutput(target string) (log.Output, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("malformed syslog target: %v", err)
 	}
-	return logOut{args, log.MultiOutput(outs...)}, nil
+	if u.Host == "" {
+		return nil, fmt.Errorf("malformed syslog target: missing host: %s", target)
+	}
+
+	network := strings.TrimPrefix(u.Scheme, "syslog+")
+	defaultPorts := map[string]string{
+		"udp": "514",
+		"tcp": "601",
+		"tls": "6514",
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[network]
+	}
+
+	return log.RemoteSyslogOutput(network, net.JoinHostPort(u.Hostname(), port), nil)
 }
 
 func defaultLogOutput() (interface{}, error) {
@@ -108,7 +218,7 @@ func reinitLogging() {
 		return
 	}
 
-	newOut, err := LogOutputOption(out.args)
+	newOut, err := logOutputWithOpts(out.args, out.rotate)
 	if err != nil {
 		log.Println("Can't reinitialize logger:", err)
 		return
@@ -117,4 +227,279 @@ func reinitLogging() {
 	out.Close()
 
 	log.DefaultLogger.Out = newOut
+
+	if out, ok := audit.Output().(logOut); ok {
+		newOut, err := logOutputWithOpts(out.args, out.rotate)
+		if err != nil {
+			log.Println("Can't reinitialize audit log:", err)
+			return
+		}
+		audit.SetOutput(newOut)
+		out.Close()
+	}
+}
+
+// auditLogOutput parses the audit_log directive and sets the output for the
+// audit events. It accepts the same targets as the log directive.
+func auditLogOutput(m *config.Map, node config.Node) (interface{}, error) {
+	out, err := logOutput(m, node)
+	if err != nil {
+		return nil, err
+	}
+	audit.SetOutput(out.(log.Output))
+	return out, nil
+}
+
+// logLevels parses the log_level directive and applies the resulting
+// per-logger levels.
+//
+//	log_level info
+//	log_level {
+//	    default info
+//	    remote debug
+//	    check.dkim debug
+//	}
+func logLevels(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) > 1 {
+		return nil, config.NodeErr(node, "expected at most 1 argument")
+	}
+	if len(node.Args) == 0 && len(node.Children) == 0 {
+		return nil, config.NodeErr(node, "expected either an argument or a block")
+	}
+
+	levels := make(map[string]log.Level, len(node.Children)+1)
+	if len(node.Args) == 1 {
+		lvl, err := log.ParseLevel(node.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		levels[""] = lvl
+	}
+	for _, child := range node.Children {
+		if len(child.Args) != 1 || len(child.Children) != 0 {
+			return nil, config.NodeErr(child, "expected exactly 1 argument")
+		}
+		lvl, err := log.ParseLevel(child.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+
+		name := child.Name
+		if name == "default" {
+			name = ""
+		}
+		if _, ok := levels[name]; ok {
+			return nil, config.NodeErr(child, "duplicate level for %s", child.Name)
+		}
+		levels[name] = lvl
+	}
+
+	log.SetLevels(levels)
+	return levels, nil
+}
+
+type tracingConfig struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	sampleRatio float64
+}
+
+func tracingDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	cfg := tracingConfig{headers: map[string]string{}}
+
+	m := config.NewMap(nil, node)
+	m.String("endpoint", false, true, "", &cfg.endpoint)
+	m.String("service_name", false, false, "maddy", &cfg.serviceName)
+	m.Float("sample_ratio", false, false, 1, &cfg.sampleRatio)
+	m.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected exactly 2 arguments")
+		}
+		cfg.headers[node.Args[0]] = node.Args[1]
+		return nil
+	})
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(cfg.endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, config.NodeErr(node, "endpoint should be a http:// or https:// URL")
+	}
+	if cfg.sampleRatio < 0 || cfg.sampleRatio > 1 {
+		return nil, config.NodeErr(node, "sample_ratio should be in [0, 1] range")
+	}
+
+	return cfg, nil
+}
+
+// initTracing enables the export of message traces if it was configured
+// using the tracing directive.
+func initTracing(globals map[string]interface{}) {
+	cfg, ok := globals["tracing"].(tracingConfig)
+	if !ok {
+		return
+	}
+
+	exp := tracing.NewExporter(cfg.endpoint, cfg.serviceName, cfg.headers, cfg.sampleRatio,
+		log.Logger{Name: "tracing", Debug: log.DefaultLogger.Debug})
+	tracing.SetExporter(exp)
+	hooks.AddHook(hooks.EventShutdown, func() {
+		tracing.SetExporter(nil)
+		exp.Close()
+	})
+}
+
+// initBufferDebug enables buffer leak detection if debug_buffers is set.
+// Buffers that are still in use are reported on shutdown after all modules
+// are closed.
+func initBufferDebug(globals map[string]interface{}) {
+	if enable, _ := globals["debug_buffers"].(bool); !enable {
+		return
+	}
+
+	buffer.EnableLeakDetection(log.Logger{Name: "buffer/leaks"})
+	hooks.AddHook(hooks.EventShutdown, func() {
+		buffer.ReportLeaks()
+	})
+}
+
+type dnsCacheConfig struct {
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+
+	redisAddr     string
+	redisPassword string
+	redisDB       int
+	redisPrefix   string
+}
+
+func dnsCacheDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	cfg := dnsCacheConfig{}
+
+	m := config.NewMap(nil, node)
+	m.Duration("min_ttl", false, false, time.Minute, &cfg.minTTL)
+	m.Duration("max_ttl", false, false, time.Hour, &cfg.maxTTL)
+	m.Duration("negative_ttl", false, false, 5*time.Minute, &cfg.negativeTTL)
+	m.Int("max_entries", false, false, 10000, &cfg.maxEntries)
+	m.String("redis", false, false, "", &cfg.redisAddr)
+	m.String("redis_password", false, false, "", &cfg.redisPassword)
+	m.Int("redis_db", false, false, 0, &cfg.redisDB)
+	m.String("redis_prefix", false, false, "maddy:dns:", &cfg.redisPrefix)
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+
+	if cfg.minTTL > cfg.maxTTL {
+		return nil, config.NodeErr(node, "min_ttl should not be bigger than max_ttl")
+	}
+
+	return cfg, nil
+}
+
+// initDNSTimeout applies the dns_timeout directive to the default resolver.
+// It should be called before modules are created.
+func initDNSTimeout(globals map[string]interface{}) {
+	timeout, ok := globals["dns_timeout"].(time.Duration)
+	if !ok {
+		return
+	}
+	dns.SetLookupTimeout(timeout)
+}
+
+// initDNSCache enables caching of TXT lookups if it was configured using
+// the dns_cache directive. It should be called before modules are created.
+func initDNSCache(globals map[string]interface{}) {
+	cfg, ok := globals["dns_cache"].(dnsCacheConfig)
+	if !ok {
+		return
+	}
+
+	cache := dns.NewCache(dns.DefaultResolver())
+	cache.MinTTL = cfg.minTTL
+	cache.MaxTTL = cfg.maxTTL
+	cache.NegativeTTL = cfg.negativeTTL
+	cache.MaxEntries = cfg.maxEntries
+
+	ext, err := dns.NewExtResolver()
+	if err != nil {
+		log.Println("dns_cache: unable to read resolver configuration, TTLs will not be respected:", err)
+	} else {
+		cache.Ext = ext
+	}
+
+	if cfg.redisAddr != "" {
+		redis := &dns.RedisCache{
+			Addr:     cfg.redisAddr,
+			Password: cfg.redisPassword,
+			DB:       cfg.redisDB,
+			Prefix:   cfg.redisPrefix,
+		}
+		cache.Shared = redis
+		hooks.AddHook(hooks.EventShutdown, func() {
+			redis.Close()
+		})
+	}
+
+	dns.SetDefaultCache(cache)
+}
+
+func sandboxDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	cfg := sandbox.Config{}
+
+	m := config.NewMap(nil, node)
+	m.String("user", false, false, "", &cfg.User)
+	m.String("group", false, false, "", &cfg.Group)
+	m.String("chroot", false, false, "", &cfg.Chroot)
+	m.Bool("no_exec", false, false, &cfg.NoExec)
+	m.Bool("landlock", false, false, &cfg.Landlock)
+	m.StringList("landlock_read", false, false, []string{"/etc", "/usr/share"}, &cfg.LandlockRead)
+	m.StringList("landlock_write", false, false, nil, &cfg.LandlockWrite)
+	m.StringList("landlock_exec", false, false, nil, &cfg.LandlockExec)
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Group != "" && cfg.User == "" {
+		return nil, config.NodeErr(node, "group can not be used without user")
+	}
+	if cfg.Chroot != "" && !filepath.IsAbs(cfg.Chroot) {
+		return nil, config.NodeErr(node, "chroot path should be absolute")
+	}
+	for _, list := range [][]string{cfg.LandlockRead, cfg.LandlockWrite, cfg.LandlockExec} {
+		for _, path := range list {
+			if !filepath.IsAbs(path) {
+				return nil, config.NodeErr(node, "landlock paths should be absolute: %s", path)
+			}
+		}
+	}
+	if err := sandbox.Validate(cfg); err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+
+	return cfg, nil
+}
+
+// initSandbox drops privileges and confines the process if it was configured
+// using the sandbox directive. It should be called after all modules are
+// initialized.
+func initSandbox(globals map[string]interface{}, start time.Time) error {
+	cfg, ok := globals["sandbox"].(sandbox.Config)
+	if !ok {
+		return nil
+	}
+
+	// Directories are known only after all global directives are processed.
+	if cfg.LandlockWrite == nil {
+		cfg.LandlockWrite = []string{config.StateDirectory, config.RuntimeDirectory, os.TempDir(), "/dev/null"}
+	}
+	if cfg.LandlockExec == nil {
+		cfg.LandlockExec = []string{config.LibexecDirectory, "/bin", "/sbin", "/usr", "/lib", "/lib64"}
+	}
+	cfg.OwnedDirs = []string{config.StateDirectory, config.RuntimeDirectory}
+
+	return sandbox.Apply(cfg, start, log.Logger{Name: "sandbox", Debug: log.DefaultLogger.Debug})
 }
@@ -0,0 +1,82 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address_test
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var addressSeeds = []string{
+	"test@example.org",
+	"postmaster",
+	`"test\" @ test"@example.org`,
+	"тест@пример.рф",
+	"test@xn--e1afmkfd.xn--p1ai",
+	"test@[127.0.0.1]",
+	"@example.org",
+	"test@",
+	"a@b@c",
+	"ǅ@example.org",
+	"test+tag@EXAMPLE.ORG.",
+}
+
+func FuzzAddress(f *testing.F) {
+	testutils.AddSeeds(f, addressSeeds...)
+
+	f.Fuzz(func(t *testing.T, addr string) {
+		address.Split(addr)       //nolint:errcheck
+		address.ForLookup(addr)   //nolint:errcheck
+		address.CleanDomain(addr) //nolint:errcheck
+		address.PRECISFold(addr)  //nolint:errcheck
+		address.ToASCII(addr)     //nolint:errcheck
+		address.ToUnicode(addr)   //nolint:errcheck
+		address.Valid(addr)
+		address.FQDNDomain(addr)
+		address.VERPDecode(addr, "=")
+
+		mbox, _, err := address.Split(addr)
+		if err == nil {
+			address.UnquoteMbox(mbox) //nolint:errcheck
+			address.ValidMailboxName(mbox)
+		}
+	})
+}
+
+func FuzzQuoteMbox(f *testing.F) {
+	testutils.AddSeeds(f, "test", `test" @ test`, `\`, "тест", "a b")
+
+	f.Fuzz(func(t *testing.T, mbox string) {
+		if mbox == "" || !utf8.ValidString(mbox) {
+			t.Skip()
+		}
+
+		quoted := address.QuoteMbox(mbox)
+		unquoted, err := address.UnquoteMbox(quoted)
+		if err != nil {
+			t.Fatalf("UnquoteMbox(%q): %v", quoted, err)
+		}
+		if unquoted != mbox {
+			t.Fatalf("round-trip mismatch: %q -> %q -> %q", mbox, quoted, unquoted)
+		}
+	})
+}
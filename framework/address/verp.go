@@ -0,0 +1,85 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"strings"
+)
+
+// VERPEncode encodes the recipient address into the sender address using
+// Variable Envelope Return Path (VERP) conventions, so the address of the
+// failed recipient can be extracted from the return path of the bounce
+// message.
+//
+// The recipient is appended to the sender mailbox after the delimiter with
+// '@' replaced by '=', e.g. list@example.org and user@example.com with
+// delimiter '+' become list+user=example.com@example.org.
+//
+// Null and domain-less sender addresses are returned unchanged.
+func VERPEncode(sender, rcpt, delim string) (string, error) {
+	if sender == "" {
+		return "", nil
+	}
+
+	senderMbox, senderDomain, err := Split(sender)
+	if err != nil {
+		return sender, err
+	}
+	if senderDomain == "" {
+		return sender, nil
+	}
+
+	rcptMbox, rcptDomain, err := Split(rcpt)
+	if err != nil {
+		return sender, err
+	}
+	if rcptDomain == "" {
+		return sender, nil
+	}
+
+	return senderMbox + delim + rcptMbox + "=" + rcptDomain + "@" + senderDomain, nil
+}
+
+// VERPDecode reverses VERPEncode, returning the original sender and recipient
+// addresses.
+//
+// ok is false if the address does not look like VERP-encoded one. Since the
+// recipient mailbox may contain the delimiter, the first delimiter occurrence
+// is used to split the address. That is, the sender mailbox should not contain
+// the delimiter for the decoding to work correctly.
+func VERPDecode(addr, delim string) (sender, rcpt string, ok bool) {
+	mbox, domain, err := Split(addr)
+	if err != nil || domain == "" || delim == "" {
+		return "", "", false
+	}
+
+	delimIndx := strings.Index(mbox, delim)
+	if delimIndx == -1 {
+		return "", "", false
+	}
+	encoded := mbox[delimIndx+len(delim):]
+
+	// Domain names can't contain '=' so the last one is the separator.
+	eqIndx := strings.LastIndexByte(encoded, '=')
+	if eqIndx <= 0 || eqIndx == len(encoded)-1 {
+		return "", "", false
+	}
+
+	return mbox[:delimIndx] + "@" + domain, encoded[:eqIndx] + "@" + encoded[eqIndx+1:], true
+}
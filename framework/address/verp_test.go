@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"testing"
+)
+
+func TestVERP(t *testing.T) {
+	cases := []struct {
+		sender, rcpt string
+		encoded      string
+	}{
+		{"list@example.org", "user@example.com", "list+user=example.com@example.org"},
+		{"list@example.org", "user+tag@example.com", "list+user+tag=example.com@example.org"},
+		{"list@example.org", "us=er@example.com", "list+us=er=example.com@example.org"},
+	}
+	for _, c := range cases {
+		encoded, err := VERPEncode(c.sender, c.rcpt, "+")
+		if err != nil {
+			t.Errorf("unexpected error for %s, %s: %v", c.sender, c.rcpt, err)
+			continue
+		}
+		if encoded != c.encoded {
+			t.Errorf("wrong encoding for %s, %s: want %s, got %s", c.sender, c.rcpt, c.encoded, encoded)
+		}
+
+		sender, rcpt, ok := VERPDecode(encoded, "+")
+		if !ok {
+			t.Errorf("failed to decode %s", encoded)
+			continue
+		}
+		if sender != c.sender || rcpt != c.rcpt {
+			t.Errorf("wrong decoding for %s: want %s, %s; got %s, %s", encoded, c.sender, c.rcpt, sender, rcpt)
+		}
+	}
+}
+
+func TestVERPEncode_NullSender(t *testing.T) {
+	encoded, err := VERPEncode("", "user@example.com", "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != "" {
+		t.Errorf("null sender should not be changed, got %s", encoded)
+	}
+}
+
+func TestVERPDecode_NotEncoded(t *testing.T) {
+	for _, addr := range []string{
+		"list@example.org",
+		"list+tag@example.org",
+		"list+user=@example.org",
+		"list+=example.com@example.org",
+		"postmaster",
+	} {
+		if _, _, ok := VERPDecode(addr, "+"); ok {
+			t.Errorf("%s should not be decoded", addr)
+		}
+	}
+}
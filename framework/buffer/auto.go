@@ -0,0 +1,44 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"bytes"
+	"io"
+)
+
+// BufferAuto buffers the contents of the passed io.Reader in memory if it is
+// not larger than maxMemory bytes. Otherwise the contents are spilled into
+// the file created in the specified directory as done by BufferInFile.
+//
+// Memory is allocated as the data is read, so small blobs do not occupy
+// maxMemory bytes each and at most maxMemory bytes are kept in memory for
+// large ones.
+func BufferAuto(r io.Reader, maxMemory int, dir string) (Buffer, error) {
+	var initial bytes.Buffer
+	n, err := io.CopyN(&initial, r, int64(maxMemory)+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= int64(maxMemory) {
+		return Track(MemoryBuffer{Slice: initial.Bytes()}), nil
+	}
+
+	return BufferInFile(io.MultiReader(&initial, r), dir)
+}
@@ -0,0 +1,79 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestBufferAuto(t *testing.T) {
+	test := func(size, maxMemory int, inMemory bool) {
+		t.Helper()
+
+		dir := t.TempDir()
+		blob := bytes.Repeat([]byte{'A'}, size)
+
+		buf, err := BufferAuto(bytes.NewReader(blob), maxMemory, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer buf.Remove()
+
+		_, isMemory := buf.(MemoryBuffer)
+		if isMemory != inMemory {
+			t.Errorf("size %d, max %d: expected inMemory=%v, got %T", size, maxMemory, inMemory, buf)
+		}
+		if buf.Len() != size {
+			t.Errorf("size %d, max %d: wrong Len: %d", size, maxMemory, buf.Len())
+		}
+
+		r, err := buf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		read, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, blob) {
+			t.Errorf("size %d, max %d: contents mismatch", size, maxMemory)
+		}
+
+		if err := buf.Remove(); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("size %d, max %d: files left after Remove: %v", size, maxMemory, entries)
+		}
+	}
+
+	test(0, 1024, true)
+	test(100, 1024, true)
+	test(1024, 1024, true)
+	test(1025, 1024, false)
+	test(64*1024, 1024, false)
+}
@@ -74,12 +74,16 @@ func BufferInFile(r io.Reader, dir string) (Buffer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("buffer: failed to create file: %v", err)
 	}
-	if _, err = io.Copy(f, r); err != nil {
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
 		return nil, fmt.Errorf("buffer: failed to write file: %v", err)
 	}
 	if err := f.Close(); err != nil {
+		os.Remove(path)
 		return nil, fmt.Errorf("buffer: failed to close file: %v", err)
 	}
 
-	return FileBuffer{Path: path}, nil
+	return Track(FileBuffer{Path: path, LenHint: int(n)}), nil
 }
@@ -0,0 +1,271 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Leak detection is an opt-in debugging aid. If it is enabled, buffers
+// created by the functions in this package (and ones wrapped using Track)
+// record the stack trace of their creation and of each Open call. The
+// following problems are then logged and counted:
+//
+//   - The buffer was garbage collected without Remove being called.
+//   - The reader was garbage collected without being closed.
+//   - Remove was called while some readers were still open.
+//   - Remove was called twice.
+//
+// Leaks of objects that are never garbage collected are reported by
+// ReportLeaks, which is called on shutdown.
+
+var (
+	leakDetection atomic.Bool
+	leakLog       = log.Logger{Name: "buffer/leaks"}
+
+	liveLock    sync.Mutex
+	liveBuffers = map[uint64]*bufferInfo{}
+	lastID      atomic.Uint64
+
+	openBuffers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "buffer",
+			Name:      "open",
+			Help:      "Amount of tracked buffers that were not removed yet",
+		},
+	)
+	openReaders = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "buffer",
+			Name:      "open_readers",
+			Help:      "Amount of tracked buffer readers that were not closed yet",
+		},
+	)
+	leaks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "buffer",
+			Name:      "leaks",
+			Help:      "Amount of buffer lifetime violations detected",
+		},
+		[]string{"kind"},
+	)
+)
+
+// EnableLeakDetection enables tracking of buffers created after the call.
+// Detected problems are written to the passed logger.
+func EnableLeakDetection(l log.Logger) {
+	leakLog = l
+	leakDetection.Store(true)
+}
+
+type bufferInfo struct {
+	id      uint64
+	stack   string
+	removed bool
+	readers map[uint64]string
+}
+
+type trackedBuffer struct {
+	Buffer
+	info *bufferInfo
+}
+
+type trackedReader struct {
+	io.ReadCloser
+	id     uint64
+	info   *bufferInfo
+	closed atomic.Bool
+}
+
+func callerStack() string {
+	buf := make([]byte, 4096)
+	n := runtime.Stack(buf, false)
+	return string(buf[:n])
+}
+
+// Track wraps the Buffer to record its lifetime if leak detection is enabled.
+// Otherwise it returns the Buffer unchanged.
+func Track(b Buffer) Buffer {
+	if !leakDetection.Load() {
+		return b
+	}
+	if _, ok := b.(*trackedBuffer); ok {
+		return b
+	}
+
+	info := &bufferInfo{
+		id:      lastID.Add(1),
+		stack:   callerStack(),
+		readers: map[uint64]string{},
+	}
+	liveLock.Lock()
+	liveBuffers[info.id] = info
+	liveLock.Unlock()
+	openBuffers.Inc()
+
+	tb := &trackedBuffer{Buffer: b, info: info}
+	runtime.SetFinalizer(tb, (*trackedBuffer).finalize)
+	return tb
+}
+
+func (tb *trackedBuffer) Open() (io.ReadCloser, error) {
+	r, err := tb.Buffer.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &trackedReader{
+		ReadCloser: r,
+		id:         lastID.Add(1),
+		info:       tb.info,
+	}
+	liveLock.Lock()
+	tb.info.readers[tr.id] = callerStack()
+	liveLock.Unlock()
+	openReaders.Inc()
+
+	runtime.SetFinalizer(tr, (*trackedReader).finalize)
+	return tr, nil
+}
+
+func (tb *trackedBuffer) Remove() error {
+	liveLock.Lock()
+	removed := tb.info.removed
+	tb.info.removed = true
+	readers := make([]string, 0, len(tb.info.readers))
+	for _, stack := range tb.info.readers {
+		readers = append(readers, stack)
+	}
+	if !removed {
+		delete(liveBuffers, tb.info.id)
+	}
+	liveLock.Unlock()
+
+	if removed {
+		leaks.WithLabelValues("double_remove").Inc()
+		leakLog.Msg("buffer removed twice", "buffer_id", tb.info.id, "created_at", tb.info.stack, "removed_at", callerStack())
+	} else {
+		openBuffers.Dec()
+	}
+	for _, stack := range readers {
+		leaks.WithLabelValues("removed_with_readers").Inc()
+		leakLog.Msg("buffer removed with open reader", "buffer_id", tb.info.id, "created_at", tb.info.stack, "opened_at", stack)
+	}
+
+	return tb.Buffer.Remove()
+}
+
+func (tb *trackedBuffer) finalize() {
+	liveLock.Lock()
+	removed := tb.info.removed
+	tb.info.removed = true
+	delete(liveBuffers, tb.info.id)
+	liveLock.Unlock()
+
+	if !removed {
+		openBuffers.Dec()
+		leaks.WithLabelValues("not_removed").Inc()
+		leakLog.Msg("buffer was never removed", "buffer_id", tb.info.id, "created_at", tb.info.stack)
+	}
+}
+
+func (tr *trackedReader) release() (string, bool) {
+	if tr.closed.Swap(true) {
+		return "", false
+	}
+
+	liveLock.Lock()
+	stack := tr.info.readers[tr.id]
+	delete(tr.info.readers, tr.id)
+	liveLock.Unlock()
+	openReaders.Dec()
+	return stack, true
+}
+
+func (tr *trackedReader) Close() error {
+	tr.release()
+	return tr.ReadCloser.Close()
+}
+
+func (tr *trackedReader) finalize() {
+	stack, ok := tr.release()
+	if !ok {
+		return
+	}
+	leaks.WithLabelValues("reader_not_closed").Inc()
+	leakLog.Msg("buffer reader was never closed", "buffer_id", tr.info.id, "created_at", tr.info.stack, "opened_at", stack)
+	tr.ReadCloser.Close()
+}
+
+// ReportLeaks logs all tracked buffers that are still not removed and
+// readers that are still not closed. It returns the amount of such buffers.
+//
+// It is a no-op if leak detection is not enabled.
+func ReportLeaks() int {
+	if !leakDetection.Load() {
+		return 0
+	}
+
+	liveLock.Lock()
+	infos := make([]*bufferInfo, 0, len(liveBuffers))
+	for _, info := range liveBuffers {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].id < infos[j].id
+	})
+	type entry struct {
+		id      uint64
+		stack   string
+		readers []string
+	}
+	entries := make([]entry, 0, len(infos))
+	for _, info := range infos {
+		e := entry{id: info.id, stack: info.stack}
+		for _, stack := range info.readers {
+			e.readers = append(e.readers, stack)
+		}
+		entries = append(entries, e)
+	}
+	liveLock.Unlock()
+
+	for _, e := range entries {
+		leakLog.Msg("buffer is still not removed", "buffer_id", e.id, "created_at", e.stack, "open_readers", len(e.readers))
+		for _, stack := range e.readers {
+			leakLog.Msg("buffer reader is still not closed", "buffer_id", e.id, "opened_at", stack)
+		}
+	}
+	return len(entries)
+}
+
+func init() {
+	prometheus.MustRegister(openBuffers)
+	prometheus.MustRegister(openReaders)
+	prometheus.MustRegister(leaks)
+}
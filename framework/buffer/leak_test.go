@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+type recordOut struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (r *recordOut) Write(_ time.Time, _ bool, msg string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lines = append(r.lines, msg)
+}
+
+func (r *recordOut) Close() error {
+	return nil
+}
+
+func (r *recordOut) count(substr string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cnt := 0
+	for _, l := range r.lines {
+		if strings.Contains(l, substr) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func TestLeakDetection(t *testing.T) {
+	out := &recordOut{}
+	EnableLeakDetection(log.Logger{Out: out, Name: "buffer/leaks"})
+	defer leakDetection.Store(false)
+
+	buf, err := BufferInMemory(strings.NewReader("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := buf.(*trackedBuffer); !ok {
+		t.Fatalf("buffer is not tracked: %T", buf)
+	}
+
+	r, err := buf.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob, err := io.ReadAll(r); err != nil || string(blob) != "foobar" {
+		t.Fatalf("wrong contents: %q, %v", blob, err)
+	}
+
+	if n := ReportLeaks(); n != 1 {
+		t.Errorf("expected 1 live buffer, got %d", n)
+	}
+	if out.count("buffer reader is still not closed") != 1 {
+		t.Errorf("open reader is not reported: %v", out.lines)
+	}
+
+	if err := buf.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if out.count("buffer removed with open reader") != 1 {
+		t.Errorf("remove with open reader is not reported: %v", out.lines)
+	}
+	r.Close()
+
+	if err := buf.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if out.count("buffer removed twice") != 1 {
+		t.Errorf("double remove is not reported: %v", out.lines)
+	}
+
+	if n := ReportLeaks(); n != 0 {
+		t.Errorf("expected no live buffers, got %d", n)
+	}
+}
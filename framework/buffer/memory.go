@@ -46,5 +46,5 @@ func BufferInMemory(r io.Reader) (Buffer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return MemoryBuffer{Slice: blob}, nil
+	return Track(MemoryBuffer{Slice: blob}), nil
 }
@@ -34,10 +34,10 @@ func expandEnvironment(nodes []Node) []Node {
 	replacer := buildEnvReplacer()
 	newNodes := make([]Node, 0, len(nodes))
 	for _, node := range nodes {
-		node.Name = removeUnexpandedEnvvars(replacer.Replace(node.Name))
+		node.Name = expandShellEnvvars(removeUnexpandedEnvvars(replacer.Replace(node.Name)))
 		newArgs := make([]string, 0, len(node.Args))
 		for _, arg := range node.Args {
-			newArgs = append(newArgs, removeUnexpandedEnvvars(replacer.Replace(arg)))
+			newArgs = append(newArgs, expandShellEnvvars(removeUnexpandedEnvvars(replacer.Replace(arg))))
 		}
 		node.Args = newArgs
 		node.Children = expandEnvironment(node.Children)
@@ -46,6 +46,13 @@ func expandEnvironment(nodes []Node) []Node {
 	return newNodes
 }
 
+// expandEnvString expands environment variables in a single string. It is
+// used for values that are needed before the tree is fully read, such as
+// include patterns.
+func expandEnvString(s string) string {
+	return expandShellEnvvars(removeUnexpandedEnvvars(buildEnvReplacer().Replace(s)))
+}
+
 var unixEnvvarRe = regexp.MustCompile(`{env:([^\$]+)}`)
 
 func removeUnexpandedEnvvars(s string) string {
@@ -53,6 +60,30 @@ func removeUnexpandedEnvvars(s string) string {
 	return s
 }
 
+var shellEnvvarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandShellEnvvars expands ${VAR} and ${VAR:-default} placeholders. Default
+// value is used if the variable is not set or empty.
+//
+// ${VAR} is left as-is if VAR is not set so the same syntax can be used for
+// other purposes, e.g. capture group references in table.regexp.
+func expandShellEnvvars(s string) string {
+	return shellEnvvarRe.ReplaceAllStringFunc(s, func(match string) string {
+		parts := shellEnvvarRe.FindStringSubmatch(match)
+		val, ok := os.LookupEnv(parts[1])
+		if val != "" {
+			return val
+		}
+		if parts[2] != "" {
+			return parts[3]
+		}
+		if !ok {
+			return match
+		}
+		return ""
+	})
+}
+
 func buildEnvReplacer() *strings.Replacer {
 	env := os.Environ()
 	pairs := make([]string, 0, len(env)*4)
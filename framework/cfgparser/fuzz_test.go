@@ -0,0 +1,54 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package parser_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func FuzzRead(f *testing.F) {
+	testutils.AddSeedFiles(f, "../../maddy.conf")
+	testutils.AddSeeds(f,
+		`a`,
+		`a a1 "a 2" { b; c { d } }`,
+		`$(macro) = a b c
+		a $(macro)`,
+		`a {env:HOME} "\"escaped\""`,
+		`a { b { c { d { e } } } }`,
+		`a "unterminated`,
+		`a { b`,
+		`}`,
+	)
+
+	f.Fuzz(func(t *testing.T, cfg string) {
+		// Imports read arbitrary files from the disk.
+		if strings.Contains(cfg, "import") {
+			t.Skip()
+		}
+
+		testutils.NoHang(t, 5*time.Second, func() {
+			parser.Read(strings.NewReader(cfg), "fuzz") //nolint:errcheck
+		})
+	})
+}
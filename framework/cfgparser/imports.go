@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -40,7 +41,7 @@ func (ctx *parseContext) expandImports(node Node, expansionDepth int) (Node, err
 			return node, err
 		}
 
-		if child.Name == "import" {
+		if child.Name == "import" || child.Name == "include" {
 			// We check it here instead of function start so we can
 			// use line information from import directive that is likely
 			// caused this error.
@@ -49,11 +50,19 @@ func (ctx *parseContext) expandImports(node Node, expansionDepth int) (Node, err
 			}
 
 			containsImports = true
-			if len(child.Args) != 1 {
-				return node, ctx.Err("import directive requires exactly 1 argument")
+			if len(child.Args) == 0 {
+				return node, NodeErr(child, "%s directive requires at least 1 argument", child.Name)
 			}
 
-			subtree, err := ctx.resolveImport(child, child.Args[0], expansionDepth)
+			var subtree []Node
+			if child.Name == "include" {
+				subtree, err = ctx.resolveInclude(child, expansionDepth)
+			} else {
+				subtree, err = ctx.resolveImport(child, child.Args[0], expansionDepth)
+				if err == nil {
+					subtree, err = substituteArgs(child, subtree, child.Args[1:])
+				}
+			}
 			if err != nil {
 				return node, err
 			}
@@ -79,24 +88,64 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 		return subtree, nil
 	}
 
-	file := name
-	if !filepath.IsAbs(name) {
-		file = filepath.Join(filepath.Dir(ctx.fileLocation), name)
+	file := ctx.relativePath(name)
+	if _, err := os.Stat(file); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		file += ".conf"
+		if _, err := os.Stat(file); err != nil {
+			if os.IsNotExist(err) {
+				return nil, NodeErr(node, "unknown import: "+name)
+			}
+			return nil, err
+		}
 	}
-	src, err := os.Open(file)
-	if err != nil {
-		if os.IsNotExist(err) {
-			src, err = os.Open(file + ".conf")
+	return ctx.readFile(file, expansionDepth)
+}
+
+// resolveInclude reads all files matching glob patterns specified as include
+// directive arguments. Files matching the same pattern are read in lexical
+// order. Patterns without wildcards should match an existing file.
+func (ctx *parseContext) resolveInclude(node Node, expansionDepth int) ([]Node, error) {
+	var res []Node
+	for _, pattern := range node.Args {
+		pattern = expandEnvString(pattern)
+		files, err := filepath.Glob(ctx.relativePath(pattern))
+		if err != nil {
+			return nil, NodeErr(node, "malformed include pattern %s: %v", pattern, err)
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, NodeErr(node, "unknown include: %s", pattern)
+		}
+
+		for _, file := range files {
+			nodes, err := ctx.readFile(file, expansionDepth)
 			if err != nil {
-				if os.IsNotExist(err) {
-					return nil, NodeErr(node, "unknown import: "+name)
-				}
 				return nil, err
 			}
-		} else {
-			return nil, err
+			res = append(res, nodes...)
 		}
 	}
+	return res, nil
+}
+
+func (ctx *parseContext) relativePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(ctx.fileLocation), name)
+}
+
+// readFile parses the configuration file and makes snippets and macros
+// declared in it available to the current file.
+func (ctx *parseContext) readFile(file string, expansionDepth int) ([]Node, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
 	nodes, snips, macros, err := readTree(src, file, expansionDepth+1)
 	if err != nil {
 		return nodes, err
@@ -111,6 +160,48 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 	return nodes, nil
 }
 
+var argRe = regexp.MustCompile(`{arg:([0-9]+)}`)
+
+// substituteArgs returns the copy of imported nodes with {arg:N} placeholders
+// replaced by the corresponding import directive arguments (1-based).
+func substituteArgs(imp Node, nodes []Node, args []string) ([]Node, error) {
+	if nodes == nil {
+		return nil, nil
+	}
+
+	var err error
+	replace := func(s string) string {
+		return argRe.ReplaceAllStringFunc(s, func(match string) string {
+			idx, _ := strconv.Atoi(argRe.FindStringSubmatch(match)[1])
+			if idx < 1 || idx > len(args) {
+				err = NodeErr(imp, "import argument %d is not specified", idx)
+				return match
+			}
+			return args[idx-1]
+		})
+	}
+
+	res := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		node.Name = replace(node.Name)
+		newArgs := make([]string, 0, len(node.Args))
+		for _, arg := range node.Args {
+			newArgs = append(newArgs, replace(arg))
+		}
+		node.Args = newArgs
+		if err != nil {
+			return nil, err
+		}
+
+		node.Children, err = substituteArgs(imp, node.Children, args)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, node)
+	}
+	return res, nil
+}
+
 func (ctx *parseContext) expandMacros(node *Node) error {
 	if strings.HasPrefix(node.Name, "$(") && strings.HasSuffix(node.Name, ")") {
 		return ctx.Err("can't use macro argument as directive name")
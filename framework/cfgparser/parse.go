@@ -386,5 +386,8 @@ func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, s
 func Read(r io.Reader, location string) (nodes []Node, err error) {
 	nodes, _, _, err = readTree(r, location, 0)
 	nodes = expandEnvironment(nodes)
-	return
+	if err != nil {
+		return
+	}
+	return expandSecrets(nodes)
 }
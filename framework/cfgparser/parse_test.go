@@ -20,6 +20,7 @@ package parser
 
 import (
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -569,6 +570,74 @@ var cases = []struct {
 		},
 		false,
 	},
+	{
+		"shell-like environment variable expansion",
+		`a ${TESTING_VARIABLE} ${TESTING_VARIABLE3:-default} ${TESTING_VARIABLE4}`,
+		[]Node{
+			{
+				Name:     "a",
+				Args:     []string{"ABCDEF", "default", ""},
+				Children: nil,
+				File:     "test",
+				Line:     1,
+			},
+		},
+		false,
+	},
+	{
+		"shell-like syntax with unset variable",
+		`a ${TESTING_VARIABLE3} x${TESTING_VARIABLE3}x`,
+		[]Node{
+			{
+				Name:     "a",
+				Args:     []string{"${TESTING_VARIABLE3}", "x${TESTING_VARIABLE3}x"},
+				Children: nil,
+				File:     "test",
+				Line:     1,
+			},
+		},
+		false,
+	},
+	{
+		"table.regexp replacement",
+		`table.regexp "(?P<user>.+)@example.org" "${user}@example.com"`,
+		[]Node{
+			{
+				Name:     "table.regexp",
+				Args:     []string{"(?P<user>.+)@example.org", "${user}@example.com"},
+				Children: nil,
+				File:     "test",
+				Line:     1,
+			},
+		},
+		false,
+	},
+	{
+		"snippet arguments",
+		`(bar) {
+				dir {arg:1} x{arg:2}x
+			}
+			import bar a b`,
+		[]Node{
+			{
+				Name:     "dir",
+				Args:     []string{"a", "xbx"},
+				Children: nil,
+				File:     "test",
+				Line:     2,
+			},
+		},
+		false,
+	},
+	{
+		"snippet arguments, missing argument",
+		`(bar) {
+				dir {arg:2}
+			}
+			import bar a`,
+		nil,
+		true,
+	},
 }
 
 func printTree(t *testing.T, root Node, indent int) {
@@ -581,6 +650,7 @@ func printTree(t *testing.T, root Node, indent int) {
 func TestRead(t *testing.T) {
 	os.Setenv("TESTING_VARIABLE", "ABCDEF")
 	os.Setenv("TESTING_VARIABLE2", "ABC2 DEF2")
+	os.Setenv("TESTING_VARIABLE4", "")
 
 	for _, case_ := range cases {
 		case_ := case_
@@ -621,3 +691,36 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestRead_Include(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"conf.d/b.conf": "b\n",
+		"conf.d/a.conf": "a\n(snip) {\n\tc {arg:1}\n}\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := Read(strings.NewReader("include conf.d/*.conf nonexistent/*.conf\nimport snip x"), filepath.Join(dir, "maddy.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, node := range tree {
+		names = append(names, node.Name+strings.Join(node.Args, ""))
+	}
+	if strings.Join(names, " ") != "a b cx" {
+		t.Fatalf("wrong result: %v", names)
+	}
+
+	_, err = Read(strings.NewReader(`include missing.conf`), filepath.Join(dir, "maddy.conf"))
+	if err == nil {
+		t.Fatal("expected failure for missing file without wildcards")
+	}
+}
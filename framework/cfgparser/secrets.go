@@ -0,0 +1,54 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package parser
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/secrets"
+)
+
+// expandSecrets replaces arguments that are secret references
+// (secret://...) with the referenced values.
+func expandSecrets(nodes []Node) ([]Node, error) {
+	return expandSecretsWith(&secrets.Resolver{}, nodes)
+}
+
+func expandSecretsWith(r *secrets.Resolver, nodes []Node) ([]Node, error) {
+	for i := range nodes {
+		node := &nodes[i]
+		for j, arg := range node.Args {
+			if !secrets.IsRef(arg) {
+				continue
+			}
+			val, err := r.Resolve(context.Background(), arg)
+			if err != nil {
+				return nil, NodeErr(*node, "%v", err)
+			}
+			node.Args[j] = val
+		}
+
+		var err error
+		node.Children, err = expandSecretsWith(r, node.Children)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
@@ -102,13 +102,7 @@ func (cfa FailAction) Apply(originalRes module.CheckResult) module.CheckResult {
 	}
 
 	if cfa.ReasonOverride != nil {
-		// Wrap instead of replace to preserve other fields.
-		originalRes.Reason = &exterrors.SMTPError{
-			Code:         cfa.ReasonOverride.Code,
-			EnhancedCode: cfa.ReasonOverride.EnhancedCode,
-			Message:      cfa.ReasonOverride.Message,
-			Err:          originalRes.Reason,
-		}
+		originalRes.Reason = OverrideReason(cfa.ReasonOverride, originalRes.Reason)
 	}
 
 	originalRes.Quarantine = cfa.Quarantine || originalRes.Quarantine
@@ -116,6 +110,26 @@ func (cfa FailAction) Apply(originalRes module.CheckResult) module.CheckResult {
 	return originalRes
 }
 
+// OverrideReason returns the error that uses the SMTP status from override
+// instead of the one of reason.
+//
+// reason is wrapped instead of replaced to preserve other fields. Check name
+// and additional fields of reason are copied so they are still reported.
+func OverrideReason(override *exterrors.SMTPError, reason error) error {
+	res := &exterrors.SMTPError{
+		Code:         override.Code,
+		EnhancedCode: override.EnhancedCode,
+		Message:      override.Message,
+		Err:          reason,
+	}
+	var smtpErr *exterrors.SMTPError
+	if errors.As(reason, &smtpErr) {
+		res.CheckName = smtpErr.CheckName
+		res.Misc = smtpErr.Misc
+	}
+	return res
+}
+
 func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 	code := 554
 	enchCode := exterrors.EnhancedCode{0, 7, 0}
@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CheckCertificate verifies that the certificate that would be served for
+// the hostname by the server using cfg is valid for it and will not expire
+// in the next minValidity.
+func CheckCertificate(cfg *tls.Config, hostname string, minValidity time.Duration) error {
+	hello := &tls.ClientHelloInfo{ServerName: hostname}
+
+	if cfg.GetConfigForClient != nil {
+		clientCfg, err := cfg.GetConfigForClient(hello)
+		if err != nil {
+			return err
+		}
+		if clientCfg != nil {
+			cfg = clientCfg
+		}
+	}
+
+	var cert *tls.Certificate
+	switch {
+	case cfg.GetCertificate != nil:
+		var err error
+		cert, err = cfg.GetCertificate(hello)
+		if err != nil {
+			return err
+		}
+	case len(cfg.Certificates) != 0:
+		cert = &cfg.Certificates[0]
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("no certificate available")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if err := leaf.VerifyHostname(hostname); err != nil {
+		return err
+	}
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		return fmt.Errorf("expired at %v", leaf.NotAfter)
+	case now.Before(leaf.NotBefore):
+		return fmt.Errorf("not valid until %v", leaf.NotBefore)
+	case now.Add(minValidity).After(leaf.NotAfter):
+		return fmt.Errorf("expires soon, at %v", leaf.NotAfter)
+	}
+	return nil
+}
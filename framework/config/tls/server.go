@@ -19,7 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package tls
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"sync"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -30,6 +33,38 @@ import (
 type TLSConfig struct {
 	loader  module.TLSLoader
 	baseCfg *tls.Config
+
+	// If non-zero, session ticket keys are rotated by TLSConfig instead of
+	// crypto/tls built-in rotation.
+	ticketRotation  time.Duration
+	ticketKeysLck   sync.Mutex
+	ticketKeys      [][32]byte
+	ticketRotatedAt time.Time
+}
+
+// sessionTicketKeys returns the current list of session ticket keys,
+// generating a new one if the rotation interval passed. The previous key is
+// kept to allow resumption of sessions established just before the
+// rotation.
+func (cfg *TLSConfig) sessionTicketKeys() ([][32]byte, error) {
+	cfg.ticketKeysLck.Lock()
+	defer cfg.ticketKeysLck.Unlock()
+
+	if len(cfg.ticketKeys) != 0 && time.Since(cfg.ticketRotatedAt) < cfg.ticketRotation {
+		return cfg.ticketKeys, nil
+	}
+
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	keys := [][32]byte{key}
+	if len(cfg.ticketKeys) != 0 {
+		keys = append(keys, cfg.ticketKeys[0])
+	}
+	cfg.ticketKeys = keys
+	cfg.ticketRotatedAt = time.Now()
+	return keys, nil
 }
 
 func (cfg *TLSConfig) Get() (*tls.Config, error) {
@@ -43,6 +78,14 @@ func (cfg *TLSConfig) Get() (*tls.Config, error) {
 		return nil, err
 	}
 
+	if cfg.ticketRotation != 0 && !tlsCfg.SessionTicketsDisabled {
+		keys, err := cfg.sessionTicketKeys()
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.SetSessionTicketKeys(keys)
+	}
+
 	return tlsCfg, nil
 }
 
@@ -84,7 +127,11 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 	}
 
 	childM := config.NewMap(globals, blockNode)
-	var tlsVersions [2]uint16
+	var (
+		tlsVersions    [2]uint16
+		sessionTickets bool
+		ticketRotation time.Duration
+	)
 
 	childM.Custom("loader", false, false, func() (interface{}, error) {
 		return loader, nil
@@ -106,10 +153,16 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 		return nil, nil
 	}, TLSCurvesDirective, &baseCfg.CurvePreferences)
 
+	childM.StringList("alpn", false, false, nil, &baseCfg.NextProtos)
+	childM.Bool("session_tickets", false, true, &sessionTickets)
+	childM.Duration("session_ticket_rotation", false, false, 0, &ticketRotation)
+
 	if _, err := childM.Process(); err != nil {
 		return nil, err
 	}
 
+	baseCfg.SessionTicketsDisabled = !sessionTickets
+
 	if len(baseCfg.CipherSuites) != 0 {
 		baseCfg.PreferServerCipherSuites = true
 	}
@@ -119,7 +172,8 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 	log.Debugf("tls: min version: %x, max version: %x", tlsVersions[0], tlsVersions[1])
 
 	return &TLSConfig{
-		loader:  loader,
-		baseCfg: &baseCfg,
+		loader:         loader,
+		baseCfg:        &baseCfg,
+		ticketRotation: ticketRotation,
 	}, nil
 }
@@ -0,0 +1,96 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+type dummyLoader struct{}
+
+func (dummyLoader) ConfigureTLS(*tls.Config) error { return nil }
+
+func TestReadTLSBlock(t *testing.T) {
+	cfg, err := readTLSBlock(nil, config.Node{
+		Name: "tls",
+		Children: []config.Node{
+			{Name: "protocols", Args: []string{"tls1.2", "tls1.3"}},
+			{Name: "alpn", Args: []string{"smtp", "imap"}},
+			{Name: "session_tickets", Args: []string{"no"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.baseCfg.MinVersion != tls.VersionTLS12 || cfg.baseCfg.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("wrong versions: %x %x", cfg.baseCfg.MinVersion, cfg.baseCfg.MaxVersion)
+	}
+	if !reflect.DeepEqual(cfg.baseCfg.NextProtos, []string{"smtp", "imap"}) {
+		t.Errorf("wrong ALPN protocols: %v", cfg.baseCfg.NextProtos)
+	}
+	if !cfg.baseCfg.SessionTicketsDisabled {
+		t.Error("session tickets should be disabled")
+	}
+}
+
+func TestTLSConfig_TicketRotation(t *testing.T) {
+	cfg := TLSConfig{
+		loader:         dummyLoader{},
+		baseCfg:        &tls.Config{},
+		ticketRotation: time.Hour,
+	}
+
+	keys, err := cfg.sessionTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys))
+	}
+
+	again, err := cfg.sessionTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, again) {
+		t.Fatal("keys rotated before the interval passed")
+	}
+
+	cfg.ticketRotatedAt = time.Now().Add(-2 * time.Hour)
+	rotated, err := cfg.sessionTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 keys after rotation, got %d", len(rotated))
+	}
+	if rotated[0] == keys[0] || rotated[1] != keys[0] {
+		t.Error("previous key should be kept after the new one")
+	}
+
+	if _, err := cfg.Get(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+var cacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "dns_cache",
+		Name:      "lookups",
+		Help:      "Amount of TXT lookups handled by the DNS cache",
+	},
+	[]string{"result"},
+)
+
+// SharedCache is a storage for cache entries shared between multiple
+// server instances.
+type SharedCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+type cacheEntry struct {
+	Records  []string  `json:"r,omitempty"`
+	NotFound bool      `json:"nf,omitempty"`
+	Expires  time.Time `json:"e"`
+}
+
+// Cache is a Resolver that caches results of TXT lookups done using the
+// underlying Resolver. These are used to fetch DKIM public keys, SPF and
+// DMARC policies and are repeated for most incoming messages.
+//
+// If Ext is set, it is used for lookups instead of Resolver to respect
+// record TTLs. Otherwise, all entries are cached for MaxTTL. Non-existent
+// records are cached for NegativeTTL, temporary errors are not cached.
+//
+// Other lookups are passed to Resolver as is.
+type Cache struct {
+	Resolver
+	Ext *ExtResolver
+
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+	MaxEntries  int
+
+	// Shared is an optional second-level cache.
+	Shared SharedCache
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+	group   singleflight.Group
+}
+
+// NewCache creates the Cache with default settings.
+func NewCache(r Resolver) *Cache {
+	return &Cache{
+		Resolver:    r,
+		MinTTL:      time.Minute,
+		MaxTTL:      time.Hour,
+		NegativeTTL: 5 * time.Minute,
+		MaxEntries:  10000,
+		entries:     map[string]cacheEntry{},
+	}
+}
+
+func (c *Cache) get(key string, now time.Time) (cacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if !now.Before(entry.Expires) {
+		delete(c.entries, key)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *Cache) put(key string, entry cacheEntry, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]cacheEntry{}
+	}
+	if c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.Expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full, drop a random entry.
+		for k := range c.entries {
+			if len(c.entries) < c.MaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *Cache) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL != 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl
+}
+
+func (c *Cache) fetchTXT(ctx context.Context, name string, now time.Time) (cacheEntry, error) {
+	if c.Ext != nil {
+		recs, ttl, err := c.Ext.lookupTXTTTL(ctx, name)
+		if err != nil {
+			if IsNotFound(err) {
+				return cacheEntry{NotFound: true, Expires: now.Add(c.NegativeTTL)}, nil
+			}
+			return cacheEntry{}, err
+		}
+		if len(recs) == 0 {
+			return cacheEntry{NotFound: true, Expires: now.Add(c.NegativeTTL)}, nil
+		}
+		return cacheEntry{Records: recs, Expires: now.Add(c.clampTTL(ttl))}, nil
+	}
+
+	recs, err := c.Resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if IsNotFound(err) {
+			return cacheEntry{NotFound: true, Expires: now.Add(c.NegativeTTL)}, nil
+		}
+		return cacheEntry{}, err
+	}
+	return cacheEntry{Records: recs, Expires: now.Add(c.clampTTL(c.MaxTTL))}, nil
+}
+
+func (c *Cache) lookupShared(ctx context.Context, key string, now time.Time) (cacheEntry, bool) {
+	if c.Shared == nil {
+		return cacheEntry{}, false
+	}
+
+	blob, ok, err := c.Shared.Get(ctx, key)
+	if err != nil {
+		cacheLookups.WithLabelValues("shared_error").Inc()
+		return cacheEntry{}, false
+	}
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(blob, &entry); err != nil || !now.Before(entry.Expires) {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *Cache) storeShared(ctx context.Context, key string, entry cacheEntry, now time.Time) {
+	if c.Shared == nil {
+		return
+	}
+
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := c.Shared.Set(ctx, key, blob, entry.Expires.Sub(now)); err != nil {
+		cacheLookups.WithLabelValues("shared_error").Inc()
+	}
+}
+
+func (c *Cache) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	key := strings.ToLower(dns.Fqdn(name))
+	now := time.Now()
+
+	entry, ok := c.get(key, now)
+	if ok {
+		cacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		// Concurrent lookups for the same name are common (e.g. a message
+		// to multiple recipients), do only one.
+		res, err, _ := c.group.Do(key, func() (interface{}, error) {
+			if entry, ok := c.lookupShared(ctx, key, now); ok {
+				cacheLookups.WithLabelValues("shared_hit").Inc()
+				c.put(key, entry, now)
+				return entry, nil
+			}
+
+			cacheLookups.WithLabelValues("miss").Inc()
+			entry, err := c.fetchTXT(ctx, name, now)
+			if err != nil {
+				return nil, err
+			}
+			c.put(key, entry, now)
+			c.storeShared(ctx, key, entry, now)
+			return entry, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		entry = res.(cacheEntry)
+	}
+
+	if entry.NotFound {
+		return nil, &net.DNSError{
+			Err:        "no such host",
+			Name:       name,
+			IsNotFound: true,
+		}
+	}
+
+	// Callers are allowed to modify the returned slice.
+	recs := make([]string, len(entry.Records))
+	copy(recs, entry.Records)
+	return recs, nil
+}
+
+var (
+	defaultCacheLock sync.RWMutex
+	defaultCache     *Cache
+)
+
+// SetDefaultCache makes DefaultResolver return the Cache. It should be
+// called before any modules are created.
+func SetDefaultCache(c *Cache) {
+	defaultCacheLock.Lock()
+	defer defaultCacheLock.Unlock()
+	defaultCache = c
+}
+
+func init() {
+	prometheus.MustRegister(cacheLookups)
+}
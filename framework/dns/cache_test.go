@@ -0,0 +1,189 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	Resolver
+	txt     map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *countingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	recs, ok := r.txt[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return recs, nil
+}
+
+type memSharedCache struct {
+	lock sync.Mutex
+	m    map[string][]byte
+}
+
+func (c *memSharedCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.m[key]
+	return v, ok, nil
+}
+
+func (c *memSharedCache) Set(_ context.Context, key string, value []byte, _ time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.m[key] = value
+	return nil
+}
+
+func TestCache_LookupTXT(t *testing.T) {
+	r := &countingResolver{txt: map[string][]string{
+		"_dmarc.example.org": {"v=DMARC1; p=none"},
+	}}
+	c := NewCache(r)
+
+	for i := 0; i < 3; i++ {
+		recs, err := c.LookupTXT(context.Background(), "_dmarc.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(recs, []string{"v=DMARC1; p=none"}) {
+			t.Fatalf("wrong records: %v", recs)
+		}
+	}
+	if r.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", r.lookups)
+	}
+
+	// Case and trailing dot do not matter.
+	if _, err := c.LookupTXT(context.Background(), "_DMARC.example.org."); err != nil {
+		t.Fatal(err)
+	}
+	if r.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", r.lookups)
+	}
+}
+
+func TestCache_Negative(t *testing.T) {
+	r := &countingResolver{txt: map[string][]string{}}
+	c := NewCache(r)
+
+	for i := 0; i < 2; i++ {
+		_, err := c.LookupTXT(context.Background(), "_dmarc.example.org")
+		if !IsNotFound(err) {
+			t.Fatalf("expected not found error, got %v", err)
+		}
+	}
+	if r.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", r.lookups)
+	}
+}
+
+func TestCache_TemporaryError(t *testing.T) {
+	r := &countingResolver{err: errors.New("timeout")}
+	c := NewCache(r)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupTXT(context.Background(), "_dmarc.example.org"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if r.lookups != 2 {
+		t.Errorf("temporary errors should not be cached, got %d lookups", r.lookups)
+	}
+}
+
+func TestCache_Expiry(t *testing.T) {
+	r := &countingResolver{txt: map[string][]string{
+		"example.org": {"v=spf1 -all"},
+	}}
+	c := NewCache(r)
+	c.MinTTL = 0
+	c.MaxTTL = time.Nanosecond
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupTXT(context.Background(), "example.org"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if r.lookups != 2 {
+		t.Errorf("expected 2 lookups, got %d", r.lookups)
+	}
+}
+
+func TestCache_Shared(t *testing.T) {
+	shared := &memSharedCache{m: map[string][]byte{}}
+
+	r1 := &countingResolver{txt: map[string][]string{
+		"example.org": {"v=spf1 -all"},
+	}}
+	c1 := NewCache(r1)
+	c1.Shared = shared
+	if _, err := c1.LookupTXT(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	r2 := &countingResolver{}
+	c2 := NewCache(r2)
+	c2.Shared = shared
+	recs, err := c2.LookupTXT(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(recs, []string{"v=spf1 -all"}) {
+		t.Fatalf("wrong records: %v", recs)
+	}
+	if r2.lookups != 0 {
+		t.Errorf("expected the entry to be fetched from the shared cache, got %d lookups", r2.lookups)
+	}
+}
+
+func TestCache_MaxEntries(t *testing.T) {
+	r := &countingResolver{txt: map[string][]string{
+		"a.example.org": {"a"},
+		"b.example.org": {"b"},
+		"c.example.org": {"c"},
+	}}
+	c := NewCache(r)
+	c.MaxEntries = 2
+
+	for _, name := range []string{"a.example.org", "b.example.org", "c.example.org"} {
+		if _, err := c.LookupTXT(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.entries) > 2 {
+		t.Errorf("cache contains %d entries, limit is 2", len(c.entries))
+	}
+}
@@ -203,6 +203,34 @@ func (e ExtResolver) AuthLookupTXT(ctx context.Context, name string) (ad bool, r
 	return
 }
 
+// lookupTXTTTL is similar to AuthLookupTXT but also returns the smallest TTL
+// of returned records.
+func (e ExtResolver) lookupTXTTTL(ctx context.Context, name string) (recs []string, ttl time.Duration, err error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	msg.SetEdns0(4096, false)
+
+	resp, err := e.exchange(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	recs = make([]string, 0, len(resp.Answer))
+	for i, rr := range resp.Answer {
+		if i == 0 || time.Duration(rr.Header().Ttl)*time.Second < ttl {
+			ttl = time.Duration(rr.Header().Ttl) * time.Second
+		}
+
+		txtRR, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		recs = append(recs, strings.Join(txtRR.Txt, ""))
+	}
+	return recs, ttl, nil
+}
+
 // CheckCNAMEAD is a special function for use in DANE lookups. It attempts to determine final
 // (canonical) name of the host and also reports whether the whole chain of CNAME's and final zone
 // are "secure".
@@ -52,6 +52,25 @@ func ForLookup(domain string) (string, error) {
 	return uDomain, nil
 }
 
+// WildcardMatches returns wildcard patterns (such as "*.example.org")
+// matching the domain, from the most specific to the least specific one.
+//
+// The domain is expected to be normalized using ForLookup.
+func WildcardMatches(domain string) []string {
+	var res []string
+	for {
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			return res
+		}
+		domain = domain[dot+1:]
+		if domain == "" {
+			return res
+		}
+		res = append(res, "*."+domain)
+	}
+}
+
 // Equal reports whether domain1 and domain2 are equivalent as defined by
 // IDNA2008 (RFC 5890).
 //
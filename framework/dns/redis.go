@@ -0,0 +1,191 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisCache is a SharedCache implementation that stores entries in Redis.
+//
+// It implements only the small subset of the protocol needed for that and
+// uses a single connection that is re-established on errors.
+type RedisCache struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	// Timeout is used for connection and each command, 5 seconds
+	// if not set.
+	Timeout time.Duration
+
+	lock sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (r *RedisCache) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return r.Timeout
+}
+
+func (r *RedisCache) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: r.timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.rd = bufio.NewReader(conn)
+
+	if r.Password != "" {
+		if _, err := r.command(ctx, "AUTH", r.Password); err != nil {
+			r.close()
+			return err
+		}
+	}
+	if r.DB != 0 {
+		if _, err := r.command(ctx, "SELECT", strconv.Itoa(r.DB)); err != nil {
+			r.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RedisCache) close() {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.conn = nil
+	r.rd = nil
+}
+
+// command sends the command and reads the reply. nil is returned for
+// null bulk strings.
+func (r *RedisCache) command(ctx context.Context, args ...string) ([]byte, error) {
+	deadline := time.Now().Add(r.timeout())
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := r.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 0, 64)
+	req = append(req, '*')
+	req = strconv.AppendInt(req, int64(len(args)), 10)
+	req = append(req, '\r', '\n')
+	for _, arg := range args {
+		req = append(req, '$')
+		req = strconv.AppendInt(req, int64(len(arg)), 10)
+		req = append(req, '\r', '\n')
+		req = append(req, arg...)
+		req = append(req, '\r', '\n')
+	}
+	if _, err := r.conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	line, err := r.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("redis: malformed reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("redis: malformed reply")
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r.rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type: %c", line[0])
+	}
+}
+
+func (r *RedisCache) do(ctx context.Context, args ...string) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := r.command(ctx, args...)
+	if err != nil {
+		// The connection state is unknown, start over next time.
+		r.close()
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (r *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := r.do(ctx, "GET", r.Prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	return reply, true, nil
+}
+
+func (r *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := r.do(ctx, "SET", r.Prefix+key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (r *RedisCache) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.close()
+	return nil
+}
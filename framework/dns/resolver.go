@@ -57,5 +57,13 @@ func DefaultResolver() Resolver {
 		override(overrideServ)
 	}
 
-	return net.DefaultResolver
+	timeout := currentLookupTimeout()
+
+	defaultCacheLock.RLock()
+	defer defaultCacheLock.RUnlock()
+	if defaultCache != nil {
+		return WithTimeout(defaultCache, timeout)
+	}
+
+	return WithTimeout(net.DefaultResolver, timeout)
 }
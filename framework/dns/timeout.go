@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	lookupTimeoutLock sync.RWMutex
+	lookupTimeout     time.Duration
+)
+
+// SetLookupTimeout sets the upper bound on the time a single lookup made
+// using DefaultResolver can take. Zero disables the limit and leaves only
+// the deadline of the caller context. It should be called before any
+// modules are created.
+func SetLookupTimeout(d time.Duration) {
+	lookupTimeoutLock.Lock()
+	defer lookupTimeoutLock.Unlock()
+	lookupTimeout = d
+}
+
+func currentLookupTimeout() time.Duration {
+	lookupTimeoutLock.RLock()
+	defer lookupTimeoutLock.RUnlock()
+	return lookupTimeout
+}
+
+// timeoutResolver wraps Resolver and applies the timeout to each lookup.
+type timeoutResolver struct {
+	r       Resolver
+	timeout time.Duration
+}
+
+// WithTimeout returns the Resolver that cancels lookups that take longer
+// than timeout. It returns r as is if timeout is zero.
+func WithTimeout(r Resolver, timeout time.Duration) Resolver {
+	if timeout <= 0 {
+		return r
+	}
+	return timeoutResolver{r: r, timeout: timeout}
+}
+
+func (tr timeoutResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, tr.timeout)
+	defer cancel()
+	return tr.r.LookupAddr(ctx, addr)
+}
+
+func (tr timeoutResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, tr.timeout)
+	defer cancel()
+	return tr.r.LookupHost(ctx, host)
+}
+
+func (tr timeoutResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(ctx, tr.timeout)
+	defer cancel()
+	return tr.r.LookupMX(ctx, name)
+}
+
+func (tr timeoutResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, tr.timeout)
+	defer cancel()
+	return tr.r.LookupTXT(ctx, name)
+}
+
+func (tr timeoutResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, tr.timeout)
+	defer cancel()
+	return tr.r.LookupIPAddr(ctx, host)
+}
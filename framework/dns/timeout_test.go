@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type blockingResolver struct{}
+
+func (blockingResolver) wait(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (b blockingResolver) LookupAddr(ctx context.Context, _ string) ([]string, error) {
+	return nil, b.wait(ctx)
+}
+
+func (b blockingResolver) LookupHost(ctx context.Context, _ string) ([]string, error) {
+	return nil, b.wait(ctx)
+}
+
+func (b blockingResolver) LookupMX(ctx context.Context, _ string) ([]*net.MX, error) {
+	return nil, b.wait(ctx)
+}
+
+func (b blockingResolver) LookupTXT(ctx context.Context, _ string) ([]string, error) {
+	return nil, b.wait(ctx)
+}
+
+func (b blockingResolver) LookupIPAddr(ctx context.Context, _ string) ([]net.IPAddr, error) {
+	return nil, b.wait(ctx)
+}
+
+func TestWithTimeout(t *testing.T) {
+	r := WithTimeout(blockingResolver{}, 50*time.Millisecond)
+
+	start := time.Now()
+	_, err := r.LookupTXT(context.Background(), "example.org")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("lookup was not cancelled in time")
+	}
+
+	if _, ok := WithTimeout(blockingResolver{}, 0).(blockingResolver); !ok {
+		t.Fatal("zero timeout should not wrap the resolver")
+	}
+}
@@ -78,3 +78,14 @@ func AddHook(eventName Event, f func()) {
 
 	hooks[eventName] = append(hooks[eventName], f)
 }
+
+// Reset removes all installed hooks.
+//
+// It is used to run multiple server instances sequentially in the same
+// process (e.g. in tests).
+func Reset() {
+	hooksLck.Lock()
+	defer hooksLck.Unlock()
+
+	hooks = make(map[Event][]func())
+}
@@ -0,0 +1,101 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Entry is the log message with all its parts kept separately.
+type Entry struct {
+	Stamp   time.Time
+	Level   Level
+	Module  string
+	Message string
+	Fields  map[string]interface{}
+
+	// raw is set for messages written via Logger.Write, these
+	// are written to text outputs without the fields separator.
+	raw bool
+}
+
+// Text returns the message formatted as it is written to text outputs:
+//
+//	module: message\t{"key":"value","key2":"value2"}
+func (e Entry) Text() string {
+	formatted := strings.Builder{}
+
+	if e.Module != "" {
+		formatted.WriteString(e.Module)
+		formatted.WriteString(": ")
+	}
+	formatted.WriteString(e.Message)
+	if e.raw {
+		return formatted.String()
+	}
+	formatted.WriteRune('\t')
+
+	if len(e.Fields) != 0 {
+		if err := marshalOrderedJSON(&formatted, e.Fields); err != nil {
+			// Fallback to printing the message with minimal processing.
+			return fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, e.Message, e.Fields)
+		}
+	}
+
+	return formatted.String()
+}
+
+// StructuredOutput is implemented by outputs that handle log messages
+// in structured form instead of formatted strings.
+type StructuredOutput interface {
+	Output
+	WriteEntry(e Entry)
+}
+
+// WriteEntry passes the message to out, formatting it as a string if out
+// does not implement StructuredOutput.
+func WriteEntry(out Output, e Entry) {
+	if so, ok := out.(StructuredOutput); ok {
+		so.WriteEntry(e)
+		return
+	}
+	out.Write(e.Stamp, e.Level == LevelDebug, e.Text())
+}
@@ -0,0 +1,116 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type jsonOutput struct {
+	wc io.WriteCloser
+}
+
+// jsonReservedKeys are keys used for Entry fields in JSON output. Message
+// fields with the same names are prefixed with "field_".
+var jsonReservedKeys = map[string]struct{}{
+	"ts":     {},
+	"level":  {},
+	"module": {},
+	"msg":    {},
+}
+
+func (j jsonOutput) Write(stamp time.Time, debug bool, msg string) {
+	level := LevelInfo
+	if debug {
+		level = LevelDebug
+	}
+	j.WriteEntry(Entry{Stamp: stamp, Level: level, Message: msg})
+}
+
+func (j jsonOutput) WriteEntry(e Entry) {
+	builder := strings.Builder{}
+	builder.WriteString(`{"ts":"`)
+	builder.WriteString(e.Stamp.UTC().Format("2006-01-02T15:04:05.000Z"))
+	builder.WriteString(`","level":"`)
+	builder.WriteString(e.Level.String())
+	builder.WriteString(`"`)
+	if e.Module != "" {
+		builder.WriteString(`,"module":`)
+		module, _ := json.Marshal(e.Module)
+		builder.Write(module)
+	}
+	builder.WriteString(`,"msg":`)
+	msg, _ := json.Marshal(e.Message)
+	builder.Write(msg)
+
+	fields := e.Fields
+	for k := range e.Fields {
+		if _, ok := jsonReservedKeys[k]; !ok {
+			continue
+		}
+		// Copy the map to not modify the one that might be used by
+		// other outputs.
+		fields = make(map[string]interface{}, len(e.Fields))
+		for k, v := range e.Fields {
+			if _, ok := jsonReservedKeys[k]; ok {
+				k = "field_" + k
+			}
+			fields[k] = v
+		}
+		break
+	}
+	if err := marshalOrderedFields(&builder, fields, true); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to format log message: %v\n", err)
+		return
+	}
+	builder.WriteString("}\n")
+
+	if _, err := io.WriteString(j.wc, builder.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to write message to log: %v\n", err)
+	}
+}
+
+func (j jsonOutput) Close() error {
+	return j.wc.Close()
+}
+
+// JSONOutput returns a log.Output implementation that writes each message as
+// a single-line JSON object to the provided io.WriteCloser.
+//
+// The object contains the timestamp ("ts", ISO 8601 in UTC), the message
+// level ("level", one of "debug", "info", "error"), the logger name
+// ("module"), the message text ("msg") and all message fields.
+//
+// Closing returned log.Output object will close the underlying
+// io.WriteCloser. Same considerations about goroutine-safety as for
+// WriteCloserOutput apply.
+func JSONOutput(wc io.WriteCloser) Output {
+	return jsonOutput{wc}
+}
+
+// JSONWriterOutput is similar to JSONOutput, but closing returned log.Output
+// object will have no effect on the underlying io.Writer.
+func JSONWriterOutput(w io.Writer) Output {
+	return jsonOutput{nopCloser{w}}
+}
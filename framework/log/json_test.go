@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJSONOutput(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := Logger{
+		Out:    JSONWriterOutput(&buf),
+		Name:   "smtp",
+		Fields: map[string]interface{}{"session_id": "abcd"},
+	}
+
+	l.Error("DATA error", errors.New("oops"), "msg_id", "1234", "msg", "conflicting")
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+		t.Fatalf("malformed output %q: %v", buf.String(), err)
+	}
+
+	want := map[string]interface{}{
+		"level":      "error",
+		"module":     "smtp",
+		"msg":        "DATA error",
+		"reason":     "oops",
+		"msg_id":     "1234",
+		"session_id": "abcd",
+		"field_msg":  "conflicting",
+	}
+	for k, v := range want {
+		if obj[k] != v {
+			t.Errorf("%s: want %v, got %v", k, v, obj[k])
+		}
+	}
+	if _, err := time.Parse("2006-01-02T15:04:05.000Z", obj["ts"].(string)); err != nil {
+		t.Errorf("malformed timestamp: %v", err)
+	}
+}
+
+func TestMultiOutput_Mixed(t *testing.T) {
+	jsonBuf, textBuf := bytes.Buffer{}, bytes.Buffer{}
+	l := Logger{
+		Out: MultiOutput(
+			JSONWriterOutput(&jsonBuf),
+			FuncOutput(func(_ time.Time, _ bool, msg string) {
+				textBuf.WriteString(msg)
+			}, func() error { return nil }),
+		),
+		Name: "test",
+	}
+
+	l.Msg("hello", "key", "value")
+
+	if textBuf.String() != "test: hello\t{\"key\":\"value\"}" {
+		t.Errorf("wrong text output: %q", textBuf.String())
+	}
+	if !json.Valid(bytes.TrimSpace(jsonBuf.Bytes())) {
+		t.Errorf("malformed JSON output: %q", jsonBuf.String())
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// levelOverrides contains the currently configured per-logger minimal
+// levels, see SetLevels.
+var levelOverrides atomic.Value // map[string]Level
+
+// ParseLevel converts the textual representation of the level (as used in
+// the configuration) into the Level value.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+// SetLevels replaces the set of per-logger minimal levels.
+//
+// Keys are logger names (as they appear in the log output). A name also
+// applies to all loggers nested under it using the "/" separator, e.g.
+// "smtp" matches "smtp/pipeline" unless it has its own entry. Empty key
+// sets the level for all loggers without a more specific entry.
+//
+// Messages below the configured level are discarded. If no level applies to
+// the logger, the Logger.Debug flag is used to decide whether debug
+// messages should be written, as usual.
+//
+// SetLevels is safe to call concurrently with logging.
+func SetLevels(levels map[string]Level) {
+	m := make(map[string]Level, len(levels))
+	for k, v := range levels {
+		m[k] = v
+	}
+	levelOverrides.Store(m)
+}
+
+// levelFor returns the minimal level configured for the logger with the
+// specified name.
+func levelFor(name string) (Level, bool) {
+	m, _ := levelOverrides.Load().(map[string]Level)
+	if len(m) == 0 {
+		return 0, false
+	}
+
+	for {
+		if lvl, ok := m[name]; ok {
+			return lvl, true
+		}
+		if name == "" {
+			return 0, false
+		}
+		if idx := strings.LastIndexByte(name, '/'); idx != -1 {
+			name = name[:idx]
+		} else {
+			name = ""
+		}
+	}
+}
+
+// Enabled reports whether messages of the specified level will be written
+// by the Logger.
+func (l Logger) Enabled(level Level) bool {
+	if lvl, ok := levelFor(l.Name); ok {
+		return level >= lvl
+	}
+	return level != LevelDebug || l.Debug
+}
@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordOut struct {
+	lines []string
+}
+
+func (r *recordOut) Write(_ time.Time, _ bool, msg string) {
+	r.lines = append(r.lines, msg)
+}
+
+func (r *recordOut) Close() error {
+	return nil
+}
+
+func TestLoggerLevels(t *testing.T) {
+	defer SetLevels(nil)
+	SetLevels(map[string]Level{
+		"":           LevelInfo,
+		"remote":     LevelDebug,
+		"smtp":       LevelError,
+		"smtp/inner": LevelInfo,
+	})
+
+	out := &recordOut{}
+	logAll := func(name string, debug bool) {
+		l := Logger{Out: out, Name: name, Debug: debug}
+		l.Debugf("debug")
+		l.Printf("info")
+		l.Msg("msg")
+		l.Error("error", errors.New("test"))
+	}
+
+	logAll("remote", false)
+	logAll("smtp/pipeline", true)
+	logAll("smtp/inner/x", false)
+	logAll("other", true)
+
+	expected := []string{
+		"remote: debug", "remote: info", "remote: msg", "remote: error",
+		"smtp/pipeline: error",
+		"smtp/inner/x: info", "smtp/inner/x: msg", "smtp/inner/x: error",
+		"other: info", "other: msg", "other: error",
+	}
+	if len(out.lines) != len(expected) {
+		t.Fatalf("wrong amount of messages written: %v", out.lines)
+	}
+	for i, line := range out.lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("message %d: want prefix %q, got %q", i, expected[i], line)
+		}
+	}
+}
+
+func TestLoggerLevels_NoOverrides(t *testing.T) {
+	SetLevels(nil)
+
+	out := &recordOut{}
+	Logger{Out: out, Name: "a"}.Debugf("debug")
+	Logger{Out: out, Name: "a", Debug: true}.Debugf("debug")
+	if len(out.lines) != 1 {
+		t.Fatalf("unexpected messages: %v", out.lines)
+	}
+}
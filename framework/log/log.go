@@ -57,25 +57,25 @@ func (l Logger) Zap() *zap.Logger {
 }
 
 func (l Logger) Debugf(format string, val ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
-	l.log(true, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.emit(LevelDebug, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Debugln(val ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
-	l.log(true, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.emit(LevelDebug, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
 }
 
 func (l Logger) Printf(format string, val ...interface{}) {
-	l.log(false, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.emit(LevelInfo, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Println(val ...interface{}) {
-	l.log(false, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.emit(LevelInfo, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
 }
 
 // Msg writes an event log message in a machine-readable format (currently
@@ -95,7 +95,7 @@ func (l Logger) Println(val ...interface{}) {
 func (l Logger) Msg(msg string, fields ...interface{}) {
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(false, l.formatMsg(msg, m))
+	l.emit(LevelInfo, msg, m)
 }
 
 // Error writes an event log message in a machine-readable format (currently
@@ -127,16 +127,16 @@ func (l Logger) Error(msg string, err error, fields ...interface{}) {
 	}
 	fieldsToMap(fields, allFields)
 
-	l.log(false, l.formatMsg(msg, allFields))
+	l.emit(LevelError, msg, allFields)
 }
 
 func (l Logger) DebugMsg(kind string, fields ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(true, l.formatMsg(kind, m))
+	l.emit(LevelDebug, kind, m)
 }
 
 func fieldsToMap(fields []interface{}, out map[string]interface{}) {
@@ -159,26 +159,35 @@ func fieldsToMap(fields []interface{}, out map[string]interface{}) {
 	}
 }
 
-func (l Logger) formatMsg(msg string, fields map[string]interface{}) string {
-	formatted := strings.Builder{}
+// emit passes the message to the output, either as an Entry if the output
+// supports it or as a formatted string.
+func (l Logger) emit(level Level, msg string, fields map[string]interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
 
-	formatted.WriteString(msg)
-	formatted.WriteRune('\t')
+	out := l.output()
+	if out == nil {
+		// Logging is disabled - do nothing.
+		return
+	}
 
-	if len(l.Fields)+len(fields) != 0 {
+	if len(l.Fields) != 0 {
 		if fields == nil {
-			fields = make(map[string]interface{})
+			fields = make(map[string]interface{}, len(l.Fields))
 		}
 		for k, v := range l.Fields {
 			fields[k] = v
 		}
-		if err := marshalOrderedJSON(&formatted, fields); err != nil {
-			// Fallback to printing the message with minimal processing.
-			return fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, msg, fields)
-		}
 	}
 
-	return formatted.String()
+	WriteEntry(out, Entry{
+		Stamp:   time.Now(),
+		Level:   level,
+		Module:  l.Name,
+		Message: msg,
+		Fields:  fields,
+	})
 }
 
 type LogFormatter interface {
@@ -194,31 +203,45 @@ func (l Logger) Write(s []byte) (int, error) {
 }
 
 // DebugWriter returns a writer that will act like Logger.Write
-// but will use debug flag on messages. If Logger.Debug is false,
-// Write method of returned object will be no-op.
+// but will use debug flag on messages. If debug messages are not enabled
+// for the Logger, Write method of returned object will be no-op.
 func (l Logger) DebugWriter() io.Writer {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return io.Discard
 	}
 	l.Debug = true
 	return &l
 }
 
-func (l Logger) log(debug bool, s string) {
-	if l.Name != "" {
-		s = l.Name + ": " + s
+func (l Logger) output() Output {
+	if l.Out != nil {
+		return l.Out
 	}
+	return DefaultLogger.Out
+}
 
-	if l.Out != nil {
-		l.Out.Write(time.Now(), debug, s)
+func (l Logger) log(debug bool, s string) {
+	level := LevelInfo
+	if debug {
+		level = LevelDebug
+	}
+	if !l.Enabled(level) {
 		return
 	}
-	if DefaultLogger.Out != nil {
-		DefaultLogger.Out.Write(time.Now(), debug, s)
+
+	out := l.output()
+	if out == nil {
+		// Logging is disabled - do nothing.
 		return
 	}
 
-	// Logging is disabled - do nothing.
+	WriteEntry(out, Entry{
+		Stamp:   time.Now(),
+		Level:   level,
+		Module:  l.Name,
+		Message: s,
+		raw:     true,
+	})
 }
 
 // DefaultLogger is the global Logger object that is used by
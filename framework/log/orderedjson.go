@@ -32,15 +32,26 @@ import (
 // other.
 
 func marshalOrderedJSON(output *strings.Builder, m map[string]interface{}) error {
+	output.WriteRune('{')
+	if err := marshalOrderedFields(output, m, false); err != nil {
+		return err
+	}
+	output.WriteRune('}')
+
+	return nil
+}
+
+// marshalOrderedFields writes key-value pairs from m without enclosing braces.
+// If comma is true, the leading comma is written before the first pair.
+func marshalOrderedFields(output *strings.Builder, m map[string]interface{}, comma bool) error {
 	order := make([]string, 0, len(m))
 	for k := range m {
 		order = append(order, k)
 	}
 	sort.Strings(order)
 
-	output.WriteRune('{')
 	for i, key := range order {
-		if i != 0 {
+		if i != 0 || comma {
 			output.WriteRune(',')
 		}
 
@@ -72,7 +83,6 @@ func marshalOrderedJSON(output *strings.Builder, m map[string]interface{}) error
 		}
 		output.Write(jsonValue)
 	}
-	output.WriteRune('}')
 
 	return nil
 }
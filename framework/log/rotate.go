@@ -0,0 +1,237 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions control log file rotation done by RotatingFile.
+type RotateOptions struct {
+	// MaxSize is the file size after which it is rotated. 0 disables
+	// size-based rotation.
+	MaxSize int64
+
+	// MaxAge is the time after which file is rotated, counted since it was
+	// opened. 0 disables time-based rotation.
+	MaxAge time.Duration
+
+	// Keep is the amount of rotated files to keep. Older ones are removed.
+	// 0 means all files are kept.
+	Keep int
+
+	// Compress enables gzip compression of rotated files.
+	Compress bool
+}
+
+// RotatingFile is an io.WriteCloser that appends to the file and
+// rotates it according to the specified options.
+//
+// Rotated files are named by appending the rotation time to the original
+// file name, e.g. maddy.log.20200102T150405, and ".gz" if compressed.
+//
+// RotatingFile is goroutine-safe.
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+
+	lock     sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+
+	// compressWg tracks background compression of rotated files.
+	compressWg sync.WaitGroup
+}
+
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path: path,
+		opts: opts,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) shouldRotate(writeLen int) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.opts.MaxSize != 0 && rf.size+int64(writeLen) > rf.opts.MaxSize {
+		return true
+	}
+	if rf.opts.MaxAge != 0 && time.Since(rf.openedAt) > rf.opts.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.shouldRotate(len(b)) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "!!! Failed to rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+
+	rotatedPath := rf.path + "." + time.Now().UTC().Format("20060102T150405")
+	if _, err := os.Stat(rotatedPath); err == nil {
+		// Rotated twice in the same second.
+		rotatedPath += fmt.Sprintf(".%d", time.Now().UnixNano())
+	}
+	renameErr := os.Rename(rf.path, rotatedPath)
+
+	// Reopen the file anyway so we will not lose messages.
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	if rf.opts.Compress {
+		rf.compressWg.Add(1)
+		go func() {
+			defer rf.compressWg.Done()
+			if err := compressFile(rotatedPath); err != nil {
+				fmt.Fprintf(os.Stderr, "!!! Failed to compress rotated log file: %v\n", err)
+			}
+			rf.removeOld()
+		}()
+		return nil
+	}
+
+	rf.removeOld()
+	return nil
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	gzw := gzip.NewWriter(out)
+	if _, err := io.Copy(gzw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeOld deletes rotated files exceeding the RotateOptions.Keep limit.
+func (rf *RotatingFile) removeOld() {
+	if rf.opts.Keep == 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	rotated := matches[:0]
+	for _, m := range matches {
+		// Skip files that are being compressed right now.
+		if strings.HasSuffix(m, ".gz") || !rf.opts.Compress {
+			rotated = append(rotated, m)
+		}
+	}
+	if len(rotated) <= rf.opts.Keep {
+		return
+	}
+
+	// Timestamp format used in names sorts lexicographically.
+	sort.Strings(rotated)
+	for _, m := range rotated[:len(rotated)-rf.opts.Keep] {
+		if err := os.Remove(m); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "!!! Failed to remove old log file: %v\n", err)
+		}
+	}
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	rf.compressWg.Wait()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,186 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// syslogFacilityMail is the "mail system" facility code from RFC 5424.
+	syslogFacilityMail = 2
+
+	remoteSyslogTimeout = 5 * time.Second
+)
+
+type remoteSyslogOut struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+
+	hostname string
+	pid      string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func syslogSeverity(l Level) int {
+	switch l {
+	case LevelDebug:
+		return 7
+	case LevelError:
+		return 3
+	default:
+		return 6
+	}
+}
+
+func (s *remoteSyslogOut) Write(stamp time.Time, debug bool, msg string) {
+	level := LevelInfo
+	if debug {
+		level = LevelDebug
+	}
+	s.WriteEntry(Entry{Stamp: stamp, Level: level, Message: msg, raw: true})
+}
+
+func (s *remoteSyslogOut) WriteEntry(e Entry) {
+	msgID := "-"
+	if e.Module != "" && len(e.Module) <= 32 && !strings.ContainsAny(e.Module, " =]\"") {
+		msgID = e.Module
+		// Module name is already in MSGID.
+		e.Module = ""
+	}
+
+	// RFC 5424, Section 6:
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	line := fmt.Sprintf("<%d>1 %s %s maddy %s %s - %s",
+		syslogFacilityMail*8+syslogSeverity(e.Level),
+		e.Stamp.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		s.hostname, s.pid, msgID, e.Text())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Try to reconnect once if the connection was broken.
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "!!! Failed to connect to syslog server: %v\n", err)
+				return
+			}
+			s.conn = conn
+		}
+
+		if err := s.send(line); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			if attempt == 1 {
+				fmt.Fprintf(os.Stderr, "!!! Failed to send message to syslog server: %v\n", err)
+			}
+			continue
+		}
+		return
+	}
+}
+
+func (s *remoteSyslogOut) send(line string) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(remoteSyslogTimeout)); err != nil {
+		return err
+	}
+	if s.network == "udp" {
+		// RFC 5426: one message per datagram.
+		_, err := s.conn.Write([]byte(line))
+		return err
+	}
+	// RFC 6587, Section 3.4.1: octet-counting framing.
+	_, err := s.conn.Write([]byte(strconv.Itoa(len(line)) + " " + line))
+	return err
+}
+
+func (s *remoteSyslogOut) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: remoteSyslogTimeout}
+	if s.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	}
+	return dialer.Dial(s.network, s.addr)
+}
+
+func (s *remoteSyslogOut) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// RemoteSyslogOutput returns a log.Output implementation that sends
+// messages to the remote syslog server using RFC 5424 format.
+//
+// network should be one of "udp", "tcp" or "tls". For TCP and TLS,
+// octet-counting framing (RFC 6587) is used. If tlsConfig is nil for "tls",
+// system defaults are used.
+//
+// The connection is established lazily and re-established if it breaks.
+// Messages that can not be delivered are dropped.
+//
+// Returned log.Output object is goroutine-safe.
+func RemoteSyslogOutput(network, addr string, tlsConfig *tls.Config) (Output, error) {
+	switch network {
+	case "udp", "tcp":
+	case "tls":
+		if tlsConfig == nil {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig = &tls.Config{ServerName: host}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog transport: %s", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	out := &remoteSyslogOut{
+		network:  network,
+		addr:     addr,
+		hostname: hostname,
+		pid:      strconv.Itoa(os.Getpid()),
+	}
+	if network == "tls" {
+		out.tlsConfig = tlsConfig
+	}
+	return out, nil
+}
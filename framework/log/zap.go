@@ -11,10 +11,13 @@ type zapLogger struct {
 }
 
 func (l zapLogger) Enabled(level zapcore.Level) bool {
-	if l.L.Debug {
-		return true
+	if level == zapcore.DebugLevel {
+		return l.L.Enabled(LevelDebug)
 	}
-	return level > zapcore.DebugLevel
+	if level >= zapcore.ErrorLevel {
+		return l.L.Enabled(LevelError)
+	}
+	return l.L.Enabled(LevelInfo)
 }
 
 func (l zapLogger) With(fields []zapcore.Field) zapcore.Core {
@@ -48,7 +51,14 @@ func (l zapLogger) Write(entry zapcore.Entry, fields []zapcore.Field) error {
 	if entry.LoggerName != "" {
 		l.L.Name += "/" + entry.LoggerName
 	}
-	l.L.log(entry.Level == zapcore.DebugLevel, l.L.formatMsg(entry.Message, enc.Fields))
+	level := LevelInfo
+	switch {
+	case entry.Level == zapcore.DebugLevel:
+		level = LevelDebug
+	case entry.Level >= zapcore.ErrorLevel:
+		level = LevelError
+	}
+	l.L.emit(level, entry.Message, enc.Fields)
 	return nil
 }
 
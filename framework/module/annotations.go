@@ -0,0 +1,321 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Annotations is a set of typed key-value pairs attached to the message by
+// checks and modifiers. Later pipeline stages can read and match on them.
+//
+// Keys should be prefixed with the name of the module that sets them, e.g.
+// "rspamd.symbols". Values are strings, string lists, integers, floats or
+// booleans.
+//
+// Annotations are serialized together with MsgMetadata so they are
+// preserved if the message is stored in the queue.
+//
+// All methods are safe for concurrent use and can be called on a nil
+// pointer, in which case getters report missing keys and setters do
+// nothing.
+type Annotations struct {
+	lock sync.RWMutex
+	m    map[string]interface{}
+}
+
+func NewAnnotations() *Annotations {
+	return &Annotations{m: map[string]interface{}{}}
+}
+
+func (a *Annotations) set(key string, value interface{}) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.m == nil {
+		a.m = map[string]interface{}{}
+	}
+	a.m[key] = value
+}
+
+func (a *Annotations) SetString(key, value string) {
+	a.set(key, value)
+}
+
+func (a *Annotations) SetStrings(key string, values []string) {
+	a.set(key, append([]string(nil), values...))
+}
+
+// AddString appends values to the string list stored under the key. If the
+// key contains a single string, it is converted to a list.
+func (a *Annotations) AddString(key string, values ...string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.m == nil {
+		a.m = map[string]interface{}{}
+	}
+	var list []string
+	switch v := a.m[key].(type) {
+	case []string:
+		list = append(list, v...)
+	case string:
+		list = append(list, v)
+	}
+	a.m[key] = append(list, values...)
+}
+
+func (a *Annotations) SetInt(key string, value int64) {
+	a.set(key, value)
+}
+
+func (a *Annotations) SetFloat(key string, value float64) {
+	a.set(key, value)
+}
+
+func (a *Annotations) SetBool(key string, value bool) {
+	a.set(key, value)
+}
+
+func (a *Annotations) Delete(key string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.m, key)
+}
+
+// Get returns the value stored under the key. The returned value is one of
+// string, []string, int64, float64 or bool and should not be modified.
+func (a *Annotations) Get(key string) (interface{}, bool) {
+	if a == nil {
+		return nil, false
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	v, ok := a.m[key]
+	return v, ok
+}
+
+func (a *Annotations) GetString(key string) (string, bool) {
+	v, _ := a.Get(key)
+	s, ok := v.(string)
+	return s, ok
+}
+
+func (a *Annotations) GetStrings(key string) ([]string, bool) {
+	v, _ := a.Get(key)
+	switch v := v.(type) {
+	case []string:
+		return append([]string(nil), v...), true
+	case string:
+		return []string{v}, true
+	}
+	return nil, false
+}
+
+func (a *Annotations) GetInt(key string) (int64, bool) {
+	v, _ := a.Get(key)
+	i, ok := v.(int64)
+	return i, ok
+}
+
+func (a *Annotations) GetFloat(key string) (float64, bool) {
+	v, _ := a.Get(key)
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func (a *Annotations) GetBool(key string) (bool, bool) {
+	v, _ := a.Get(key)
+	b, ok := v.(bool)
+	return b, ok
+}
+
+// Keys returns the sorted list of all keys.
+func (a *Annotations) Keys() []string {
+	if a == nil {
+		return nil
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	keys := make([]string, 0, len(a.m))
+	for k := range a.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Match reports whether the value stored under the key matches the passed
+// string. Lists match if any of their elements is equal to the value, other
+// types are compared using their textual representation.
+func (a *Annotations) Match(key, value string) bool {
+	v, ok := a.Get(key)
+	if !ok {
+		return false
+	}
+	switch v := v.(type) {
+	case []string:
+		for _, s := range v {
+			if s == value {
+				return true
+			}
+		}
+		return false
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		return err == nil && f == v
+	default:
+		return annotationString(v) == value
+	}
+}
+
+func annotationString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Copy returns the independent copy of the annotations set.
+func (a *Annotations) Copy() *Annotations {
+	if a == nil {
+		return nil
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	cpy := &Annotations{m: make(map[string]interface{}, len(a.m))}
+	for k, v := range a.m {
+		if list, ok := v.([]string); ok {
+			v = append([]string(nil), list...)
+		}
+		cpy.m[k] = v
+	}
+	return cpy
+}
+
+// annotationJSON is the serialized form of a single value. The type is
+// stored explicitly so integers and floats survive the round-trip.
+type annotationJSON struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+func (a *Annotations) MarshalJSON() ([]byte, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	out := make(map[string]annotationJSON, len(a.m))
+	for k, v := range a.m {
+		var typ string
+		switch v.(type) {
+		case string:
+			typ = "string"
+		case []string:
+			typ = "strings"
+		case int64:
+			typ = "int"
+		case float64:
+			typ = "float"
+		case bool:
+			typ = "bool"
+		default:
+			return nil, fmt.Errorf("annotations: unsupported value type %T for %s", v, k)
+		}
+		blob, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = annotationJSON{Type: typ, Value: blob}
+	}
+	return json.Marshal(out)
+}
+
+func (a *Annotations) UnmarshalJSON(b []byte) error {
+	var in map[string]annotationJSON
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	m := make(map[string]interface{}, len(in))
+	for k, v := range in {
+		var (
+			val interface{}
+			err error
+		)
+		switch v.Type {
+		case "string":
+			var s string
+			err = json.Unmarshal(v.Value, &s)
+			val = s
+		case "strings":
+			var l []string
+			err = json.Unmarshal(v.Value, &l)
+			val = l
+		case "int":
+			var i int64
+			err = json.Unmarshal(v.Value, &i)
+			val = i
+		case "float":
+			var f float64
+			err = json.Unmarshal(v.Value, &f)
+			val = f
+		case "bool":
+			var bl bool
+			err = json.Unmarshal(v.Value, &bl)
+			val = bl
+		default:
+			// Written by a newer version, skip it instead of failing to
+			// load the whole message.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("annotations: %s: %w", k, err)
+		}
+		m[k] = val
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.m = m
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 type Blob interface {
@@ -44,3 +45,18 @@ type BlobStore interface {
 	// Delete removes a set of keys from store. Non-existent keys are ignored.
 	Delete(ctx context.Context, keys []string) error
 }
+
+// BlobInfo describes a stored object as returned by BlobLister.
+type BlobInfo struct {
+	Key     string
+	ModTime time.Time
+}
+
+// BlobLister is an optional interface implemented by BlobStore
+// implementations that can enumerate stored objects.
+//
+// It is used by storage maintenance jobs to find objects that are not
+// referenced anymore.
+type BlobLister interface {
+	ListBlobs(ctx context.Context) ([]BlobInfo, error)
+}
@@ -87,6 +87,29 @@ type CheckState interface {
 	Close() error
 }
 
+// HeaderCheckState is an optional interface that can be implemented by
+// CheckState of checks that need only the message header.
+//
+// CheckHeader is executed once the message header is received, before the
+// body is received and buffered, so the message can be rejected early.
+// CheckBody is still called for such checks and should not repeat the same
+// work.
+type HeaderCheckState interface {
+	CheckHeader(ctx context.Context, header textproto.Header) CheckResult
+}
+
+// OutcomeCheckState is an optional interface that can be implemented by
+// CheckState of checks that want to learn the combined result of all checks,
+// e.g. to maintain statistics about message sources.
+//
+// CheckOutcome is called with stage set to the stage at which the message
+// was rejected, "rcpt" if only one recipient was rejected (it can be called
+// multiple times in this case) or "body" with the Reject flag unset once all
+// checks passed. Quarantine is set if the message was quarantined.
+type OutcomeCheckState interface {
+	CheckOutcome(ctx context.Context, stage string, res CheckResult)
+}
+
 type CheckResult struct {
 	// Reason is the error that is reported to the message source
 	// if check decided that the message should be rejected.
@@ -103,6 +126,15 @@ type CheckResult struct {
 	// This value is copied into MsgMetadata by the msgpipeline.
 	Quarantine bool
 
+	// Accept is the flag that specifies that the message should be
+	// accepted without consulting other checks. Rejections and quarantine
+	// requests from checks run at the same stage are ignored.
+	//
+	// If set at the connection or sender stage, all further checks for
+	// the message are skipped. If set at the recipient stage, it applies
+	// only to the recipient being checked.
+	Accept bool
+
 	// AuthResult is the information that is supposed to
 	// be included in Authentication-Results header.
 	AuthResult []authres.Result
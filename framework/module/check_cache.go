@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CheckCache stores results of checks executed for the message so each
+// check runs once per message even if the message passes through multiple
+// pipelines (e.g. when a message pipeline is used as a delivery target).
+//
+// Results are keyed by the check instance, the stage name and the set of
+// recipients the check state has seen. Pipelines that route different
+// recipients to the nested pipeline (e.g. using multiple destination
+// blocks) get separate results since the check might have made its
+// decision based on the recipients.
+//
+// All methods are safe for concurrent use and can be called on a nil
+// pointer, in which case nothing is cached.
+type CheckCache struct {
+	lock    sync.Mutex
+	results map[checkCacheKey]CheckResult
+}
+
+type checkCacheKey struct {
+	check Check
+	stage string
+	rcpts string
+}
+
+func newCheckCacheKey(check Check, stage string, rcpts []string) checkCacheKey {
+	sorted := make([]string, len(rcpts))
+	copy(sorted, rcpts)
+	sort.Strings(sorted)
+	// Line breaks can't appear in addresses.
+	return checkCacheKey{check, stage, strings.Join(sorted, "\n")}
+}
+
+func NewCheckCache() *CheckCache {
+	return &CheckCache{results: map[checkCacheKey]CheckResult{}}
+}
+
+// Get returns the result of the check for the stage, if it was executed
+// for the message with the same set of recipients before.
+func (c *CheckCache) Get(check Check, stage string, rcpts []string) (CheckResult, bool) {
+	if c == nil {
+		return CheckResult{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res, ok := c.results[newCheckCacheKey(check, stage, rcpts)]
+	return res, ok
+}
+
+// Set stores the result of the check for the stage and the set of
+// recipients.
+func (c *CheckCache) Set(check Check, stage string, rcpts []string, res CheckResult) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.results[newCheckCacheKey(check, stage, rcpts)] = res
+}
@@ -91,3 +91,22 @@ type Delivery interface {
 	// atomicity of the delivery if multiple targets are used.
 	Commit(ctx context.Context) error
 }
+
+// StreamingDelivery is an optional interface that can be implemented by
+// Delivery to process the message header before the body is received.
+//
+// Message sources that receive messages over the network should call Header
+// once the header is parsed and stop receiving the message if it fails.
+// Body is called afterwards with the same header as usual.
+type StreamingDelivery interface {
+	Delivery
+
+	// Header is called once after the message header is received.
+	// Implementation should not repeat the same work in Body.
+	Header(ctx context.Context, header textproto.Header) error
+
+	// MaxMessageSize returns the maximum accepted size of the message
+	// (header and body) in bytes. Zero means there is no limit other than
+	// the message source one. It is called after Header.
+	MaxMessageSize() int64
+}
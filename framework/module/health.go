@@ -0,0 +1,58 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"sync"
+)
+
+// HealthChecker is implemented by modules that can report whether they are
+// able to do their work, e.g. whether the database is reachable.
+type HealthChecker interface {
+	// CheckHealth returns a non-nil error if the module is not operational.
+	//
+	// It is called periodically by health check endpoints and should
+	// return quickly, respecting the ctx deadline.
+	CheckHealth(ctx context.Context) error
+}
+
+var (
+	runningLock sync.RWMutex
+	running     []Module
+	started     bool
+)
+
+// SetRunning records the set of module instances (including endpoints) used
+// by the server. It should be called once all modules are initialized.
+func SetRunning(mods []Module) {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	running = mods
+	started = true
+}
+
+// Running returns the set of module instances recorded by SetRunning.
+//
+// ok is false if the server initialization is not complete yet.
+func Running() (mods []Module, ok bool) {
+	runningLock.RLock()
+	defer runningLock.RUnlock()
+	return running, started
+}
@@ -56,6 +56,20 @@ func RegisterAlias(aliasName, instName string) {
 	aliases[aliasName] = instName
 }
 
+// ResetInstances removes all instances and aliases from the global registry.
+//
+// It is used to run multiple server instances sequentially in the same
+// process (e.g. in tests) and should not be called while any of the
+// registered modules are in use.
+func ResetInstances() {
+	instances = make(map[string]struct {
+		mod Module
+		cfg *config.Map
+	})
+	aliases = make(map[string]string)
+	Initialized = make(map[string]bool)
+}
+
 func HasInstance(name string) bool {
 	aliasedName := aliases[name]
 	if aliasedName != "" {
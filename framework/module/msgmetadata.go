@@ -136,6 +136,21 @@ type MsgMetadata struct {
 	// header. It is only meaningful if server has seen the body at least once
 	// (e.g. the message was passed via queue).
 	TLSRequireOverride bool
+
+	// Annotations contains values set by checks and modifiers for use by
+	// later pipeline stages. It is preserved if the message is stored in the
+	// queue.
+	//
+	// MsgPipeline initializes this field if it is nil, methods are safe to
+	// call concurrently from checks running in parallel.
+	Annotations *Annotations
+
+	// CheckCache contains results of checks executed for the message. It is
+	// shared by all pipelines that handle the message and is not preserved
+	// if the message is stored in the queue.
+	//
+	// MsgPipeline initializes this field if it is nil.
+	CheckCache *CheckCache `json:"-"`
 }
 
 // DeepCopy creates a copy of the MsgMetadata structure, also
@@ -143,8 +158,12 @@ type MsgMetadata struct {
 //
 // There are a few exceptions, however:
 // - SrcAddr is not copied and copy field references original value.
+//
+// Annotations are copied, changes to them are not visible in the
+// original structure. CheckCache is shared between the copies.
 func (msgMeta *MsgMetadata) DeepCopy() *MsgMetadata {
 	cpy := *msgMeta
+	cpy.Annotations = msgMeta.Annotations.Copy()
 	// There is no good way to copy net.Addr, but it should not be
 	// modified by anything anyway so we are safe.
 	return &cpy
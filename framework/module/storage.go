@@ -19,6 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	imapbackend "github.com/emersion/go-imap/backend"
 )
 
@@ -48,3 +52,34 @@ type ManageableStorage interface {
 	CreateIMAPAcct(username string) error
 	DeleteIMAPAcct(username string) error
 }
+
+// MetadataStorage is an optional interface that can be implemented by
+// Storage to support the IMAP METADATA extension (RFC 5464).
+//
+// Mailbox name is empty for server annotations. Entry names are
+// lower-case and include the "/private" or "/shared" prefix.
+type MetadataStorage interface {
+	// Metadata returns all annotations set for the mailbox.
+	Metadata(ctx context.Context, username, mailbox string) (map[string]string, error)
+
+	// SetMetadata sets annotations for the mailbox, nil value removes the
+	// annotation. Either all values are set or none.
+	//
+	// ErrMetadataTooMany or MetadataTooLargeError is returned if the
+	// storage limits are exceeded.
+	SetMetadata(ctx context.Context, username, mailbox string, values map[string]*string) error
+}
+
+// ErrMetadataTooMany is returned by MetadataStorage.SetMetadata if the
+// account has too many annotations.
+var ErrMetadataTooMany = errors.New("too many annotations")
+
+// MetadataTooLargeError is returned by MetadataStorage.SetMetadata if the
+// annotation value exceeds the size limit.
+type MetadataTooLargeError struct {
+	MaxSize int64
+}
+
+func (err MetadataTooLargeError) Error() string {
+	return fmt.Sprintf("annotation value is too large, max size is %d", err.MaxSize)
+}
@@ -0,0 +1,180 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package plugin defines the protocol used by maddy to communicate with
+// external modules and provides helpers to implement them.
+//
+// External module is a program started by maddy as a subprocess. It
+// receives JSON-RPC 1.0 requests (as implemented by net/rpc/jsonrpc) on its
+// standard input and writes responses to its standard output. Anything
+// written to standard error is copied to the maddy log.
+//
+// All methods belong to the "Plugin" service. Plugin.Init is called once
+// after the process is started, other methods are called concurrently
+// depending on the module kind:
+//
+//	check.external  - Plugin.Check
+//	target.external - Plugin.Deliver
+//	table.external  - Plugin.Lookup
+//
+// Go programs should use Serve instead of implementing the protocol
+// directly.
+package plugin
+
+import (
+	"fmt"
+)
+
+// ProtocolVersion is incremented on incompatible protocol changes.
+// Plugin.Init fails if plugin reports a different version.
+const ProtocolVersion = 1
+
+const (
+	KindCheck  = "check"
+	KindTarget = "target"
+	KindTable  = "table"
+)
+
+const (
+	StageConnection = "conn"
+	StageSender     = "sender"
+	StageRcpt       = "rcpt"
+	StageBody       = "body"
+)
+
+// ConfigNode is a configuration directive passed to the plugin as is.
+type ConfigNode struct {
+	Name     string
+	Args     []string
+	Children []ConfigNode
+}
+
+type InitArgs struct {
+	ProtocolVersion int
+	Kind            string
+	InstanceName    string
+
+	// Command line of the plugin process as specified in the configuration.
+	Command []string
+
+	// Config contains all directives from the module configuration block
+	// that are not handled by maddy itself.
+	Config []ConfigNode
+}
+
+type InitReply struct {
+	ProtocolVersion int
+
+	// Stages lists the check stages the plugin wants to be called at.
+	// Only used for checks. Defaults to StageBody.
+	Stages []string
+}
+
+type HeaderField struct {
+	Key   string
+	Value string
+}
+
+// MsgInfo contains the information about the message source.
+type MsgInfo struct {
+	ID string
+
+	// Proto is the protocol used to submit the message, e.g. "ESMTP".
+	Proto      string
+	Hostname   string
+	RemoteAddr string
+	RDNSName   string
+	AuthUser   string
+	TLS        bool
+	SMTPUTF8   bool
+	Quarantine bool
+}
+
+// Error is the SMTP error reported by the plugin.
+type Error struct {
+	Code         int
+	EnhancedCode [3]int
+	Message      string
+
+	// Reason is the explanation written to the log. It is not sent to the
+	// SMTP client.
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %d.%d.%d %s", e.Code, e.EnhancedCode[0], e.EnhancedCode[1], e.EnhancedCode[2], e.Message)
+}
+
+// Temporary reports whether the error is a temporary (4xx) one.
+func (e *Error) Temporary() bool {
+	return e.Code/100 == 4
+}
+
+type CheckArgs struct {
+	Msg   MsgInfo
+	Stage string
+
+	// MailFrom is set for all stages except StageConnection.
+	MailFrom string
+
+	// Rcpt is set for StageRcpt.
+	Rcpt string
+
+	// Rcpts, Header and Body are set for StageBody.
+	Rcpts  []string
+	Header []HeaderField
+	Body   []byte
+}
+
+type CheckReply struct {
+	Reject     bool
+	Quarantine bool
+
+	// Error is the error returned to the client if Reject is set. If it is
+	// nil, generic 550 5.7.1 error is used.
+	Error *Error
+
+	// Header contains fields to add to the message header.
+	Header []HeaderField
+}
+
+type DeliverArgs struct {
+	Msg      MsgInfo
+	MailFrom string
+	Rcpts    []string
+	Header   []HeaderField
+	Body     []byte
+}
+
+type DeliverReply struct {
+	// Error is the error that applies to all recipients.
+	Error *Error
+
+	// RcptErrors contains errors for individual recipients, recipients
+	// not listed are considered delivered.
+	RcptErrors map[string]*Error
+}
+
+type LookupArgs struct {
+	Key string
+}
+
+type LookupReply struct {
+	// Values is empty if the key is not found.
+	Values []string
+}
@@ -0,0 +1,141 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package plugin
+
+import (
+	"errors"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+)
+
+// Initializer can be implemented by plugins that need to read the
+// configuration or report the stages they want to be called at.
+type Initializer interface {
+	Init(args InitArgs) (InitReply, error)
+}
+
+type Check interface {
+	Check(args CheckArgs) (CheckReply, error)
+}
+
+type Target interface {
+	Deliver(args DeliverArgs) (DeliverReply, error)
+}
+
+type Table interface {
+	Lookup(args LookupArgs) (LookupReply, error)
+}
+
+// ErrNotImplemented is returned if maddy calls a method that is not
+// implemented by the plugin.
+var ErrNotImplemented = errors.New("plugin: method not implemented")
+
+type service struct {
+	impl interface{}
+}
+
+func (s *service) Init(args InitArgs, reply *InitReply) error {
+	if args.ProtocolVersion != ProtocolVersion {
+		return errors.New("plugin: unsupported protocol version")
+	}
+
+	if init, ok := s.impl.(Initializer); ok {
+		r, err := init.Init(args)
+		if err != nil {
+			return err
+		}
+		*reply = r
+	}
+	reply.ProtocolVersion = ProtocolVersion
+	return nil
+}
+
+func (s *service) Check(args CheckArgs, reply *CheckReply) error {
+	c, ok := s.impl.(Check)
+	if !ok {
+		return ErrNotImplemented
+	}
+	r, err := c.Check(args)
+	if err != nil {
+		return err
+	}
+	*reply = r
+	return nil
+}
+
+func (s *service) Deliver(args DeliverArgs, reply *DeliverReply) error {
+	t, ok := s.impl.(Target)
+	if !ok {
+		return ErrNotImplemented
+	}
+	r, err := t.Deliver(args)
+	if err != nil {
+		return err
+	}
+	*reply = r
+	return nil
+}
+
+func (s *service) Lookup(args LookupArgs, reply *LookupReply) error {
+	t, ok := s.impl.(Table)
+	if !ok {
+		return ErrNotImplemented
+	}
+	r, err := t.Lookup(args)
+	if err != nil {
+		return err
+	}
+	*reply = r
+	return nil
+}
+
+type stdio struct{}
+
+func (stdio) Read(b []byte) (int, error) {
+	return os.Stdin.Read(b)
+}
+
+func (stdio) Write(b []byte) (int, error) {
+	return os.Stdout.Write(b)
+}
+
+func (stdio) Close() error {
+	return os.Stdout.Close()
+}
+
+// Serve serves requests on the standard input and output until maddy
+// closes the standard input.
+//
+// impl should implement at least one of Check, Target or Table. Methods are
+// called concurrently.
+func Serve(impl interface{}) error {
+	return ServeConn(impl, stdio{})
+}
+
+// ServeConn is similar to Serve but uses the specified connection.
+func ServeConn(impl interface{}, conn io.ReadWriteCloser) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Plugin", &service{impl: impl}); err != nil {
+		return err
+	}
+	srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+	return nil
+}
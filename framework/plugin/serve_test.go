@@ -0,0 +1,64 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package plugin
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+)
+
+type tableOnly struct{}
+
+func (tableOnly) Lookup(args LookupArgs) (LookupReply, error) {
+	return LookupReply{Values: []string{args.Key + "-value"}}, nil
+}
+
+func TestServeConn(t *testing.T) {
+	srvConn, cliConn := net.Pipe()
+	go ServeConn(tableOnly{}, srvConn) //nolint:errcheck
+	cl := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(cliConn))
+	defer cl.Close()
+
+	var initReply InitReply
+	if err := cl.Call("Plugin.Init", InitArgs{ProtocolVersion: ProtocolVersion + 1}, &initReply); err == nil {
+		t.Error("expected an error for the wrong protocol version")
+	}
+	if err := cl.Call("Plugin.Init", InitArgs{ProtocolVersion: ProtocolVersion, Kind: KindTable}, &initReply); err != nil {
+		t.Fatal(err)
+	}
+	if initReply.ProtocolVersion != ProtocolVersion {
+		t.Errorf("wrong protocol version: %d", initReply.ProtocolVersion)
+	}
+
+	var lookupReply LookupReply
+	if err := cl.Call("Plugin.Lookup", LookupArgs{Key: "key"}, &lookupReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(lookupReply.Values) != 1 || lookupReply.Values[0] != "key-value" {
+		t.Errorf("wrong lookup reply: %v", lookupReply.Values)
+	}
+
+	var checkReply CheckReply
+	err := cl.Call("Plugin.Check", CheckArgs{}, &checkReply)
+	if err == nil || err.Error() != ErrNotImplemented.Error() {
+		t.Errorf("expected ErrNotImplemented, got %v", err)
+	}
+}
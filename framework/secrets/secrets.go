@@ -0,0 +1,263 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package secrets implements retrieval of secret values (such as passwords
+// and private keys) referenced from the configuration.
+//
+// References have the form secret://SOURCE/NAME, supported sources are:
+//
+//	secret://file/ABSOLUTE-PATH      - file that is not accessible by others
+//	secret://env/VARIABLE            - environment variable
+//	secret://systemd/NAME            - systemd credential (LoadCredential=)
+//	secret://vault/PATH#FIELD        - field of HashiCorp Vault secret
+//
+// Vault server address and token are taken from VAULT_ADDR and VAULT_TOKEN
+// (or VAULT_TOKEN_FILE) environment variables. VAULT_NAMESPACE and
+// VAULT_CACERT are also respected.
+package secrets
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const Prefix = "secret://"
+
+// IsRef reports whether s is a secret reference.
+func IsRef(s string) bool {
+	return strings.HasPrefix(s, Prefix)
+}
+
+// Resolver retrieves secret values. Vault responses are cached for the
+// lifetime of the Resolver so multiple fields of the same secret are fetched
+// only once.
+type Resolver struct {
+	// Environment variable lookup function, os.LookupEnv is used if nil.
+	LookupEnv func(string) (string, bool)
+
+	vaultCache map[string]map[string]interface{}
+}
+
+// Resolve returns the value referenced by ref.
+func (r *Resolver) Resolve(ctx context.Context, ref string) (string, error) {
+	if !IsRef(ref) {
+		return "", fmt.Errorf("secrets: not a secret reference: %s", ref)
+	}
+	source, name, _ := strings.Cut(strings.TrimPrefix(ref, Prefix), "/")
+	if name == "" {
+		return "", fmt.Errorf("secrets: missing secret name: %s", ref)
+	}
+
+	var (
+		val string
+		err error
+	)
+	switch source {
+	case "file":
+		val, err = readFile("/" + name)
+	case "env":
+		v, ok := r.lookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		val = v
+	case "systemd":
+		val, err = r.systemdCredential(name)
+	case "vault":
+		val, err = r.vault(ctx, name)
+	default:
+		err = fmt.Errorf("unknown secret source: %s", source)
+	}
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	return val, nil
+}
+
+func (r *Resolver) lookupEnv(name string) (string, bool) {
+	if r.LookupEnv != nil {
+		return r.LookupEnv(name)
+	}
+	return os.LookupEnv(name)
+}
+
+// readFile reads the secret from the file and makes sure it is not
+// accessible by other users.
+func readFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0o007 != 0 {
+		return "", fmt.Errorf("%s is accessible by other users (mode %v), use chmod o-rwx", path, info.Mode().Perm())
+	}
+
+	blob, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return trimNewline(string(blob)), nil
+}
+
+func (r *Resolver) systemdCredential(name string) (string, error) {
+	dir, ok := r.lookupEnv("CREDENTIALS_DIRECTORY")
+	if !ok || dir == "" {
+		return "", errors.New("CREDENTIALS_DIRECTORY is not set, is the credential configured in the service unit?")
+	}
+	if strings.Contains(name, "/") {
+		return "", errors.New("credential name can not contain slashes")
+	}
+	blob, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return trimNewline(string(blob)), nil
+}
+
+const vaultTimeout = 10 * time.Second
+
+func (r *Resolver) vault(ctx context.Context, name string) (string, error) {
+	path, field, ok := strings.Cut(name, "#")
+	if !ok || field == "" {
+		return "", errors.New("field name is required for vault secrets (vault/PATH#FIELD)")
+	}
+
+	data, ok := r.vaultCache[path]
+	if !ok {
+		var err error
+		data, err = r.vaultRead(ctx, path)
+		if err != nil {
+			return "", err
+		}
+		if r.vaultCache == nil {
+			r.vaultCache = make(map[string]map[string]interface{})
+		}
+		r.vaultCache[path] = data
+	}
+
+	val, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("no field %s in secret %s", field, path)
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s in secret %s is not a string", field, path)
+	}
+	return str, nil
+}
+
+func (r *Resolver) vaultRead(ctx context.Context, path string) (map[string]interface{}, error) {
+	addr, _ := r.lookupEnv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	token, _ := r.lookupEnv("VAULT_TOKEN")
+	if tokenFile, _ := r.lookupEnv("VAULT_TOKEN_FILE"); token == "" && tokenFile != "" {
+		blob, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(blob))
+	}
+	if token == "" {
+		return nil, errors.New("neither VAULT_TOKEN nor VAULT_TOKEN_FILE is set")
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("malformed VAULT_ADDR: %w", err)
+	}
+
+	client := &http.Client{Timeout: vaultTimeout}
+	if caFile, _ := r.lookupEnv("VAULT_CACERT"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("X-Vault-Request", "true")
+	if ns, _ := r.lookupEnv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("malformed vault response: %w", err)
+	}
+
+	// KV version 2 engine wraps the secret with metadata.
+	if inner, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, ok := body.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return body.Data, nil
+}
+
+func trimNewline(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
+
+// IsInlinePEM reports whether the value of the directive that normally
+// contains a file path is a PEM blob instead (e.g. a private key retrieved
+// from the secret store).
+func IsInlinePEM(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN ")
+}
@@ -0,0 +1,153 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testResolver(env map[string]string) *Resolver {
+	return &Resolver{
+		LookupEnv: func(name string) (string, bool) {
+			v, ok := env[name]
+			return v, ok
+		},
+	}
+}
+
+func TestResolve_File(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "password")
+	if err := os.WriteFile(path, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := testResolver(nil)
+	val, err := r.Resolve(context.Background(), "secret://file"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hunter2" {
+		t.Errorf("wrong value: %q", val)
+	}
+
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(context.Background(), "secret://file"+path); err == nil {
+		t.Error("world-readable file is accepted")
+	}
+}
+
+func TestResolve_Env(t *testing.T) {
+	r := testResolver(map[string]string{"DB_PASSWORD": "hunter2"})
+	val, err := r.Resolve(context.Background(), "secret://env/DB_PASSWORD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hunter2" {
+		t.Errorf("wrong value: %q", val)
+	}
+	if _, err := r.Resolve(context.Background(), "secret://env/MISSING"); err == nil {
+		t.Error("missing variable is accepted")
+	}
+	if _, err := r.Resolve(context.Background(), "secret://unknown/a"); err == nil {
+		t.Error("unknown source is accepted")
+	}
+}
+
+func TestResolve_Systemd(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "relay_password"), []byte("hunter2"), 0o400); err != nil {
+		t.Fatal(err)
+	}
+
+	r := testResolver(map[string]string{"CREDENTIALS_DIRECTORY": dir})
+	val, err := r.Resolve(context.Background(), "secret://systemd/relay_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hunter2" {
+		t.Errorf("wrong value: %q", val)
+	}
+	if _, err := r.Resolve(context.Background(), "secret://systemd/../relay_password"); err == nil {
+		t.Error("path traversal is not rejected")
+	}
+
+	if _, err := testResolver(nil).Resolve(context.Background(), "secret://systemd/relay_password"); err == nil {
+		t.Error("missing CREDENTIALS_DIRECTORY is not reported")
+	}
+}
+
+func TestResolve_Vault(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/maddy":
+			w.Write([]byte(`{"data":{"data":{"db_password":"hunter2","port":5432},"metadata":{"version":3}}}`))
+		case "/v1/kv1/maddy":
+			w.Write([]byte(`{"data":{"relay_password":"swordfish"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	r := testResolver(map[string]string{"VAULT_ADDR": srv.URL, "VAULT_TOKEN": "s.token"})
+	ctx := context.Background()
+
+	val, err := r.Resolve(ctx, "secret://vault/secret/data/maddy#db_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hunter2" {
+		t.Errorf("wrong KV v2 value: %q", val)
+	}
+	if _, err := r.Resolve(ctx, "secret://vault/secret/data/maddy#port"); err == nil {
+		t.Error("non-string field is accepted")
+	}
+	if requests != 1 {
+		t.Errorf("secret is fetched %d times, want 1", requests)
+	}
+
+	val, err = r.Resolve(ctx, "secret://vault/kv1/maddy#relay_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "swordfish" {
+		t.Errorf("wrong KV v1 value: %q", val)
+	}
+
+	if _, err := r.Resolve(ctx, "secret://vault/kv1/maddy"); err == nil {
+		t.Error("missing field name is accepted")
+	}
+	if _, err := r.Resolve(ctx, "secret://vault/kv1/missing#a"); err == nil {
+		t.Error("missing secret is accepted")
+	}
+}
@@ -0,0 +1,51 @@
+//go:build cgo && (linux || darwin || freebsd)
+// +build cgo
+// +build linux darwin freebsd
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"plugin"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// loadGoPlugin loads the Go plugin specified by the 'plugin' directive.
+//
+// Plugins are expected to register their modules using module.Register in
+// init functions, so loading the plugin is enough to make them available
+// in the configuration. Plugins should be built using the same Go version
+// and dependency versions as maddy itself.
+func loadGoPlugin(_ *config.Map, node config.Node) error {
+	if len(node.Args) != 1 {
+		return config.NodeErr(node, "exactly one argument required")
+	}
+	if len(node.Children) != 0 {
+		return config.NodeErr(node, "can't declare block here")
+	}
+
+	if _, err := plugin.Open(node.Args[0]); err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+	log.Debugf("loaded Go plugin %s", node.Args[0])
+	return nil
+}
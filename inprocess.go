@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+var (
+	inProcessLck     sync.Mutex
+	inProcessRunning bool
+)
+
+// StartInProcess creates and initializes all modules defined in cfg without
+// taking over the process: signals are not handled and service manager is
+// not notified. Endpoints accept connections once it returns.
+//
+// The returned function shuts the server down and resets the global module
+// registry so another instance can be started afterwards. Only one instance
+// can be running at a time since modules rely on global state.
+//
+// It is intended for integration tests.
+func StartInProcess(cfg []config.Node) (stop func(), err error) {
+	inProcessLck.Lock()
+	if inProcessRunning {
+		inProcessLck.Unlock()
+		return nil, errors.New("maddy: in-process server is already running")
+	}
+	inProcessRunning = true
+	inProcessLck.Unlock()
+
+	stop = func() {
+		hooks.RunHooks(hooks.EventShutdown)
+		hooks.Reset()
+		module.ResetInstances()
+		dns.SetDefaultCache(nil)
+		dns.SetLookupTimeout(0)
+
+		inProcessLck.Lock()
+		inProcessRunning = false
+		inProcessLck.Unlock()
+	}
+
+	if err := startModules(cfg); err != nil {
+		stop()
+		return nil, err
+	}
+	return stop, nil
+}
@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package audit implements the security event log.
+//
+// Audit events are written to a separate log output configured using the
+// audit_log directive. Unlike regular log messages, they are never filtered
+// by log levels and use a stable set of event names and fields, so the log
+// can be consumed by SIEM software and tools like fail2ban.
+package audit
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// Event names. These are part of the stable interface and should not be
+// changed.
+const (
+	AuthSuccess       = "auth.success"
+	AuthFailure       = "auth.failure"
+	AuthImpersonation = "auth.impersonation"
+	TLSDowngrade      = "tls.downgrade"
+	PolicyReject      = "policy.reject"
+	AdminCommand      = "admin.command"
+)
+
+var (
+	outLock sync.RWMutex
+	out     log.Output = log.NopOutput{}
+
+	authObserversLock sync.RWMutex
+	authObservers     []AuthObserver
+)
+
+// AuthObserver is notified about authentication attempts. Observers are
+// called even if the audit log is disabled and should not block.
+type AuthObserver interface {
+	AuthAttempt(endpoint string, srcAddr net.Addr, err error)
+}
+
+// AddAuthObserver registers the observer to be called by Auth.
+func AddAuthObserver(o AuthObserver) {
+	authObserversLock.Lock()
+	defer authObserversLock.Unlock()
+	authObservers = append(authObservers, o)
+}
+
+// RemoveAuthObserver removes the observer previously added using
+// AddAuthObserver.
+func RemoveAuthObserver(o AuthObserver) {
+	authObserversLock.Lock()
+	defer authObserversLock.Unlock()
+	for i, obs := range authObservers {
+		if obs == o {
+			authObservers = append(authObservers[:i:i], authObservers[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetOutput replaces the output used for audit events. nil disables the
+// audit log.
+func SetOutput(o log.Output) {
+	if o == nil {
+		o = log.NopOutput{}
+	}
+	outLock.Lock()
+	defer outLock.Unlock()
+	out = o
+}
+
+// Output returns the output currently used for audit events.
+func Output() log.Output {
+	outLock.RLock()
+	defer outLock.RUnlock()
+	return out
+}
+
+// Event writes the event to the audit log.
+//
+// fields should contain key strings followed by corresponding values,
+// as with log.Logger.Msg.
+func Event(name string, fields ...interface{}) {
+	o := Output()
+	if _, ok := o.(log.NopOutput); ok {
+		return
+	}
+
+	m := make(map[string]interface{}, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprint("field", i)
+		}
+		m[key] = fields[i+1]
+	}
+
+	log.WriteEntry(o, log.Entry{
+		Stamp:   time.Now(),
+		Level:   log.LevelInfo,
+		Module:  "audit",
+		Message: name,
+		Fields:  m,
+	})
+}
+
+func addrIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case nil:
+		return ""
+	default:
+		return addr.String()
+	}
+}
+
+// InboundPlaintext records the inbound session that started a mail
+// transaction without TLS while it was offered.
+func InboundPlaintext(endpoint string, srcAddr net.Addr, helo string) {
+	Event(TLSDowngrade,
+		"direction", "inbound",
+		"endpoint", endpoint,
+		"src_ip", addrIP(srcAddr),
+		"helo", helo,
+		"tls_level", "none",
+		"reason", "STARTTLS was not used")
+}
+
+// Auth records the result of the authentication attempt.
+//
+// endpoint is the name of the endpoint module instance (e.g. "submission").
+func Auth(endpoint, mech, username string, srcAddr net.Addr, err error) {
+	notifyAuthObservers(endpoint, srcAddr, err)
+
+	if err != nil {
+		Event(AuthFailure,
+			"endpoint", endpoint,
+			"mechanism", mech,
+			"username", username,
+			"src_ip", addrIP(srcAddr),
+			"reason", err.Error())
+		return
+	}
+	Event(AuthSuccess,
+		"endpoint", endpoint,
+		"mechanism", mech,
+		"username", username,
+		"src_ip", addrIP(srcAddr))
+}
+
+// Impersonation records the result of the authentication attempt by the
+// master user that requested to act as another account.
+//
+// Failures are recorded as auth.failure events with the additional
+// master_user field.
+func Impersonation(endpoint, mech, masterUser, username string, srcAddr net.Addr, err error) {
+	notifyAuthObservers(endpoint, srcAddr, err)
+
+	if err != nil {
+		Event(AuthFailure,
+			"endpoint", endpoint,
+			"mechanism", mech,
+			"username", username,
+			"master_user", masterUser,
+			"src_ip", addrIP(srcAddr),
+			"reason", err.Error())
+		return
+	}
+	Event(AuthImpersonation,
+		"endpoint", endpoint,
+		"mechanism", mech,
+		"username", username,
+		"master_user", masterUser,
+		"src_ip", addrIP(srcAddr))
+}
+
+func notifyAuthObservers(endpoint string, srcAddr net.Addr, err error) {
+	authObserversLock.RLock()
+	defer authObserversLock.RUnlock()
+	for _, obs := range authObservers {
+		obs.AuthAttempt(endpoint, srcAddr, err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestAuthEvents(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetOutput(log.JSONOutput(nopCloser{buf}))
+	defer SetOutput(nil)
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	Auth("submission", "PLAIN", "user@example.org", addr, nil)
+	Auth("imap", "LOGIN", "user@example.org", addr, errors.New("invalid credentials"))
+	Impersonation("imap", "PLAIN", "webmail", "user@example.org", addr, nil)
+
+	dec := json.NewDecoder(buf)
+	for _, expected := range []map[string]string{
+		{"msg": AuthSuccess, "endpoint": "submission", "mechanism": "PLAIN", "src_ip": "192.0.2.1"},
+		{"msg": AuthFailure, "endpoint": "imap", "mechanism": "LOGIN", "src_ip": "192.0.2.1", "reason": "invalid credentials"},
+		{"msg": AuthImpersonation, "endpoint": "imap", "username": "user@example.org", "master_user": "webmail"},
+	} {
+		ev := map[string]interface{}{}
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev["module"] != "audit" {
+			t.Errorf("wrong module: %v", ev["module"])
+		}
+		for k, v := range expected {
+			if ev[k] != v {
+				t.Errorf("%s: want %v, got %v", k, v, ev[k])
+			}
+		}
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	SetOutput(nil)
+	// Should not panic or write anywhere.
+	Event(AdminCommand, "command", "creds create")
+}
+
+type countingObserver struct {
+	failures int
+}
+
+func (o *countingObserver) AuthAttempt(_ string, _ net.Addr, err error) {
+	if err != nil {
+		o.failures++
+	}
+}
+
+func TestAuthObserver(t *testing.T) {
+	SetOutput(nil)
+	obs := &countingObserver{}
+	AddAuthObserver(obs)
+
+	Auth("imap", "PLAIN", "user@example.org", nil, errors.New("invalid credentials"))
+	Auth("imap", "PLAIN", "user@example.org", nil, nil)
+	if obs.failures != 1 {
+		t.Errorf("expected 1 failure, got %d", obs.failures)
+	}
+
+	RemoveAuthObserver(obs)
+	Auth("imap", "PLAIN", "user@example.org", nil, errors.New("invalid credentials"))
+	if obs.failures != 1 {
+		t.Errorf("observer called after removal")
+	}
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package external
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -89,13 +90,13 @@ func (ea *ExternalAuth) Init(cfg *config.Map) error {
 	return nil
 }
 
-func (ea *ExternalAuth) AuthPlain(username, password string) error {
+func (ea *ExternalAuth) AuthPlain(ctx context.Context, username, password string) error {
 	accountName, ok := auth.CheckDomainAuth(username, ea.perDomain, ea.domains)
 	if !ok {
 		return module.ErrUnknownCredentials
 	}
 
-	return AuthUsingHelper(ea.helperPath, accountName, password)
+	return AuthUsingHelper(ctx, ea.helperPath, accountName, password)
 }
 
 func init() {
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package external
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os/exec"
@@ -26,8 +27,8 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 )
 
-func AuthUsingHelper(binaryPath, accountName, password string) error {
-	cmd := exec.Command(binaryPath)
+func AuthUsingHelper(ctx context.Context, binaryPath, accountName, password string) error {
+	cmd := exec.CommandContext(ctx, binaryPath)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return fmt.Errorf("helperauth: stdin init: %w", err)
@@ -23,24 +23,38 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
 const (
 	HashSHA256 = "sha256"
 	HashBcrypt = "bcrypt"
 	HashArgon2 = "argon2"
+	HashScrypt = "scrypt"
+
+	// Verification-only schemes, used for hashes imported from other
+	// systems.
+	HashSHA256Crypt = "sha256-crypt"
+	HashSHA512Crypt = "sha512-crypt"
 
 	DefaultHash = HashBcrypt
 
 	Argon2Salt = 16
 	Argon2Size = 64
+
+	ScryptSalt = 16
+	ScryptSize = 32
 )
 
 type (
@@ -56,6 +70,10 @@ type (
 		Argon2Time    uint32
 		Argon2Memory  uint32
 		Argon2Threads uint8
+
+		ScryptN int
+		ScryptR int
+		ScryptP int
 	}
 
 	FuncHashCompute func(opts HashOpts, pass string) (string, error)
@@ -66,15 +84,33 @@ var (
 	HashCompute = map[string]FuncHashCompute{
 		HashBcrypt: computeBcrypt,
 		HashArgon2: computeArgon2,
+		HashScrypt: computeScrypt,
 	}
 	HashVerify = map[string]FuncHashVerify{
-		HashBcrypt: verifyBcrypt,
-		HashArgon2: verifyArgon2,
+		HashBcrypt:      verifyBcrypt,
+		HashArgon2:      verifyArgon2,
+		HashScrypt:      verifyScrypt,
+		HashSHA256Crypt: verifyCrypt,
+		HashSHA512Crypt: verifyCrypt,
 	}
 
-	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2}
+	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2, HashScrypt}
 )
 
+// DefaultHashOpts returns parameters used for new passwords unless
+// configured otherwise.
+func DefaultHashOpts() HashOpts {
+	return HashOpts{
+		BcryptCost:    bcrypt.DefaultCost,
+		Argon2Time:    3,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+		ScryptN:       32768,
+		ScryptR:       8,
+		ScryptP:       1,
+	}
+}
+
 func computeArgon2(opts HashOpts, pass string) (string, error) {
 	salt := make([]byte, Argon2Salt)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
@@ -97,6 +133,9 @@ func computeArgon2(opts HashOpts, pass string) (string, error) {
 
 func verifyArgon2(pass, hashSalt string) error {
 	parts := strings.SplitN(hashSalt, ":", 5)
+	if len(parts) != 5 {
+		return fmt.Errorf("pass_table: malformed hash string, expected 5 parts")
+	}
 
 	time, err := strconv.ParseUint(parts[0], 10, 32)
 	if err != nil {
@@ -119,7 +158,8 @@ func verifyArgon2(pass, hashSalt string) error {
 		return fmt.Errorf("pass_table: malformed hash string: %w", err)
 	}
 
-	passHash := argon2.IDKey([]byte(pass), salt, uint32(time), uint32(memory), uint8(threads), Argon2Size)
+	// Hashes imported from other systems may use a different key length.
+	passHash := argon2.IDKey([]byte(pass), salt, uint32(time), uint32(memory), uint8(threads), uint32(len(hash)))
 	if subtle.ConstantTimeCompare(passHash, hash) != 1 {
 		return fmt.Errorf("pass_table: hash mismatch")
 	}
@@ -174,6 +214,207 @@ func verifyBcrypt(pass, hashSalt string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashSalt), []byte(pass))
 }
 
+func computeScrypt(opts HashOpts, pass string) (string, error) {
+	salt := make([]byte, ScryptSalt)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", fmt.Errorf("pass_table: failed to generate salt: %w", err)
+	}
+
+	hash, err := scrypt.Key([]byte(pass), salt, opts.ScryptN, opts.ScryptR, opts.ScryptP, ScryptSize)
+	if err != nil {
+		return "", fmt.Errorf("pass_table: %w", err)
+	}
+	var out strings.Builder
+	out.WriteString(strconv.Itoa(opts.ScryptN))
+	out.WriteRune(':')
+	out.WriteString(strconv.Itoa(opts.ScryptR))
+	out.WriteRune(':')
+	out.WriteString(strconv.Itoa(opts.ScryptP))
+	out.WriteRune(':')
+	out.WriteString(base64.StdEncoding.EncodeToString(salt))
+	out.WriteRune(':')
+	out.WriteString(base64.StdEncoding.EncodeToString(hash))
+	return out.String(), nil
+}
+
+func verifyScrypt(pass, hashSalt string) error {
+	parts := strings.SplitN(hashSalt, ":", 5)
+	if len(parts) != 5 {
+		return fmt.Errorf("pass_table: malformed hash string, expected 5 parts")
+	}
+
+	var params [3]int
+	for i := range params {
+		val, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return fmt.Errorf("pass_table: malformed hash string: %w", err)
+		}
+		params[i] = val
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+	}
+
+	passHash, err := scrypt.Key([]byte(pass), salt, params[0], params[1], params[2], len(hash))
+	if err != nil {
+		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+	}
+	if subtle.ConstantTimeCompare(passHash, hash) != 1 {
+		return fmt.Errorf("pass_table: hash mismatch")
+	}
+	return nil
+}
+
+// verifyCrypt verifies hashes in crypt(3) format, such as SHA512-CRYPT
+// ("$6$...") used by Dovecot and system shadow files.
+func verifyCrypt(pass, hashSalt string) (err error) {
+	if !crypt.IsHashSupported(hashSalt) {
+		return fmt.Errorf("pass_table: unsupported crypt hash")
+	}
+
+	// crypt.NewFromHash may panic on malformed hash.
+	defer func() {
+		if rcvr := recover(); rcvr != nil {
+			err = fmt.Errorf("pass_table: malformed hash string: %v", rcvr)
+		}
+	}()
+
+	if err := crypt.NewFromHash(hashSalt).Verify(hashSalt, []byte(pass)); err != nil {
+		if errors.Is(err, crypt.ErrKeyMismatch) {
+			return fmt.Errorf("pass_table: hash mismatch")
+		}
+		return fmt.Errorf("pass_table: %w", err)
+	}
+	return nil
+}
+
+// NeedsRehash reports whether the stored hash (including the "scheme:"
+// prefix) should be recomputed to match the preferred function and
+// parameters.
+func NeedsRehash(storedHash, preferred string, opts HashOpts) bool {
+	parts := strings.SplitN(storedHash, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	if parts[0] != preferred {
+		return true
+	}
+
+	switch parts[0] {
+	case HashBcrypt:
+		cost, err := bcrypt.Cost([]byte(parts[1]))
+		return err == nil && cost < opts.BcryptCost
+	case HashArgon2:
+		params := strings.SplitN(parts[1], ":", 5)
+		if len(params) != 5 {
+			return false
+		}
+		return params[0] != strconv.FormatUint(uint64(opts.Argon2Time), 10) ||
+			params[1] != strconv.FormatUint(uint64(opts.Argon2Memory), 10) ||
+			params[2] != strconv.FormatUint(uint64(opts.Argon2Threads), 10)
+	case HashScrypt:
+		params := strings.SplitN(parts[1], ":", 5)
+		if len(params) != 5 {
+			return false
+		}
+		return params[0] != strconv.Itoa(opts.ScryptN) ||
+			params[1] != strconv.Itoa(opts.ScryptR) ||
+			params[2] != strconv.Itoa(opts.ScryptP)
+	}
+	return false
+}
+
+// FromDovecotHash converts the password hash in the Dovecot format
+// ("{SCHEME}hash") into the format used by pass_table ("scheme:hash").
+//
+// Supported schemes are BLF-CRYPT, SHA256-CRYPT, SHA512-CRYPT, ARGON2ID
+// and CRYPT if it contains one of former hashes.
+func FromDovecotHash(hash string) (string, error) {
+	if !strings.HasPrefix(hash, "{") {
+		return "", errors.New("pass_table: missing scheme prefix")
+	}
+	end := strings.IndexByte(hash, '}')
+	if end == -1 {
+		return "", errors.New("pass_table: malformed scheme prefix")
+	}
+	scheme, data := strings.ToUpper(hash[1:end]), hash[end+1:]
+
+	if scheme == "CRYPT" {
+		switch {
+		case strings.HasPrefix(data, "$2"):
+			scheme = "BLF-CRYPT"
+		case strings.HasPrefix(data, "$5$"):
+			scheme = "SHA256-CRYPT"
+		case strings.HasPrefix(data, "$6$"):
+			scheme = "SHA512-CRYPT"
+		default:
+			return "", errors.New("pass_table: unsupported CRYPT hash, only bcrypt and SHA-crypt are supported")
+		}
+	}
+
+	switch scheme {
+	case "BLF-CRYPT":
+		return HashBcrypt + ":" + data, nil
+	case "SHA256-CRYPT":
+		return HashSHA256Crypt + ":" + data, nil
+	case "SHA512-CRYPT":
+		return HashSHA512Crypt + ":" + data, nil
+	case "ARGON2ID":
+		return fromPHCArgon2(data)
+	default:
+		return "", fmt.Errorf("pass_table: unsupported scheme: %s", scheme)
+	}
+}
+
+// fromPHCArgon2 converts Argon2id hash in the PHC string format
+// ("$argon2id$v=19$m=65536,t=3,p=1$salt$hash") into the pass_table format.
+func fromPHCArgon2(data string) (string, error) {
+	parts := strings.Split(data, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return "", errors.New("pass_table: malformed argon2id hash")
+	}
+	if parts[2] != "v=19" {
+		return "", fmt.Errorf("pass_table: unsupported argon2id version: %s", parts[2])
+	}
+
+	var memory, time, threads string
+	for _, param := range strings.Split(parts[3], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return "", errors.New("pass_table: malformed argon2id parameters")
+		}
+		switch kv[0] {
+		case "m":
+			memory = kv[1]
+		case "t":
+			time = kv[1]
+		case "p":
+			threads = kv[1]
+		}
+	}
+	if memory == "" || time == "" || threads == "" {
+		return "", errors.New("pass_table: missing argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return "", fmt.Errorf("pass_table: malformed argon2id salt: %w", err)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return "", fmt.Errorf("pass_table: malformed argon2id hash: %w", err)
+	}
+
+	return HashArgon2 + ":" + time + ":" + memory + ":" + threads + ":" +
+		base64.StdEncoding.EncodeToString(salt) + ":" +
+		base64.StdEncoding.EncodeToString(hash), nil
+}
+
 func addSHA256() {
 	HashCompute[HashSHA256] = computeSHA256
 	HashVerify[HashSHA256] = verifySHA256
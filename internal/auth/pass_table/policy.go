@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package pass_table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrPasswordExpired is returned by AuthPlain if the password is correct but
+// older than allowed by the policy. ChangePassword can be used to set the new
+// one.
+var ErrPasswordExpired = errors.New("password expired")
+
+// PolicyError is returned when the new password does not satisfy the
+// configured policy.
+type PolicyError struct {
+	Reason string
+}
+
+func (err PolicyError) Error() string {
+	return "password policy: " + err.Reason
+}
+
+// Policy describes requirements for new passwords.
+type Policy struct {
+	MinLength int
+	// Minimal amount of character classes (lowercase and uppercase letters,
+	// digits, other characters) that should be present in the password.
+	MinClasses int
+	// Reject passwords containing the username (without the domain part).
+	RejectUsername bool
+
+	// Passwords older than MaxAge are not accepted for authentication.
+	// Zero means no expiry.
+	MaxAge time.Duration
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, ch := range password {
+		switch {
+		case unicode.IsLower(ch):
+			lower = true
+		case unicode.IsUpper(ch):
+			upper = true
+		case unicode.IsDigit(ch):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	count := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
+
+// Check returns PolicyError if the password does not satisfy the policy.
+func (p Policy) Check(username, password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return PolicyError{Reason: fmt.Sprintf("should be at least %d characters long", p.MinLength)}
+	}
+	if charClasses(password) < p.MinClasses {
+		return PolicyError{Reason: fmt.Sprintf("should contain at least %d of: lowercase letters, uppercase letters, digits, other characters", p.MinClasses)}
+	}
+	if p.RejectUsername {
+		localPart := username
+		if at := strings.LastIndexByte(username, '@'); at != -1 {
+			localPart = username[:at]
+		}
+		if localPart != "" && strings.Contains(strings.ToLower(password), strings.ToLower(localPart)) {
+			return PolicyError{Reason: "should not contain the username"}
+		}
+	}
+	return nil
+}
+
+// recordPasswordChange stores the time of the password change if password
+// metadata table is configured.
+func (a *Auth) recordPasswordChange(key string) error {
+	if a.changedTable == nil {
+		return nil
+	}
+	return a.changedTable.SetKey(key, strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// PasswordChanged returns the time of the last password change. ok is false
+// if it is not known, e.g. the metadata table is not configured or the
+// password was set before it was.
+func (a *Auth) PasswordChanged(ctx context.Context, key string) (changed time.Time, ok bool, err error) {
+	if a.changedTable == nil {
+		return time.Time{}, false, nil
+	}
+
+	val, ok, err := a.changedTable.Lookup(ctx, key)
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	ts, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s: malformed password change time for %s: %w", a.modName, key, err)
+	}
+	return time.Unix(ts, 0), true, nil
+}
+
+func (a *Auth) checkExpiry(ctx context.Context, key string) error {
+	if a.policy.MaxAge == 0 {
+		return nil
+	}
+
+	changed, ok, err := a.PasswordChanged(ctx, key)
+	if err != nil {
+		return err
+	}
+	if ok && time.Since(changed) > a.policy.MaxAge {
+		return ErrPasswordExpired
+	}
+	return nil
+}
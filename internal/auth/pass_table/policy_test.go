@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package pass_table
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestPolicy_Check(t *testing.T) {
+	p := Policy{MinLength: 8, MinClasses: 3, RejectUsername: true}
+
+	test := func(password string, ok bool) {
+		t.Helper()
+
+		err := p.Check("foxcpp@example.org", password)
+		if (err == nil) != ok {
+			t.Errorf("%q: ok=%v, err: %v", password, ok, err)
+		}
+		if err != nil && !errors.As(err, &PolicyError{}) {
+			t.Errorf("%q: not a PolicyError: %v", password, err)
+		}
+	}
+
+	test("Sh0rt", false)
+	test("longpassword", false)
+	test("LongPassword", false)
+	test("LongPassw0rd", true)
+	test("long passw0rd", true)
+	test("FoxCPP-passw0rd", false)
+	test("Пароль-2000", true)
+}
+
+func TestAuth_PasswordExpiry(t *testing.T) {
+	mod, err := New("pass_table", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.table = mapTable{m: map[string]string{}}
+	a.changedTable = mapTable{m: map[string]string{}}
+	a.policy = Policy{MinLength: 8, MaxAge: time.Hour}
+	a.hashOpts.BcryptCost = 4
+
+	if err := a.CreateUser("foxcpp", "short"); err == nil {
+		t.Fatal("policy is not enforced on user creation")
+	}
+	if err := a.CreateUser("foxcpp", "password1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain(context.Background(), "foxcpp", "password1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the password was set long ago.
+	old := strconv.FormatInt(time.Now().Add(-2*time.Hour).Unix(), 10)
+	if err := a.changedTable.SetKey("foxcpp", old); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain(context.Background(), "foxcpp", "password1"); !errors.Is(err, ErrPasswordExpired) {
+		t.Fatalf("expected ErrPasswordExpired, got %v", err)
+	}
+
+	if err := a.ChangePassword(context.Background(), "foxcpp", "wrong-password", "password2"); err == nil {
+		t.Fatal("password changed without the correct old password")
+	}
+	if err := a.ChangePassword(context.Background(), "foxcpp", "password1", "password1"); err == nil {
+		t.Fatal("password change to the same value accepted")
+	}
+	if err := a.ChangePassword(context.Background(), "foxcpp", "password1", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain(context.Background(), "foxcpp", "password2"); err != nil {
+		t.Fatal("authentication failed after the password change:", err)
+	}
+}
+
+func TestAuth_PolicyConfig(t *testing.T) {
+	mod, err := New("pass_table", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "table", Args: []string{"dummy"}},
+			{Name: "password_max_age", Args: []string{"720h"}},
+		},
+	}))
+	if err == nil {
+		t.Fatal("password_max_age without password_changed_table should be rejected")
+	}
+}
@@ -25,6 +25,7 @@ import (
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/secure/precis"
@@ -36,6 +37,19 @@ type Auth struct {
 	inlineArgs []string
 
 	table module.Table
+
+	// Hash function and parameters used for new passwords.
+	hash     string
+	hashOpts HashOpts
+	// Recompute hashes using other functions or parameters on successful
+	// authentication.
+	rehash bool
+
+	policy Policy
+	// Time of the last password change for each user, optional.
+	changedTable module.MutableTable
+
+	log log.Logger
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -43,6 +57,9 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 		modName:    modName,
 		instName:   instName,
 		inlineArgs: inlineArgs,
+		hash:       DefaultHash,
+		hashOpts:   DefaultHashOpts(),
+		log:        log.Logger{Name: modName},
 	}, nil
 }
 
@@ -51,9 +68,61 @@ func (a *Auth) Init(cfg *config.Map) error {
 		return modconfig.ModuleFromNode("table", a.inlineArgs, cfg.Block, cfg.Globals, &a.table)
 	}
 
+	var (
+		argon2Time    int
+		argon2Memory  int
+		argon2Threads int
+		changedTable  module.Table
+	)
+	defaults := DefaultHashOpts()
+	cfg.Bool("debug", true, false, &a.log.Debug)
 	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
-	_, err := cfg.Process()
-	return err
+	cfg.Enum("hash", false, false, Hashes, DefaultHash, &a.hash)
+	cfg.Int("bcrypt_cost", false, false, defaults.BcryptCost, &a.hashOpts.BcryptCost)
+	cfg.Int("argon2_time", false, false, int(defaults.Argon2Time), &argon2Time)
+	cfg.Int("argon2_memory", false, false, int(defaults.Argon2Memory), &argon2Memory)
+	cfg.Int("argon2_threads", false, false, int(defaults.Argon2Threads), &argon2Threads)
+	cfg.Int("scrypt_n", false, false, defaults.ScryptN, &a.hashOpts.ScryptN)
+	cfg.Int("scrypt_r", false, false, defaults.ScryptR, &a.hashOpts.ScryptR)
+	cfg.Int("scrypt_p", false, false, defaults.ScryptP, &a.hashOpts.ScryptP)
+	cfg.Bool("rehash", false, false, &a.rehash)
+	cfg.Int("password_min_length", false, false, 0, &a.policy.MinLength)
+	cfg.Int("password_min_classes", false, false, 0, &a.policy.MinClasses)
+	cfg.Bool("password_reject_username", false, false, &a.policy.RejectUsername)
+	cfg.Duration("password_max_age", false, false, 0, &a.policy.MaxAge)
+	cfg.Custom("password_changed_table", false, false, nil, modconfig.TableDirective, &changedTable)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if changedTable != nil {
+		mutable, ok := changedTable.(module.MutableTable)
+		if !ok {
+			return fmt.Errorf("%s: password_changed_table should be mutable", a.modName)
+		}
+		a.changedTable = mutable
+	}
+	if a.policy.MaxAge != 0 && a.changedTable == nil {
+		return fmt.Errorf("%s: password_max_age requires password_changed_table", a.modName)
+	}
+	if a.policy.MinClasses > 4 {
+		return fmt.Errorf("%s: password_min_classes can't be bigger than 4", a.modName)
+	}
+
+	if _, ok := HashCompute[a.hash]; !ok {
+		return fmt.Errorf("%s: hash function %s is not available", a.modName, a.hash)
+	}
+	if a.hashOpts.BcryptCost < bcrypt.MinCost || a.hashOpts.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("%s: bcrypt_cost should be in range %d-%d", a.modName, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if argon2Time <= 0 || argon2Memory <= 0 || argon2Threads <= 0 || argon2Threads > 255 {
+		return fmt.Errorf("%s: invalid argon2 parameters", a.modName)
+	}
+	a.hashOpts.Argon2Time = uint32(argon2Time)
+	a.hashOpts.Argon2Memory = uint32(argon2Memory)
+	a.hashOpts.Argon2Threads = uint8(argon2Threads)
+
+	return nil
 }
 
 func (a *Auth) Name() string {
@@ -73,19 +142,43 @@ func (a *Auth) Lookup(ctx context.Context, username string) (string, bool, error
 	return a.table.Lookup(ctx, key)
 }
 
-func (a *Auth) AuthPlain(username, password string) error {
+func (a *Auth) AuthPlain(ctx context.Context, username, password string) error {
 	key, err := precis.UsernameCaseMapped.CompareKey(username)
 	if err != nil {
 		return err
 	}
 
-	hash, ok, err := a.table.Lookup(context.TODO(), key)
-	if !ok {
-		return module.ErrUnknownCredentials
+	if err := a.verify(ctx, key, password); err != nil {
+		return err
+	}
+	return a.checkExpiry(ctx, key)
+}
+
+// ChangePassword sets the new password for the user after verifying the
+// current one. Unlike AuthPlain, it accepts expired passwords.
+func (a *Auth) ChangePassword(ctx context.Context, username, oldPassword, newPassword string) error {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return err
+	}
+
+	if err := a.verify(ctx, key, oldPassword); err != nil {
+		return err
 	}
+	if oldPassword == newPassword {
+		return PolicyError{Reason: "should be different from the current one"}
+	}
+	return a.SetUserPassword(username, newPassword)
+}
+
+func (a *Auth) verify(ctx context.Context, key, password string) error {
+	hash, ok, err := a.table.Lookup(ctx, key)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		return module.ErrUnknownCredentials
+	}
 
 	parts := strings.SplitN(hash, ":", 2)
 	if len(parts) != 2 {
@@ -95,7 +188,36 @@ func (a *Auth) AuthPlain(username, password string) error {
 	if hashVerify == nil {
 		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", a.modName, key, parts[0])
 	}
-	return hashVerify(password, parts[1])
+	if err := hashVerify(password, parts[1]); err != nil {
+		return err
+	}
+
+	if a.rehash && NeedsRehash(hash, a.hash, a.hashOpts) {
+		a.rehashUser(key, hash, password)
+	}
+	return nil
+}
+
+// rehashUser replaces the stored password hash with the one computed using
+// the preferred hash function. Failures are logged but otherwise ignored
+// since the authentication itself already succeeded.
+func (a *Auth) rehashUser(key, oldHash, password string) {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return
+	}
+
+	hash, err := HashCompute[a.hash](a.hashOpts, password)
+	if err != nil {
+		a.log.Error("rehash failed", err, "username", key)
+		return
+	}
+	if err := tbl.SetKey(key, a.hash+":"+hash); err != nil {
+		a.log.Error("rehash failed", err, "username", key)
+		return
+	}
+	a.log.Msg("password rehashed", "username", key,
+		"old_hash", strings.SplitN(oldHash, ":", 2)[0], "new_hash", a.hash)
 }
 
 func (a *Auth) ListUsers() ([]string, error) {
@@ -112,9 +234,7 @@ func (a *Auth) ListUsers() ([]string, error) {
 }
 
 func (a *Auth) CreateUser(username, password string) error {
-	return a.CreateUserHash(username, password, HashBcrypt, HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	})
+	return a.CreateUserHash(username, password, a.hash, a.hashOpts)
 }
 
 func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts HashOpts) error {
@@ -126,6 +246,9 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 	if _, ok := HashCompute[hashAlgo]; !ok {
 		return fmt.Errorf("%s: unknown hash function: %v", a.modName, hashAlgo)
 	}
+	if err := a.policy.Check(username, password); err != nil {
+		return err
+	}
 
 	key, err := precis.UsernameCaseMapped.CompareKey(username)
 	if err != nil {
@@ -148,6 +271,45 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 	if err := tbl.SetKey(key, hashAlgo+":"+hash); err != nil {
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
+	if err := a.recordPasswordChange(key); err != nil {
+		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
+	}
+	return nil
+}
+
+// CreateUserPrehashed creates the user using the already computed password
+// hash. The hash should be in the same format as stored in the table, that
+// is, prefixed with the hash function name (e.g. "bcrypt:...").
+func (a *Auth) CreateUserPrehashed(username, hash string) error {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
+	}
+
+	parts := strings.SplitN(hash, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%s: create user %s: no hash tag", a.modName, username)
+	}
+	if _, ok := HashVerify[parts[0]]; !ok {
+		return fmt.Errorf("%s: create user %s: unknown hash function: %v", a.modName, username, parts[0])
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: create user %s (raw): %w", a.modName, username, err)
+	}
+
+	_, ok, err = tbl.Lookup(context.TODO(), key)
+	if err != nil {
+		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
+	}
+	if ok {
+		return fmt.Errorf("%s: credentials for %s already exist", a.modName, key)
+	}
+
+	if err := tbl.SetKey(key, hash); err != nil {
+		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
+	}
 	return nil
 }
 
@@ -161,16 +323,19 @@ func (a *Auth) SetUserPassword(username, password string) error {
 	if err != nil {
 		return fmt.Errorf("%s: set password %s (raw): %w", a.modName, username, err)
 	}
+	if err := a.policy.Check(username, password); err != nil {
+		return err
+	}
 
-	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	hash, err := HashCompute[a.hash](a.hashOpts, password)
 	if err != nil {
 		return fmt.Errorf("%s: set password %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, a.hash+":"+hash); err != nil {
+		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
+	}
+	if err := a.recordPasswordChange(key); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
 	return nil
@@ -190,6 +355,11 @@ func (a *Auth) DeleteUser(username string) error {
 	if err := tbl.RemoveKey(key); err != nil {
 		return fmt.Errorf("%s: del user %s: %w", a.modName, key, err)
 	}
+	if a.changedTable != nil {
+		if err := a.changedTable.RemoveKey(key); err != nil {
+			return fmt.Errorf("%s: del user %s: %w", a.modName, key, err)
+		}
+	}
 	return nil
 }
 
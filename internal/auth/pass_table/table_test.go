@@ -19,10 +19,17 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/argon2"
 )
 
 func TestAuth_AuthPlain(t *testing.T) {
@@ -50,7 +57,7 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check := func(user, pass string, ok bool) {
 		t.Helper()
 
-		err := a.AuthPlain(user, pass)
+		err := a.AuthPlain(context.Background(), user, pass)
 		if (err == nil) != ok {
 			t.Errorf("ok=%v, err: %v", ok, err)
 		}
@@ -62,3 +69,192 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+type mapTable struct {
+	m map[string]string
+}
+
+func (t mapTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	val, ok := t.m[key]
+	return val, ok, nil
+}
+
+func (t mapTable) LookupMulti(_ context.Context, key string) ([]string, error) {
+	val, ok := t.m[key]
+	if !ok {
+		return nil, nil
+	}
+	return []string{val}, nil
+}
+
+func (t mapTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t.m))
+	for k := range t.m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t mapTable) SetKey(key, value string) error {
+	t.m[key] = value
+	return nil
+}
+
+func (t mapTable) RemoveKey(key string) error {
+	delete(t.m, key)
+	return nil
+}
+
+func TestAuth_Rehash(t *testing.T) {
+	addSHA256()
+
+	mod, err := New("pass_table", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.rehash = true
+	tbl := mapTable{m: map[string]string{
+		"foxcpp": "sha256:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=",
+	}}
+	a.table = tbl
+
+	if err := a.AuthPlain(context.Background(), "foxcpp", "different-password"); err == nil {
+		t.Fatal("expected failure for the wrong password")
+	}
+	if !strings.HasPrefix(tbl.m["foxcpp"], "sha256:") {
+		t.Fatal("hash changed after failed authentication")
+	}
+
+	if err := a.AuthPlain(context.Background(), "foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.m["foxcpp"], "bcrypt:") {
+		t.Fatalf("hash was not upgraded: %s", tbl.m["foxcpp"])
+	}
+	if err := a.AuthPlain(context.Background(), "foxcpp", "password"); err != nil {
+		t.Fatal("authentication failed after rehash:", err)
+	}
+}
+
+func TestAuth_NoRehashByDefault(t *testing.T) {
+	mod, err := New("pass_table", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+
+	hash, err := computeArgon2(DefaultHashOpts(), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mapTable{m: map[string]string{
+		"foxcpp": HashArgon2 + ":" + hash,
+	}}
+	a.table = tbl
+
+	if err := a.AuthPlain(context.Background(), "foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if tbl.m["foxcpp"] != HashArgon2+":"+hash {
+		t.Fatalf("hash was changed: %s", tbl.m["foxcpp"])
+	}
+}
+
+func TestAuth_LookupError(t *testing.T) {
+	mod, err := New("pass_table", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.table = testutils.Table{Err: errors.New("table is down")}
+
+	err = a.AuthPlain(context.Background(), "foxcpp", "password")
+	if err == nil {
+		t.Fatal("expected failure")
+	}
+	if errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("lookup error reported as unknown credentials")
+	}
+}
+
+func TestHash_Scrypt(t *testing.T) {
+	opts := DefaultHashOpts()
+	opts.ScryptN = 1024
+
+	hash, err := computeScrypt(opts, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyScrypt("password", hash); err != nil {
+		t.Error("correct password rejected:", err)
+	}
+	if err := verifyScrypt("different-password", hash); err == nil {
+		t.Error("wrong password accepted")
+	}
+
+	if NeedsRehash(HashScrypt+":"+hash, HashScrypt, opts) {
+		t.Error("rehash requested for the hash with preferred parameters")
+	}
+	if !NeedsRehash(HashScrypt+":"+hash, HashScrypt, DefaultHashOpts()) {
+		t.Error("rehash not requested for the hash with different parameters")
+	}
+}
+
+func TestFromDovecotHash(t *testing.T) {
+	test := func(in, pass string) {
+		t.Helper()
+
+		hash, err := FromDovecotHash(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			return
+		}
+		parts := strings.SplitN(hash, ":", 2)
+		verify := HashVerify[parts[0]]
+		if verify == nil {
+			t.Errorf("%s: unknown hash: %s", in, parts[0])
+			return
+		}
+		if err := verify(pass, parts[1]); err != nil {
+			t.Errorf("%s: correct password rejected: %v", in, err)
+		}
+		if err := verify("wrong-"+pass, parts[1]); err == nil {
+			t.Errorf("%s: wrong password accepted", in)
+		}
+	}
+
+	const sha512Crypt = "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"
+	test("{SHA512-CRYPT}"+sha512Crypt, "password")
+	test("{CRYPT}"+sha512Crypt, "password")
+	test("{BLF-CRYPT}$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa", "password")
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	key := argon2.IDKey([]byte("password"), salt, 2, 64, 1, 32)
+	test("{ARGON2ID}$argon2id$v=19$m=64,t=2,p=1$"+
+		base64.RawStdEncoding.EncodeToString(salt)+"$"+
+		base64.RawStdEncoding.EncodeToString(key), "password")
+
+	for _, in := range []string{
+		"$6$saltsalt$abc",
+		"{PLAIN}password",
+		"{CRYPT}abJnggxhB/yWI",
+		"{ARGON2ID}$argon2id$v=16$m=64,t=2,p=1$c2FsdA$aGFzaA",
+	} {
+		if _, err := FromDovecotHash(in); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
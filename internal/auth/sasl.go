@@ -23,18 +23,22 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
 	"github.com/foxcpp/maddy/internal/authz"
 )
 
 var (
 	ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
 	ErrInvalidAuthCred = errors.New("auth: invalid credentials")
+	ErrProtocolDenied  = errors.New("auth: protocol is not allowed for the account")
+	ErrNotMasterUser   = errors.New("auth: account is not allowed to log in as other accounts")
 )
 
 // SASLAuth is a wrapper that initializes sasl.Server using authenticators that
@@ -49,9 +53,33 @@ type SASLAuth struct {
 	Log         log.Logger
 	OnlyFirstID bool
 
+	// Endpoint is the name of the endpoint using the SASLAuth, it is
+	// recorded in the audit log.
+	Endpoint string
+
 	AuthMap       module.Table
 	AuthNormalize authz.NormalizeFunc
 
+	// AccountProtocols maps the account name to the list of endpoints
+	// (e.g. "imap submission") it is allowed to authenticate on. Accounts
+	// missing from the table are not restricted. May be nil.
+	AccountProtocols module.Table
+
+	// MasterUsers contains accounts that are allowed to log in as any other
+	// account by specifying it as the authorization identity (e.g. webmail
+	// backends or migration tools). Only the presence of the key is
+	// checked. May be nil.
+	MasterUsers module.Table
+
+	// MasterSeparator allows master users to specify the account to log in
+	// as using "account<separator>master" as the username. It is useful for
+	// mechanisms and commands that have no authorization identity (LOGIN).
+	// Empty string disables the syntax.
+	MasterSeparator string
+
+	// DisabledMechs contains SASL mechanisms that should not be offered.
+	DisabledMechs map[string]struct{}
+
 	Plain []module.PlainAuth
 }
 
@@ -59,12 +87,40 @@ func (s *SASLAuth) SASLMechanisms() []string {
 	var mechs []string
 
 	if len(s.Plain) != 0 {
-		mechs = append(mechs, sasl.Plain, sasl.Login)
+		for _, mech := range []string{sasl.Plain, sasl.Login} {
+			if _, disabled := s.DisabledMechs[mech]; !disabled {
+				mechs = append(mechs, mech)
+			}
+		}
 	}
 
 	return mechs
 }
 
+// checkProtocol returns ErrProtocolDenied if the account is not allowed to
+// authenticate on the endpoint.
+func (s *SASLAuth) checkProtocol(ctx context.Context, username string) error {
+	if s.AccountProtocols == nil {
+		return nil
+	}
+
+	val, ok, err := s.AccountProtocols.Lookup(ctx, username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	for _, proto := range strings.FieldsFunc(val, func(r rune) bool {
+		return r == ' ' || r == ','
+	}) {
+		if proto == s.Endpoint {
+			return nil
+		}
+	}
+	return ErrProtocolDenied
+}
+
 func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (string, error) {
 	if s.AuthNormalize != nil {
 		var err error
@@ -93,40 +149,93 @@ func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (st
 	return mapped, nil
 }
 
-func (s *SASLAuth) AuthPlain(username, password string) error {
+func (s *SASLAuth) AuthPlain(ctx context.Context, username, password string) error {
 	if len(s.Plain) == 0 {
 		return ErrUnsupportedMech
 	}
 
 	var lastErr error
 	for _, p := range s.Plain {
-		username, err := s.usernameForAuth(context.TODO(), username)
+		username, err := s.usernameForAuth(ctx, username)
 		if err != nil {
 			return err
 		}
 
-		lastErr = p.AuthPlain(username, password)
+		lastErr = p.AuthPlain(ctx, username, password)
 		if lastErr == nil {
-			return nil
+			return s.checkProtocol(ctx, username)
 		}
 	}
 
 	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
+// isMasterUser checks whether the authenticated account can log in as other
+// accounts.
+func (s *SASLAuth) isMasterUser(ctx context.Context, username string) (bool, error) {
+	if s.MasterUsers == nil {
+		return false, nil
+	}
+
+	username, err := s.usernameForAuth(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	_, ok, err := s.MasterUsers.Lookup(ctx, username)
+	return ok, err
+}
+
+// Authenticate checks the credentials and returns the identity the client
+// should be logged in as. The attempt is recorded in the audit log.
+//
+// authzid is the authorization identity requested by the client, empty if it
+// was not specified. If it is different from authcid, the authenticated
+// account should be listed in MasterUsers.
+func (s *SASLAuth) Authenticate(ctx context.Context, mech string, remoteAddr net.Addr, authzid, authcid, password string) (string, error) {
+	if authzid == "" && s.MasterSeparator != "" && s.MasterUsers != nil {
+		if idx := strings.LastIndex(authcid, s.MasterSeparator); idx > 0 {
+			authzid = authcid[:idx]
+			authcid = authcid[idx+len(s.MasterSeparator):]
+		}
+	}
+	if authzid == "" || authzid == authcid {
+		err := s.AuthPlain(ctx, authcid, password)
+		audit.Auth(s.Endpoint, mech, authcid, remoteAddr, err)
+		if err != nil {
+			return "", err
+		}
+		return authcid, nil
+	}
+
+	err := s.AuthPlain(ctx, authcid, password)
+	if err == nil {
+		var isMaster bool
+		isMaster, err = s.isMasterUser(ctx, authcid)
+		if err == nil && !isMaster {
+			err = ErrNotMasterUser
+		}
+	}
+	if err == nil {
+		err = s.checkProtocol(ctx, authzid)
+	}
+	audit.Impersonation(s.Endpoint, mech, authcid, authzid, remoteAddr, err)
+	if err != nil {
+		return "", err
+	}
+
+	s.Log.Msg("master user logged in as another account", "master_user", authcid, "username", authzid, "src_ip", remoteAddr)
+	return authzid, nil
+}
+
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
-func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(identity string) error) sasl.Server {
+//
+// ctx is passed to the authentication providers and should be cancelled when
+// the client connection is closed.
+func (s *SASLAuth) CreateSASL(ctx context.Context, mech string, remoteAddr net.Addr, successCb func(identity string) error) sasl.Server {
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
-			if identity == "" {
-				identity = username
-			}
-			if identity != username {
-				return ErrInvalidAuthCred
-			}
-
-			err := s.AuthPlain(username, password)
+			identity, err := s.Authenticate(ctx, mech, remoteAddr, identity, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
 				return ErrInvalidAuthCred
@@ -136,13 +245,13 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 		})
 	case sasl.Login:
 		return sasl.NewLoginServer(func(username, password string) error {
-			err := s.AuthPlain(username, password)
+			identity, err := s.Authenticate(ctx, mech, remoteAddr, "", username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
 				return ErrInvalidAuthCred
 			}
 
-			return successCb(username)
+			return successCb(identity)
 		})
 	}
 	return FailingSASLServ{Err: ErrUnsupportedMech}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package auth
 
 import (
+	"context"
 	"errors"
 	"net"
 	"testing"
@@ -31,7 +32,7 @@ type mockAuth struct {
 	db map[string]bool
 }
 
-func (m mockAuth) AuthPlain(username, _ string) error {
+func (m mockAuth) AuthPlain(_ context.Context, username, _ string) error {
 	ok := m.db[username]
 	if !ok {
 		return errors.New("invalid creds")
@@ -52,7 +53,7 @@ func TestCreateSASL(t *testing.T) {
 	}
 
 	t.Run("XWHATEVER", func(t *testing.T) {
-		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, func(string) error { return nil })
+		srv := a.CreateSASL(context.Background(), "XWHATEVER", &net.TCPAddr{}, func(string) error { return nil })
 		_, _, err := srv.Next([]byte(""))
 		if err == nil {
 			t.Error("No error for XWHATEVER use")
@@ -60,7 +61,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+		srv := a.CreateSASL(context.Background(), "PLAIN", &net.TCPAddr{}, func(id string) error {
 			if id != "user1" {
 				t.Fatal("Wrong auth. identities passed to callback:", id)
 			}
@@ -74,7 +75,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN with authorization identity", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+		srv := a.CreateSASL(context.Background(), "PLAIN", &net.TCPAddr{}, func(id string) error {
 			if id != "user1" {
 				t.Fatal("Wrong authorization identity passed:", id)
 			}
@@ -87,3 +88,127 @@ func TestCreateSASL(t *testing.T) {
 		}
 	})
 }
+
+func TestSASLAuth_AccountProtocols(t *testing.T) {
+	a := SASLAuth{
+		Log:      testutils.Logger(t, "saslauth"),
+		Endpoint: "imap",
+		AccountProtocols: testutils.Table{
+			M: map[string]string{
+				"submission-only": "submission",
+				"imap-and-smtp":   "imap, submission",
+				"disabled":        "",
+			},
+		},
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1":           true,
+					"submission-only": true,
+					"imap-and-smtp":   true,
+					"disabled":        true,
+				},
+			},
+		},
+	}
+
+	test := func(username string, expectErr error) {
+		t.Helper()
+
+		err := a.AuthPlain(context.Background(), username, "")
+		if !errors.Is(err, expectErr) {
+			t.Errorf("%s: expected %v, got %v", username, expectErr, err)
+		}
+	}
+
+	test("user1", nil)
+	test("imap-and-smtp", nil)
+	test("submission-only", ErrProtocolDenied)
+	test("disabled", ErrProtocolDenied)
+}
+
+func TestSASLAuth_DisabledMechs(t *testing.T) {
+	a := SASLAuth{
+		DisabledMechs: map[string]struct{}{"LOGIN": {}},
+		Plain:         []module.PlainAuth{&mockAuth{}},
+	}
+
+	mechs := a.SASLMechanisms()
+	if len(mechs) != 1 || mechs[0] != "PLAIN" {
+		t.Errorf("unexpected mechanisms: %v", mechs)
+	}
+}
+
+func TestSASLAuth_MasterUsers(t *testing.T) {
+	a := SASLAuth{
+		Log:      testutils.Logger(t, "saslauth"),
+		Endpoint: "imap",
+		MasterUsers: testutils.Table{
+			M: map[string]string{
+				"master": "",
+			},
+		},
+		MasterSeparator: "*",
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1":  true,
+					"user2":  true,
+					"master": true,
+				},
+			},
+		},
+	}
+
+	test := func(authzid, authcid, expectID string, expectErr error) {
+		t.Helper()
+
+		id, err := a.Authenticate(context.Background(), "PLAIN", &net.TCPAddr{}, authzid, authcid, "")
+		if expectErr != nil {
+			if !errors.Is(err, expectErr) {
+				t.Errorf("%s/%s: expected %v, got %v", authzid, authcid, expectErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error: %v", authzid, authcid, err)
+			return
+		}
+		if id != expectID {
+			t.Errorf("%s/%s: expected identity %s, got %s", authzid, authcid, expectID, id)
+		}
+	}
+
+	test("", "user1", "user1", nil)
+	test("user1", "user1", "user1", nil)
+	test("user2", "master", "user2", nil)
+	test("", "user2*master", "user2", nil)
+	test("user2", "user1", "", ErrNotMasterUser)
+	test("", "user2*user1", "", ErrNotMasterUser)
+
+	t.Run("PLAIN", func(t *testing.T) {
+		srv := a.CreateSASL(context.Background(), "PLAIN", &net.TCPAddr{}, func(id string) error {
+			if id != "user1" {
+				t.Fatal("Wrong authorization identity passed:", id)
+			}
+			return nil
+		})
+
+		_, _, err := srv.Next([]byte("user1\x00master\x00aa"))
+		if err != nil {
+			t.Error("Unexpected error:", err)
+		}
+	})
+
+	t.Run("PLAIN without master user", func(t *testing.T) {
+		srv := a.CreateSASL(context.Background(), "PLAIN", &net.TCPAddr{}, func(id string) error {
+			t.Fatal("Callback called for unauthorized identity:", id)
+			return nil
+		})
+
+		_, _, err := srv.Next([]byte("user1\x00user2\x00aa"))
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
@@ -8,23 +8,32 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 )
 
-func AuthorizeEmailUse(ctx context.Context, username string, addrs []string, mapping module.Table) (bool, error) {
-	var validEmails []string
-
+// Addresses returns the list of addresses the user is allowed to use
+// according to the mapping table. Values can also be domain names or "*",
+// see AuthorizeEmailUse.
+func Addresses(ctx context.Context, username string, mapping module.Table) ([]string, error) {
 	if multi, ok := mapping.(module.MultiTable); ok {
-		var err error
-		validEmails, err = multi.LookupMulti(ctx, username)
+		validEmails, err := multi.LookupMulti(ctx, username)
 		if err != nil {
-			return false, fmt.Errorf("authz: %w", err)
-		}
-	} else {
-		validEmail, ok, err := mapping.Lookup(ctx, username)
-		if err != nil {
-			return false, fmt.Errorf("authz: %w", err)
-		}
-		if ok {
-			validEmails = []string{validEmail}
+			return nil, fmt.Errorf("authz: %w", err)
 		}
+		return validEmails, nil
+	}
+
+	validEmail, ok, err := mapping.Lookup(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("authz: %w", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	return []string{validEmail}, nil
+}
+
+func AuthorizeEmailUse(ctx context.Context, username string, addrs []string, mapping module.Table) (bool, error) {
+	validEmails, err := Addresses(ctx, username, mapping)
+	if err != nil {
+		return false, err
 	}
 
 	for _, addr := range addrs {
@@ -0,0 +1,380 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package access implements the check.access module that applies
+// allow and deny lists to the client IP, HELO hostname, sender and
+// recipient addresses.
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.access"
+
+// action is the decision taken for a matching list entry.
+type action struct {
+	accept bool
+	fail   modconfig.FailAction
+}
+
+func parseAction(args []string) (action, error) {
+	if len(args) == 0 {
+		return action{}, errors.New("missing action")
+	}
+	if args[0] == "accept" {
+		if len(args) != 1 {
+			return action{}, errors.New("accept action takes no arguments")
+		}
+		return action{accept: true}, nil
+	}
+
+	fail, err := modconfig.ParseActionDirective(args)
+	if err != nil {
+		return action{}, err
+	}
+	return action{fail: fail}, nil
+}
+
+// parseTableAction parses the action stored as a table value using the
+// configuration syntax, e.g. `reject 550 5.7.1 "Go away"`.
+func parseTableAction(value string) (action, error) {
+	nodes, err := parser.Read(strings.NewReader(value), "table value")
+	if err != nil {
+		return action{}, err
+	}
+	if len(nodes) != 1 || len(nodes[0].Children) != 0 {
+		return action{}, errors.New("expected a single action")
+	}
+	return parseAction(append([]string{nodes[0].Name}, nodes[0].Args...))
+}
+
+type netEntry struct {
+	net    *net.IPNet
+	action action
+}
+
+// list is a set of entries for a single lookup key kind.
+type list struct {
+	name    string
+	entries map[string]action
+	nets    []netEntry
+	table   module.Table
+}
+
+func (l *list) lookupKey(ctx context.Context, key string) (action, bool, error) {
+	if a, ok := l.entries[key]; ok {
+		return a, true, nil
+	}
+	if l.table == nil {
+		return action{}, false, nil
+	}
+
+	val, ok, err := l.table.Lookup(ctx, key)
+	if err != nil || !ok {
+		return action{}, false, err
+	}
+	a, err := parseTableAction(val)
+	if err != nil {
+		return action{}, false, fmt.Errorf("invalid action for %s in %s table: %w", key, l.name, err)
+	}
+	return a, true, nil
+}
+
+// lookup returns the action for the first key that matches. Keys should be
+// ordered from the most specific to the least specific one.
+func (l *list) lookup(ctx context.Context, keys []string) (action, string, bool, error) {
+	for _, key := range keys {
+		a, ok, err := l.lookupKey(ctx, key)
+		if err != nil {
+			return action{}, key, false, err
+		}
+		if ok {
+			return a, key, true, nil
+		}
+	}
+	return action{}, "", false, nil
+}
+
+func (l *list) lookupIP(ctx context.Context, ip net.IP) (action, string, bool, error) {
+	a, key, ok, err := l.lookup(ctx, []string{ip.String()})
+	if err != nil || ok {
+		return a, key, ok, err
+	}
+	for _, e := range l.nets {
+		if e.net.Contains(ip) {
+			return e.action, e.net.String(), true, nil
+		}
+	}
+	return action{}, "", false, nil
+}
+
+// domainKeys returns lookup keys for the domain: the domain itself followed
+// by wildcards from the most specific to the least specific one.
+func domainKeys(domain string) []string {
+	return append([]string{domain}, dns.WildcardMatches(domain)...)
+}
+
+// addressKeys returns lookup keys for the address: the full address
+// followed by domain keys.
+func addressKeys(addr string) []string {
+	if addr == "" {
+		return []string{"<>"}
+	}
+	norm, err := address.ForLookup(addr)
+	if err != nil {
+		return nil
+	}
+	_, domain, err := address.Split(norm)
+	if err != nil || domain == "" {
+		return []string{norm}
+	}
+	return append([]string{norm}, domainKeys(domain)...)
+}
+
+func heloKeys(hostname string) []string {
+	norm, err := dns.ForLookup(hostname)
+	if err != nil {
+		// Likely an address literal.
+		return []string{strings.ToLower(hostname)}
+	}
+	return domainKeys(norm)
+}
+
+func normalizeEntry(kind, entry string) (string, error) {
+	switch {
+	case kind == "sender" && entry == "<>":
+		return entry, nil
+	case kind != "helo" && strings.Contains(entry, "@"):
+		return address.ForLookup(entry)
+	case strings.HasPrefix(entry, "*."):
+		norm, err := dns.ForLookup(entry[2:])
+		return "*." + norm, err
+	default:
+		return dns.ForLookup(entry)
+	}
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	client list
+	helo   list
+	sender list
+	rcpt   list
+
+	errAction modconfig.FailAction
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+	for name, l := range map[string]*list{
+		"client": &c.client,
+		"helo":   &c.helo,
+		"sender": &c.sender,
+		"rcpt":   &c.rcpt,
+	} {
+		l.name = name
+		l.entries = map[string]action{}
+	}
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) entryDirective(l *list) func(*config.Map, config.Node) error {
+	return func(_ *config.Map, node config.Node) error {
+		if len(node.Children) != 0 {
+			return config.NodeErr(node, "can't declare block here")
+		}
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected at least 2 arguments")
+		}
+		a, err := parseAction(node.Args[1:])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+
+		if l == &c.client {
+			if _, ipNet, err := net.ParseCIDR(node.Args[0]); err == nil {
+				l.nets = append(l.nets, netEntry{net: ipNet, action: a})
+				return nil
+			}
+			ip := net.ParseIP(node.Args[0])
+			if ip == nil {
+				return config.NodeErr(node, "invalid IP address or network: %s", node.Args[0])
+			}
+			if _, ok := l.entries[ip.String()]; ok {
+				return config.NodeErr(node, "duplicate entry: %s", node.Args[0])
+			}
+			l.entries[ip.String()] = a
+			return nil
+		}
+
+		key, err := normalizeEntry(l.name, node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "invalid entry: %s: %v", node.Args[0], err)
+		}
+		if _, ok := l.entries[key]; ok {
+			return config.NodeErr(node, "duplicate entry: %s", node.Args[0])
+		}
+		l.entries[key] = a
+		return nil
+	}
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	for _, l := range []*list{&c.client, &c.helo, &c.sender, &c.rcpt} {
+		cfg.Callback(l.name, c.entryDirective(l))
+		cfg.Custom(l.name+"_table", false, false, nil, modconfig.TableDirective, &l.table)
+	}
+	cfg.Custom("err_action", false, false, func() (interface{}, error) {
+		return modconfig.FailAction{Reject: true}, nil
+	}, modconfig.FailActionDirective, &c.errAction)
+
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) result(l *list, key string, a action, lookupErr error) module.CheckResult {
+	if lookupErr != nil {
+		return s.c.errAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         454,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          lookupErr,
+				Misc: map[string]interface{}{
+					"list": l.name,
+					"key":  key,
+				},
+			}})
+	}
+
+	if a.accept {
+		s.log.DebugMsg("accepted", "list", l.name, "key", key)
+		return module.CheckResult{Accept: true}
+	}
+	if !a.fail.Reject && !a.fail.Quarantine {
+		s.log.DebugMsg("ignored", "list", l.name, "key", key)
+		return module.CheckResult{}
+	}
+	return a.fail.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Access denied",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"list": l.name,
+				"key":  key,
+			},
+		}})
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		return module.CheckResult{}
+	}
+
+	if tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		a, key, ok, err := s.c.client.lookupIP(ctx, tcpAddr.IP)
+		if err != nil || ok {
+			return s.result(&s.c.client, key, a, err)
+		}
+	}
+
+	if s.msgMeta.Conn.Hostname != "" {
+		a, key, ok, err := s.c.helo.lookup(ctx, heloKeys(s.msgMeta.Conn.Hostname))
+		if err != nil || ok {
+			return s.result(&s.c.helo, key, a, err)
+		}
+	}
+
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	a, key, ok, err := s.c.sender.lookup(ctx, addressKeys(mailFrom))
+	if err != nil || ok {
+		return s.result(&s.c.sender, key, a, err)
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	a, key, ok, err := s.c.rcpt.lookup(ctx, addressKeys(rcptTo))
+	if err != nil || ok {
+		return s.result(&s.c.rcpt, key, a, err)
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
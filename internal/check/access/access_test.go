@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package access
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+	return c
+}
+
+func testState(t *testing.T, c *Check, ip, helo string) module.CheckState {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn: &module.ConnState{
+			Hostname:   helo,
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func expectResult(t *testing.T, res module.CheckResult, accept, reject, quarantine bool, code int) {
+	t.Helper()
+	if res.Accept != accept || res.Reject != reject || res.Quarantine != quarantine {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if code == 0 {
+		return
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) {
+		t.Fatalf("expected SMTPError, got %v", res.Reason)
+	}
+	if smtpErr.Code != code {
+		t.Fatalf("expected code %d, got %d", code, smtpErr.Code)
+	}
+}
+
+func TestCheck_Inline(t *testing.T) {
+	c := testCheck(t, []config.Node{
+		{Name: "client", Args: []string{"192.0.2.1", "accept"}},
+		{Name: "client", Args: []string{"192.0.2.0/24", "reject", "550", "5.7.1", "Go away"}},
+		{Name: "helo", Args: []string{"*.spam.example", "quarantine"}},
+		{Name: "sender", Args: []string{"<>", "reject"}},
+		{Name: "sender", Args: []string{"Partner.Example", "accept"}},
+		{Name: "sender", Args: []string{"bad@partner.example", "reject"}},
+		{Name: "rcpt", Args: []string{"abuse@example.org", "accept"}},
+		{Name: "rcpt", Args: []string{"old@example.org", "ignore"}},
+	})
+
+	ctx := context.Background()
+
+	expectResult(t, testState(t, c, "192.0.2.1", "mx.example.org").CheckConnection(ctx), true, false, false, 0)
+	expectResult(t, testState(t, c, "192.0.2.2", "mx.example.org").CheckConnection(ctx), false, true, false, 550)
+	expectResult(t, testState(t, c, "203.0.113.1", "mx.spam.example").CheckConnection(ctx), false, false, true, 554)
+	expectResult(t, testState(t, c, "203.0.113.1", "spam.example").CheckConnection(ctx), false, false, false, 0)
+
+	s := testState(t, c, "203.0.113.1", "mx.example.org")
+	expectResult(t, s.CheckSender(ctx, ""), false, true, false, 554)
+	expectResult(t, s.CheckSender(ctx, "someone@partner.example"), true, false, false, 0)
+	expectResult(t, s.CheckSender(ctx, "BAD@partner.example"), false, true, false, 554)
+	expectResult(t, s.CheckSender(ctx, "someone@example.com"), false, false, false, 0)
+	expectResult(t, s.CheckRcpt(ctx, "abuse@example.org"), true, false, false, 0)
+	expectResult(t, s.CheckRcpt(ctx, "old@example.org"), false, false, false, 0)
+	expectResult(t, s.CheckRcpt(ctx, "user@example.org"), false, false, false, 0)
+}
+
+func TestCheck_Table(t *testing.T) {
+	c := testCheck(t, nil)
+	c.client.table = testutils.Table{M: map[string]string{
+		"192.0.2.1": "reject 421 4.7.0 \"Try again later\"",
+		"192.0.2.2": "bogus",
+	}}
+	c.rcpt.table = testutils.Table{M: map[string]string{
+		"example.org":      "accept",
+		"*.example.net":    "reject 550 5.1.1",
+		"user@example.net": "quarantine",
+	}}
+
+	ctx := context.Background()
+
+	expectResult(t, testState(t, c, "192.0.2.1", "").CheckConnection(ctx), false, true, false, 421)
+	// Invalid action is handled as a lookup error.
+	expectResult(t, testState(t, c, "192.0.2.2", "").CheckConnection(ctx), false, true, false, 454)
+
+	s := testState(t, c, "203.0.113.1", "")
+	expectResult(t, s.CheckRcpt(ctx, "anyone@example.org"), true, false, false, 0)
+	expectResult(t, s.CheckRcpt(ctx, "anyone@mx.example.net"), false, true, false, 550)
+	expectResult(t, s.CheckRcpt(ctx, "user@example.net"), false, false, true, 554)
+	expectResult(t, s.CheckRcpt(ctx, "anyone@example.com"), false, false, false, 0)
+
+	c.rcpt.table = testutils.Table{Err: errors.New("lookup failed")}
+	expectResult(t, s.CheckRcpt(ctx, "anyone@example.org"), false, true, false, 454)
+}
@@ -0,0 +1,171 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package annotation implements the check that matches on message annotations
+// set by other checks and modifiers.
+package annotation
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.annotation"
+
+type rule struct {
+	key   string
+	value string
+	// If false, the rule matches if the key is present.
+	hasValue bool
+}
+
+func (r rule) match(a *module.Annotations) bool {
+	if !r.hasValue {
+		_, ok := a.Get(r.key)
+		return ok
+	}
+	return a.Match(r.key, r.value)
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	rules      []rule
+	failAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		c.rules = append(c.rules, rule{key: inlineArgs[0]})
+	case 2:
+		c.rules = append(c.rules, rule{key: inlineArgs[0], value: inlineArgs[1], hasValue: true})
+	default:
+		return nil, errors.New("check.annotation: at most two inline arguments are allowed")
+	}
+	return c, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Callback("match", func(_ *config.Map, node config.Node) error {
+		switch len(node.Args) {
+		case 1:
+			c.rules = append(c.rules, rule{key: node.Args[0]})
+		case 2:
+			c.rules = append(c.rules, rule{key: node.Args[0], value: node.Args[1], hasValue: true})
+		default:
+			return config.NodeErr(node, "expected 1 or 2 arguments")
+		}
+		return nil
+	})
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(c.rules) == 0 {
+		return errors.New("check.annotation: at least one match rule is required")
+	}
+	return nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(_ context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// CheckBody matches the rules against annotations. It is done at the body
+// stage so values set by checks during earlier stages are visible.
+func (s *state) CheckBody(_ context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	for _, r := range s.c.rules {
+		if !r.match(s.msgMeta.Annotations) {
+			continue
+		}
+
+		s.log.Debugf("matched annotation %s", r.key)
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Message rejected due to local policy",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"annotation": r.key,
+					"value":      r.value,
+				},
+			},
+		})
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
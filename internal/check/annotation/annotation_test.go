@@ -0,0 +1,76 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package annotation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestCheck(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	err = c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "match", Args: []string{"rspamd.symbols", "BAYES_SPAM"}},
+			{Name: "match", Args: []string{"greylist.delayed"}},
+			{Name: "fail_action", Args: []string{"reject"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func(annotations *module.Annotations, fail bool) {
+		t.Helper()
+
+		state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Annotations: annotations,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := state.CheckBody(context.Background(), textproto.Header{}, buffer.MemoryBuffer{})
+		if res.Reject != fail {
+			t.Errorf("expected reject=%v, got %+v", fail, res)
+		}
+	}
+
+	a := module.NewAnnotations()
+	test(a, false)
+	test(nil, false)
+
+	a.SetStrings("rspamd.symbols", []string{"R_SPF_ALLOW", "BAYES_HAM"})
+	test(a, false)
+
+	a.AddString("rspamd.symbols", "BAYES_SPAM")
+	test(a, true)
+
+	a = module.NewAnnotations()
+	a.SetBool("greylist.delayed", false)
+	test(a, true)
+}
@@ -215,7 +215,13 @@ func (s *state) CheckRcpt(_ context.Context, _ string) module.CheckResult {
 	return module.CheckResult{}
 }
 
-func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, _ buffer.Buffer) module.CheckResult {
+func (s *state) CheckBody(_ context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// CheckHeader checks the From and Sender header fields before the body is
+// received.
+func (s *state) CheckHeader(ctx context.Context, hdr textproto.Header) module.CheckResult {
 	if !s.c.checkHeader {
 		return module.CheckResult{}
 	}
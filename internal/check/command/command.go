@@ -388,6 +388,7 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 			Reject: true,
 		}
 	}
+	defer bR.Close()
 
 	return s.run(cmdName, cmdArgs, io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
 }
@@ -155,6 +155,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 			),
 		}
 	}
+	defer bodyRdr.Close()
 
 	verifications, err := dkim.VerifyWithOptions(io.MultiReader(&b, bodyRdr), &dkim.VerifyOptions{
 		LookupTXT: func(domain string) ([]string, error) {
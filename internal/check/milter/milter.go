@@ -419,6 +419,7 @@ func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buf
 				},
 			}
 		}
+		defer r.Close()
 
 		modifyAct, act, err = s.session.BodyReadFrom(r)
 		if err != nil {
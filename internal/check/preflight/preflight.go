@@ -0,0 +1,278 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package preflight implements a submission check that predicts whether the
+// message would pass SPF and DMARC checks at the destination once it is
+// relayed by this server.
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/trace"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	maddydmarc "github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName    = "check.preflight"
+	headerName = "X-Maddy-Preflight"
+)
+
+type Check struct {
+	instName string
+
+	hostname    string
+	sourceIPs   []net.IP
+	dkimDomains []string
+	failAction  failAction
+
+	log      log.Logger
+	resolver dns.Resolver
+}
+
+// failAction is the action taken for messages that are predicted to fail
+// sender authentication. In addition to usual check actions, it can only
+// add a warning header field.
+type failAction struct {
+	modconfig.FailAction
+
+	AddHeader bool
+}
+
+func failActionDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Children) != 0 {
+		return nil, config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) == 1 && node.Args[0] == "add-header" {
+		return failAction{AddHeader: true}, nil
+	}
+
+	val, err := modconfig.ParseActionDirective(node.Args)
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	return failAction{FailAction: val}, nil
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("preflight: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var sourceIPs []string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, true, "", &c.hostname)
+	cfg.StringList("source_ips", false, true, nil, &sourceIPs)
+	cfg.StringList("dkim_domains", false, false, nil, &c.dkimDomains)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return failAction{AddHeader: true}, nil
+		}, failActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, s := range sourceIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("preflight: malformed IP address: %s", s)
+		}
+		c.sourceIPs = append(c.sourceIPs, ip)
+	}
+	for i, d := range c.dkimDomains {
+		norm, err := dns.ForLookup(d)
+		if err != nil {
+			return fmt.Errorf("preflight: malformed domain: %s: %w", d, err)
+		}
+		c.dkimDomains[i] = norm
+	}
+
+	return nil
+}
+
+// evalSPF returns the worst SPF result of the sender domain among all
+// configured source addresses.
+func (c *Check) evalSPF(ctx context.Context, sender string) (spf.Result, error) {
+	for _, ip := range c.sourceIPs {
+		res, err := spf.CheckHostWithSender(ip, dns.FQDN(c.hostname), sender,
+			spf.WithContext(ctx), spf.WithResolver(c.resolver))
+		c.log.DebugMsg("SPF result", "src_ip", ip.String(), "sender", sender, "result", res, "err", err)
+		if res != spf.Pass {
+			return res, err
+		}
+	}
+	return spf.Pass, nil
+}
+
+// authResults returns the authentication results the destination is expected
+// to get for the message. Alignment with the RFC5322.From domain is left to
+// the DMARC evaluation.
+func (c *Check) authResults(senderDomain string, spfRes spf.Result) []authres.Result {
+	spfAuth := &authres.SPFResult{Value: authres.ResultFail, From: senderDomain}
+	if spfRes == spf.Pass {
+		spfAuth.Value = authres.ResultPass
+	}
+	results := []authres.Result{spfAuth}
+
+	// Messages are expected to be signed by modify.dkim using each of the
+	// configured domains.
+	for _, d := range c.dkimDomains {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultPass, Domain: d})
+	}
+	if len(c.dkimDomains) == 0 {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+	}
+	return results
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(_ context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) fail(reason string) module.CheckResult {
+	if s.c.failAction.AddHeader {
+		hdr := textproto.Header{}
+		hdr.Add(headerName, "fail ("+reason+")")
+		return module.CheckResult{Header: hdr}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message would fail sender authentication at the destination, use the address of your own domain",
+			CheckName:    modName,
+			Reason:       reason,
+		},
+	})
+}
+
+func (s *state) CheckBody(_ context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckHeader(ctx context.Context, header textproto.Header) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.preflight/CheckHeader").End()
+
+	if s.msgMeta.OriginalFrom == "" {
+		return module.CheckResult{}
+	}
+
+	_, senderDomain, err := address.Split(s.msgMeta.OriginalFrom)
+	if err != nil || senderDomain == "" {
+		s.log.Error("malformed sender address, skipping", err, "sender", s.msgMeta.OriginalFrom)
+		return module.CheckResult{}
+	}
+
+	spfRes, err := s.c.evalSPF(ctx, s.msgMeta.OriginalFrom)
+	if spfRes == spf.TempError {
+		s.log.Error("SPF evaluation failed, skipping", err, "sender", s.msgMeta.OriginalFrom)
+		return module.CheckResult{}
+	}
+
+	fromDomain, err := maddydmarc.ExtractFromDomain(header)
+	if err != nil {
+		// Leave it to other checks to reject the message if needed.
+		s.log.Error("cannot extract From domain, skipping", err)
+		return module.CheckResult{}
+	}
+
+	policyDomain, rec, err := maddydmarc.FetchRecord(ctx, s.c.resolver, fromDomain)
+	if err != nil {
+		s.log.Error("DMARC policy lookup failed, skipping", err, "from_domain", fromDomain)
+		return module.CheckResult{}
+	}
+	if rec == nil || rec.Policy == maddydmarc.PolicyNone {
+		// Without an enforced DMARC policy, only SPF result for the envelope
+		// sender matters.
+		if spfRes == spf.Fail {
+			s.log.Msg("message would fail SPF", "sender_domain", senderDomain, "spf", spfRes)
+			return s.fail(fmt.Sprintf("spf=%s for %s", spfRes, senderDomain))
+		}
+		return module.CheckResult{}
+	}
+
+	evalRes := maddydmarc.EvaluateAlignment(fromDomain, rec, s.c.authResults(senderDomain, spfRes))
+	if evalRes.Authres.Value == authres.ResultFail {
+		s.log.Msg("message would fail DMARC", "from_domain", fromDomain, "policy_domain", policyDomain,
+			"policy", rec.Policy, "spf", spfRes)
+		return s.fail(fmt.Sprintf("dmarc=fail for %s, p=%s", fromDomain, rec.Policy))
+	}
+
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package preflight
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testZones = map[string]mockdns.Zone{
+	"example.org.": {
+		TXT: []string{"v=spf1 ip4:192.0.2.1 -all"},
+	},
+	"_dmarc.example.org.": {
+		TXT: []string{"v=DMARC1; p=reject"},
+	},
+	"gmail.test.": {
+		TXT: []string{"v=spf1 ip4:198.51.100.0/24 -all"},
+	},
+	"_dmarc.gmail.test.": {
+		TXT: []string{"v=DMARC1; p=quarantine"},
+	},
+	"strict.test.": {
+		TXT: []string{"v=spf1 -all"},
+	},
+	"relaxed.test.": {
+		TXT: []string{"v=spf1 ~all"},
+	},
+}
+
+func testCheck(t *testing.T, cfg ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.resolver = &mockdns.Resolver{Zones: testZones}
+	c.log = testutils.Logger(t, modName)
+
+	cfg = append(cfg,
+		config.Node{Name: "hostname", Args: []string{"mx.example.org"}},
+		config.Node{Name: "source_ips", Args: []string{"192.0.2.1"}},
+	)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func check(t *testing.T, c *Check, sender, from string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: sender,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("From", from)
+	return st.(module.HeaderCheckState).CheckHeader(context.Background(), hdr)
+}
+
+func TestPreflight(t *testing.T) {
+	c := testCheck(t, config.Node{Name: "dkim_domains", Args: []string{"example.org"}})
+
+	test := func(sender, from string, fail bool) {
+		t.Helper()
+
+		res := check(t, c, sender, from)
+		if res.Reject || res.Quarantine {
+			t.Errorf("%s/%s: unexpected rejection with add-header action", sender, from)
+		}
+		failed := res.Header.Get(headerName) != ""
+		if failed != fail {
+			t.Errorf("%s/%s: expected fail=%v, got header %q", sender, from, fail, res.Header.Get(headerName))
+		}
+	}
+
+	test("test@example.org", "test@example.org", false)
+	test("", "test@gmail.test", false)
+	test("test@gmail.test", "test@gmail.test", true)
+	// SPF passes, but is not aligned.
+	test("test@example.org", "test@gmail.test", true)
+	// No DMARC, SPF result is used.
+	test("test@strict.test", "test@strict.test", true)
+	test("test@relaxed.test", "test@relaxed.test", false)
+}
+
+func TestPreflight_DKIMAligned(t *testing.T) {
+	c := testCheck(t, config.Node{Name: "dkim_domains", Args: []string{"example.org"}})
+
+	// SPF fails for the envelope sender but the message is signed using
+	// the From domain.
+	res := check(t, c, "test@gmail.test", "news@sub.example.org")
+	if res.Header.Get(headerName) != "" {
+		t.Errorf("unexpected failure: %q", res.Header.Get(headerName))
+	}
+}
+
+func TestPreflight_Reject(t *testing.T) {
+	c := testCheck(t, config.Node{Name: "fail_action", Args: []string{"reject"}})
+
+	res := check(t, c, "test@gmail.test", "test@gmail.test")
+	if !res.Reject || res.Reason == nil {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	if res.Header.Get(headerName) != "" {
+		t.Errorf("header should not be added with reject action")
+	}
+}
@@ -0,0 +1,632 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package reputation implements the check.reputation module that keeps
+// local statistics about message sources and uses them to score or defer
+// messages from sources with a bad history.
+//
+// Statistics are collected per client IP (IPv6 addresses are aggregated by
+// prefix) and, optionally, per origin AS. Each source has counters for
+// messages, rejected and quarantined messages and failed authentication
+// attempts. Counters decay exponentially, so old events gradually stop
+// affecting the score.
+package reputation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+	"github.com/foxcpp/maddy/internal/target"
+	_ "github.com/lib/pq"
+)
+
+const (
+	modName = "check.reputation"
+
+	headerField = "X-Maddy-Reputation"
+)
+
+var migrations = []sqlmigrate.Migration{
+	{
+		Version:     1,
+		Description: "create reputation table",
+		Up: []string{`CREATE TABLE reputation (
+			source TEXT PRIMARY KEY NOT NULL,
+			messages DOUBLE PRECISION NOT NULL,
+			rejected DOUBLE PRECISION NOT NULL,
+			quarantined DOUBLE PRECISION NOT NULL,
+			auth_failures DOUBLE PRECISION NOT NULL,
+			updated_at BIGINT NOT NULL
+		)`},
+		Down: []string{`DROP TABLE reputation`},
+	},
+}
+
+// Entry contains the statistics for a message source.
+//
+// Key is either "ip:" followed by the IPv4 address or IPv6 prefix or "asn:"
+// followed by the AS number.
+type Entry struct {
+	Key          string
+	Messages     float64
+	Rejected     float64
+	Quarantined  float64
+	AuthFailures float64
+	UpdatedAt    time.Time
+}
+
+// Events returns the total weight of events recorded for the source.
+func (e Entry) Events() float64 {
+	return e.Messages + e.AuthFailures
+}
+
+// Score returns the share of negative events, from 0 (no negative events)
+// to 1 (only negative events).
+func (e Entry) Score() float64 {
+	events := e.Events()
+	if events == 0 {
+		return 0
+	}
+	return (e.Rejected + e.Quarantined + e.AuthFailures) / events
+}
+
+// decay scales counters down according to time passed since the last
+// update.
+func (e Entry) decay(now time.Time, halfLife time.Duration) Entry {
+	elapsed := now.Sub(e.UpdatedAt)
+	if elapsed <= 0 || halfLife <= 0 {
+		return e
+	}
+	k := math.Pow(0.5, float64(elapsed)/float64(halfLife))
+	e.Messages *= k
+	e.Rejected *= k
+	e.Quarantined *= k
+	e.AuthFailures *= k
+	e.UpdatedAt = now
+	return e
+}
+
+func (e Entry) add(delta Entry) Entry {
+	e.Messages += delta.Messages
+	e.Rejected += delta.Rejected
+	e.Quarantined += delta.Quarantined
+	e.AuthFailures += delta.AuthFailures
+	return e
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	halfLife        time.Duration
+	forgetAfter     time.Duration
+	minEvents       float64
+	quarantineScore float64
+	deferScore      float64
+	asnLookup       bool
+	ipv6Prefix      int
+
+	db       *sql.DB
+	migrator *sqlmigrate.Migrator
+
+	stopCleanup chan struct{}
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName:    instName,
+		log:         log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver:    dns.DefaultResolver(),
+		stopCleanup: make(chan struct{}),
+	}, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		driver   string
+		dsnParts []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("driver", false, true, "", &driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.Duration("half_life", false, false, 24*time.Hour, &c.halfLife)
+	cfg.Duration("forget_after", false, false, 30*24*time.Hour, &c.forgetAfter)
+	cfg.Float("min_events", false, false, 10, &c.minEvents)
+	cfg.Float("quarantine_score", false, false, 0, &c.quarantineScore)
+	cfg.Float("defer_score", false, false, 0.9, &c.deferScore)
+	cfg.Bool("asn_lookup", false, false, &c.asnLookup)
+	cfg.Int("ipv6_prefix", false, false, 64, &c.ipv6Prefix)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.halfLife <= 0 {
+		return config.NodeErr(cfg.Block, "half_life should be positive")
+	}
+	if c.quarantineScore < 0 || c.quarantineScore > 1 || c.deferScore < 0 || c.deferScore > 1 {
+		return config.NodeErr(cfg.Block, "scores should be in the 0-1 range")
+	}
+	if c.ipv6Prefix <= 0 || c.ipv6Prefix > 128 {
+		return config.NodeErr(cfg.Block, "invalid ipv6_prefix: %d", c.ipv6Prefix)
+	}
+
+	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	c.db = db
+	c.migrator = &sqlmigrate.Migrator{
+		DB:         db,
+		Driver:     driver,
+		Component:  "reputation",
+		Migrations: migrations,
+	}
+
+	// Schema is managed using 'maddy db' commands in this case.
+	if module.NoRun {
+		return nil
+	}
+	if err := c.migrator.Prepare(context.Background()); err != nil {
+		return config.NodeErr(cfg.Block, "schema init: %v", err)
+	}
+
+	audit.AddAuthObserver(c)
+	go c.cleanupLoop()
+	return nil
+}
+
+// Migrators implements sqlmigrate.Provider.
+func (c *Check) Migrators() []*sqlmigrate.Migrator {
+	return []*sqlmigrate.Migrator{c.migrator}
+}
+
+func (c *Check) Close() error {
+	audit.RemoveAuthObserver(c)
+	close(c.stopCleanup)
+	return c.db.Close()
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) cleanupLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.forgetAfter == 0 {
+				continue
+			}
+			_, err := c.db.Exec(`DELETE FROM reputation WHERE updated_at < $1`, time.Now().Add(-c.forgetAfter).Unix())
+			if err != nil {
+				c.log.Error("failed to remove old entries", err)
+			}
+		case <-c.stopCleanup:
+			return
+		}
+	}
+}
+
+// ipKey returns the key used for statistics about the IP address.
+func (c *Check) ipKey(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return "ip:" + ipv4.String()
+	}
+	network := net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(c.ipv6Prefix, 128)),
+		Mask: net.CIDRMask(c.ipv6Prefix, 128),
+	}
+	return "ip:" + network.String()
+}
+
+// Key converts the user-provided source identifier (IP address or AS number
+// in the "AS64500" or "asn:64500" form) into the key used in Entry.
+func (c *Check) Key(source string) (string, error) {
+	lower := strings.ToLower(source)
+	for _, prefix := range []string{"asn:", "as"} {
+		if strings.HasPrefix(lower, prefix) {
+			asn, err := strconv.ParseUint(lower[len(prefix):], 10, 32)
+			if err != nil {
+				return "", fmt.Errorf("malformed AS number: %s", source)
+			}
+			return "asn:" + strconv.FormatUint(asn, 10), nil
+		}
+	}
+
+	ip := net.ParseIP(strings.TrimPrefix(lower, "ip:"))
+	if ip == nil {
+		if _, network, err := net.ParseCIDR(strings.TrimPrefix(lower, "ip:")); err == nil {
+			ip = network.IP
+		}
+	}
+	if ip == nil {
+		return "", fmt.Errorf("not an IP address or AS number: %s", source)
+	}
+	return c.ipKey(ip), nil
+}
+
+// lookupASN returns the number of the AS originating the IP address using
+// the Team Cymru IP to ASN mapping service.
+func (c *Check) lookupASN(ctx context.Context, ip net.IP) (string, error) {
+	zone := "origin.asn.cymru.com"
+	if ip.To4() == nil {
+		zone = "origin6.asn.cymru.com"
+	}
+
+	txts, err := c.resolver.LookupTXT(ctx, reverseIP(ip)+"."+zone)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, txt := range txts {
+		// "13335 | 1.1.1.0/24 | US | apnic | 2011-08-11"
+		// Multiple origin ASes are separated by spaces in the first field.
+		fields := strings.Fields(strings.SplitN(txt, "|", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := strconv.ParseUint(fields[0], 10, 32); err != nil {
+			continue
+		}
+		return "asn:" + fields[0], nil
+	}
+	return "", nil
+}
+
+func reverseIP(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ipv4[3], ipv4[2], ipv4[1], ipv4[0])
+	}
+	parts := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		parts = append(parts, strconv.FormatInt(int64(ip[i]&0xf), 16), strconv.FormatInt(int64(ip[i]>>4), 16))
+	}
+	return strings.Join(parts, ".")
+}
+
+// sourceKeys returns the keys for statistics about the client IP.
+func (c *Check) sourceKeys(ctx context.Context, ip net.IP) []string {
+	keys := []string{c.ipKey(ip)}
+	if c.asnLookup {
+		asn, err := c.lookupASN(ctx, ip)
+		if err != nil {
+			c.log.Error("ASN lookup failed", err, "src_ip", ip.String())
+		} else if asn != "" {
+			keys = append(keys, asn)
+		}
+	}
+	return keys
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (c *Check) get(ctx context.Context, q queryer, key string) (Entry, bool, error) {
+	var (
+		e         = Entry{Key: key}
+		updatedAt int64
+	)
+	err := q.QueryRowContext(ctx, `SELECT messages, rejected, quarantined, auth_failures, updated_at
+		FROM reputation WHERE source = $1`, key).
+		Scan(&e.Messages, &e.Rejected, &e.Quarantined, &e.AuthFailures, &updatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Entry{}, false, nil
+		}
+		return Entry{}, false, err
+	}
+	e.UpdatedAt = time.Unix(updatedAt, 0)
+	return e, true, nil
+}
+
+// Lookup returns the statistics for the source key with the decay applied.
+// It returns false if there are no statistics for the source.
+func (c *Check) Lookup(ctx context.Context, key string) (Entry, bool, error) {
+	e, ok, err := c.get(ctx, c.db, key)
+	if err != nil || !ok {
+		return Entry{}, false, err
+	}
+	if c.forgetAfter != 0 && time.Since(e.UpdatedAt) > c.forgetAfter {
+		return Entry{}, false, nil
+	}
+	return e.decay(time.Now(), c.halfLife), true, nil
+}
+
+// Record adds counters from delta to statistics for all specified keys.
+func (c *Check) Record(ctx context.Context, keys []string, delta Entry) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	now := time.Now()
+	for _, key := range keys {
+		e, ok, err := c.get(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			e = Entry{Key: key, UpdatedAt: now}
+		}
+		e = e.decay(now, c.halfLife).add(delta)
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO reputation (source, messages, rejected, quarantined, auth_failures, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (source) DO UPDATE SET messages = $2, rejected = $3, quarantined = $4, auth_failures = $5, updated_at = $6`,
+			key, e.Messages, e.Rejected, e.Quarantined, e.AuthFailures, now.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// List returns statistics for all sources with the decay applied.
+func (c *Check) List(ctx context.Context) ([]Entry, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT source, messages, rejected, quarantined, auth_failures, updated_at
+		FROM reputation ORDER BY source`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		res []Entry
+		now = time.Now()
+	)
+	for rows.Next() {
+		var (
+			e         Entry
+			updatedAt int64
+		)
+		if err := rows.Scan(&e.Key, &e.Messages, &e.Rejected, &e.Quarantined, &e.AuthFailures, &updatedAt); err != nil {
+			return nil, err
+		}
+		e.UpdatedAt = time.Unix(updatedAt, 0)
+		if c.forgetAfter != 0 && now.Sub(e.UpdatedAt) > c.forgetAfter {
+			continue
+		}
+		res = append(res, e.decay(now, c.halfLife))
+	}
+	return res, rows.Err()
+}
+
+// Reset removes statistics for the source. It returns false if there were no
+// statistics.
+func (c *Check) Reset(ctx context.Context, key string) (bool, error) {
+	res, err := c.db.ExecContext(ctx, `DELETE FROM reputation WHERE source = $1`, key)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected != 0, err
+}
+
+// AuthAttempt implements audit.AuthObserver.
+func (c *Check) AuthAttempt(endpoint string, srcAddr net.Addr, err error) {
+	if err == nil || exterrors.IsTemporary(err) {
+		return
+	}
+	tcpAddr, ok := srcAddr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		keys := c.sourceKeys(ctx, tcpAddr.IP)
+		if err := c.Record(ctx, keys, Entry{AuthFailures: 1}); err != nil {
+			c.log.Error("failed to record auth failure", err, "src_ip", tcpAddr.IP.String(), "endpoint", endpoint)
+		}
+	}()
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	keys []string
+
+	deferred     bool
+	rcptRejected bool
+	rejected     bool
+	quarantined  bool
+	passed       bool
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+// worst returns the entry with the highest score among sources with enough
+// events to be judged.
+func (s *state) worst(ctx context.Context) (Entry, bool) {
+	var (
+		worst Entry
+		found bool
+	)
+	for _, key := range s.keys {
+		e, ok, err := s.c.Lookup(ctx, key)
+		if err != nil {
+			s.log.Error("reputation lookup failed", err, "source", key)
+			continue
+		}
+		if !ok || e.Events() < s.c.minEvents {
+			continue
+		}
+		if !found || e.Score() > worst.Score() {
+			worst = e
+			found = true
+		}
+	}
+	return worst, found
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	conn := s.msgMeta.Conn
+	if conn == nil || conn.AuthUser != "" {
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return module.CheckResult{}
+	}
+	s.keys = s.c.sourceKeys(ctx, tcpAddr.IP)
+
+	e, ok := s.worst(ctx)
+	if !ok {
+		return module.CheckResult{}
+	}
+	score := e.Score()
+
+	if s.c.deferScore != 0 && score >= s.c.deferScore {
+		s.deferred = true
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+				Message:      "Too many suspicious messages from your network, try again later",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"source": e.Key,
+					"score":  score,
+					"events": e.Events(),
+				},
+			},
+		}
+	}
+
+	res := module.CheckResult{
+		Header: textproto.Header{},
+	}
+	res.Header.Add(headerField, fmt.Sprintf("source=%s; score=%.2f; events=%.1f", e.Key, score, e.Events()))
+	if s.c.quarantineScore != 0 && score >= s.c.quarantineScore {
+		res.Quarantine = true
+		res.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Poor sender reputation",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"source": e.Key,
+				"score":  score,
+			},
+		}
+	}
+	return res
+}
+
+func (s *state) CheckSender(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(_ context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// CheckOutcome implements module.OutcomeCheckState.
+func (s *state) CheckOutcome(_ context.Context, stage string, res module.CheckResult) {
+	switch {
+	case stage == "rcpt":
+		s.rcptRejected = true
+	case res.Reject:
+		s.rejected = true
+	default:
+		s.passed = true
+		s.quarantined = res.Quarantine
+	}
+}
+
+// delta returns the counters to record for the message. Messages deferred by
+// the check itself are not counted so the source can recover as old events
+// decay.
+func (s *state) delta() (Entry, bool) {
+	switch {
+	case len(s.keys) == 0 || s.deferred:
+		return Entry{}, false
+	case s.rejected:
+		return Entry{Messages: 1, Rejected: 1}, true
+	case s.passed && s.quarantined:
+		return Entry{Messages: 1, Quarantined: 1}, true
+	case s.passed:
+		return Entry{Messages: 1}, true
+	case s.rcptRejected:
+		// All recipients were rejected and the client gave up.
+		return Entry{Messages: 1, Rejected: 1}, true
+	default:
+		// Transaction aborted by the client.
+		return Entry{}, false
+	}
+}
+
+func (s *state) Close() error {
+	delta, ok := s.delta()
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.c.Record(ctx, s.keys, delta); err != nil {
+		s.log.Error("failed to update reputation", err, "sources", s.keys)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
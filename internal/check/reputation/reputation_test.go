@@ -0,0 +1,242 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package reputation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testCheck(t *testing.T) *Check {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	c := &Check{
+		log: log.Logger{Name: modName},
+		// No decay to keep counters exact.
+		halfLife:    0,
+		forgetAfter: 30 * 24 * time.Hour,
+		minEvents:   3,
+		deferScore:  0.9,
+		ipv6Prefix:  64,
+		db:          db,
+		migrator: &sqlmigrate.Migrator{
+			DB:         db,
+			Driver:     "sqlite3",
+			Component:  "reputation",
+			Migrations: migrations,
+		},
+	}
+	if err := c.migrator.Prepare(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEntryDecay(t *testing.T) {
+	now := time.Now()
+	e := Entry{Messages: 8, Rejected: 4, UpdatedAt: now.Add(-48 * time.Hour)}
+	e = e.decay(now, 24*time.Hour)
+	if math.Abs(e.Messages-2) > 1e-9 || math.Abs(e.Rejected-1) > 1e-9 {
+		t.Errorf("wrong decayed counters: %+v", e)
+	}
+	if e.Score() != 0.5 {
+		t.Errorf("wrong score: %v", e.Score())
+	}
+}
+
+func TestKey(t *testing.T) {
+	c := &Check{ipv6Prefix: 64}
+	for source, expected := range map[string]string{
+		"192.0.2.1":            "ip:192.0.2.1",
+		"ip:192.0.2.1":         "ip:192.0.2.1",
+		"2001:db8::1":          "ip:2001:db8::/64",
+		"2001:db8:0:0:ffff::1": "ip:2001:db8::/64",
+		"2001:db8::/64":        "ip:2001:db8::/64",
+		"AS64500":              "asn:64500",
+		"asn:64500":            "asn:64500",
+	} {
+		key, err := c.Key(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		if key != expected {
+			t.Errorf("%s: want %s, got %s", source, expected, key)
+		}
+	}
+	if _, err := c.Key("example.org"); err == nil {
+		t.Error("expected error for a hostname")
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	if rev := reverseIP(net.ParseIP("192.0.2.1")); rev != "1.2.0.192" {
+		t.Errorf("wrong reversed IPv4: %s", rev)
+	}
+	rev := reverseIP(net.ParseIP("2001:db8::1"))
+	if rev != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" {
+		t.Errorf("wrong reversed IPv6: %s", rev)
+	}
+}
+
+func testMsg(c *Check) (*state, *module.MsgMetadata) {
+	msgMeta := &module.MsgMetadata{
+		ID: "test",
+		Conn: &module.ConnState{
+			RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2525},
+		},
+	}
+	st, _ := c.CheckStateForMsg(context.Background(), msgMeta)
+	return st.(*state), msgMeta
+}
+
+func TestCheckDefer(t *testing.T) {
+	c := testCheck(t)
+	ctx := context.Background()
+
+	// Not enough history yet.
+	for i := 0; i < 2; i++ {
+		s, _ := testMsg(c)
+		if res := s.CheckConnection(ctx); res.Reject || res.Header.Len() != 0 {
+			t.Fatalf("unexpected result for unknown source: %+v", res)
+		}
+		s.CheckOutcome(ctx, "body", module.CheckResult{Reject: true})
+		s.Close()
+	}
+
+	// All recipients rejected.
+	s, _ := testMsg(c)
+	s.CheckConnection(ctx)
+	s.CheckOutcome(ctx, "rcpt", module.CheckResult{Reject: true})
+	s.Close()
+
+	s, _ = testMsg(c)
+	res := s.CheckConnection(ctx)
+	if !res.Reject {
+		t.Fatalf("expected deferral, got %+v", res)
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("expected 451 code, got %v", res.Reason)
+	}
+	s.Close()
+
+	// Deferral should not be recorded.
+	e, ok, err := c.Lookup(ctx, "ip:192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || e.Messages != 3 || e.Rejected != 3 {
+		t.Errorf("wrong entry: %+v", e)
+	}
+
+	if _, err := c.Reset(ctx, "ip:192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = testMsg(c)
+	if res := s.CheckConnection(ctx); res.Reject {
+		t.Errorf("source deferred after reset")
+	}
+}
+
+func TestCheckScoreHeader(t *testing.T) {
+	c := testCheck(t)
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		s, _ := testMsg(c)
+		s.CheckConnection(ctx)
+		s.CheckOutcome(ctx, "body", module.CheckResult{Quarantine: i == 0})
+		s.Close()
+	}
+
+	s, _ := testMsg(c)
+	res := s.CheckConnection(ctx)
+	if res.Reject || res.Quarantine {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if v := res.Header.Get(headerField); v != "source=ip:192.0.2.1; score=0.25; events=4.0" {
+		t.Errorf("wrong header field: %s", v)
+	}
+
+	// Authenticated clients are not scored.
+	s, msgMeta := testMsg(c)
+	msgMeta.Conn.AuthUser = "user@example.org"
+	if res := s.CheckConnection(ctx); res.Header.Len() != 0 {
+		t.Errorf("authenticated client was scored")
+	}
+	s.CheckOutcome(ctx, "body", module.CheckResult{})
+	s.Close()
+	e, _, err := c.Lookup(ctx, "ip:192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Messages != 4 {
+		t.Errorf("message from authenticated client was recorded")
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	c := testCheck(t)
+	ctx := context.Background()
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2525}
+	c.AuthAttempt("imap", addr, errors.New("invalid credentials"))
+	c.AuthAttempt("imap", addr, nil)
+
+	// Recorded asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e, ok, err := c.Lookup(ctx, "ip:192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			if e.AuthFailures != 1 || e.Messages != 0 {
+				t.Errorf("wrong entry: %+v", e)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("auth failure was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -210,6 +211,7 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
 		}
 	}
+	defer bodyR.Close()
 
 	var buf bytes.Buffer
 	if err := textproto.WriteHeader(&buf, hdr); err != nil {
@@ -281,6 +283,8 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 		})
 	}
 
+	s.annotate(respData)
+
 	switch respData.Action {
 	case "no action":
 		return module.CheckResult{}
@@ -348,6 +352,20 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 	return module.CheckResult{}
 }
 
+// annotate stores the scan result in message annotations so it can be matched
+// on by later pipeline stages.
+func (s *state) annotate(respData response) {
+	symbols := make([]string, 0, len(respData.Symbols))
+	for name := range respData.Symbols {
+		symbols = append(symbols, name)
+	}
+	sort.Strings(symbols)
+
+	s.msgMeta.Annotations.SetString("rspamd.action", respData.Action)
+	s.msgMeta.Annotations.SetFloat("rspamd.score", respData.Score)
+	s.msgMeta.Annotations.SetStrings("rspamd.symbols", symbols)
+}
+
 type response struct {
 	Score   float64 `json:"score"`
 	Action  string  `json:"action"`
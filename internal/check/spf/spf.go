@@ -25,6 +25,7 @@ import (
 	"net"
 	"runtime/debug"
 	"runtime/trace"
+	"strconv"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/emersion/go-message/textproto"
@@ -49,12 +50,15 @@ type Check struct {
 	instName     string
 	enforceEarly bool
 
-	noneAction     modconfig.FailAction
-	neutralAction  modconfig.FailAction
-	failAction     modconfig.FailAction
-	softfailAction modconfig.FailAction
-	permerrAction  modconfig.FailAction
-	temperrAction  modconfig.FailAction
+	noneAction     resultAction
+	neutralAction  resultAction
+	failAction     resultAction
+	softfailAction resultAction
+	permerrAction  resultAction
+	temperrAction  resultAction
+
+	skipAuthenticated bool
+	trustedNets       []net.IPNet
 
 	log      log.Logger
 	resolver dns.Resolver
@@ -76,41 +80,123 @@ func (c *Check) InstanceName() string {
 	return c.instName
 }
 
+// resultAction is the action taken for a certain SPF result. In addition to
+// usual check actions, it can add a score to the message or only record the
+// result in the Received-SPF header field.
+type resultAction struct {
+	modconfig.FailAction
+
+	// Score is added to the spf.score message annotation.
+	Score int
+
+	// AddHeader indicates that the Received-SPF field should be added to the
+	// message header.
+	AddHeader bool
+}
+
+func resultActionDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Children) != 0 {
+		return nil, config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "expected at least 1 argument")
+	}
+
+	switch node.Args[0] {
+	case "score":
+		if len(node.Args) != 2 {
+			return nil, config.NodeErr(node, "expected exactly 1 argument for score")
+		}
+		score, err := strconv.Atoi(node.Args[1])
+		if err != nil {
+			return nil, config.NodeErr(node, "invalid score: %v", err)
+		}
+		return resultAction{Score: score}, nil
+	case "add-header":
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "add-header does not take arguments")
+		}
+		return resultAction{AddHeader: true}, nil
+	}
+
+	val, err := modconfig.ParseActionDirective(node.Args)
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	return resultAction{FailAction: val}, nil
+}
+
 func (c *Check) Init(cfg *config.Map) error {
+	var trustedNets []string
+
 	cfg.Bool("debug", true, false, &c.log.Debug)
 	cfg.Bool("enforce_early", true, false, &c.enforceEarly)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuthenticated)
+	cfg.StringList("trusted_networks", false, false, nil, &trustedNets)
 	cfg.Custom("none_action", false, false,
 		func() (interface{}, error) {
-			return modconfig.FailAction{}, nil
-		}, modconfig.FailActionDirective, &c.noneAction)
+			return resultAction{}, nil
+		}, resultActionDirective, &c.noneAction)
 	cfg.Custom("neutral_action", false, false,
 		func() (interface{}, error) {
-			return modconfig.FailAction{}, nil
-		}, modconfig.FailActionDirective, &c.neutralAction)
+			return resultAction{}, nil
+		}, resultActionDirective, &c.neutralAction)
 	cfg.Custom("fail_action", false, false,
 		func() (interface{}, error) {
-			return modconfig.FailAction{Quarantine: true}, nil
-		}, modconfig.FailActionDirective, &c.failAction)
+			return resultAction{FailAction: modconfig.FailAction{Quarantine: true}}, nil
+		}, resultActionDirective, &c.failAction)
 	cfg.Custom("softfail_action", false, false,
 		func() (interface{}, error) {
-			return modconfig.FailAction{}, nil
-		}, modconfig.FailActionDirective, &c.softfailAction)
+			return resultAction{}, nil
+		}, resultActionDirective, &c.softfailAction)
 	cfg.Custom("permerr_action", false, false,
 		func() (interface{}, error) {
-			return modconfig.FailAction{}, nil
-		}, modconfig.FailActionDirective, &c.permerrAction)
+			return resultAction{}, nil
+		}, resultActionDirective, &c.permerrAction)
 	cfg.Custom("temperr_action", false, false,
 		func() (interface{}, error) {
-			return modconfig.FailAction{}, nil
-		}, modconfig.FailActionDirective, &c.temperrAction)
+			return resultAction{}, nil
+		}, resultActionDirective, &c.temperrAction)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	for _, n := range trustedNets {
+		ipNet, err := parseNet(n)
+		if err != nil {
+			return fmt.Errorf("%s: trusted_networks: %w", modName, err)
+		}
+		c.trustedNets = append(c.trustedNets, ipNet)
+	}
+
 	return nil
 }
 
+// parseNet parses the CIDR notation or a single IP address.
+func parseNet(s string) (net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return *ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("malformed network: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (c *Check) trusted(ip net.IP) bool {
+	for _, ipNet := range c.trustedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 type spfRes struct {
 	res spf.Result
 	err error
@@ -122,6 +208,9 @@ type state struct {
 	spfFetch chan spfRes
 	log      log.Logger
 
+	clientIP net.IP
+	mailFrom string
+
 	skip bool
 }
 
@@ -134,6 +223,27 @@ func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadat
 	}, nil
 }
 
+// applyAction applies the configured action for the SPF result. Score and
+// add-header actions never reject or quarantine the message.
+func (s *state) applyAction(action resultAction, res spf.Result, checkRes module.CheckResult) module.CheckResult {
+	checkRes = action.FailAction.Apply(checkRes)
+	if action.Score != 0 {
+		s.msgMeta.Annotations.SetInt("spf.score", int64(action.Score))
+	}
+	if action.AddHeader {
+		checkRes.Header = textproto.Header{}
+		checkRes.Header.Add("Received-SPF", s.receivedSPF(res))
+	}
+	return checkRes
+}
+
+// receivedSPF formats the Received-SPF field value as defined in RFC 7208,
+// Section 9.1.
+func (s *state) receivedSPF(res spf.Result) string {
+	return fmt.Sprintf("%s client-ip=%s; envelope-from=%q; helo=%s;",
+		res, s.clientIP, s.mailFrom, s.msgMeta.Conn.Hostname)
+}
+
 func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 	_, fromDomain, _ := address.Split(s.msgMeta.OriginalFrom)
 	spfAuth := &authres.SPFResult{
@@ -151,7 +261,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 	switch res {
 	case spf.None:
 		spfAuth.Value = authres.ResultNone
-		return s.c.noneAction.Apply(module.CheckResult{
+		return s.applyAction(s.c.noneAction, res, module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -163,7 +273,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.Neutral:
 		spfAuth.Value = authres.ResultNeutral
-		return s.c.neutralAction.Apply(module.CheckResult{
+		return s.applyAction(s.c.neutralAction, res, module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -178,7 +288,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		return module.CheckResult{AuthResult: []authres.Result{spfAuth}}
 	case spf.Fail:
 		spfAuth.Value = authres.ResultFail
-		return s.c.failAction.Apply(module.CheckResult{
+		return s.applyAction(s.c.failAction, res, module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -190,7 +300,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.SoftFail:
 		spfAuth.Value = authres.ResultSoftFail
-		return s.c.softfailAction.Apply(module.CheckResult{
+		return s.applyAction(s.c.softfailAction, res, module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -202,7 +312,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.TempError:
 		spfAuth.Value = authres.ResultTempError
-		return s.c.temperrAction.Apply(module.CheckResult{
+		return s.applyAction(s.c.temperrAction, res, module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         451,
 				EnhancedCode: exterrors.EnhancedCode{4, 7, 23},
@@ -214,7 +324,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.PermError:
 		spfAuth.Value = authres.ResultPermError
-		return s.c.permerrAction.Apply(module.CheckResult{
+		return s.applyAction(s.c.permerrAction, res, module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -314,6 +424,17 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		return module.CheckResult{}
 	}
 
+	if s.c.skipAuthenticated && s.msgMeta.Conn.AuthUser != "" {
+		s.skip = true
+		s.log.DebugMsg("authenticated session, skipping", "username", s.msgMeta.Conn.AuthUser)
+		return module.CheckResult{}
+	}
+	if s.c.trusted(ip.IP) {
+		s.skip = true
+		s.log.DebugMsg("trusted network, skipping", "src_ip", ip.IP.String())
+		return module.CheckResult{}
+	}
+
 	mailFromOriginal := s.msgMeta.OriginalFrom
 	if mailFromOriginal == "" {
 		// RFC 7208 Section 2.4.
@@ -333,6 +454,9 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		}
 	}
 
+	s.clientIP = ip.IP
+	s.mailFrom = mailFromOriginal
+
 	if s.c.enforceEarly {
 		res, err := spf.CheckHostWithSender(ip.IP,
 			dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom,
@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.resolver = &mockdns.Resolver{Zones: zones}
+	c.log = testutils.Logger(t, modName)
+
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testMeta(ip string, authUser string) *module.MsgMetadata {
+	return &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: "test@example.org",
+		Conn: &module.ConnState{
+			Hostname:   "mx.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+			AuthUser:   authUser,
+		},
+		Annotations: module.NewAnnotations(),
+	}
+}
+
+func TestResultActionDirective(t *testing.T) {
+	test := func(args []string, expected resultAction, fail bool) {
+		t.Helper()
+
+		val, err := resultActionDirective(nil, config.Node{Name: "fail_action", Args: args})
+		if err != nil {
+			if !fail {
+				t.Errorf("unexpected error for %v: %v", args, err)
+			}
+			return
+		}
+		if fail {
+			t.Errorf("expected error for %v", args)
+			return
+		}
+		act := val.(resultAction)
+		if act.Reject != expected.Reject || act.Quarantine != expected.Quarantine ||
+			act.Score != expected.Score || act.AddHeader != expected.AddHeader {
+			t.Errorf("wrong action for %v: %+v", args, act)
+		}
+	}
+
+	test([]string{"reject"}, resultAction{FailAction: modconfig.FailAction{Reject: true}}, false)
+	test([]string{"ignore"}, resultAction{}, false)
+	test([]string{"score", "5"}, resultAction{Score: 5}, false)
+	test([]string{"score", "-2"}, resultAction{Score: -2}, false)
+	test([]string{"score"}, resultAction{}, true)
+	test([]string{"score", "a"}, resultAction{}, true)
+	test([]string{"add-header"}, resultAction{AddHeader: true}, false)
+	test([]string{"add-header", "X"}, resultAction{}, true)
+	test([]string{"whatever"}, resultAction{}, true)
+}
+
+func TestCheckConnection_Actions(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.1 ~all"},
+		},
+	}
+
+	c := testCheck(t, zones, []config.Node{
+		{Name: "enforce_early", Args: []string{"yes"}},
+		{Name: "fail_action", Args: []string{"reject"}},
+		{Name: "softfail_action", Args: []string{"score", "3"}},
+		{Name: "none_action", Args: []string{"add-header"}},
+	})
+
+	meta := testMeta("192.0.2.2", "")
+	st, err := c.CheckStateForMsg(context.Background(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := st.CheckConnection(context.Background())
+	if res.Reject || res.Quarantine {
+		t.Errorf("softfail should not reject or quarantine: %+v", res)
+	}
+	if score, _ := meta.Annotations.GetInt("spf.score"); score != 3 {
+		t.Errorf("expected spf.score = 3, got %v", score)
+	}
+
+	meta = testMeta("192.0.2.2", "")
+	meta.OriginalFrom = "test@example.com"
+	st, err = c.CheckStateForMsg(context.Background(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = st.CheckConnection(context.Background())
+	if res.Reject || res.Quarantine {
+		t.Errorf("none result should not reject or quarantine: %+v", res)
+	}
+	hdr := res.Header.Get("Received-SPF")
+	if !strings.HasPrefix(hdr, "none ") || !strings.Contains(hdr, "client-ip=192.0.2.2;") {
+		t.Errorf("wrong Received-SPF field: %q", hdr)
+	}
+}
+
+func TestCheckConnection_Skip(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 -all"},
+		},
+	}
+
+	c := testCheck(t, zones, []config.Node{
+		{Name: "enforce_early", Args: []string{"yes"}},
+		{Name: "fail_action", Args: []string{"reject"}},
+		{Name: "trusted_networks", Args: []string{"10.0.0.0/8", "192.0.2.5"}},
+	})
+
+	test := func(ip, authUser string, reject bool) {
+		t.Helper()
+
+		st, err := c.CheckStateForMsg(context.Background(), testMeta(ip, authUser))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := st.CheckConnection(context.Background())
+		if res.Reject != reject {
+			t.Errorf("%s (auth %q): expected reject=%v, got %+v", ip, authUser, reject, res)
+		}
+	}
+
+	test("192.0.2.2", "", true)
+	test("192.0.2.2", "user", false)
+	test("10.1.2.3", "", false)
+	test("192.0.2.5", "", false)
+}
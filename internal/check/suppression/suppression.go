@@ -0,0 +1,300 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package suppression implements the check.suppression module that rejects
+// messages to addresses that hard-bounced recently.
+//
+// Bounces are recorded by target.queue if the module is referenced in its
+// bounce_suppression directive.
+package suppression
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+	"github.com/foxcpp/maddy/internal/target"
+	_ "github.com/lib/pq"
+)
+
+const modName = "check.suppression"
+
+var migrations = []sqlmigrate.Migration{
+	{
+		Version:     1,
+		Description: "create bounce_suppression table",
+		Up: []string{`CREATE TABLE bounce_suppression (
+			address TEXT PRIMARY KEY NOT NULL,
+			category TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			bounced_at BIGINT NOT NULL
+		)`},
+		Down: []string{`DROP TABLE bounce_suppression`},
+	},
+}
+
+// Entry describes a suppressed address.
+type Entry struct {
+	Address   string
+	Category  dsn.Category
+	Reason    string
+	BouncedAt time.Time
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	ttl        time.Duration
+	categories map[dsn.Category]struct{}
+	failAction modconfig.FailAction
+
+	db       *sql.DB
+	migrator *sqlmigrate.Migrator
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		driver     string
+		dsnParts   []string
+		categories []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("driver", false, true, "", &driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.Duration("ttl", false, false, 30*24*time.Hour, &c.ttl)
+	cfg.EnumList("categories", false, false, dsn.Categories, []string{string(dsn.CategoryUserUnknown)}, &categories)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.categories = make(map[dsn.Category]struct{}, len(categories))
+	for _, cat := range categories {
+		c.categories[dsn.Category(cat)] = struct{}{}
+	}
+
+	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	c.db = db
+	c.migrator = &sqlmigrate.Migrator{
+		DB:         db,
+		Driver:     driver,
+		Component:  "bounce_suppression",
+		Migrations: migrations,
+	}
+
+	// Schema is managed using 'maddy db' commands in this case.
+	if module.NoRun {
+		return nil
+	}
+	if err := c.migrator.Prepare(context.Background()); err != nil {
+		return config.NodeErr(cfg.Block, "schema init: %v", err)
+	}
+	return nil
+}
+
+// Migrators implements sqlmigrate.Provider.
+func (c *Check) Migrators() []*sqlmigrate.Migrator {
+	return []*sqlmigrate.Migrator{c.migrator}
+}
+
+func (c *Check) Close() error {
+	return c.db.Close()
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// RecordBounce adds the address to the suppression list if the bounce
+// category is one of the configured ones.
+func (c *Check) RecordBounce(ctx context.Context, rcpt string, category dsn.Category, reason string) error {
+	if _, ok := c.categories[category]; !ok {
+		return nil
+	}
+
+	addr, err := address.ForLookup(rcpt)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.ExecContext(ctx, `INSERT INTO bounce_suppression (address, category, reason, bounced_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (address) DO UPDATE SET category = $2, reason = $3, bounced_at = $4`,
+		addr, string(category), reason, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	c.log.Msg("address suppressed", "rcpt", addr, "category", category, "reason", reason)
+	return nil
+}
+
+// Lookup returns the suppression entry for the address. It returns false if
+// the address is not suppressed or the entry has expired.
+func (c *Check) Lookup(ctx context.Context, rcpt string) (Entry, bool, error) {
+	addr, err := address.ForLookup(rcpt)
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	var (
+		e         = Entry{Address: addr}
+		category  string
+		bouncedAt int64
+	)
+	err = c.db.QueryRowContext(ctx, `SELECT category, reason, bounced_at FROM bounce_suppression WHERE address = $1`, addr).
+		Scan(&category, &e.Reason, &bouncedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Entry{}, false, nil
+		}
+		return Entry{}, false, err
+	}
+	e.Category = dsn.Category(category)
+	e.BouncedAt = time.Unix(bouncedAt, 0)
+
+	if c.ttl != 0 && time.Since(e.BouncedAt) > c.ttl {
+		return Entry{}, false, nil
+	}
+	return e, true, nil
+}
+
+// List returns all entries, including expired ones.
+func (c *Check) List(ctx context.Context) ([]Entry, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT address, category, reason, bounced_at FROM bounce_suppression ORDER BY address`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Entry
+	for rows.Next() {
+		var (
+			e         Entry
+			category  string
+			bouncedAt int64
+		)
+		if err := rows.Scan(&e.Address, &category, &e.Reason, &bouncedAt); err != nil {
+			return nil, err
+		}
+		e.Category = dsn.Category(category)
+		e.BouncedAt = time.Unix(bouncedAt, 0)
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// Remove removes the address from the list. It returns false if the address
+// was not suppressed.
+func (c *Check) Remove(ctx context.Context, rcpt string) (bool, error) {
+	addr, err := address.ForLookup(rcpt)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.db.ExecContext(ctx, `DELETE FROM bounce_suppression WHERE address = $1`, addr)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected != 0, err
+}
+
+type state struct {
+	c   *Check
+	log log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:   c,
+		log: target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(_ context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	e, ok, err := s.c.Lookup(ctx, rcptTo)
+	if err != nil {
+		s.log.Error("suppression list lookup failed", err, "rcpt", rcptTo)
+		return module.CheckResult{}
+	}
+	if !ok {
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "Recipient address recently bounced, not sending",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"rcpt":       rcptTo,
+				"category":   string(e.Category),
+				"bounced_at": e.BouncedAt,
+			},
+		},
+	})
+}
+
+func (s *state) CheckBody(_ context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,145 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package suppression
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testCheck(t *testing.T, extra ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	err = c.Init(config.NewMap(nil, config.Node{
+		Children: append([]config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(t.TempDir(), "suppression.db")}},
+		}, extra...),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSuppression(t *testing.T) {
+	c := testCheck(t)
+	ctx := context.Background()
+
+	if err := c.RecordBounce(ctx, "Full@Example.org", dsn.CategoryMailboxFull, "mailbox is full"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Lookup(ctx, "full@example.org"); err != nil || ok {
+		t.Fatal("bounce of not configured category is recorded:", ok, err)
+	}
+
+	if err := c.RecordBounce(ctx, "User@Example.org", dsn.CategoryUserUnknown, "no such user"); err != nil {
+		t.Fatal(err)
+	}
+	// Repeated bounce updates the entry.
+	if err := c.RecordBounce(ctx, "user@example.org", dsn.CategoryUserUnknown, "user unknown"); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok, err := c.Lookup(ctx, "USER@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("address is not suppressed")
+	}
+	if e.Address != "user@example.org" || e.Category != dsn.CategoryUserUnknown || e.Reason != "user unknown" {
+		t.Errorf("wrong entry: %+v", e)
+	}
+
+	list, err := c.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Address != "user@example.org" {
+		t.Errorf("wrong list: %+v", list)
+	}
+
+	st, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	res := st.CheckRcpt(ctx, "user@example.org")
+	if !res.Reject {
+		t.Fatal("suppressed recipient is not rejected")
+	}
+	testutils.CheckSMTPErr(t, res.Reason, 550, exterrors.EnhancedCode{5, 1, 1}, "Recipient address recently bounced, not sending")
+	if res := st.CheckRcpt(ctx, "other@example.org"); res.Reject {
+		t.Error("not suppressed recipient is rejected:", res.Reason)
+	}
+
+	removed, err := c.Remove(ctx, "user@example.org")
+	if err != nil || !removed {
+		t.Fatal("Remove failed:", removed, err)
+	}
+	if removed, err := c.Remove(ctx, "user@example.org"); err != nil || removed {
+		t.Fatal("Remove of missing entry:", removed, err)
+	}
+	if _, ok, err := c.Lookup(ctx, "user@example.org"); err != nil || ok {
+		t.Fatal("address is suppressed after removal:", ok, err)
+	}
+}
+
+func TestSuppression_TTL(t *testing.T) {
+	c := testCheck(t, config.Node{Name: "ttl", Args: []string{"1h"}})
+	ctx := context.Background()
+
+	_, err := c.db.Exec(`INSERT INTO bounce_suppression (address, category, reason, bounced_at) VALUES ($1, $2, $3, $4)`,
+		"old@example.org", string(dsn.CategoryUserUnknown), "no such user", time.Now().Add(-2*time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Lookup(ctx, "old@example.org"); err != nil || ok {
+		t.Fatal("expired entry is used:", ok, err)
+	}
+
+	// Expired entries are still listed.
+	list, err := c.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("wrong list: %+v", list)
+	}
+}
@@ -0,0 +1,395 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package verify_rcpt implements the check.verify_rcpt module that verifies
+// recipient addresses by probing the downstream SMTP server with RCPT TO.
+//
+// It is meant to be used for relay domains where mailboxes live on a
+// different server (e.g. with target.smtp) so invalid recipients are
+// rejected during the SMTP transaction instead of causing backscatter.
+package verify_rcpt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.verify_rcpt"
+
+type Check struct {
+	instName   string
+	targetsArg []string
+	log        log.Logger
+
+	hostname        string
+	endpoints       []config.Endpoint
+	attemptStartTLS bool
+	requireTLS      bool
+	tlsConfig       tls.Config
+	connectTimeout  time.Duration
+	commandTimeout  time.Duration
+	mailFrom        string
+	domains         map[string]struct{}
+
+	failAction  modconfig.FailAction
+	errorAction modconfig.FailAction
+
+	cache *resultCache
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Check{
+		instName:   instName,
+		targetsArg: inlineArgs,
+		log:        log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		targetsArg []string
+		domains    []string
+		validTTL   time.Duration
+		invalidTTL time.Duration
+		cacheSize  int
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, true, "", &c.hostname)
+	cfg.StringList("targets", false, false, nil, &targetsArg)
+	cfg.Bool("attempt_starttls", false, true, &c.attemptStartTLS)
+	cfg.Bool("require_tls", false, false, &c.requireTLS)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &c.tlsConfig)
+	cfg.Duration("connect_timeout", true, false, 30*time.Second, &c.connectTimeout)
+	cfg.Duration("command_timeout", true, false, 30*time.Second, &c.commandTimeout)
+	cfg.String("mail_from", false, false, "", &c.mailFrom)
+	cfg.StringList("domains", false, false, nil, &domains)
+	cfg.Duration("valid_cache_ttl", false, false, 1*time.Hour, &validTTL)
+	cfg.Duration("invalid_cache_ttl", false, false, 10*time.Minute, &invalidTTL)
+	cfg.Int("cache_size", false, false, 10000, &cacheSize)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errorAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	c.hostname, err = idna.ToASCII(c.hostname)
+	if err != nil {
+		return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", modName, err)
+	}
+
+	for _, tgt := range append(c.targetsArg, targetsArg...) {
+		endp, err := config.ParseEndpoint(tgt)
+		if err != nil {
+			return err
+		}
+		c.endpoints = append(c.endpoints, endp)
+	}
+	if len(c.endpoints) == 0 {
+		return fmt.Errorf("%s: at least one target endpoint is required", modName)
+	}
+
+	if len(domains) != 0 {
+		c.domains = make(map[string]struct{}, len(domains))
+		for _, d := range domains {
+			d, err := dns.ForLookup(d)
+			if err != nil {
+				return fmt.Errorf("%s: invalid domain %s: %w", modName, d, err)
+			}
+			c.domains[d] = struct{}{}
+		}
+	}
+
+	c.cache = newResultCache(validTTL, invalidTTL, cacheSize)
+
+	return nil
+}
+
+// verifyResult is the outcome of the RCPT TO probe for a single address.
+type verifyResult struct {
+	// valid is true if the downstream server accepted the recipient.
+	valid bool
+	// err is the error returned by the downstream server for the recipient.
+	err error
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	// conn is the connection to the downstream server, lazily created
+	// by the first CheckRcpt call that misses the cache and reused for
+	// all recipients of the message.
+	conn *smtpconn.C
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	if s.c.domains != nil {
+		_, domain, err := address.Split(addr)
+		if err != nil {
+			return module.CheckResult{}
+		}
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			return module.CheckResult{}
+		}
+		if _, ok := s.c.domains[domain]; !ok {
+			return module.CheckResult{}
+		}
+	}
+
+	res, ok := s.c.cache.get(addr)
+	if ok {
+		s.log.DebugMsg("cached result", "rcpt", addr, "valid", res.valid)
+	} else {
+		var err error
+		res, err = s.probe(ctx, addr)
+		if err != nil {
+			s.log.Error("verification failed", err, "rcpt", addr)
+			return s.c.errorAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 4, 0},
+					Message:      "Unable to verify the recipient address, try again later",
+					CheckName:    modName,
+					Err:          err,
+				},
+			})
+		}
+		s.c.cache.set(addr, res)
+	}
+
+	if res.valid {
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "No such user here",
+			CheckName:    modName,
+			Err:          res.err,
+		},
+	})
+}
+
+// probe sends RCPT TO for the address to the downstream server.
+//
+// Returned error indicates that the verification result is not known
+// (e.g. the server is unavailable or returned a temporary error). Permanent
+// rejections are reported using verifyResult.
+func (s *state) probe(ctx context.Context, addr string) (verifyResult, error) {
+	if s.conn == nil {
+		conn, err := s.connect(ctx)
+		if err != nil {
+			return verifyResult{}, err
+		}
+		s.conn = conn
+	}
+
+	err := s.conn.Rcpt(ctx, addr, smtp.RcptOptions{})
+	if err == nil {
+		return verifyResult{valid: true}, nil
+	}
+
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code/100 == 5 {
+		return verifyResult{valid: false, err: err}, nil
+	}
+
+	// Connection state is not known for sure after I/O errors
+	// (reported as 4xx too), do not reuse it.
+	s.conn.DirectClose()
+	s.conn = nil
+	return verifyResult{}, err
+}
+
+func (s *state) connect(ctx context.Context) (*smtpconn.C, error) {
+	conn := smtpconn.New()
+	conn.Log = s.log
+	conn.Hostname = s.c.hostname
+	conn.AddrInSMTPMsg = false
+	conn.ConnectTimeout = s.c.connectTimeout
+	conn.CommandTimeout = s.c.commandTimeout
+
+	var lastErr error
+	for _, endp := range s.c.endpoints {
+		didTLS, err := conn.Connect(ctx, endp, s.c.attemptStartTLS, &s.c.tlsConfig)
+		if err != nil {
+			if len(s.c.endpoints) != 1 {
+				s.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
+			}
+			lastErr = err
+			continue
+		}
+		if !didTLS && s.c.requireTLS {
+			conn.Close()
+			lastErr = errors.New("TLS is required, but unsupported by downstream")
+			continue
+		}
+
+		if err := conn.Mail(ctx, s.c.mailFrom, smtp.MailOptions{UTF8: s.msgMeta.SMTPOpts.UTF8}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	return nil, lastErr
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// resultCache stores verification results for the configured time to avoid
+// probing the downstream server for each message.
+type resultCache struct {
+	validTTL   time.Duration
+	invalidTTL time.Duration
+	maxSize    int
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	res    verifyResult
+	expiry time.Time
+}
+
+func newResultCache(validTTL, invalidTTL time.Duration, maxSize int) *resultCache {
+	return &resultCache{
+		validTTL:   validTTL,
+		invalidTTL: invalidTTL,
+		maxSize:    maxSize,
+		entries:    make(map[string]cacheEntry),
+	}
+}
+
+func (rc *resultCache) get(addr string) (verifyResult, bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	ent, ok := rc.entries[addr]
+	if !ok {
+		return verifyResult{}, false
+	}
+	if time.Now().After(ent.expiry) {
+		delete(rc.entries, addr)
+		return verifyResult{}, false
+	}
+	return ent.res, true
+}
+
+func (rc *resultCache) set(addr string, res verifyResult) {
+	ttl := rc.validTTL
+	if !res.valid {
+		ttl = rc.invalidTTL
+	}
+	if ttl == 0 || rc.maxSize <= 0 {
+		return
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	now := time.Now()
+	if len(rc.entries) >= rc.maxSize {
+		for k, ent := range rc.entries {
+			if now.After(ent.expiry) {
+				delete(rc.entries, k)
+			}
+		}
+		// Still full, drop an arbitrary entry.
+		for k := range rc.entries {
+			if len(rc.entries) < rc.maxSize {
+				break
+			}
+			delete(rc.entries, k)
+		}
+	}
+
+	rc.entries[addr] = cacheEntry{res: res, expiry: now.Add(ttl)}
+}
+
+func init() {
+	module.Register(modName, New)
+}
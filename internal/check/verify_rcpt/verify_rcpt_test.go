@@ -0,0 +1,153 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package verify_rcpt
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testPort string
+
+func testCheck(t *testing.T) *Check {
+	return &Check{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		connectTimeout: 5 * time.Second,
+		commandTimeout: 5 * time.Second,
+		failAction:     modconfig.FailAction{Reject: true},
+		errorAction:    modconfig.FailAction{},
+		cache:          newResultCache(time.Hour, time.Hour, 100),
+		log:            testutils.Logger(t, modName),
+	}
+}
+
+func checkRcpts(t *testing.T, c *Check, rcpts ...string) []module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	res := make([]module.CheckResult, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		res = append(res, st.CheckRcpt(context.Background(), rcpt))
+	}
+	return res
+}
+
+func TestVerifyRcpt(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	be.RcptErr = map[string]error{
+		"invalid@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"greylisted@example.invalid": &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "Try again later",
+		},
+	}
+
+	c := testCheck(t)
+	res := checkRcpts(t, c, "greylisted@example.invalid", "valid@example.invalid", "invalid@example.invalid")
+	if res[0].Reject {
+		t.Error("temporary error resulted in rejection:", res[0].Reason)
+	}
+	if res[1].Reject {
+		t.Error("valid recipient rejected:", res[1].Reason)
+	}
+	if !res[2].Reject {
+		t.Error("invalid recipient accepted")
+	}
+	if be.SessionCounter != 2 {
+		t.Errorf("expected 2 sessions (reconnect after temporary error), got %d", be.SessionCounter)
+	}
+
+	// Results should be cached.
+	res = checkRcpts(t, c, "valid@example.invalid", "invalid@example.invalid")
+	if res[0].Reject || !res[1].Reject {
+		t.Error("wrong cached results:", res[0].Reject, res[1].Reject)
+	}
+	if be.SessionCounter != 2 {
+		t.Errorf("downstream server contacted for cached results, sessions: %d", be.SessionCounter)
+	}
+}
+
+func TestVerifyRcpt_Domains(t *testing.T) {
+	tarpit := testutils.FailOnConn(t, "127.0.0.1:"+testPort)
+	defer tarpit.Close()
+
+	c := testCheck(t)
+	c.domains = map[string]struct{}{"example.invalid": {}}
+
+	res := checkRcpts(t, c, "test@example.org")
+	if res[0].Reject {
+		t.Error("recipient in unrelated domain rejected:", res[0].Reason)
+	}
+}
+
+func TestVerifyRcpt_ServerUnavailable(t *testing.T) {
+	c := testCheck(t)
+	c.errorAction = modconfig.FailAction{Reject: true}
+
+	res := checkRcpts(t, c, "test@example.invalid")
+	if !res[0].Reject {
+		t.Error("expected rejection with error_action reject")
+	}
+	if _, ok := c.cache.get("test@example.invalid"); ok {
+		t.Error("unknown result should not be cached")
+	}
+}
+
+func TestMain(m *testing.M) {
+	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
+	flag.Parse()
+
+	if *remoteSmtpPort == "random" {
+		rand.Seed(time.Now().UnixNano())
+		*remoteSmtpPort = strconv.Itoa(rand.Intn(65536-10000) + 10000)
+	}
+
+	testPort = *remoteSmtpPort
+	os.Exit(m.Run())
+}
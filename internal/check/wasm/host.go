@@ -0,0 +1,196 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package wasm
+
+import (
+	"io"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Actions accepted by the set_result host function.
+const (
+	ActionAccept int32 = iota
+	ActionReject
+	ActionQuarantine
+)
+
+const wasmPageSize = 64 * 1024
+
+// callState is the data accessible to the guest during a single call and
+// the result it sets. Host functions are thin wrappers around its methods.
+type callState struct {
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	stage    int32
+	mailFrom string
+	rcpts    []string
+	rcpt     string
+	header   textproto.Header
+	body     buffer.Buffer
+
+	bodyBlob   []byte
+	bodyLoaded bool
+
+	action       int32
+	code         int
+	enhancedCode exterrors.EnhancedCode
+	message      string
+	addHeader    textproto.Header
+}
+
+// info returns the value for the get_info host function.
+func (cs *callState) info(key string) (string, bool) {
+	switch key {
+	case "msg_id":
+		return cs.msgMeta.ID, true
+	case "mail_from":
+		return cs.mailFrom, cs.stage != StageConnection
+	case "rcpt":
+		return cs.rcpt, cs.stage == StageRcpt
+	}
+
+	conn := cs.msgMeta.Conn
+	if conn == nil {
+		return "", false
+	}
+	switch key {
+	case "proto":
+		return conn.Proto, true
+	case "source_host":
+		return conn.Hostname, true
+	case "source_ip":
+		tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr)
+		if !ok {
+			return "", false
+		}
+		return tcpAddr.IP.String(), true
+	case "source_rdns":
+		if conn.RDNSName == nil {
+			return "", false
+		}
+		rdns, err := conn.RDNSName.Get()
+		if err != nil || rdns == nil {
+			return "", false
+		}
+		return rdns.(string), true
+	case "auth_user":
+		return conn.AuthUser, conn.AuthUser != ""
+	}
+	return "", false
+}
+
+func (cs *callState) rcptAt(idx int) (string, bool) {
+	if idx < 0 || idx >= len(cs.rcpts) {
+		return "", false
+	}
+	return cs.rcpts[idx], true
+}
+
+// headerValue returns the idx-th value of the header field name.
+func (cs *callState) headerValue(name string, idx int) (string, bool) {
+	if idx < 0 {
+		return "", false
+	}
+	fields := cs.header.FieldsByKey(name)
+	for i := 0; fields.Next(); i++ {
+		if i == idx {
+			return fields.Value(), true
+		}
+	}
+	return "", false
+}
+
+// bodyAt returns the body contents starting at offset. The body is read
+// into memory on the first call.
+func (cs *callState) bodyAt(offset int) ([]byte, error) {
+	if cs.body == nil {
+		return nil, nil
+	}
+	if !cs.bodyLoaded {
+		r, err := cs.body.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		cs.bodyBlob, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		cs.bodyLoaded = true
+	}
+	if offset < 0 || offset >= len(cs.bodyBlob) {
+		return nil, nil
+	}
+	return cs.bodyBlob[offset:], nil
+}
+
+// setResult implements the set_result host function. enhancedCode is
+// packed as class<<16 | subject<<8 | detail.
+func (cs *callState) setResult(action int32, code int32, enhancedCode uint32, msg string) {
+	cs.action = action
+	cs.code = int(code)
+	cs.enhancedCode = exterrors.EnhancedCode{
+		int(enhancedCode >> 16 & 0xff),
+		int(enhancedCode >> 8 & 0xff),
+		int(enhancedCode & 0xff),
+	}
+	cs.message = msg
+}
+
+func (cs *callState) addHeaderField(key, value string) {
+	cs.addHeader.Add(key, strings.ReplaceAll(strings.ReplaceAll(value, "\r", ""), "\n", ""))
+}
+
+func (cs *callState) result() module.CheckResult {
+	res := module.CheckResult{Header: cs.addHeader}
+	if cs.action != ActionReject && cs.action != ActionQuarantine {
+		return res
+	}
+
+	smtpErr := &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected due to a local policy",
+		CheckName:    modName,
+	}
+	if cs.code/100 == 4 || cs.code/100 == 5 {
+		smtpErr.Code = cs.code
+		if cs.enhancedCode[0] == cs.code/100 {
+			smtpErr.EnhancedCode = cs.enhancedCode
+		} else {
+			smtpErr.EnhancedCode = exterrors.EnhancedCode{cs.code / 100, 7, 1}
+		}
+	}
+	if cs.message != "" {
+		smtpErr.Message = cs.message
+	}
+
+	res.Reason = smtpErr
+	res.Reject = cs.action == ActionReject
+	res.Quarantine = cs.action == ActionQuarantine
+	return res
+}
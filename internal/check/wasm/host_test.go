@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package wasm
+
+import (
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestCallState_Data(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.Add("Received", "second")
+	hdr.Add("Received", "first")
+	cs := callState{
+		msgMeta:  &module.MsgMetadata{ID: "msg"},
+		stage:    StageBody,
+		mailFrom: "from@example.org",
+		rcpts:    []string{"a@example.org"},
+		header:   hdr,
+		body:     buffer.MemoryBuffer{Slice: []byte("hello")},
+	}
+
+	if v, ok := cs.info("msg_id"); !ok || v != "msg" {
+		t.Errorf("msg_id: %v %v", v, ok)
+	}
+	if _, ok := cs.info("rcpt"); ok {
+		t.Error("rcpt should not be available at the body stage")
+	}
+	if _, ok := cs.info("source_ip"); ok {
+		t.Error("source_ip should not be available without Conn")
+	}
+	if v, ok := cs.rcptAt(0); !ok || v != "a@example.org" {
+		t.Errorf("rcpt 0: %v %v", v, ok)
+	}
+	if _, ok := cs.rcptAt(1); ok {
+		t.Error("rcpt 1 should not exist")
+	}
+	if v, ok := cs.headerValue("received", 1); !ok || v != "second" {
+		t.Errorf("Received 1: %v %v", v, ok)
+	}
+	if _, ok := cs.headerValue("Received", 2); ok {
+		t.Error("Received 2 should not exist")
+	}
+
+	body, err := cs.bodyAt(2)
+	if err != nil || string(body) != "llo" {
+		t.Errorf("body at 2: %q %v", body, err)
+	}
+	body, err = cs.bodyAt(5)
+	if err != nil || len(body) != 0 {
+		t.Errorf("body at 5: %q %v", body, err)
+	}
+}
+
+func TestCallState_Result(t *testing.T) {
+	cs := callState{}
+	cs.addHeaderField("X-Test", "a\r\nInjected: b")
+	res := cs.result()
+	if res.Reject || res.Quarantine || res.Reason != nil {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if v := res.Header.Get("X-Test"); v != "aInjected: b" {
+		t.Errorf("wrong header value: %q", v)
+	}
+
+	cs = callState{}
+	cs.setResult(ActionReject, 451, 4<<16|7<<8|26, "Try later")
+	res = cs.result()
+	if !res.Reject {
+		t.Fatal("expected rejection")
+	}
+	fields := exterrors.Fields(res.Reason)
+	if fields["smtp_code"] != 451 || fields["smtp_enchcode"] != (exterrors.EnhancedCode{4, 7, 26}) || fields["smtp_msg"] != "Try later" {
+		t.Errorf("wrong error: %v", fields)
+	}
+
+	// Invalid codes are replaced with defaults.
+	cs = callState{}
+	cs.setResult(ActionQuarantine, 250, 0, "")
+	res = cs.result()
+	if !res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	fields = exterrors.Fields(res.Reason)
+	if fields["smtp_code"] != 550 || fields["smtp_enchcode"] != (exterrors.EnhancedCode{5, 7, 1}) {
+		t.Errorf("wrong error: %v", fields)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package wasm implements the check.wasm module that runs message checks
+// compiled to WebAssembly in a sandbox.
+//
+// Actual WebAssembly support requires the wazero build tag, see
+// runtime_wazero.go for the host API implementation.
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/trace"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.wasm"
+
+// Stage numbers passed to the guest "check" function.
+const (
+	StageConnection int32 = iota
+	StageSender
+	StageRcpt
+	StageBody
+)
+
+var stageNames = map[string]int32{
+	"conn":   StageConnection,
+	"sender": StageSender,
+	"rcpt":   StageRcpt,
+	"body":   StageBody,
+}
+
+// runtime runs the compiled guest module.
+type runtime interface {
+	// Run instantiates a fresh copy of the guest module and calls its "check"
+	// function. Host functions access the call state via cs.
+	Run(ctx context.Context, cs *callState) error
+	Close() error
+}
+
+type Check struct {
+	instName string
+	path     string
+	log      log.Logger
+
+	stages      map[int32]bool
+	memoryLimit int64
+	timeLimit   time.Duration
+
+	rt runtime
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 1 {
+		return nil, errors.New("check.wasm: exactly one argument is required (module path)")
+	}
+	return &Check{
+		instName: instName,
+		path:     inlineArgs[0],
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var stages []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.EnumList("run_on", false, false, []string{"conn", "sender", "rcpt", "body"}, []string{"body"}, &stages)
+	cfg.DataSize("memory_limit", false, false, 16*1024*1024, &c.memoryLimit)
+	cfg.Duration("time_limit", false, false, 1*time.Second, &c.timeLimit)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.stages = make(map[int32]bool, len(stages))
+	for _, stage := range stages {
+		c.stages[stageNames[stage]] = true
+	}
+
+	if c.memoryLimit < wasmPageSize {
+		return fmt.Errorf("%s: memory_limit should be at least %d bytes", modName, wasmPageSize)
+	}
+
+	blob, err := os.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	c.rt, err = newRuntime(blob, uint32(c.memoryLimit/wasmPageSize), c.timeLimit, c.log)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.rt == nil {
+		return nil
+	}
+	return c.rt.Close()
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) run(ctx context.Context, cs *callState) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.wasm/run").End()
+
+	cs.msgMeta = s.msgMeta
+	cs.log = s.log
+	cs.mailFrom = s.mailFrom
+	cs.rcpts = s.rcpts
+
+	if err := s.c.rt.Run(ctx, cs); err != nil {
+		s.log.Error("module execution failed", err, "stage", cs.stage)
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal server error",
+				CheckName:    modName,
+				Err:          err,
+			},
+			Reject: true,
+		}
+	}
+
+	return cs.result()
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if !s.c.stages[StageConnection] {
+		return module.CheckResult{}
+	}
+	return s.run(ctx, &callState{stage: StageConnection})
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	s.mailFrom = mailFrom
+	if !s.c.stages[StageSender] {
+		return module.CheckResult{}
+	}
+	return s.run(ctx, &callState{stage: StageSender})
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	s.rcpts = append(s.rcpts, rcptTo)
+	if !s.c.stages[StageRcpt] {
+		return module.CheckResult{}
+	}
+	return s.run(ctx, &callState{stage: StageRcpt, rcpt: rcptTo})
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if !s.c.stages[StageBody] {
+		return module.CheckResult{}
+	}
+	return s.run(ctx, &callState{stage: StageBody, header: header, body: body})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,33 @@
+//go:build !wazero
+// +build !wazero
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package wasm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+func newRuntime(_ []byte, _ uint32, _ time.Duration, _ log.Logger) (runtime, error) {
+	return nil, errors.New("this build lacks WebAssembly support, rebuild with the wazero tag")
+}
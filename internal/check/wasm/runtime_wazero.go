@@ -0,0 +1,195 @@
+//go:build wazero
+// +build wazero
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Host API available to the guest in the "maddy" module.
+//
+// Functions that return data copy it into the guest buffer (ptr, size)
+// and return its length. If the buffer is too small, nothing is copied and
+// the required length is returned. -1 is returned if the value is not
+// available.
+//
+//	get_info(key_ptr, key_len, ptr, size) i32
+//	get_rcpt(idx, ptr, size) i32
+//	get_header(name_ptr, name_len, idx, ptr, size) i32
+//	get_body(offset, ptr, size) i32  - copies up to size bytes, 0 at the end
+//	add_header(name_ptr, name_len, value_ptr, value_len)
+//	set_result(action, code, enhanced_code, msg_ptr, msg_len)
+//	log(ptr, len)
+//
+// The guest should export the memory and the check(stage i32) function.
+
+type callStateKey struct{}
+
+type wazeroRuntime struct {
+	rt        wazero.Runtime
+	compiled  wazero.CompiledModule
+	timeLimit time.Duration
+}
+
+func newRuntime(blob []byte, memoryPages uint32, timeLimit time.Duration, logger log.Logger) (runtime, error) {
+	ctx := context.Background()
+
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(memoryPages).
+		WithCloseOnContextDone(true))
+
+	_, err := rt.NewHostModuleBuilder("maddy").
+		NewFunctionBuilder().WithFunc(hostGetInfo).Export("get_info").
+		NewFunctionBuilder().WithFunc(hostGetRcpt).Export("get_rcpt").
+		NewFunctionBuilder().WithFunc(hostGetHeader).Export("get_header").
+		NewFunctionBuilder().WithFunc(hostGetBody).Export("get_body").
+		NewFunctionBuilder().WithFunc(hostAddHeader).Export("add_header").
+		NewFunctionBuilder().WithFunc(hostSetResult).Export("set_result").
+		NewFunctionBuilder().WithFunc(hostLog).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := rt.CompileModule(ctx, blob)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	if _, ok := compiled.ExportedFunctions()["check"]; !ok {
+		rt.Close(ctx)
+		return nil, errors.New("module does not export the check function")
+	}
+
+	logger.DebugMsg("module compiled", "memory_pages", memoryPages, "time_limit", timeLimit)
+
+	return &wazeroRuntime{
+		rt:        rt,
+		compiled:  compiled,
+		timeLimit: timeLimit,
+	}, nil
+}
+
+func (r *wazeroRuntime) Run(ctx context.Context, cs *callState) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeLimit)
+	defer cancel()
+	ctx = context.WithValue(ctx, callStateKey{}, cs)
+
+	// Each call gets a fresh instance so no state is shared between
+	// messages.
+	mod, err := r.rt.InstantiateModule(ctx, r.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return err
+	}
+	defer mod.Close(ctx)
+
+	if _, err := mod.ExportedFunction("check").Call(ctx, api.EncodeI32(cs.stage)); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("time limit exceeded: %w", err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *wazeroRuntime) Close() error {
+	return r.rt.Close(context.Background())
+}
+
+func stateFrom(ctx context.Context) *callState {
+	return ctx.Value(callStateKey{}).(*callState)
+}
+
+func readString(m api.Module, ptr, size uint32) string {
+	b, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		panic(errors.New("out of bounds memory access"))
+	}
+	return string(b)
+}
+
+func writeValue(m api.Module, ptr, size uint32, value []byte) int32 {
+	if uint32(len(value)) > size {
+		return int32(len(value))
+	}
+	if !m.Memory().Write(ptr, value) {
+		panic(errors.New("out of bounds memory access"))
+	}
+	return int32(len(value))
+}
+
+func hostGetInfo(ctx context.Context, m api.Module, keyPtr, keyLen, ptr, size uint32) int32 {
+	value, ok := stateFrom(ctx).info(readString(m, keyPtr, keyLen))
+	if !ok {
+		return -1
+	}
+	return writeValue(m, ptr, size, []byte(value))
+}
+
+func hostGetRcpt(ctx context.Context, m api.Module, idx, ptr, size uint32) int32 {
+	value, ok := stateFrom(ctx).rcptAt(int(idx))
+	if !ok {
+		return -1
+	}
+	return writeValue(m, ptr, size, []byte(value))
+}
+
+func hostGetHeader(ctx context.Context, m api.Module, namePtr, nameLen, idx, ptr, size uint32) int32 {
+	value, ok := stateFrom(ctx).headerValue(readString(m, namePtr, nameLen), int(idx))
+	if !ok {
+		return -1
+	}
+	return writeValue(m, ptr, size, []byte(value))
+}
+
+func hostGetBody(ctx context.Context, m api.Module, offset, ptr, size uint32) int32 {
+	body, err := stateFrom(ctx).bodyAt(int(offset))
+	if err != nil {
+		panic(err)
+	}
+	if uint32(len(body)) > size {
+		body = body[:size]
+	}
+	return writeValue(m, ptr, size, body)
+}
+
+func hostAddHeader(ctx context.Context, m api.Module, namePtr, nameLen, valuePtr, valueLen uint32) {
+	stateFrom(ctx).addHeaderField(readString(m, namePtr, nameLen), readString(m, valuePtr, valueLen))
+}
+
+func hostSetResult(ctx context.Context, m api.Module, action, code int32, enhancedCode, msgPtr, msgLen uint32) {
+	stateFrom(ctx).setResult(action, code, enhancedCode, readString(m, msgPtr, msgLen))
+}
+
+func hostLog(ctx context.Context, m api.Module, ptr, size uint32) {
+	cs := stateFrom(ctx)
+	cs.log.Msg("module log", "stage", cs.stage, "msg", readString(m, ptr, size))
+}
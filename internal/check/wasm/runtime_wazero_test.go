@@ -0,0 +1,147 @@
+//go:build wazero
+// +build wazero
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package wasm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+func wasmModule(sections ...[]byte) []byte {
+	blob := append([]byte{}, wasmHeader...)
+	for _, s := range sections {
+		blob = append(blob, s...)
+	}
+	return blob
+}
+
+var (
+	// (type (func (param i32)))
+	typeCheck = []byte{0x01, 0x05, 0x01, 0x60, 0x01, 0x7f, 0x00}
+	// (func (type 0))
+	funcCheck = []byte{0x03, 0x02, 0x01, 0x00}
+	// (export "check" (func 0))
+	exportCheck = []byte{0x07, 0x09, 0x01, 0x05, 'c', 'h', 'e', 'c', 'k', 0x00, 0x00}
+)
+
+func newTestRuntime(t *testing.T, blob []byte) runtime {
+	t.Helper()
+	rt, err := newRuntime(blob, 16, time.Second, testutils.Logger(t, modName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rt.Close() })
+	return rt
+}
+
+func TestRuntime_Compile(t *testing.T) {
+	log := testutils.Logger(t, modName)
+
+	if _, err := newRuntime([]byte("not wasm"), 16, time.Second, log); err == nil {
+		t.Error("expected an error for an invalid module")
+	}
+	if _, err := newRuntime(wasmModule(), 16, time.Second, log); err == nil {
+		t.Error("expected an error for a module without the check function")
+	}
+}
+
+func TestRuntime_Accept(t *testing.T) {
+	// (func (param i32))
+	code := []byte{0x0a, 0x04, 0x01, 0x02, 0x00, 0x0b}
+	rt := newTestRuntime(t, wasmModule(typeCheck, funcCheck, exportCheck, code))
+
+	cs := &callState{stage: StageBody}
+	if err := rt.Run(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if res := cs.result(); res.Reject || res.Quarantine {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestRuntime_Reject(t *testing.T) {
+	blob := wasmModule(
+		// (type (func (param i32)))
+		// (type (func (param i32 i32 i32 i32 i32)))
+		[]byte{0x01, 0x0d, 0x02,
+			0x60, 0x01, 0x7f, 0x00,
+			0x60, 0x05, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x00},
+		// (import "maddy" "set_result" (func (type 1)))
+		[]byte{0x02, 0x14, 0x01,
+			0x05, 'm', 'a', 'd', 'd', 'y',
+			0x0a, 's', 'e', 't', '_', 'r', 'e', 's', 'u', 'l', 't',
+			0x00, 0x01},
+		funcCheck,
+		// (memory 1)
+		[]byte{0x05, 0x03, 0x01, 0x00, 0x01},
+		// (export "check" (func 1)) (export "memory" (memory 0))
+		[]byte{0x07, 0x12, 0x02,
+			0x05, 'c', 'h', 'e', 'c', 'k', 0x00, 0x01,
+			0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00},
+		// (func (call 0 (i32.const 1) (i32.const 550) (i32.const 0)
+		//               (i32.const 0) (i32.const 0)))
+		[]byte{0x0a, 0x11, 0x01, 0x0f, 0x00,
+			0x41, 0x01,
+			0x41, 0xa6, 0x04,
+			0x41, 0x00,
+			0x41, 0x00,
+			0x41, 0x00,
+			0x10, 0x00,
+			0x0b},
+	)
+	rt := newTestRuntime(t, blob)
+
+	cs := &callState{stage: StageBody}
+	if err := rt.Run(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	res := cs.result()
+	if !res.Reject {
+		t.Fatalf("expected rejection: %+v", res)
+	}
+	fields := exterrors.Fields(res.Reason)
+	if fields["smtp_code"] != 550 || fields["smtp_enchcode"] != (exterrors.EnhancedCode{5, 7, 1}) {
+		t.Errorf("wrong error: %v", fields)
+	}
+}
+
+func TestRuntime_TimeLimit(t *testing.T) {
+	// (func (param i32) (loop (br 0)))
+	code := []byte{0x0a, 0x09, 0x01, 0x07, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b}
+	blob := wasmModule(typeCheck, funcCheck, exportCheck, code)
+
+	rt, err := newRuntime(blob, 16, 100*time.Millisecond, testutils.Logger(t, modName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	if err := rt.Run(context.Background(), &callState{stage: StageBody}); err == nil {
+		t.Fatal("expected an error for a module exceeding the time limit")
+	}
+}
@@ -0,0 +1,449 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/hooks"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+// Backup is a tar archive with the following layout:
+//
+//	manifest.json                 backupManifest, always the first entry
+//	accounts/USER/account.json    backupAccount
+//	accounts/USER/N/UID.eml       message, N is the index in backupAccount.Mailboxes
+//
+// USER is path-escaped. Messages of each account follow its account.json.
+// Message flags are stored in the MADDY.flags PAX record, internal date is
+// stored as the modification time.
+
+const (
+	backupFormatVersion = 1
+	backupManifestName  = "manifest.json"
+	backupFlagsRecord   = "MADDY.flags"
+)
+
+type backupManifest struct {
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Accounts []string  `json:"accounts"`
+}
+
+type backupAccount struct {
+	userRecord
+	Mailboxes []string `json:"mailboxes,omitempty"`
+}
+
+func init() {
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "backup",
+			Usage: "Write a backup of user accounts and messages",
+			Description: `Write credentials, aliases and messages of all (or selected) accounts
+to a tar archive. If FILE is not specified or is "-", the archive is written
+to stdout and can be compressed using external tools.
+
+Password hashes are saved only if the credentials store is a pass_table.
+
+Each mailbox is read at once, but changes made to other mailboxes while
+the backup is running may be partially included. For a fully consistent
+snapshot, stop the server during the backup.
+`,
+			ArgsUsage: "[FILE]",
+			Flags: append(usersModulesFlags(),
+				&cli.StringSliceFlag{
+					Name:    "account",
+					Aliases: []string{"a"},
+					Usage:   "Back up only the specified account, can be specified multiple times",
+				},
+			),
+			Action: backupCreate,
+		}))
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "restore",
+			Usage: "Restore user accounts and messages from a backup",
+			Description: `Restore accounts from the archive created by 'maddy backup'. If FILE
+is not specified or is "-", the archive is read from stdin.
+
+By default, accounts are created and the restore fails if any of them
+already exists. Use --skip-existing to leave existing accounts unchanged
+or --messages-only to add messages to existing accounts without
+touching credentials (e.g. to recover accidentally removed messages,
+note that messages that were not removed will be duplicated).
+
+Aliases are restored only if --aliases-cfg-block is set.
+`,
+			ArgsUsage: "[FILE]",
+			Flags: append(usersModulesFlags(),
+				&cli.StringSliceFlag{
+					Name:    "account",
+					Aliases: []string{"a"},
+					Usage:   "Restore only the specified account, can be specified multiple times",
+				},
+				&cli.BoolFlag{
+					Name:  "skip-existing",
+					Usage: "Do not restore accounts that already exist",
+				},
+				&cli.BoolFlag{
+					Name:  "messages-only",
+					Usage: "Restore only messages into existing accounts",
+				},
+			),
+			Action: backupRestore,
+		}))
+}
+
+func backupAccountDir(username string) string {
+	return path.Join("accounts", url.PathEscape(username))
+}
+
+func writeBackupJSON(tw *tar.Writer, name string, v interface{}) error {
+	blob, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o600,
+		Size:    int64(len(blob)),
+		ModTime: time.Now(),
+		Format:  tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	_, err = tw.Write(blob)
+	return err
+}
+
+func backupCreate(ctx *cli.Context) error {
+	mods, err := openUsersBulkModules(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer mods.close()
+
+	users, err := mods.creds.ListUsers()
+	if err != nil {
+		return err
+	}
+	sort.Strings(users)
+	if ctx.IsSet("account") {
+		known := make(map[string]bool, len(users))
+		for _, u := range users {
+			known[u] = true
+		}
+		users = ctx.StringSlice("account")
+		for _, u := range users {
+			if !known[u] {
+				return cli.Exit(fmt.Sprintf("Error: unknown account: %s", u), 2)
+			}
+		}
+	}
+
+	aliases, err := mods.aliasesByTarget()
+	if err != nil {
+		return err
+	}
+
+	f, err := openUsersBulkFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeBackup(ctx, f, mods, users, aliases)
+}
+
+// writeBackup writes the backup of the specified accounts to w. aliases
+// contains aliases of each account, as returned by aliasesByTarget.
+func writeBackup(ctx *cli.Context, w io.Writer, mods *usersBulkModules, users []string, aliases map[string][]string) error {
+	tw := tar.NewWriter(w)
+	if err := writeBackupJSON(tw, backupManifestName, backupManifest{
+		Version:  backupFormatVersion,
+		Created:  time.Now(),
+		Accounts: users,
+	}); err != nil {
+		return err
+	}
+	for _, username := range users {
+		if err := backupAccountData(ctx, tw, mods, username, aliases[username]); err != nil {
+			return fmt.Errorf("%s: %w", username, err)
+		}
+	}
+	return tw.Close()
+}
+
+func backupAccountData(ctx *cli.Context, tw *tar.Writer, mods *usersBulkModules, username string, aliases []string) error {
+	rec, err := mods.exportAccount(username, aliases)
+	if err != nil {
+		return err
+	}
+	acct := backupAccount{userRecord: rec}
+
+	var u imapbackend.User
+	if mods.storage != nil {
+		// exportAccount already reported the error.
+		u, err = mods.storage.GetIMAPAcct(username)
+		if err == nil {
+			defer u.Logout()
+			acct.Mailboxes, err = exportMailboxes(u, ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	dir := backupAccountDir(username)
+	if err := writeBackupJSON(tw, path.Join(dir, "account.json"), acct); err != nil {
+		return err
+	}
+
+	for i, name := range acct.Mailboxes {
+		mboxDir := path.Join(dir, strconv.Itoa(i))
+		err := exportMailbox(u, name, &mboxTransferState{}, func(msg exportedMsg) error {
+			hdr := &tar.Header{
+				Name:    path.Join(mboxDir, strconv.FormatUint(uint64(msg.uid), 10)+".eml"),
+				Mode:    0o600,
+				Size:    int64(len(msg.body)),
+				ModTime: msg.date,
+				Format:  tar.FormatPAX,
+			}
+			if len(msg.flags) != 0 {
+				hdr.PAXRecords = map[string]string{
+					backupFlagsRecord: strings.Join(msg.flags, " "),
+				}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := tw.Write(msg.body)
+			return err
+		}, func() error { return nil })
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// restoreAccount is the account currently being restored by backupRestore.
+type restoreAccount struct {
+	username  string
+	skip      bool
+	user      imapbackend.User
+	mailboxes []string
+	count     int
+}
+
+func backupRestore(ctx *cli.Context) error {
+	f, err := openUsersBulkFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	selected, err := readBackupManifest(ctx, tr)
+	if err != nil {
+		return err
+	}
+
+	mods, err := openUsersBulkModules(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer mods.close()
+
+	return restoreBackup(ctx, tr, mods, selected)
+}
+
+// readBackupManifest reads and validates the manifest entry of the backup.
+// It returns the set of accounts selected for restore, the set is empty if
+// all accounts should be restored.
+func readBackupManifest(ctx *cli.Context, tr *tar.Reader) (map[string]bool, error) {
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return nil, cli.Exit("Error: not a maddy backup", 2)
+	}
+	var manifest backupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, cli.Exit(fmt.Sprintf("Error: malformed manifest: %v", err), 2)
+	}
+	if manifest.Version != backupFormatVersion {
+		return nil, cli.Exit(fmt.Sprintf("Error: unsupported backup version: %d", manifest.Version), 2)
+	}
+
+	selected := map[string]bool{}
+	if ctx.IsSet("account") {
+		inBackup := make(map[string]bool, len(manifest.Accounts))
+		for _, u := range manifest.Accounts {
+			inBackup[u] = true
+		}
+		for _, u := range ctx.StringSlice("account") {
+			if !inBackup[u] {
+				return nil, cli.Exit(fmt.Sprintf("Error: account %s is not in the backup", u), 2)
+			}
+			selected[u] = true
+		}
+	}
+	return selected, nil
+}
+
+// restoreBackup restores accounts from the backup entries following the
+// manifest.
+func restoreBackup(ctx *cli.Context, tr *tar.Reader, mods *usersBulkModules, selected map[string]bool) error {
+	var cur *restoreAccount
+	finish := func() {
+		if cur == nil || cur.skip {
+			return
+		}
+		if cur.user != nil {
+			cur.user.Logout()
+		}
+		fmt.Fprintf(os.Stderr, "Restored %s, %d messages\n", cur.username, cur.count)
+	}
+	defer finish()
+
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		parts := strings.Split(hdr.Name, "/")
+		if len(parts) < 3 || parts[0] != "accounts" {
+			return fmt.Errorf("unexpected entry in backup: %s", hdr.Name)
+		}
+		username, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return fmt.Errorf("unexpected entry in backup: %s", hdr.Name)
+		}
+
+		if len(parts) == 3 && parts[2] == "account.json" {
+			finish()
+
+			var acct backupAccount
+			if err := json.NewDecoder(tr).Decode(&acct); err != nil {
+				return fmt.Errorf("%s: malformed account data: %w", username, err)
+			}
+			cur = &restoreAccount{
+				username:  username,
+				skip:      len(selected) != 0 && !selected[username],
+				mailboxes: acct.Mailboxes,
+			}
+			if cur.skip {
+				continue
+			}
+			if err := restoreAccountData(ctx, mods, cur, acct); err != nil {
+				return fmt.Errorf("%s: %w", username, err)
+			}
+			continue
+		}
+
+		if len(parts) != 4 || cur == nil || cur.username != username {
+			return fmt.Errorf("unexpected entry in backup: %s", hdr.Name)
+		}
+		if cur.skip || cur.user == nil {
+			continue
+		}
+		idx, err := strconv.Atoi(parts[2])
+		if err != nil || idx < 0 || idx >= len(cur.mailboxes) {
+			return fmt.Errorf("unexpected entry in backup: %s", hdr.Name)
+		}
+
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		flags := []string{}
+		for _, flag := range strings.Fields(hdr.PAXRecords[backupFlagsRecord]) {
+			if flag != imap.RecentFlag {
+				flags = append(flags, flag)
+			}
+		}
+		if err := cur.user.CreateMessage(cur.mailboxes[idx], flags, hdr.ModTime, bytes.NewReader(body), nil); err != nil {
+			return fmt.Errorf("%s: %s: %w", username, cur.mailboxes[idx], err)
+		}
+		cur.count++
+	}
+}
+
+func restoreAccountData(ctx *cli.Context, mods *usersBulkModules, cur *restoreAccount, acct backupAccount) error {
+	if !ctx.Bool("messages-only") {
+		exists, err := mods.userExists(acct.Username)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if ctx.Bool("skip-existing") {
+				fmt.Fprintf(os.Stderr, "Skipping %s, already exists\n", acct.Username)
+				cur.skip = true
+				return nil
+			}
+			return errors.New("account already exists, use --skip-existing or --messages-only")
+		}
+		if acct.Hash == "" {
+			return errors.New("backup does not contain the password hash")
+		}
+		if mods.aliases == nil {
+			acct.Aliases = nil
+		}
+		if err := mods.createAccount(ctx, acct.userRecord); err != nil {
+			return err
+		}
+	}
+
+	if mods.storage == nil {
+		return nil
+	}
+	u, err := mods.storage.GetIMAPAcct(acct.Username)
+	if err != nil {
+		return err
+	}
+	cur.user = u
+	for _, name := range acct.Mailboxes {
+		if err := ensureMailbox(u, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/table"
+	"github.com/urfave/cli/v2"
+)
+
+func backupTestContext(t *testing.T, args ...string) *cli.Context {
+	t.Helper()
+
+	flags := append(usersModulesFlags(),
+		&cli.StringSliceFlag{Name: "account"},
+		&cli.BoolFlag{Name: "skip-existing"},
+		&cli.BoolFlag{Name: "messages-only"},
+	)
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func sqlTableNode(dir, name string) config.Node {
+	return config.Node{
+		Name: "table",
+		Args: []string{"sql_table"},
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, name+".db")}},
+			{Name: "table_name", Args: []string{name}},
+		},
+	}
+}
+
+func backupTestModules(t *testing.T) *usersBulkModules {
+	t.Helper()
+	dir := t.TempDir()
+
+	creds, err := pass_table.New("pass_table", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := creds.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			sqlTableNode(dir, "passwords"),
+			{Name: "bcrypt_cost", Args: []string{"4"}},
+			{Name: "hash", Args: []string{"bcrypt"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	aliases, err := table.NewSQLTable("table.sql_table", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aliases.Init(config.NewMap(nil, config.Node{
+		Children: sqlTableNode(dir, "aliases").Children,
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := imapsql.New("storage.imapsql", "", nil, []string{"sqlite3", filepath.Join(dir, "imapsql.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "msg_store", Args: []string{"fs", filepath.Join(dir, "messages")}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	mods := &usersBulkModules{
+		creds:   creds.(module.PlainUserDB),
+		storage: storage.(module.ManageableStorage),
+		aliases: aliases.(module.MutableTable),
+	}
+	t.Cleanup(mods.close)
+	return mods
+}
+
+func restoreTestBackup(ctx *cli.Context, backup []byte, mods *usersBulkModules) error {
+	tr := tar.NewReader(bytes.NewReader(backup))
+	selected, err := readBackupManifest(ctx, tr)
+	if err != nil {
+		return err
+	}
+	return restoreBackup(ctx, tr, mods, selected)
+}
+
+func TestBackup_RoundTrip(t *testing.T) {
+	limit := uint32(1000)
+	accounts := []userRecord{
+		{
+			Username:    "alice@example.org",
+			Password:    "alice-password",
+			AppendLimit: &limit,
+			Aliases:     []string{"a@example.org", "postmaster@example.org"},
+		},
+		{
+			Username: "bob@example.org",
+			Password: "bob-password",
+		},
+	}
+
+	src := backupTestModules(t)
+	ctx := backupTestContext(t)
+	for _, rec := range accounts {
+		if err := src.createAccount(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		u, err := src.storage.GetIMAPAcct(rec.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillTransferMailbox(t, u, "Archive")
+		fillTransferMailbox(t, u, "Work/Projects")
+		u.Logout()
+	}
+
+	users, err := src.creds.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := src.aliasesByTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := writeBackup(ctx, &backup, src, users, aliases); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := backupTestModules(t)
+	if err := restoreTestBackup(ctx, backup.Bytes(), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rec := range accounts {
+		srcHash, _, err := src.creds.(*pass_table.Auth).Lookup(context.Background(), rec.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstHash, _, err := dst.creds.(*pass_table.Auth).Lookup(context.Background(), rec.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dstHash != srcHash {
+			t.Errorf("%s: wrong password hash: %s, want %s", rec.Username, dstHash, srcHash)
+		}
+		if err := dst.creds.(*pass_table.Auth).AuthPlain(context.Background(), rec.Username, rec.Password); err != nil {
+			t.Errorf("%s: authentication failed: %v", rec.Username, err)
+		}
+
+		for _, alias := range rec.Aliases {
+			target, ok, err := dst.aliases.Lookup(context.Background(), alias)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || target != rec.Username {
+				t.Errorf("%s: wrong alias target: %s (%v)", alias, target, ok)
+			}
+		}
+
+		u, err := dst.storage.GetIMAPAcct(rec.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actualLimit := u.(AppendLimitUser).CreateMessageLimit()
+		switch {
+		case rec.AppendLimit == nil && actualLimit != nil:
+			t.Errorf("%s: unexpected append limit: %d", rec.Username, *actualLimit)
+		case rec.AppendLimit != nil && (actualLimit == nil || *actualLimit != *rec.AppendLimit):
+			t.Errorf("%s: wrong append limit: %v, want %d", rec.Username, actualLimit, *rec.AppendLimit)
+		}
+		checkTransferMailbox(t, u, "Archive")
+		checkTransferMailbox(t, u, "Work/Projects")
+		u.Logout()
+	}
+
+	// Existing accounts are left unchanged and messages are not duplicated.
+	if err := restoreTestBackup(ctx, backup.Bytes(), dst); err == nil {
+		t.Error("restore into existing accounts succeeded")
+	}
+	if err := restoreTestBackup(backupTestContext(t, "--skip-existing"), backup.Bytes(), dst); err != nil {
+		t.Fatal(err)
+	}
+	u, err := dst.storage.GetIMAPAcct("bob@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Logout()
+	checkTransferMailbox(t, u, "Archive")
+}
+
+func TestBackup_RestoreSelected(t *testing.T) {
+	src := backupTestModules(t)
+	ctx := backupTestContext(t)
+	for _, username := range []string{"alice@example.org", "bob@example.org"} {
+		if err := src.createAccount(ctx, userRecord{Username: username, Password: "password"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var backup bytes.Buffer
+	if err := writeBackup(ctx, &backup, src, []string{"alice@example.org", "bob@example.org"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := backupTestModules(t)
+	if err := restoreTestBackup(backupTestContext(t, "--account", "bob@example.org"), backup.Bytes(), dst); err != nil {
+		t.Fatal(err)
+	}
+	users, err := dst.creds.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0] != "bob@example.org" {
+		t.Errorf("wrong accounts restored: %v", users)
+	}
+
+	err = restoreTestBackup(backupTestContext(t, "--account", "eve@example.org"), backup.Bytes(), backupTestModules(t))
+	if err == nil {
+		t.Error("restore of the account not in the backup succeeded")
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/config"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "db",
+			Usage: "SQL schema management and backups",
+			Description: `These commands manage the schema of SQL tables used by maddy modules
+(such as the MTA-STS policy cache).
+
+Pending migrations are applied automatically on start-up unless
+'sql_auto_migrate no' is set in the configuration. In that case, these commands
+should be used to upgrade the schema after maddy update.
+
+The schema of storage.imapsql tables is managed by go-imap-sql and is
+always upgraded automatically.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "status",
+					Usage: "Show current schema versions and pending migrations",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "cfg-block",
+							Usage:    "Module configuration block to use",
+							EnvVars:  []string{"MADDY_CFGBLOCK"},
+							Required: true,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						migrators, err := openMigrators(ctx)
+						if err != nil {
+							return err
+						}
+						return dbStatus(migrators)
+					},
+				},
+				{
+					Name:  "migrate",
+					Usage: "Apply pending migrations",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "cfg-block",
+							Usage:    "Module configuration block to use",
+							EnvVars:  []string{"MADDY_CFGBLOCK"},
+							Required: true,
+						},
+						&cli.IntFlag{
+							Name:  "to",
+							Usage: "Migrate up to the specified version instead of the latest one",
+							Value: -1,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						migrators, err := openMigrators(ctx)
+						if err != nil {
+							return err
+						}
+						return dbMigrate(migrators, ctx)
+					},
+				},
+				{
+					Name:  "rollback",
+					Usage: "Revert applied migrations",
+					Description: `Revert migrations down to the specified version.
+
+Use it to downgrade maddy to the previous version. Note that reverting
+migrations may remove data stored in new tables and columns.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "cfg-block",
+							Usage:    "Module configuration block to use",
+							EnvVars:  []string{"MADDY_CFGBLOCK"},
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  "component",
+							Usage: "Revert migrations only for the specified component",
+						},
+						&cli.IntFlag{
+							Name:     "to",
+							Usage:    "Schema version to revert to",
+							Required: true,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						migrators, err := openMigrators(ctx)
+						if err != nil {
+							return err
+						}
+						return dbRollback(migrators, ctx)
+					},
+				},
+				{
+					Name:      "backup",
+					Usage:     "Copy the SQLite database without stopping the server",
+					ArgsUsage: "OUTPUT",
+					Description: `Write a consistent copy of the storage.imapsql SQLite database
+to the OUTPUT file. Unlike copying the database file directly, it is safe
+to do while the server is running.
+
+Only the database is copied, messages stored in msg_store should be backed up
+separately. Back up the database first so all referenced messages are present
+in the message store backup.
+
+PostgreSQL and MySQL databases should be backed up using pg_dump and
+mysqldump.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "cfg-block",
+							Usage:    "Module configuration block to use",
+							EnvVars:  []string{"MADDY_CFGBLOCK"},
+							Required: true,
+						},
+					},
+					Action: dbBackup,
+				},
+			},
+		}))
+}
+
+func openMigrators(ctx *cli.Context) ([]*sqlmigrate.Migrator, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prov, ok := mod.Instance.(sqlmigrate.Provider)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not use SQL tables managed by maddy", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	migrators := prov.Migrators()
+	if len(migrators) == 0 {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not use SQL tables managed by maddy", ctx.String("cfg-block")), 2)
+	}
+	return migrators, nil
+}
+
+// dbBackuper is implemented by modules that can create consistent copies of
+// their databases.
+type dbBackuper interface {
+	BackupDB(ctx context.Context, path string) error
+}
+
+func dbBackup(ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return cli.Exit("Error: OUTPUT is required", 2)
+	}
+
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return err
+	}
+	backuper, ok := mod.Instance.(dbBackuper)
+	if !ok {
+		return cli.Exit(fmt.Sprintf("Error: configuration block %s does not support backups", ctx.String("cfg-block")), 2)
+	}
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+	defer closeIfNeeded(mod.Instance)
+
+	if err := backuper.BackupDB(context.Background(), path); err != nil {
+		return err
+	}
+	fmt.Println("Database copied to", path)
+	return nil
+}
+
+func dbStatus(migrators []*sqlmigrate.Migrator) error {
+	for _, m := range migrators {
+		current, err := m.Current(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: version %d, latest %d\n", m.Component, current, m.Latest())
+
+		pending, err := m.Pending(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, mig := range pending {
+			fmt.Printf("  pending: %d %s\n", mig.Version, mig.Description)
+		}
+	}
+	return nil
+}
+
+func dbMigrate(migrators []*sqlmigrate.Migrator, ctx *cli.Context) error {
+	for _, m := range migrators {
+		target := ctx.Int("to")
+		if target < 0 {
+			target = m.Latest()
+		}
+		if err := m.Migrate(context.Background(), target); err != nil {
+			return err
+		}
+
+		current, err := m.Current(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: version %d\n", m.Component, current)
+	}
+	return nil
+}
+
+func dbRollback(migrators []*sqlmigrate.Migrator, ctx *cli.Context) error {
+	component := ctx.String("component")
+	if len(migrators) > 1 && component == "" {
+		return cli.Exit("Error: --component is required since the module uses multiple components", 2)
+	}
+
+	found := false
+	for _, m := range migrators {
+		if component != "" && m.Component != component {
+			continue
+		}
+		found = true
+
+		if err := m.Rollback(context.Background(), ctx.Int("to")); err != nil {
+			return err
+		}
+		fmt.Printf("%s: version %d\n", m.Component, ctx.Int("to"))
+	}
+	if !found {
+		return cli.Exit(fmt.Sprintf("Error: unknown component: %s", component), 2)
+	}
+	return nil
+}
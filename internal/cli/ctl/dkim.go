@@ -0,0 +1,150 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "dkim",
+			Usage: "DKIM keys management",
+			Description: `These commands manage keys used by modify.dkim.
+
+Corresponding modifier should be defined in maddy.conf as a top-level
+config block, e.g. 'modify.dkim local_dkim { ... }'. By default the
+block name should be local_dkim (can be changed using --cfg-block argument
+for subcommands).
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "records",
+					Usage: "Print DNS records for used keys",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_dkim",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						m, err := openDKIM(ctx)
+						if err != nil {
+							return err
+						}
+						defer m.Close()
+						return dkimRecords(m)
+					},
+				},
+				{
+					Name:  "rotate",
+					Usage: "Generate new keys for the domain",
+					Description: `Generate new keys for all configured selectors.
+
+By default, new keys are used by the server after the grace period configured
+using rotate_grace directive. The server picks up the change within an hour.
+`,
+					ArgsUsage: "DOMAIN",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_dkim",
+						},
+						&cli.BoolFlag{
+							Name:  "activate",
+							Usage: "Use the new keys immediately, without waiting for the grace period",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						m, err := openDKIM(ctx)
+						if err != nil {
+							return err
+						}
+						defer m.Close()
+						return dkimRotate(m, ctx)
+					},
+				},
+			},
+		}))
+}
+
+func openDKIM(ctx *cli.Context) (*dkim.Modifier, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := mod.Instance.(*dkim.Modifier)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not modify.dkim", ctx.String("cfg-block")), 2)
+	}
+
+	if err := m.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return m, nil
+}
+
+func dkimRecords(m *dkim.Modifier) error {
+	records, err := m.DNSRecords()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		// TXT record strings are limited to 255 characters, longer values
+		// (e.g. for RSA keys) should be split.
+		value := r.Value
+		var parts []string
+		for len(value) > 255 {
+			parts = append(parts, `"`+value[:255]+`"`)
+			value = value[255:]
+		}
+		parts = append(parts, `"`+value+`"`)
+
+		fmt.Printf("; %s\n", r.State)
+		fmt.Printf("%s. IN TXT %s\n", r.Name(), strings.Join(parts, " "))
+	}
+	return nil
+}
+
+func dkimRotate(m *dkim.Modifier, ctx *cli.Context) error {
+	domain := ctx.Args().First()
+	if domain == "" {
+		return cli.Exit("Error: DOMAIN is required", 2)
+	}
+
+	if err := m.Rotate(domain, ctx.Bool("activate")); err != nil {
+		return err
+	}
+
+	return dkimRecords(m)
+}
@@ -87,12 +87,7 @@ func hashCommand(ctx *cli.Context) error {
 		return cli.Exit(fmt.Sprintf("Error: Unknown hash function, available: %s", strings.Join(funcs, ", ")), 2)
 	}
 
-	opts := pass_table.HashOpts{
-		BcryptCost:    bcrypt.DefaultCost,
-		Argon2Memory:  1024,
-		Argon2Time:    2,
-		Argon2Threads: 1,
-	}
+	opts := pass_table.DefaultHashOpts()
 	if ctx.IsSet("bcrypt-cost") {
 		if ctx.Int("bcrypt-cost") > bcrypt.MaxCost {
 			return cli.Exit("Error: too big bcrypt cost", 2)
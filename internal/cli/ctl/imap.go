@@ -36,7 +36,7 @@ import (
 )
 
 func init() {
-	maddycli.AddSubcommand(
+	maddycli.AddSubcommand(withAudit(
 		&cli.Command{
 			Name:  "imap-mboxes",
 			Usage: "IMAP mailboxes (folders) management",
@@ -142,8 +142,8 @@ func init() {
 					},
 				},
 			},
-		})
-	maddycli.AddSubcommand(&cli.Command{
+		}))
+	maddycli.AddSubcommand(withAudit(&cli.Command{
 		Name:  "imap-msgs",
 		Usage: "IMAP messages management",
 		Subcommands: []*cli.Command{
@@ -405,8 +405,108 @@ func init() {
 					return msgsDump(be, ctx)
 				},
 			},
+			{
+				Name:  "export",
+				Usage: "Export messages into mbox or Maildir",
+				Description: `Exports messages from all (or only specified) mailboxes of the user.
+
+For mbox format, PATH is a directory where each mailbox is written into a separate
+file named after the mailbox with .mbox extension. Hierarchy delimiter is replaced
+with the directory separator.
+
+For Maildir format, PATH is the root of Maildir++ directory structure.
+
+Message flags and internal dates are preserved. If --state is specified, progress
+is saved into the specified file and interrupted export can be resumed
+by running the command again with the same arguments.
+`,
+				ArgsUsage: "USERNAME PATH",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "cfg-block",
+						Usage:   "Module configuration block to use",
+						EnvVars: []string{"MADDY_CFGBLOCK"},
+						Value:   "local_mailboxes",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format, valid values: mbox, maildir",
+						Value: "maildir",
+					},
+					&cli.StringSliceFlag{
+						Name:    "mailbox",
+						Aliases: []string{"m"},
+						Usage:   "Export only specified mailbox. Can be specified multiple times",
+					},
+					&cli.PathFlag{
+						Name:  "state",
+						Usage: "Save progress to `FILE` and resume from it if it exists",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					be, err := openStorage(ctx)
+					if err != nil {
+						return err
+					}
+					defer closeIfNeeded(be)
+					return msgsExport(be, ctx)
+				},
+			},
+			{
+				Name:  "import",
+				Usage: "Import messages from mbox or Maildir",
+				Description: `Imports messages into the user mailboxes, creating them if necessary.
+
+For mbox format, PATH can be either a single file or a directory with .mbox files
+(as created by the 'export' subcommand). Single file is imported into the mailbox
+specified using --mailbox (INBOX by default).
+
+For Maildir format, PATH is the root of Maildir++ directory structure
+(as used by Dovecot and Courier).
+
+If --mailbox is specified for a directory, all mailboxes are imported as
+children of the specified one.
+
+Message flags and internal dates are preserved. If --state is specified, progress
+is saved into the specified file and interrupted import can be resumed
+by running the command again with the same arguments.
+
+Note: APPENDLIMIT of target mailboxes is not enforced.
+`,
+				ArgsUsage: "USERNAME PATH",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "cfg-block",
+						Usage:   "Module configuration block to use",
+						EnvVars: []string{"MADDY_CFGBLOCK"},
+						Value:   "local_mailboxes",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Input format, valid values: mbox, maildir",
+						Value: "maildir",
+					},
+					&cli.StringFlag{
+						Name:    "mailbox",
+						Aliases: []string{"m"},
+						Usage:   "Import messages into specified mailbox",
+					},
+					&cli.PathFlag{
+						Name:  "state",
+						Usage: "Save progress to `FILE` and resume from it if it exists",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					be, err := openStorage(ctx)
+					if err != nil {
+						return err
+					}
+					defer closeIfNeeded(be)
+					return msgsImport(be, ctx)
+				},
+			},
 		},
-	})
+	}))
 }
 
 func FormatAddress(addr *imap.Address) string {
@@ -31,7 +31,7 @@ import (
 )
 
 func init() {
-	maddycli.AddSubcommand(
+	maddycli.AddSubcommand(withAudit(
 		&cli.Command{
 			Name:  "imap-acct",
 			Usage: "IMAP storage accounts management",
@@ -182,7 +182,7 @@ APPENDLIMIT value (either global or per-account) cannot be larger than
 					},
 				},
 			},
-		})
+		}))
 }
 
 type SpecialUseUser interface {
@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+)
+
+type maintenanceRunner interface {
+	RunMaintenance(ctx context.Context, jobs []string) error
+}
+
+type fscker interface {
+	Fsck(ctx context.Context, repair bool, report func(imapsql.FsckIssue)) error
+}
+
+func init() {
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "imap-maint",
+			Usage: "IMAP storage maintenance",
+			Description: `These subcommands can be used to run storage housekeeping jobs
+on demand instead of waiting for the maintenance_interval.
+
+Available jobs: ` + strings.Join(imapsql.MaintenanceJobs, ", ") + `.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "run",
+					Usage: "Run maintenance jobs",
+					Description: `Run the specified jobs or all jobs if none are specified.
+maintenance_max_load is not applied.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringSliceFlag{
+							Name:    "job",
+							Aliases: []string{"j"},
+							Usage:   "Job to run, can be specified multiple times",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapMaintRun(be, ctx)
+					},
+				},
+				{
+					Name:  "fsck",
+					Usage: "Check storage consistency",
+					Description: `Cross-check the database against the message store and report found
+inconsistencies: missing message bodies, orphaned blobs, invalid
+UIDNEXT values, wrong blob reference counters and flags of
+non-existent messages.
+
+With --repair, messages with missing bodies are removed and other
+issues are fixed. Repair modifies the database directly without
+notifying connected IMAP clients, so stop the server before using it.
+
+Exit status is 1 if any issues were found and not repaired.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "repair",
+							Usage: "Fix found issues",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapMaintFsck(be, ctx)
+					},
+				},
+			},
+		}))
+}
+
+func imapMaintRun(be module.Storage, ctx *cli.Context) error {
+	runner, ok := be.(maintenanceRunner)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support maintenance jobs", 2)
+	}
+
+	jobs := ctx.StringSlice("job")
+	if len(jobs) == 0 {
+		jobs = imapsql.MaintenanceJobs
+	}
+	for _, job := range jobs {
+		fmt.Println("Running", job)
+		if err := runner.RunMaintenance(context.Background(), []string{job}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func imapMaintFsck(be module.Storage, ctx *cli.Context) error {
+	f, ok := be.(fscker)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support consistency checks", 2)
+	}
+
+	repair := ctx.Bool("repair")
+	if repair && !ctx.Bool("yes") {
+		if !clitools2.Confirmation("Messages with missing bodies will be removed, continue?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	unrepaired := 0
+	err := f.Fsck(context.Background(), repair, func(issue imapsql.FsckIssue) {
+		status := ""
+		if issue.Repaired {
+			status = " (repaired)"
+		} else {
+			unrepaired++
+		}
+		fmt.Printf("%s: %s%s\n", issue.Kind, issue.Detail, status)
+	})
+	if err != nil {
+		return err
+	}
+	if unrepaired != 0 {
+		return cli.Exit(fmt.Sprintf("%d issues found", unrepaired), 1)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package ctl
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/foxcpp/maddy/framework/config"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/imap_filter/rules"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "filing_rules",
+	}
+
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "imap-rules",
+			Usage: "Per-account folder filing rules",
+			Description: `These subcommands manage rules used by imap.filter.rules module
+to select the target folder for delivered messages, mark them as read or
+forward them to another address.
+
+Supported rule kinds: ` + strings.Join(rules.Kinds, ", ") + `.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "list",
+					Usage:     "List rules defined for the account",
+					ArgsUsage: "USERNAME",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						f, err := openFilingRules(ctx)
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						return imapRulesList(f, ctx)
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Add the rule or change actions of the existing one",
+					ArgsUsage: "USERNAME KIND PATTERN [FOLDER]",
+					Description: `Examples:
+  maddy imap-rules set foxcpp@example.org detail lists Lists
+  maddy imap-rules set foxcpp@example.org sender_domain '*.github.com' GitHub
+  maddy imap-rules set --mark-read foxcpp@example.org list_id announce.example.org Announcements
+  maddy imap-rules set --forward accounting@example.org foxcpp@example.org subject invoice
+`,
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						&cli.BoolFlag{
+							Name:  "mark-read",
+							Usage: "Mark matching messages as read",
+						},
+						&cli.StringFlag{
+							Name:  "forward",
+							Usage: "Forward a copy of matching messages to the `ADDRESS`",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						f, err := openFilingRules(ctx)
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						return imapRulesSet(f, ctx)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove the rule",
+					ArgsUsage: "USERNAME KIND PATTERN",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						f, err := openFilingRules(ctx)
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						return imapRulesRemove(f, ctx)
+					},
+				},
+			},
+		}))
+}
+
+func openFilingRules(ctx *cli.Context) (*rules.Filter, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := mod.Instance.(*rules.Filter)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not imap.filter.rules", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return f, nil
+}
+
+func imapRulesList(f *rules.Filter, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	list, err := f.Rules(username)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(os.Stderr, "No rules.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, r := range list {
+		folder := r.Folder
+		if folder == "" {
+			folder = "-"
+		}
+		var actions []string
+		if r.MarkRead {
+			actions = append(actions, "mark-read")
+		}
+		if r.ForwardTo != "" {
+			actions = append(actions, "forward "+r.ForwardTo)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Kind, r.Pattern, folder, strings.Join(actions, ", "))
+	}
+	return w.Flush()
+}
+
+func imapRulesSet(f *rules.Filter, ctx *cli.Context) error {
+	if ctx.NArg() != 3 && ctx.NArg() != 4 {
+		return cli.Exit("Error: USERNAME, KIND and PATTERN are required", 2)
+	}
+	args := ctx.Args()
+
+	err := f.SetRule(rules.Rule{
+		Account:   args.Get(0),
+		Kind:      args.Get(1),
+		Pattern:   args.Get(2),
+		Folder:    args.Get(3),
+		MarkRead:  ctx.Bool("mark-read"),
+		ForwardTo: ctx.String("forward"),
+	})
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	return nil
+}
+
+func imapRulesRemove(f *rules.Filter, ctx *cli.Context) error {
+	if ctx.NArg() != 3 {
+		return cli.Exit("Error: USERNAME, KIND and PATTERN are required", 2)
+	}
+	args := ctx.Args()
+
+	removed, err := f.RemoveRule(args.Get(0), args.Get(1), args.Get(2))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if !removed {
+		return cli.Exit("Error: no such rule", 1)
+	}
+	return nil
+}
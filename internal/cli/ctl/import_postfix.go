@@ -0,0 +1,624 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package ctl
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "import",
+			Usage: "Convert configuration of other mail servers",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "postfix",
+					Usage: "Convert Postfix maps and Dovecot passwd-files",
+					Description: `Reads Postfix virtual alias and transport maps (source files, as
+passed to postmap) and Dovecot passwd-files and writes the following files
+into the output directory:
+
+  aliases       virtual aliases in table.file format
+  users.csv     accounts for 'maddy users import'
+  postfix.conf  module definitions and snippets for maddy.conf
+
+Entries that cannot be converted are reported and listed in postfix.conf as
+comments. Existing files are never overwritten. The configuration of the
+running server is not changed, review the generated files and follow the
+instructions in postfix.conf.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "output",
+							Aliases:  []string{"o"},
+							Usage:    "Write converted files into `DIR`",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  "virtual",
+							Usage: "Postfix virtual alias map `FILE`",
+						},
+						&cli.StringFlag{
+							Name:  "transport",
+							Usage: "Postfix transport map `FILE`",
+						},
+						&cli.StringSliceFlag{
+							Name:  "dovecot-passwd",
+							Usage: "Dovecot passwd-file or userdb `FILE`, can be specified multiple times",
+						},
+						&cli.StringFlag{
+							Name:  "myorigin",
+							Usage: "`DOMAIN` appended to alias targets without a domain, as Postfix does with $myorigin",
+						},
+					},
+					Action: importPostfix,
+				},
+			},
+		})
+}
+
+// postfixEntry is the entry of the Postfix lookup table source file.
+type postfixEntry struct {
+	line       int
+	key, value string
+}
+
+// readPostfixMap reads the Postfix lookup table source file.
+//
+// Lines starting with whitespace continue the previous entry.
+func readPostfixMap(r io.Reader) ([]postfixEntry, error) {
+	var (
+		entries []postfixEntry
+		lineNum int
+	)
+	scnr := bufio.NewScanner(r)
+	for scnr.Scan() {
+		lineNum++
+		line := scnr.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(entries) == 0 {
+				return nil, fmt.Errorf("line %d: continuation line without an entry", lineNum)
+			}
+			entries[len(entries)-1].value += " " + trimmed
+			continue
+		}
+
+		parts := strings.SplitN(trimmed, " ", 2)
+		if tab := strings.SplitN(trimmed, "\t", 2); len(tab[0]) < len(parts[0]) {
+			parts = tab
+		}
+		e := postfixEntry{line: lineNum, key: strings.ToLower(parts[0])}
+		if len(parts) == 2 {
+			e.value = strings.TrimSpace(parts[1])
+		}
+		entries = append(entries, e)
+	}
+	return entries, scnr.Err()
+}
+
+// postfixImport holds the conversion results.
+type postfixImport struct {
+	myorigin string
+
+	aliases  []string
+	catchAll [][2]string
+	domains  []string
+
+	targets []string
+	dests   []string
+
+	users []userRecord
+
+	notes []string
+}
+
+func (imp *postfixImport) note(file string, line int, format string, args ...interface{}) {
+	imp.notes = append(imp.notes, fmt.Sprintf("%s:%d: ", file, line)+fmt.Sprintf(format, args...))
+}
+
+func (imp *postfixImport) convertVirtual(file string, entries []postfixEntry) {
+	for _, e := range entries {
+		values := strings.FieldsFunc(e.value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(values) == 0 {
+			imp.note(file, e.line, "%s: no value, skipped", e.key)
+			continue
+		}
+
+		// Virtual alias domain declaration, the value is ignored by Postfix.
+		if !strings.Contains(e.key, "@") && strings.Contains(e.key, ".") &&
+			len(values) == 1 && !strings.Contains(values[0], "@") {
+			imp.domains = append(imp.domains, e.key)
+			continue
+		}
+
+		targets := make([]string, 0, len(values))
+		for _, val := range values {
+			if strings.HasPrefix(val, "|") || strings.HasPrefix(val, "/") || strings.HasPrefix(val, ":include:") {
+				imp.note(file, e.line, "%s: command, file and include targets are not supported, %s skipped", e.key, val)
+				continue
+			}
+			if !strings.Contains(val, "@") {
+				if imp.myorigin == "" {
+					imp.note(file, e.line, "%s: target %s has no domain and --myorigin is not set, skipped", e.key, val)
+					continue
+				}
+				val += "@" + imp.myorigin
+			}
+			if !address.Valid(val) {
+				imp.note(file, e.line, "%s: invalid target %s, skipped", e.key, val)
+				continue
+			}
+			targets = append(targets, val)
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(e.key, "@") {
+			if len(targets) > 1 {
+				imp.note(file, e.line, "%s: catch-all can have only one target, using %s", e.key, targets[0])
+			}
+			imp.catchAll = append(imp.catchAll, [2]string{e.key[1:], targets[0]})
+			continue
+		}
+		if strings.HasSuffix(e.key, "@") {
+			imp.note(file, e.line, "%s: local-part lookups without the domain are not supported, skipped", e.key)
+			continue
+		}
+		// Keys without the domain match the local part in any domain, same as
+		// in replace_rcpt.
+		imp.aliases = append(imp.aliases, e.key+": "+strings.Join(targets, ", "))
+	}
+}
+
+var (
+	nonAlnum       = regexp.MustCompile(`[^a-z0-9]+`)
+	enhancedCodeRe = regexp.MustCompile(`^[45]\.\d{1,3}\.\d{1,3}$`)
+)
+
+// postfixNexthop parses the Postfix next-hop specification into the maddy
+// endpoint address. The second return value is false if Postfix would do
+// an MX lookup for the host.
+func postfixNexthop(nexthop string, lmtp bool) (string, bool, error) {
+	if lmtp {
+		switch {
+		case strings.HasPrefix(nexthop, "unix:"):
+			return "unix://" + strings.TrimPrefix(nexthop, "unix:"), true, nil
+		case strings.HasPrefix(nexthop, "inet:"):
+			nexthop = strings.TrimPrefix(nexthop, "inet:")
+		}
+	}
+
+	host, port := nexthop, ""
+	exact := false
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end == -1 {
+			return "", false, errors.New("malformed next-hop")
+		}
+		host, port = host[1:end], strings.TrimPrefix(host[end+1:], ":")
+		exact = true
+	} else if i := strings.LastIndexByte(host, ':'); i != -1 {
+		host, port = host[:i], host[i+1:]
+	}
+	if host == "" {
+		return "", false, errors.New("missing next-hop host")
+	}
+	if port == "" {
+		port = "25"
+		if lmtp {
+			port = "24"
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "tcp://" + host + ":" + port, exact || lmtp, nil
+}
+
+// postfixError converts the error or retry transport next-hop ("5.1.1 Text")
+// into the reject directive.
+func postfixError(nexthop string, temporary bool) string {
+	code, enchCode := "550", "5.0.0"
+	if temporary {
+		code, enchCode = "450", "4.3.0"
+	}
+	text := nexthop
+	if parts := strings.SplitN(nexthop, " ", 2); enhancedCodeRe.MatchString(parts[0]) {
+		enchCode = parts[0]
+		code = string(enchCode[0]) + "50"
+		text = ""
+		if len(parts) == 2 {
+			text = parts[1]
+		}
+	}
+	if text == "" {
+		return "reject " + code + " " + enchCode
+	}
+	return "reject " + code + " " + enchCode + ` "` + strings.ReplaceAll(text, `"`, `'`) + `"`
+}
+
+func (imp *postfixImport) convertTransport(file string, entries []postfixEntry) {
+	type dest struct {
+		rule, action string
+		order        int
+	}
+	var (
+		dests   []dest
+		targets = map[string]bool{}
+	)
+
+	for _, e := range entries {
+		var rule string
+		order := 1
+		switch {
+		case e.key == "*":
+			imp.note(file, e.line, "*: default transport %s should be configured in default_destination manually", e.value)
+			continue
+		case strings.HasSuffix(e.key, "@") || strings.HasPrefix(e.key, "@"):
+			imp.note(file, e.line, "%s: partial address keys are not supported, skipped", e.key)
+			continue
+		case strings.Contains(e.key, "@"):
+			rule, order = e.key, 0
+		case strings.HasPrefix(e.key, "."):
+			rule, order = "*"+e.key, 2
+		default:
+			rule = e.key
+		}
+
+		transport, nexthop := e.value, ""
+		if i := strings.IndexByte(e.value, ':'); i != -1 {
+			transport, nexthop = e.value[:i], e.value[i+1:]
+		}
+
+		var action string
+		switch transport {
+		case "local", "virtual":
+			action = "deliver_to &local_routing"
+		case "error":
+			action = postfixError(nexthop, false)
+		case "retry":
+			action = postfixError(nexthop, true)
+		case "discard":
+			action = "deliver_to dummy"
+		case "", "smtp", "relay", "lmtp":
+			if nexthop == "" {
+				if transport == "lmtp" {
+					imp.note(file, e.line, "%s: lmtp transport without next-hop, skipped", e.key)
+					continue
+				}
+				action = "deliver_to &remote_queue"
+				break
+			}
+			lmtp := transport == "lmtp"
+			endp, exact, err := postfixNexthop(nexthop, lmtp)
+			if err != nil {
+				imp.note(file, e.line, "%s: %s: %v, skipped", e.key, nexthop, err)
+				continue
+			}
+			if !exact {
+				imp.note(file, e.line, "%s: Postfix looks up MX records for %s, maddy connects to the host directly", e.key, nexthop)
+			}
+
+			modName := "smtp"
+			if lmtp {
+				modName = "lmtp"
+			}
+			name := "postfix_" + modName + "_" + strings.Trim(nonAlnum.ReplaceAllString(strings.ToLower(endp[strings.Index(endp, "://")+3:]), "_"), "_")
+			if !targets[name] {
+				targets[name] = true
+				def := fmt.Sprintf("target.%s %s {\n    targets %s\n}\n", modName, name, endp)
+				if !lmtp {
+					// target.smtp does not retry failed deliveries.
+					def += fmt.Sprintf("target.queue %s_queue {\n    target &%s\n}\n", name, name)
+				}
+				imp.targets = append(imp.targets, def)
+			}
+			if lmtp {
+				action = "deliver_to &" + name
+			} else {
+				action = "deliver_to &" + name + "_queue"
+			}
+		default:
+			imp.note(file, e.line, "%s: transport %s is not supported, skipped", e.key, transport)
+			continue
+		}
+		dests = append(dests, dest{rule: rule, action: action, order: order})
+	}
+
+	// The first matching destination block is used, so addresses should go
+	// before domains and domains before wildcards.
+	sort.SliceStable(dests, func(i, j int) bool {
+		return dests[i].order < dests[j].order
+	})
+	for _, d := range dests {
+		imp.dests = append(imp.dests, fmt.Sprintf("    destination %s {\n        %s\n    }\n", d.rule, d.action))
+	}
+}
+
+// convertDovecotPasswd converts entries of the Dovecot passwd-file
+// ("user:password:uid:gid:gecos:home:shell:extra_fields").
+func (imp *postfixImport) convertDovecotPasswd(file string, r io.Reader) error {
+	scnr := bufio.NewScanner(r)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 8)
+		if fields[0] == "" {
+			imp.note(file, lineNum, "missing user name, skipped")
+			continue
+		}
+		rec := userRecord{Username: fields[0]}
+
+		pass := ""
+		if len(fields) > 1 {
+			pass = fields[1]
+		}
+		scheme := ""
+		if strings.HasPrefix(pass, "{") && strings.IndexByte(pass, '}') != -1 {
+			scheme = strings.ToUpper(pass[1:strings.IndexByte(pass, '}')])
+		}
+		switch {
+		case pass == "":
+			imp.note(file, lineNum, "%s: no password, skipped", rec.Username)
+			continue
+		case scheme == "PLAIN" || scheme == "CLEARTEXT":
+			rec.Password = pass[strings.IndexByte(pass, '}')+1:]
+		default:
+			hash, err := pass_table.FromDovecotHash(pass)
+			if err != nil {
+				imp.note(file, lineNum, "%s: %v, skipped", rec.Username, err)
+				continue
+			}
+			rec.Hash = hash
+		}
+
+		if len(fields) == 8 && strings.TrimSpace(fields[7]) != "" {
+			imp.note(file, lineNum, "%s: extra fields are not converted: %s", rec.Username, fields[7])
+		}
+		imp.users = append(imp.users, rec)
+	}
+	return scnr.Err()
+}
+
+func (imp *postfixImport) writeUsers(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"username", "password", "hash"}); err != nil {
+		return err
+	}
+	for _, rec := range imp.users {
+		if err := cw.Write([]string{rec.Username, rec.Password, rec.Hash}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (imp *postfixImport) writeConfig(w io.Writer, outDir string) error {
+	b := &strings.Builder{}
+	b.WriteString(`# Generated by 'maddy import postfix'. Review before use.
+#
+# Import this file at the top level of maddy.conf:
+#
+#   import ` + filepath.Join(outDir, "postfix.conf") + `
+#
+`)
+	if len(imp.aliases) != 0 || len(imp.catchAll) != 0 {
+		b.WriteString(`# Virtual aliases are applied by the postfix_aliases snippet, use it
+# in the modify block of the destination with local domains:
+#
+#   modify {
+#       import postfix_aliases
+#   }
+#
+`)
+	}
+	if len(imp.domains) != 0 {
+		b.WriteString("# Virtual alias domains, add them to $(local_domains):\n#\n#   " +
+			strings.Join(imp.domains, " ") + "\n#\n")
+	}
+	if len(imp.dests) != 0 {
+		b.WriteString(`# Transport map entries are converted into destination blocks in the
+# postfix_transport snippet, use it in the smtp endpoint before other
+# destination blocks:
+#
+#   smtp tcp://0.0.0.0:25 {
+#       ...
+#       source $(local_domains) { ... }
+#       default_source {
+#           import postfix_transport
+#           destination postmaster $(local_domains) { ... }
+#           default_destination { ... }
+#       }
+#   }
+#
+`)
+	}
+	if len(imp.users) != 0 {
+		b.WriteString("# Create accounts using:\n#\n#   maddy users import " + filepath.Join(outDir, "users.csv") + "\n#\n")
+	}
+	if len(imp.notes) != 0 {
+		b.WriteString("# Notes:\n#\n")
+		for _, n := range imp.notes {
+			b.WriteString("#   " + n + "\n")
+		}
+		b.WriteString("#\n")
+	}
+
+	if len(imp.catchAll) != 0 {
+		b.WriteString("\ntable.catchall postfix_catchall {\n")
+		for _, entry := range imp.catchAll {
+			b.WriteString("    entry " + entry[0] + " " + entry[1] + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	if len(imp.aliases) != 0 || len(imp.catchAll) != 0 {
+		b.WriteString("\n(postfix_aliases) {\n")
+		if len(imp.aliases) != 0 {
+			b.WriteString("    replace_rcpt file " + filepath.Join(outDir, "aliases") + "\n")
+		}
+		if len(imp.catchAll) != 0 {
+			b.WriteString("    replace_rcpt &postfix_catchall\n")
+		}
+		b.WriteString("}\n")
+	}
+
+	for _, def := range imp.targets {
+		b.WriteString("\n" + def)
+	}
+	if len(imp.dests) != 0 {
+		b.WriteString("\n(postfix_transport) {\n")
+		for _, d := range imp.dests {
+			b.WriteString(d)
+		}
+		b.WriteString("}\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// createOutput creates the file in the output directory, failing if it
+// already exists.
+func createOutput(outDir, name string, write func(io.Writer) error) error {
+	path := filepath.Join(outDir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println("Written", path)
+	return nil
+}
+
+func importPostfix(ctx *cli.Context) error {
+	if ctx.String("virtual") == "" && ctx.String("transport") == "" && len(ctx.StringSlice("dovecot-passwd")) == 0 {
+		return cli.Exit("Error: at least one of --virtual, --transport or --dovecot-passwd is required", 2)
+	}
+	outDir, err := filepath.Abs(ctx.String("output"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+
+	imp := postfixImport{myorigin: ctx.String("myorigin")}
+
+	readMap := func(path string) ([]postfixEntry, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		entries, err := readPostfixMap(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return entries, nil
+	}
+	if path := ctx.String("virtual"); path != "" {
+		entries, err := readMap(path)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+		imp.convertVirtual(path, entries)
+	}
+	if path := ctx.String("transport"); path != "" {
+		entries, err := readMap(path)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+		imp.convertTransport(path, entries)
+	}
+	for _, path := range ctx.StringSlice("dovecot-passwd") {
+		f, err := os.Open(path)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+		err = imp.convertDovecotPasswd(path, f)
+		f.Close()
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %s: %v", path, err), 1)
+		}
+	}
+	if err := validateUserRecords(imp.users, false); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	if err := os.MkdirAll(outDir, 0o700); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if len(imp.aliases) != 0 {
+		err := createOutput(outDir, "aliases", func(w io.Writer) error {
+			_, err := io.WriteString(w, strings.Join(imp.aliases, "\n")+"\n")
+			return err
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+	}
+	if len(imp.users) != 0 {
+		if err := createOutput(outDir, "users.csv", imp.writeUsers); err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+	}
+	err = createOutput(outDir, "postfix.conf", func(w io.Writer) error {
+		return imp.writeConfig(w, outDir)
+	})
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	for _, n := range imp.notes {
+		fmt.Fprintln(os.Stderr, "Warning:", n)
+	}
+	return nil
+}
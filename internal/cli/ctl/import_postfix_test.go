@@ -0,0 +1,202 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPostfixMap(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      string
+		entries []postfixEntry
+		fail    bool
+	}{
+		{
+			name: "comments and blank lines",
+			in: "# comment\n" +
+				"\n" +
+				"   # indented comment\n" +
+				"foo@example.org bar@example.org\n",
+			entries: []postfixEntry{{line: 4, key: "foo@example.org", value: "bar@example.org"}},
+		},
+		{
+			name:    "tab separator",
+			in:      "Foo@Example.ORG\t\tbar@example.org\n",
+			entries: []postfixEntry{{line: 1, key: "foo@example.org", value: "bar@example.org"}},
+		},
+		{
+			name:    "extra whitespace",
+			in:      "foo@example.org    bar@example.org   \n",
+			entries: []postfixEntry{{line: 1, key: "foo@example.org", value: "bar@example.org"}},
+		},
+		{
+			name: "continuation lines",
+			in: "list@example.org a@example.org,\n" +
+				"  b@example.org,\n" +
+				"# comment between continuation lines\n" +
+				"\tc@example.org\n" +
+				"other@example.org d@example.org\n",
+			entries: []postfixEntry{
+				{line: 1, key: "list@example.org", value: "a@example.org, b@example.org, c@example.org"},
+				{line: 5, key: "other@example.org", value: "d@example.org"},
+			},
+		},
+		{
+			name:    "key without value",
+			in:      "foo@example.org\n",
+			entries: []postfixEntry{{line: 1, key: "foo@example.org"}},
+		},
+		{
+			name:    "no trailing newline",
+			in:      "foo@example.org bar@example.org",
+			entries: []postfixEntry{{line: 1, key: "foo@example.org", value: "bar@example.org"}},
+		},
+		{
+			name: "continuation without an entry",
+			in:   "  bar@example.org\n",
+			fail: true,
+		},
+		{
+			name: "continuation after a comment only",
+			in: "# comment\n" +
+				"\tbar@example.org\n",
+			fail: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := readPostfixMap(strings.NewReader(tc.in))
+			if tc.fail {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !reflect.DeepEqual(entries, tc.entries) {
+				t.Errorf("wrong entries:\n%+v\nwant:\n%+v", entries, tc.entries)
+			}
+		})
+	}
+}
+
+func TestConvertDovecotPasswd(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		in    string
+		users []userRecord
+		notes []string
+	}{
+		{
+			name: "comments and blank lines",
+			in: "# user:password\n" +
+				"\n" +
+				"  # indented comment\n" +
+				"a@example.org:{PLAIN}secret\n",
+			users: []userRecord{{Username: "a@example.org", Password: "secret"}},
+		},
+		{
+			name:  "plain scheme",
+			in:    "a@example.org:{PLAIN}secret:1000:1000::/home/a::\n",
+			users: []userRecord{{Username: "a@example.org", Password: "secret"}},
+		},
+		{
+			name:  "cleartext scheme in lower case",
+			in:    "a@example.org:{cleartext}secret\n",
+			users: []userRecord{{Username: "a@example.org", Password: "secret"}},
+		},
+		{
+			name:  "bcrypt",
+			in:    "a@example.org:{BLF-CRYPT}$2y$05$abcdefghijklmnopqrstuv\n",
+			users: []userRecord{{Username: "a@example.org", Hash: "bcrypt:$2y$05$abcdefghijklmnopqrstuv"}},
+		},
+		{
+			name:  "CRYPT with SHA-512",
+			in:    "a@example.org:{CRYPT}$6$salt$hash\n",
+			users: []userRecord{{Username: "a@example.org", Hash: "sha512-crypt:$6$salt$hash"}},
+		},
+		{
+			name:  "SHA256-CRYPT",
+			in:    "a@example.org:{SHA256-CRYPT}$5$salt$hash\n",
+			users: []userRecord{{Username: "a@example.org", Hash: "sha256-crypt:$5$salt$hash"}},
+		},
+		{
+			name:  "extra fields",
+			in:    "a@example.org:{PLAIN}secret:1000:1000::/home/a::userdb_quota_rule=*:storage=1G\n",
+			users: []userRecord{{Username: "a@example.org", Password: "secret"}},
+			notes: []string{"passwd:1: a@example.org: extra fields are not converted: userdb_quota_rule=*:storage=1G"},
+		},
+		{
+			name:  "unsupported scheme",
+			in:    "a@example.org:{MD5-CRYPT}$1$salt$hash\n",
+			notes: []string{"passwd:1: a@example.org: pass_table: unsupported scheme: MD5-CRYPT, skipped"},
+		},
+		{
+			name:  "unsupported CRYPT hash",
+			in:    "a@example.org:{CRYPT}abcdefghijklm\n",
+			notes: []string{"passwd:1: a@example.org: pass_table: unsupported CRYPT hash, only bcrypt and SHA-crypt are supported, skipped"},
+		},
+		{
+			name:  "missing scheme",
+			in:    "a@example.org:secret\n",
+			notes: []string{"passwd:1: a@example.org: pass_table: missing scheme prefix, skipped"},
+		},
+		{
+			name:  "unterminated scheme",
+			in:    "a@example.org:{PLAINsecret\n",
+			notes: []string{"passwd:1: a@example.org: pass_table: malformed scheme prefix, skipped"},
+		},
+		{
+			name:  "missing user name",
+			in:    ":{PLAIN}secret\n",
+			notes: []string{"passwd:1: missing user name, skipped"},
+		},
+		{
+			name: "missing password",
+			in: "a@example.org\n" +
+				"b@example.org::1000\n" +
+				"c@example.org:{PLAIN}secret\n",
+			users: []userRecord{{Username: "c@example.org", Password: "secret"}},
+			notes: []string{
+				"passwd:1: a@example.org: no password, skipped",
+				"passwd:2: b@example.org: no password, skipped",
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			imp := postfixImport{}
+			if err := imp.convertDovecotPasswd("passwd", strings.NewReader(tc.in)); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !reflect.DeepEqual(imp.users, tc.users) {
+				t.Errorf("wrong users:\n%+v\nwant:\n%+v", imp.users, tc.users)
+			}
+			if !reflect.DeepEqual(imp.notes, tc.notes) {
+				t.Errorf("wrong notes:\n%q\nwant:\n%q", imp.notes, tc.notes)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+)
+
+// Maildir++ layout is used: INBOX is stored in the root directory,
+// other mailboxes are stored in subdirectories named ".Name.Subname".
+//
+// Keywords are stored using the dovecot-keywords file that maps
+// lowercase letters in the info part of the file name to keyword names.
+
+const maildirKeywordsFile = "dovecot-keywords"
+
+func maildirDir(root, mbox, delim string) string {
+	if strings.EqualFold(mbox, imap.InboxName) {
+		return root
+	}
+	return filepath.Join(root, "."+strings.ReplaceAll(mbox, delim, "."))
+}
+
+func readMaildirKeywords(dir string) (map[byte]string, error) {
+	f, err := os.Open(filepath.Join(dir, maildirKeywordsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[byte]string{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	keywords := map[byte]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 || idx >= 26 {
+			continue
+		}
+		keywords['a'+byte(idx)] = parts[1]
+	}
+	return keywords, scanner.Err()
+}
+
+func writeMaildirKeywords(dir string, keywords map[byte]string) error {
+	letters := make([]byte, 0, len(keywords))
+	for l := range keywords {
+		letters = append(letters, l)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+
+	buf := bytes.Buffer{}
+	for _, l := range letters {
+		fmt.Fprintf(&buf, "%d %s\n", l-'a', keywords[l])
+	}
+	return os.WriteFile(filepath.Join(dir, maildirKeywordsFile), buf.Bytes(), 0o600)
+}
+
+func exportMaildir(u imapbackend.User, root, name, delim string, st *transferState) error {
+	dir := maildirDir(root, name, delim)
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+
+	status, err := u.Status(name, []imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return err
+	}
+
+	keywords, err := readMaildirKeywords(dir)
+	if err != nil {
+		return err
+	}
+	keywordLetter := func(kw string) (byte, bool) {
+		for l, name := range keywords {
+			if name == kw {
+				return l, true
+			}
+		}
+		if len(keywords) >= 26 {
+			return 0, false
+		}
+		l := 'a' + byte(len(keywords))
+		keywords[l] = kw
+		return l, true
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// '/' and ':' are not allowed in Maildir file names.
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	return exportMailbox(u, name, st.mbox(name), func(msg exportedMsg) error {
+		system, msgKeywords := splitFlags(msg.flags)
+		info := []byte{}
+		for flag, letter := range maildirFlags {
+			if system[flag] {
+				info = append(info, letter)
+			}
+		}
+		kwChanged := false
+		for _, kw := range msgKeywords {
+			l, ok := keywordLetter(kw)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Too many keywords in %s, %s will not be preserved\n", name, kw)
+				continue
+			}
+			info = append(info, l)
+			kwChanged = true
+		}
+		sort.Slice(info, func(i, j int) bool { return info[i] < info[j] })
+		if kwChanged {
+			if err := writeMaildirKeywords(dir, keywords); err != nil {
+				return err
+			}
+		}
+
+		body := toLF(msg.body)
+		base := fmt.Sprintf("%d.U%dV%d.%s,S=%d", msg.date.Unix(), msg.uid, status.UidValidity, hostname, len(body))
+		tmpPath := filepath.Join(dir, "tmp", base)
+		if err := os.WriteFile(tmpPath, body, 0o600); err != nil {
+			return err
+		}
+		if err := os.Chtimes(tmpPath, msg.date, msg.date); err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, filepath.Join(dir, "cur", base+":2,"+string(info)))
+	}, st.save)
+}
+
+func importMaildir(u imapbackend.User, root, mailbox, delim string, st *transferState) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+
+	target := func(name string) string {
+		if mailbox == "" {
+			return name
+		}
+		if strings.EqualFold(name, imap.InboxName) {
+			return mailbox
+		}
+		return mailbox + delim + name
+	}
+
+	if err := importMaildirDir(u, root, target(imap.InboxName), st); err != nil {
+		return fmt.Errorf("%s: %w", root, err)
+	}
+
+	for _, ent := range entries {
+		if !ent.IsDir() || !strings.HasPrefix(ent.Name(), ".") || ent.Name() == "." || ent.Name() == ".." {
+			continue
+		}
+		name := strings.ReplaceAll(strings.TrimPrefix(ent.Name(), "."), ".", delim)
+		dir := filepath.Join(root, ent.Name())
+		if err := importMaildirDir(u, dir, target(name), st); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+type maildirFile struct {
+	path string
+	key  string
+	info string
+}
+
+func importMaildirDir(u imapbackend.User, dir, name string, st *transferState) error {
+	mst := st.mbox(name)
+	if mst.Complete {
+		fmt.Fprintf(os.Stderr, "Skipping %s, already imported\n", dir)
+		return nil
+	}
+
+	var files []maildirFile
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, ent := range entries {
+			if ent.IsDir() || strings.HasPrefix(ent.Name(), ".") {
+				continue
+			}
+			key, info, _ := strings.Cut(ent.Name(), ":")
+			files = append(files, maildirFile{
+				path: filepath.Join(dir, sub, ent.Name()),
+				key:  key,
+				info: info,
+			})
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].key < files[j].key })
+
+	keywords, err := readMaildirKeywords(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureMailbox(u, name); err != nil {
+		return err
+	}
+
+	count := 0
+	for _, file := range files {
+		if mst.LastFile != "" && file.key <= mst.LastFile {
+			continue
+		}
+
+		flags := []string{}
+		if strings.HasPrefix(file.info, "2,") {
+			for _, l := range []byte(file.info[2:]) {
+				if flag, ok := flagLetter(maildirFlags, l); ok {
+					flags = append(flags, flag)
+				} else if kw, ok := keywords[l]; ok {
+					flags = append(flags, kw)
+				}
+			}
+		}
+
+		stat, err := os.Stat(file.path)
+		if err != nil {
+			return err
+		}
+		body, err := os.ReadFile(file.path)
+		if err != nil {
+			return err
+		}
+
+		if err := u.CreateMessage(name, flags, stat.ModTime(), bytes.NewBuffer(toCRLF(body)), nil); err != nil {
+			return err
+		}
+		count++
+
+		mst.LastFile = file.key
+		if err := st.save(); err != nil {
+			return err
+		}
+	}
+
+	mst.Complete = true
+	if err := st.save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d messages into %s\n", count, name)
+	return nil
+}
@@ -0,0 +1,377 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+)
+
+// The mbox files are written in the mboxrd variant: Any line that looks like
+// a "From " separator, optionally prefixed by any amount of '>', gets an
+// additional '>' prepended. This makes quoting reversible.
+//
+// Flags are stored in Status, X-Status and X-Keywords header fields,
+// same as Dovecot and many MUAs do.
+
+var mboxFromLine = regexp.MustCompile(`^>*From `)
+
+const mboxExt = ".mbox"
+
+func mboxFileName(root, mbox, delim string) string {
+	return filepath.Join(root, filepath.FromSlash(strings.ReplaceAll(mbox, delim, "/"))+mboxExt)
+}
+
+func exportMbox(u imapbackend.User, root, name, delim string, st *transferState) error {
+	path := mboxFileName(root, name, delim)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	mst := st.mbox(name)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if mst.LastUID == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	return exportMailbox(u, name, mst, func(msg exportedMsg) error {
+		if err := writeMboxMsg(w, msg); err != nil {
+			return err
+		}
+		return w.Flush()
+	}, st.save)
+}
+
+func writeMboxMsg(w io.Writer, msg exportedMsg) error {
+	if _, err := fmt.Fprintf(w, "From MAILER-DAEMON %s\n", msg.date.UTC().Format(time.ANSIC)); err != nil {
+		return err
+	}
+
+	system, keywords := splitFlags(msg.flags)
+	status := []byte{}
+	for flag, letter := range mboxStatusFlags {
+		if system[flag] {
+			status = append(status, letter)
+		}
+	}
+	// "O" - the message is not new (we do not preserve \Recent).
+	status = append(status, 'O')
+	xstatus := []byte{}
+	for flag, letter := range mboxXStatusFlags {
+		if system[flag] {
+			xstatus = append(xstatus, letter)
+		}
+	}
+	sort.Slice(xstatus, func(i, j int) bool { return xstatus[i] < xstatus[j] })
+
+	if _, err := fmt.Fprintf(w, "Status: %s\n", status); err != nil {
+		return err
+	}
+	if len(xstatus) != 0 {
+		if _, err := fmt.Fprintf(w, "X-Status: %s\n", xstatus); err != nil {
+			return err
+		}
+	}
+	if len(keywords) != 0 {
+		if _, err := fmt.Fprintf(w, "X-Keywords: %s\n", strings.Join(keywords, " ")); err != nil {
+			return err
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(toLF(msg.body)))
+	scanner.Buffer(make([]byte, 0, 4096), len(msg.body)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if mboxFromLine.Match(line) {
+			if _, err := w.Write([]byte{'>'}); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Blank line separating messages.
+	_, err := w.Write([]byte{'\n'})
+	return err
+}
+
+// mboxReader splits the mbox file into separate messages.
+type mboxReader struct {
+	r      *bufio.Reader
+	offset int64
+
+	// First line of the next message ("From " separator), if it was
+	// already consumed.
+	nextFrom []byte
+}
+
+// next returns the next message from the mbox file along with its "From "
+// line date. io.EOF is returned if there are no more messages.
+//
+// After next returns, offset points to the start of the next message.
+func (mr *mboxReader) next() ([]byte, time.Time, error) {
+	fromLine := mr.nextFrom
+	mr.nextFrom = nil
+	mr.offset += int64(len(fromLine))
+	for fromLine == nil {
+		line, err := mr.r.ReadBytes('\n')
+		mr.offset += int64(len(line))
+		if err != nil {
+			if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+				return nil, time.Time{}, io.EOF
+			}
+			if err == io.EOF {
+				return nil, time.Time{}, fmt.Errorf("malformed mbox file, expected 'From ' line")
+			}
+			return nil, time.Time{}, err
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			fromLine = line
+		} else if len(bytes.TrimSpace(line)) != 0 {
+			return nil, time.Time{}, fmt.Errorf("malformed mbox file, expected 'From ' line")
+		}
+	}
+
+	msg := bytes.Buffer{}
+	for {
+		line, err := mr.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, time.Time{}, err
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			// Not accounted in offset so it points at the start of the
+			// next message.
+			mr.nextFrom = line
+			break
+		}
+		mr.offset += int64(len(line))
+
+		if mboxFromLine.Match(line) {
+			line = line[1:]
+		}
+		msg.Write(line)
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	body := msg.Bytes()
+	// Strip the blank line separating messages.
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	body = bytes.TrimSuffix(body, []byte("\r"))
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		body = append(body, '\n')
+	}
+
+	return body, parseFromLineDate(fromLine), nil
+}
+
+// parseFromLineDate extracts the date from the "From sender date" line.
+// Zero time is returned if it can't be parsed.
+func parseFromLineDate(line []byte) time.Time {
+	parts := strings.Fields(string(line))
+	if len(parts) < 3 {
+		return time.Time{}
+	}
+	// Some writers append time zone or other extra information
+	// after the asctime date, try to find the longest prefix that parses.
+	dateParts := parts[2:]
+	for i := len(dateParts); i > 0; i-- {
+		t, err := time.Parse(time.ANSIC, strings.Join(dateParts[:i], " "))
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// mboxFlags extracts flags from Status, X-Status and X-Keywords fields and
+// removes them from the message.
+func mboxFlags(msg []byte) ([]string, []byte, error) {
+	br := bufio.NewReader(bytes.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var flags []string
+	for _, l := range []byte(hdr.Get("Status")) {
+		if flag, ok := flagLetter(mboxStatusFlags, l); ok {
+			flags = append(flags, flag)
+		}
+	}
+	for _, l := range []byte(hdr.Get("X-Status")) {
+		if flag, ok := flagLetter(mboxXStatusFlags, l); ok {
+			flags = append(flags, flag)
+		}
+	}
+	flags = append(flags, strings.Fields(hdr.Get("X-Keywords"))...)
+
+	if !hdr.Has("Status") && !hdr.Has("X-Status") && !hdr.Has("X-Keywords") {
+		return flags, msg, nil
+	}
+
+	hdr.Del("Status")
+	hdr.Del("X-Status")
+	hdr.Del("X-Keywords")
+
+	out := bytes.Buffer{}
+	if err := textproto.WriteHeader(&out, hdr); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(&out, br); err != nil {
+		return nil, nil, err
+	}
+	return flags, out.Bytes(), nil
+}
+
+func importMbox(u imapbackend.User, path, mailbox, delim string, st *transferState) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	// Single file - import into the specified mailbox.
+	if !info.IsDir() {
+		if mailbox == "" {
+			mailbox = imap.InboxName
+		}
+		return importMboxFile(u, path, mailbox, st)
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(p, mboxExt) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		name := strings.ReplaceAll(filepath.ToSlash(strings.TrimSuffix(rel, mboxExt)), "/", delim)
+		if mailbox != "" {
+			name = mailbox + delim + name
+		}
+		if err := importMboxFile(u, file, name, st); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func importMboxFile(u imapbackend.User, path, name string, st *transferState) error {
+	mst := st.mbox(name)
+	if mst.Complete {
+		fmt.Fprintf(os.Stderr, "Skipping %s, already imported\n", path)
+		return nil
+	}
+
+	if err := ensureMailbox(u, name); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(mst.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	mr := mboxReader{r: bufio.NewReader(f), offset: mst.Offset}
+
+	count := 0
+	for {
+		msg, date, err := mr.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		flags, msg, err := mboxFlags(msg)
+		if err != nil {
+			return err
+		}
+		if date.IsZero() {
+			date = time.Now()
+		}
+		if flags == nil {
+			flags = []string{}
+		}
+
+		if err := u.CreateMessage(name, flags, date, bytes.NewBuffer(toCRLF(msg)), nil); err != nil {
+			return err
+		}
+		count++
+
+		mst.Offset = mr.offset
+		if err := st.save(); err != nil {
+			return err
+		}
+	}
+
+	mst.Complete = true
+	if err := st.save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d messages into %s\n", count, name)
+	return nil
+}
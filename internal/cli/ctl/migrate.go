@@ -0,0 +1,455 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "migrate",
+			Usage: "Migrate data from other mail servers",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "imap",
+					Usage: "Copy all mailboxes of the user from a remote IMAP server",
+					Description: `Logs into the remote IMAP server using the specified credentials and
+copies all mailboxes with their messages into the local storage account.
+
+Message flags and internal dates are preserved. Messages are never removed
+from the remote server.
+
+Mailboxes are copied in parallel using multiple connections (see --parallel).
+If the connection fails, mailbox copying is retried from the last copied message.
+If --state is specified, progress is saved into the specified file and
+the command can be re-run to copy only new messages (e.g. right before the switchover).
+
+Local storage account must exist, use 'imap-acct create' to create it.
+Remote password is read from stdin unless --remote-password is used.
+`,
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:     "remote",
+							Aliases:  []string{"r"},
+							Usage:    "Remote server `ADDRESS` (host:port)",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  "tls",
+							Usage: "Use TLS for the remote connection; valid values: implicit, starttls, off",
+							Value: "implicit",
+						},
+						&cli.BoolFlag{
+							Name:  "tls-skip-verify",
+							Usage: "Do not verify remote server certificate",
+						},
+						&cli.StringFlag{
+							Name:  "remote-user",
+							Usage: "Username to use on the remote server, same as USERNAME by default",
+						},
+						&cli.StringFlag{
+							Name:    "remote-password",
+							Usage:   "Use `PASSWORD` instead of reading password from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
+							EnvVars: []string{"MADDY_REMOTE_PASSWORD"},
+						},
+						&cli.StringSliceFlag{
+							Name:    "exclude",
+							Aliases: []string{"x"},
+							Usage:   "Do not copy mailboxes matching the `PATTERN` (shell glob, e.g. 'Trash' or 'Archive/*'). Can be specified multiple times",
+						},
+						&cli.IntFlag{
+							Name:  "parallel",
+							Usage: "Copy up to `N` mailboxes at the same time",
+							Value: 4,
+						},
+						&cli.IntFlag{
+							Name:  "retries",
+							Usage: "Retry copying of a mailbox up to `N` times if it fails",
+							Value: 3,
+						},
+						&cli.PathFlag{
+							Name:  "state",
+							Usage: "Save progress to `FILE` and resume from it if it exists",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return migrateIMAP(be, ctx)
+					},
+				},
+			},
+		}))
+}
+
+type imapMigration struct {
+	addr     string
+	tlsMode  string
+	tlsCfg   *tls.Config
+	username string
+	password string
+
+	exclude []string
+	retries int
+
+	local      imapbackend.User
+	localDelim string
+	st         *transferState
+}
+
+func migrateIMAP(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	if ctx.Int("parallel") < 1 {
+		return cli.Exit("Error: --parallel should be at least 1", 2)
+	}
+	switch ctx.String("tls") {
+	case "implicit", "starttls", "off":
+	default:
+		return cli.Exit("Error: unknown --tls value: "+ctx.String("tls"), 2)
+	}
+	for _, pattern := range ctx.StringSlice("exclude") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return cli.Exit(fmt.Sprintf("Error: malformed exclusion pattern %s: %v", pattern, err), 2)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(ctx.String("remote"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: malformed remote address: %v", err), 2)
+	}
+
+	m := imapMigration{
+		addr:    ctx.String("remote"),
+		tlsMode: ctx.String("tls"),
+		tlsCfg: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: ctx.Bool("tls-skip-verify"),
+		},
+		username: ctx.String("remote-user"),
+		exclude:  ctx.StringSlice("exclude"),
+		retries:  ctx.Int("retries"),
+	}
+	if m.username == "" {
+		m.username = username
+	}
+	if ctx.IsSet("remote-password") {
+		m.password = ctx.String("remote-password")
+	} else {
+		m.password, err = clitools2.ReadPassword("Enter password for " + m.username + " on " + m.addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.local, err = be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	m.localDelim = mailboxDelimiter(m.local)
+
+	m.st, err = loadTransferState(ctx.Path("state"))
+	if err != nil {
+		return err
+	}
+
+	c, err := m.connect()
+	if err != nil {
+		return err
+	}
+	mboxes, err := m.listMailboxes(c)
+	c.Logout() //nolint:errcheck
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg     sync.WaitGroup
+		queue  = make(chan *imap.MailboxInfo)
+		failed = make(chan string, len(mboxes))
+	)
+	for i := 0; i < ctx.Int("parallel"); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for info := range queue {
+				if err := m.migrateMailboxRetry(info); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to copy %s: %v\n", info.Name, err)
+					failed <- info.Name
+				}
+			}
+		}()
+	}
+	for _, info := range mboxes {
+		queue <- info
+	}
+	close(queue)
+	wg.Wait()
+	close(failed)
+
+	var failedNames []string
+	for name := range failed {
+		failedNames = append(failedNames, name)
+	}
+	if len(failedNames) != 0 {
+		return fmt.Errorf("failed to copy mailboxes: %s", strings.Join(failedNames, ", "))
+	}
+	return nil
+}
+
+func (m *imapMigration) connect() (*imapclient.Client, error) {
+	var (
+		c   *imapclient.Client
+		err error
+	)
+	if m.tlsMode == "implicit" {
+		c, err = imapclient.DialTLS(m.addr, m.tlsCfg)
+	} else {
+		c, err = imapclient.Dial(m.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.tlsMode == "starttls" {
+		if err := c.StartTLS(m.tlsCfg); err != nil {
+			c.Terminate() //nolint:errcheck
+			return nil, err
+		}
+	}
+
+	if err := c.Login(m.username, m.password); err != nil {
+		c.Terminate() //nolint:errcheck
+		return nil, err
+	}
+	return c, nil
+}
+
+func (m *imapMigration) excluded(name string) bool {
+	for _, pattern := range m.exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *imapMigration) listMailboxes(c *imapclient.Client) ([]*imap.MailboxInfo, error) {
+	ch := make(chan *imap.MailboxInfo, 10)
+	var listErr error
+	go func() {
+		listErr = c.List("", "*", ch)
+	}()
+
+	var mboxes []*imap.MailboxInfo
+	for info := range ch {
+		noSelect := false
+		for _, attr := range info.Attributes {
+			if attr == imap.NoSelectAttr {
+				noSelect = true
+			}
+		}
+		if noSelect {
+			continue
+		}
+
+		// Patterns always use '/' as a separator.
+		if m.excluded(strings.ReplaceAll(info.Name, info.Delimiter, "/")) {
+			fmt.Fprintf(os.Stderr, "Skipping excluded mailbox %s\n", info.Name)
+			continue
+		}
+		mboxes = append(mboxes, info)
+	}
+	return mboxes, listErr
+}
+
+func (m *imapMigration) localName(info *imap.MailboxInfo) string {
+	if strings.EqualFold(info.Name, imap.InboxName) {
+		return imap.InboxName
+	}
+	if info.Delimiter == "" || info.Delimiter == m.localDelim {
+		return info.Name
+	}
+	return strings.ReplaceAll(info.Name, info.Delimiter, m.localDelim)
+}
+
+func (m *imapMigration) migrateMailboxRetry(info *imap.MailboxInfo) error {
+	var err error
+	for attempt := 0; attempt <= m.retries; attempt++ {
+		if attempt != 0 {
+			fmt.Fprintf(os.Stderr, "Copying of %s failed, retrying (attempt %d): %v\n", info.Name, attempt, err)
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+
+		err = m.migrateMailbox(info)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (m *imapMigration) ensureLocalMailbox(info *imap.MailboxInfo, name string) error {
+	mboxes, err := m.local.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	for _, local := range mboxes {
+		if local.Name == name {
+			return nil
+		}
+	}
+
+	if suu, ok := m.local.(SpecialUseUser); ok {
+		for _, attr := range info.Attributes {
+			switch attr {
+			case imap.ArchiveAttr, imap.DraftsAttr, imap.JunkAttr, imap.SentAttr, imap.TrashAttr:
+				return suu.CreateMailboxSpecial(name, attr)
+			}
+		}
+	}
+	return m.local.CreateMailbox(name)
+}
+
+func (m *imapMigration) migrateMailbox(info *imap.MailboxInfo) error {
+	name := m.localName(info)
+	mst := m.st.mbox(name)
+
+	if err := m.ensureLocalMailbox(info, name); err != nil {
+		return err
+	}
+
+	c, err := m.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Logout() //nolint:errcheck
+
+	status, err := c.Select(info.Name, true)
+	if err != nil {
+		return err
+	}
+
+	var lastUID uint32
+	err = m.st.update(func() {
+		if mst.UIDValidity != status.UidValidity {
+			if mst.UIDValidity != 0 {
+				fmt.Fprintf(os.Stderr, "UIDVALIDITY of %s changed, copying all messages again\n", info.Name)
+			}
+			mst.UIDValidity = status.UidValidity
+			mst.LastUID = 0
+		}
+		lastUID = mst.LastUID
+	})
+	if err != nil {
+		return err
+	}
+
+	if status.Messages == 0 {
+		return nil
+	}
+
+	seq := &imap.SeqSet{}
+	seq.AddRange(lastUID+1, 0)
+	section := &imap.BodySectionName{Peek: true}
+
+	ch := make(chan *imap.Message, 10)
+	var fetchErr error
+	go func() {
+		fetchErr = c.UidFetch(seq, []imap.FetchItem{
+			imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem(),
+		}, ch)
+	}()
+
+	var (
+		copyErr error
+		count   int
+	)
+	for msg := range ch {
+		if copyErr != nil {
+			continue
+		}
+		// N:* always matches the last message, even if its UID is less
+		// than N.
+		if msg.Uid <= lastUID {
+			continue
+		}
+
+		body := msg.GetBody(section)
+		if body == nil {
+			copyErr = errors.New("server did not return message body")
+			continue
+		}
+
+		flags := make([]string, 0, len(msg.Flags))
+		for _, f := range msg.Flags {
+			if f != imap.RecentFlag {
+				flags = append(flags, f)
+			}
+		}
+
+		if copyErr = m.local.CreateMessage(name, flags, msg.InternalDate, body, nil); copyErr != nil {
+			continue
+		}
+		count++
+		lastUID = msg.Uid
+		copyErr = m.st.update(func() {
+			mst.LastUID = msg.Uid
+		})
+	}
+	if fetchErr != nil {
+		return fetchErr
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+
+	fmt.Fprintf(os.Stderr, "Copied %d messages from %s into %s\n", count, info.Name, name)
+	return nil
+}
@@ -23,12 +23,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/foxcpp/maddy"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/urfave/cli/v2"
 )
@@ -39,7 +41,52 @@ func closeIfNeeded(i interface{}) {
 	}
 }
 
-func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+// withAudit wraps actions of the command and all its subcommands to record
+// their invocations in the audit log.
+//
+// Audit log output is configured when the configuration file is read, so
+// commands that do not use it are never recorded.
+func withAudit(cmd *cli.Command) *cli.Command {
+	for _, sub := range cmd.Subcommands {
+		withAudit(sub)
+	}
+	if cmd.Action == nil {
+		return cmd
+	}
+
+	action := cmd.Action
+	cmd.Action = func(ctx *cli.Context) error {
+		err := action(ctx)
+
+		var names []string
+		for _, c := range ctx.Lineage() {
+			if c.Command != nil && c.Command.Name != "" {
+				names = append([]string{c.Command.Name}, names...)
+			}
+		}
+		fields := []interface{}{
+			"command", strings.Join(names, " "),
+			"args", ctx.Args().Slice(),
+			"uid", os.Getuid(),
+		}
+		if cfgBlock := ctx.String("cfg-block"); cfgBlock != "" {
+			fields = append(fields, "cfg_block", cfgBlock)
+		}
+		if err != nil {
+			fields = append(fields, "result", "failed", "reason", err.Error())
+		} else {
+			fields = append(fields, "result", "ok")
+		}
+		audit.Event(audit.AdminCommand, fields...)
+
+		return err
+	}
+	return cmd
+}
+
+// loadCfgModules reads the configuration file and registers all module
+// instances defined in it without initializing them.
+func loadCfgModules(ctx *cli.Context) (map[string]interface{}, []maddy.ModInfo, error) {
 	cfgPath := ctx.String("config")
 	if cfgPath == "" {
 		return nil, nil, cli.Exit("Error: config is required", 2)
@@ -68,24 +115,36 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 	if err != nil {
 		return nil, nil, err
 	}
+	return globals, mods, nil
+}
+
+func findCfgBlock(mods []maddy.ModInfo, cfgBlock string) (*maddy.ModInfo, error) {
+	for _, m := range mods {
+		if m.Instance.InstanceName() == cfgBlock {
+			m := m
+			return &m, nil
+		}
+	}
+	return nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+}
+
+func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+	globals, mods, err := loadCfgModules(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer hooks.RunHooks(hooks.EventShutdown)
 
 	cfgBlock := ctx.String("cfg-block")
 	if cfgBlock == "" {
 		return nil, nil, cli.Exit("Error: cfg-block is required", 2)
 	}
-	var mod maddy.ModInfo
-	for _, m := range mods {
-		if m.Instance.InstanceName() == cfgBlock {
-			mod = m
-			break
-		}
-	}
-	if mod.Instance == nil {
-		return nil, nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+	mod, err := findCfgBlock(mods, cfgBlock)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return globals, &mod, nil
+	return globals, mod, nil
 }
 
 func openStorage(ctx *cli.Context) (module.Storage, error) {
@@ -0,0 +1,443 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "queue",
+			Usage: "Delivery queue management",
+			Description: `These commands pause and resume deliveries from target.queue
+and inspect queued messages and damaged queue entries.
+
+Corresponding queue should be defined in maddy.conf as a top-level config block.
+By default the block name should be remote_queue (can be changed using
+--cfg-block argument for subcommands).
+
+Messages for held destinations stay in the queue, delivery attempts are not
+counted against max_tries. The running server picks up changes on the next
+delivery attempt.
+
+Entries that fail the integrity check on server start-up are quarantined,
+use 'verify' to list them and 'restore' or 'drop' to deal with them.
+
+Messages scheduled for later delivery (see allow_scheduled) can be listed
+using 'scheduled' and removed before the release time using 'cancel'.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "hold",
+					Usage:     "Pause deliveries to the domain or all deliveries",
+					ArgsUsage: "[DOMAIN...]",
+					Description: `Pause deliveries to the specified domains.
+
+If no domains are specified, all deliveries are paused.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return queueHold(q, ctx)
+					},
+				},
+				{
+					Name:      "release",
+					Usage:     "Resume deliveries paused using 'hold'",
+					ArgsUsage: "[DOMAIN...]",
+					Description: `Resume deliveries to the specified domains.
+
+If no domains are specified, all holds set using 'hold' are removed.
+Holds defined in the configuration file are not affected.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return queueRelease(q, ctx)
+					},
+				},
+				{
+					Name:  "status",
+					Usage: "List held destinations",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return queueStatus(q)
+					},
+				},
+				{
+					Name:      "show",
+					Usage:     "Show the queued message and the history of delivery attempts",
+					ArgsUsage: "ID",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						if ctx.NArg() != 1 {
+							return cli.Exit("Error: ID is required", 2)
+						}
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return queueShow(q, ctx.Args().First())
+					},
+				},
+				{
+					Name:  "verify",
+					Usage: "Check integrity of queue entries and list damaged ones",
+					Description: `Verify checksums of all queue entries, including quarantined ones.
+
+Quarantined entries that pass the check (e.g. files were fixed manually) are
+listed as "ok" and can be restored using 'restore'.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return queueVerify(q)
+					},
+				},
+				{
+					Name:      "restore",
+					Usage:     "Move the quarantined entry back to the queue",
+					ArgsUsage: "ID",
+					Description: `Move the quarantined entry back to the queue.
+
+Entry should pass the integrity check unless --rehash is specified, in which
+case checksums are recomputed from the current file contents. Server restart
+is required for the entry to be picked up.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+						&cli.BoolFlag{
+							Name:  "rehash",
+							Usage: "Accept current contents of damaged files",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						if ctx.NArg() != 1 {
+							return cli.Exit("Error: ID is required", 2)
+						}
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return q.Restore(ctx.Args().First(), ctx.Bool("rehash"))
+					},
+				},
+				{
+					Name:      "drop",
+					Usage:     "Remove the entry from the queue",
+					ArgsUsage: "ID",
+					Description: `Remove the queue entry (quarantined or not) from disk.
+
+No bounce message is sent. Should not be used for entries that are being
+delivered by the running server.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						if ctx.NArg() != 1 {
+							return cli.Exit("Error: ID is required", 2)
+						}
+						id := ctx.Args().First()
+						if !ctx.Bool("yes") && !clitools2.Confirmation("Are you sure you want to remove queue entry "+id+"?", false) {
+							return errors.New("Cancelled")
+						}
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return q.Drop(id)
+					},
+				},
+				{
+					Name:  "scheduled",
+					Usage: "List messages scheduled for later delivery",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return queueScheduled(q)
+					},
+				},
+				{
+					Name:      "cancel",
+					Usage:     "Cancel delivery of the scheduled message",
+					ArgsUsage: "ID",
+					Description: `Remove the message scheduled for later delivery from the queue.
+
+No bounce message is sent. Messages that are already released are not
+affected, use 'drop' for them.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "remote_queue",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						if ctx.NArg() != 1 {
+							return cli.Exit("Error: ID is required", 2)
+						}
+						id := ctx.Args().First()
+						if !ctx.Bool("yes") && !clitools2.Confirmation("Are you sure you want to cancel delivery of "+id+"?", false) {
+							return errors.New("Cancelled")
+						}
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						defer q.Close()
+						return q.Cancel(id)
+					},
+				},
+			},
+		}))
+}
+
+func openQueue(ctx *cli.Context) (*queue.Queue, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q, ok := mod.Instance.(*queue.Queue)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not target.queue", ctx.String("cfg-block")), 2)
+	}
+
+	if err := q.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return q, nil
+}
+
+func queueHold(q *queue.Queue, ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return q.Hold("")
+	}
+	for _, domain := range ctx.Args().Slice() {
+		if err := q.Hold(domain); err != nil {
+			return fmt.Errorf("%s: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+func queueRelease(q *queue.Queue, ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return q.Release("")
+	}
+	for _, domain := range ctx.Args().Slice() {
+		if err := q.Release(domain); err != nil {
+			return fmt.Errorf("%s: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+func queueStatus(q *queue.Queue) error {
+	st, err := q.HoldState()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case st.All:
+		fmt.Println("All deliveries are held")
+	case len(st.Domains) != 0:
+		fmt.Println("Held domains:", strings.Join(st.Domains, " "))
+	default:
+		fmt.Println("No holds")
+	}
+	return nil
+}
+
+func queueVerify(q *queue.Queue) error {
+	damaged, err := q.Verify()
+	if err != nil {
+		return err
+	}
+	if len(damaged) == 0 {
+		fmt.Println("No damaged entries")
+		return nil
+	}
+	for _, e := range damaged {
+		state := "active"
+		if e.Quarantined {
+			state = "quarantined"
+		}
+		status := "ok"
+		if e.Err != nil {
+			status = e.Err.Error()
+		}
+		fmt.Printf("%s\t%s\t%s\n", e.ID, state, status)
+	}
+	return nil
+}
+
+func queueScheduled(q *queue.Queue) error {
+	entries, err := q.Scheduled()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No scheduled messages")
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Printf("%s\t%s\t%s\t%s\n", e.ID, e.ReleaseAt.Format(time.RFC3339), e.From, strings.Join(e.To, " "))
+	}
+	return nil
+}
+
+func queueShow(q *queue.Queue, id string) error {
+	meta, err := q.Entry(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Message ID:", id)
+	fmt.Println("From:", meta.From)
+	fmt.Println("Pending recipients:", strings.Join(meta.To, " "))
+	fmt.Println("First attempt:", meta.FirstAttempt.Format(time.RFC3339))
+	if !meta.ReleaseAt.IsZero() {
+		fmt.Println("Release at:", meta.ReleaseAt.Format(time.RFC3339))
+	}
+	if !meta.LastAttempt.IsZero() {
+		fmt.Println("Last attempt:", meta.LastAttempt.Format(time.RFC3339))
+	}
+	for _, rcpt := range meta.To {
+		fmt.Printf("Attempts for %s: %d\n", rcpt, meta.TriesCount[rcpt])
+	}
+
+	if len(meta.Attempts) == 0 {
+		return nil
+	}
+	fmt.Println()
+	fmt.Println("Delivery attempts:")
+	for _, a := range meta.Attempts {
+		server := a.RemoteServer
+		if server == "" {
+			server = "-"
+		}
+		fmt.Printf("%s\t%s\t%s\t%d %d.%d.%d %s\n",
+			a.Time.Format(time.RFC3339), a.Rcpt, server,
+			a.Code, a.EnhancedCode[0], a.EnhancedCode[1], a.EnhancedCode[2], a.Message)
+	}
+	return nil
+}
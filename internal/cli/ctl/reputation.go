@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/check/reputation"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "reputation",
+	}
+
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "reputation",
+			Usage: "Sender reputation statistics",
+			Description: `These subcommands inspect and reset statistics collected by
+check.reputation module.
+
+Sources are specified as IP addresses or AS numbers (e.g. AS64500).
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List known sources",
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						&cli.Float64Flag{
+							Name:  "min-score",
+							Usage: "Show only sources with score at least `SCORE`",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						c, err := openReputation(ctx)
+						if err != nil {
+							return err
+						}
+						defer c.Close()
+						return reputationList(c, ctx)
+					},
+				},
+				{
+					Name:      "show",
+					Usage:     "Show statistics for the source",
+					ArgsUsage: "SOURCE",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						c, err := openReputation(ctx)
+						if err != nil {
+							return err
+						}
+						defer c.Close()
+						return reputationShow(c, ctx)
+					},
+				},
+				{
+					Name:      "reset",
+					Usage:     "Remove statistics for the source",
+					ArgsUsage: "SOURCE",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						c, err := openReputation(ctx)
+						if err != nil {
+							return err
+						}
+						defer c.Close()
+						return reputationReset(c, ctx)
+					},
+				},
+			},
+		}))
+}
+
+func openReputation(ctx *cli.Context) (*reputation.Check, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := mod.Instance.(*reputation.Check)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not check.reputation", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return c, nil
+}
+
+func printReputation(w *tabwriter.Writer, e reputation.Entry) {
+	fmt.Fprintf(w, "%s\t%.2f\t%.1f\t%.1f\t%.1f\t%.1f\t%s\n", e.Key, e.Score(),
+		e.Messages, e.Rejected, e.Quarantined, e.AuthFailures, e.UpdatedAt.Format(time.RFC3339))
+}
+
+func reputationList(c *reputation.Check, ctx *cli.Context) error {
+	list, err := c.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tSCORE\tMESSAGES\tREJECTED\tQUARANTINED\tAUTH FAILURES\tUPDATED")
+	shown := 0
+	for _, e := range list {
+		if e.Score() < ctx.Float64("min-score") {
+			continue
+		}
+		printReputation(w, e)
+		shown++
+	}
+	if shown == 0 {
+		fmt.Fprintln(os.Stderr, "No sources.")
+		return nil
+	}
+	return w.Flush()
+}
+
+func reputationShow(c *reputation.Check, ctx *cli.Context) error {
+	if ctx.Args().First() == "" {
+		return cli.Exit("Error: SOURCE is required", 2)
+	}
+	key, err := c.Key(ctx.Args().First())
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+
+	e, ok, err := c.Lookup(context.Background(), key)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if !ok {
+		return cli.Exit("Error: no statistics for the source", 1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tSCORE\tMESSAGES\tREJECTED\tQUARANTINED\tAUTH FAILURES\tUPDATED")
+	printReputation(w, e)
+	return w.Flush()
+}
+
+func reputationReset(c *reputation.Check, ctx *cli.Context) error {
+	if ctx.Args().First() == "" {
+		return cli.Exit("Error: SOURCE is required", 2)
+	}
+	key, err := c.Key(ctx.Args().First())
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+
+	removed, err := c.Reset(context.Background(), key)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if !removed {
+		return cli.Exit("Error: no statistics for the source", 1)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package ctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/sessions"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	adminFlag := &cli.StringFlag{
+		Name:    "admin-endpoint",
+		Usage:   "Address of the admin endpoint of the running server",
+		EnvVars: []string{"MADDY_ADMIN_ENDPOINT"},
+		Value:   "unix:///run/maddy/admin.sock",
+	}
+
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "sessions",
+			Usage: "Active IMAP and SMTP sessions management",
+			Description: `These subcommands talk to the running server using the admin
+endpoint, it should be enabled in the configuration.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List active sessions",
+					Flags: []cli.Flag{
+						adminFlag,
+						&cli.StringFlag{
+							Name:  "user",
+							Usage: "Show only sessions of the specified user",
+						},
+					},
+					Action: sessionsList,
+				},
+				{
+					Name:      "kill",
+					Usage:     "Terminate a session or all sessions of a user",
+					ArgsUsage: "[ID]",
+					Flags: []cli.Flag{
+						adminFlag,
+						&cli.StringFlag{
+							Name:  "user",
+							Usage: "Terminate all sessions of the specified user",
+						},
+					},
+					Action: sessionsKill,
+				},
+			},
+		}))
+}
+
+// adminClient returns the HTTP client and the base URL to use for requests
+// to the admin endpoint.
+func adminClient(ctx *cli.Context) (*http.Client, string, error) {
+	endp, err := config.ParseEndpoint(ctx.String("admin-endpoint"))
+	if err != nil {
+		return nil, "", cli.Exit(fmt.Sprintf("Error: malformed endpoint: %v", err), 2)
+	}
+	if endp.IsTLS() {
+		return nil, "", cli.Exit("Error: TLS is not supported for the admin endpoint", 2)
+	}
+
+	dialer := net.Dialer{}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(c context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(c, endp.Network(), endp.Address())
+			},
+		},
+	}
+	return client, "http://admin", nil
+}
+
+func adminError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		return fmt.Errorf("Error: admin endpoint returned %s", resp.Status)
+	}
+	return errors.New("Error: " + body.Error)
+}
+
+func sessionsList(ctx *cli.Context) error {
+	client, base, err := adminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if user := ctx.String("user"); user != "" {
+		q.Set("user", user)
+	}
+	resp, err := client.Get(base + "/sessions?" + q.Encode())
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cli.Exit(adminError(resp).Error(), 1)
+	}
+
+	var list []sessions.Info
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: malformed response: %v", err), 1)
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(os.Stderr, "No active sessions.")
+		return nil
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROTOCOL\tUSER\tREMOTE\tSTARTED\tIDLE\tMAILBOX")
+	for _, s := range list {
+		user := s.Username
+		if user == "" {
+			user = "-"
+		}
+		mbox := s.Mailbox
+		if mbox == "" {
+			mbox = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%s\n",
+			s.ID, s.Protocol, user, s.RemoteAddr, s.Started.Format(time.RFC3339),
+			now.Sub(s.LastActive).Truncate(time.Second), mbox)
+	}
+	return w.Flush()
+}
+
+func sessionsKill(ctx *cli.Context) error {
+	id, user := ctx.Args().First(), ctx.String("user")
+	if (id == "") == (user == "") {
+		return cli.Exit("Error: either session ID or --user should be specified", 2)
+	}
+
+	client, base, err := adminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	if id != "" {
+		form.Set("id", id)
+	} else {
+		form.Set("user", user)
+	}
+	resp, err := client.Post(base+"/sessions/terminate", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cli.Exit(adminError(resp).Error(), 1)
+	}
+
+	var res struct {
+		Terminated int `json:"terminated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: malformed response: %v", err), 1)
+	}
+	fmt.Fprintf(os.Stderr, "Terminated %d session(s).\n", res.Terminated)
+	return nil
+}
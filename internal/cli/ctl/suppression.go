@@ -0,0 +1,129 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/check/suppression"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "bounce_suppression",
+	}
+
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "suppression",
+			Usage: "Bounce suppression list management",
+			Description: `These subcommands inspect and edit the list of addresses maintained
+by check.suppression module.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List suppressed addresses",
+					Flags: []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						c, err := openSuppression(ctx)
+						if err != nil {
+							return err
+						}
+						defer c.Close()
+						return suppressionList(c)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove the address from the list",
+					ArgsUsage: "ADDRESS",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						c, err := openSuppression(ctx)
+						if err != nil {
+							return err
+						}
+						defer c.Close()
+						return suppressionRemove(c, ctx)
+					},
+				},
+			},
+		}))
+}
+
+func openSuppression(ctx *cli.Context) (*suppression.Check, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := mod.Instance.(*suppression.Check)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not check.suppression", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return c, nil
+}
+
+func suppressionList(c *suppression.Check) error {
+	list, err := c.List(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(os.Stderr, "No suppressed addresses.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, e := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Address, e.Category, e.BouncedAt.Format(time.RFC3339), e.Reason)
+	}
+	return w.Flush()
+}
+
+func suppressionRemove(c *suppression.Check, ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+
+	removed, err := c.Remove(context.Background(), addr)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if !removed {
+		return cli.Exit("Error: address is not suppressed", 1)
+	}
+	return nil
+}
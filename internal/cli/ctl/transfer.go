@@ -0,0 +1,417 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli/v2"
+)
+
+// transferState is the progress information saved by 'imap-msgs export' and
+// 'imap-msgs import' to allow resuming an interrupted operation.
+//
+// It is keyed by the mailbox name. Only fields relevant for the used
+// direction and format are set.
+type transferState struct {
+	path string
+
+	// lock protects Mailboxes and fields of the values if the state is
+	// shared between multiple goroutines.
+	lock      sync.Mutex
+	Mailboxes map[string]*mboxTransferState `json:"mailboxes"`
+}
+
+type mboxTransferState struct {
+	// Complete is set once all messages of the mailbox were processed.
+	Complete bool `json:"complete,omitempty"`
+
+	// LastUID is the UID of the last exported (or migrated) message.
+	LastUID uint32 `json:"last_uid,omitempty"`
+
+	// UIDValidity is the UIDVALIDITY value of the remote mailbox LastUID
+	// refers to.
+	UIDValidity uint32 `json:"uid_validity,omitempty"`
+
+	// Offset is the offset of the first not yet imported message in the
+	// mbox file.
+	Offset int64 `json:"offset,omitempty"`
+
+	// LastFile is the name of the last imported Maildir file (without
+	// the info part). Files are processed in lexicographical order.
+	LastFile string `json:"last_file,omitempty"`
+}
+
+func loadTransferState(path string) (*transferState, error) {
+	st := &transferState{
+		path:      path,
+		Mailboxes: map[string]*mboxTransferState{},
+	}
+	if path == "" {
+		return st, nil
+	}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, st); err != nil {
+		return nil, fmt.Errorf("malformed state file %s: %w", path, err)
+	}
+	if st.Mailboxes == nil {
+		st.Mailboxes = map[string]*mboxTransferState{}
+	}
+	return st, nil
+}
+
+func (st *transferState) mbox(name string) *mboxTransferState {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	mst := st.Mailboxes[name]
+	if mst == nil {
+		mst = &mboxTransferState{}
+		st.Mailboxes[name] = mst
+	}
+	return mst
+}
+
+// save writes the state to the disk. It is a no-op if no state file was
+// specified.
+//
+// State is saved after each processed message, so interrupted operation
+// will not duplicate or skip any messages when resumed.
+func (st *transferState) save() error {
+	if st.path == "" {
+		return nil
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	blob, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(st.path+".tmp", blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(st.path+".tmp", st.path)
+}
+
+// update calls f with the state lock held and then saves the state.
+func (st *transferState) update(f func()) error {
+	st.lock.Lock()
+	f()
+	st.lock.Unlock()
+	return st.save()
+}
+
+// Flags are stored using the same conventions Dovecot uses for mbox and Maildir
+// so exported mailboxes can be used by other software and vice versa.
+
+var maildirFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+var mboxStatusFlags = map[string]byte{
+	imap.SeenFlag: 'R',
+}
+
+var mboxXStatusFlags = map[string]byte{
+	imap.AnsweredFlag: 'A',
+	imap.FlaggedFlag:  'F',
+	imap.DraftFlag:    'T',
+	imap.DeletedFlag:  'D',
+}
+
+func flagLetter(letters map[string]byte, l byte) (string, bool) {
+	for flag, letter := range letters {
+		if letter == l {
+			return flag, true
+		}
+	}
+	return "", false
+}
+
+// splitFlags separates system flags from keywords. \Recent is dropped
+// since it can't be set by clients.
+func splitFlags(flags []string) (system map[string]bool, keywords []string) {
+	system = make(map[string]bool, len(flags))
+	for _, f := range flags {
+		f = imap.CanonicalFlag(f)
+		switch {
+		case f == imap.RecentFlag:
+		case strings.HasPrefix(f, "\\"):
+			system[f] = true
+		default:
+			keywords = append(keywords, f)
+		}
+	}
+	sort.Strings(keywords)
+	return system, keywords
+}
+
+// toCRLF converts all line endings in the message to CRLF, as expected by IMAP
+// clients.
+func toCRLF(msg []byte) []byte {
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+}
+
+// toLF converts all line endings in the message to LF, as expected by most
+// local mail storage formats.
+func toLF(msg []byte) []byte {
+	return bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+}
+
+// ensureMailbox creates the mailbox if it does not exist yet.
+func ensureMailbox(u imapbackend.User, name string) error {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	for _, info := range mboxes {
+		if info.Name == name {
+			return nil
+		}
+	}
+	return u.CreateMailbox(name)
+}
+
+// mailboxDelimiter returns the hierarchy delimiter used by the storage for the
+// user's mailboxes.
+func mailboxDelimiter(u imapbackend.User) string {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil || len(mboxes) == 0 || mboxes[0].Delimiter == "" {
+		return "."
+	}
+	return mboxes[0].Delimiter
+}
+
+type exportedMsg struct {
+	uid   uint32
+	date  time.Time
+	flags []string
+	body  []byte
+}
+
+// exportMailbox reads all messages from the mailbox that were not exported
+// before (as indicated by state) and passes them to the write callback.
+func exportMailbox(u imapbackend.User, name string, mst *mboxTransferState, write func(exportedMsg) error, save func() error) error {
+	if mst.Complete {
+		fmt.Fprintf(os.Stderr, "Skipping %s, already exported\n", name)
+		return nil
+	}
+
+	_, mbox, err := u.GetMailbox(name, true, nil)
+	if err != nil {
+		return err
+	}
+
+	seq := &imap.SeqSet{}
+	seq.AddRange(mst.LastUID+1, 0)
+
+	ch := make(chan *imap.Message, 10)
+	// ListMessages closes ch before returning, the error is passed
+	// separately so it is not read before it is set.
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- mbox.ListMessages(true, seq, []imap.FetchItem{
+			imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822,
+		}, ch)
+	}()
+
+	var (
+		writeErr error
+		count    int
+	)
+	for msg := range ch {
+		if writeErr != nil {
+			continue
+		}
+		// N:* always matches the last message, even if its UID is less
+		// than N.
+		if msg.Uid <= mst.LastUID {
+			continue
+		}
+
+		var body []byte
+		for _, v := range msg.Body {
+			body, writeErr = readLiteral(v)
+			break
+		}
+		if writeErr != nil {
+			continue
+		}
+
+		writeErr = write(exportedMsg{
+			uid:   msg.Uid,
+			date:  msg.InternalDate,
+			flags: msg.Flags,
+			body:  body,
+		})
+		if writeErr != nil {
+			continue
+		}
+
+		mst.LastUID = msg.Uid
+		writeErr = save()
+		count++
+	}
+	if err := <-listErr; err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	mst.Complete = true
+	if err := save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d messages from %s\n", count, name)
+	return nil
+}
+
+func readLiteral(l imap.Literal) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, l.Len()))
+	_, err := buf.ReadFrom(l)
+	return buf.Bytes(), err
+}
+
+func exportMailboxes(u imapbackend.User, ctx *cli.Context) ([]string, error) {
+	if ctx.IsSet("mailbox") {
+		return ctx.StringSlice("mailbox"), nil
+	}
+
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(mboxes))
+	for _, info := range mboxes {
+		noSelect := false
+		for _, attr := range info.Attributes {
+			if attr == imap.NoSelectAttr {
+				noSelect = true
+			}
+		}
+		if !noSelect {
+			names = append(names, info.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func msgsExport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	path := ctx.Args().Get(1)
+	if path == "" {
+		return cli.Exit("Error: PATH is required", 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+
+	st, err := loadTransferState(ctx.Path("state"))
+	if err != nil {
+		return err
+	}
+
+	mboxes, err := exportMailboxes(u, ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return err
+	}
+
+	delim := mailboxDelimiter(u)
+	for _, name := range mboxes {
+		switch ctx.String("format") {
+		case "mbox":
+			err = exportMbox(u, path, name, delim, st)
+		case "maildir":
+			err = exportMaildir(u, path, name, delim, st)
+		default:
+			return cli.Exit("Error: unknown format: "+ctx.String("format"), 2)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func msgsImport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	path := ctx.Args().Get(1)
+	if path == "" {
+		return cli.Exit("Error: PATH is required", 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+
+	st, err := loadTransferState(ctx.Path("state"))
+	if err != nil {
+		return err
+	}
+
+	switch ctx.String("format") {
+	case "mbox":
+		return importMbox(u, path, ctx.String("mailbox"), mailboxDelimiter(u), st)
+	case "maildir":
+		return importMaildir(u, path, ctx.String("mailbox"), mailboxDelimiter(u), st)
+	default:
+		return cli.Exit("Error: unknown format: "+ctx.String("format"), 2)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+var transferTestMsgs = []struct {
+	flags []string
+	date  time.Time
+	body  string
+}{
+	{
+		flags: []string{imap.SeenFlag, imap.FlaggedFlag, "$Label1"},
+		date:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		body: "From: sender@example.org\r\n" +
+			"Subject: Quoting\r\n" +
+			"\r\n" +
+			"From here on, lines look like separators.\r\n" +
+			">From quoted already\r\n",
+	},
+	{
+		flags: []string{imap.AnsweredFlag, imap.DraftFlag, imap.DeletedFlag},
+		date:  time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC),
+		body: "Subject: Flags\r\n" +
+			"\r\n" +
+			"Body\r\n",
+	},
+	{
+		flags: []string{},
+		date:  time.Date(2022, 11, 12, 13, 14, 15, 0, time.UTC),
+		body: "Subject: No flags\r\n" +
+			"\r\n" +
+			"\r\n" +
+			"Empty line above\r\n",
+	},
+}
+
+func transferTestUser(t *testing.T) imapbackend.User {
+	t.Helper()
+	u, err := memory.New().Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func fillTransferMailbox(t *testing.T, u imapbackend.User, name string) {
+	t.Helper()
+	if err := u.CreateMailbox(name); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range transferTestMsgs {
+		if err := u.CreateMessage(name, msg.flags, msg.date, bytes.NewBufferString(msg.body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTransferMailbox(t *testing.T, u imapbackend.User, name string) {
+	t.Helper()
+
+	_, mbox, err := u.GetMailbox(name, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := &imap.SeqSet{}
+	seq.AddRange(1, 0)
+	ch := make(chan *imap.Message, len(transferTestMsgs)+1)
+	if err := mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != len(transferTestMsgs) {
+		t.Fatalf("wrong amount of messages in %s: want %d, got %d", name, len(transferTestMsgs), len(msgs))
+	}
+	for i, msg := range msgs {
+		expected := transferTestMsgs[i]
+
+		var body []byte
+		for _, l := range msg.Body {
+			body, err = readLiteral(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(body) != expected.body {
+			t.Errorf("message %d: wrong body:\n%q\nwant:\n%q", i, body, expected.body)
+		}
+		if !msg.InternalDate.Equal(expected.date) {
+			t.Errorf("message %d: wrong date: %v, want %v", i, msg.InternalDate, expected.date)
+		}
+
+		// Keywords are case-insensitive and are stored in the canonical
+		// (lower) case. \Recent is a session state and is not transferred.
+		canonical := func(flags []string) []string {
+			res := make([]string, 0, len(flags))
+			for _, f := range flags {
+				if f == imap.RecentFlag {
+					continue
+				}
+				res = append(res, imap.CanonicalFlag(f))
+			}
+			sort.Strings(res)
+			return res
+		}
+		flags, expectedFlags := canonical(msg.Flags), canonical(expected.flags)
+		if !reflect.DeepEqual(flags, expectedFlags) {
+			t.Errorf("message %d: wrong flags: %v, want %v", i, flags, expectedFlags)
+		}
+	}
+}
+
+func TestTransfer_Mbox(t *testing.T) {
+	src := transferTestUser(t)
+	fillTransferMailbox(t, src, "Archive")
+
+	dir := t.TempDir()
+	st, err := loadTransferState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exportMbox(src, dir, "Archive", mailboxDelimiter(src), st); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := transferTestUser(t)
+	st, err = loadTransferState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := importMbox(dst, dir, "", mailboxDelimiter(dst), st); err != nil {
+		t.Fatal(err)
+	}
+	checkTransferMailbox(t, dst, "Archive")
+}
+
+func TestTransfer_Maildir(t *testing.T) {
+	src := transferTestUser(t)
+	fillTransferMailbox(t, src, "Archive")
+
+	dir := t.TempDir()
+	st, err := loadTransferState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exportMaildir(src, dir, "Archive", mailboxDelimiter(src), st); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := transferTestUser(t)
+	st, err = loadTransferState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := importMaildir(dst, dir, "", mailboxDelimiter(dst), st); err != nil {
+		t.Fatal(err)
+	}
+	checkTransferMailbox(t, dst, "Archive")
+}
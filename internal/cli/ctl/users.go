@@ -33,7 +33,7 @@ import (
 )
 
 func init() {
-	maddycli.AddSubcommand(
+	maddycli.AddSubcommand(withAudit(
 		&cli.Command{
 			Name:  "creds",
 			Usage: "Local credentials management",
@@ -163,7 +163,7 @@ using command flags. Otherwise, these options cannot be used.
 					},
 				},
 			},
-		})
+		}))
 }
 
 func usersList(be module.PlainUserDB, ctx *cli.Context) error {
@@ -200,9 +200,13 @@ func usersCreate(be module.PlainUserDB, ctx *cli.Context) error {
 	}
 
 	if beHash, ok := be.(*pass_table.Auth); ok {
-		return beHash.CreateUserHash(username, pass, ctx.String("hash"), pass_table.HashOpts{
-			BcryptCost: ctx.Int("bcrypt-cost"),
-		})
+		if !ctx.IsSet("hash") && !ctx.IsSet("bcrypt-cost") {
+			// Use the hash function configured for the module.
+			return beHash.CreateUser(username, pass)
+		}
+		opts := pass_table.DefaultHashOpts()
+		opts.BcryptCost = ctx.Int("bcrypt-cost")
+		return beHash.CreateUserHash(username, pass, ctx.String("hash"), opts)
 	} else if ctx.IsSet("hash") || ctx.IsSet("bcrypt-cost") {
 		return cli.Exit("Error: --hash cannot be used with non-pass_table credentials DB", 2)
 	} else {
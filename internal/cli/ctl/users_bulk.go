@@ -0,0 +1,665 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	maddycli.AddSubcommand(withAudit(
+		&cli.Command{
+			Name:  "users",
+			Usage: "Bulk user accounts provisioning",
+			Description: `These commands create or dump user accounts in bulk.
+
+Each account consists of credentials (stored in the block specified using
+--creds-cfg-block, local_authdb by default), IMAP storage account (stored in
+the block specified using --storage-cfg-block, local_mailboxes by default) and,
+optionally, a set of aliases (stored in the mutable table specified using
+--aliases-cfg-block).
+
+Accounts are read from (or written to) a CSV file with a header row
+or a stream of JSON objects, one per line. Recognized fields are:
+
+  username     account name, required
+  password     plain-text password
+  hash         password hash as stored in the credentials table
+               (e.g. "bcrypt:...") or in Dovecot format (e.g.
+               "{SHA512-CRYPT}$6$..."), mutually exclusive with password
+  appendlimit  maximum size of messages that can be added to the account
+  aliases      list of addresses mapped to the account, in CSV it is a
+               space- or semicolon-separated list
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "import",
+					Usage: "Create user accounts listed in the file",
+					Description: `All records are validated before any changes are made.
+
+In addition to CSV and JSON, the import supports Dovecot passwd-file format
+(--format dovecot). Only user name and password hash fields are used.
+Supported Dovecot schemes are BLF-CRYPT, SHA256-CRYPT, SHA512-CRYPT and
+ARGON2ID.
+
+Each account is created atomically: if any step fails, changes already made
+for it are reverted and the import stops. Accounts created before the failing
+one are kept.`,
+					ArgsUsage: "[FILE]",
+					Flags: append(usersBulkFlags(),
+						&cli.StringFlag{
+							Name:  "hash",
+							Usage: "Use specified hash algorithm for plain-text passwords",
+							Value: "bcrypt",
+						},
+						&cli.IntFlag{
+							Name:  "bcrypt-cost",
+							Usage: "Specify bcrypt cost value",
+							Value: bcrypt.DefaultCost,
+						},
+						&cli.BoolFlag{
+							Name:  "skip-existing",
+							Usage: "Do not fail if the account already exists, leave it unchanged instead",
+						},
+					),
+					Action: usersImport,
+				},
+				{
+					Name:      "export",
+					Usage:     "Write all user accounts to the file",
+					ArgsUsage: "[FILE]",
+					Description: `Password hashes are exported only if the credentials
+store is a pass_table. Only accounts that have credentials are exported.`,
+					Flags:  usersBulkFlags(),
+					Action: usersExport,
+				},
+			},
+		}))
+}
+
+func usersBulkFlags() []cli.Flag {
+	return append(usersModulesFlags(),
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "File format to use (csv, json or, for import only, dovecot)",
+			Value: "csv",
+		},
+	)
+}
+
+// usersModulesFlags returns flags used by openUsersBulkModules.
+func usersModulesFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "creds-cfg-block",
+			Usage: "Credentials store configuration block to use",
+			Value: "local_authdb",
+		},
+		&cli.StringFlag{
+			Name:  "storage-cfg-block",
+			Usage: "Storage configuration block to use, set to empty string to not touch IMAP accounts",
+			Value: "local_mailboxes",
+		},
+		&cli.StringFlag{
+			Name:  "aliases-cfg-block",
+			Usage: "Mutable table configuration block to store aliases in",
+		},
+	}
+}
+
+type userRecord struct {
+	Username    string   `json:"username"`
+	Password    string   `json:"password,omitempty"`
+	Hash        string   `json:"hash,omitempty"`
+	AppendLimit *uint32  `json:"appendlimit,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
+}
+
+var userRecordFields = []string{"username", "password", "hash", "appendlimit", "aliases"}
+
+func readUserRecordsCSV(r io.Reader) ([]userRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, f := range userRecordFields {
+			if f == name {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown column: %s", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, errors.New("username column is required")
+	}
+
+	var recs []userRecord
+	for {
+		row, err := cr.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+
+		rec := userRecord{
+			Username: field("username"),
+			Password: field("password"),
+			Hash:     field("hash"),
+		}
+		if val := field("appendlimit"); val != "" {
+			lim, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				line, _ := cr.FieldPos(0)
+				return nil, fmt.Errorf("line %d: invalid appendlimit: %w", line, err)
+			}
+			lim32 := uint32(lim)
+			rec.AppendLimit = &lim32
+		}
+		rec.Aliases = strings.FieldsFunc(field("aliases"), func(r rune) bool {
+			return r == ' ' || r == ';'
+		})
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func readUserRecordsJSON(r io.Reader) ([]userRecord, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var recs []userRecord
+	for {
+		var rec userRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("record %d: %w", len(recs)+1, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// readUserRecordsDovecot reads accounts from the Dovecot passwd-file.
+func readUserRecordsDovecot(r io.Reader) ([]userRecord, error) {
+	var recs []userRecord
+	scnr := bufio.NewScanner(r)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: malformed entry", lineNum)
+		}
+		recs = append(recs, userRecord{
+			Username: parts[0],
+			Hash:     parts[1],
+		})
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// convertDovecotHashes converts password hashes in Dovecot format
+// ("{SCHEME}...") into the format used by pass_table.
+func convertDovecotHashes(recs []userRecord) error {
+	for i, rec := range recs {
+		if !strings.HasPrefix(rec.Hash, "{") {
+			continue
+		}
+		hash, err := pass_table.FromDovecotHash(rec.Hash)
+		if err != nil {
+			return fmt.Errorf("record %d (%s): %w", i+1, rec.Username, err)
+		}
+		recs[i].Hash = hash
+	}
+	return nil
+}
+
+func validateUserRecords(recs []userRecord, haveAliases bool) error {
+	seenUsers := make(map[string]bool, len(recs))
+	seenAliases := map[string]string{}
+	for i, rec := range recs {
+		if rec.Username == "" {
+			return fmt.Errorf("record %d: username is required", i+1)
+		}
+		if seenUsers[rec.Username] {
+			return fmt.Errorf("record %d: duplicate username: %s", i+1, rec.Username)
+		}
+		seenUsers[rec.Username] = true
+
+		switch {
+		case rec.Password == "" && rec.Hash == "":
+			return fmt.Errorf("record %d (%s): password or hash is required", i+1, rec.Username)
+		case rec.Password != "" && rec.Hash != "":
+			return fmt.Errorf("record %d (%s): password and hash are mutually exclusive", i+1, rec.Username)
+		case rec.Hash != "":
+			if _, ok := pass_table.HashVerify[strings.SplitN(rec.Hash, ":", 2)[0]]; !ok {
+				return fmt.Errorf("record %d (%s): hash should be prefixed with a known hash function name", i+1, rec.Username)
+			}
+		}
+
+		if len(rec.Aliases) != 0 && !haveAliases {
+			return fmt.Errorf("record %d (%s): aliases are specified but --aliases-cfg-block is not set", i+1, rec.Username)
+		}
+		for _, alias := range rec.Aliases {
+			if other, ok := seenAliases[alias]; ok {
+				return fmt.Errorf("record %d (%s): alias %s is already used for %s", i+1, rec.Username, alias, other)
+			}
+			seenAliases[alias] = rec.Username
+		}
+	}
+	return nil
+}
+
+// usersBulkModules contains modules used by 'users import' and
+// 'users export'. storage and aliases are nil if not configured.
+type usersBulkModules struct {
+	creds   module.PlainUserDB
+	storage module.ManageableStorage
+	aliases module.MutableTable
+}
+
+func openUsersBulkModules(ctx *cli.Context) (*usersBulkModules, error) {
+	_, mods, err := loadCfgModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	getInstance := func(cfgBlock string) (module.Module, error) {
+		if _, err := findCfgBlock(mods, cfgBlock); err != nil {
+			return nil, err
+		}
+		inst, err := module.GetInstance(cfgBlock)
+		if err != nil {
+			return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+		}
+		return inst, nil
+	}
+
+	var res usersBulkModules
+
+	inst, err := getInstance(ctx.String("creds-cfg-block"))
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	res.creds, ok = inst.(module.PlainUserDB)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not a local credentials store", ctx.String("creds-cfg-block")), 2)
+	}
+
+	if cfgBlock := ctx.String("storage-cfg-block"); cfgBlock != "" {
+		inst, err := getInstance(cfgBlock)
+		if err != nil {
+			return nil, err
+		}
+		res.storage, ok = inst.(module.ManageableStorage)
+		if !ok {
+			return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not support accounts management", cfgBlock), 2)
+		}
+	}
+
+	if cfgBlock := ctx.String("aliases-cfg-block"); cfgBlock != "" {
+		inst, err := getInstance(cfgBlock)
+		if err != nil {
+			return nil, err
+		}
+		res.aliases, ok = inst.(module.MutableTable)
+		if !ok {
+			return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not a mutable table", cfgBlock), 2)
+		}
+	}
+
+	return &res, nil
+}
+
+func (m *usersBulkModules) close() {
+	closeIfNeeded(m.creds)
+	if m.storage != nil {
+		closeIfNeeded(m.storage)
+	}
+	if m.aliases != nil {
+		closeIfNeeded(m.aliases)
+	}
+}
+
+func (m *usersBulkModules) userExists(username string) (bool, error) {
+	list, err := m.creds.ListUsers()
+	if err != nil {
+		return false, err
+	}
+	for _, u := range list {
+		if u == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// createAccount creates the account described by rec. If any step fails,
+// all changes made before it are reverted.
+func (m *usersBulkModules) createAccount(ctx *cli.Context, rec userRecord) (err error) {
+	var rollback []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(rollback) - 1; i >= 0; i-- {
+			if rbErr := rollback[i](); rbErr != nil {
+				fmt.Fprintf(os.Stderr, "Failed to revert changes for %s: %v\n", rec.Username, rbErr)
+			}
+		}
+	}()
+
+	switch {
+	case rec.Hash != "":
+		ptAuth, ok := m.creds.(*pass_table.Auth)
+		if !ok {
+			return errors.New("password hashes can be imported only into pass_table credentials DB")
+		}
+		err = ptAuth.CreateUserPrehashed(rec.Username, rec.Hash)
+	default:
+		if ptAuth, ok := m.creds.(*pass_table.Auth); ok && (ctx.IsSet("hash") || ctx.IsSet("bcrypt-cost")) {
+			opts := pass_table.DefaultHashOpts()
+			opts.BcryptCost = ctx.Int("bcrypt-cost")
+			err = ptAuth.CreateUserHash(rec.Username, rec.Password, ctx.String("hash"), opts)
+		} else {
+			err = m.creds.CreateUser(rec.Username, rec.Password)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	rollback = append(rollback, func() error { return m.creds.DeleteUser(rec.Username) })
+
+	if m.storage != nil {
+		if err = m.storage.CreateIMAPAcct(rec.Username); err != nil {
+			return err
+		}
+		rollback = append(rollback, func() error { return m.storage.DeleteIMAPAcct(rec.Username) })
+
+		if rec.AppendLimit != nil {
+			var u interface{}
+			u, err = m.storage.GetIMAPAcct(rec.Username)
+			if err != nil {
+				return err
+			}
+			userAL, ok := u.(AppendLimitUser)
+			if !ok {
+				return errors.New("storage does not support per-user append limit")
+			}
+			if err = userAL.SetMessageLimit(rec.AppendLimit); err != nil {
+				return err
+			}
+		}
+	} else if rec.AppendLimit != nil {
+		return errors.New("appendlimit is specified but --storage-cfg-block is not set")
+	}
+
+	for _, alias := range rec.Aliases {
+		var exists bool
+		_, exists, err = m.aliases.Lookup(context.TODO(), alias)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("alias %s already exists", alias)
+		}
+		if err = m.aliases.SetKey(alias, rec.Username); err != nil {
+			return err
+		}
+		alias := alias
+		rollback = append(rollback, func() error { return m.aliases.RemoveKey(alias) })
+	}
+
+	return nil
+}
+
+// aliasesByTarget returns all aliases grouped by the account they are mapped
+// to.
+func (m *usersBulkModules) aliasesByTarget() (map[string][]string, error) {
+	aliases := map[string][]string{}
+	if m.aliases == nil {
+		return aliases, nil
+	}
+
+	keys, err := m.aliases.Keys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	for _, alias := range keys {
+		target, ok, err := m.aliases.Lookup(context.TODO(), alias)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			aliases[target] = append(aliases[target], alias)
+		}
+	}
+	return aliases, nil
+}
+
+// exportAccount builds the record describing the existing account.
+func (m *usersBulkModules) exportAccount(username string, aliases []string) (userRecord, error) {
+	rec := userRecord{
+		Username: username,
+		Aliases:  aliases,
+	}
+	if ptAuth, ok := m.creds.(*pass_table.Auth); ok {
+		var err error
+		rec.Hash, _, err = ptAuth.Lookup(context.TODO(), username)
+		if err != nil {
+			return userRecord{}, fmt.Errorf("%s: %w", username, err)
+		}
+	}
+	if m.storage != nil {
+		u, err := m.storage.GetIMAPAcct(username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "No IMAP account for %s: %v\n", username, err)
+		} else if userAL, ok := u.(AppendLimitUser); ok {
+			rec.AppendLimit = userAL.CreateMessageLimit()
+		}
+	}
+	return rec, nil
+}
+
+func openUsersBulkFile(ctx *cli.Context, write bool) (*os.File, error) {
+	path := ctx.Args().First()
+	if path == "" || path == "-" {
+		if write {
+			return os.Stdout, nil
+		}
+		return os.Stdin, nil
+	}
+	if write {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	}
+	return os.Open(path)
+}
+
+func usersImport(ctx *cli.Context) error {
+	f, err := openUsersBulkFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var recs []userRecord
+	switch ctx.String("format") {
+	case "csv":
+		recs, err = readUserRecordsCSV(f)
+	case "json":
+		recs, err = readUserRecordsJSON(f)
+	case "dovecot":
+		recs, err = readUserRecordsDovecot(f)
+	default:
+		return cli.Exit("Error: unknown format: "+ctx.String("format"), 2)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: malformed input: %v", err), 2)
+	}
+	if err := convertDovecotHashes(recs); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+	if err := validateUserRecords(recs, ctx.String("aliases-cfg-block") != ""); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+
+	mods, err := openUsersBulkModules(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer mods.close()
+
+	created, skipped := 0, 0
+	for _, rec := range recs {
+		if ctx.Bool("skip-existing") {
+			exists, err := mods.userExists(rec.Username)
+			if err != nil {
+				return err
+			}
+			if exists {
+				skipped++
+				continue
+			}
+		}
+
+		if err := mods.createAccount(ctx, rec); err != nil {
+			fmt.Fprintf(os.Stderr, "Created %d accounts, skipped %d\n", created, skipped)
+			return fmt.Errorf("%s: %w", rec.Username, err)
+		}
+		created++
+	}
+
+	fmt.Fprintf(os.Stderr, "Created %d accounts, skipped %d\n", created, skipped)
+	return nil
+}
+
+func usersExport(ctx *cli.Context) error {
+	format := ctx.String("format")
+	if format != "csv" && format != "json" {
+		return cli.Exit("Error: unknown format: "+format, 2)
+	}
+
+	mods, err := openUsersBulkModules(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer mods.close()
+
+	users, err := mods.creds.ListUsers()
+	if err != nil {
+		return err
+	}
+	sort.Strings(users)
+
+	aliases, err := mods.aliasesByTarget()
+	if err != nil {
+		return err
+	}
+
+	recs := make([]userRecord, 0, len(users))
+	for _, username := range users {
+		rec, err := mods.exportAccount(username, aliases[username])
+		if err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+	}
+
+	f, err := openUsersBulkFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if format == "json" {
+		enc := json.NewEncoder(f)
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cw := csv.NewWriter(f)
+	if err := cw.Write(userRecordFields); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		lim := ""
+		if rec.AppendLimit != nil {
+			lim = strconv.FormatUint(uint64(*rec.AppendLimit), 10)
+		}
+		if err := cw.Write([]string{rec.Username, "", rec.Hash, lim, strings.Join(rec.Aliases, " ")}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
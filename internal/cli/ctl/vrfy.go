@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	adminFlag := &cli.StringFlag{
+		Name:    "admin-endpoint",
+		Usage:   "Address of the admin endpoint of the running server",
+		EnvVars: []string{"MADDY_ADMIN_ENDPOINT"},
+		Value:   "unix:///run/maddy/admin.sock",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:      "vrfy",
+			Usage:     "Check whether the address exists",
+			ArgsUsage: "ADDRESS",
+			Description: `Check the address against the local_addresses table of the admin
+endpoint, similarly to the SMTP VRFY command.
+
+The command talks to the running server using the admin endpoint, it should
+be enabled in the configuration.
+`,
+			Flags: []cli.Flag{adminFlag},
+			Action: func(ctx *cli.Context) error {
+				return vrfyQuery(ctx, "/vrfy")
+			},
+		})
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:      "expn",
+			Usage:     "List members of the mailing list",
+			ArgsUsage: "ADDRESS",
+			Description: `Expand the list address using the mailing_lists table of the admin
+endpoint, similarly to the SMTP EXPN command.
+
+The command talks to the running server using the admin endpoint, it should
+be enabled in the configuration.
+`,
+			Flags: []cli.Flag{adminFlag},
+			Action: func(ctx *cli.Context) error {
+				return vrfyQuery(ctx, "/expn")
+			},
+		})
+}
+
+func vrfyQuery(ctx *cli.Context, path string) error {
+	if ctx.NArg() != 1 {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+
+	client, base, err := adminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("address", ctx.Args().First())
+	resp, err := client.Get(base + path + "?" + q.Encode())
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cli.Exit(adminError(resp).Error(), 1)
+	}
+
+	var res struct {
+		Address string   `json:"address"`
+		Members []string `json:"members"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: malformed response: %v", err), 1)
+	}
+	if len(res.Members) == 0 {
+		fmt.Println(res.Address)
+		return nil
+	}
+	for _, member := range res.Members {
+		fmt.Println(member)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package cluster provides primitives for coordination of multiple maddy
+// instances sharing the same state (e.g. the queue directory).
+package cluster
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+
+	_ "github.com/lib/pq"
+)
+
+// Locker implements exclusive locks shared between multiple instances.
+//
+// Locks are bound to the instance lifetime: if it crashes or loses the
+// connection to the coordination backend, all locks it holds are released.
+type Locker interface {
+	// TryLock attempts to acquire the lock without blocking. ok is false if
+	// the lock is held by another instance. If ok is true, unlock should be
+	// called to release the lock.
+	TryLock(ctx context.Context, key string) (unlock func(), ok bool, err error)
+
+	Close() error
+}
+
+// PostgresLocker implements Locker using PostgreSQL session-level advisory
+// locks.
+type PostgresLocker struct {
+	db *sql.DB
+}
+
+func NewPostgresLocker(dsn string) (*PostgresLocker, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresLocker{db: db}, nil
+}
+
+// lockID converts the key into the 64-bit advisory lock identifier.
+func lockID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+func (l *PostgresLocker) TryLock(ctx context.Context, key string) (func(), bool, error) {
+	// Advisory locks belong to the database session so the same connection
+	// should be used to release the lock.
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	id := lockID(key)
+	var ok bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, id).Scan(&ok); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if !ok {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	return func() {
+		var released bool
+		err := conn.QueryRowContext(context.Background(), `SELECT pg_advisory_unlock($1)`, id).Scan(&released)
+		if err != nil || !released {
+			// Do not return the connection to the pool if the lock
+			// state is not known, closing it releases all locks.
+			_ = conn.Raw(func(interface{}) error {
+				return driver.ErrBadConn
+			})
+		}
+		conn.Close()
+	}, true, nil
+}
+
+func (l *PostgresLocker) Close() error {
+	return l.db.Close()
+}
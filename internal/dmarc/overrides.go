@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Actions that can be taken for messages failing DMARC checks with
+// p=quarantine policy.
+const (
+	// QuarantineJunk marks the message as quarantined so it is delivered to
+	// the Junk mailbox.
+	QuarantineJunk = "junk"
+
+	// QuarantineSubject prepends a tag to the message subject, the message is
+	// delivered normally otherwise.
+	QuarantineSubject = "subject"
+
+	// QuarantineMailbox marks the message as quarantined and requests the
+	// delivery to the specific mailbox via the quarantine.mailbox
+	// annotation.
+	QuarantineMailbox = "mailbox"
+)
+
+// Overrides is the local policy applied on top of the policy published by
+// the sender domain.
+type Overrides struct {
+	// Exceptions contains RFC5322.From domains the policy should never be
+	// enforced for. If the value is "quarantine", p=reject is downgraded to
+	// p=quarantine instead of being ignored completely.
+	Exceptions module.Table
+
+	// TrustedForwarders contains IP addresses of forwarding servers (e.g.
+	// mailing lists) messages from which are never rejected or quarantined
+	// due to the DMARC policy.
+	TrustedForwarders module.Table
+
+	// IgnorePercent makes Verifier apply the policy to all failing messages
+	// regardless of the pct= value.
+	IgnorePercent bool
+
+	// QuarantineAction is one of Quarantine* constants. Empty value is
+	// equivalent to QuarantineJunk.
+	QuarantineAction string
+
+	// QuarantineArg is the subject tag or mailbox name, depending on
+	// QuarantineAction.
+	QuarantineArg string
+}
+
+// Adjust returns the policy that should be enforced for the message after
+// applying local overrides. The reason string describes the applied
+// override and is empty if the policy is not changed.
+//
+// On lookup errors, the original policy is returned together with the
+// error.
+func (o Overrides) Adjust(ctx context.Context, fromDomain string, srcIP net.IP, policy Policy) (Policy, string, error) {
+	if policy == PolicyNone {
+		return policy, "", nil
+	}
+
+	if o.TrustedForwarders != nil && srcIP != nil {
+		_, ok, err := o.TrustedForwarders.Lookup(ctx, srcIP.String())
+		if err != nil {
+			return policy, "", fmt.Errorf("dmarc: trusted forwarders lookup: %w", err)
+		}
+		if ok {
+			return PolicyNone, "trusted forwarder", nil
+		}
+	}
+
+	if o.Exceptions != nil && fromDomain != "" {
+		key, err := dns.ForLookup(fromDomain)
+		if err != nil {
+			return policy, "", nil
+		}
+		val, ok, err := o.Exceptions.Lookup(ctx, key)
+		if err != nil {
+			return policy, "", fmt.Errorf("dmarc: exceptions lookup: %w", err)
+		}
+		if ok {
+			if val == string(PolicyQuarantine) {
+				return PolicyQuarantine, "domain exception", nil
+			}
+			return PolicyNone, "domain exception", nil
+		}
+	}
+
+	return policy, "", nil
+}
@@ -57,6 +57,10 @@ type Verifier struct {
 
 	resolver Resolver
 
+	// IgnorePercent disables sampling using the pct= policy key, the policy
+	// is applied to all failing messages.
+	IgnorePercent bool
+
 	// TODO(GH #206): DMARC reporting
 	// FailureReportFunc is the callback that is called when a failure report
 	// is generated. If it is nil - failure reports generation is disabled.
@@ -161,7 +165,7 @@ func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 		return result, dmarc.PolicyNone
 	}
 
-	if data.record.Percent != nil && rand.Int31n(100) > int32(*data.record.Percent) {
+	if !v.IgnorePercent && data.record.Percent != nil && rand.Int31n(100) > int32(*data.record.Percent) {
 		return result, dmarc.PolicyNone
 	}
 
@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package dsn
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Category is the class of the delivery failure determined from the SMTP
+// status codes and the error message returned by the remote server.
+type Category string
+
+const (
+	CategoryUserUnknown Category = "user_unknown"
+	CategoryMailboxFull Category = "mailbox_full"
+	CategoryPolicy      Category = "policy"
+	CategoryReputation  Category = "reputation"
+	CategoryOther       Category = "other"
+)
+
+// Categories lists all values returned by Classify.
+var Categories = []string{
+	string(CategoryUserUnknown),
+	string(CategoryMailboxFull),
+	string(CategoryPolicy),
+	string(CategoryReputation),
+	string(CategoryOther),
+}
+
+// Phrases used by popular mail servers in rejections caused by the sender IP
+// or domain reputation. Enhanced codes are not reliable for these.
+var reputationPhrases = []string{
+	"blocklist",
+	"blacklist",
+	"block list",
+	"black list",
+	"spamhaus",
+	"reputation",
+	"listed at",
+	"listed in",
+	"dnsbl",
+}
+
+// Classify determines the category of the delivery failure.
+//
+// Enhanced status codes (RFC 3463) are used if they are present, the text
+// of the message is used only to tell reputation-related rejections apart
+// from other policy rejections.
+func Classify(code int, enchCode smtp.EnhancedCode, message string) Category {
+	lowerMsg := strings.ToLower(message)
+	for _, phrase := range reputationPhrases {
+		if strings.Contains(lowerMsg, phrase) {
+			return CategoryReputation
+		}
+	}
+
+	switch {
+	case enchCode[1] == 1 && (enchCode[2] == 1 || enchCode[2] == 0 || enchCode[2] == 6):
+		// X.1.1 Bad destination mailbox address, X.1.0 Other address status,
+		// X.1.6 Destination mailbox has moved.
+		return CategoryUserUnknown
+	case enchCode[1] == 2 && enchCode[2] == 1:
+		// X.2.1 Mailbox disabled, not accepting messages.
+		return CategoryUserUnknown
+	case enchCode[1] == 2 && enchCode[2] == 2:
+		// X.2.2 Mailbox full.
+		return CategoryMailboxFull
+	case enchCode[1] == 7:
+		// X.7.X Security or policy status.
+		return CategoryPolicy
+	}
+
+	switch code {
+	case 550, 553:
+		if strings.Contains(lowerMsg, "user unknown") ||
+			strings.Contains(lowerMsg, "no such user") ||
+			strings.Contains(lowerMsg, "does not exist") {
+			return CategoryUserUnknown
+		}
+	case 452, 552:
+		if strings.Contains(lowerMsg, "quota") || strings.Contains(lowerMsg, "full") {
+			return CategoryMailboxFull
+		}
+	}
+
+	return CategoryOther
+}
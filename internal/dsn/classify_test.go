@@ -0,0 +1,42 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package dsn
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestClassify(t *testing.T) {
+	test := func(code int, enchCode smtp.EnhancedCode, msg string, expected Category) {
+		t.Helper()
+		if cat := Classify(code, enchCode, msg); cat != expected {
+			t.Errorf("Classify(%d, %v, %q) = %s, want %s", code, enchCode, msg, cat, expected)
+		}
+	}
+
+	test(550, smtp.EnhancedCode{5, 1, 1}, "User unknown", CategoryUserUnknown)
+	test(550, smtp.EnhancedCode{5, 2, 1}, "Account disabled", CategoryUserUnknown)
+	test(552, smtp.EnhancedCode{5, 2, 2}, "Mailbox full", CategoryMailboxFull)
+	test(452, smtp.EnhancedCode{4, 0, 0}, "Over quota", CategoryMailboxFull)
+	test(550, smtp.EnhancedCode{5, 7, 1}, "Message rejected due to local policy", CategoryPolicy)
+	test(554, smtp.EnhancedCode{5, 7, 1}, "Client host blocked using Spamhaus", CategoryReputation)
+	test(550, smtp.EnhancedCode{5, 0, 0}, "No such user here", CategoryUserUnknown)
+	test(451, smtp.EnhancedCode{4, 4, 0}, "Connection timed out", CategoryOther)
+}
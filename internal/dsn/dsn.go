@@ -50,6 +50,10 @@ type ReportingMTAInfo struct {
 
 	// Time when message delivery was attempted last time.
 	LastAttemptDate time.Time
+
+	// Text replaces the default explanation in the human-readable part if
+	// not empty. It is not included in the machine-readable part.
+	Text string
 }
 
 func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
@@ -185,10 +189,26 @@ type Envelope struct {
 	To    string
 }
 
+// Return specifies what part of the original message is included in the DSN.
+type Return int
+
+const (
+	ReturnHeaders Return = iota
+	ReturnFull
+	ReturnNone
+)
+
 // GenerateDSN is a top-level function that should be used for generation of the DSNs.
 //
 // DSN header will be returned, body itself will be written to outWriter.
 func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	return GenerateDSNReturn(utf8, envelope, mtaInfo, rcptsInfo, ReturnHeaders, failedHeader, nil, outWriter)
+}
+
+// GenerateDSNReturn is similar to GenerateDSN but allows to control what part
+// of the original message is included. failedBody is used only for
+// ReturnFull.
+func GenerateDSNReturn(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, ret Return, failedHeader textproto.Header, failedBody io.Reader, outWriter io.Writer) (textproto.Header, error) {
 	partWriter := textproto.NewMultipartWriter(outWriter)
 
 	reportHeader := textproto.Header{}
@@ -210,7 +230,34 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
 		return textproto.Header{}, err
 	}
-	return reportHeader, writeHeader(utf8, partWriter, failedHeader)
+	switch ret {
+	case ReturnNone:
+		return reportHeader, nil
+	case ReturnFull:
+		return reportHeader, writeMessage(utf8, partWriter, failedHeader, failedBody)
+	default:
+		return reportHeader, writeHeader(utf8, partWriter, failedHeader)
+	}
+}
+
+func writeMessage(utf8 bool, w *textproto.MultipartWriter, header textproto.Header, body io.Reader) error {
+	partHeader := textproto.Header{}
+	partHeader.Add("Content-Description", "Undelivered message")
+	if utf8 {
+		partHeader.Add("Content-Type", "message/global")
+	} else {
+		partHeader.Add("Content-Type", "message/rfc822")
+	}
+	partHeader.Add("Content-Transfer-Encoding", "8bit")
+	msgWriter, err := w.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+	if err := textproto.WriteHeader(msgWriter, header); err != nil {
+		return err
+	}
+	_, err = io.Copy(msgWriter, body)
+	return err
 }
 
 func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header) error {
@@ -284,7 +331,12 @@ func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAIn
 	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
 	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
 
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
+	if mtaInfo.Text != "" {
+		// Separate the text from the list of failed recipients.
+		if _, err := io.WriteString(humanWriter, strings.TrimRight(mtaInfo.Text, "\n")+"\n\n"); err != nil {
+			return err
+		}
+	} else if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
 		return err
 	}
 
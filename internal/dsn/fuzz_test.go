@@ -0,0 +1,110 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func FuzzClassify(f *testing.F) {
+	f.Add(550, 5, 1, 1, "User unknown")
+	f.Add(452, 4, 0, 0, "Over quota")
+	f.Add(554, 5, 7, 1, "Client host blocked using Spamhaus")
+	f.Add(0, -1, -1, -1, "")
+
+	f.Fuzz(func(t *testing.T, code, class, subject, detail int, msg string) {
+		Classify(code, smtp.EnhancedCode{class, subject, detail}, msg)
+	})
+}
+
+func FuzzGenerateDSN(f *testing.F) {
+	f.Add("test@example.org", "mx.example.org", "Mailbox full", "Subject: Hello\r\n\r\n")
+	f.Add("тест@пример.рф", "пример.рф", "Пользователь не найден", "Subject: =?utf-8?q?=D0=9F?=\r\n\r\n")
+	f.Add("\"quoted @ local\"@example.org", "[127.0.0.1]", "", "\r\n")
+
+	f.Fuzz(func(t *testing.T, rcpt, remoteMTA, diagnostic, failedHdr string) {
+		hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(failedHdr)))
+		if err != nil {
+			t.Skip()
+		}
+
+		var body bytes.Buffer
+		var reportHdr textproto.Header
+		testutils.NoHang(t, 5*time.Second, func() {
+			reportHdr, err = GenerateDSN(true, Envelope{
+				MsgID: "<test@example.org>",
+				From:  "MAILER-DAEMON@example.org",
+				To:    "sender@example.org",
+			}, ReportingMTAInfo{
+				ReportingMTA: "mx.example.org",
+				XSender:      "sender@example.org",
+				ArrivalDate:  time.Unix(0, 0),
+			}, []RecipientInfo{{
+				FinalRecipient: rcpt,
+				RemoteMTA:      remoteMTA,
+				Action:         ActionFailed,
+				Status:         smtp.EnhancedCode{5, 0, 0},
+				DiagnosticCode: errors.New(diagnostic),
+			}}, hdr, &body)
+		})
+		if err != nil {
+			return
+		}
+
+		// The report should always be a well-formed MIME message, regardless
+		// of the contents of fields.
+		var full bytes.Buffer
+		if err := textproto.WriteHeader(&full, reportHdr); err != nil {
+			t.Fatal(err)
+		}
+		full.Write(body.Bytes())
+
+		ent, err := message.Read(&full)
+		if err != nil && !message.IsUnknownCharset(err) {
+			t.Fatal("generated report is not parseable:", err)
+		}
+		mr := ent.MultipartReader()
+		if mr == nil {
+			t.Fatal("generated report is not multipart")
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil && !message.IsUnknownCharset(err) {
+				t.Fatal("malformed report part:", err)
+			}
+			if _, err := io.Copy(io.Discard, part.Body); err != nil {
+				t.Fatal("malformed report part:", err)
+			}
+		}
+	})
+}
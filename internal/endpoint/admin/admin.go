@@ -0,0 +1,479 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package admin implements the HTTP endpoint used by the maddy CLI to
+// inspect and control the running server.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/imap_filter/rules"
+	"github.com/foxcpp/maddy/internal/sessions"
+	"github.com/foxcpp/maddy/internal/table"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
+)
+
+const modName = "admin"
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+
+	hostname      string
+	tlsrptContact string
+
+	// Account to addresses mapping, normally the same table as
+	// user_to_email of check.authorize_sender.
+	aliases  module.Table
+	authNorm authz.NormalizeFunc
+
+	filingRules *rules.Filter
+
+	// Tables used to answer VRFY/EXPN-like requests. nil if the
+	// corresponding request is disabled.
+	localAddrs   module.Table
+	mailingLists module.Table
+}
+
+type terminateResponse struct {
+	Terminated int    `json:"terminated"`
+	Error      string `json:"error,omitempty"`
+}
+
+type rulesResponse struct {
+	Rules []rules.Rule `json:"rules,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+type vrfyResponse struct {
+	Address string   `json:"address,omitempty"`
+	Exists  bool     `json:"exists,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type addressesResponse struct {
+	User      string   `json:"user,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("hostname", true, false, "", &e.hostname)
+	cfg.String("tlsrpt_contact", false, false, "", &e.tlsrptContact)
+	cfg.Custom("aliases", false, false, func() (interface{}, error) {
+		return &table.Identity{}, nil
+	}, modconfig.TableDirective, &e.aliases)
+	config.EnumMapped(cfg, "auth_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
+		&e.authNorm)
+	cfg.Custom("filing_rules", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var f *rules.Filter
+		err := modconfig.ModuleFromNode("imap.filter", node.Args, node, m.Globals, &f)
+		return f, err
+	}, &e.filingRules)
+	cfg.Custom("local_addresses", false, false, nil, modconfig.TableDirective, &e.localAddrs)
+	cfg.Custom("mailing_lists", false, false, nil, modconfig.TableDirective, &e.mailingLists)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", e.handleSessions)
+	mux.HandleFunc("/sessions/terminate", e.handleTerminate)
+	mux.HandleFunc("/tlsrpt", e.handleTLSRPT)
+	mux.HandleFunc("/addresses", e.handleAddresses)
+	mux.HandleFunc("/filing-rules", e.handleRules)
+	mux.HandleFunc("/filing-rules/set", e.handleRuleSet)
+	mux.HandleFunc("/filing-rules/remove", e.handleRuleRemove)
+	mux.HandleFunc("/vrfy", e.handleVrfy)
+	mux.HandleFunc("/expn", e.handleExpn)
+	e.serv.Handler = mux
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			return fmt.Errorf("%s: TLS is not supported", modName)
+		}
+		if endp.Scheme != "unix" && !isLoopback(endp.Host) {
+			e.logger.Println("endpoint is not bound to a loopback address, anyone able to connect to it can control the server:", endp)
+		}
+		if module.NoRun {
+			continue
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.Scheme == "unix" {
+			if err := os.Chmod(endp.Address(), 0o600); err != nil {
+				l.Close()
+				return fmt.Errorf("%s: %v", modName, err)
+			}
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (e *Endpoint) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		e.logger.Error("response write failed", err)
+	}
+}
+
+func (e *Endpoint) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	e.writeJSON(w, http.StatusOK, sessions.List(r.URL.Query().Get("user")))
+}
+
+func (e *Endpoint) handleTerminate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		e.writeJSON(w, http.StatusBadRequest, terminateResponse{Error: "malformed request"})
+		return
+	}
+
+	id, user := r.Form.Get("id"), r.Form.Get("user")
+	switch {
+	case id != "" && user != "":
+		e.writeJSON(w, http.StatusBadRequest, terminateResponse{Error: "id and user are mutually exclusive"})
+	case id != "":
+		if !sessions.Terminate(id) {
+			e.writeJSON(w, http.StatusNotFound, terminateResponse{Error: "no such session"})
+			return
+		}
+		e.logger.Msg("session terminated", "id", id)
+		e.writeJSON(w, http.StatusOK, terminateResponse{Terminated: 1})
+	case user != "":
+		n := sessions.TerminateUser(user)
+		e.logger.Msg("user sessions terminated", "username", user, "count", n)
+		e.writeJSON(w, http.StatusOK, terminateResponse{Terminated: n})
+	default:
+		e.writeJSON(w, http.StatusBadRequest, terminateResponse{Error: "id or user is required"})
+	}
+}
+
+// handleTLSRPT returns the TLS report for outbound sessions since the
+// previous request. Counters are reset, hence POST.
+func (e *Endpoint) handleTLSRPT(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	e.writeJSON(w, http.StatusOK, tlsrpt.Collect(e.hostname, e.tlsrptContact))
+}
+
+// handleAddresses returns the list of addresses belonging to the account.
+func (e *Endpoint) handleAddresses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		e.writeJSON(w, http.StatusBadRequest, addressesResponse{Error: "user is required"})
+		return
+	}
+	userNorm, err := e.authNorm(user)
+	if err != nil {
+		e.writeJSON(w, http.StatusBadRequest, addressesResponse{Error: "malformed username"})
+		return
+	}
+
+	addrs, err := authz.Addresses(r.Context(), userNorm, e.aliases)
+	if err != nil {
+		e.logger.Error("addresses lookup failed", err, "username", userNorm)
+		e.writeJSON(w, http.StatusInternalServerError, addressesResponse{Error: "lookup failed"})
+		return
+	}
+	if len(addrs) == 0 {
+		e.writeJSON(w, http.StatusNotFound, addressesResponse{Error: "no such user"})
+		return
+	}
+	e.writeJSON(w, http.StatusOK, addressesResponse{User: userNorm, Addresses: addrs})
+}
+
+// vrfyAddress checks the request method and returns the normalized address
+// from the request. On failure, the error response is written and false is
+// returned.
+func (e *Endpoint) vrfyAddress(w http.ResponseWriter, r *http.Request, tbl module.Table) (string, bool) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	if tbl == nil {
+		e.writeJSON(w, http.StatusNotImplemented, vrfyResponse{Error: "disabled in the configuration"})
+		return "", false
+	}
+
+	addr := r.URL.Query().Get("address")
+	if addr == "" {
+		e.writeJSON(w, http.StatusBadRequest, vrfyResponse{Error: "address is required"})
+		return "", false
+	}
+	addrNorm, err := address.ForLookup(addr)
+	if err != nil {
+		e.writeJSON(w, http.StatusBadRequest, vrfyResponse{Error: "malformed address"})
+		return "", false
+	}
+	return addrNorm, true
+}
+
+func (e *Endpoint) handleVrfy(w http.ResponseWriter, r *http.Request) {
+	addr, ok := e.vrfyAddress(w, r, e.localAddrs)
+	if !ok {
+		return
+	}
+
+	_, exists, err := e.localAddrs.Lookup(r.Context(), addr)
+	if err != nil {
+		e.logger.Error("address lookup failed", err, "address", addr)
+		e.writeJSON(w, http.StatusInternalServerError, vrfyResponse{Error: "lookup failed"})
+		return
+	}
+	if !exists {
+		e.writeJSON(w, http.StatusNotFound, vrfyResponse{Address: addr, Error: "no such address"})
+		return
+	}
+	e.writeJSON(w, http.StatusOK, vrfyResponse{Address: addr, Exists: true})
+}
+
+func (e *Endpoint) handleExpn(w http.ResponseWriter, r *http.Request) {
+	addr, ok := e.vrfyAddress(w, r, e.mailingLists)
+	if !ok {
+		return
+	}
+
+	var members []string
+	if multi, ok := e.mailingLists.(module.MultiTable); ok {
+		vals, err := multi.LookupMulti(r.Context(), addr)
+		if err != nil {
+			e.logger.Error("list lookup failed", err, "address", addr)
+			e.writeJSON(w, http.StatusInternalServerError, vrfyResponse{Error: "lookup failed"})
+			return
+		}
+		members = vals
+	} else {
+		val, ok, err := e.mailingLists.Lookup(r.Context(), addr)
+		if err != nil {
+			e.logger.Error("list lookup failed", err, "address", addr)
+			e.writeJSON(w, http.StatusInternalServerError, vrfyResponse{Error: "lookup failed"})
+			return
+		}
+		if ok {
+			for _, member := range strings.Split(val, ",") {
+				if member = strings.TrimSpace(member); member != "" {
+					members = append(members, member)
+				}
+			}
+		}
+	}
+	if len(members) == 0 {
+		e.writeJSON(w, http.StatusNotFound, vrfyResponse{Address: addr, Error: "no such list"})
+		return
+	}
+	e.writeJSON(w, http.StatusOK, vrfyResponse{Address: addr, Exists: true, Members: members})
+}
+
+// rulesUser checks that filing_rules is configured and returns the
+// normalized account name from the request. On failure, the error response
+// is written and false is returned.
+func (e *Endpoint) rulesUser(w http.ResponseWriter, user string) (string, bool) {
+	if e.filingRules == nil {
+		e.writeJSON(w, http.StatusNotFound, rulesResponse{Error: "filing_rules is not configured"})
+		return "", false
+	}
+	if user == "" {
+		e.writeJSON(w, http.StatusBadRequest, rulesResponse{Error: "user is required"})
+		return "", false
+	}
+	userNorm, err := e.authNorm(user)
+	if err != nil {
+		e.writeJSON(w, http.StatusBadRequest, rulesResponse{Error: "malformed username"})
+		return "", false
+	}
+	return userNorm, true
+}
+
+// handleRules returns the filing rules defined for the account.
+func (e *Endpoint) handleRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := e.rulesUser(w, r.URL.Query().Get("user"))
+	if !ok {
+		return
+	}
+	list, err := e.filingRules.Rules(user)
+	if err != nil {
+		e.logger.Error("filing rules lookup failed", err, "username", user)
+		e.writeJSON(w, http.StatusInternalServerError, rulesResponse{Error: "lookup failed"})
+		return
+	}
+	e.writeJSON(w, http.StatusOK, rulesResponse{Rules: list})
+}
+
+// handleRuleSet adds the filing rule or replaces actions of the existing
+// one.
+func (e *Endpoint) handleRuleSet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		e.writeJSON(w, http.StatusBadRequest, rulesResponse{Error: "malformed request"})
+		return
+	}
+
+	user, ok := e.rulesUser(w, r.Form.Get("user"))
+	if !ok {
+		return
+	}
+	rule := rules.Rule{
+		Account:   user,
+		Kind:      r.Form.Get("kind"),
+		Pattern:   r.Form.Get("pattern"),
+		Folder:    r.Form.Get("folder"),
+		MarkRead:  r.Form.Get("mark_read") == "true",
+		ForwardTo: r.Form.Get("forward_to"),
+	}
+	if err := e.filingRules.SetRule(rule); err != nil {
+		e.writeJSON(w, http.StatusBadRequest, rulesResponse{Error: err.Error()})
+		return
+	}
+	e.logger.Msg("filing rule set", "username", user, "kind", rule.Kind, "pattern", rule.Pattern)
+	e.writeJSON(w, http.StatusOK, rulesResponse{})
+}
+
+// handleRuleRemove removes the filing rule.
+func (e *Endpoint) handleRuleRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		e.writeJSON(w, http.StatusBadRequest, rulesResponse{Error: "malformed request"})
+		return
+	}
+
+	user, ok := e.rulesUser(w, r.Form.Get("user"))
+	if !ok {
+		return
+	}
+	kind, pattern := r.Form.Get("kind"), r.Form.Get("pattern")
+	removed, err := e.filingRules.RemoveRule(user, kind, pattern)
+	if err != nil {
+		e.writeJSON(w, http.StatusBadRequest, rulesResponse{Error: err.Error()})
+		return
+	}
+	if !removed {
+		e.writeJSON(w, http.StatusNotFound, rulesResponse{Error: "no such rule"})
+		return
+	}
+	e.logger.Msg("filing rule removed", "username", user, "kind", kind, "pattern", pattern)
+	e.writeJSON(w, http.StatusOK, rulesResponse{})
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
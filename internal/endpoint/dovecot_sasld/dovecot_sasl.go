@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package dovecotsasld
 
 import (
+	"context"
 	"fmt"
 	stdlog "log"
 	"net"
@@ -48,15 +49,24 @@ type Endpoint struct {
 	authMap       module.Table
 
 	srv *dovecotsasl.Server
+
+	// shutdownCtx is cancelled when the endpoint is closed to abort
+	// in-flight authentication requests.
+	shutdownCtx context.Context
+	shutdown    context.CancelFunc
 }
 
 func New(_ string, addrs []string) (module.Module, error) {
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
 	return &Endpoint{
 		addrs: addrs,
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/saslauth"},
+			Log:      log.Logger{Name: modName + "/saslauth"},
+			Endpoint: modName,
 		},
-		log: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		log:         log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		shutdownCtx: shutdownCtx,
+		shutdown:    shutdown,
 	}, nil
 }
 
@@ -92,7 +102,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 				remoteAddr = &net.TCPAddr{IP: req.RemoteIP, Port: int(req.RemotePort)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, remoteAddr, func(_ string) error { return nil })
+			return endp.saslAuth.CreateSASL(endp.shutdownCtx, mech, remoteAddr, func(_ string) error { return nil })
 		})
 	}
 
@@ -101,6 +111,9 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
+		if module.NoRun {
+			continue
+		}
 
 		l, err := net.Listen(parsed.Network(), parsed.Address())
 		if err != nil {
@@ -123,6 +136,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 }
 
 func (endp *Endpoint) Close() error {
+	endp.shutdown()
 	return endp.srv.Close()
 }
 
@@ -0,0 +1,260 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package health implements the HTTP endpoint for health and readiness
+// checks, suitable for use with load balancers and Kubernetes probes.
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "health"
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	hostname        string
+	tlsConfig       *tls.Config
+	certMinValidity time.Duration
+	checkTimeout    time.Duration
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+type checkStatus struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type status struct {
+	Ready  bool          `json:"ready"`
+	Checks []checkStatus `json:"checks"`
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("hostname", true, false, "", &e.hostname)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Duration("cert_min_validity", false, false, 24*time.Hour, &e.certMinValidity)
+	cfg.Duration("check_timeout", false, false, 5*time.Second, &e.checkTimeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", e.handleHealthz)
+	mux.HandleFunc("/readyz", e.handleReadyz)
+	mux.HandleFunc("/status", e.handleStatus)
+	e.serv.Handler = mux
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			return fmt.Errorf("%s: TLS is not supported yet", modName)
+		}
+		if module.NoRun {
+			continue
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func (e *Endpoint) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (e *Endpoint) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	st := e.status(r.Context())
+
+	w.Header().Set("Content-Type", "text/plain")
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, c := range st.Checks {
+			if c.Error != "" {
+				fmt.Fprintf(w, "%s: %s\n", c.Name, c.Error)
+			}
+		}
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (e *Endpoint) handleStatus(w http.ResponseWriter, r *http.Request) {
+	st := e.status(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(st); err != nil {
+		e.logger.Error("status write failed", err)
+	}
+}
+
+func moduleName(mod module.Module) string {
+	if mod.InstanceName() == "" || mod.InstanceName() == mod.Name() {
+		return mod.Name()
+	}
+	return mod.Name() + ":" + mod.InstanceName()
+}
+
+// status runs all health checks in parallel and collects the results.
+func (e *Endpoint) status(ctx context.Context) status {
+	mods, ok := module.Running()
+	if !ok {
+		return status{
+			Ready: false,
+			Checks: []checkStatus{{
+				Name:   "startup",
+				Status: "failed",
+				Error:  "server initialization is not complete",
+			}},
+		}
+	}
+
+	checks := make(map[string]func(context.Context) error)
+	for _, mod := range mods {
+		if hc, ok := mod.(module.HealthChecker); ok {
+			checks[moduleName(mod)] = hc.CheckHealth
+		}
+	}
+	if e.tlsConfig != nil && e.hostname != "" {
+		checks["tls_certificate"] = func(context.Context) error {
+			return tls2.CheckCertificate(e.tlsConfig, e.hostname, e.certMinValidity)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.checkTimeout)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		resLock sync.Mutex
+		st      = status{Ready: true, Checks: make([]checkStatus, 0, len(checks))}
+	)
+	for name, check := range checks {
+		name, check := name, check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			errCh := make(chan error, 1)
+			go func() { errCh <- check(ctx) }()
+
+			var err error
+			select {
+			case err = <-errCh:
+			case <-ctx.Done():
+				err = errors.New("check timed out")
+			}
+
+			res := checkStatus{
+				Name:       name,
+				Status:     "ok",
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				e.logger.Error("health check failed", err, "check", name)
+				res.Status = "failed"
+				res.Error = err.Error()
+			}
+
+			resLock.Lock()
+			defer resLock.Unlock()
+			if err != nil {
+				st.Ready = false
+			}
+			st.Checks = append(st.Checks, res)
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(st.Checks, func(i, j int) bool {
+		return st.Checks[i].Name < st.Checks[j].Name
+	})
+	return st
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
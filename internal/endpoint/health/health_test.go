@@ -0,0 +1,94 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type mockMod struct {
+	name string
+	err  error
+}
+
+func (m mockMod) Init(*config.Map) error { return nil }
+func (m mockMod) Name() string           { return "mock" }
+func (m mockMod) InstanceName() string   { return m.name }
+
+func (m mockMod) CheckHealth(context.Context) error {
+	return m.err
+}
+
+func testEndpoint() *Endpoint {
+	return &Endpoint{
+		logger:       log.Logger{Name: modName, Out: log.NopOutput{}},
+		checkTimeout: time.Second,
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	e := testEndpoint()
+	defer module.SetRunning(nil)
+
+	module.SetRunning([]module.Module{mockMod{name: "a"}, mockMod{name: "b"}})
+	rec := httptest.NewRecorder()
+	e.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v %s", rec.Code, rec.Body.String())
+	}
+
+	module.SetRunning([]module.Module{mockMod{name: "a"}, mockMod{name: "b", err: errors.New("broken")}})
+	rec = httptest.NewRecorder()
+	e.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %v", rec.Code)
+	}
+	if rec.Body.String() != "mock:b: broken\n" {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	e := testEndpoint()
+	defer module.SetRunning(nil)
+
+	module.SetRunning([]module.Module{mockMod{name: "b", err: errors.New("broken")}, mockMod{name: "a"}})
+	st := e.status(context.Background())
+	if st.Ready {
+		t.Fatal("expected not ready status")
+	}
+	if len(st.Checks) != 2 {
+		t.Fatalf("expected 2 checks, got %d", len(st.Checks))
+	}
+	if st.Checks[0].Name != "mock:a" || st.Checks[0].Status != "ok" {
+		t.Errorf("wrong check status: %+v", st.Checks[0])
+	}
+	if st.Checks[1].Name != "mock:b" || st.Checks[1].Status != "failed" || st.Checks[1].Error != "broken" {
+		t.Errorf("wrong check status: %+v", st.Checks[1])
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sentcopy"
+)
+
+// appendUser wraps the storage account to pass messages added using APPEND
+// through the append_pipeline and to skip duplicate copies of sent messages
+// before storing them.
+type appendUser struct {
+	imapbackend.User
+	endp      *Endpoint
+	connState *module.ConnState
+}
+
+func (endp *Endpoint) wrapUser(u imapbackend.User, info *imap.ConnInfo) imapbackend.User {
+	if endp.appendPipeline == nil && !endp.sentDedup {
+		return u
+	}
+
+	connState := &module.ConnState{
+		Proto:    "IMAP",
+		AuthUser: u.Username(),
+	}
+	if info != nil {
+		connState.LocalAddr = info.LocalAddr
+		connState.RemoteAddr = info.RemoteAddr
+		if info.TLS != nil {
+			connState.TLS = *info.TLS
+		}
+	}
+	return &appendUser{
+		User:      u,
+		endp:      endp,
+		connState: connState,
+	}
+}
+
+// CreateMessageLimit implements APPENDLIMIT extension if it is supported by
+// the underlying account.
+func (u *appendUser) CreateMessageLimit() *uint32 {
+	al, ok := u.User.(imapbackend.AppendLimitUser)
+	if !ok {
+		return nil
+	}
+	return al.CreateMessageLimit()
+}
+
+func (u *appendUser) CreateMessage(mbox string, flags []string, date time.Time, body imap.Literal, selected imapbackend.Mailbox) error {
+	bufr := bufio.NewReader(body)
+	header, err := textproto.ReadHeader(bufr)
+	if err != nil {
+		return errors.New("malformed message header")
+	}
+	bodyBuf, err := buffer.BufferInMemory(bufr)
+	if err != nil {
+		return err
+	}
+	defer bodyBuf.Remove()
+
+	if u.endp.sentDedup {
+		isSent, err := sentcopy.IsSent(u.User, mbox)
+		if err != nil {
+			return err
+		}
+		if isSent {
+			dup, err := sentcopy.Contains(u.User, mbox, header.Get("Message-Id"))
+			if err != nil {
+				return err
+			}
+			if dup {
+				u.endp.Log.DebugMsg("skipping duplicate APPEND to Sent", "username", u.connState.AuthUser, "mailbox", mbox, "message_id", header.Get("Message-Id"))
+				return nil
+			}
+		}
+	}
+
+	if u.endp.appendPipeline != nil {
+		header, bodyBuf, err = u.endp.filterAppend(u.connState, header, bodyBuf)
+		if err != nil {
+			return err
+		}
+		defer bodyBuf.Remove()
+	}
+
+	final := bytes.Buffer{}
+	if err := textproto.WriteHeader(&final, header); err != nil {
+		return err
+	}
+	r, err := bodyBuf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := final.ReadFrom(r); err != nil {
+		return err
+	}
+
+	return u.User.CreateMessage(mbox, flags, date, &final, selected)
+}
+
+type appendCtxKey struct{}
+
+// appendResult receives the message as it was passed to the target of
+// append_pipeline.
+type appendResult struct {
+	header textproto.Header
+	body   buffer.Buffer
+}
+
+// filterAppend runs the message through append_pipeline and returns the
+// resulting header and body.
+func (endp *Endpoint) filterAppend(connState *module.ConnState, header textproto.Header, bodyBuf buffer.Buffer) (textproto.Header, buffer.Buffer, error) {
+	msgMeta := &module.MsgMetadata{
+		OriginalFrom: connState.AuthUser,
+		Conn:         connState,
+	}
+	var err error
+	msgMeta.ID, err = module.GenerateMsgID()
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	var res appendResult
+	ctx := context.WithValue(endp.shutdownCtx, appendCtxKey{}, &res)
+
+	if err := endp.runAppendPipeline(ctx, msgMeta, header, bodyBuf); err != nil {
+		endp.Log.Error("APPEND rejected", err, "msg_id", msgMeta.ID, "username", connState.AuthUser)
+		var smtpErr *exterrors.SMTPError
+		if errors.As(err, &smtpErr) {
+			return textproto.Header{}, nil, errors.New(smtpErr.Message)
+		}
+		return textproto.Header{}, nil, errors.New("internal server error")
+	}
+	if res.body == nil {
+		return textproto.Header{}, nil, errors.New("internal server error")
+	}
+
+	return res.header, res.body, nil
+}
+
+func (endp *Endpoint) runAppendPipeline(ctx context.Context, msgMeta *module.MsgMetadata, header textproto.Header, body buffer.Buffer) error {
+	d, err := endp.appendPipeline.Start(ctx, msgMeta, msgMeta.Conn.AuthUser)
+	if err != nil {
+		return err
+	}
+	if err := d.AddRcpt(ctx, msgMeta.Conn.AuthUser, smtp.RcptOptions{}); err != nil {
+		d.Abort(ctx)
+		return err
+	}
+	if err := d.Body(ctx, header, body); err != nil {
+		d.Abort(ctx)
+		return err
+	}
+	return d.Commit(ctx)
+}
+
+// appendTarget is the final target of append_pipeline. It saves the
+// message to the appendResult passed via the context.
+type appendTarget struct{}
+
+func (appendTarget) Name() string {
+	return "imap_append"
+}
+
+func (appendTarget) InstanceName() string {
+	return "imap_append"
+}
+
+func (appendTarget) Init(*config.Map) error {
+	return nil
+}
+
+func (appendTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	res, ok := ctx.Value(appendCtxKey{}).(*appendResult)
+	if !ok {
+		return nil, errors.New("imap: append_pipeline used outside of APPEND")
+	}
+	return &appendDelivery{res: res}, nil
+}
+
+type appendDelivery struct {
+	res    *appendResult
+	header textproto.Header
+	body   buffer.Buffer
+}
+
+func (d *appendDelivery) AddRcpt(context.Context, string, smtp.RcptOptions) error {
+	return nil
+}
+
+func (d *appendDelivery) Body(_ context.Context, header textproto.Header, body buffer.Buffer) error {
+	// The buffer is removed once the pipeline is done with it, so make
+	// a copy.
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	d.body, err = buffer.BufferInMemory(r)
+	if err != nil {
+		return err
+	}
+	d.header = header.Copy()
+	return nil
+}
+
+func (d *appendDelivery) Abort(context.Context) error {
+	if d.body != nil {
+		d.body.Remove()
+	}
+	return nil
+}
+
+func (d *appendDelivery) Commit(context.Context) error {
+	d.res.header = d.header
+	d.res.body = d.body
+	return nil
+}
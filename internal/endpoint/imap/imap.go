@@ -26,6 +26,8 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-imap"
 	compress "github.com/emersion/go-imap-compress"
@@ -44,6 +46,8 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/sessions"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 )
 
@@ -55,6 +59,8 @@ type Endpoint struct {
 
 	tlsConfig   *tls.Config
 	listenersWg sync.WaitGroup
+	// servingCnt is the amount of listeners that are still being served.
+	servingCnt atomic.Int32
 
 	saslAuth auth.SASLAuth
 
@@ -63,6 +69,29 @@ type Endpoint struct {
 	authNormalize    authz.NormalizeFunc
 	authMap          module.Table
 
+	// appendPipeline is used to check messages added using APPEND,
+	// nil if not configured.
+	appendPipeline *msgpipeline.MsgPipeline
+	// sentDedup enables skipping of APPENDs to the Sent mailbox if it
+	// already contains the message (e.g. stored by submission).
+	sentDedup bool
+
+	limits *connLimits
+
+	// disabledExts contains extensions and commands disabled using the
+	// disable_extensions directive.
+	disabledExts map[string]struct{}
+
+	// Value of the /shared/admin server annotation (METADATA extension).
+	metadataAdmin string
+	// Account to addresses mapping exposed as a server annotation.
+	metadataAddresses module.Table
+
+	// shutdownCtx is cancelled when the endpoint is closed to abort
+	// in-flight authentication and storage lookups.
+	shutdownCtx context.Context
+	shutdown    context.CancelFunc
+
 	Log log.Logger
 }
 
@@ -71,9 +100,12 @@ func New(modName string, addrs []string) (module.Module, error) {
 		addrs: addrs,
 		Log:   log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Endpoint: modName,
 		},
 	}
+	endp.limits = newConnLimits(endp.Log)
+	endp.shutdownCtx, endp.shutdown = context.WithCancel(context.Background())
 
 	return endp, nil
 }
@@ -83,6 +115,8 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		insecureAuth bool
 		ioDebug      bool
 		ioErrors     bool
+		hostname     string
+		disabledExts []string
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
@@ -100,11 +134,44 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.authNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.authMap)
+	modconfig.Table(cfg, "account_protocols", true, false, nil, &endp.saslAuth.AccountProtocols)
+	modconfig.Table(cfg, "master_users", true, false, nil, &endp.saslAuth.MasterUsers)
+	cfg.String("master_separator", true, false, "", &endp.saslAuth.MasterSeparator)
+	cfg.EnumList("disable_extensions", false, false,
+		[]string{"COMPRESS", "NAMESPACE", "SORT", "THREAD", "I18NLEVEL", "LIST-STATUS", "METADATA", "UNAUTHENTICATE", "AUTH=PLAIN", "AUTH=LOGIN", "LOGIN"},
+		nil, &disabledExts)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.Callback("append_pipeline", func(m *config.Map, node config.Node) error {
+		var err error
+		endp.appendPipeline, err = msgpipeline.NewFilter(m.Globals, node.Children, appendTarget{})
+		return err
+	})
+	cfg.Bool("sent_dedup", false, false, &endp.sentDedup)
+	cfg.String("metadata_admin", false, false, "", &endp.metadataAdmin)
+	modconfig.Table(cfg, "metadata_addresses", false, false, nil, &endp.metadataAddresses)
+	cfg.Int("max_connections", false, false, 0, &endp.limits.maxConns)
+	cfg.Int("max_connections_per_ip", false, false, 0, &endp.limits.maxPerIP)
+	cfg.Int("max_connections_per_user", false, false, 0, &endp.limits.maxPerUser)
+	cfg.Duration("idle_timeout", false, false, 30*time.Minute, &endp.limits.idleTimeout)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	if updBe, ok := endp.Store.(updatepipe.Backend); ok {
+	endp.disabledExts = make(map[string]struct{}, len(disabledExts))
+	endp.saslAuth.DisabledMechs = make(map[string]struct{})
+	for _, ext := range disabledExts {
+		endp.disabledExts[ext] = struct{}{}
+		if mech := strings.TrimPrefix(ext, "AUTH="); mech != ext {
+			endp.saslAuth.DisabledMechs[mech] = struct{}{}
+		}
+	}
+
+	if endp.appendPipeline != nil {
+		endp.appendPipeline.Hostname = hostname
+		endp.appendPipeline.Log = log.Logger{Name: "imap/append_pipeline", Debug: endp.Log.Debug}
+	}
+
+	if updBe, ok := endp.Store.(updatepipe.Backend); ok && !module.NoRun {
 		if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
 			endp.Log.Error("failed to initialize updates pipe", err)
 		}
@@ -141,7 +208,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		mech := mech
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string) error {
+			return endp.saslAuth.CreateSASL(endp.shutdownCtx, mech, c.Info().RemoteAddr, func(identity string) error {
 				return endp.openAccount(c, identity)
 			})
 		})
@@ -152,6 +219,13 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
+		if addr.IsTLS() && endp.tlsConfig == nil {
+			return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
+		}
+		if module.NoRun {
+			continue
+		}
+
 		var l net.Listener
 		var err error
 		l, err = net.Listen(addr.Network(), addr.Address())
@@ -160,21 +234,24 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		l = sessions.WrapListener(l, "imap")
+		if endp.limits.enabled() {
+			l = endp.limits.wrap(l, !addr.IsTLS())
+		}
 		if addr.IsTLS() {
-			if endp.tlsConfig == nil {
-				return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
-			}
 			l = tls.NewListener(l, endp.tlsConfig)
 		}
 
 		endp.listeners = append(endp.listeners, l)
 
 		endp.listenersWg.Add(1)
+		endp.servingCnt.Add(1)
 		addr := addr
 		go func() {
 			if err := endp.serv.Serve(l); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
 				endp.Log.Printf("imap: failed to serve %s: %s", addr, err)
 			}
+			endp.servingCnt.Add(-1)
 			endp.listenersWg.Done()
 		}()
 	}
@@ -194,11 +271,21 @@ func (endp *Endpoint) Name() string {
 	return "imap"
 }
 
+// CheckHealth implements module.HealthChecker. It checks whether all
+// listeners are still accepting connections.
+func (endp *Endpoint) CheckHealth(_ context.Context) error {
+	if serving := int(endp.servingCnt.Load()); serving != len(endp.listeners) {
+		return fmt.Errorf("imap: %d of %d listeners are not serving", len(endp.listeners)-serving, len(endp.listeners))
+	}
+	return nil
+}
+
 func (endp *Endpoint) InstanceName() string {
 	return "imap"
 }
 
 func (endp *Endpoint) Close() error {
+	endp.shutdown()
 	for _, l := range endp.listeners {
 		l.Close()
 	}
@@ -256,7 +343,7 @@ func (endp *Endpoint) usernameForStorage(ctx context.Context, saslUsername strin
 }
 
 func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
-	username, err := endp.usernameForStorage(context.TODO(), identity)
+	username, err := endp.usernameForStorage(endp.shutdownCtx, identity)
 	if err != nil {
 		if errors.Is(err, imapbackend.ErrInvalidCredentials) {
 			return err
@@ -265,25 +352,35 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 		return fmt.Errorf("internal server error")
 	}
 
+	if err := endp.limits.login(c.Info().RemoteAddr, username); err != nil {
+		endp.Log.Msg("login rejected", "reason", err.Error(), "username", username, "src_ip", c.Info().RemoteAddr)
+		return err
+	}
+
 	u, err := endp.Store.GetOrCreateIMAPAcct(username)
 	if err != nil {
 		return err
 	}
 	ctx := c.Context()
 	ctx.State = imap.AuthenticatedState
-	ctx.User = u
+	ctx.User = endp.trackSession(endp.wrapUser(u, c.Info()), identity, c.Info())
 	return nil
 }
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	if endp.extDisabled("LOGIN") {
+		return nil, errors.New("LOGIN is disabled, use AUTHENTICATE")
+	}
+
 	// saslAuth handles AuthMap calling.
-	err := endp.saslAuth.AuthPlain(username, password)
+	loginName := username
+	username, err := endp.saslAuth.Authenticate(endp.shutdownCtx, "LOGIN", connInfo.RemoteAddr, "", loginName, password)
 	if err != nil {
-		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
+		endp.Log.Error("authentication failed", err, "username", loginName, "src_ip", connInfo.RemoteAddr)
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
-	storageUsername, err := endp.usernameForStorage(context.TODO(), username)
+	storageUsername, err := endp.usernameForStorage(endp.shutdownCtx, username)
 	if err != nil {
 		if errors.Is(err, imapbackend.ErrInvalidCredentials) {
 			return nil, err
@@ -292,7 +389,16 @@ func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string)
 		return nil, fmt.Errorf("internal server error")
 	}
 
-	return endp.Store.GetOrCreateIMAPAcct(storageUsername)
+	if err := endp.limits.login(connInfo.RemoteAddr, storageUsername); err != nil {
+		endp.Log.Msg("login rejected", "reason", err.Error(), "username", username, "src_ip", connInfo.RemoteAddr)
+		return nil, err
+	}
+
+	u, err := endp.Store.GetOrCreateIMAPAcct(storageUsername)
+	if err != nil {
+		return nil, err
+	}
+	return endp.trackSession(endp.wrapUser(u, connInfo), username, connInfo), nil
 }
 
 func (endp *Endpoint) I18NLevel() int {
@@ -303,22 +409,49 @@ func (endp *Endpoint) I18NLevel() int {
 	return be.I18NLevel()
 }
 
+func (endp *Endpoint) extDisabled(name string) bool {
+	_, ok := endp.disabledExts[name]
+	return ok
+}
+
 func (endp *Endpoint) enableExtensions() error {
 	exts := endp.Store.IMAPExtensions()
 	for _, ext := range exts {
 		switch ext {
 		case "I18NLEVEL=1", "I18NLEVEL=2":
-			endp.serv.Enable(i18nlevel.NewExtension())
+			if !endp.extDisabled("I18NLEVEL") {
+				endp.serv.Enable(i18nlevel.NewExtension())
+			}
 		case "SORT":
-			endp.serv.Enable(sortthread.NewSortExtension())
+			if !endp.extDisabled("SORT") {
+				endp.serv.Enable(sortthread.NewSortExtension())
+			}
 		}
-		if strings.HasPrefix(ext, "THREAD") {
+		if strings.HasPrefix(ext, "THREAD") && !endp.extDisabled("THREAD") {
 			endp.serv.Enable(sortthread.NewThreadExtension())
 		}
 	}
 
-	endp.serv.Enable(compress.NewExtension())
-	endp.serv.Enable(namespace.NewExtension())
+	if !endp.extDisabled("COMPRESS") {
+		endp.serv.Enable(compress.NewExtension())
+	}
+	if !endp.extDisabled("NAMESPACE") {
+		endp.serv.Enable(namespace.NewExtension())
+	}
+	if !endp.extDisabled("LIST-STATUS") {
+		endp.serv.Enable(listStatusExtension{})
+	}
+	if !endp.extDisabled("UNAUTHENTICATE") {
+		endp.serv.Enable(unauthenticateExtension{endp: endp})
+	}
+	if store, ok := endp.Store.(module.MetadataStorage); ok && !endp.extDisabled("METADATA") {
+		endp.serv.Enable(&metadataExtension{
+			ctx:       endp.shutdownCtx,
+			store:     store,
+			admin:     endp.metadataAdmin,
+			addresses: endp.metadataAddresses,
+		})
+	}
 
 	return nil
 }
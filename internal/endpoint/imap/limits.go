@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+var errUserConnLimit = errors.New("Too many connections for this account")
+
+// connLimits enforces limits on the amount of concurrent connections and
+// closes connections that stay idle for too long.
+type connLimits struct {
+	maxConns    int
+	maxPerIP    int
+	maxPerUser  int
+	idleTimeout time.Duration
+
+	log log.Logger
+
+	lock    sync.Mutex
+	total   int
+	perIP   map[string]int
+	perUser map[string]int
+	// Connections indexed by the remote address to find them during
+	// authentication. Only TCP connections are indexed.
+	byAddr map[string]*limitedConn
+}
+
+func newConnLimits(l log.Logger) *connLimits {
+	return &connLimits{
+		log:     l,
+		perIP:   make(map[string]int),
+		perUser: make(map[string]int),
+		byAddr:  make(map[string]*limitedConn),
+	}
+}
+
+func (cl *connLimits) enabled() bool {
+	return cl.maxConns > 0 || cl.maxPerIP > 0 || cl.maxPerUser > 0 || cl.idleTimeout > 0
+}
+
+// accept registers the new connection. It returns the reason if the
+// connection should be rejected.
+func (cl *connLimits) accept(conn net.Conn) (*limitedConn, string) {
+	lc := &limitedConn{
+		Conn:   conn,
+		limits: cl,
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		lc.ip = tcpAddr.IP.String()
+		lc.addr = tcpAddr.String()
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if cl.maxConns > 0 && cl.total >= cl.maxConns {
+		return nil, "too many connections"
+	}
+	if lc.ip != "" && cl.maxPerIP > 0 && cl.perIP[lc.ip] >= cl.maxPerIP {
+		return nil, "too many connections from the IP"
+	}
+
+	cl.total++
+	if lc.ip != "" {
+		cl.perIP[lc.ip]++
+		cl.byAddr[lc.addr] = lc
+	}
+	return lc, ""
+}
+
+// login records that the connection is used by the account. It returns
+// errUserConnLimit if the account has too many connections already.
+func (cl *connLimits) login(remoteAddr net.Addr, username string) error {
+	if remoteAddr == nil {
+		return nil
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	lc := cl.byAddr[remoteAddr.String()]
+	if lc == nil || lc.user == username {
+		return nil
+	}
+	if cl.maxPerUser > 0 && cl.perUser[username] >= cl.maxPerUser {
+		return errUserConnLimit
+	}
+	if lc.user != "" {
+		cl.releaseUser(lc.user)
+	}
+	lc.user = username
+	cl.perUser[username]++
+	return nil
+}
+
+// logout records that the connection is no longer used by any account.
+func (cl *connLimits) logout(remoteAddr net.Addr) {
+	if remoteAddr == nil {
+		return
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	lc := cl.byAddr[remoteAddr.String()]
+	if lc == nil || lc.user == "" {
+		return
+	}
+	cl.releaseUser(lc.user)
+	lc.user = ""
+}
+
+func (cl *connLimits) releaseUser(username string) {
+	cl.perUser[username]--
+	if cl.perUser[username] <= 0 {
+		delete(cl.perUser, username)
+	}
+}
+
+func (cl *connLimits) release(lc *limitedConn) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.total--
+	if lc.ip != "" {
+		cl.perIP[lc.ip]--
+		if cl.perIP[lc.ip] <= 0 {
+			delete(cl.perIP, lc.ip)
+		}
+		if cl.byAddr[lc.addr] == lc {
+			delete(cl.byAddr, lc.addr)
+		}
+	}
+	if lc.user != "" {
+		cl.releaseUser(lc.user)
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	limits *connLimits
+	ip     string
+	addr   string
+	// Storage account using the connection, protected by limits.lock.
+	user string
+
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if c.limits.idleTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.limits.idleTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.limits.release(c)
+	})
+	return c.Conn.Close()
+}
+
+type limitListener struct {
+	net.Listener
+	limits *connLimits
+	// Send the BYE response before closing rejected connections. Not done
+	// for implicit TLS listeners since the handshake is not done yet.
+	greet bool
+}
+
+func (l limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		lc, reason := l.limits.accept(conn)
+		if lc != nil {
+			return lc, nil
+		}
+
+		l.limits.log.Msg("connection rejected", "reason", reason, "src_ip", conn.RemoteAddr())
+		go func() {
+			if l.greet {
+				_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				_, _ = conn.Write([]byte("* BYE [UNAVAILABLE] Too many connections, try again later\r\n"))
+			}
+			conn.Close()
+		}()
+	}
+}
+
+func (cl *connLimits) wrap(l net.Listener, greet bool) net.Listener {
+	return limitListener{Listener: l, limits: cl, greet: greet}
+}
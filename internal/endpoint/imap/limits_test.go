@@ -0,0 +1,118 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func testConn(t *testing.T, ip string, port int) net.Conn {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return addrConn{Conn: c1, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+}
+
+func TestConnLimits(t *testing.T) {
+	cl := newConnLimits(testutils.Logger(t, "imap"))
+	cl.maxConns = 3
+	cl.maxPerIP = 2
+	cl.maxPerUser = 1
+
+	c1, reason := cl.accept(testConn(t, "127.0.0.1", 1))
+	if c1 == nil {
+		t.Fatal("first connection rejected:", reason)
+	}
+	c2, reason := cl.accept(testConn(t, "127.0.0.1", 2))
+	if c2 == nil {
+		t.Fatal("second connection rejected:", reason)
+	}
+	if c, _ := cl.accept(testConn(t, "127.0.0.1", 3)); c != nil {
+		t.Fatal("per-IP limit is not enforced")
+	}
+	c3, reason := cl.accept(testConn(t, "127.0.0.2", 1))
+	if c3 == nil {
+		t.Fatal("connection from another IP rejected:", reason)
+	}
+	if c, _ := cl.accept(testConn(t, "127.0.0.3", 1)); c != nil {
+		t.Fatal("global limit is not enforced")
+	}
+
+	if err := cl.login(c1.RemoteAddr(), "user"); err != nil {
+		t.Fatal("unexpected login error:", err)
+	}
+	if err := cl.login(c2.RemoteAddr(), "user"); !errors.Is(err, errUserConnLimit) {
+		t.Fatal("per-user limit is not enforced:", err)
+	}
+	if err := cl.login(c3.RemoteAddr(), "another"); err != nil {
+		t.Fatal("unexpected login error:", err)
+	}
+
+	cl.logout(c1.RemoteAddr())
+	if err := cl.login(c2.RemoteAddr(), "user"); err != nil {
+		t.Fatal("login rejected after logout:", err)
+	}
+	if err := cl.login(c1.RemoteAddr(), "user"); !errors.Is(err, errUserConnLimit) {
+		t.Fatal("per-user limit is not enforced after logout:", err)
+	}
+	cl.logout(c2.RemoteAddr())
+
+	c1.Close()
+	if err := cl.login(c2.RemoteAddr(), "user"); err != nil {
+		t.Fatal("login rejected after connection was closed:", err)
+	}
+	if c, reason := cl.accept(testConn(t, "127.0.0.1", 4)); c == nil {
+		t.Fatal("connection rejected after connection was closed:", reason)
+	}
+}
+
+func TestConnLimits_IdleTimeout(t *testing.T) {
+	cl := newConnLimits(testutils.Logger(t, "imap"))
+	cl.idleTimeout = 50 * time.Millisecond
+
+	c, _ := cl.accept(testConn(t, "127.0.0.1", 1))
+	defer c.Close()
+
+	start := time.Now()
+	_, err := c.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("expected timeout error, got", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("read took too long")
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// listStatusExtension implements the LIST-STATUS extension (RFC 5819) that
+// allows clients to get the status of all mailboxes using a single LIST
+// command:
+//
+//	LIST "" "*" RETURN (STATUS (MESSAGES UNSEEN))
+//
+// LIST commands without return options are handled by the built-in
+// implementation.
+type listStatusExtension struct{}
+
+func (listStatusExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"LIST-STATUS"}
+	}
+	return nil
+}
+
+func (listStatusExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "LIST" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &listStatus{}
+	}
+}
+
+type listStatus struct {
+	commands.List
+
+	// Set if RETURN options are present.
+	extended bool
+	// Return \Subscribed attribute (RETURN (SUBSCRIBED)).
+	retSubscribed bool
+	statusItems   []imap.StatusItem
+}
+
+func parseStatusItems(f interface{}) ([]imap.StatusItem, error) {
+	list, ok := f.([]interface{})
+	if !ok {
+		return nil, errors.New("STATUS return option requires a list of items")
+	}
+	items := make([]imap.StatusItem, 0, len(list))
+	for _, item := range list {
+		s, err := imap.ParseString(item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, imap.StatusItem(strings.ToUpper(s)))
+	}
+	return items, nil
+}
+
+func (cmd *listStatus) Parse(fields []interface{}) error {
+	// Selection options (RFC 5258). Only SUBSCRIBED affects the result.
+	if len(fields) > 0 {
+		if opts, ok := fields[0].([]interface{}); ok {
+			for _, opt := range opts {
+				s, err := imap.ParseString(opt)
+				if err != nil {
+					return err
+				}
+				switch strings.ToUpper(s) {
+				case "SUBSCRIBED":
+					cmd.Subscribed = true
+				case "REMOTE":
+				default:
+					return errors.New("unsupported LIST selection option: " + s)
+				}
+			}
+			cmd.extended = true
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) < 2 {
+		return errors.New("not enough arguments")
+	}
+	if err := cmd.List.Parse(fields[:2]); err != nil {
+		return err
+	}
+	fields = fields[2:]
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if len(fields) != 2 {
+		return errors.New("unexpected arguments")
+	}
+	if kw, err := imap.ParseString(fields[0]); err != nil || !strings.EqualFold(kw, "RETURN") {
+		return errors.New("RETURN expected")
+	}
+	opts, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("list of return options expected")
+	}
+	cmd.extended = true
+	for i := 0; i < len(opts); i++ {
+		s, err := imap.ParseString(opts[i])
+		if err != nil {
+			return err
+		}
+		switch strings.ToUpper(s) {
+		case "STATUS":
+			if i+1 >= len(opts) {
+				return errors.New("STATUS return option requires a list of items")
+			}
+			cmd.statusItems, err = parseStatusItems(opts[i+1])
+			if err != nil {
+				return err
+			}
+			i++
+		case "SUBSCRIBED":
+			cmd.retSubscribed = true
+		case "CHILDREN", "SPECIAL-USE":
+			// These attributes are always returned.
+		default:
+			return errors.New("unsupported LIST return option: " + s)
+		}
+	}
+	return nil
+}
+
+func (cmd *listStatus) Handle(conn imapserver.Conn) error {
+	if !cmd.extended || cmd.Mailbox == "" {
+		builtin := &imapserver.List{List: cmd.List}
+		return builtin.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mailboxes, err := ctx.User.ListMailboxes(cmd.Subscribed)
+	if err != nil {
+		return err
+	}
+
+	var subscribed map[string]bool
+	if cmd.retSubscribed || cmd.Subscribed {
+		subscribed = make(map[string]bool)
+		subMboxes := mailboxes
+		if !cmd.Subscribed {
+			subMboxes, err = ctx.User.ListMailboxes(true)
+			if err != nil {
+				return err
+			}
+		}
+		for _, info := range subMboxes {
+			subscribed[info.Name] = true
+		}
+	}
+
+	for _, info := range mailboxes {
+		info := info
+		if !info.Match(cmd.Reference, cmd.Mailbox) {
+			continue
+		}
+		if cmd.retSubscribed && subscribed[info.Name] {
+			info.Attributes = append(info.Attributes, `\Subscribed`)
+		}
+
+		resp := imap.NewUntaggedResp(append([]interface{}{imap.RawString("LIST")}, info.Format()...))
+		if err := conn.WriteResp(resp); err != nil {
+			return err
+		}
+
+		if len(cmd.statusItems) == 0 || !selectable(info) {
+			continue
+		}
+		status, err := ctx.User.Status(info.Name, cmd.statusItems)
+		if err != nil {
+			// The mailbox could have been removed concurrently, do not fail
+			// the whole listing.
+			continue
+		}
+		status.Name = info.Name
+		if err := conn.WriteResp(&responses.Status{Mailbox: status}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func selectable(info imap.MailboxInfo) bool {
+	for _, attr := range info.Attributes {
+		if strings.EqualFold(attr, imap.NoSelectAttr) || strings.EqualFold(attr, `\NonExistent`) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestListStatusParse(t *testing.T) {
+	test := func(fields []interface{}, expected listStatus, fail bool) {
+		t.Helper()
+
+		var cmd listStatus
+		err := cmd.Parse(fields)
+		if fail {
+			if err == nil {
+				t.Errorf("expected error for %v", fields)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", fields, err)
+			return
+		}
+		if !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("wrong result for %v:\nwant %+v\ngot  %+v", fields, expected, cmd)
+		}
+	}
+
+	plain := listStatus{}
+	plain.Mailbox = "*"
+	test([]interface{}{"", "*"}, plain, false)
+
+	withStatus := listStatus{
+		extended:    true,
+		statusItems: []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen},
+	}
+	withStatus.Mailbox = "*"
+	test([]interface{}{"", "*", "RETURN", []interface{}{"STATUS", []interface{}{"MESSAGES", "unseen"}}}, withStatus, false)
+
+	subscribed := listStatus{
+		extended:      true,
+		retSubscribed: true,
+	}
+	subscribed.Mailbox = "%"
+	subscribed.Subscribed = true
+	test([]interface{}{[]interface{}{"SUBSCRIBED"}, "", "%", "RETURN", []interface{}{"SUBSCRIBED", "CHILDREN"}}, subscribed, false)
+
+	test([]interface{}{"", "*", "RETURN", []interface{}{"STATUS"}}, listStatus{}, true)
+	test([]interface{}{"", "*", "RETURN", []interface{}{"MYRIGHTS"}}, listStatus{}, true)
+	test([]interface{}{"", "*", "FOO", []interface{}{}}, listStatus{}, true)
+	test([]interface{}{[]interface{}{"RECURSIVEMATCH"}, "", "*"}, listStatus{}, true)
+	test([]interface{}{""}, listStatus{}, true)
+}
@@ -0,0 +1,402 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/authz"
+)
+
+const (
+	// adminEntry is the server annotation with the administrator contact URI,
+	// it is read-only and set using the metadata_admin directive.
+	adminEntry = "/shared/admin"
+	// addressesEntry is the server annotation with the comma-separated list
+	// of addresses belonging to the account, it is read-only and taken from
+	// the metadata_addresses table.
+	addressesEntry = "/shared/vendor/maddy/addresses"
+)
+
+// metadataExtension implements the METADATA extension (RFC 5464) on top of
+// module.MetadataStorage:
+//
+//	SETMETADATA INBOX (/private/comment "My comment")
+//	GETMETADATA (DEPTH infinity) "" /private
+//
+// Annotations are not shared between accounts, /shared entries are visible
+// only to the account owner too.
+type metadataExtension struct {
+	ctx       context.Context
+	store     module.MetadataStorage
+	admin     string
+	addresses module.Table
+}
+
+// serverEntries returns the read-only server annotations for the account.
+func (ext *metadataExtension) serverEntries(username string) (map[string]string, error) {
+	entries := make(map[string]string)
+	if ext.admin != "" {
+		entries[adminEntry] = ext.admin
+	}
+	if ext.addresses != nil {
+		addrs, err := authz.Addresses(ext.ctx, username, ext.addresses)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) != 0 {
+			entries[addressesEntry] = strings.Join(addrs, ", ")
+		}
+	}
+	return entries, nil
+}
+
+func (ext *metadataExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"METADATA"}
+	}
+	return nil
+}
+
+func (ext *metadataExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETMETADATA":
+		return func() imapserver.Handler {
+			return &getMetadata{ext: ext}
+		}
+	case "SETMETADATA":
+		return func() imapserver.Handler {
+			return &setMetadata{ext: ext}
+		}
+	}
+	return nil
+}
+
+// parseEntry validates the entry name and converts it to the lower case
+// since entry names are case-insensitive.
+func parseEntry(f interface{}) (string, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	entry := strings.ToLower(s)
+	if entry != "/private" && entry != "/shared" &&
+		!strings.HasPrefix(entry, "/private/") && !strings.HasPrefix(entry, "/shared/") {
+		return "", errors.New("entry name should start with /private or /shared")
+	}
+	if strings.HasSuffix(entry, "/") || strings.Contains(entry, "//") || strings.ContainsAny(entry, "*%") {
+		return "", errors.New("malformed entry name: " + s)
+	}
+	for _, ch := range entry {
+		if ch < 0x20 || ch > 0x7e {
+			return "", errors.New("malformed entry name: " + s)
+		}
+	}
+	return entry, nil
+}
+
+// parseMailbox decodes the mailbox name, empty name refers to server
+// annotations.
+func parseMailbox(f interface{}) (string, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	name, err := utf7.Encoding.NewDecoder().String(s)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	return name, nil
+}
+
+func formatMailbox(name string) interface{} {
+	encoded, err := utf7.Encoding.NewEncoder().String(name)
+	if err != nil {
+		encoded = name
+	}
+	return imap.FormatMailboxName(encoded)
+}
+
+func checkMailbox(user imapbackend.User, name string) error {
+	if name == "" {
+		return nil
+	}
+	mboxes, err := user.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	for _, info := range mboxes {
+		if info.Name == name {
+			return nil
+		}
+	}
+	return imapbackend.ErrNoSuchMailbox
+}
+
+// matchEntry reports whether the entry is returned for the requested one
+// with the specified depth (-1 is infinity).
+func matchEntry(req, entry string, depth int) bool {
+	if entry == req {
+		return true
+	}
+	if depth == 0 || !strings.HasPrefix(entry, req+"/") {
+		return false
+	}
+	if depth == 1 {
+		return !strings.Contains(entry[len(req)+1:], "/")
+	}
+	return true
+}
+
+func metadataStatus(typ imap.StatusRespType, info string, args ...interface{}) error {
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      typ,
+		Code:      "METADATA",
+		Arguments: args,
+		Info:      info,
+	})
+}
+
+type getMetadata struct {
+	ext *metadataExtension
+
+	mailbox string
+	entries []string
+	// Values larger than maxSize are not returned, -1 means no limit.
+	maxSize int
+	depth   int
+}
+
+func (cmd *getMetadata) Parse(fields []interface{}) error {
+	cmd.maxSize = -1
+	if len(fields) > 0 {
+		if opts, ok := fields[0].([]interface{}); ok {
+			if len(opts)%2 != 0 {
+				return errors.New("malformed GETMETADATA options")
+			}
+			for i := 0; i < len(opts); i += 2 {
+				name, err := imap.ParseString(opts[i])
+				if err != nil {
+					return err
+				}
+				value, err := imap.ParseString(opts[i+1])
+				if err != nil {
+					return err
+				}
+				switch strings.ToUpper(name) {
+				case "MAXSIZE":
+					n, err := strconv.ParseUint(value, 10, 32)
+					if err != nil {
+						return errors.New("malformed MAXSIZE value")
+					}
+					cmd.maxSize = int(n)
+				case "DEPTH":
+					switch strings.ToLower(value) {
+					case "0":
+						cmd.depth = 0
+					case "1":
+						cmd.depth = 1
+					case "infinity":
+						cmd.depth = -1
+					default:
+						return errors.New("malformed DEPTH value")
+					}
+				default:
+					return errors.New("unsupported GETMETADATA option: " + name)
+				}
+			}
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) != 2 {
+		return errors.New("mailbox name and entries are expected")
+	}
+	var err error
+	cmd.mailbox, err = parseMailbox(fields[0])
+	if err != nil {
+		return err
+	}
+	if list, ok := fields[1].([]interface{}); ok {
+		for _, f := range list {
+			entry, err := parseEntry(f)
+			if err != nil {
+				return err
+			}
+			cmd.entries = append(cmd.entries, entry)
+		}
+		if len(cmd.entries) == 0 {
+			return errors.New("empty list of entries")
+		}
+		return nil
+	}
+	entry, err := parseEntry(fields[1])
+	if err != nil {
+		return err
+	}
+	cmd.entries = []string{entry}
+	return nil
+}
+
+func (cmd *getMetadata) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	if err := checkMailbox(ctx.User, cmd.mailbox); err != nil {
+		return err
+	}
+
+	all, err := cmd.ext.store.Metadata(cmd.ext.ctx, ctx.User.Username(), cmd.mailbox)
+	if err != nil {
+		return err
+	}
+	if cmd.mailbox == "" {
+		server, err := cmd.ext.serverEntries(ctx.User.Username())
+		if err != nil {
+			return err
+		}
+		for entry, value := range server {
+			all[entry] = value
+		}
+	}
+
+	res := make(map[string]string)
+	longest := 0
+	for _, req := range cmd.entries {
+		for entry, value := range all {
+			if !matchEntry(req, entry, cmd.depth) {
+				continue
+			}
+			if cmd.maxSize >= 0 && len(value) > cmd.maxSize {
+				if len(value) > longest {
+					longest = len(value)
+				}
+				continue
+			}
+			res[entry] = value
+		}
+	}
+
+	if len(res) != 0 {
+		names := make([]string, 0, len(res))
+		for entry := range res {
+			names = append(names, entry)
+		}
+		sort.Strings(names)
+		list := make([]interface{}, 0, len(names)*2)
+		for _, entry := range names {
+			list = append(list, entry, res[entry])
+		}
+		resp := imap.NewUntaggedResp([]interface{}{imap.RawString("METADATA"), formatMailbox(cmd.mailbox), list})
+		if err := conn.WriteResp(resp); err != nil {
+			return err
+		}
+	}
+
+	if longest != 0 {
+		return metadataStatus(imap.StatusRespOk, "GETMETADATA completed",
+			imap.RawString("LONGENTRIES"), uint32(longest))
+	}
+	return nil
+}
+
+type setMetadata struct {
+	ext *metadataExtension
+
+	mailbox string
+	values  map[string]*string
+}
+
+func (cmd *setMetadata) Parse(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("mailbox name and list of entries are expected")
+	}
+	var err error
+	cmd.mailbox, err = parseMailbox(fields[0])
+	if err != nil {
+		return err
+	}
+	list, ok := fields[1].([]interface{})
+	if !ok || len(list) == 0 || len(list)%2 != 0 {
+		return errors.New("list of entry-value pairs is expected")
+	}
+
+	cmd.values = make(map[string]*string, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		entry, err := parseEntry(list[i])
+		if err != nil {
+			return err
+		}
+		if entry == "/private" || entry == "/shared" {
+			return errors.New("entry name is required after /private or /shared")
+		}
+		if list[i+1] == nil {
+			cmd.values[entry] = nil
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+		cmd.values[entry] = &value
+	}
+	return nil
+}
+
+func (cmd *setMetadata) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	if cmd.mailbox == "" {
+		for _, entry := range []string{adminEntry, addressesEntry} {
+			if _, ok := cmd.values[entry]; ok {
+				return errors.New("permission denied: " + entry + " is read-only")
+			}
+		}
+	}
+	if err := checkMailbox(ctx.User, cmd.mailbox); err != nil {
+		return err
+	}
+
+	err := cmd.ext.store.SetMetadata(cmd.ext.ctx, ctx.User.Username(), cmd.mailbox, cmd.values)
+	var tooLarge module.MetadataTooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return metadataStatus(imap.StatusRespNo, "Annotation value is too large",
+			imap.RawString("MAXSIZE"), uint32(tooLarge.MaxSize))
+	case errors.Is(err, module.ErrMetadataTooMany):
+		return metadataStatus(imap.StatusRespNo, "Too many annotations",
+			imap.RawString("TOOMANY"))
+	}
+	return err
+}
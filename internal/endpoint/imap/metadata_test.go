@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestGetMetadataParse(t *testing.T) {
+	test := func(fields []interface{}, expected getMetadata, fail bool) {
+		t.Helper()
+
+		var cmd getMetadata
+		err := cmd.Parse(fields)
+		if fail {
+			if err == nil {
+				t.Errorf("expected error for %v", fields)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", fields, err)
+			return
+		}
+		if !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("wrong result for %v:\nwant %+v\ngot  %+v", fields, expected, cmd)
+		}
+	}
+
+	test([]interface{}{"INBOX", "/private/Comment"}, getMetadata{
+		mailbox: "INBOX",
+		entries: []string{"/private/comment"},
+		maxSize: -1,
+	}, false)
+	test([]interface{}{[]interface{}{"MAXSIZE", "1024", "DEPTH", "infinity"}, "", []interface{}{"/shared", "/private"}}, getMetadata{
+		entries: []string{"/shared", "/private"},
+		maxSize: 1024,
+		depth:   -1,
+	}, false)
+	test([]interface{}{"inbox", "/private/a"}, getMetadata{
+		mailbox: "INBOX",
+		entries: []string{"/private/a"},
+		maxSize: -1,
+	}, false)
+	test([]interface{}{"INBOX", "/comment"}, getMetadata{}, true)
+	test([]interface{}{"INBOX", "/private/"}, getMetadata{}, true)
+	test([]interface{}{"INBOX", "/private//a"}, getMetadata{}, true)
+	test([]interface{}{[]interface{}{"DEPTH", "2"}, "INBOX", "/private"}, getMetadata{}, true)
+	test([]interface{}{"INBOX"}, getMetadata{}, true)
+}
+
+func TestMetadataMatchEntry(t *testing.T) {
+	cases := []struct {
+		req, entry string
+		depth      int
+		match      bool
+	}{
+		{"/private/a", "/private/a", 0, true},
+		{"/private/a", "/private/a/b", 0, false},
+		{"/private/a", "/private/a/b", 1, true},
+		{"/private/a", "/private/a/b/c", 1, false},
+		{"/private/a", "/private/a/b/c", -1, true},
+		{"/private/a", "/private/ab", -1, false},
+		{"/private", "/shared/a", -1, false},
+	}
+	for _, c := range cases {
+		if got := matchEntry(c.req, c.entry, c.depth); got != c.match {
+			t.Errorf("matchEntry(%q, %q, %d) = %v, want %v", c.req, c.entry, c.depth, got, c.match)
+		}
+	}
+}
+
+type multiTable struct {
+	testutils.Table
+	testutils.MultiTable
+}
+
+func TestMetadataServerEntries(t *testing.T) {
+	ext := &metadataExtension{
+		ctx:   context.Background(),
+		admin: "mailto:postmaster@example.org",
+		addresses: multiTable{MultiTable: testutils.MultiTable{M: map[string][]string{
+			"foxcpp@example.org": {"foxcpp@example.org", "fox@example.org", "example.com"},
+		}}},
+	}
+
+	entries, err := ext.serverEntries("foxcpp@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		adminEntry:     "mailto:postmaster@example.org",
+		addressesEntry: "foxcpp@example.org, fox@example.org, example.com",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("wrong entries:\nwant %v\ngot  %v", expected, entries)
+	}
+
+	entries, err = ext.serverEntries("unknown@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries[addressesEntry]; ok {
+		t.Errorf("unexpected %s for unknown account: %v", addressesEntry, entries)
+	}
+
+	ext.addresses = testutils.Table{Err: errors.New("lookup failed")}
+	if _, err := ext.serverEntries("foxcpp@example.org"); err == nil {
+		t.Error("expected lookup error to be returned")
+	}
+}
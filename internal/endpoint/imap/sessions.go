@@ -0,0 +1,60 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package imap
+
+import (
+	"net"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/internal/sessions"
+)
+
+// sessionUser wraps the storage account to report the mailbox opened by the
+// client to the sessions registry.
+type sessionUser struct {
+	imapbackend.User
+	remoteAddr net.Addr
+}
+
+func (endp *Endpoint) trackSession(u imapbackend.User, identity string, info *imap.ConnInfo) imapbackend.User {
+	if info == nil {
+		return u
+	}
+	sessions.SetUser(info.RemoteAddr, identity)
+	return &sessionUser{
+		User:       u,
+		remoteAddr: info.RemoteAddr,
+	}
+}
+
+func (u *sessionUser) CreateMessageLimit() *uint32 {
+	al, ok := u.User.(imapbackend.AppendLimitUser)
+	if !ok {
+		return nil
+	}
+	return al.CreateMessageLimit()
+}
+
+func (u *sessionUser) GetMailbox(name string, readOnly bool, conn imapbackend.Conn) (*imap.MailboxStatus, imapbackend.Mailbox, error) {
+	status, mbox, err := u.User.GetMailbox(name, readOnly, conn)
+	if err == nil && conn != nil {
+		sessions.SetMailbox(u.remoteAddr, name)
+	}
+	return status, mbox, err
+}
@@ -0,0 +1,91 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"io"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/sessions"
+)
+
+// unauthenticateExtension implements the UNAUTHENTICATE extension (RFC 8437)
+// that allows clients to return to the not authenticated state and log in as
+// another account without opening a new connection. It is used by webmail
+// backends and proxies that reuse connections.
+type unauthenticateExtension struct {
+	endp *Endpoint
+}
+
+func (unauthenticateExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"UNAUTHENTICATE"}
+	}
+	return nil
+}
+
+func (ext unauthenticateExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "UNAUTHENTICATE" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &unauthenticate{endp: ext.endp}
+	}
+}
+
+type unauthenticate struct {
+	endp *Endpoint
+}
+
+func (cmd *unauthenticate) Parse(fields []interface{}) error {
+	if len(fields) != 0 {
+		return errors.New("unexpected arguments")
+	}
+	return nil
+}
+
+func (cmd *unauthenticate) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if mbox, ok := ctx.Mailbox.(io.Closer); ok {
+		if err := mbox.Close(); err != nil {
+			cmd.endp.Log.Error("failed to close mailbox", err, "username", ctx.User.Username())
+		}
+	}
+	if err := ctx.User.Logout(); err != nil {
+		cmd.endp.Log.Error("logout failed", err, "username", ctx.User.Username())
+	}
+
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+	ctx.User = nil
+	ctx.State = imap.NotAuthenticatedState
+
+	if info := conn.Info(); info != nil {
+		cmd.endp.limits.logout(info.RemoteAddr)
+		sessions.SetUser(info.RemoteAddr, "")
+		sessions.SetMailbox(info.RemoteAddr, "")
+	}
+	return nil
+}
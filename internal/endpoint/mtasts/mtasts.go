@@ -0,0 +1,269 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mtasts implements the HTTPS endpoint serving MTA-STS policies
+// (RFC 8461) for local domains.
+package mtasts
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/vdomain"
+)
+
+const (
+	modName    = "mta_sts"
+	policyPath = "/.well-known/mta-sts.txt"
+)
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	// policies contains the policy served for each domain.
+	policies  map[string]policy
+	tlsConfig *tls.Config
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+type policy struct {
+	text []byte
+	// ID changes each time the policy is changed so senders will refetch
+	// it.
+	id string
+}
+
+func newPolicy(mode string, mxs []string, maxAge time.Duration) policy {
+	text := formatPolicy(mode, mxs, maxAge)
+	sum := sha1.Sum(text)
+	return policy{
+		text: text,
+		id:   hex.EncodeToString(sum[:10]),
+	}
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+// formatPolicy returns the policy text as defined in RFC 8461, Section 3.2.
+func formatPolicy(mode string, mxs []string, maxAge time.Duration) []byte {
+	var sb strings.Builder
+	sb.WriteString("version: STSv1\r\n")
+	sb.WriteString("mode: " + mode + "\r\n")
+	for _, mx := range mxs {
+		sb.WriteString("mx: " + mx + "\r\n")
+	}
+	sb.WriteString("max_age: " + strconv.FormatInt(int64(maxAge/time.Second), 10) + "\r\n")
+	return []byte(sb.String())
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var (
+		hostname       string
+		domains        []string
+		virtualDomains bool
+		mxs            []string
+		mode           string
+		maxAge         time.Duration
+	)
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("domains", false, false, nil, &domains)
+	cfg.Bool("virtual_domains", false, false, &virtualDomains)
+	cfg.StringList("mx", false, false, nil, &mxs)
+	cfg.Enum("mode", false, false, []string{"enforce", "testing", "none"}, "enforce", &mode)
+	cfg.Duration("max_age", false, false, 7*24*time.Hour, &maxAge)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(domains) == 0 && !virtualDomains {
+		return fmt.Errorf("%s: domains or virtual_domains should be set", modName)
+	}
+	if len(mxs) == 0 && hostname != "" {
+		mxs = []string{hostname}
+	}
+	if maxAge < time.Second || maxAge > 365*24*time.Hour {
+		return fmt.Errorf("%s: max_age should be between 1 second and 1 year", modName)
+	}
+
+	e.policies = make(map[string]policy, len(domains))
+	if len(domains) != 0 {
+		if len(mxs) == 0 {
+			return fmt.Errorf("%s: mx or hostname should be set", modName)
+		}
+		p := newPolicy(mode, mxs, maxAge)
+		for _, d := range domains {
+			d, err := dns.ForLookup(d)
+			if err != nil {
+				return fmt.Errorf("%s: malformed domain: %v", modName, err)
+			}
+			e.policies[d] = p
+		}
+	}
+	if virtualDomains {
+		for _, d := range vdomain.List() {
+			if d.MTASTSMode == "" {
+				continue
+			}
+			if _, ok := e.policies[d.Name]; ok {
+				return fmt.Errorf("%s: %s is both in domains and virtual_domains", modName, d.Name)
+			}
+			domainMXs := d.MTASTSMX
+			if len(domainMXs) == 0 {
+				domainMXs = mxs
+			}
+			if len(domainMXs) == 0 {
+				return fmt.Errorf("%s: %s: mta_sts_mx, mx or hostname should be set", modName, d.Name)
+			}
+			e.policies[d.Name] = newPolicy(d.MTASTSMode, domainMXs, maxAge)
+
+			if len(d.TLSRPTRUA) != 0 {
+				e.logger.Msg("TLS reporting is configured, make sure the DNS record is published",
+					"record", "_smtp._tls."+d.Name+". TXT \"v=TLSRPTv1; rua="+strings.Join(d.TLSRPTRUA, ",")+"\"")
+			}
+		}
+	}
+
+	for d, p := range e.policies {
+		e.logger.Msg("MTA-STS policy served, make sure the DNS record is published",
+			"record", "_mta-sts."+d+". TXT \"v=STSv1; id="+p.id+"\"",
+			"policy_host", "mta-sts."+d)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(policyPath, e.handlePolicy)
+	e.serv.Handler = mux
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if module.NoRun {
+			continue
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+// policyDomain returns the domain the policy is requested for based on the
+// Host header and the policy for it. ok is false if the domain is not served
+// by the endpoint.
+func (e *Endpoint) policyDomain(host string) (string, policy, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host, err := dns.ForLookup(host)
+	if err != nil {
+		return "", policy{}, false
+	}
+	if !strings.HasPrefix(host, "mta-sts.") {
+		return "", policy{}, false
+	}
+	domain := strings.TrimPrefix(host, "mta-sts.")
+	p, ok := e.policies[domain]
+	return domain, p, ok
+}
+
+func (e *Endpoint) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain, p, ok := e.policyDomain(r.Host)
+	if !ok {
+		e.logger.DebugMsg("policy requested for unknown domain", "host", r.Host, "src_ip", r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+	e.logger.DebugMsg("policy requested", "domain", domain, "src_ip", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.text)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(p.text)
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mtasts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/vdomain"
+)
+
+func testEndpoint(t *testing.T) *Endpoint {
+	t.Helper()
+
+	module.NoRun = true
+	defer func() { module.NoRun = false }()
+
+	mod, err := New(modName, []string{"tcp://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	e.logger = log.Logger{Name: modName, Out: log.NopOutput{}}
+	err = e.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"example.org", "Example.COM"}},
+			{Name: "mx", Args: []string{"mx1.example.org", "*.example.net"}},
+			{Name: "max_age", Args: []string{"24h"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestPolicy(t *testing.T) {
+	e := testEndpoint(t)
+
+	test := func(host string, code int, body string) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, policyPath, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		e.handlePolicy(rec, req)
+		if rec.Code != code {
+			t.Errorf("%s: expected status %d, got %d", host, code, rec.Code)
+			return
+		}
+		if code == http.StatusOK && rec.Body.String() != body {
+			t.Errorf("%s: wrong policy: %q", host, rec.Body.String())
+		}
+	}
+
+	policy := "version: STSv1\r\nmode: enforce\r\nmx: mx1.example.org\r\nmx: *.example.net\r\nmax_age: 86400\r\n"
+	test("mta-sts.example.org", http.StatusOK, policy)
+	test("mta-sts.example.org:443", http.StatusOK, policy)
+	test("MTA-STS.example.com", http.StatusOK, policy)
+	test("example.org", http.StatusNotFound, "")
+	test("mta-sts.example.net", http.StatusNotFound, "")
+}
+
+func TestFormatPolicy(t *testing.T) {
+	policy := string(formatPolicy("testing", []string{"mx.example.org"}, time.Hour))
+	if policy != "version: STSv1\r\nmode: testing\r\nmx: mx.example.org\r\nmax_age: 3600\r\n" {
+		t.Errorf("wrong policy: %q", policy)
+	}
+}
+
+func TestPolicy_VirtualDomains(t *testing.T) {
+	domains, err := vdomain.ParseBlock(config.Node{
+		Name: "virtual_domain",
+		Args: []string{"example.com"},
+		Children: []config.Node{
+			{Name: "mta_sts_mode", Args: []string{"testing"}},
+			{Name: "mta_sts_mx", Args: []string{"mx.example.com"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := vdomain.ParseBlock(config.Node{Name: "virtual_domain", Args: []string{"example.net"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vdomain.Set(append(domains, plain...)); err != nil {
+		t.Fatal(err)
+	}
+	defer vdomain.Set(nil)
+
+	module.NoRun = true
+	defer func() { module.NoRun = false }()
+
+	e := &Endpoint{logger: log.Logger{Name: modName, Out: log.NopOutput{}}}
+	err = e.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"example.org"}},
+			{Name: "mx", Args: []string{"mx.example.org"}},
+			{Name: "virtual_domains"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, p, ok := e.policyDomain("mta-sts.example.org"); !ok || string(p.text) != string(formatPolicy("enforce", []string{"mx.example.org"}, 7*24*time.Hour)) {
+		t.Errorf("wrong policy for example.org: %q", p.text)
+	}
+	if _, p, ok := e.policyDomain("mta-sts.example.com"); !ok || string(p.text) != string(formatPolicy("testing", []string{"mx.example.com"}, 7*24*time.Hour)) {
+		t.Errorf("wrong policy for example.com: %q", p.text)
+	}
+	if _, _, ok := e.policyDomain("mta-sts.example.net"); ok {
+		t.Error("policy served for the domain without mta_sts_mode")
+	}
+}
@@ -0,0 +1,317 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package passwd implements the HTTP endpoint allowing users to change their
+// own passwords.
+package passwd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/limits"
+)
+
+const (
+	modName    = "passwd"
+	changePath = "/password"
+
+	// Limit for the request body, passwords are not expected to be long.
+	maxRequestSize = 16 * 1024
+
+	// maxTrackedIPs is the maximum amount of IPs failed attempts are
+	// counted for. Counters are reset once it is reached to bound the
+	// memory usage.
+	maxTrackedIPs = 20010
+)
+
+// PasswordChanger is implemented by credentials stores that allow users to
+// change their own passwords, such as auth.pass_table.
+type PasswordChanger interface {
+	ChangePassword(ctx context.Context, username, oldPassword, newPassword string) error
+}
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	creds        PasswordChanger
+	tlsConfig    *tls.Config
+	insecureAuth bool
+
+	limits          *limits.Group
+	maxAuthFailures int
+	errBlockTime    time.Duration
+
+	failuresLock sync.Mutex
+	failures     map[string]int
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+type changeRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
+
+type changeResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.Custom("auth", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var creds PasswordChanger
+		err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &creds)
+		return creds, err
+	}, &e.creds)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Bool("insecure_auth", false, false, &e.insecureAuth)
+	cfg.Int("max_auth_failures", false, false, 5, &e.maxAuthFailures)
+	cfg.Duration("error_block_time", false, false, 15*time.Minute, &e.errBlockTime)
+	cfg.Custom("limits", false, false, func() (interface{}, error) {
+		return &limits.Group{}, nil
+	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
+		var g *limits.Group
+		if err := modconfig.GroupFromNode("limits", n.Args, n, cfg.Globals, &g); err != nil {
+			return nil, err
+		}
+		return g, nil
+	}, &e.limits)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(changePath, e.handleChange)
+	e.serv.Handler = mux
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if !endp.IsTLS() && !e.insecureAuth {
+			return fmt.Errorf("%s: passwords can't be accepted over plain-text endpoint %s, use TLS or set insecure_auth", modName, a)
+		}
+		if module.NoRun {
+			continue
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func (e *Endpoint) readRequest(r *http.Request) (changeRequest, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxRequestSize)
+
+	var req changeRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, err
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(maxRequestSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return req, err
+		}
+		req.Username = r.PostFormValue("username")
+		req.Password = r.PostFormValue("password")
+		req.NewPassword = r.PostFormValue("new_password")
+	default:
+		return req, fmt.Errorf("unsupported content type: %s", mediaType)
+	}
+
+	if req.Username == "" || req.Password == "" || req.NewPassword == "" {
+		return req, errors.New("username, password and new_password are required")
+	}
+	return req, nil
+}
+
+func (e *Endpoint) reply(w http.ResponseWriter, status int, errMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(changeResponse{Error: errMsg}); err != nil {
+		e.logger.Error("response write failed", err)
+	}
+}
+
+func (e *Endpoint) handleChange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	srcAddr := remoteAddr(r)
+	var auditAddr net.Addr
+	if srcAddr != nil {
+		auditAddr = srcAddr
+	}
+	if srcAddr != nil && e.limits != nil && e.limits.IPBlocked(srcAddr.IP) {
+		e.logger.Msg("rejecting blocked IP", "src_ip", srcAddr.IP)
+		e.reply(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+		return
+	}
+
+	req, err := e.readRequest(r)
+	if err != nil {
+		e.reply(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = e.creds.ChangePassword(r.Context(), req.Username, req.Password, req.NewPassword)
+	if err != nil {
+		var policyErr pass_table.PolicyError
+		if errors.As(err, &policyErr) {
+			// The current password was accepted, only the new one was not.
+			audit.Auth(modName, "password", req.Username, auditAddr, nil)
+			e.authSucceeded(srcAddr)
+			e.logger.Msg("password change rejected by policy", "username", req.Username, "reason", policyErr.Reason, "src_ip", r.RemoteAddr)
+			e.reply(w, http.StatusBadRequest, policyErr.Error())
+			return
+		}
+
+		audit.Auth(modName, "password", req.Username, auditAddr, err)
+		e.authFailed(srcAddr)
+		e.logger.Error("password change failed", err, "username", req.Username, "src_ip", r.RemoteAddr)
+		e.reply(w, http.StatusForbidden, "authentication failed")
+		return
+	}
+
+	audit.Auth(modName, "password", req.Username, auditAddr, nil)
+	e.authSucceeded(srcAddr)
+	e.logger.Msg("password changed", "username", req.Username, "src_ip", r.RemoteAddr)
+	e.reply(w, http.StatusOK, "")
+}
+
+// remoteAddr returns the client address of the request or nil if it can't
+// be parsed.
+func remoteAddr(r *http.Request) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	portNum, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ip, Port: portNum}
+}
+
+// authFailed counts the failed attempt for the client IP and blocks it
+// using the limits group once max_auth_failures is reached.
+func (e *Endpoint) authFailed(addr *net.TCPAddr) {
+	if addr == nil || e.limits == nil || e.maxAuthFailures <= 0 || e.errBlockTime == 0 {
+		return
+	}
+
+	e.failuresLock.Lock()
+	if e.failures == nil || len(e.failures) >= maxTrackedIPs {
+		e.failures = make(map[string]int)
+	}
+	key := addr.IP.String()
+	e.failures[key]++
+	block := e.failures[key] >= e.maxAuthFailures
+	if block {
+		delete(e.failures, key)
+	}
+	e.failuresLock.Unlock()
+
+	if block {
+		e.logger.Msg("blocking IP", "src_ip", addr.IP, "duration", e.errBlockTime)
+		e.limits.BlockIP(addr.IP, e.errBlockTime)
+	}
+}
+
+// authSucceeded resets the failed attempts counter for the client IP.
+func (e *Endpoint) authSucceeded(addr *net.TCPAddr) {
+	if addr == nil {
+		return
+	}
+	e.failuresLock.Lock()
+	delete(e.failures, addr.IP.String())
+	e.failuresLock.Unlock()
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package passwd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/audit"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/limits"
+)
+
+type mockCreds struct {
+	passwords map[string]string
+	policy    pass_table.Policy
+}
+
+func (m *mockCreds) ChangePassword(_ context.Context, username, oldPassword, newPassword string) error {
+	if m.passwords[username] != oldPassword {
+		return errors.New("hash mismatch")
+	}
+	if err := m.policy.Check(username, newPassword); err != nil {
+		return err
+	}
+	m.passwords[username] = newPassword
+	return nil
+}
+
+func testEndpoint() (*Endpoint, *mockCreds) {
+	creds := &mockCreds{
+		passwords: map[string]string{"foxcpp@example.org": "old"},
+		policy:    pass_table.Policy{MinLength: 8},
+	}
+	return &Endpoint{
+		logger:          log.Logger{Name: modName, Out: log.NopOutput{}},
+		creds:           creds,
+		limits:          &limits.Group{},
+		maxAuthFailures: 3,
+		errBlockTime:    time.Minute,
+	}, creds
+}
+
+func TestHandleChange_JSON(t *testing.T) {
+	e, creds := testEndpoint()
+
+	test := func(body string, expectedStatus int) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodPost, changePath, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.handleChange(rec, req)
+		if rec.Code != expectedStatus {
+			t.Errorf("%s: expected %d, got %d %s", body, expectedStatus, rec.Code, rec.Body.String())
+		}
+	}
+
+	test(`{"username":"foxcpp@example.org","password":"wrong","new_password":"long-password"}`, http.StatusForbidden)
+	test(`{"username":"foxcpp@example.org","password":"old","new_password":"short"}`, http.StatusBadRequest)
+	test(`{"username":"foxcpp@example.org","password":"old"}`, http.StatusBadRequest)
+	test(`{"username":"foxcpp@example.org","password":"old","new_password":"long-password"}`, http.StatusOK)
+
+	if creds.passwords["foxcpp@example.org"] != "long-password" {
+		t.Error("password was not changed")
+	}
+}
+
+func TestHandleChange_Form(t *testing.T) {
+	e, creds := testEndpoint()
+
+	form := url.Values{
+		"username":     {"foxcpp@example.org"},
+		"password":     {"old"},
+		"new_password": {"long-password"},
+	}
+	req := httptest.NewRequest(http.MethodPost, changePath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	e.handleChange(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if creds.passwords["foxcpp@example.org"] != "long-password" {
+		t.Error("password was not changed")
+	}
+
+	rec = httptest.NewRecorder()
+	e.handleChange(rec, httptest.NewRequest(http.MethodGet, changePath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for GET: %d", rec.Code)
+	}
+}
+
+type authObserver struct {
+	failures, successes int
+}
+
+func (o *authObserver) AuthAttempt(endpoint string, _ net.Addr, err error) {
+	if endpoint != modName {
+		return
+	}
+	if err != nil {
+		o.failures++
+	} else {
+		o.successes++
+	}
+}
+
+func TestHandleChange_BlockAfterFailures(t *testing.T) {
+	e, _ := testEndpoint()
+
+	obs := &authObserver{}
+	audit.AddAuthObserver(obs)
+	defer audit.RemoveAuthObserver(obs)
+
+	test := func(remoteAddr, password string, expectedStatus int) {
+		t.Helper()
+
+		body := `{"username":"foxcpp@example.org","password":"` + password + `","new_password":"long-password"}`
+		req := httptest.NewRequest(http.MethodPost, changePath, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		e.handleChange(rec, req)
+		if rec.Code != expectedStatus {
+			t.Errorf("%s %s: expected %d, got %d %s", remoteAddr, password, expectedStatus, rec.Code, rec.Body.String())
+		}
+	}
+
+	test("192.0.2.1:1234", "wrong", http.StatusForbidden)
+	test("192.0.2.1:1234", "wrong", http.StatusForbidden)
+	test("192.0.2.1:1234", "wrong", http.StatusForbidden)
+	// Blocked now, even the correct password is not checked.
+	test("192.0.2.1:1234", "old", http.StatusTooManyRequests)
+
+	// Other clients are not affected.
+	test("192.0.2.2:1234", "wrong", http.StatusForbidden)
+	test("192.0.2.2:1234", "old", http.StatusOK)
+
+	if obs.failures != 4 {
+		t.Errorf("expected 4 failures reported, got %d", obs.failures)
+	}
+	if obs.successes != 1 {
+		t.Errorf("expected 1 success reported, got %d", obs.successes)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+)
+
+// bannerListener wraps accepted connections to replace the text of the
+// greeting sent by go-smtp with the configured one.
+type bannerListener struct {
+	net.Listener
+	domain   string
+	template string
+}
+
+func (l *bannerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &bannerConn{
+		Conn:   c,
+		banner: expandBanner(l.template, l.domain, c.LocalAddr(), c.RemoteAddr()),
+	}, nil
+}
+
+// expandBanner returns the greeting line with placeholders in the template
+// replaced by the connection details. Hostname is always the first word of
+// the greeting as required by RFC 5321.
+func expandBanner(template, domain string, localAddr, remoteAddr net.Addr) []byte {
+	var localIP, remoteIP string
+	if tcpAddr, ok := localAddr.(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP.String()
+	}
+	if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+		remoteIP = tcpAddr.IP.String()
+	}
+
+	text := strings.NewReplacer(
+		"{hostname}", domain,
+		"{local_ip}", localIP,
+		"{remote_ip}", remoteIP,
+		"\r", "",
+		"\n", "",
+	).Replace(template)
+	return []byte("220 " + domain + " " + text + "\r\n")
+}
+
+type bannerConn struct {
+	net.Conn
+	banner []byte
+
+	once sync.Once
+}
+
+func (c *bannerConn) Write(b []byte) (int, error) {
+	replaced := false
+	c.once.Do(func() {
+		replaced = bytes.HasPrefix(b, []byte("220 "))
+	})
+	if !replaced {
+		return c.Conn.Write(b)
+	}
+
+	if _, err := c.Conn.Write(c.banner); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,54 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestBannerConn(t *testing.T) {
+	srv, cl := net.Pipe()
+	defer cl.Close()
+
+	c := &bannerConn{
+		Conn: srv,
+		banner: expandBanner("ESMTP {hostname} at {remote_ip}\r\n", "mx.example.org",
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25},
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}),
+	}
+
+	go func() {
+		greeting := []byte("220 mx.example.org ESMTP Service Ready\r\n")
+		if n, err := c.Write(greeting); err != nil || n != len(greeting) {
+			t.Errorf("Write returned %v, %v", n, err)
+		}
+		_, _ = c.Write([]byte("250 OK\r\n"))
+		c.Close()
+	}()
+
+	out, err := io.ReadAll(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "220 mx.example.org ESMTP mx.example.org at 192.0.2.2\r\n250 OK\r\n"
+	if string(out) != expected {
+		t.Errorf("wrong output: %q, expected %q", out, expected)
+	}
+}
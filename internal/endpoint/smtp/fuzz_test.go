@@ -0,0 +1,67 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// FuzzSMTPSession feeds arbitrary client input to the endpoint and makes
+// sure the server does not panic or hang processing it.
+func FuzzSMTPSession(f *testing.F) {
+	testutils.AddSeeds(f,
+		"EHLO mx.example.org\r\nMAIL FROM:<sender@example.org>\r\nRCPT TO:<rcpt@example.com>\r\nDATA\r\n"+testMsg+".\r\nQUIT\r\n",
+		"HELO x\r\nMAIL FROM:<> SIZE=100 BODY=8BITMIME\r\nRCPT TO:<postmaster>\r\nRSET\r\nQUIT\r\n",
+		"EHLO x\r\nMAIL FROM:<тест@пример.рф> SMTPUTF8\r\nRCPT TO:<\"quoted @ local\"@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;a@b\r\n",
+		"EHLO x\r\nMAIL FROM:<a@b> RET=HDRS ENVID=QQ314159\r\nBDAT 10 LAST\r\n0123456789",
+		"EHLO x\r\nAUTH PLAIN AHRlc3QAdGVzdA==\r\n",
+		"EHLO x\r\nMAIL FROM:<a@b>\r\nRCPT TO:<c@d>\r\nDATA\r\nReceived: x\r\nReceived: y\r\n\r\n.\r\n",
+		"MAIL FROM:\r\nRCPT TO:\r\nDATA\r\n",
+		"EHLO x\r\nSTARTTLS\r\nVRFY postmaster\r\nNOOP\r\n",
+	)
+
+	f.Fuzz(func(t *testing.T, input string) {
+		tgt := testutils.Target{DiscardMessages: true}
+		endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+		defer endp.Close()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// The read deadline is not a failure since the server is expected to
+		// wait for more data for some inputs (e.g. inside DATA).
+		testutils.NoHang(t, 10*time.Second, func() {
+			conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+			go func() {
+				io.WriteString(conn, input)          //nolint:errcheck
+				io.WriteString(conn, "\r\nQUIT\r\n") //nolint:errcheck
+			}()
+			io.Copy(io.Discard, conn) //nolint:errcheck
+		})
+	})
+}
@@ -67,6 +67,15 @@ var (
 		},
 		[]string{"module"},
 	)
+	plaintextSessions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp",
+			Name:      "plaintext_sessions",
+			Help:      "Sessions that started a transaction without TLS while it was offered",
+		},
+		[]string{"module"},
+	)
 	failedCmds = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "maddy",
@@ -84,4 +93,5 @@ func init() {
 	prometheus.MustRegister(abortedSMTPTransactions)
 	prometheus.MustRegister(ratelimitDefers)
 	prometheus.MustRegister(failedCmds)
+	prometheus.MustRegister(plaintextSessions)
 }
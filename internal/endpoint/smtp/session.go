@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"runtime/trace"
 	"strconv"
@@ -38,6 +39,9 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
+	"github.com/foxcpp/maddy/internal/sessions"
+	"github.com/foxcpp/maddy/internal/tracing"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -72,21 +76,31 @@ type Session struct {
 	endp *Endpoint
 
 	// Specific for this session.
-	// sessionCtx is not used for cancellation or timeouts, only for tracing.
+	// sessionCtx is cancelled when the client disconnects or the endpoint
+	// is closed.
 	sessionCtx       context.Context
+	cancelSession    context.CancelFunc
 	cancelRDNS       func()
 	connState        module.ConnState
 	repeatedMailErrs int
 	loggedRcptErrors int
+	errCount         int
+	rcptRejects      int
+	earlyTalker      bool
+	plaintextLogged  bool
+
+	// conn is the underlying connection, used to drop misbehaving clients.
+	conn net.Conn
 
 	// Specific for the currently handled message.
-	// msgCtx is not used for cancellation or timeouts, only for tracing.
-	// It is the subcontext of sessionCtx.
+	// msgCtx is the subcontext of sessionCtx. Per-command timeouts are
+	// applied to contexts derived from it, not msgCtx itself.
 	// Mutex is used to prevent Close from accessing inconsistent state when it
 	// is called asynchronously to any SMTP command.
 	msgLock     sync.Mutex
 	msgCtx      context.Context
 	msgTask     *trace.Task
+	msgSpan     *tracing.Span
 	mailFrom    string
 	opts        smtp.MailOptions
 	msgMeta     *module.MsgMetadata
@@ -128,6 +142,7 @@ func (s *Session) abort(ctx context.Context) {
 		s.endp.Log.Error("delivery abort failed", err)
 	}
 	s.log.Msg("aborted", "msg_id", s.msgMeta.ID)
+	s.msgSpan.SetAttrs("smtp.aborted", true)
 	abortedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
 	s.cleanSession()
 }
@@ -142,24 +157,36 @@ func (s *Session) cleanSession() {
 	s.deliveryErr = nil
 	s.msgCtx = nil
 	s.msgTask.End()
+	s.msgSpan.End()
+	s.msgSpan = nil
 }
 
 func (s *Session) AuthPlain(username, password string) error {
+	return s.authPlain("", username, password)
+}
+
+// authPlain authenticates the client using the PLAIN mechanism. authzid is
+// the requested authorization identity, empty if not specified.
+func (s *Session) authPlain(authzid, username, password string) error {
 	if s.endp.serv.AuthDisabled {
 		return smtp.ErrAuthUnsupported
 	}
 
+	ctx, cancel := s.commandCtx(s.sessionCtx)
+	defer cancel()
+
 	// Executed before authentication and session initialization.
-	if err := s.endp.pipeline.RunEarlyChecks(context.TODO(), &s.connState); err != nil {
-		return s.endp.wrapErr("", true, "AUTH", err)
+	if err := s.endp.pipeline.RunEarlyChecks(ctx, &s.connState); err != nil {
+		return s.wrapErr("", true, "AUTH", err)
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	identity, err := s.endp.saslAuth.Authenticate(ctx, "PLAIN", s.connState.RemoteAddr, authzid, username, password)
 	if err != nil {
 		s.endp.Log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
 
 		failedLogins.WithLabelValues(s.endp.name).Inc()
+		s.tarpit()
 
 		if exterrors.IsTemporary(err) {
 			return &smtp.SMTPError{
@@ -176,18 +203,47 @@ func (s *Session) AuthPlain(username, password string) error {
 		}
 	}
 
-	s.connState.AuthUser = username
-	s.connState.AuthPassword = password
+	s.connState.AuthUser = identity
+	// Credentials of the master user are not usable for the impersonated
+	// account.
+	if identity == username {
+		s.connState.AuthPassword = password
+	}
+	sessions.SetUser(s.connState.RemoteAddr, identity)
 
 	return nil
 }
 
+// commandCtx returns the context for processing of a single SMTP command. It
+// is cancelled after command_timeout so hung checks or targets can't block
+// the session forever.
+func (s *Session) commandCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.endp.commandTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.endp.commandTimeout)
+}
+
+// dataCtx returns the context for processing of the received message body.
+// It uses data_timeout if it is set and command_timeout otherwise.
+func (s *Session) dataCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.endp.dataTimeout <= 0 {
+		return s.commandCtx(ctx)
+	}
+	return context.WithTimeout(ctx, s.endp.dataTimeout)
+}
+
 func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.MailOptions) (string, error) {
 	var err error
 	msgMeta := &module.MsgMetadata{
 		Conn:     &s.connState,
 		SMTPOpts: opts,
 	}
+	if s.earlyTalker {
+		msgMeta.Annotations = module.NewAnnotations()
+		msgMeta.Annotations.SetBool("smtp.early_talker", true)
+		msgMeta.Quarantine = s.endp.earlyTalkerAction == earlyTalkerQuarantine
+	}
 	msgMeta.ID, err = module.GenerateMsgID()
 	if err != nil {
 		return "", err
@@ -250,17 +306,29 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if !ok {
 		remoteIP = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 	}
-	if err := s.endp.limits.TakeMsg(context.Background(), remoteIP.IP, domain); err != nil {
+	if err := s.endp.limits.TakeMsg(ctx, remoteIP.IP, domain); err != nil {
 		return "", err
 	}
 
 	s.msgCtx, s.msgTask = trace.NewTask(ctx, "Incoming Message")
+	var msgSpan *tracing.Span
+	s.msgCtx, msgSpan = tracing.StartMessage(s.msgCtx, msgMeta.ID, "smtp.message",
+		"maddy.endpoint", s.endp.name,
+		"net.peer.ip", remoteIP.IP.String(),
+		"smtp.mail_from", cleanFrom)
 
 	mailCtx, mailTask := trace.NewTask(s.msgCtx, "MAIL FROM")
 	defer mailTask.End()
+	mailCtx, mailSpan := tracing.Start(mailCtx, "smtp.mail")
+	defer mailSpan.End()
+	mailCtx, cancelMail := s.commandCtx(mailCtx)
+	defer cancelMail()
 
 	delivery, err := s.endp.pipeline.Start(mailCtx, msgMeta, cleanFrom)
 	if err != nil {
+		mailSpan.SetError(err)
+		msgSpan.SetError(err)
+		msgSpan.End()
 		s.msgCtx = nil
 		s.msgTask.End()
 		s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
@@ -270,6 +338,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	startedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
 
 	s.msgMeta = msgMeta
+	s.msgSpan = msgSpan
 	s.mailFrom = cleanFrom
 	s.delivery = delivery
 
@@ -277,9 +346,28 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.endp.tlsRequired && !s.connState.TLS.HandshakeComplete {
+		return &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Must issue a STARTTLS command first",
+		}
+	}
 	if s.endp.authAlwaysRequired && s.connState.AuthUser == "" {
 		return smtp.ErrAuthRequired
 	}
+	if s.endp.maxMessageBytes > 0 && opts.Size > s.endp.maxMessageBytes {
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Message size exceeds limit",
+		}
+	}
+	if !s.plaintextLogged && !s.endp.lmtp && s.endp.serv.TLSConfig != nil && !s.connState.TLS.HandshakeComplete {
+		s.plaintextLogged = true
+		plaintextSessions.WithLabelValues(s.endp.name).Inc()
+		audit.InboundPlaintext(s.endp.name, s.connState.RemoteAddr, s.connState.Hostname)
+	}
 
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
@@ -291,7 +379,7 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 			if !errors.Is(err, context.DeadlineExceeded) {
 				s.log.Error("MAIL FROM error", err, "msg_id", msgID)
 			}
-			return s.endp.wrapErr(msgID, !opts.UTF8, "MAIL", err)
+			return s.wrapErr(msgID, !opts.UTF8, "MAIL", err)
 		}
 	}
 
@@ -345,6 +433,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 		// fail again.
 		if s.deliveryErr != nil {
 			s.repeatedMailErrs++
+			s.tarpit()
 			// The deliveryErr is already wrapped.
 			return s.deliveryErr
 		}
@@ -355,15 +444,20 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 			if !errors.Is(err, context.DeadlineExceeded) {
 				s.log.Error("MAIL FROM error (deferred)", err, "rcpt", to, "msg_id", msgID)
 			}
-			s.deliveryErr = s.endp.wrapErr(msgID, !s.opts.UTF8, "RCPT", err)
+			s.deliveryErr = s.wrapErr(msgID, !s.opts.UTF8, "RCPT", err)
 			return s.deliveryErr
 		}
 	}
 
 	rcptCtx, rcptTask := trace.NewTask(s.msgCtx, "RCPT TO")
 	defer rcptTask.End()
+	rcptCtx, rcptSpan := tracing.Start(rcptCtx, "smtp.rcpt", "smtp.rcpt_to", to)
+	defer rcptSpan.End()
+	rcptCtx, cancelRcpt := s.commandCtx(rcptCtx)
+	defer cancelRcpt()
 
 	if err := s.rcpt(rcptCtx, to, opts); err != nil {
+		rcptSpan.SetError(err)
 		if s.loggedRcptErrors < s.endp.maxLoggedRcptErrors {
 			s.log.Error("RCPT error", err, "rcpt", to, "msg_id", s.msgMeta.ID)
 			s.loggedRcptErrors++
@@ -371,7 +465,9 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 				s.log.Msg("too many RCPT errors, possible dictonary attack", "src_ip", s.connState.RemoteAddr, "msg_id", s.msgMeta.ID)
 			}
 		}
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
+		err = s.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
+		s.rcptRejected()
+		return err
 	}
 	s.endp.Log.Msg("RCPT ok", "rcpt", to, "msg_id", s.msgMeta.ID)
 	return nil
@@ -413,14 +509,39 @@ func (s *Session) Logout() error {
 	if s.cancelRDNS != nil {
 		s.cancelRDNS()
 	}
+	s.cancelSession()
 
 	s.endp.sessionCnt.Add(-1)
 
 	return nil
 }
 
-func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, error) {
-	limitr := limitReader(r, int64(s.endp.maxHeaderBytes), &exterrors.SMTPError{
+// prepareBody reads the message header, runs header-only checks and then
+// buffers the body.
+//
+// The size limit is enforced while reading so oversized messages are
+// rejected without buffering them fully. If the delivery is rejected
+// based on the header, the body is not buffered at all. For BDAT, go-smtp
+// returns the error for the current chunk right away.
+func (s *Session) prepareBody(ctx context.Context, r io.Reader) (textproto.Header, buffer.Buffer, error) {
+	sizeErr := &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+		Message:      "Message size exceeds limit",
+	}
+	// go-smtp enforces max_message_size too (with one byte of slack, see
+	// setConfig), but its error is lost if it is returned while the body is
+	// buffered.
+	maxSize := s.endp.maxMessageBytes
+	if maxSize <= 0 {
+		maxSize = math.MaxInt64 - 1
+	}
+	// Allow one byte above the limit so the message of exactly maxSize bytes
+	// can be read until EOF. Reading the extra byte means the limit is
+	// exceeded.
+	sizer := limitReader(r, maxSize+1, sizeErr)
+
+	limitr := limitReader(sizer, int64(s.endp.maxHeaderBytes), &exterrors.SMTPError{
 		Code:         552,
 		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
 		Message:      "Message header size exceeds limit",
@@ -439,13 +560,46 @@ func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, err
 		}
 	}
 
-	// the header size check is done. The message size will be checked by go-smtp
+	// the header size check is done.
 	limitr.Enabled = false
 
+	if err := s.checkRoutingLoops(header); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	if strings.EqualFold(header.Get("TLS-Required"), "No") {
+		s.msgMeta.TLSRequireOverride = true
+	}
+
+	if sd, ok := s.delivery.(module.StreamingDelivery); ok {
+		hdrCtx, cancelHdr := s.dataCtx(ctx)
+		err := sd.Header(hdrCtx, header)
+		cancelHdr()
+		if err != nil {
+			return textproto.Header{}, nil, err
+		}
+
+		if limit := sd.MaxMessageSize(); limit > 0 && limit < maxSize {
+			// Bytes that are already read count against the new limit.
+			read := maxSize + 1 - sizer.N
+			sizer.N = limit + 1 - read
+		}
+	}
+
 	buf, err := s.endp.buffer(bufr)
 	if err != nil {
+		if sizer.N <= 0 {
+			return textproto.Header{}, nil, sizeErr
+		}
 		return textproto.Header{}, nil, fmt.Errorf("I/O error while writing buffer: %w", err)
 	}
+	// The extra byte might be returned together with io.EOF.
+	if sizer.N <= 0 {
+		if err := buf.Remove(); err != nil {
+			s.log.Error("failed to remove buffered body", err)
+		}
+		return textproto.Header{}, nil, sizeErr
+	}
 
 	return header, buf, nil
 }
@@ -456,13 +610,17 @@ func (s *Session) Data(r io.Reader) error {
 
 	bodyCtx, bodyTask := trace.NewTask(s.msgCtx, "DATA")
 	defer bodyTask.End()
+	bodyCtx, bodySpan := tracing.Start(bodyCtx, "smtp.data")
+	defer bodySpan.End()
 
 	wrapErr := func(err error) error {
+		bodySpan.SetError(err)
+		s.msgSpan.SetError(err)
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
+		return s.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
-	header, buf, err := s.prepareBody(r)
+	header, buf, err := s.prepareBody(bodyCtx, r)
 	if err != nil {
 		return wrapErr(err)
 	}
@@ -475,13 +633,10 @@ func (s *Session) Data(r io.Reader) error {
 		s.cleanSession()
 	}()
 
-	if err := s.checkRoutingLoops(header); err != nil {
-		return wrapErr(err)
-	}
-
-	if strings.EqualFold(header.Get("TLS-Required"), "No") {
-		s.msgMeta.TLSRequireOverride = true
-	}
+	// Time spent receiving the body is limited by read_timeout, the timeout
+	// applies only to the processing.
+	bodyCtx, cancelBody := s.dataCtx(bodyCtx)
+	defer cancelBody()
 
 	if err := s.delivery.Body(bodyCtx, header, buf); err != nil {
 		return wrapErr(err)
@@ -493,6 +648,10 @@ func (s *Session) Data(r io.Reader) error {
 
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
 
+	if s.endp.sentCopyStore != nil {
+		s.storeSentCopy(bodyCtx, header, buf)
+	}
+
 	return nil
 }
 
@@ -511,13 +670,17 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 
 	bodyCtx, bodyTask := trace.NewTask(s.msgCtx, "DATA")
 	defer bodyTask.End()
+	bodyCtx, bodySpan := tracing.Start(bodyCtx, "smtp.data")
+	defer bodySpan.End()
 
 	wrapErr := func(err error) error {
+		bodySpan.SetError(err)
+		s.msgSpan.SetError(err)
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
+		return s.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
-	header, buf, err := s.prepareBody(r)
+	header, buf, err := s.prepareBody(bodyCtx, r)
 	if err != nil {
 		return wrapErr(err)
 	}
@@ -530,13 +693,10 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		s.cleanSession()
 	}()
 
-	if strings.EqualFold(header.Get("TLS-Required"), "No") {
-		s.msgMeta.TLSRequireOverride = true
-	}
-
-	if err := s.checkRoutingLoops(header); err != nil {
-		return wrapErr(err)
-	}
+	// Time spent receiving the body is limited by read_timeout, the timeout
+	// applies only to the processing.
+	bodyCtx, cancelBody := s.dataCtx(bodyCtx)
+	defer cancelBody()
 
 	s.delivery.(module.PartialDelivery).BodyNonAtomic(bodyCtx, statusWrapper{sc, s}, header, buf)
 
@@ -571,6 +731,22 @@ func (s *Session) checkRoutingLoops(header textproto.Header) error {
 	return nil
 }
 
+// expandReply replaces placeholders in the error message. Message ID is not
+// appended if the message already includes it.
+func (endp *Endpoint) expandReply(msg, msgId string, fields map[string]interface{}) string {
+	check, _ := fields["check"].(string)
+	hasMsgId := strings.Contains(msg, "{msg_id}")
+	msg = strings.NewReplacer(
+		"{msg_id}", msgId,
+		"{support_url}", endp.supportURL,
+		"{check}", check,
+	).Replace(msg)
+	if msgId != "" && !hasMsgId {
+		msg += " (msg ID = " + msgId + ")"
+	}
+	return msg
+}
+
 func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err error) error {
 	if err == nil {
 		return nil
@@ -583,6 +759,13 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 			Message:      "High load, try again later",
 		}
 	}
+	if errors.Is(err, context.Canceled) {
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+			Message:      "Service shutting down, try again later",
+		}
+	}
 
 	res := &smtp.SMTPError{
 		Code:         554,
@@ -618,7 +801,9 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 		res.Message = smtpErr.Message
 	}
 
-	if msgId != "" {
+	if strings.Contains(res.Message, "{") {
+		res.Message = endp.expandReply(res.Message, msgId, ctxInfo)
+	} else if msgId != "" {
 		res.Message += " (msg ID = " + msgId + ")"
 	}
 
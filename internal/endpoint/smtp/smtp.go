@@ -19,7 +19,6 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -47,6 +46,8 @@ import (
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/sessions"
+	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
 )
 
@@ -63,19 +64,52 @@ type Endpoint struct {
 	buffer func(r io.Reader) (buffer.Buffer, error)
 
 	authAlwaysRequired  bool
+	tlsRequired         bool
 	submission          bool
+	receivedOpts        target.ReceivedOptions
 	lmtp                bool
 	deferServerReject   bool
 	maxLoggedRcptErrors int
 	maxReceived         int
+	maxMessageBytes     int64
 	maxHeaderBytes      int64
+	commandTimeout      time.Duration
+	dataTimeout         time.Duration
+
+	bannerDelay       time.Duration
+	banner            string
+	earlyTalkerAction string
+	errDelay          time.Duration
+	errDelayAfter     int
+	errDelayMax       time.Duration
+	maxProtoErrs      int
+	maxRcptRejects    int
+	errBlockTime      time.Duration
+
+	// supportURL is substituted for the {support_url} placeholder in
+	// error messages.
+	supportURL string
 
 	sessionCnt atomic.Int32
 
 	authNormalize authz.NormalizeFunc
 	authMap       module.Table
 
+	// sentCopyStore is the storage to save copies of submitted messages
+	// to, nil if disabled.
+	sentCopyStore     module.Storage
+	sentCopyMailbox   string
+	sentCopyMap       module.Table
+	sentCopyNormalize authz.NormalizeFunc
+
 	listenersWg sync.WaitGroup
+	// servingCnt is the amount of listeners that are still being served.
+	servingCnt atomic.Int32
+
+	// shutdownCtx is cancelled when the endpoint is closed. Contexts of all
+	// sessions are derived from it.
+	shutdownCtx context.Context
+	shutdown    context.CancelFunc
 
 	Log log.Logger
 }
@@ -98,9 +132,11 @@ func New(modName string, addrs []string) (module.Module, error) {
 		buffer:     buffer.BufferInMemory,
 		Log:        log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Endpoint: modName,
 		},
 	}
+	endp.shutdownCtx, endp.shutdown = context.WithCancel(context.Background())
 	return endp, nil
 }
 
@@ -154,33 +190,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 func autoBufferMode(maxSize int, dir string) func(io.Reader) (buffer.Buffer, error) {
 	return func(r io.Reader) (buffer.Buffer, error) {
-		// First try to read up to N bytes.
-		initial := make([]byte, maxSize)
-		actualSize, err := io.ReadFull(r, initial)
-		if err != nil {
-			if err == io.ErrUnexpectedEOF {
-				log.Debugln("autobuffer: keeping the message in RAM (read", actualSize, "bytes, got EOF)")
-				return buffer.MemoryBuffer{Slice: initial[:actualSize]}, nil
-			}
-			if err == io.EOF {
-				// Special case: message with empty body.
-				return buffer.MemoryBuffer{}, nil
-			}
-			// Some I/O error happened, bail out.
-			return nil, err
-		}
-		if actualSize < maxSize {
-			// Ok, the message is smaller than N. Make a MemoryBuffer and
-			// handle it in RAM.
-			log.Debugln("autobuffer: keeping the message in RAM (read", actualSize, "bytes, got short read)")
-			return buffer.MemoryBuffer{Slice: initial[:actualSize]}, nil
-		}
-
-		log.Debugln("autobuffer: spilling the message to the FS")
-		// The message is big. Dump what we got to the disk and continue writing it there.
-		return buffer.BufferInFile(
-			io.MultiReader(bytes.NewReader(initial[:actualSize]), r),
-			dir)
+		return buffer.BufferAuto(r, maxSize, dir)
 	}
 }
 
@@ -238,26 +248,50 @@ func bufferModeDirective(_ *config.Map, node config.Node) (interface{}, error) {
 	}
 }
 
+// defaultReceivedAuthClient returns the default value for
+// received_auth_client. Client details of authenticated users are not
+// included by default for the Submission endpoint since they are usually
+// the end-user devices.
+func defaultReceivedAuthClient(submission bool) string {
+	if submission {
+		return target.ReceivedOmit
+	}
+	return target.ReceivedFull
+}
+
 func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	var (
-		hostname string
-		err      error
-		ioDebug  bool
+		hostname     string
+		err          error
+		ioDebug      bool
+		disabledExts []string
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
 	cfg.String("hostname", true, true, "", &hostname)
+	cfg.String("support_url", true, false, "", &endp.supportURL)
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.authNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.authMap)
+	modconfig.Table(cfg, "account_protocols", true, false, nil, &endp.saslAuth.AccountProtocols)
+	modconfig.Table(cfg, "master_users", true, false, nil, &endp.saslAuth.MasterUsers)
+	cfg.String("master_separator", true, false, "", &endp.saslAuth.MasterSeparator)
+	cfg.EnumList("disable_extensions", false, false,
+		[]string{"AUTH", "AUTH=LOGIN", "SMTPUTF8", "REQUIRETLS"}, nil, &disabledExts)
 	cfg.Duration("write_timeout", false, false, 1*time.Minute, &endp.serv.WriteTimeout)
 	cfg.Duration("read_timeout", false, false, 10*time.Minute, &endp.serv.ReadTimeout)
-	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.serv.MaxMessageBytes)
+	cfg.Duration("command_timeout", false, false, 5*time.Minute, &endp.commandTimeout)
+	cfg.Duration("data_timeout", false, false, 0, &endp.dataTimeout)
+	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.maxMessageBytes)
 	cfg.DataSize("max_header_size", false, false, 1*1024*1024, &endp.maxHeaderBytes)
 	cfg.Int("max_recipients", false, false, 20000, &endp.serv.MaxRecipients)
 	cfg.Int("max_received", false, false, 50, &endp.maxReceived)
+	cfg.String("received_template", false, false, "", &endp.receivedOpts.Template)
+	cfg.Enum("received_auth_client", false, false,
+		[]string{target.ReceivedFull, target.ReceivedRedact, target.ReceivedOmit},
+		defaultReceivedAuthClient(endp.submission), &endp.receivedOpts.AuthClient)
 	cfg.Custom("buffer", false, false, func() (interface{}, error) {
 		path := filepath.Join(config.StateDirectory, "buffer")
 		if err := os.MkdirAll(path, 0o700); err != nil {
@@ -267,11 +301,23 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}, bufferModeDirective, &endp.buffer)
 	cfg.Custom("tls", true, endp.name != "lmtp", nil, tls2.TLSDirective, &endp.serv.TLSConfig)
 	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.serv.AllowInsecureAuth)
+	cfg.Bool("require_tls", false, false, &endp.tlsRequired)
 	cfg.Int("smtp_max_line_length", false, false, 4000, &endp.serv.MaxLineLength)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
 	cfg.Bool("defer_sender_reject", false, true, &endp.deferServerReject)
 	cfg.Int("max_logged_rcpt_errors", false, false, 5, &endp.maxLoggedRcptErrors)
+	cfg.Duration("banner_delay", false, false, 0, &endp.bannerDelay)
+	cfg.String("banner", false, false, "", &endp.banner)
+	cfg.Enum("early_talker_action", false, false,
+		[]string{earlyTalkerReject, earlyTalkerQuarantine, earlyTalkerIgnore}, earlyTalkerReject,
+		&endp.earlyTalkerAction)
+	cfg.Duration("error_delay", false, false, 0, &endp.errDelay)
+	cfg.Int("error_delay_after", false, false, 3, &endp.errDelayAfter)
+	cfg.Duration("error_delay_max", false, false, 30*time.Second, &endp.errDelayMax)
+	cfg.Int("max_protocol_errors", false, false, 0, &endp.maxProtoErrs)
+	cfg.Int("max_rcpt_rejects", false, false, 0, &endp.maxRcptRejects)
+	cfg.Duration("error_block_time", false, false, 0, &endp.errBlockTime)
 	cfg.Custom("limits", false, false, func() (interface{}, error) {
 		return &limits.Group{}, nil
 	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
@@ -281,12 +327,26 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &endp.limits)
+	cfg.Custom("sent_copy", false, false, nil, modconfig.StorageDirective, &endp.sentCopyStore)
+	cfg.String("sent_copy_mailbox", false, false, "", &endp.sentCopyMailbox)
+	modconfig.Table(cfg, "sent_copy_map", false, false, nil, &endp.sentCopyMap)
+	config.EnumMapped(cfg, "sent_copy_map_normalize", false, false, authz.NormalizeFuncs, authz.NormalizeAuto,
+		&endp.sentCopyNormalize)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	// go-smtp stops reading DATA once MaxMessageBytes bytes are read and
+	// so rejects messages of exactly that size before it sees the end of
+	// data. The limit is enforced by Session.prepareBody and Session.Mail
+	// instead, go-smtp is allowed to read one byte more. This also makes
+	// the SIZE value in the EHLO response one byte larger than the limit.
+	if endp.maxMessageBytes > 0 {
+		endp.serv.MaxMessageBytes = endp.maxMessageBytes + 1
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.3.
 	endp.serv.Domain, err = idna.ToASCII(hostname)
 	if err != nil {
@@ -301,9 +361,38 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	endp.pipeline.Resolver = endp.resolver
 	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
 	endp.pipeline.FirstPipeline = true
+	endp.pipeline.Received = endp.receivedOpts
+
+	if endp.sentCopyStore != nil && !endp.submission {
+		return fmt.Errorf("%s: sent_copy can be used only for submission endpoint", endp.name)
+	}
+
+	if endp.tlsRequired {
+		if endp.serv.TLSConfig == nil {
+			return fmt.Errorf("%s: require_tls is used but TLS is disabled", endp.name)
+		}
+		endp.serv.AllowInsecureAuth = false
+	}
+
+	authDisabled := false
+	for _, ext := range disabledExts {
+		switch ext {
+		case "AUTH":
+			authDisabled = true
+		case "AUTH=LOGIN":
+			endp.saslAuth.DisabledMechs = map[string]struct{}{sasl.Login: {}}
+		case "SMTPUTF8":
+			endp.serv.EnableSMTPUTF8 = false
+		case "REQUIRETLS":
+			endp.serv.EnableREQUIRETLS = false
+		}
+	}
 
-	endp.serv.AuthDisabled = len(endp.saslAuth.SASLMechanisms()) == 0
+	endp.serv.AuthDisabled = authDisabled || len(endp.saslAuth.SASLMechanisms()) == 0
 	if endp.submission {
+		if authDisabled {
+			return fmt.Errorf("%s: AUTH can't be disabled for submission endpoint", endp.name)
+		}
 		endp.authAlwaysRequired = true
 		if len(endp.saslAuth.SASLMechanisms()) == 0 {
 			return fmt.Errorf("%s: auth. provider must be set for submission endpoint", endp.name)
@@ -312,17 +401,26 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	endp.saslAuth.AuthNormalize = endp.authNormalize
 	endp.saslAuth.AuthMap = endp.authMap
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
-		// The code below lacks handling to set AuthPassword. Don't
-		// override sasl.Plain handler so Login() will be called as usual.
+		// The code below lacks handling to set AuthPassword so the Session
+		// handles PLAIN. The default handler rejects authorization
+		// identities, replace it to pass them through.
 		if mech == sasl.Plain {
+			endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
+				sess := c.Session().(*Session)
+				return sasl.NewPlainServer(func(identity, username, password string) error {
+					return sess.authPlain(identity, username, password)
+				})
+			})
 			continue
 		}
 
 		mech := mech
 
 		endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Conn().RemoteAddr(), func(id string) error {
-				c.Session().(*Session).connState.AuthUser = id
+			sess := c.Session().(*Session)
+			return endp.saslAuth.CreateSASL(sess.sessionCtx, mech, c.Conn().RemoteAddr(), func(id string) error {
+				sess.connState.AuthUser = id
+				sessions.SetUser(c.Conn().RemoteAddr(), id)
 				return nil
 			})
 		})
@@ -338,6 +436,13 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
+		if addr.IsTLS() && endp.serv.TLSConfig == nil {
+			return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
+		}
+		if module.NoRun {
+			continue
+		}
+
 		var l net.Listener
 		var err error
 		l, err = net.Listen(addr.Network(), addr.Address())
@@ -346,21 +451,39 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		l = sessions.WrapListener(l, endp.name)
 		if addr.IsTLS() {
-			if endp.serv.TLSConfig == nil {
-				return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
-			}
 			l = tls.NewListener(l, endp.serv.TLSConfig)
 		}
+		if endp.banner != "" {
+			l = &bannerListener{
+				Listener: l,
+				domain:   endp.serv.Domain,
+				template: endp.banner,
+			}
+		}
+		if !addr.IsTLS() && (endp.bannerDelay != 0 || endp.maxProtoErrs != 0) {
+			l = &guardListener{
+				Listener: l,
+				delay:    endp.bannerDelay,
+				reject:   endp.earlyTalkerAction == earlyTalkerReject,
+				log:      endp.Log,
+
+				maxProtoErrs: endp.maxProtoErrs,
+				onLimit:      endp.blockAddr,
+			}
+		}
 
 		endp.listeners = append(endp.listeners, l)
 
 		endp.listenersWg.Add(1)
+		endp.servingCnt.Add(1)
 		addr := addr
 		go func() {
 			if err := endp.serv.Serve(l); err != nil {
 				endp.Log.Printf("failed to serve %s: %s", addr, err)
 			}
+			endp.servingCnt.Add(-1)
 			endp.listenersWg.Done()
 		}()
 	}
@@ -368,6 +491,15 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	return nil
 }
 
+// CheckHealth implements module.HealthChecker. It checks whether all
+// listeners are still accepting connections.
+func (endp *Endpoint) CheckHealth(_ context.Context) error {
+	if serving := int(endp.servingCnt.Load()); serving != len(endp.listeners) {
+		return fmt.Errorf("%s: %d of %d listeners are not serving", endp.name, len(endp.listeners)-serving, len(endp.listeners))
+	}
+	return nil
+}
+
 func (endp *Endpoint) usernameForAuth(ctx context.Context, saslUsername string) (string, error) {
 	saslUsername, err := endp.authNormalize(saslUsername)
 	if err != nil {
@@ -395,9 +527,29 @@ func (endp *Endpoint) usernameForAuth(ctx context.Context, saslUsername string)
 
 func (endp *Endpoint) NewSession(conn *smtp.Conn) (smtp.Session, error) {
 	sess := endp.newSession(conn)
+	if gConn, ok := sess.conn.(*guardConn); ok && gConn.EarlyTalker() {
+		sess.earlyTalker = true
+	}
+
+	if tcpAddr, ok := sess.connState.RemoteAddr.(*net.TCPAddr); ok && endp.limits.IPBlocked(tcpAddr.IP) {
+		endp.Log.Msg("rejecting blocked IP", "src_ip", tcpAddr.IP)
+		if err := sess.Logout(); err != nil {
+			endp.Log.Error("blocked IP logout failed", err)
+		}
+		// Make sure the connection is closed after the response is sent.
+		_, _ = sess.conn.Write([]byte("421 4.7.0 Too many errors from your IP, try again later\r\n"))
+		sess.conn.Close()
+		return nil, &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many errors from your IP, try again later",
+		}
+	}
 
 	// Executed before authentication and session initialization.
-	if err := endp.pipeline.RunEarlyChecks(context.TODO(), &sess.connState); err != nil {
+	checkCtx, cancelChecks := sess.commandCtx(sess.sessionCtx)
+	defer cancelChecks()
+	if err := endp.pipeline.RunEarlyChecks(checkCtx, &sess.connState); err != nil {
 		if err := sess.Logout(); err != nil {
 			endp.Log.Error("early checks logout failed", err)
 		}
@@ -411,9 +563,19 @@ func (endp *Endpoint) NewSession(conn *smtp.Conn) (smtp.Session, error) {
 
 func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 	s := &Session{
-		endp:       endp,
-		log:        endp.Log,
-		sessionCtx: context.Background(),
+		endp: endp,
+		log:  endp.Log,
+	}
+	s.sessionCtx, s.cancelSession = context.WithCancel(endp.shutdownCtx)
+
+	// Used to correlate messages related to the same connection.
+	if sessionID, err := module.GenerateMsgID(); err == nil {
+		fields := make(map[string]interface{}, len(endp.Log.Fields)+1)
+		for k, v := range endp.Log.Fields {
+			fields[k] = v
+		}
+		fields["session_id"] = sessionID
+		s.log.Fields = fields
 	}
 
 	// Used in tests.
@@ -421,6 +583,7 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 		return s
 	}
 
+	s.conn = conn.Conn()
 	s.connState = module.ConnState{
 		Hostname:   conn.Hostname(),
 		LocalAddr:  conn.Conn().LocalAddr(),
@@ -456,7 +619,13 @@ func (endp *Endpoint) ConnectionCount() int {
 	return int(endp.sessionCnt.Load())
 }
 
+// Pipeline returns the message pipeline used by the endpoint.
+func (endp *Endpoint) Pipeline() *msgpipeline.MsgPipeline {
+	return endp.pipeline
+}
+
 func (endp *Endpoint) Close() error {
+	endp.shutdown()
 	endp.serv.Close()
 	endp.listenersWg.Wait()
 	return nil
@@ -22,6 +22,7 @@ import (
 	"flag"
 	"math/rand"
 	"net"
+	"net/textproto"
 	"os"
 	"strconv"
 	"strings"
@@ -289,6 +290,51 @@ func TestSMTPDeliver_CheckError(t *testing.T) {
 	}
 }
 
+func TestSMTPDeliver_CheckError_Template(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			ConnRes: module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:      550,
+					Message:   "Rejected by {check}, see {support_url}?id={msg_id}",
+					CheckName: "test_check",
+				},
+				Reject: true,
+			},
+		},
+	}, []config.Node{
+		{
+			Name: "support_url",
+			Args: []string{"https://support.example.org"},
+		},
+	})
+	endp.deferServerReject = false
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Mail("sender@example.org", nil)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned")
+	}
+
+	if !strings.HasPrefix(smtpErr.Message, "Rejected by test_check, see https://support.example.org?id=") {
+		t.Fatal("Wrong SMTP message:", smtpErr.Message)
+	}
+	if strings.Contains(smtpErr.Message, "{") || strings.Contains(smtpErr.Message, "msg ID") {
+		t.Fatal("Wrong SMTP message:", smtpErr.Message)
+	}
+}
+
 func TestSMTPDeliver_CheckError_Deferred(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
@@ -454,6 +500,188 @@ func TestSMTPDelivery_EmptyMessage(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_TooLarge(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_message_size",
+			Args: []string{"1K"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, testMsg+strings.Repeat(strings.Repeat("A", 100)+"\r\n", 40))
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 552 {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Expected no messages, got", len(tgt.Messages))
+	}
+}
+
+// sizedMsg returns the message of exactly size bytes.
+func sizedMsg(size int) string {
+	hdr := "Subject: Size test\r\n\r\n"
+	return hdr + strings.Repeat("A", size-len(hdr)-2) + "\r\n"
+}
+
+func TestSMTPDelivery_SizeBoundary(t *testing.T) {
+	const limit = 1024
+
+	for _, tc := range []struct {
+		size int
+		ok   bool
+	}{
+		{limit - 1, true},
+		{limit, true},
+		{limit + 1, false},
+	} {
+		tc := tc
+		t.Run("DATA "+strconv.Itoa(tc.size), func(t *testing.T) {
+			tgt := testutils.Target{}
+			endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+				{
+					Name: "max_message_size",
+					Args: []string{"1K"},
+				},
+			})
+			defer endp.Close()
+
+			cl, err := smtp.Dial("127.0.0.1:" + testPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Close()
+
+			err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, sizedMsg(tc.size))
+			checkSizeResult(t, err, tc.ok, &tgt, tc.size)
+		})
+		t.Run("MAIL SIZE="+strconv.Itoa(tc.size), func(t *testing.T) {
+			tgt := testutils.Target{}
+			endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+				{
+					Name: "max_message_size",
+					Args: []string{"1K"},
+				},
+			})
+			defer endp.Close()
+
+			cl, err := smtp.Dial("127.0.0.1:" + testPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Close()
+
+			err = cl.Mail("sender@example.org", &smtp.MailOptions{Size: int64(tc.size)})
+			if tc.ok {
+				if err != nil {
+					t.Fatal("Unexpected error:", err)
+				}
+				return
+			}
+			smtpErr, isSMTPErr := err.(*smtp.SMTPError)
+			if !isSMTPErr {
+				t.Fatal("Expected SMTPError, got", err)
+			}
+			if smtpErr.Code != 552 {
+				t.Fatal("Wrong SMTP code:", smtpErr.Code)
+			}
+		})
+		t.Run("BDAT "+strconv.Itoa(tc.size), func(t *testing.T) {
+			tgt := testutils.Target{}
+			endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+				{
+					Name: "max_message_size",
+					Args: []string{"1K"},
+				},
+			})
+			defer endp.Close()
+
+			c, err := textproto.Dial("tcp", "127.0.0.1:"+testPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			for _, cmd := range []struct {
+				line string
+				code int
+			}{
+				{"", 220},
+				{"EHLO mx.example.org", 250},
+				{"MAIL FROM:<sender@example.org>", 250},
+				{"RCPT TO:<rcpt@example.com>", 250},
+			} {
+				if cmd.line != "" {
+					if err := c.PrintfLine("%s", cmd.line); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, _, err := c.ReadResponse(cmd.code); err != nil {
+					t.Fatal(cmd.line, err)
+				}
+			}
+
+			msg := sizedMsg(tc.size)
+			if err := c.PrintfLine("BDAT %d LAST", len(msg)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.W.WriteString(msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.W.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			code, msgText, err := c.ReadResponse(250)
+			if err != nil {
+				err = &smtp.SMTPError{Code: code, Message: msgText}
+			}
+			checkSizeResult(t, err, tc.ok, &tgt, tc.size)
+		})
+	}
+}
+
+func checkSizeResult(t *testing.T, err error, ok bool, tgt *testutils.Target, size int) {
+	t.Helper()
+
+	if ok {
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(tgt.Messages) != 1 {
+			t.Fatal("Expected 1 message, got", len(tgt.Messages))
+		}
+		if got := len(tgt.Messages[0].Body) + len("Subject: Size test\r\n\r\n"); got != size {
+			t.Fatal("Wrong message size:", got)
+		}
+		return
+	}
+
+	smtpErr, isSMTPErr := err.(*smtp.SMTPError)
+	if !isSMTPErr {
+		t.Fatal("Expected SMTPError, got", err)
+	}
+	if smtpErr.Code != 552 {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Expected no messages, got", len(tgt.Messages))
+	}
+}
+
 func TestSMTPDelivery_AbortLogout(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
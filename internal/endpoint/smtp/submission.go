@@ -19,14 +19,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/mail"
 	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sentcopy"
+	"github.com/foxcpp/maddy/internal/target"
 	"github.com/google/uuid"
 )
 
@@ -43,7 +49,7 @@ var (
 )
 
 func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textproto.Header) error {
-	msgMeta.DontTraceSender = true
+	msgMeta.DontTraceSender = s.endp.receivedOpts.AuthClient == target.ReceivedOmit
 
 	if header.Get("Message-ID") == "" {
 		msgId, err := msgIDField()
@@ -146,3 +152,74 @@ func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textpro
 
 	return nil
 }
+
+// sentCopyAccount returns the name of the storage account to save the copy
+// of the message submitted by the authenticated user to.
+func (s *Session) sentCopyAccount(ctx context.Context) (string, bool, error) {
+	username, err := s.endp.sentCopyNormalize(s.connState.AuthUser)
+	if err != nil {
+		return "", false, err
+	}
+	if s.endp.sentCopyMap == nil {
+		return username, true, nil
+	}
+	return s.endp.sentCopyMap.Lookup(ctx, username)
+}
+
+// storeSentCopy saves the copy of the accepted message to the Sent mailbox of
+// the authenticated user. Errors are logged, but not reported to the client
+// since the message is already accepted for delivery.
+func (s *Session) storeSentCopy(ctx context.Context, header textproto.Header, body buffer.Buffer) {
+	err := func() error {
+		account, ok, err := s.sentCopyAccount(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			s.log.DebugMsg("no storage account for sent copy", "username", s.connState.AuthUser)
+			return nil
+		}
+
+		u, err := s.endp.sentCopyStore.GetIMAPAcct(account)
+		if err != nil {
+			return err
+		}
+		defer u.Logout()
+
+		mbox := s.endp.sentCopyMailbox
+		if mbox == "" {
+			mbox, err = sentcopy.Mailbox(u, sentcopy.DefaultMailbox)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The client might have stored the message already.
+		dup, err := sentcopy.Contains(u, mbox, header.Get("Message-Id"))
+		if err != nil {
+			return err
+		}
+		if dup {
+			s.log.DebugMsg("message is already in the Sent mailbox", "msg_id", s.msgMeta.ID, "mailbox", mbox)
+			return nil
+		}
+
+		msg := bytes.Buffer{}
+		if err := textproto.WriteHeader(&msg, header); err != nil {
+			return err
+		}
+		r, err := body.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if _, err := msg.ReadFrom(r); err != nil {
+			return err
+		}
+
+		return u.CreateMessage(mbox, []string{imap.SeenFlag}, now(), &msg, nil)
+	}()
+	if err != nil {
+		s.log.Error("failed to store sent copy", err, "msg_id", s.msgMeta.ID, "username", s.connState.AuthUser)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// Actions for clients that send data before the greeting.
+const (
+	earlyTalkerReject     = "reject"
+	earlyTalkerQuarantine = "quarantine"
+	earlyTalkerIgnore     = "ignore"
+)
+
+var (
+	errEarlyTalker    = errors.New("smtp: client sent data before the greeting")
+	errTooManyErrors  = errors.New("smtp: too many errors")
+	tooManyErrorsResp = []byte("421 4.7.0 Too many errors, closing connection\r\n")
+)
+
+// guardListener wraps accepted connections to delay the greeting,
+// detect clients that do not wait for it and limit the amount of protocol
+// errors.
+type guardListener struct {
+	net.Listener
+	delay  time.Duration
+	reject bool
+	log    log.Logger
+
+	maxProtoErrs int
+	onLimit      func(net.Addr)
+}
+
+func (l *guardListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &guardConn{
+		Conn:   c,
+		delay:  l.delay,
+		reject: l.reject,
+		log:    l.log,
+
+		maxProtoErrs: l.maxProtoErrs,
+		onLimit:      l.onLimit,
+	}, nil
+}
+
+// guardConn delays the first write (the greeting) by the configured
+// duration, listening for client data meanwhile.
+//
+// Data sent by the client before the greeting is not lost and is returned
+// by subsequent Read calls unless the connection is rejected.
+//
+// Additionally, it counts syntax errors and unknown commands reported to the
+// client (these are handled by go-smtp and never reach Session) and closes
+// the connection once maxProtoErrs is exceeded. Counting stops once the
+// client starts a TLS handshake since the responses are encrypted
+// afterwards.
+type guardConn struct {
+	net.Conn
+	delay  time.Duration
+	reject bool
+	log    log.Logger
+
+	maxProtoErrs int
+	onLimit      func(net.Addr)
+
+	waitOnce   sync.Once
+	early      bool
+	pending    []byte
+	readErr    error
+	protoErrs  int
+	tlsStarted bool
+}
+
+func (c *guardConn) wait() {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.delay)); err != nil {
+		return
+	}
+	buf := make([]byte, 512)
+	n, err := c.Conn.Read(buf)
+	_ = c.Conn.SetReadDeadline(time.Time{})
+
+	if n > 0 {
+		c.early = true
+		c.pending = buf[:n]
+		c.log.Msg("early talker detected", "src_ip", c.Conn.RemoteAddr(), "reject", c.reject)
+	}
+	var netErr net.Error
+	if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		c.readErr = err
+	}
+}
+
+func (c *guardConn) Write(b []byte) (int, error) {
+	if c.delay != 0 {
+		c.waitOnce.Do(c.wait)
+	}
+	if c.early && c.reject {
+		_, _ = c.Conn.Write([]byte("554 5.5.1 Protocol violation: data sent before the greeting\r\n"))
+		c.Conn.Close()
+		return 0, errEarlyTalker
+	}
+
+	if c.maxProtoErrs != 0 && !c.tlsStarted && isProtoError(b) {
+		c.protoErrs++
+		if c.protoErrs > c.maxProtoErrs {
+			c.log.Msg("too many protocol errors, closing connection", "src_ip", c.Conn.RemoteAddr(), "errors", c.protoErrs)
+			_, _ = c.Conn.Write(tooManyErrorsResp)
+			c.Conn.Close()
+			if c.onLimit != nil {
+				c.onLimit(c.Conn.RemoteAddr())
+			}
+			return 0, errTooManyErrors
+		}
+	}
+
+	return c.Conn.Write(b)
+}
+
+// isProtoError reports whether the server response indicates a syntax error,
+// unknown command or bad sequence of commands (codes 500-504).
+func isProtoError(resp []byte) bool {
+	return len(resp) >= 4 && resp[0] == '5' && resp[1] == '0' &&
+		resp[2] >= '0' && resp[2] <= '4' && (resp[3] == ' ' || resp[3] == '-')
+}
+
+func (c *guardConn) Read(b []byte) (int, error) {
+	if len(c.pending) != 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		c.checkTLS(b[:n])
+		return n, nil
+	}
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	n, err := c.Conn.Read(b)
+	c.checkTLS(b[:n])
+	return n, err
+}
+
+// checkTLS detects the start of the TLS handshake after STARTTLS. TLS
+// records with the handshake type (0x16) can not be mistaken for an SMTP
+// command.
+func (c *guardConn) checkTLS(data []byte) {
+	if len(data) != 0 && data[0] == 0x16 {
+		c.tlsStarted = true
+	}
+}
+
+// EarlyTalker reports whether the client sent any data before the greeting.
+func (c *guardConn) EarlyTalker() bool {
+	return c.early
+}
+
+// errorDelay returns the delay to apply before responding with an error
+// after errCount errors in the session. The delay doubles with each error
+// after errorDelayAfter errors.
+func (endp *Endpoint) errorDelay(errCount int) time.Duration {
+	if endp.errDelay == 0 || errCount <= endp.errDelayAfter {
+		return 0
+	}
+
+	shift := errCount - endp.errDelayAfter - 1
+	if shift > 16 {
+		return endp.errDelayMax
+	}
+	delay := endp.errDelay << shift
+	if delay > endp.errDelayMax {
+		return endp.errDelayMax
+	}
+	return delay
+}
+
+// tarpit slows down clients that repeatedly cause errors. It should be
+// called each time an error is returned to the client.
+func (s *Session) tarpit() {
+	s.errCount++
+	delay := s.endp.errorDelay(s.errCount)
+	if delay == 0 {
+		return
+	}
+
+	s.log.DebugMsg("delaying error response", "delay", delay, "errors", s.errCount)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.sessionCtx.Done():
+	}
+}
+
+// rcptRejected should be called each time a RCPT command fails. It closes
+// the connection if the client exceeds the max_rcpt_rejects limit.
+func (s *Session) rcptRejected() {
+	s.rcptRejects++
+	if s.endp.maxRcptRejects == 0 || s.rcptRejects <= s.endp.maxRcptRejects {
+		return
+	}
+
+	s.log.Msg("too many rejected recipients, closing connection", "src_ip", s.connState.RemoteAddr, "rejects", s.rcptRejects)
+	s.drop()
+}
+
+// drop sends the 421 response to the client and closes the underlying
+// connection. go-smtp will terminate the session once it fails to write
+// the response for the current command.
+//
+// go-smtp Conn.Close can not be used since it calls Session.Logout
+// that would deadlock if called from a command handler.
+func (s *Session) drop() {
+	s.endp.blockAddr(s.connState.RemoteAddr)
+	if s.conn == nil {
+		return
+	}
+	_, _ = s.conn.Write(tooManyErrorsResp)
+	s.conn.Close()
+}
+
+// blockAddr temporarily blocks the client IP address using the limits
+// group if error_block_time is set.
+func (endp *Endpoint) blockAddr(addr net.Addr) {
+	if endp.errBlockTime == 0 {
+		return
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	endp.Log.Msg("blocking IP", "src_ip", tcpAddr.IP, "duration", endp.errBlockTime)
+	endp.limits.BlockIP(tcpAddr.IP, endp.errBlockTime)
+}
+
+func (s *Session) wrapErr(msgId string, mangleUTF8 bool, command string, err error) error {
+	err = s.endp.wrapErr(msgId, mangleUTF8, command, err)
+	if err != nil {
+		s.tarpit()
+	}
+	return err
+}
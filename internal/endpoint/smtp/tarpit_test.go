@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestBannerDelayConn(t *testing.T) {
+	test := func(early, reject bool) {
+		t.Helper()
+
+		srv, cl := net.Pipe()
+		defer srv.Close()
+		defer cl.Close()
+
+		conn := &guardConn{
+			Conn:   srv,
+			delay:  50 * time.Millisecond,
+			reject: reject,
+			log:    testutils.Logger(t, "smtp"),
+		}
+
+		if early {
+			go func() {
+				_, _ = io.WriteString(cl, "EHLO example.org\r\n")
+			}()
+		}
+		greeting := make(chan string, 1)
+		go func() {
+			line, _ := bufio.NewReader(cl).ReadString('\n')
+			greeting <- line
+		}()
+
+		_, err := conn.Write([]byte("220 mx.example.org ESMTP\r\n"))
+		line := <-greeting
+
+		if conn.EarlyTalker() != early {
+			t.Fatalf("EarlyTalker() = %v, expected %v", conn.EarlyTalker(), early)
+		}
+		if early && reject {
+			if !errors.Is(err, errEarlyTalker) {
+				t.Fatalf("expected errEarlyTalker, got %v", err)
+			}
+			if !strings.HasPrefix(line, "554 ") {
+				t.Fatalf("unexpected response: %q", line)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("unexpected response: %q", line)
+		}
+
+		if early {
+			// Data sent early should not be lost.
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "EHLO example.org\r\n" {
+				t.Fatalf("unexpected data: %q", buf[:n])
+			}
+		}
+	}
+
+	test(false, true)
+	test(true, true)
+	test(true, false)
+}
+
+func TestGuardConn_ProtoErrors(t *testing.T) {
+	srv, cl := net.Pipe()
+	defer srv.Close()
+	defer cl.Close()
+
+	var blocked net.Addr
+	conn := &guardConn{
+		Conn:         srv,
+		log:          testutils.Logger(t, "smtp"),
+		maxProtoErrs: 2,
+		onLimit: func(addr net.Addr) {
+			blocked = addr
+		},
+	}
+
+	lines := make(chan string, 10)
+	go func() {
+		r := bufio.NewReader(cl)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	for _, resp := range []string{
+		"250 OK\r\n",
+		"500 5.5.2 Unknown command\r\n",
+		"550 5.1.1 No such user\r\n",
+		"501 5.5.4 Syntax error\r\n",
+	} {
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			t.Fatal(err)
+		}
+		if line := <-lines; line != resp {
+			t.Fatalf("unexpected response: %q", line)
+		}
+	}
+
+	_, err := conn.Write([]byte("502 5.5.1 Not implemented\r\n"))
+	if !errors.Is(err, errTooManyErrors) {
+		t.Fatalf("expected errTooManyErrors, got %v", err)
+	}
+	if line := <-lines; !strings.HasPrefix(line, "421 ") {
+		t.Fatalf("unexpected response: %q", line)
+	}
+	if blocked == nil {
+		t.Fatal("onLimit was not called")
+	}
+}
+
+func TestIsProtoError(t *testing.T) {
+	for resp, expected := range map[string]bool{
+		"500 5.5.2 Unknown command\r\n": true,
+		"504-Multiline\r\n":             true,
+		"505 5.5.0 Whatever\r\n":        false,
+		"550 5.1.1 No such user\r\n":    false,
+		"250 OK\r\n":                    false,
+		"50":                            false,
+	} {
+		if res := isProtoError([]byte(resp)); res != expected {
+			t.Errorf("isProtoError(%q) = %v, expected %v", resp, res, expected)
+		}
+	}
+}
+
+func TestErrorDelay(t *testing.T) {
+	endp := &Endpoint{
+		errDelay:      time.Second,
+		errDelayAfter: 2,
+		errDelayMax:   5 * time.Second,
+	}
+
+	for i, expected := range []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := endp.errorDelay(i); delay != expected {
+			t.Errorf("errorDelay(%d) = %v, expected %v", i, delay, expected)
+		}
+	}
+	if delay := endp.errorDelay(1000); delay != 5*time.Second {
+		t.Errorf("errorDelay(1000) = %v", delay)
+	}
+
+	endp.errDelay = 0
+	if delay := endp.errorDelay(10); delay != 0 {
+		t.Errorf("errorDelay with disabled delays = %v", delay)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package external
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/plugin"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const checkModName = "check.external"
+
+type Check struct {
+	instName string
+	cmd      []string
+	log      log.Logger
+
+	proc   *process
+	stages map[string]bool
+}
+
+func NewCheck(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) == 0 {
+		return nil, errors.New("check.external: at least one argument is required (command name)")
+	}
+	return &Check{
+		instName: instName,
+		cmd:      inlineArgs,
+		log:      log.Logger{Name: checkModName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return checkModName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	proc, reply, err := parseCommon(cfg, &c.log, plugin.KindCheck, c.instName, c.cmd)
+	if err != nil {
+		return err
+	}
+	c.proc = proc
+
+	c.stages = make(map[string]bool)
+	if len(reply.Stages) == 0 {
+		c.stages[plugin.StageBody] = true
+	}
+	for _, stage := range reply.Stages {
+		switch stage {
+		case plugin.StageConnection, plugin.StageSender, plugin.StageRcpt, plugin.StageBody:
+			c.stages[stage] = true
+		default:
+			return errors.New("check.external: plugin requested unknown stage: " + stage)
+		}
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.proc == nil {
+		return nil
+	}
+	return c.proc.Close()
+}
+
+type checkState struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &checkState{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *checkState) run(ctx context.Context, args plugin.CheckArgs) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.external/"+args.Stage).End()
+
+	args.Msg = msgInfo(s.msgMeta)
+	args.MailFrom = s.mailFrom
+
+	var reply plugin.CheckReply
+	if err := s.c.proc.Call(ctx, "Plugin.Check", args, &reply); err != nil {
+		return module.CheckResult{
+			Reason: callError(err, checkModName, true),
+			Reject: true,
+		}
+	}
+
+	res := module.CheckResult{
+		Reject:     reply.Reject,
+		Quarantine: reply.Quarantine,
+	}
+	for _, f := range reply.Header {
+		res.Header.Add(f.Key, f.Value)
+	}
+	if reply.Error != nil {
+		res.Reason = pluginError(reply.Error, checkModName, true)
+	} else if reply.Reject || reply.Quarantine {
+		res.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to a local policy",
+			CheckName:    checkModName,
+		}
+	}
+	return res
+}
+
+func (s *checkState) CheckConnection(ctx context.Context) module.CheckResult {
+	if !s.c.stages[plugin.StageConnection] {
+		return module.CheckResult{}
+	}
+	return s.run(ctx, plugin.CheckArgs{Stage: plugin.StageConnection})
+}
+
+func (s *checkState) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	s.mailFrom = mailFrom
+	if !s.c.stages[plugin.StageSender] {
+		return module.CheckResult{}
+	}
+	return s.run(ctx, plugin.CheckArgs{Stage: plugin.StageSender})
+}
+
+func (s *checkState) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	s.rcpts = append(s.rcpts, rcptTo)
+	if !s.c.stages[plugin.StageRcpt] {
+		return module.CheckResult{}
+	}
+	return s.run(ctx, plugin.CheckArgs{Stage: plugin.StageRcpt, Rcpt: rcptTo})
+}
+
+func (s *checkState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if !s.c.stages[plugin.StageBody] {
+		return module.CheckResult{}
+	}
+
+	blob, err := readBody(body)
+	if err != nil {
+		return module.CheckResult{
+			Reason: callError(err, checkModName, true),
+			Reject: true,
+		}
+	}
+
+	return s.run(ctx, plugin.CheckArgs{
+		Stage:  plugin.StageBody,
+		Rcpts:  s.rcpts,
+		Header: headerFields(header),
+		Body:   blob,
+	})
+}
+
+func (s *checkState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(checkModName, NewCheck)
+}
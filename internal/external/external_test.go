@@ -0,0 +1,217 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package external
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/plugin"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const pluginEnv = "MADDY_EXTERNAL_TEST_PLUGIN"
+
+// testPlugin is served by the test binary itself when started with
+// pluginEnv set.
+type testPlugin struct {
+	quarantine bool
+}
+
+func (p *testPlugin) Init(args plugin.InitArgs) (plugin.InitReply, error) {
+	for _, node := range args.Config {
+		if node.Name == "quarantine" {
+			p.quarantine = true
+		}
+	}
+	return plugin.InitReply{Stages: []string{plugin.StageRcpt, plugin.StageBody}}, nil
+}
+
+func (p *testPlugin) Check(args plugin.CheckArgs) (plugin.CheckReply, error) {
+	switch args.Stage {
+	case plugin.StageRcpt:
+		if args.Rcpt == "bad@example.org" {
+			return plugin.CheckReply{Reject: true, Error: &plugin.Error{
+				Code:         550,
+				EnhancedCode: [3]int{5, 1, 1},
+				Message:      "No such user",
+			}}, nil
+		}
+	case plugin.StageBody:
+		return plugin.CheckReply{
+			Quarantine: p.quarantine,
+			Header: []plugin.HeaderField{
+				{Key: "X-Plugin", Value: fmt.Sprintf("%s %d", args.MailFrom, len(args.Rcpts))},
+			},
+		}, nil
+	}
+	return plugin.CheckReply{}, nil
+}
+
+func (p *testPlugin) Deliver(args plugin.DeliverArgs) (plugin.DeliverReply, error) {
+	reply := plugin.DeliverReply{RcptErrors: map[string]*plugin.Error{}}
+	for _, rcpt := range args.Rcpts {
+		if rcpt == "fail@example.org" {
+			reply.RcptErrors[rcpt] = &plugin.Error{
+				Code:         451,
+				EnhancedCode: [3]int{4, 2, 0},
+				Message:      "Try again later",
+			}
+		}
+	}
+	return reply, nil
+}
+
+func (p *testPlugin) Lookup(args plugin.LookupArgs) (plugin.LookupReply, error) {
+	switch args.Key {
+	case "crash":
+		os.Exit(1)
+	case "error":
+		return plugin.LookupReply{}, errors.New("lookup failed")
+	case "alias":
+		return plugin.LookupReply{Values: []string{"a@example.org", "b@example.org"}}, nil
+	}
+	return plugin.LookupReply{}, nil
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(pluginEnv) != "" {
+		if err := plugin.Serve(&testPlugin{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	os.Setenv(pluginEnv, "1")
+	os.Exit(m.Run())
+}
+
+func TestCheck(t *testing.T) {
+	mod, err := NewCheck(checkModName, "test", nil, []string{os.Args[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, checkModName)
+	if err := c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{{Name: "quarantine"}},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	state, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if res := state.CheckSender(ctx, "from@example.org"); res.Reason != nil {
+		t.Fatal("unexpected error:", res.Reason)
+	}
+	if res := state.CheckRcpt(ctx, "good@example.org"); res.Reason != nil {
+		t.Fatal("unexpected error:", res.Reason)
+	}
+	res := state.CheckRcpt(ctx, "bad@example.org")
+	if !res.Reject {
+		t.Fatal("expected rejection")
+	}
+	testutils.CheckSMTPErr(t, res.Reason, 550, exterrors.EnhancedCode{5, 1, 1}, "No such user")
+
+	res = state.CheckBody(ctx, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("hello\r\n")})
+	if !res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if v := res.Header.Get("X-Plugin"); v != "from@example.org 2" {
+		t.Errorf("wrong X-Plugin: %q", v)
+	}
+}
+
+type statusCollector map[string]error
+
+func (sc statusCollector) SetStatus(rcptTo string, err error) {
+	sc[rcptTo] = err
+}
+
+func TestTarget(t *testing.T) {
+	mod, err := NewTarget(targetModName, "test", nil, []string{os.Args[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt := mod.(*Target)
+	tgt.log = testutils.Logger(t, targetModName)
+	if err := tgt.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "from@example.org", []string{"a@example.org", "b@example.org"})
+
+	c := statusCollector{}
+	testutils.DoTestDeliveryNonAtomic(t, c, tgt, "from@example.org", []string{"a@example.org", "fail@example.org"})
+	if c["a@example.org"] != nil {
+		t.Error("unexpected error for a@example.org:", c["a@example.org"])
+	}
+	testutils.CheckSMTPErr(t, c["fail@example.org"], 451, exterrors.EnhancedCode{4, 2, 0}, "Try again later")
+}
+
+func TestTable(t *testing.T) {
+	mod, err := NewTable(tableModName, "test", nil, []string{os.Args[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mod.(*Table)
+	tbl.log = testutils.Logger(t, tableModName)
+	if err := tbl.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+
+	ctx := context.Background()
+	val, ok, err := tbl.Lookup(ctx, "alias")
+	if err != nil || !ok || val != "a@example.org" {
+		t.Fatalf("Lookup: %v %v %v", val, ok, err)
+	}
+	_, ok, err = tbl.Lookup(ctx, "missing")
+	if err != nil || ok {
+		t.Fatalf("Lookup missing: %v %v", ok, err)
+	}
+	if _, _, err := tbl.Lookup(ctx, "error"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// The process should be restarted after a crash.
+	if _, _, err := tbl.Lookup(ctx, "crash"); err == nil {
+		t.Fatal("expected an error")
+	}
+	vals, err := tbl.LookupMulti(ctx, "alias")
+	if err != nil || len(vals) != 2 {
+		t.Fatalf("LookupMulti after crash: %v %v", vals, err)
+	}
+}
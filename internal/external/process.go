@@ -0,0 +1,343 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package external implements modules that run external programs
+// speaking the framework/plugin protocol.
+package external
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/plugin"
+)
+
+const stopTimeout = 5 * time.Second
+
+type pipeConn struct {
+	io.ReadCloser
+	w io.WriteCloser
+}
+
+func (c pipeConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c pipeConn) Close() error {
+	c.w.Close()
+	return c.ReadCloser.Close()
+}
+
+// process manages the plugin subprocess. The process is started lazily and
+// restarted on the next call if it terminates.
+type process struct {
+	cmd  []string
+	init plugin.InitArgs
+	log  *log.Logger
+
+	lock   sync.Mutex
+	proc   *exec.Cmd
+	client *rpc.Client
+	reply  plugin.InitReply
+}
+
+func newProcess(kind, instName string, cmd []string, cfg []config.Node, logger *log.Logger) *process {
+	return &process{
+		cmd: cmd,
+		init: plugin.InitArgs{
+			ProtocolVersion: plugin.ProtocolVersion,
+			Kind:            kind,
+			InstanceName:    instName,
+			Command:         cmd,
+			Config:          convertNodes(cfg),
+		},
+		log: logger,
+	}
+}
+
+func convertNodes(nodes []config.Node) []plugin.ConfigNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+	res := make([]plugin.ConfigNode, 0, len(nodes))
+	for _, n := range nodes {
+		res = append(res, plugin.ConfigNode{
+			Name:     n.Name,
+			Args:     n.Args,
+			Children: convertNodes(n.Children),
+		})
+	}
+	return res
+}
+
+// start starts the process if it is not running, p.lock should be held.
+func (p *process) start() (*rpc.Client, error) {
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	proc := exec.Command(p.cmd[0], p.cmd[1:]...)
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := proc.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := proc.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := proc.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		scnr := bufio.NewScanner(stderr)
+		for scnr.Scan() {
+			p.log.Msg("plugin output", "pid", proc.Process.Pid, "line", scnr.Text())
+		}
+	}()
+
+	client := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(pipeConn{ReadCloser: stdout, w: stdin}))
+
+	var reply plugin.InitReply
+	if err := client.Call("Plugin.Init", p.init, &reply); err != nil {
+		client.Close()
+		p.terminate(proc)
+		return nil, fmt.Errorf("plugin init: %w", err)
+	}
+	if reply.ProtocolVersion != plugin.ProtocolVersion {
+		client.Close()
+		p.terminate(proc)
+		return nil, fmt.Errorf("plugin init: unsupported protocol version: %d", reply.ProtocolVersion)
+	}
+
+	p.log.DebugMsg("plugin started", "pid", proc.Process.Pid)
+
+	p.proc = proc
+	p.client = client
+	p.reply = reply
+	return client, nil
+}
+
+func (p *process) wait(proc *exec.Cmd) {
+	if err := proc.Wait(); err != nil {
+		p.log.Error("plugin terminated", err, "pid", proc.Process.Pid)
+	}
+}
+
+// Start starts the process and returns the reply to the Plugin.Init call.
+func (p *process) Start() (plugin.InitReply, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, err := p.start(); err != nil {
+		return plugin.InitReply{}, err
+	}
+	return p.reply, nil
+}
+
+// Call calls the plugin method.
+//
+// If ctx is cancelled, Call returns without waiting for the reply.
+func (p *process) Call(ctx context.Context, method string, args, reply interface{}) error {
+	p.lock.Lock()
+	client, err := p.start()
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if errors.Is(call.Error, rpc.ErrShutdown) || errors.Is(call.Error, io.ErrUnexpectedEOF) {
+			p.reset(client)
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reset terminates the process if it is still associated with client so the
+// next call starts it again.
+func (p *process) reset(client *rpc.Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.client != client {
+		return
+	}
+	p.stop()
+}
+
+// stop closes plugin stdin and waits for it to exit, p.lock should be held.
+func (p *process) stop() {
+	if p.client == nil {
+		return
+	}
+	p.client.Close()
+	p.terminate(p.proc)
+	p.client = nil
+	p.proc = nil
+}
+
+// terminate waits for the process to exit, killing it if it does not exit
+// in stopTimeout.
+func (p *process) terminate(proc *exec.Cmd) {
+	done := make(chan struct{})
+	go func() {
+		p.wait(proc)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		p.log.Msg("plugin did not exit in time, killing it", "pid", proc.Process.Pid)
+		if err := proc.Process.Kill(); err != nil {
+			p.log.Error("failed to kill plugin", err, "pid", proc.Process.Pid)
+		}
+		<-done
+	}
+}
+
+func (p *process) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stop()
+	return nil
+}
+
+func msgInfo(msgMeta *module.MsgMetadata) plugin.MsgInfo {
+	info := plugin.MsgInfo{
+		ID:         msgMeta.ID,
+		SMTPUTF8:   msgMeta.SMTPOpts.UTF8,
+		Quarantine: msgMeta.Quarantine,
+	}
+	if msgMeta.Conn == nil {
+		return info
+	}
+
+	info.Proto = msgMeta.Conn.Proto
+	info.Hostname = msgMeta.Conn.Hostname
+	info.AuthUser = msgMeta.Conn.AuthUser
+	info.TLS = msgMeta.Conn.TLS.HandshakeComplete
+	if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		info.RemoteAddr = tcpAddr.IP.String()
+	}
+	if msgMeta.Conn.RDNSName != nil {
+		rdns, err := msgMeta.Conn.RDNSName.Get()
+		if err == nil && rdns != nil {
+			info.RDNSName = rdns.(string)
+		}
+	}
+	return info
+}
+
+func headerFields(hdr textproto.Header) []plugin.HeaderField {
+	fields := make([]plugin.HeaderField, 0, hdr.Len())
+	for f := hdr.Fields(); f.Next(); {
+		fields = append(fields, plugin.HeaderField{Key: f.Key(), Value: f.Value()})
+	}
+	return fields
+}
+
+func readBody(body buffer.Buffer) ([]byte, error) {
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// pluginError converts the error reported by the plugin into SMTPError.
+func pluginError(e *plugin.Error, modName string, isCheck bool) *exterrors.SMTPError {
+	err := &exterrors.SMTPError{
+		Code:         e.Code,
+		EnhancedCode: exterrors.EnhancedCode(e.EnhancedCode),
+		Message:      e.Message,
+		Reason:       e.Reason,
+	}
+	if isCheck {
+		err.CheckName = modName
+	} else {
+		err.TargetName = modName
+	}
+	return err
+}
+
+// callError converts the error returned by process.Call into SMTPError.
+func callError(err error, modName string, isCheck bool) *exterrors.SMTPError {
+	smtpErr := &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error",
+		Err:          err,
+	}
+	if isCheck {
+		smtpErr.CheckName = modName
+	} else {
+		smtpErr.TargetName = modName
+	}
+	return smtpErr
+}
+
+// parseCommon reads the configuration directives shared by all external
+// modules and starts the process unless module.NoRun is set.
+func parseCommon(cfg *config.Map, logger *log.Logger, kind, instName string, cmd []string) (*process, plugin.InitReply, error) {
+	cfg.Bool("debug", true, false, &logger.Debug)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return nil, plugin.InitReply{}, err
+	}
+
+	if _, err := exec.LookPath(cmd[0]); err != nil {
+		return nil, plugin.InitReply{}, err
+	}
+
+	proc := newProcess(kind, instName, cmd, unknown, logger)
+	if module.NoRun {
+		return proc, plugin.InitReply{}, nil
+	}
+	reply, err := proc.Start()
+	if err != nil {
+		return nil, plugin.InitReply{}, err
+	}
+	return proc, reply, nil
+}
@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package external
+
+import (
+	"context"
+	"errors"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/plugin"
+)
+
+const tableModName = "table.external"
+
+type Table struct {
+	instName string
+	cmd      []string
+	log      log.Logger
+
+	proc *process
+}
+
+func NewTable(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) == 0 {
+		return nil, errors.New("table.external: at least one argument is required (command name)")
+	}
+	return &Table{
+		instName: instName,
+		cmd:      inlineArgs,
+		log:      log.Logger{Name: tableModName},
+	}, nil
+}
+
+func (t *Table) Name() string {
+	return tableModName
+}
+
+func (t *Table) InstanceName() string {
+	return t.instName
+}
+
+func (t *Table) Init(cfg *config.Map) error {
+	proc, _, err := parseCommon(cfg, &t.log, plugin.KindTable, t.instName, t.cmd)
+	if err != nil {
+		return err
+	}
+	t.proc = proc
+	return nil
+}
+
+func (t *Table) Close() error {
+	if t.proc == nil {
+		return nil
+	}
+	return t.proc.Close()
+}
+
+func (t *Table) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	var reply plugin.LookupReply
+	if err := t.proc.Call(ctx, "Plugin.Lookup", plugin.LookupArgs{Key: key}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Values, nil
+}
+
+func (t *Table) Lookup(ctx context.Context, key string) (string, bool, error) {
+	values, err := t.LookupMulti(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(values) == 0 {
+		return "", false, nil
+	}
+	return values[0], true, nil
+}
+
+func init() {
+	module.Register(tableModName, NewTable)
+}
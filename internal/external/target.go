@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package external
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/plugin"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const targetModName = "target.external"
+
+// Target passes messages to the plugin process.
+//
+// The message is submitted when the body is received, Commit and Abort are
+// no-op.
+type Target struct {
+	instName string
+	cmd      []string
+	log      log.Logger
+
+	proc *process
+}
+
+func NewTarget(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) == 0 {
+		return nil, errors.New("target.external: at least one argument is required (command name)")
+	}
+	return &Target{
+		instName: instName,
+		cmd:      inlineArgs,
+		log:      log.Logger{Name: targetModName},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return targetModName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	proc, _, err := parseCommon(cfg, &t.log, plugin.KindTarget, t.instName, t.cmd)
+	if err != nil {
+		return err
+	}
+	t.proc = proc
+	return nil
+}
+
+func (t *Target) Close() error {
+	if t.proc == nil {
+		return nil
+	}
+	return t.proc.Close()
+}
+
+type delivery struct {
+	t        *Target
+	msgMeta  *module.MsgMetadata
+	log      log.Logger
+	mailFrom string
+	rcpts    []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		mailFrom: mailFrom,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) deliver(ctx context.Context, header textproto.Header, body buffer.Buffer) (plugin.DeliverReply, error) {
+	defer trace.StartRegion(ctx, "target.external/Body").End()
+
+	blob, err := readBody(body)
+	if err != nil {
+		return plugin.DeliverReply{}, callError(err, targetModName, false)
+	}
+
+	var reply plugin.DeliverReply
+	err = d.t.proc.Call(ctx, "Plugin.Deliver", plugin.DeliverArgs{
+		Msg:      msgInfo(d.msgMeta),
+		MailFrom: d.mailFrom,
+		Rcpts:    d.rcpts,
+		Header:   headerFields(header),
+		Body:     blob,
+	}, &reply)
+	if err != nil {
+		return plugin.DeliverReply{}, callError(err, targetModName, false)
+	}
+	if reply.Error != nil {
+		return plugin.DeliverReply{}, pluginError(reply.Error, targetModName, false)
+	}
+	return reply, nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	reply, err := d.deliver(ctx, header, body)
+	if err != nil {
+		return err
+	}
+	// Atomic delivery cannot report partial failures, fail the whole
+	// message if any recipient failed.
+	for _, rcpt := range d.rcpts {
+		if rcptErr := reply.RcptErrors[rcpt]; rcptErr != nil {
+			return pluginError(rcptErr, targetModName, false)
+		}
+	}
+	return nil
+}
+
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	reply, err := d.deliver(ctx, header, body)
+	for _, rcpt := range d.rcpts {
+		if err != nil {
+			c.SetStatus(rcpt, err)
+			continue
+		}
+		if rcptErr := reply.RcptErrors[rcpt]; rcptErr != nil {
+			c.SetStatus(rcpt, pluginError(rcptErr, targetModName, false))
+			continue
+		}
+		c.SetStatus(rcpt, nil)
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+func init() {
+	module.Register(targetModName, NewTarget)
+}
@@ -0,0 +1,177 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package grpcfilter
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const checkModName = "check.grpc"
+
+type Check struct {
+	instName string
+	log      log.Logger
+	client
+}
+
+func NewCheck(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: checkModName, Debug: log.DefaultLogger.Debug},
+	}
+	c.client = client{
+		modName: checkModName,
+		isCheck: true,
+		log:     &c.log,
+	}
+	switch len(inlineArgs) {
+	case 1:
+		c.endpoint = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of arguments, want 1 or 0", checkModName)
+	}
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return checkModName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	return c.parseCommon(cfg, []string{stageConnection, stageSender, stageRcpt, stageBody})
+}
+
+type checkState struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &checkState{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *checkState) result(verdict *Verdict, err error) module.CheckResult {
+	if err != nil {
+		err := s.c.callError(err)
+		if err == nil {
+			return module.CheckResult{}
+		}
+		return module.CheckResult{Reason: err, Reject: true}
+	}
+
+	res := module.CheckResult{
+		Reject:     verdict.Reject,
+		Quarantine: verdict.Quarantine,
+	}
+	for _, f := range verdict.Header {
+		res.Header.Add(f.Key, f.Value)
+	}
+	if verdict.Error != nil {
+		res.Reason = s.c.serviceError(verdict.Error)
+	} else if verdict.Reject || verdict.Quarantine {
+		res.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to a local policy",
+			CheckName:    checkModName,
+		}
+	}
+	return res
+}
+
+func (s *checkState) event(ctx context.Context, stage, method string, ev *Event) module.CheckResult {
+	if !s.c.stages[stage] {
+		return module.CheckResult{}
+	}
+	defer trace.StartRegion(ctx, "check.grpc/"+method).End()
+
+	ev.Msg = msgInfo(s.msgMeta)
+	var verdict Verdict
+	err := s.c.invoke(ctx, method, ev, &verdict)
+	return s.result(&verdict, err)
+}
+
+func (s *checkState) CheckConnection(ctx context.Context) module.CheckResult {
+	return s.event(ctx, stageConnection, "CheckConnection", &Event{})
+}
+
+func (s *checkState) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	s.mailFrom = mailFrom
+	return s.event(ctx, stageSender, "CheckSender", &Event{MailFrom: mailFrom})
+}
+
+func (s *checkState) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	s.rcpts = append(s.rcpts, rcptTo)
+	return s.event(ctx, stageRcpt, "CheckRcpt", &Event{MailFrom: s.mailFrom, Rcpt: rcptTo})
+}
+
+func (s *checkState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if !s.c.stages[stageBody] {
+		return module.CheckResult{}
+	}
+	defer trace.StartRegion(ctx, "check.grpc/CheckBody").End()
+
+	var verdict Verdict
+	err := s.c.stream(ctx, "CheckBody", &BodyChunk{
+		Msg:      msgInfo(s.msgMeta),
+		MailFrom: s.mailFrom,
+		Rcpts:    s.rcpts,
+		Header:   headerFields(header),
+	}, body, &verdict)
+	return s.result(&verdict, err)
+}
+
+func (s *checkState) Close() error {
+	return nil
+}
+
+func headerFields(hdr textproto.Header) []HeaderField {
+	fields := make([]HeaderField, 0, hdr.Len())
+	for f := hdr.Fields(); f.Next(); {
+		fields = append(fields, HeaderField{Key: f.Key(), Value: f.Value()})
+	}
+	return fields
+}
+
+func init() {
+	module.Register(checkModName, NewCheck)
+}
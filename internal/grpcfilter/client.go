@@ -0,0 +1,353 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package grpcfilter implements check.grpc and modify.grpc modules that
+// offload message filtering to a separate service using gRPC.
+//
+// The service definition is in filter.proto.
+package grpcfilter
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const servicePrefix = "/maddy.filter.v1.Filter/"
+
+// Stage names used in the 'stages' directive.
+const (
+	stageConnection = "connection"
+	stageSender     = "sender"
+	stageRcpt       = "rcpt"
+	stageBody       = "body"
+)
+
+// codec encodes messages using the protobuf wire format. It has the same
+// name as the default gRPC codec so the sidecar sees regular protobuf
+// requests.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("grpcfilter: unexpected message type %T", v)
+	}
+	return m.marshal(nil), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("grpcfilter: unexpected message type %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+// client contains the connection to the filter service and configuration
+// shared by check.grpc and modify.grpc.
+type client struct {
+	modName  string
+	isCheck  bool
+	log      *log.Logger
+	endpoint string
+
+	timeout   time.Duration
+	failOpen  bool
+	chunkSize int
+	stages    map[string]bool
+
+	conn *grpc.ClientConn
+}
+
+// parseCommon reads the configuration directives shared by check.grpc and
+// modify.grpc and sets up the connection unless module.NoRun is set.
+//
+// allowedStages is the list of stages supported by the module, last one
+// is used by default.
+func (c *client) parseCommon(cfg *config.Map, allowedStages []string) error {
+	var (
+		tlsConfig tls.Config
+		stages    []string
+		chunkSize int64
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpoint, &c.endpoint)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	cfg.Duration("timeout", false, false, 10*time.Second, &c.timeout)
+	cfg.Bool("fail_open", false, false, &c.failOpen)
+	cfg.DataSize("chunk_size", false, false, 64*1024, &chunkSize)
+	cfg.StringList("stages", false, false, allowedStages[len(allowedStages)-1:], &stages)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.endpoint == "" {
+		return fmt.Errorf("%s: endpoint is not set", c.modName)
+	}
+	if chunkSize <= 0 {
+		return fmt.Errorf("%s: chunk_size should be positive", c.modName)
+	}
+	c.chunkSize = int(chunkSize)
+
+	c.stages = make(map[string]bool, len(stages))
+	for _, stage := range stages {
+		allowed := false
+		for _, s := range allowedStages {
+			if s == stage {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s: unknown stage: %s", c.modName, stage)
+		}
+		c.stages[stage] = true
+	}
+
+	endp, err := config.ParseEndpoint(c.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.modName, err)
+	}
+	switch endp.Scheme {
+	case "tcp", "unix", "tls":
+	default:
+		return fmt.Errorf("%s: scheme unsupported: %v", c.modName, endp.Scheme)
+	}
+
+	if module.NoRun {
+		return nil
+	}
+
+	creds := insecure.NewCredentials()
+	if endp.IsTLS() {
+		tlsConfig := tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = endp.Host
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	// The connection is established lazily and re-established as needed
+	// by grpc-go.
+	c.conn, err = grpc.Dial("passthrough:///"+endp.Address(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, endp.Network(), endp.Address())
+		}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.modName, err)
+	}
+	return nil
+}
+
+func (c *client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *client) invoke(ctx context.Context, method string, req, reply message) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.conn.Invoke(ctx, servicePrefix+method, req, reply)
+}
+
+// stream sends the message body to the client-streaming method. first is
+// sent before the body and should contain the message header.
+//
+// Body is read and sent in chunk_size parts as the service consumes them,
+// so a slow service slows down the reading instead of the whole message
+// being buffered in memory. The service may reply before reading the whole
+// body.
+func (c *client) stream(ctx context.Context, method string, first *BodyChunk, body buffer.Buffer, reply message) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	desc := &grpc.StreamDesc{StreamName: method, ClientStreams: true}
+	st, err := c.conn.NewStream(ctx, desc, servicePrefix+method)
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendBody(st, first, body); err != nil {
+		return err
+	}
+	return st.RecvMsg(reply)
+}
+
+func (c *client) sendBody(st grpc.ClientStream, first *BodyChunk, body buffer.Buffer) error {
+	if err := st.SendMsg(first); err != nil {
+		if errors.Is(err, io.EOF) {
+			// Stream is closed by the service, the reply or error
+			// is returned by RecvMsg.
+			return nil
+		}
+		return err
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for {
+		// Message can be kept by gRPC after SendMsg returns, so the
+		// buffer is not reused.
+		chunk := make([]byte, c.chunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err := st.SendMsg(&BodyChunk{Data: chunk[:n]}); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return st.CloseSend()
+}
+
+// callError converts the gRPC call error into SMTPError. It returns nil if
+// fail_open is set.
+func (c *client) callError(err error) error {
+	if c.failOpen {
+		c.log.Error("call failed, ignoring (fail_open)", err)
+		return nil
+	}
+
+	smtpErr := &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+		Message:      "Unable to check the message, try again later",
+		Err:          err,
+	}
+	if c.isCheck {
+		smtpErr.CheckName = c.modName
+	} else {
+		smtpErr.Misc = map[string]interface{}{"modifier": c.modName}
+	}
+	return smtpErr
+}
+
+// serviceError converts the error reported by the service into SMTPError.
+func (c *client) serviceError(e *SMTPError) *exterrors.SMTPError {
+	code := int(e.Code)
+	if code < 400 || code > 599 {
+		code = 550
+	}
+	enchCode, err := parseEnhancedCode(e.EnhancedCode)
+	if err != nil {
+		enchCode = exterrors.EnhancedCode{code / 100, 7, 1}
+	}
+	msg := e.Message
+	if msg == "" {
+		msg = "Message rejected due to a local policy"
+	}
+
+	smtpErr := &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: enchCode,
+		Message:      msg,
+		Reason:       e.Reason,
+	}
+	if c.isCheck {
+		smtpErr.CheckName = c.modName
+	} else {
+		smtpErr.Misc = map[string]interface{}{"modifier": c.modName}
+	}
+	return smtpErr
+}
+
+func parseEnhancedCode(s string) (exterrors.EnhancedCode, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return exterrors.EnhancedCode{}, fmt.Errorf("malformed enhanced code: %s", s)
+	}
+	var code exterrors.EnhancedCode
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return exterrors.EnhancedCode{}, fmt.Errorf("malformed enhanced code: %s", s)
+		}
+		code[i] = num
+	}
+	if code[0] != 2 && code[0] != 4 && code[0] != 5 {
+		return exterrors.EnhancedCode{}, fmt.Errorf("malformed enhanced code: %s", s)
+	}
+	return code, nil
+}
+
+func msgInfo(msgMeta *module.MsgMetadata) *MsgInfo {
+	info := &MsgInfo{
+		ID:         msgMeta.ID,
+		SMTPUTF8:   msgMeta.SMTPOpts.UTF8,
+		Quarantine: msgMeta.Quarantine,
+	}
+	if msgMeta.Conn == nil {
+		return info
+	}
+
+	info.Proto = msgMeta.Conn.Proto
+	info.Hostname = msgMeta.Conn.Hostname
+	info.AuthUser = msgMeta.Conn.AuthUser
+	info.TLS = msgMeta.Conn.TLS.HandshakeComplete
+	if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		info.RemoteAddr = tcpAddr.IP.String()
+	}
+	if msgMeta.Conn.RDNSName != nil {
+		rdns, err := msgMeta.Conn.RDNSName.Get()
+		if err == nil && rdns != nil {
+			info.RDNSName = rdns.(string)
+		}
+	}
+	return info
+}
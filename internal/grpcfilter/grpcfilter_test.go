@@ -0,0 +1,328 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package grpcfilter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"google.golang.org/grpc"
+)
+
+func TestMessages_RoundTrip(t *testing.T) {
+	test := func(in, out message) {
+		t.Helper()
+		if err := out.unmarshal(in.marshal(nil)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+		}
+	}
+
+	test(&BodyChunk{
+		Msg: &MsgInfo{
+			ID:         "id",
+			Proto:      "ESMTP",
+			Hostname:   "mx.example.org",
+			RemoteAddr: "192.0.2.1",
+			AuthUser:   "user",
+			TLS:        true,
+			Quarantine: true,
+		},
+		MailFrom: "from@example.org",
+		Rcpts:    []string{"a@example.org", ""},
+		Header:   []HeaderField{{Key: "Subject", Value: "hello"}},
+		Data:     []byte("body"),
+	}, &BodyChunk{})
+	test(&Verdict{
+		Reject: true,
+		Error:  &SMTPError{Code: 550, EnhancedCode: "5.7.1", Message: "no", Reason: "spam"},
+		Header: []HeaderField{{Key: "X-Spam", Value: "yes"}},
+	}, &Verdict{})
+	test(&Rewrite{Values: []string{"a@example.org", "b@example.org"}}, &Rewrite{})
+	test(&Event{Msg: &MsgInfo{ID: "id"}, MailFrom: "from@example.org", Rcpt: "to@example.org"}, &Event{})
+}
+
+func TestMessages_UnknownFields(t *testing.T) {
+	// Fields added in newer protocol versions should be skipped.
+	b := (&Verdict{Quarantine: true}).marshal(nil)
+	b = appendString(b, 100, "future")
+	b = appendInt32(b, 101, 42)
+
+	var v Verdict
+	if err := v.unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if !v.Quarantine {
+		t.Error("quarantine field is lost")
+	}
+
+	if err := v.unmarshal([]byte{0x0a, 0x10, 'a'}); err == nil {
+		t.Error("expected an error for the truncated message")
+	}
+}
+
+// testService implements a subset of the filter service.
+type testService struct {
+	body []byte
+}
+
+func (s *testService) checkRcpt(_ context.Context, ev *Event) (message, error) {
+	if ev.Rcpt == "bad@example.org" {
+		return &Verdict{Reject: true, Error: &SMTPError{
+			Code:         550,
+			EnhancedCode: "5.1.1",
+			Message:      "No such user",
+		}}, nil
+	}
+	return &Verdict{}, nil
+}
+
+func (s *testService) checkBody(stream grpc.ServerStream) error {
+	var first BodyChunk
+	if err := stream.RecvMsg(&first); err != nil {
+		return err
+	}
+	for {
+		var chunk BodyChunk
+		err := stream.RecvMsg(&chunk)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.body = append(s.body, chunk.Data...)
+	}
+
+	return stream.SendMsg(&Verdict{
+		Quarantine: true,
+		Header: []HeaderField{
+			{Key: "X-Filter", Value: first.MailFrom + " " + first.Header[0].Value},
+		},
+	})
+}
+
+func (s *testService) rewriteRcpt(_ context.Context, ev *Event) (message, error) {
+	if ev.Rcpt == "list@example.org" {
+		return &Rewrite{Values: []string{"a@example.org", "b@example.org"}}, nil
+	}
+	return &Rewrite{}, nil
+}
+
+type unaryHandler = func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error)
+
+func eventHandler(fn func(context.Context, *Event) (message, error)) unaryHandler {
+	return func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+		var ev Event
+		if err := dec(&ev); err != nil {
+			return nil, err
+		}
+		return fn(ctx, &ev)
+	}
+}
+
+func startService(t *testing.T, svc *testService) string {
+	t.Helper()
+
+	sock := filepath.Join(t.TempDir(), "filter.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "maddy.filter.v1.Filter",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "CheckRcpt", Handler: eventHandler(svc.checkRcpt)},
+			{MethodName: "RewriteRcpt", Handler: eventHandler(svc.rewriteRcpt)},
+		},
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName:    "CheckBody",
+				ClientStreams: true,
+				Handler: func(_ interface{}, stream grpc.ServerStream) error {
+					return svc.checkBody(stream)
+				},
+			},
+		},
+	}, svc)
+	go srv.Serve(l) //nolint:errcheck
+	t.Cleanup(srv.Stop)
+
+	return "unix://" + sock
+}
+
+func TestCheck(t *testing.T) {
+	svc := &testService{}
+	endpoint := startService(t, svc)
+
+	mod, err := NewCheck(checkModName, "test", nil, []string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, checkModName)
+	if err := c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "stages", Args: []string{"rcpt", "body"}},
+			{Name: "chunk_size", Args: []string{"4B"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	state, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if res := state.CheckSender(ctx, "from@example.org"); res.Reason != nil {
+		t.Fatal("unexpected error:", res.Reason)
+	}
+	if res := state.CheckRcpt(ctx, "good@example.org"); res.Reason != nil {
+		t.Fatal("unexpected error:", res.Reason)
+	}
+	res := state.CheckRcpt(ctx, "bad@example.org")
+	if !res.Reject {
+		t.Fatal("expected rejection")
+	}
+	testutils.CheckSMTPErr(t, res.Reason, 550, exterrors.EnhancedCode{5, 1, 1}, "No such user")
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "hello")
+	body := []byte("message body\r\n")
+	res = state.CheckBody(ctx, hdr, buffer.MemoryBuffer{Slice: body})
+	if !res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if v := res.Header.Get("X-Filter"); v != "from@example.org hello" {
+		t.Errorf("wrong X-Filter: %q", v)
+	}
+	if !bytes.Equal(svc.body, body) {
+		t.Errorf("wrong body received by the service: %q", svc.body)
+	}
+}
+
+func TestCheck_FailOpen(t *testing.T) {
+	test := func(failOpen bool) {
+		t.Helper()
+
+		mod, err := NewCheck(checkModName, "test", nil, []string{"unix://" + filepath.Join(t.TempDir(), "missing.sock")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		c.log = testutils.Logger(t, checkModName)
+		cfg := config.Node{
+			Children: []config.Node{
+				{Name: "stages", Args: []string{"rcpt"}},
+				{Name: "timeout", Args: []string{"1s"}},
+			},
+		}
+		if failOpen {
+			cfg.Children = append(cfg.Children, config.Node{Name: "fail_open", Args: []string{"yes"}})
+		}
+		if err := c.Init(config.NewMap(nil, cfg)); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		ctx := context.Background()
+		state, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer state.Close()
+
+		res := state.CheckRcpt(ctx, "good@example.org")
+		if failOpen {
+			if res.Reason != nil {
+				t.Error("unexpected error:", res.Reason)
+			}
+			return
+		}
+		if !res.Reject || !exterrors.IsTemporary(res.Reason) {
+			t.Errorf("expected temporary rejection, got %+v", res)
+		}
+	}
+
+	test(true)
+	test(false)
+}
+
+func TestModifier_RewriteRcpt(t *testing.T) {
+	endpoint := startService(t, &testService{})
+
+	mod, err := NewModifier(modifierModName, "test", nil, []string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, modifierModName)
+	if err := m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "stages", Args: []string{"rcpt"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	state, err := m.ModStateForMsg(ctx, &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	rcpts, err := state.RewriteRcpt(ctx, "list@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rcpts, []string{"a@example.org", "b@example.org"}) {
+		t.Errorf("wrong rcpts: %v", rcpts)
+	}
+
+	rcpts, err = state.RewriteRcpt(ctx, "user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rcpts, []string{"user@example.org"}) {
+		t.Errorf("wrong rcpts: %v", rcpts)
+	}
+}
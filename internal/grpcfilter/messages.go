@@ -0,0 +1,387 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package grpcfilter
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Messages of the maddy.filter.v1 protocol (see filter.proto).
+//
+// They are encoded by hand using protowire to avoid depending on
+// generated code, field numbers should match filter.proto.
+
+type MsgInfo struct {
+	ID         string
+	Proto      string
+	Hostname   string
+	RemoteAddr string
+	RDNSName   string
+	AuthUser   string
+	TLS        bool
+	SMTPUTF8   bool
+	Quarantine bool
+}
+
+type Event struct {
+	Msg      *MsgInfo
+	MailFrom string
+	Rcpt     string
+}
+
+type HeaderField struct {
+	Key   string
+	Value string
+}
+
+type BodyChunk struct {
+	Msg      *MsgInfo
+	MailFrom string
+	Rcpts    []string
+	Header   []HeaderField
+	Data     []byte
+}
+
+type SMTPError struct {
+	Code         int32
+	EnhancedCode string
+	Message      string
+	Reason       string
+}
+
+type Verdict struct {
+	Reject     bool
+	Quarantine bool
+	Error      *SMTPError
+	Header     []HeaderField
+}
+
+type Rewrite struct {
+	Values []string
+	Header []HeaderField
+	Error  *SMTPError
+}
+
+// message is implemented by all protocol messages.
+type message interface {
+	marshal(b []byte) []byte
+	unmarshal(b []byte) error
+}
+
+var errMalformed = errors.New("grpcfilter: malformed message")
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendInt32(b []byte, num protowire.Number, v int32) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendRepeatedString(b []byte, num protowire.Number, values []string) []byte {
+	for _, v := range values {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+func appendMessage(b []byte, num protowire.Number, m message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal(nil))
+}
+
+func appendHeader(b []byte, num protowire.Number, fields []HeaderField) []byte {
+	for i := range fields {
+		b = appendMessage(b, num, &fields[i])
+	}
+	return b
+}
+
+// walk calls fn for each varint and length-delimited field of the encoded
+// message. Fields of other types are skipped.
+func walk(b []byte, fn func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v    uint64
+			data []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MsgInfo) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.ID)
+	b = appendString(b, 2, m.Proto)
+	b = appendString(b, 3, m.Hostname)
+	b = appendString(b, 4, m.RemoteAddr)
+	b = appendString(b, 5, m.RDNSName)
+	b = appendString(b, 6, m.AuthUser)
+	b = appendBool(b, 7, m.TLS)
+	b = appendBool(b, 8, m.SMTPUTF8)
+	b = appendBool(b, 9, m.Quarantine)
+	return b
+}
+
+func (m *MsgInfo) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.ID = string(data)
+		case 2:
+			m.Proto = string(data)
+		case 3:
+			m.Hostname = string(data)
+		case 4:
+			m.RemoteAddr = string(data)
+		case 5:
+			m.RDNSName = string(data)
+		case 6:
+			m.AuthUser = string(data)
+		case 7:
+			m.TLS = v != 0
+		case 8:
+			m.SMTPUTF8 = v != 0
+		case 9:
+			m.Quarantine = v != 0
+		}
+		return nil
+	})
+}
+
+func (m *Event) marshal(b []byte) []byte {
+	if m.Msg != nil {
+		b = appendMessage(b, 1, m.Msg)
+	}
+	b = appendString(b, 2, m.MailFrom)
+	b = appendString(b, 3, m.Rcpt)
+	return b
+}
+
+func (m *Event) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Msg = &MsgInfo{}
+			return m.Msg.unmarshal(data)
+		case 2:
+			m.MailFrom = string(data)
+		case 3:
+			m.Rcpt = string(data)
+		}
+		return nil
+	})
+}
+
+func (m *HeaderField) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Key)
+	b = appendString(b, 2, m.Value)
+	return b
+}
+
+func (m *HeaderField) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Key = string(data)
+		case 2:
+			m.Value = string(data)
+		}
+		return nil
+	})
+}
+
+func unmarshalField(data []byte) (HeaderField, error) {
+	var f HeaderField
+	if err := f.unmarshal(data); err != nil {
+		return HeaderField{}, err
+	}
+	if f.Key == "" {
+		return HeaderField{}, errMalformed
+	}
+	return f, nil
+}
+
+func (m *BodyChunk) marshal(b []byte) []byte {
+	if m.Msg != nil {
+		b = appendMessage(b, 1, m.Msg)
+	}
+	b = appendString(b, 2, m.MailFrom)
+	b = appendRepeatedString(b, 3, m.Rcpts)
+	b = appendHeader(b, 4, m.Header)
+	b = appendBytes(b, 5, m.Data)
+	return b
+}
+
+func (m *BodyChunk) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Msg = &MsgInfo{}
+			return m.Msg.unmarshal(data)
+		case 2:
+			m.MailFrom = string(data)
+		case 3:
+			m.Rcpts = append(m.Rcpts, string(data))
+		case 4:
+			f, err := unmarshalField(data)
+			if err != nil {
+				return err
+			}
+			m.Header = append(m.Header, f)
+		case 5:
+			m.Data = append([]byte(nil), data...)
+		}
+		return nil
+	})
+}
+
+func (m *SMTPError) marshal(b []byte) []byte {
+	b = appendInt32(b, 1, m.Code)
+	b = appendString(b, 2, m.EnhancedCode)
+	b = appendString(b, 3, m.Message)
+	b = appendString(b, 4, m.Reason)
+	return b
+}
+
+func (m *SMTPError) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Code = int32(v)
+		case 2:
+			m.EnhancedCode = string(data)
+		case 3:
+			m.Message = string(data)
+		case 4:
+			m.Reason = string(data)
+		}
+		return nil
+	})
+}
+
+func (m *Verdict) marshal(b []byte) []byte {
+	b = appendBool(b, 1, m.Reject)
+	b = appendBool(b, 2, m.Quarantine)
+	if m.Error != nil {
+		b = appendMessage(b, 3, m.Error)
+	}
+	b = appendHeader(b, 4, m.Header)
+	return b
+}
+
+func (m *Verdict) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Reject = v != 0
+		case 2:
+			m.Quarantine = v != 0
+		case 3:
+			m.Error = &SMTPError{}
+			return m.Error.unmarshal(data)
+		case 4:
+			f, err := unmarshalField(data)
+			if err != nil {
+				return err
+			}
+			m.Header = append(m.Header, f)
+		}
+		return nil
+	})
+}
+
+func (m *Rewrite) marshal(b []byte) []byte {
+	b = appendRepeatedString(b, 1, m.Values)
+	b = appendHeader(b, 2, m.Header)
+	if m.Error != nil {
+		b = appendMessage(b, 3, m.Error)
+	}
+	return b
+}
+
+func (m *Rewrite) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Values = append(m.Values, string(data))
+		case 2:
+			f, err := unmarshalField(data)
+			if err != nil {
+				return err
+			}
+			m.Header = append(m.Header, f)
+		case 3:
+			m.Error = &SMTPError{}
+			return m.Error.unmarshal(data)
+		}
+		return nil
+	})
+}
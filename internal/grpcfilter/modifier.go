@@ -0,0 +1,175 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package grpcfilter
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modifierModName = "modify.grpc"
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+	client
+}
+
+func NewModifier(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modifierModName, Debug: log.DefaultLogger.Debug},
+	}
+	m.client = client{
+		modName: modifierModName,
+		log:     &m.log,
+	}
+	switch len(inlineArgs) {
+	case 1:
+		m.endpoint = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of arguments, want 1 or 0", modifierModName)
+	}
+	return m, nil
+}
+
+func (m *Modifier) Name() string {
+	return modifierModName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	return m.parseCommon(cfg, []string{stageSender, stageRcpt, stageBody})
+}
+
+type modifierState struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &modifierState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *modifierState) event(ctx context.Context, method string, ev *Event) (*Rewrite, error) {
+	defer trace.StartRegion(ctx, "modify.grpc/"+method).End()
+
+	ev.Msg = msgInfo(s.msgMeta)
+	var rewrite Rewrite
+	if err := s.m.invoke(ctx, method, ev, &rewrite); err != nil {
+		return nil, s.m.callError(err)
+	}
+	if rewrite.Error != nil {
+		return nil, s.m.serviceError(rewrite.Error)
+	}
+	return &rewrite, nil
+}
+
+func (s *modifierState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	s.mailFrom = mailFrom
+	if !s.m.stages[stageSender] {
+		return mailFrom, nil
+	}
+
+	rewrite, err := s.event(ctx, "RewriteSender", &Event{MailFrom: mailFrom})
+	if err != nil {
+		return "", err
+	}
+	if rewrite == nil || len(rewrite.Values) == 0 {
+		return mailFrom, nil
+	}
+	if len(rewrite.Values) > 1 {
+		s.log.Msg("service returned multiple senders, using the first one", "values", rewrite.Values)
+	}
+	s.mailFrom = rewrite.Values[0]
+	s.log.DebugMsg("sender rewritten", "old", mailFrom, "new", s.mailFrom)
+	return s.mailFrom, nil
+}
+
+func (s *modifierState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if !s.m.stages[stageRcpt] {
+		s.rcpts = append(s.rcpts, rcptTo)
+		return []string{rcptTo}, nil
+	}
+
+	rewrite, err := s.event(ctx, "RewriteRcpt", &Event{MailFrom: s.mailFrom, Rcpt: rcptTo})
+	if err != nil {
+		return nil, err
+	}
+	if rewrite == nil || len(rewrite.Values) == 0 {
+		s.rcpts = append(s.rcpts, rcptTo)
+		return []string{rcptTo}, nil
+	}
+	s.rcpts = append(s.rcpts, rewrite.Values...)
+	s.log.DebugMsg("recipient rewritten", "old", rcptTo, "new", rewrite.Values)
+	return rewrite.Values, nil
+}
+
+func (s *modifierState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if !s.m.stages[stageBody] {
+		return nil
+	}
+	defer trace.StartRegion(ctx, "modify.grpc/RewriteBody").End()
+
+	var rewrite Rewrite
+	err := s.m.stream(ctx, "RewriteBody", &BodyChunk{
+		Msg:      msgInfo(s.msgMeta),
+		MailFrom: s.mailFrom,
+		Rcpts:    s.rcpts,
+		Header:   headerFields(*h),
+	}, body, &rewrite)
+	if err != nil {
+		return s.m.callError(err)
+	}
+	if rewrite.Error != nil {
+		return s.m.serviceError(rewrite.Error)
+	}
+	for _, f := range rewrite.Header {
+		h.Add(f.Key, f.Value)
+	}
+	return nil
+}
+
+func (s *modifierState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modifierModName, NewModifier)
+}
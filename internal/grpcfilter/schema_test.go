@@ -0,0 +1,236 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package grpcfilter
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var (
+	protoMessageRe = regexp.MustCompile(`^message (\w+) \{$`)
+	protoFieldRe   = regexp.MustCompile(`^(repeated )?(\w+) (\w+) = (\d+);$`)
+)
+
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+}
+
+// loadSchema parses messages declared in filter.proto.
+//
+// Only the subset of the syntax used by the file is supported: top-level
+// messages with scalar, message and repeated fields.
+func loadSchema(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+
+	f, err := os.Open("filter.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:   proto.String("filter.proto"),
+		Syntax: proto.String("proto3"),
+	}
+	var (
+		msg       *descriptorpb.DescriptorProto
+		inService bool
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "//")
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "syntax "):
+		case strings.HasPrefix(line, "package "):
+			fdp.Package = proto.String(strings.TrimSuffix(strings.TrimPrefix(line, "package "), ";"))
+		case strings.HasPrefix(line, "service "):
+			inService = true
+		case inService:
+			inService = line != "}"
+		case protoMessageRe.MatchString(line):
+			msg = &descriptorpb.DescriptorProto{Name: proto.String(protoMessageRe.FindStringSubmatch(line)[1])}
+			fdp.MessageType = append(fdp.MessageType, msg)
+		case line == "}" && msg != nil:
+			msg = nil
+		case protoFieldRe.MatchString(line) && msg != nil:
+			m := protoFieldRe.FindStringSubmatch(line)
+			num, _ := strconv.Atoi(m[4])
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:   proto.String(m[3]),
+				Number: proto.Int32(int32(num)),
+				Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			if m[1] != "" {
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			}
+			if typ, ok := protoScalarTypes[m[2]]; ok {
+				field.Type = typ.Enum()
+			} else {
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String("." + fdp.GetPackage() + "." + m[2])
+			}
+			msg.Field = append(msg.Field, field)
+		default:
+			t.Fatalf("filter.proto: unexpected line: %s", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := protodesc.NewFile(fdp, new(protoregistry.Files))
+	if err != nil {
+		t.Fatal("filter.proto:", err)
+	}
+	return fd
+}
+
+// checkSchemaFields checks that all fields of the message defined by the
+// schema are set to the values used in TestMessages_Schema.
+func checkSchemaFields(t *testing.T, m protoreflect.Message) {
+	t.Helper()
+
+	desc := m.Descriptor()
+	if len(m.GetUnknown()) != 0 {
+		t.Errorf("%s: fields with unknown number or type", desc.Name())
+	}
+
+	checkValue := func(fd protoreflect.FieldDescriptor, v protoreflect.Value) {
+		t.Helper()
+		ok := true
+		switch fd.Kind() {
+		case protoreflect.StringKind:
+			ok = v.String() == string(fd.Name())
+		case protoreflect.BytesKind:
+			ok = string(v.Bytes()) == string(fd.Name())
+		case protoreflect.BoolKind:
+			ok = v.Bool()
+		case protoreflect.Int32Kind:
+			ok = v.Int() != 0
+		case protoreflect.MessageKind:
+			checkSchemaFields(t, v.Message())
+		}
+		if !ok {
+			t.Errorf("%s: wrong value of %s: %v", desc.Name(), fd.Name(), v)
+		}
+	}
+
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !m.Has(fd) {
+			t.Errorf("%s: %s is not set", desc.Name(), fd.Name())
+			continue
+		}
+		v := m.Get(fd)
+		if !fd.IsList() {
+			checkValue(fd, v)
+			continue
+		}
+		for j := 0; j < v.List().Len(); j++ {
+			checkValue(fd, v.List().Get(j))
+		}
+	}
+}
+
+func TestMessages_Schema(t *testing.T) {
+	schema := loadSchema(t)
+
+	// Values of string fields are set to the field names in filter.proto so
+	// a mismatched field number is detected even if types are the same.
+	msgInfo := &MsgInfo{
+		ID:         "id",
+		Proto:      "proto",
+		Hostname:   "hostname",
+		RemoteAddr: "remote_addr",
+		RDNSName:   "rdns_name",
+		AuthUser:   "auth_user",
+		TLS:        true,
+		SMTPUTF8:   true,
+		Quarantine: true,
+	}
+	header := []HeaderField{{Key: "key", Value: "value"}}
+	smtpErr := &SMTPError{
+		Code:         550,
+		EnhancedCode: "enhanced_code",
+		Message:      "message",
+		Reason:       "reason",
+	}
+
+	test := func(name string, in, out message) {
+		t.Helper()
+
+		desc := schema.Messages().ByName(protoreflect.Name(name))
+		if desc == nil {
+			t.Fatalf("%s is not defined in filter.proto", name)
+		}
+		dyn := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(in.marshal(nil), dyn); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkSchemaFields(t, dyn)
+
+		b, err := proto.Marshal(dyn)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := out.unmarshal(b); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s: mismatch after decoding:\n%+v\n%+v", name, in, out)
+		}
+	}
+
+	test("MsgInfo", msgInfo, &MsgInfo{})
+	test("Event", &Event{Msg: msgInfo, MailFrom: "mail_from", Rcpt: "rcpt"}, &Event{})
+	test("HeaderField", &header[0], &HeaderField{})
+	test("BodyChunk", &BodyChunk{
+		Msg:      msgInfo,
+		MailFrom: "mail_from",
+		Rcpts:    []string{"rcpts", "rcpts"},
+		Header:   header,
+		Data:     []byte("data"),
+	}, &BodyChunk{})
+	test("SMTPError", smtpErr, &SMTPError{})
+	test("Verdict", &Verdict{Reject: true, Quarantine: true, Error: smtpErr, Header: header}, &Verdict{})
+	test("Rewrite", &Rewrite{Values: []string{"values"}, Header: header, Error: smtpErr}, &Rewrite{})
+
+	if n := schema.Messages().Len(); n != 7 {
+		t.Errorf("filter.proto defines %d messages, not all of them are tested", n)
+	}
+}
@@ -57,6 +57,7 @@ func (c *Check) IMAPFilter(accountName string, rcptTo string, msgMeta *module.Ms
 	if err != nil {
 		return "", nil, err
 	}
+	defer bR.Close()
 
 	return c.run(cmd, args, io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
 }
@@ -0,0 +1,503 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package rules implements the imap.filter.rules module that files messages
+// into IMAP folders using simple per-account rules stored in an SQL table.
+//
+// Besides selecting the folder, rules can mark the message as read and
+// forward a copy of it to another address.
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+	_ "github.com/lib/pq"
+)
+
+const modName = "imap.filter.rules"
+
+// Rule kinds.
+const (
+	// KindDetail matches the address extension (the part after the detail
+	// separator, "user+detail@example.org") of the original recipient address.
+	KindDetail = "detail"
+	// KindSenderDomain matches the domain of the envelope sender. Wildcard
+	// patterns ("*.example.org") match all subdomains.
+	KindSenderDomain = "sender_domain"
+	// KindListID matches the List-Id header field.
+	KindListID = "list_id"
+	// KindFrom matches the From header field.
+	KindFrom = "from"
+	// KindTo matches the To and Cc header fields.
+	KindTo = "to"
+	// KindSubject matches the Subject header field.
+	KindSubject = "subject"
+)
+
+// Kinds lists all supported rule kinds in the order they are evaluated.
+var Kinds = []string{KindDetail, KindSenderDomain, KindListID, KindFrom, KindTo, KindSubject}
+
+// headerKinds are matched against the decoded header field value using a
+// case-insensitive substring match.
+var headerKinds = map[string]bool{
+	KindListID:  true,
+	KindFrom:    true,
+	KindTo:      true,
+	KindSubject: true,
+}
+
+var migrations = []sqlmigrate.Migration{
+	{
+		Version:     1,
+		Description: "create filing_rules table",
+		Up: []string{`CREATE TABLE filing_rules (
+			account TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			pattern TEXT NOT NULL,
+			folder TEXT NOT NULL,
+			PRIMARY KEY (account, kind, pattern)
+		)`},
+		Down: []string{`DROP TABLE filing_rules`},
+	},
+	{
+		Version:     2,
+		Description: "add mark_read and forward_to actions",
+		Up: []string{
+			`ALTER TABLE filing_rules ADD COLUMN mark_read BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE filing_rules ADD COLUMN forward_to TEXT NOT NULL DEFAULT ''`,
+		},
+		Down: []string{
+			`ALTER TABLE filing_rules DROP COLUMN forward_to`,
+			`ALTER TABLE filing_rules DROP COLUMN mark_read`,
+		},
+	},
+}
+
+// Rule is a single filing rule.
+//
+// At least one of Folder, MarkRead and ForwardTo should be set.
+type Rule struct {
+	Account string `json:"account"`
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+	// Folder is the folder to place the message in. Empty means the
+	// storage default (INBOX).
+	Folder   string `json:"folder,omitempty"`
+	MarkRead bool   `json:"mark_read,omitempty"`
+	// ForwardTo is the address to send a copy of the message to.
+	ForwardTo string `json:"forward_to,omitempty"`
+}
+
+type Filter struct {
+	instName string
+	log      log.Logger
+
+	detailSep string
+
+	forwardTarget module.DeliveryTarget
+
+	db       *sql.DB
+	migrator *sqlmigrate.Migrator
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Filter{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (f *Filter) Name() string {
+	return modName
+}
+
+func (f *Filter) InstanceName() string {
+	return f.instName
+}
+
+func (f *Filter) Init(cfg *config.Map) error {
+	var (
+		driver   string
+		dsnParts []string
+	)
+	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.String("driver", false, true, "", &driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.String("detail_separator", false, false, "+", &f.detailSep)
+	cfg.Custom("forward_target", false, false, nil, modconfig.DeliveryDirective, &f.forwardTarget)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if f.detailSep == "" {
+		return config.NodeErr(cfg.Block, "detail_separator can't be empty")
+	}
+
+	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	f.db = db
+	f.migrator = &sqlmigrate.Migrator{
+		DB:         db,
+		Driver:     driver,
+		Component:  "filing_rules",
+		Migrations: migrations,
+	}
+
+	// Schema is managed using 'maddy db' commands in this case.
+	if module.NoRun {
+		return nil
+	}
+	if err := f.migrator.Prepare(context.Background()); err != nil {
+		return config.NodeErr(cfg.Block, "schema init: %v", err)
+	}
+	return nil
+}
+
+// Migrators implements sqlmigrate.Provider.
+func (f *Filter) Migrators() []*sqlmigrate.Migrator {
+	return []*sqlmigrate.Migrator{f.migrator}
+}
+
+func (f *Filter) Close() error {
+	return f.db.Close()
+}
+
+// NormalizePattern validates the rule pattern and converts it into the form
+// used for matching.
+func NormalizePattern(kind, pattern string) (string, error) {
+	switch kind {
+	case KindDetail:
+		if pattern == "" {
+			return "", errors.New("empty detail pattern")
+		}
+		return strings.ToLower(pattern), nil
+	case KindSenderDomain:
+		domain, wildcard := pattern, false
+		if strings.HasPrefix(domain, "*.") {
+			domain, wildcard = domain[2:], true
+		}
+		// ValidDomain checks only the length limits.
+		if !address.ValidDomain(domain) || strings.ContainsAny(domain, " \t@") {
+			return "", fmt.Errorf("invalid domain: %s", pattern)
+		}
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return "", err
+		}
+		if wildcard {
+			domain = "*." + domain
+		}
+		return domain, nil
+	case KindListID, KindFrom, KindTo, KindSubject:
+		if strings.TrimSpace(pattern) == "" {
+			return "", fmt.Errorf("empty %s pattern", kind)
+		}
+		return strings.ToLower(pattern), nil
+	default:
+		return "", fmt.Errorf("unknown rule kind: %s", kind)
+	}
+}
+
+// Rules returns the rules defined for the account.
+func (f *Filter) Rules(account string) ([]Rule, error) {
+	rows, err := f.db.Query(`SELECT kind, pattern, folder, mark_read, forward_to FROM filing_rules
+		WHERE account = $1 ORDER BY kind, pattern`, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		r := Rule{Account: account}
+		if err := rows.Scan(&r.Kind, &r.Pattern, &r.Folder, &r.MarkRead, &r.ForwardTo); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// SetRule adds the rule, replacing the actions of the existing rule with the
+// same kind and pattern, if any.
+func (f *Filter) SetRule(r Rule) error {
+	pattern, err := NormalizePattern(r.Kind, r.Pattern)
+	if err != nil {
+		return err
+	}
+	if r.Folder == "" && !r.MarkRead && r.ForwardTo == "" {
+		return errors.New("rule has no actions")
+	}
+	if r.ForwardTo != "" {
+		if !address.Valid(r.ForwardTo) {
+			return fmt.Errorf("invalid forwarding address: %s", r.ForwardTo)
+		}
+	}
+
+	tx, err := f.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	_, err = tx.Exec(`DELETE FROM filing_rules WHERE account = $1 AND kind = $2 AND pattern = $3`,
+		r.Account, r.Kind, pattern)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO filing_rules (account, kind, pattern, folder, mark_read, forward_to)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		r.Account, r.Kind, pattern, r.Folder, r.MarkRead, r.ForwardTo)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveRule removes the rule with the specified kind and pattern. It returns
+// false if there is no such rule.
+func (f *Filter) RemoveRule(account, kind, pattern string) (bool, error) {
+	pattern, err := NormalizePattern(kind, pattern)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := f.db.Exec(`DELETE FROM filing_rules WHERE account = $1 AND kind = $2 AND pattern = $3`,
+		account, kind, pattern)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func (f *Filter) IMAPFilter(accountName string, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (string, []string, error) {
+	rules, err := f.Rules(accountName)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rules) == 0 {
+		return "", nil, nil
+	}
+
+	// Address extension is usually lost after alias expansion, so look at
+	// the recipient as it was specified by the client.
+	originalRcpt := rcptTo
+	for rcpt, ok := rcptTo, true; ok; rcpt, ok = meta.OriginalRcpts[rcpt] {
+		originalRcpt = rcpt
+	}
+
+	values := headerValues(hdr)
+	values[KindDetail] = f.detail(originalRcpt)
+	values[KindSenderDomain] = senderDomain(meta.OriginalFrom)
+
+	r := match(rules, values)
+	if r == nil {
+		return "", nil, nil
+	}
+	f.log.DebugMsg("rule matched", "account", accountName, "msg_id", meta.ID,
+		"kind", r.Kind, "pattern", r.Pattern, "folder", r.Folder)
+
+	if r.ForwardTo != "" {
+		f.forward(accountName, r.ForwardTo, meta, hdr, body)
+	}
+
+	var flags []string
+	if r.MarkRead {
+		flags = append(flags, imap.SeenFlag)
+	}
+	return r.Folder, flags, nil
+}
+
+// forward sends a copy of the message using forward_target. Failures are
+// logged and do not affect the delivery to the mailbox.
+func (f *Filter) forward(accountName, to string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) {
+	if f.forwardTarget == nil {
+		f.log.Msg("forward_target is not configured, not forwarding", "account", accountName, "msg_id", meta.ID)
+		return
+	}
+	// Messages with the null sender are non-delivery reports and similar,
+	// forwarding these could create loops between two forwarding accounts.
+	if meta.OriginalFrom == "" {
+		return
+	}
+	if strings.EqualFold(to, accountName) {
+		return
+	}
+
+	ctx := context.Background()
+	fwdMeta := meta.DeepCopy()
+	fwdMeta.ID = meta.ID + "-fwd"
+
+	// Envelope sender is rewritten to the account address so the forwarded
+	// message passes SPF checks on the receiving side.
+	delivery, err := f.forwardTarget.Start(ctx, fwdMeta, accountName)
+	if err != nil {
+		f.log.Error("forward failed", err, "account", accountName, "msg_id", meta.ID, "rcpt", to)
+		return
+	}
+	err = delivery.AddRcpt(ctx, to, smtp.RcptOptions{})
+	if err == nil {
+		err = delivery.Body(ctx, hdr.Copy(), body)
+	}
+	if err == nil {
+		err = delivery.Commit(ctx)
+	}
+	if err != nil {
+		f.log.Error("forward failed", err, "account", accountName, "msg_id", meta.ID, "rcpt", to)
+		if err := delivery.Abort(ctx); err != nil {
+			f.log.Error("forward abort failed", err, "msg_id", meta.ID)
+		}
+		return
+	}
+	f.log.Msg("message forwarded", "account", accountName, "msg_id", meta.ID, "rcpt", to)
+}
+
+// headerValues returns the lowercased values of header fields used by
+// header rule kinds.
+func headerValues(hdr textproto.Header) map[string]string {
+	text := func(fields ...string) string {
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			for _, raw := range hdr.Values(field) {
+				values = append(values, decodeText(raw))
+			}
+		}
+		return strings.ToLower(strings.Join(values, ", "))
+	}
+
+	return map[string]string{
+		KindListID:  text("List-Id"),
+		KindFrom:    text("From"),
+		KindTo:      text("To", "Cc"),
+		KindSubject: text("Subject"),
+	}
+}
+
+// decodeText decodes RFC 2047 encoded words in the header field value,
+// returning it as is if it can't be decoded.
+func decodeText(raw string) string {
+	var h message.Header
+	h.Set("X-Value", raw)
+	decoded, err := h.Text("X-Value")
+	if err != nil {
+		return raw
+	}
+	return decoded
+}
+
+func (f *Filter) detail(rcpt string) string {
+	mbox, _, err := address.Split(rcpt)
+	if err != nil {
+		return ""
+	}
+	idx := strings.Index(mbox, f.detailSep)
+	if idx == -1 {
+		return ""
+	}
+	return strings.ToLower(mbox[idx+len(f.detailSep):])
+}
+
+func senderDomain(sender string) string {
+	_, domain, err := address.Split(sender)
+	if err != nil || domain == "" {
+		return ""
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// match returns the best matching rule or nil if there is none. values
+// contains the normalized value to check for each rule kind.
+//
+// Rule kinds are evaluated in the order of Kinds. Exact sender domain
+// rules take priority over wildcard ones. For header rules, the longest
+// matching pattern wins.
+func match(rules []Rule, values map[string]string) *Rule {
+	byKind := make(map[string]map[string]*Rule, len(Kinds))
+	for i, r := range rules {
+		if byKind[r.Kind] == nil {
+			byKind[r.Kind] = make(map[string]*Rule)
+		}
+		byKind[r.Kind][r.Pattern] = &rules[i]
+	}
+
+	for _, kind := range Kinds {
+		value := values[kind]
+		if value == "" || len(byKind[kind]) == 0 {
+			continue
+		}
+
+		switch {
+		case kind == KindDetail:
+			if r, ok := byKind[kind][value]; ok {
+				return r
+			}
+		case kind == KindSenderDomain:
+			if r, ok := byKind[kind][value]; ok {
+				return r
+			}
+			for _, wildcard := range dns.WildcardMatches(value) {
+				if r, ok := byKind[kind][wildcard]; ok {
+					return r
+				}
+			}
+		case headerKinds[kind]:
+			var best *Rule
+			for pattern, r := range byKind[kind] {
+				if !strings.Contains(value, pattern) {
+					continue
+				}
+				if best == nil || len(pattern) > len(best.Pattern) ||
+					(len(pattern) == len(best.Pattern) && pattern < best.Pattern) {
+					best = r
+				}
+			}
+			if best != nil {
+				return best
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
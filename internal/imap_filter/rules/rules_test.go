@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package rules
+
+import (
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{
+		{Kind: KindDetail, Pattern: "lists", Folder: "Lists"},
+		{Kind: KindSenderDomain, Pattern: "github.com", Folder: "GitHub"},
+		{Kind: KindSenderDomain, Pattern: "*.example.org", Folder: "Example"},
+		{Kind: KindSenderDomain, Pattern: "*.dev.example.org", Folder: "Dev"},
+		{Kind: KindListID, Pattern: "maddy.lists.example.com", Folder: "Maddy"},
+		{Kind: KindFrom, Pattern: "boss@", MarkRead: true},
+		{Kind: KindSubject, Pattern: "invoice", Folder: "Invoices"},
+		{Kind: KindSubject, Pattern: "overdue invoice", Folder: "Urgent"},
+	}
+
+	test := func(values map[string]string, expected string) {
+		t.Helper()
+		r := match(rules, values)
+		matched := ""
+		if r != nil {
+			matched = r.Kind + " " + r.Pattern
+		}
+		if matched != expected {
+			t.Errorf("match(%v) = %q, want %q", values, matched, expected)
+		}
+	}
+
+	test(map[string]string{}, "")
+	test(map[string]string{KindDetail: "lists"}, "detail lists")
+	test(map[string]string{KindDetail: "lists", KindSenderDomain: "github.com"}, "detail lists")
+	test(map[string]string{KindDetail: "other", KindSenderDomain: "github.com"}, "sender_domain github.com")
+	test(map[string]string{KindSenderDomain: "notifications.github.com"}, "")
+	test(map[string]string{KindSenderDomain: "mail.example.org"}, "sender_domain *.example.org")
+	test(map[string]string{KindSenderDomain: "example.org"}, "")
+	test(map[string]string{KindSenderDomain: "ci.dev.example.org"}, "sender_domain *.dev.example.org")
+	test(map[string]string{KindListID: "maddy development <maddy.lists.example.com>"}, "list_id maddy.lists.example.com")
+	test(map[string]string{KindFrom: "the boss <boss@example.com>", KindSubject: "invoice"}, "from boss@")
+	test(map[string]string{KindSubject: "your invoice"}, "subject invoice")
+	test(map[string]string{KindSubject: "re: overdue invoice #1"}, "subject overdue invoice")
+	test(map[string]string{KindTo: "boss@example.com"}, "")
+}
+
+func TestHeaderValues(t *testing.T) {
+	var hdr textproto.Header
+	hdr.Add("From", "=?utf-8?q?J=C3=B6rg?= <Joerg@example.org>")
+	hdr.Add("To", "a@example.org")
+	hdr.Add("Cc", "B@example.org")
+	hdr.Add("Subject", "Hello")
+
+	values := headerValues(hdr)
+	if v := values[KindFrom]; v != "jörg <joerg@example.org>" {
+		t.Errorf("from = %q", v)
+	}
+	if v := values[KindTo]; v != "a@example.org, b@example.org" {
+		t.Errorf("to = %q", v)
+	}
+	if v := values[KindSubject]; v != "hello" {
+		t.Errorf("subject = %q", v)
+	}
+	if v := values[KindListID]; v != "" {
+		t.Errorf("list_id = %q", v)
+	}
+}
+
+func TestDetail(t *testing.T) {
+	f := Filter{detailSep: "+"}
+	test := func(rcpt, expected string) {
+		t.Helper()
+		if detail := f.detail(rcpt); detail != expected {
+			t.Errorf("detail(%q) = %q, want %q", rcpt, detail, expected)
+		}
+	}
+
+	test("user@example.org", "")
+	test("user+Lists@example.org", "lists")
+	test("user+a+b@example.org", "a+b")
+	test("user+@example.org", "")
+	test("postmaster", "")
+}
+
+func TestNormalizePattern(t *testing.T) {
+	test := func(kind, pattern, expected string, fail bool) {
+		t.Helper()
+		res, err := NormalizePattern(kind, pattern)
+		if fail {
+			if err == nil {
+				t.Errorf("expected failure for %s %q, got %q", kind, pattern, res)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected failure for %s %q: %v", kind, pattern, err)
+			return
+		}
+		if res != expected {
+			t.Errorf("NormalizePattern(%s, %q) = %q, want %q", kind, pattern, res, expected)
+		}
+	}
+
+	test(KindDetail, "Lists", "lists", false)
+	test(KindDetail, "", "", true)
+	test(KindSenderDomain, "GitHub.com", "github.com", false)
+	test(KindSenderDomain, "*.Example.org", "*.example.org", false)
+	test(KindSenderDomain, "not a domain", "", true)
+	test(KindSubject, "Invoice", "invoice", false)
+	test(KindListID, "  ", "", true)
+	test("body", "x", "", true)
+}
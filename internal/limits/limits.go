@@ -30,9 +30,11 @@ import (
 	"context"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits/limiters"
 )
@@ -44,8 +46,17 @@ type Group struct {
 	ip     *limiters.BucketSet // BucketSet of MultiLimit
 	source *limiters.BucketSet // BucketSet of MultiLimit
 	dest   *limiters.BucketSet // BucketSet of MultiLimit
+
+	// blocked contains IPs temporarily blocked using BlockIP and
+	// the time the block expires.
+	blockedLock sync.Mutex
+	blocked     map[string]time.Time
 }
 
+// maxBlockedIPs is the maximum amount of simultaneously blocked IPs.
+// Blocks are dropped once it is reached to bound the memory usage.
+const maxBlockedIPs = 20010
+
 func New(_, instName string, _, _ []string) (module.Module, error) {
 	return &Group{
 		instName: instName,
@@ -172,6 +183,18 @@ func concurrencyCtor(node config.Node, args []string) (func() limiters.L, error)
 }
 
 func (g *Group) TakeMsg(ctx context.Context, addr net.IP, sourceDomain string) error {
+	if g.IPBlocked(addr) {
+		return &exterrors.SMTPError{
+			Code:         421,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Too many errors from your IP, try again later",
+			CheckName:    "limits",
+			Misc: map[string]interface{}{
+				"src_ip": addr.String(),
+			},
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
@@ -221,6 +244,52 @@ func (g *Group) ReleaseDest(domain string) {
 	g.dest.Release(domain)
 }
 
+// BlockIP rejects all messages from the specified IP for the duration.
+//
+// It is used by endpoints to temporarily block clients that
+// misbehave. Blocks are shared between all users of the Group.
+func (g *Group) BlockIP(addr net.IP, duration time.Duration) {
+	g.blockedLock.Lock()
+	defer g.blockedLock.Unlock()
+
+	now := time.Now()
+	if g.blocked == nil {
+		g.blocked = make(map[string]time.Time)
+	}
+	if len(g.blocked) >= maxBlockedIPs {
+		for k, expiry := range g.blocked {
+			if now.After(expiry) {
+				delete(g.blocked, k)
+			}
+		}
+		if len(g.blocked) >= maxBlockedIPs {
+			return
+		}
+	}
+
+	expiry := now.Add(duration)
+	if cur, ok := g.blocked[addr.String()]; ok && cur.After(expiry) {
+		return
+	}
+	g.blocked[addr.String()] = expiry
+}
+
+// IPBlocked reports whether the IP is blocked using BlockIP.
+func (g *Group) IPBlocked(addr net.IP) bool {
+	g.blockedLock.Lock()
+	defer g.blockedLock.Unlock()
+
+	expiry, ok := g.blocked[addr.String()]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(g.blocked, addr.String())
+		return false
+	}
+	return true
+}
+
 func (g *Group) Name() string {
 	return "limits"
 }
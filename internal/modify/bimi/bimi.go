@@ -0,0 +1,422 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package bimi implements the modify.bimi module that adds BIMI-Location and
+// BIMI-Indicator header fields to messages eligible for Brand Indicators for
+// Message Identification.
+//
+// It is a modifier instead of a check since eligibility depends on the DMARC
+// result which is known only after all checks are complete.
+package bimi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/publicsuffix"
+)
+
+const modName = "modify.bimi"
+
+const (
+	// maxIndicatorSize is the maximum size of the SVG indicator as
+	// recommended by the BIMI specification.
+	maxIndicatorSize = 32 * 1024
+	// maxVMCSize limits the size of the downloaded VMC PEM file.
+	maxVMCSize = 64 * 1024
+)
+
+// Record is the parsed BIMI assertion record.
+type Record struct {
+	// Location is the URL of the SVG indicator (l= tag).
+	Location string
+	// Authority is the URL of the Verified Mark Certificate (a= tag).
+	Authority string
+}
+
+// Declination reports whether the record is a declination to publish
+// (both l= and a= are empty).
+func (r Record) Declination() bool {
+	return r.Location == "" && r.Authority == ""
+}
+
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag: %s", part)
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+func checkURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	if !strings.HasPrefix(s, "https://") {
+		return fmt.Errorf("not an HTTPS URL: %s", s)
+	}
+	return nil
+}
+
+// ParseRecord parses the BIMI assertion record.
+func ParseRecord(txt string) (Record, error) {
+	if !strings.HasPrefix(txt, "v=BIMI1") {
+		return Record{}, errors.New("not a BIMI record")
+	}
+	tags, err := parseTags(txt)
+	if err != nil {
+		return Record{}, err
+	}
+	if tags["v"] != "BIMI1" {
+		return Record{}, errors.New("unsupported version")
+	}
+
+	rec := Record{
+		Location:  tags["l"],
+		Authority: tags["a"],
+	}
+	if err := checkURL(rec.Location); err != nil {
+		return Record{}, fmt.Errorf("l=: %w", err)
+	}
+	if err := checkURL(rec.Authority); err != nil {
+		return Record{}, fmt.Errorf("a=: %w", err)
+	}
+	return rec, nil
+}
+
+// selectorFromHeader returns the selector from the BIMI-Selector header
+// field or "default".
+func selectorFromHeader(h textproto.Header) string {
+	value := h.Get("BIMI-Selector")
+	if value == "" {
+		return "default"
+	}
+	tags, err := parseTags(value)
+	if err != nil || tags["v"] != "BIMI1" || tags["s"] == "" {
+		return "default"
+	}
+	return strings.ToLower(tags["s"])
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookupRecord discovers the BIMI record for the domain as described in the
+// BIMI specification: the author domain is tried first, then the
+// organizational domain. It returns the domain the record was found at.
+func lookupRecord(ctx context.Context, r dns.Resolver, selector, domain string) (string, *Record, error) {
+	domains := []string{domain}
+	if orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil && orgDomain != domain {
+		domains = append(domains, orgDomain)
+	}
+
+	for _, d := range domains {
+		txts, err := r.LookupTXT(ctx, dns.FQDN(selector+"._bimi."+d))
+		if err != nil && !isNotFound(err) {
+			return "", nil, err
+		}
+
+		var records []string
+		for _, txt := range txts {
+			if strings.HasPrefix(txt, "v=BIMI1") {
+				records = append(records, txt)
+			}
+		}
+		switch len(records) {
+		case 0:
+			continue
+		case 1:
+			rec, err := ParseRecord(records[0])
+			if err != nil {
+				return "", nil, err
+			}
+			return d, &rec, nil
+		default:
+			return "", nil, errors.New("multiple BIMI records")
+		}
+	}
+	return "", nil, nil
+}
+
+// policyEligible reports whether the DMARC policy is strict enough for BIMI:
+// quarantine or reject, applied to all messages.
+func policyEligible(fromDomain, policyDomain string, rec *dmarc.Record) bool {
+	if rec == nil {
+		return false
+	}
+	if rec.Percent != nil && *rec.Percent != 100 {
+		return false
+	}
+	policy := rec.Policy
+	if fromDomain != policyDomain && rec.SubdomainPolicy != "" {
+		policy = rec.SubdomainPolicy
+	}
+	return policy == dmarc.PolicyQuarantine || policy == dmarc.PolicyReject
+}
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+	client   *http.Client
+
+	verifyVMC      bool
+	requireVMC     bool
+	fetchIndicator bool
+	vmcRoots       *x509.CertPool
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		rootsPath    string
+		fetchTimeout time.Duration
+	)
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Bool("verify_vmc", false, true, &m.verifyVMC)
+	cfg.Bool("require_vmc", false, false, &m.requireVMC)
+	cfg.Bool("fetch_indicator", false, false, &m.fetchIndicator)
+	cfg.String("vmc_roots", false, false, "", &rootsPath)
+	cfg.Duration("fetch_timeout", false, false, 10*time.Second, &fetchTimeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.requireVMC && !m.verifyVMC {
+		return fmt.Errorf("%s: require_vmc can't be used with verify_vmc off", modName)
+	}
+	if rootsPath != "" {
+		pemBlob, err := os.ReadFile(rootsPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		m.vmcRoots = x509.NewCertPool()
+		if !m.vmcRoots.AppendCertsFromPEM(pemBlob) {
+			return fmt.Errorf("%s: no certificates found in %s", modName, rootsPath)
+		}
+	}
+	m.client = &http.Client{Timeout: fetchTimeout}
+	return nil
+}
+
+// fetch downloads the HTTPS resource with the size limit.
+func (m *Modifier) fetch(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	blob, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(blob)) > limit {
+		return nil, fmt.Errorf("response is larger than %d bytes", limit)
+	}
+	return blob, nil
+}
+
+type state struct {
+	m    *Modifier
+	meta *module.MsgMetadata
+	log  log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		m:    m,
+		meta: msgMeta,
+		log:  target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(_ context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(_ context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+// evaluate returns the BIMI record to use for the message or nil if the
+// message is not eligible.
+func (s *state) evaluate(ctx context.Context, h textproto.Header) (*Record, error) {
+	if res, _ := s.meta.Annotations.GetString("dmarc.result"); res != "pass" {
+		s.log.DebugMsg("not eligible", "reason", "DMARC result is not pass", "dmarc", res)
+		return nil, nil
+	}
+
+	fromDomain, err := dmarc.ExtractFromDomain(h)
+	if err != nil {
+		return nil, nil
+	}
+	fromDomain, err = dns.ForLookup(fromDomain)
+	if err != nil {
+		return nil, nil
+	}
+
+	policyDomain, dmarcRec, err := dmarc.FetchRecord(ctx, s.m.resolver, fromDomain)
+	if err != nil {
+		return nil, fmt.Errorf("DMARC record lookup: %w", err)
+	}
+	if !policyEligible(fromDomain, policyDomain, dmarcRec) {
+		s.log.DebugMsg("not eligible", "reason", "DMARC policy is not enforced", "domain", fromDomain)
+		return nil, nil
+	}
+
+	selector := selectorFromHeader(h)
+	recDomain, rec, err := lookupRecord(ctx, s.m.resolver, selector, fromDomain)
+	if err != nil {
+		return nil, fmt.Errorf("BIMI record lookup: %w", err)
+	}
+	if rec == nil || rec.Declination() {
+		s.log.DebugMsg("not eligible", "reason", "no BIMI record", "domain", fromDomain, "selector", selector)
+		return nil, nil
+	}
+
+	if rec.Authority == "" {
+		if s.m.requireVMC {
+			s.log.DebugMsg("not eligible", "reason", "no VMC", "domain", recDomain)
+			return nil, nil
+		}
+		return rec, nil
+	}
+	if s.m.verifyVMC {
+		pemBlob, err := s.m.fetch(ctx, rec.Authority, maxVMCSize)
+		if err != nil {
+			return nil, fmt.Errorf("VMC fetch: %w", err)
+		}
+		if err := VerifyVMC(pemBlob, []string{fromDomain, recDomain}, s.m.vmcRoots, time.Now()); err != nil {
+			s.log.Msg("VMC verification failed", "domain", recDomain, "reason", err.Error())
+			return nil, nil
+		}
+	}
+	return rec, nil
+}
+
+// foldBase64 formats the value so that header lines stay within the line
+// length limit.
+func foldBase64(s string) string {
+	const lineLen = 76
+	var b strings.Builder
+	for len(s) > lineLen {
+		b.WriteString(s[:lineLen])
+		b.WriteString("\r\n ")
+		s = s[lineLen:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, _ buffer.Buffer) error {
+	// These fields are meant to be added only by the receiving system.
+	if h.Has("BIMI-Location") || h.Has("BIMI-Indicator") {
+		s.log.Msg("removed BIMI header fields added by the sender")
+		h.Del("BIMI-Location")
+		h.Del("BIMI-Indicator")
+	}
+
+	rec, err := s.evaluate(ctx, *h)
+	if err != nil {
+		// BIMI is purely cosmetic, do not fail the delivery.
+		s.log.Error("BIMI evaluation failed", err)
+		return nil
+	}
+	if rec == nil {
+		return nil
+	}
+
+	location := "v=BIMI1"
+	if rec.Location != "" {
+		location += "; l=" + rec.Location
+	}
+	if rec.Authority != "" {
+		location += "; a=" + rec.Authority
+	}
+
+	if s.m.fetchIndicator && rec.Location != "" {
+		svg, err := s.m.fetch(ctx, rec.Location, maxIndicatorSize)
+		if err != nil {
+			s.log.Error("indicator fetch failed", err, "url", rec.Location)
+			return nil
+		}
+		h.AddRaw([]byte("BIMI-Indicator: " + foldBase64(base64.StdEncoding.EncodeToString(svg)) + "\r\n"))
+	}
+	h.Add("BIMI-Location", location)
+
+	s.log.DebugMsg("BIMI header fields added", "location", rec.Location, "authority", rec.Authority)
+	return nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,292 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bimi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestParseRecord(t *testing.T) {
+	test := func(txt string, expected Record, fail bool) {
+		t.Helper()
+		rec, err := ParseRecord(txt)
+		if fail {
+			if err == nil {
+				t.Errorf("expected error for %q, got %+v", txt, rec)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", txt, err)
+			return
+		}
+		if rec != expected {
+			t.Errorf("wrong record for %q: want %+v, got %+v", txt, expected, rec)
+		}
+	}
+
+	test("v=BIMI1; l=https://example.org/logo.svg; a=https://example.org/vmc.pem",
+		Record{Location: "https://example.org/logo.svg", Authority: "https://example.org/vmc.pem"}, false)
+	test("v=BIMI1;l=https://example.org/logo.svg", Record{Location: "https://example.org/logo.svg"}, false)
+	test("v=BIMI1; l=; a=;", Record{}, false)
+	test("v=BIMI1; l=http://example.org/logo.svg", Record{}, true)
+	test("v=BIMI1; a=ftp://example.org/vmc.pem", Record{}, true)
+	test("v=BIMI2; l=https://example.org/logo.svg", Record{}, true)
+	test("v=spf1 -all", Record{}, true)
+	test("v=BIMI1; garbage", Record{}, true)
+}
+
+func TestSelectorFromHeader(t *testing.T) {
+	h := textproto.Header{}
+	if sel := selectorFromHeader(h); sel != "default" {
+		t.Error("wrong selector without header:", sel)
+	}
+	h.Set("BIMI-Selector", "v=BIMI1; s=Brand")
+	if sel := selectorFromHeader(h); sel != "brand" {
+		t.Error("wrong selector:", sel)
+	}
+	h.Set("BIMI-Selector", "s=brand")
+	if sel := selectorFromHeader(h); sel != "default" {
+		t.Error("wrong selector for header without version:", sel)
+	}
+}
+
+func testModifier(t *testing.T, zones map[string]mockdns.Zone, children ...config.Node) *Modifier {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, modName)
+	m.resolver = &mockdns.Resolver{Zones: zones}
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func rewriteTestMsg(t *testing.T, m *Modifier, dmarcRes string, h textproto.Header) textproto.Header {
+	t.Helper()
+
+	annotations := module.NewAnnotations()
+	annotations.SetString("dmarc.result", dmarcRes)
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:          "testing",
+		Annotations: annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if err := state.RewriteBody(context.Background(), &h, nil); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestModifier(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=reject"},
+		},
+		"default._bimi.example.org.": {
+			TXT: []string{"v=BIMI1; l=https://example.org/logo.svg"},
+		},
+		"brand._bimi.example.org.": {
+			TXT: []string{"v=BIMI1; l=https://example.org/brand.svg"},
+		},
+		"_dmarc.example.com.": {
+			TXT: []string{"v=DMARC1; p=none"},
+		},
+		"default._bimi.example.com.": {
+			TXT: []string{"v=BIMI1; l=https://example.com/logo.svg"},
+		},
+		"_dmarc.example.net.": {
+			TXT: []string{"v=DMARC1; p=quarantine; pct=50"},
+		},
+		"default._bimi.example.net.": {
+			TXT: []string{"v=BIMI1; l=https://example.net/logo.svg"},
+		},
+		"_dmarc.example.invalid.": {
+			TXT: []string{"v=DMARC1; p=reject"},
+		},
+		"default._bimi.example.invalid.": {
+			TXT: []string{"v=BIMI1; l=; a="},
+		},
+	}
+	m := testModifier(t, zones)
+
+	test := func(from, selector, dmarcRes, expected string) {
+		t.Helper()
+
+		h := textproto.Header{}
+		h.Add("From", "<test@"+from+">")
+		h.Add("BIMI-Location", "v=BIMI1; l=https://evil.example/logo.svg")
+		h.Add("BIMI-Indicator", "AAAA")
+		if selector != "" {
+			h.Add("BIMI-Selector", "v=BIMI1; s="+selector)
+		}
+		h = rewriteTestMsg(t, m, dmarcRes, h)
+
+		if h.Has("BIMI-Indicator") {
+			t.Errorf("%s: BIMI-Indicator is not removed", from)
+		}
+		if actual := h.Get("BIMI-Location"); actual != expected {
+			t.Errorf("%s: wrong BIMI-Location: want %q, got %q", from, expected, actual)
+		}
+		if len(h.Values("BIMI-Location")) > 1 {
+			t.Errorf("%s: multiple BIMI-Location fields", from)
+		}
+	}
+
+	test("example.org", "", "pass", "v=BIMI1; l=https://example.org/logo.svg")
+	test("sub.example.org", "", "pass", "v=BIMI1; l=https://example.org/logo.svg")
+	test("example.org", "brand", "pass", "v=BIMI1; l=https://example.org/brand.svg")
+	test("example.org", "", "fail", "")
+	test("example.org", "", "none", "")
+	test("example.com", "", "pass", "")
+	test("example.net", "", "pass", "")
+	test("example.invalid", "", "pass", "")
+	test("example.test", "", "pass", "")
+}
+
+func TestModifier_RequireVMC(t *testing.T) {
+	m := testModifier(t, map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=reject"},
+		},
+		"default._bimi.example.org.": {
+			TXT: []string{"v=BIMI1; l=https://example.org/logo.svg"},
+		},
+	}, config.Node{Name: "require_vmc", Args: []string{"yes"}})
+
+	h := textproto.Header{}
+	h.Add("From", "<test@example.org>")
+	h = rewriteTestMsg(t, m, "pass", h)
+	if h.Has("BIMI-Location") {
+		t.Error("BIMI-Location added for record without VMC")
+	}
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test VMC CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca testCA) issue(t *testing.T, domains []string, ekus []asn1.ObjectIdentifier) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "Test Brand"},
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(time.Hour),
+		DNSNames:           domains,
+		UnknownExtKeyUsage: ekus,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestVerifyVMC(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+
+	vmc := ca.issue(t, []string{"example.org"}, []asn1.ObjectIdentifier{oidBrandIndicator})
+	if err := VerifyVMC(vmc, []string{"example.org"}, ca.pool, now); err != nil {
+		t.Error("valid VMC rejected:", err)
+	}
+	if err := VerifyVMC(vmc, []string{"sub.example.org", "example.org"}, ca.pool, now); err != nil {
+		t.Error("valid VMC for organizational domain rejected:", err)
+	}
+	if err := VerifyVMC(vmc, []string{"example.com"}, ca.pool, now); err == nil {
+		t.Error("VMC accepted for wrong domain")
+	}
+	if err := VerifyVMC(vmc, []string{"example.org"}, ca.pool, now.Add(2*time.Hour)); err == nil {
+		t.Error("expired VMC accepted")
+	}
+	if err := VerifyVMC(vmc, []string{"example.org"}, newTestCA(t).pool, now); err == nil {
+		t.Error("VMC from untrusted CA accepted")
+	}
+
+	noEKU := ca.issue(t, []string{"example.org"}, nil)
+	if err := VerifyVMC(noEKU, []string{"example.org"}, ca.pool, now); err == nil {
+		t.Error("certificate without Brand Indicator EKU accepted")
+	}
+
+	if err := VerifyVMC([]byte("garbage"), []string{"example.org"}, ca.pool, now); err == nil {
+		t.Error("garbage accepted")
+	}
+}
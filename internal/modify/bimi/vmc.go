@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bimi
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// oidBrandIndicator is the id-kp-BrandIndicatorforMessageIdentification
+// extended key usage that VMCs must have.
+var oidBrandIndicator = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 31}
+
+func parsePEMChain(pemBlob []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBlob = pem.Decode(pemBlob)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+func hasBrandIndicatorEKU(cert *x509.Certificate) bool {
+	for _, oid := range cert.UnknownExtKeyUsage {
+		if oid.Equal(oidBrandIndicator) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyVMC checks the Verified Mark Certificate chain in PEM format. The
+// first certificate is the VMC itself, the rest are intermediates. The VMC
+// should be valid for one of the domains. If roots is nil, system roots are
+// used.
+func VerifyVMC(pemBlob []byte, domains []string, roots *x509.CertPool, now time.Time) error {
+	certs, err := parsePEMChain(pemBlob)
+	if err != nil {
+		return err
+	}
+	leaf := certs[0]
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		// Brand Indicator EKU is not known to crypto/x509, checked below.
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return err
+	}
+
+	if !hasBrandIndicatorEKU(leaf) {
+		return errors.New("certificate is not a VMC: missing Brand Indicator extended key usage")
+	}
+
+	for _, domain := range domains {
+		for _, name := range leaf.DNSNames {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), domain) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate is not valid for %v", domains)
+}
@@ -24,9 +24,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -34,6 +34,7 @@ import (
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -93,29 +94,70 @@ var (
 	}
 )
 
+// signingKey is a private key used to sign messages for a domain.
+type signingKey struct {
+	selector string
+	signer   crypto.Signer
+}
+
 type Modifier struct {
 	instName string
 
-	domains        []string
-	selector       string
-	signers        map[string]crypto.Signer
-	oversignHeader []string
-	signHeader     []string
-	headerCanon    dkim.Canonicalization
-	bodyCanon      dkim.Canonicalization
-	sigExpiry      time.Duration
-	hash           crypto.Hash
-	multipleFromOk bool
-	signSubdomains bool
+	domains         []string
+	selectors       []string
+	newKeyAlgos     []string
+	keyPathTemplate string
+	oversignHeader  []string
+	signHeader      []string
+	headerCanon     dkim.Canonicalization
+	bodyCanon       dkim.Canonicalization
+	sigExpiry       time.Duration
+	signTimestamp   bool
+	hash            crypto.Hash
+	multipleFromOk  bool
+	signSubdomains  bool
+
+	// bodyLength controls the l= tag: zero disables it, bodyLengthFull
+	// covers the whole body and positive values limit the amount of signed
+	// body octets.
+	bodyLength int64
+
+	// signingTable selects the signing domain and selectors using
+	// lookup keys built from signingKeys templates.
+	signingTable module.Table
+	signingKeys  []string
+
+	// domainCanon overrides canonicalization for specific domains.
+	domainCanon map[string]canonPair
+
+	// selectorTable maps domains to the lists of selectors to use
+	// instead of the configured ones.
+	selectorTable module.Table
+
+	keysLock sync.RWMutex
+	// keys contains signing keys for each configured domain, keyed by
+	// the normalized domain name.
+	keys map[string][]signingKey
+	// tableKeys contains keys loaded for selectors returned by
+	// selectorTable, keyed by "domain/selector".
+	tableKeys map[string]signingKey
+
+	rotateInterval        time.Duration
+	rotateGrace           time.Duration
+	rotateOverlap         time.Duration
+	rotateWebhook         string
+	rotationStateTemplate string
+	stopRotation          chan struct{}
 
 	log log.Logger
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
-		instName: instName,
-		signers:  map[string]crypto.Signer{},
-		log:      log.Logger{Name: "modify.dkim"},
+		instName:  instName,
+		keys:      map[string][]signingKey{},
+		tableKeys: map[string]signingKey{},
+		log:       log.Logger{Name: "modify.dkim"},
 	}
 
 	if len(inlineArgs) == 0 {
@@ -126,7 +168,7 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	}
 
 	m.domains = inlineArgs[0 : len(inlineArgs)-1]
-	m.selector = inlineArgs[len(inlineArgs)-1]
+	m.selectors = []string{inlineArgs[len(inlineArgs)-1]}
 
 	return m, nil
 }
@@ -140,16 +182,12 @@ func (m *Modifier) InstanceName() string {
 }
 
 func (m *Modifier) Init(cfg *config.Map) error {
-	var (
-		hashName        string
-		keyPathTemplate string
-		newKeyAlgo      string
-	)
+	var hashName string
 
 	cfg.Bool("debug", true, false, &m.log.Debug)
 	cfg.StringList("domains", false, false, m.domains, &m.domains)
-	cfg.String("selector", false, false, m.selector, &m.selector)
-	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.StringList("selector", false, false, m.selectors, &m.selectors)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &m.keyPathTemplate)
 	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
 	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
 	cfg.Enum("header_canon", false, false,
@@ -159,23 +197,50 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		[]string{string(dkim.CanonicalizationRelaxed), string(dkim.CanonicalizationSimple)},
 		dkim.CanonicalizationRelaxed, (*string)(&m.bodyCanon))
 	cfg.Duration("sig_expiry", false, false, 5*Day, &m.sigExpiry)
+	cfg.Bool("sign_timestamp", false, true, &m.signTimestamp)
+	cfg.Custom("body_length", false, false, func() (interface{}, error) {
+		return int64(0), nil
+	}, bodyLengthDirective, &m.bodyLength)
+	cfg.Callback("domain_canon", func(_ *config.Map, node config.Node) error {
+		return m.domainCanonDirective(node)
+	})
 	cfg.Enum("hash", false, false,
 		[]string{"sha256"}, "sha256", &hashName)
-	cfg.Enum("newkey_algo", false, false,
-		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+	cfg.EnumList("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048", "ed25519"}, []string{"rsa2048"}, &m.newKeyAlgos)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	cfg.Custom("selector_table", false, false, nil, modconfig.TableDirective, &m.selectorTable)
+	cfg.Custom("signing_table", false, false, nil, modconfig.TableDirective, &m.signingTable)
+	cfg.StringList("signing_keys", false, false, defaultSigningKeys, &m.signingKeys)
+	cfg.Duration("rotate_interval", false, false, 0, &m.rotateInterval)
+	cfg.Duration("rotate_grace", false, false, 3*Day, &m.rotateGrace)
+	cfg.Duration("rotate_overlap", false, false, 3*Day, &m.rotateOverlap)
+	cfg.String("rotate_webhook", false, false, "", &m.rotateWebhook)
+	cfg.String("rotation_state", false, false, "dkim_keys/{domain}_rotation.json", &m.rotationStateTemplate)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	if len(m.domains) == 0 {
+	if len(m.domains) == 0 && m.selectorTable == nil && m.signingTable == nil {
 		return errors.New("sign_domain: at least one domain is needed")
 	}
-	if m.selector == "" {
+	if len(m.selectors) == 0 && (len(m.domains) != 0 || m.signingTable == nil) {
 		return errors.New("sign_domain: selector is not specified")
 	}
+	if len(m.newKeyAlgos) != 1 && len(m.newKeyAlgos) != len(m.selectors) {
+		return errors.New("sign_domain: newkey_algo should specify either one algorithm or one per selector")
+	}
+	if len(m.selectors) > 1 && !strings.Contains(m.keyPathTemplate, "{selector}") {
+		return errors.New("sign_domain: key_path should contain {selector} if multiple selectors are used")
+	}
+	if m.rotationEnabled() && !strings.Contains(m.keyPathTemplate, "{selector}") {
+		return errors.New("sign_domain: key_path should contain {selector} if key rotation is enabled")
+	}
+	if m.rotationEnabled() && m.rotateInterval <= m.rotateGrace {
+		return errors.New("sign_domain: rotate_interval should be longer than rotate_grace")
+	}
 	if m.signSubdomains && len(m.domains) > 1 {
 		return errors.New("sign_domain: only one domain is supported when sign_subdomains is enabled")
 	}
@@ -190,34 +255,197 @@ func (m *Modifier) Init(cfg *config.Map) error {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
 
-		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(keyPathTemplate)
-
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+		normDomain, err := dns.ForLookup(domain)
 		if err != nil {
-			return err
+			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
 		}
 
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		for i, selector := range m.selectors {
+			newKeyAlgo := m.newKeyAlgo(i)
+
+			keyPath := m.keyPath(domain, selector)
+			signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+			if err != nil {
+				return err
+			}
+
+			if newKey {
+				m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+					"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+					newKeyAlgo, keyPath, dnsPath(keyPath), selector, domain)
 			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
+
+			m.keys[normDomain] = append(m.keys[normDomain], signingKey{
+				selector: selector,
+				signer:   signer,
+			})
 		}
+	}
 
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+	if m.rotationEnabled() && !module.NoRun {
+		for _, domain := range m.domains {
+			if err := m.rotateDomain(domain, false, false); err != nil {
+				return fmt.Errorf("modify.dkim: key rotation for %s: %w", domain, err)
+			}
 		}
-		m.signers[normDomain] = signer
+		m.stopRotation = make(chan struct{})
+		go m.rotationLoop()
 	}
 
 	return nil
 }
 
+// canonPair is the header and body canonicalization used for a domain.
+type canonPair struct {
+	header dkim.Canonicalization
+	body   dkim.Canonicalization
+}
+
+func parseCanon(s string) (dkim.Canonicalization, error) {
+	switch c := dkim.Canonicalization(s); c {
+	case dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown canonicalization: %s", s)
+	}
+}
+
+func (m *Modifier) domainCanonDirective(node config.Node) error {
+	if len(node.Children) != 0 {
+		return config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) != 2 {
+		return config.NodeErr(node, "expected exactly two arguments")
+	}
+	domain, err := dns.ForLookup(node.Args[0])
+	if err != nil {
+		return config.NodeErr(node, "invalid domain: %v", err)
+	}
+
+	// Same syntax as c= tag: header/body or a single value for both.
+	headerCanon, bodyCanon, ok := strings.Cut(node.Args[1], "/")
+	if !ok {
+		bodyCanon = headerCanon
+	}
+	var pair canonPair
+	if pair.header, err = parseCanon(headerCanon); err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+	if pair.body, err = parseCanon(bodyCanon); err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+
+	if m.domainCanon == nil {
+		m.domainCanon = make(map[string]canonPair)
+	}
+	if _, ok := m.domainCanon[domain]; ok {
+		return config.NodeErr(node, "duplicate domain_canon for %s", domain)
+	}
+	m.domainCanon[domain] = pair
+	return nil
+}
+
+// canonFor returns header and body canonicalization to use for the domain.
+func (m *Modifier) canonFor(normDomain string) (dkim.Canonicalization, dkim.Canonicalization) {
+	if pair, ok := m.domainCanon[normDomain]; ok {
+		return pair.header, pair.body
+	}
+	return m.headerCanon, m.bodyCanon
+}
+
+func bodyLengthDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Children) != 0 {
+		return nil, config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	switch node.Args[0] {
+	case "off":
+		return int64(0), nil
+	case "full":
+		return int64(bodyLengthFull), nil
+	}
+	size, err := config.ParseDataSize(node.Args[0])
+	if err != nil || size <= 0 {
+		return nil, config.NodeErr(node, "invalid body length: %v", node.Args[0])
+	}
+	return int64(size), nil
+}
+
+// newKeyAlgo returns the algorithm to use for new keys of the i-th
+// configured selector.
+func (m *Modifier) newKeyAlgo(i int) string {
+	if len(m.newKeyAlgos) > 1 {
+		return m.newKeyAlgos[i]
+	}
+	return m.newKeyAlgos[0]
+}
+
+func (m *Modifier) keyPath(domain, selector string) string {
+	keyValues := strings.NewReplacer("{domain}", domain, "{selector}", selector)
+	return keyValues.Replace(m.keyPathTemplate)
+}
+
+// domainKeys returns the keys that should be used to sign the message for the
+// domain.
+//
+// If selector_table is used and contains the domain, keys for listed
+// selectors are loaded on the first use. Missing keys are not generated and
+// corresponding selectors are skipped.
+func (m *Modifier) domainKeys(ctx context.Context, normDomain string) ([]signingKey, error) {
+	if m.selectorTable != nil {
+		value, ok, err := m.selectorTable.Lookup(ctx, normDomain)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return m.selectorKeys(normDomain, strings.Fields(value)), nil
+		}
+	}
+
+	m.keysLock.RLock()
+	defer m.keysLock.RUnlock()
+	return m.keys[normDomain], nil
+}
+
+// selectorKeys loads keys for the listed selectors of the domain. Missing keys
+// are not generated and corresponding selectors are skipped.
+func (m *Modifier) selectorKeys(normDomain string, selectors []string) []signingKey {
+	keys := make([]signingKey, 0, len(selectors))
+	for _, selector := range selectors {
+		key, err := m.tableKey(normDomain, selector)
+		if err != nil {
+			m.log.Error("unable to load key", err, "domain", normDomain, "selector", selector)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (m *Modifier) tableKey(normDomain, selector string) (signingKey, error) {
+	cacheKey := normDomain + "/" + selector
+
+	m.keysLock.RLock()
+	key, ok := m.tableKeys[cacheKey]
+	m.keysLock.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	signer, err := loadKey(m.keyPath(normDomain, selector))
+	if err != nil {
+		return signingKey{}, fmt.Errorf("modify.dkim: no key for selector %s of %s: %w", selector, normDomain, err)
+	}
+	key = signingKey{selector: selector, signer: signer}
+
+	m.keysLock.Lock()
+	m.tableKeys[cacheKey] = key
+	m.keysLock.Unlock()
+	return key, nil
+}
+
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
@@ -278,33 +506,63 @@ func (s state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error)
 func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "modify.dkim/RewriteBody").End()
 
-	var domain string
-	if s.from != "" {
+	var (
+		rule      signingRule
+		ruleFound bool
+	)
+	if s.m.signingTable != nil {
 		var err error
-		_, domain, err = address.Split(s.from)
+		rule, ruleFound, err = s.signingRule(ctx, h)
 		if err != nil {
-			return err
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+		if rule.skip {
+			s.log.DebugMsg("signing disabled by signing_table")
+			return nil
 		}
 	}
-	// Use first key for null return path (<>) and postmaster (<postmaster>)
-	if domain == "" {
-		domain = s.m.domains[0]
-	}
-	selector := s.m.selector
 
-	if s.m.signSubdomains {
-		topDomain := s.m.domains[0]
-		if strings.HasSuffix(domain, "."+topDomain) {
-			domain = topDomain
+	var domain string
+	if ruleFound {
+		domain = rule.domain
+	} else {
+		if s.from != "" {
+			var err error
+			_, domain, err = address.Split(s.from)
+			if err != nil {
+				return err
+			}
+		}
+		// Use first key for null return path (<>) and postmaster (<postmaster>)
+		if domain == "" {
+			if len(s.m.domains) == 0 {
+				return nil
+			}
+			domain = s.m.domains[0]
+		}
+
+		if s.m.signSubdomains {
+			topDomain := s.m.domains[0]
+			if strings.HasSuffix(domain, "."+topDomain) {
+				domain = topDomain
+			}
 		}
 	}
 	normDomain, err := dns.ForLookup(domain)
 	if err != nil {
-		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
+		s.log.Error("unable to normalize signing domain", err, "domain", domain)
 		return nil
 	}
-	keySigner := s.m.signers[normDomain]
-	if keySigner == nil {
+	var keys []signingKey
+	if ruleFound && len(rule.selectors) != 0 {
+		keys = s.m.selectorKeys(normDomain, rule.selectors)
+	} else {
+		keys, err = s.m.domainKeys(ctx, normDomain)
+		if err != nil {
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+	}
+	if len(keys) == 0 {
 		s.log.Msg("no key for domain", "domain", normDomain)
 		return nil
 	}
@@ -317,51 +575,148 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		if err != nil {
 			return nil
 		}
+	}
 
-		selector, err = idna.ToASCII(selector)
-		if err != nil {
-			return nil
+	// All signatures are computed in a single pass over the message, so
+	// neither of them covers the other.
+	headerKeys := s.m.fieldsToSign(h)
+	headerCanon, bodyCanon := s.m.canonFor(normDomain)
+	if s.m.bodyLength != 0 || !s.m.signTimestamp {
+		return s.signRaw(h, body, domain, keys, headerKeys, headerCanon, bodyCanon)
+	}
+
+	signers := make([]*dkim.Signer, 0, len(keys))
+	writers := make([]io.Writer, 0, len(keys))
+	closeAll := func() {
+		for _, signer := range signers {
+			signer.Close()
 		}
 	}
+	for _, key := range keys {
+		selector := key.selector
+		if !s.meta.SMTPOpts.UTF8 {
+			selector, err = idna.ToASCII(selector)
+			if err != nil {
+				continue
+			}
+		}
 
-	opts := dkim.SignOptions{
-		Domain:                 domain,
-		Selector:               selector,
-		Identifier:             "@" + domain,
-		Signer:                 keySigner,
-		Hash:                   s.m.hash,
-		HeaderCanonicalization: s.m.headerCanon,
-		BodyCanonicalization:   s.m.bodyCanon,
-		HeaderKeys:             s.m.fieldsToSign(h),
+		opts := dkim.SignOptions{
+			Domain:                 domain,
+			Selector:               selector,
+			Identifier:             "@" + domain,
+			Signer:                 key.signer,
+			Hash:                   s.m.hash,
+			HeaderCanonicalization: headerCanon,
+			BodyCanonicalization:   bodyCanon,
+			HeaderKeys:             headerKeys,
+		}
+		if s.m.sigExpiry != 0 {
+			opts.Expiration = time.Now().Add(s.m.sigExpiry)
+		}
+		signer, err := dkim.NewSigner(&opts)
+		if err != nil {
+			closeAll()
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+		signers = append(signers, signer)
+		writers = append(writers, signer)
 	}
-	if s.m.sigExpiry != 0 {
-		opts.Expiration = time.Now().Add(s.m.sigExpiry)
+	if len(signers) == 0 {
+		return nil
+	}
+
+	w := io.MultiWriter(writers...)
+	if err := textproto.WriteHeader(w, *h); err != nil {
+		closeAll()
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
-	signer, err := dkim.NewSigner(&opts)
+	r, err := body.Open()
 	if err != nil {
+		closeAll()
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
-	if err := textproto.WriteHeader(signer, *h); err != nil {
-		signer.Close()
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		closeAll()
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
+
+	for _, signer := range signers {
+		if err := signer.Close(); err != nil {
+			closeAll()
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+	}
+	for _, signer := range signers {
+		h.AddRaw([]byte(signer.Signature()))
+	}
+
+	s.m.log.DebugMsg("signed", "domain", domain, "signatures", len(signers))
+
+	return nil
+}
+
+// signRaw signs the message using the built-in signer. It is used when
+// options not supported by go-msgauth are enabled.
+func (s *state) signRaw(h *textproto.Header, body buffer.Buffer, domain string, keys []signingKey,
+	headerKeys []string, headerCanon, bodyCanon dkim.Canonicalization,
+) error {
 	r, err := body.Open()
 	if err != nil {
-		signer.Close()
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
-	if _, err := io.Copy(signer, r); err != nil {
-		signer.Close()
+	limit := int64(-1)
+	if s.m.bodyLength > 0 {
+		limit = s.m.bodyLength
+	}
+	bh, bodyLen, err := bodyHash(r, bodyCanon, s.m.hash, limit)
+	r.Close()
+	if err != nil {
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
 
-	if err := signer.Close(); err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+	opts := rawSignOptions{
+		domain:      domain,
+		identifier:  "@" + domain,
+		hash:        s.m.hash,
+		headerCanon: headerCanon,
+		bodyCanon:   bodyCanon,
+		headerKeys:  headerKeys,
+	}
+	if s.m.bodyLength != 0 {
+		opts.bodyLength = bodyLen
+	}
+	now := time.Now()
+	if s.m.signTimestamp {
+		opts.timestamp = now
+	}
+	if s.m.sigExpiry != 0 {
+		opts.expiration = now.Add(s.m.sigExpiry)
 	}
 
-	h.AddRaw([]byte(signer.Signature()))
+	sigs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		opts.selector = key.selector
+		if !s.meta.SMTPOpts.UTF8 {
+			opts.selector, err = idna.ToASCII(key.selector)
+			if err != nil {
+				continue
+			}
+		}
+		opts.signer = key.signer
+
+		sig, err := rawSign(opts, *h, bh)
+		if err != nil {
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+		sigs = append(sigs, sig)
+	}
+	for _, sig := range sigs {
+		h.AddRaw([]byte(sig))
+	}
 
-	s.m.log.DebugMsg("signed", "domain", domain)
+	s.m.log.DebugMsg("signed", "domain", domain, "signatures", len(sigs), "body_length", opts.bodyLength)
 
 	return nil
 }
@@ -243,3 +243,135 @@ func TestFieldsToSign(t *testing.T) {
 		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
 	}
 }
+
+func TestDualSign(t *testing.T) {
+	dir := t.TempDir()
+
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "domains",
+				Args: []string{"maddy.test"},
+			},
+			{
+				Name: "selector",
+				Args: []string{"rsa", "ed"},
+			},
+			{
+				Name: "key_path",
+				Args: []string{filepath.Join(dir, "{domain}_{selector}.key")},
+			},
+			{
+				Name: "newkey_algo",
+				Args: []string{"rsa2048", "ed25519"},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testHdr, body := signTestMsg(t, m, "test@maddy.test")
+
+	zones := map[string]mockdns.Zone{}
+	for _, selector := range []string{"rsa", "ed"} {
+		dnsRecord, err := os.ReadFile(filepath.Join(dir, "maddy.test_"+selector+".dns"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zones[selector+"._domainkey.maddy.test."] = mockdns.Zone{TXT: []string{string(dnsRecord)}}
+	}
+
+	var fullBody bytes.Buffer
+	if err := textproto.WriteHeader(&fullBody, testHdr); err != nil {
+		t.Fatal(err)
+	}
+	fullBody.Write(body)
+
+	resolver := &mockdns.Resolver{Zones: zones}
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(fullBody.Bytes()), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return resolver.LookupTXT(context.Background(), domain)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != 2 {
+		t.Fatalf("expected 2 signatures, got %d", len(verifs))
+	}
+	for _, v := range verifs {
+		if v.Err != nil {
+			t.Errorf("Verification error for %s: %v", v.Domain, v.Err)
+		}
+	}
+}
+
+func TestSelectorTable(t *testing.T) {
+	dir := t.TempDir()
+
+	// Generate the key for the table selector beforehand, keys for
+	// selectors from the table are never generated.
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.selectorTable = testutils.Table{M: map[string]string{"maddy.test": "default"}}
+	m.keys = map[string][]signingKey{}
+	m.keyPathTemplate = filepath.Join(dir, "{domain}_{selector}.key")
+	if err := os.Rename(filepath.Join(dir, "maddy.test.key"), filepath.Join(dir, "maddy.test_default.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	testHdr, body := signTestMsg(t, m, "test@maddy.test")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+
+	m.selectorTable = testutils.Table{M: map[string]string{"maddy.test": "missing"}}
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("From", "<test@maddy.test>")
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Has("DKIM-Signature") {
+		t.Error("message should not be signed if the key is missing")
+	}
+}
+
+func TestSigningTable(t *testing.T) {
+	dir := t.TempDir()
+
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test", "other.maddy.test"})
+	m.signingTable = testutils.Table{M: map[string]string{
+		"forwarder@example.org": "other.maddy.test",
+		"example.net":           "off",
+		"hello":                 "maddy.test",
+	}}
+
+	testHdr, body := signTestMsg(t, m, "forwarder@example.org")
+	verifyTestMsg(t, dir, []string{"other.maddy.test"}, testHdr, body)
+
+	testHdr, _ = signTestMsg(t, m, "test@example.net")
+	if testHdr.Has("DKIM-Signature") {
+		t.Error("message should not be signed if disabled by signing_table")
+	}
+
+	// No match, envelope sender domain is used as usual.
+	testHdr, body = signTestMsg(t, m, "test@maddy.test")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+
+	// From header domain of the test message is "hello".
+	m.signingKeys = []string{"{from_domain}"}
+	testHdr, body = signTestMsg(t, m, "test@unrelated.test")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+}
@@ -27,31 +27,57 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/foxcpp/maddy/framework/secrets"
 )
 
 func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
-	f, err := os.Open(keyPath)
+	pkey, err = loadKey(keyPath)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			pkey, err = m.generateAndWrite(keyPath, newKeyAlgo)
 			return pkey, true, err
 		}
 		return nil, false, err
 	}
-	defer f.Close()
+	return pkey, false, nil
+}
 
-	pemBlob, err := io.ReadAll(f)
-	if err != nil {
-		return nil, false, err
+// loadKey reads the private key from the file. The returned error
+// wraps os.ErrNotExist if the file does not exist.
+//
+// keyPath can also contain the key itself if it was loaded from the secret
+// store.
+func loadKey(keyPath string) (crypto.Signer, error) {
+	var (
+		pemBlob []byte
+		err     error
+	)
+	if secrets.IsInlinePEM(keyPath) {
+		pemBlob = []byte(keyPath)
+		keyPath = "inline key"
+	} else {
+		var f *os.File
+		f, err = os.Open(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		pemBlob, err = io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	block, _ := pem.Decode(pemBlob)
 	if block == nil {
-		return nil, false, fmt.Errorf("modify.dkim: %s: invalid PEM block", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: invalid PEM block", keyPath)
 	}
 
 	var key interface{}
@@ -59,35 +85,35 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 	case "PRIVATE KEY": // RFC 5208 aka PKCS #8
 		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	case "RSA PRIVATE KEY": // RFC 3447 aka PKCS #1
 		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	case "EC PRIVATE KEY": // RFC 5915
 		key, err = x509.ParseECPrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: not a private key or unsupported format", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: not a private key or unsupported format", keyPath)
 	}
 
 	switch key := key.(type) {
 	case *rsa.PrivateKey:
 		if err := key.Validate(); err != nil {
-			return nil, false, err
+			return nil, err
 		}
 		key.Precompute()
-		return key, false, nil
+		return key, nil
 	case ed25519.PrivateKey:
-		return key, false, nil
+		return key, nil
 	case *ecdsa.PublicKey:
-		return nil, false, fmt.Errorf("modify.dkim: %s: ECDSA keys are not supported", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: ECDSA keys are not supported", keyPath)
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: unknown key type: %T", keyPath, key)
+		return nil, fmt.Errorf("modify.dkim: %s: unknown key type: %T", keyPath, key)
 	}
 }
 
@@ -99,16 +125,13 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
-		pkey     crypto.Signer
-		dkimName = newKeyAlgo
-		err      error
+		pkey crypto.Signer
+		err  error
 	)
 	switch newKeyAlgo {
 	case "rsa4096":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
 	case "rsa2048":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
 	case "ed25519":
 		_, pkey, err = ed25519.GenerateKey(rand.Reader)
@@ -130,7 +153,7 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 		return nil, wrapErr(err)
 	}
 
-	_, err = writeDNSRecord(keyPath, dkimName, pkey)
+	_, err = writeDNSRecord(keyPath, pkey)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
@@ -150,10 +173,38 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	return pkey, nil
 }
 
-func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
+// dnsPath returns the path of the file with the DNS record for the key.
+func dnsPath(keyPath string) string {
+	if filepath.Ext(keyPath) == ".key" {
+		return keyPath[:len(keyPath)-4] + ".dns"
+	}
+	return keyPath + ".dns"
+}
+
+func writeDNSRecord(keyPath string, pkey crypto.Signer) (string, error) {
+	keyRecord, err := dkimRecord(pkey)
+	if err != nil {
+		return "", err
+	}
+
+	dnsPath := dnsPath(keyPath)
+	dnsF, err := os.Create(dnsPath)
+	if err != nil {
+		return "", err
+	}
+	defer dnsF.Close()
+	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
+		return "", err
+	}
+	return dnsPath, nil
+}
+
+// dkimRecord returns the value of the DNS TXT record with the public key.
+func dkimRecord(pkey crypto.Signer) (string, error) {
 	var (
-		keyBlob []byte
-		pubkey  = pkey.Public()
+		keyBlob  []byte
+		algoName string
+		pubkey   = pkey.Public()
 	)
 	switch pubkey := pubkey.(type) {
 	case *rsa.PublicKey:
@@ -162,23 +213,13 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 		if err != nil {
 			return "", err
 		}
+		algoName = "rsa"
 	case ed25519.PublicKey:
 		keyBlob = pubkey
+		algoName = "ed25519"
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		return "", fmt.Errorf("modify.dkim: unknown key algorithm: %T", pubkey)
 	}
 
-	dnsPath := keyPath + ".dns"
-	if filepath.Ext(keyPath) == ".key" {
-		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-	}
-	dnsF, err := os.Create(dnsPath)
-	if err != nil {
-		return "", err
-	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
-	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
-		return "", err
-	}
-	return dnsPath, nil
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", algoName, base64.StdEncoding.EncodeToString(keyBlob)), nil
 }
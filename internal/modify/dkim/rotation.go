@@ -0,0 +1,404 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// rotationCheckInterval is how often the rotation state is checked and
+// advanced.
+const rotationCheckInterval = time.Hour
+
+// rotationState is the persistent state of key rotation for a domain.
+//
+// It is stored as a JSON file and re-read on each check, so changes made
+// using maddy dkim commands are picked up by the running server.
+type rotationState struct {
+	Slots []*rotationSlot `json:"slots"`
+}
+
+// rotationSlot tracks keys used in place of a single configured selector.
+//
+// The new key is generated as pending and is not used until the grace
+// period passes, giving time to publish the DNS record. Then it becomes
+// current and the previous key is used together with it until
+// RetireAfter.
+type rotationSlot struct {
+	// Base is the configured selector, names of new selectors are derived
+	// from it.
+	Base string `json:"base"`
+	Algo string `json:"algo"`
+
+	Current        string    `json:"current"`
+	CurrentCreated time.Time `json:"current_created"`
+
+	Pending        string    `json:"pending,omitempty"`
+	PendingCreated time.Time `json:"pending_created,omitempty"`
+
+	Retiring    string    `json:"retiring,omitempty"`
+	RetireAfter time.Time `json:"retire_after,omitempty"`
+}
+
+// DNSRecord describes the DKIM public key record that should be published
+// in DNS.
+type DNSRecord struct {
+	Domain   string
+	Selector string
+	Value    string
+
+	// State is "active", "pending" or "retiring". Pending and retiring
+	// records are used only if rotation is enabled.
+	State string
+}
+
+// Name returns the domain name the record should be published at.
+func (r DNSRecord) Name() string {
+	return r.Selector + "._domainkey." + r.Domain
+}
+
+func (m *Modifier) rotationEnabled() bool {
+	return m.rotateInterval != 0
+}
+
+func (m *Modifier) rotationStatePath(domain string) string {
+	return strings.NewReplacer("{domain}", domain).Replace(m.rotationStateTemplate)
+}
+
+func (m *Modifier) loadRotationState(domain string) (*rotationState, error) {
+	st := &rotationState{}
+	blob, err := os.ReadFile(m.rotationStatePath(domain))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(blob, st); err != nil {
+			return nil, fmt.Errorf("modify.dkim: malformed rotation state for %s: %w", domain, err)
+		}
+	}
+
+	// Add slots for selectors that were not configured before.
+	for i, selector := range m.selectors {
+		found := false
+		for _, slot := range st.Slots {
+			if slot.Base == selector {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		created := time.Now()
+		if info, err := os.Stat(m.keyPath(domain, selector)); err == nil {
+			created = info.ModTime()
+		}
+		st.Slots = append(st.Slots, &rotationSlot{
+			Base:           selector,
+			Algo:           m.newKeyAlgo(i),
+			Current:        selector,
+			CurrentCreated: created,
+		})
+	}
+
+	return st, nil
+}
+
+func (m *Modifier) saveRotationState(domain string, st *rotationState) error {
+	path := m.rotationStatePath(domain)
+	blob, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// advance moves the slot to the next rotation stage if it is time to do so.
+//
+// If force is set, a new pending key is generated regardless of the current
+// key age. If activate is set, the pending key is used immediately.
+func (m *Modifier) advance(domain string, slot *rotationSlot, now time.Time, force, activate bool) (bool, error) {
+	changed := false
+
+	if slot.Retiring != "" && !now.Before(slot.RetireAfter) {
+		m.log.Msg("retired DKIM key, its DNS record can be removed", "domain", domain, "selector", slot.Retiring)
+		slot.Retiring = ""
+		slot.RetireAfter = time.Time{}
+		changed = true
+	}
+
+	if slot.Pending == "" && (force || now.Sub(slot.CurrentCreated) >= m.rotateInterval) {
+		selector := slot.Base + "-" + now.UTC().Format("20060102150405")
+		keyPath := m.keyPath(domain, selector)
+		pkey, err := m.generateAndWrite(keyPath, slot.Algo)
+		if err != nil {
+			return changed, err
+		}
+		record, err := dkimRecord(pkey)
+		if err != nil {
+			return changed, err
+		}
+
+		slot.Pending = selector
+		slot.PendingCreated = now
+		changed = true
+
+		m.log.Msg("generated a new DKIM key, publish the TXT record before it is used",
+			"domain", domain, "selector", selector, "record_name", selector+"._domainkey."+domain,
+			"record_file", dnsPath(keyPath), "used_after", now.Add(m.rotateGrace))
+		m.notifyRotation(DNSRecord{Domain: domain, Selector: selector, Value: record, State: "pending"})
+	}
+
+	if slot.Pending != "" && (activate || now.Sub(slot.PendingCreated) >= m.rotateGrace) {
+		if slot.Retiring != "" {
+			m.log.Msg("retired DKIM key, its DNS record can be removed", "domain", domain, "selector", slot.Retiring)
+		}
+		slot.Retiring = slot.Current
+		slot.RetireAfter = now.Add(m.rotateOverlap)
+		slot.Current = slot.Pending
+		slot.CurrentCreated = slot.PendingCreated
+		slot.Pending = ""
+		slot.PendingCreated = time.Time{}
+		changed = true
+
+		m.log.Msg("started using the new DKIM key", "domain", domain, "selector", slot.Current,
+			"old_selector", slot.Retiring, "old_retired_after", slot.RetireAfter)
+	}
+
+	return changed, nil
+}
+
+// rotateDomain checks the rotation state for the domain, advances it if
+// needed and updates keys used for signing.
+func (m *Modifier) rotateDomain(domain string, force, activate bool) error {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return err
+	}
+
+	st, err := m.loadRotationState(domain)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	changed := false
+	for _, slot := range st.Slots {
+		slotChanged, err := m.advance(domain, slot, now, force, activate)
+		changed = changed || slotChanged
+		if err != nil {
+			if changed {
+				if saveErr := m.saveRotationState(domain, st); saveErr != nil {
+					m.log.Error("failed to save rotation state", saveErr, "domain", domain)
+				}
+			}
+			return err
+		}
+	}
+	if changed {
+		if err := m.saveRotationState(domain, st); err != nil {
+			return err
+		}
+	}
+
+	var keys []signingKey
+	for _, slot := range st.Slots {
+		for _, selector := range []string{slot.Current, slot.Retiring} {
+			if selector == "" {
+				continue
+			}
+			signer, err := loadKey(m.keyPath(domain, selector))
+			if err != nil {
+				return err
+			}
+			keys = append(keys, signingKey{selector: selector, signer: signer})
+		}
+	}
+
+	m.keysLock.Lock()
+	m.keys[normDomain] = keys
+	m.keysLock.Unlock()
+
+	return nil
+}
+
+func (m *Modifier) rotationLoop() {
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopRotation:
+			return
+		case <-ticker.C:
+			for _, domain := range m.domains {
+				if err := m.rotateDomain(domain, false, false); err != nil {
+					m.log.Error("key rotation failed", err, "domain", domain)
+				}
+			}
+		}
+	}
+}
+
+// Rotate forces generation of a new key for each configured selector of the
+// domain. If activate is set, new keys are used immediately instead of
+// waiting for the grace period.
+//
+// Rotation should be enabled using rotate_interval.
+func (m *Modifier) Rotate(domain string, activate bool) error {
+	if !m.rotationEnabled() {
+		return errors.New("modify.dkim: key rotation is not enabled")
+	}
+
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return err
+	}
+	for _, d := range m.domains {
+		normD, err := dns.ForLookup(d)
+		if err != nil {
+			continue
+		}
+		if normD == normDomain {
+			return m.rotateDomain(d, true, activate)
+		}
+	}
+	return fmt.Errorf("modify.dkim: unknown domain: %s", domain)
+}
+
+// DNSRecords returns DNS records for all keys that are used or will be used
+// for signing.
+func (m *Modifier) DNSRecords() ([]DNSRecord, error) {
+	var records []DNSRecord
+	add := func(domain, selector, state string) error {
+		pkey, err := loadKey(m.keyPath(domain, selector))
+		if err != nil {
+			return err
+		}
+		value, err := dkimRecord(pkey)
+		if err != nil {
+			return err
+		}
+		records = append(records, DNSRecord{
+			Domain:   domain,
+			Selector: selector,
+			Value:    value,
+			State:    state,
+		})
+		return nil
+	}
+
+	for _, domain := range m.domains {
+		if !m.rotationEnabled() {
+			for _, selector := range m.selectors {
+				if err := add(domain, selector, "active"); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		st, err := m.loadRotationState(domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range st.Slots {
+			if err := add(domain, slot.Current, "active"); err != nil {
+				return nil, err
+			}
+			if slot.Pending != "" {
+				if err := add(domain, slot.Pending, "pending"); err != nil {
+					return nil, err
+				}
+			}
+			if slot.Retiring != "" {
+				if err := add(domain, slot.Retiring, "retiring"); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// notifyRotation sends the information about the new key to the configured
+// webhook, if any.
+func (m *Modifier) notifyRotation(record DNSRecord) {
+	if m.rotateWebhook == "" {
+		return
+	}
+
+	blob, err := json.Marshal(map[string]interface{}{
+		"event":       "dkim.key_generated",
+		"domain":      record.Domain,
+		"selector":    record.Selector,
+		"record_name": record.Name(),
+		"record":      record.Value,
+		"used_after":  time.Now().Add(m.rotateGrace),
+	})
+	if err != nil {
+		m.log.Error("failed to serialize webhook payload", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.rotateWebhook, bytes.NewReader(blob))
+	if err != nil {
+		m.log.Error("failed to create webhook request", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		m.log.Error("webhook request failed", err, "domain", record.Domain, "selector", record.Selector)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		m.log.Msg("webhook request failed", "status", resp.StatusCode, "domain", record.Domain, "selector", record.Selector)
+	}
+}
+
+func (m *Modifier) Close() error {
+	if m.stopRotation != nil {
+		close(m.stopRotation)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newRotationTestModifier(t *testing.T, dir string) *Modifier {
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"maddy.test"}},
+			{Name: "selector", Args: []string{"default"}},
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+			{Name: "newkey_algo", Args: []string{"ed25519"}},
+			{Name: "rotate_interval", Args: []string{"720h"}},
+			{Name: "rotation_state", Args: []string{filepath.Join(dir, "{domain}_rotation.json")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func selectorsInUse(m *Modifier) []string {
+	m.keysLock.RLock()
+	defer m.keysLock.RUnlock()
+	var res []string
+	for _, key := range m.keys["maddy.test"] {
+		res = append(res, key.selector)
+	}
+	return res
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	m := newRotationTestModifier(t, dir)
+
+	if sels := selectorsInUse(m); len(sels) != 1 || sels[0] != "default" {
+		t.Fatalf("wrong selectors in use after init: %v", sels)
+	}
+
+	// Forced rotation generates a pending key that is not used yet.
+	if err := m.Rotate("maddy.test", false); err != nil {
+		t.Fatal(err)
+	}
+	if sels := selectorsInUse(m); len(sels) != 1 || sels[0] != "default" {
+		t.Fatalf("pending key should not be used: %v", sels)
+	}
+	records, err := m.DNSRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].State != "active" || records[1].State != "pending" {
+		t.Fatalf("wrong DNS records: %+v", records)
+	}
+	pending := records[1].Selector
+
+	// After activation, both keys are used.
+	if err := m.Rotate("maddy.test", true); err != nil {
+		t.Fatal(err)
+	}
+	sels := selectorsInUse(m)
+	if len(sels) != 2 || sels[0] != pending || sels[1] != "default" {
+		t.Fatalf("wrong selectors in use after activation: %v", sels)
+	}
+
+	// Retire the old key.
+	st, err := m.loadRotationState("maddy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Slots[0].RetireAfter = time.Now().Add(-time.Minute)
+	if err := m.saveRotationState("maddy.test", st); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.rotateDomain("maddy.test", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if sels := selectorsInUse(m); len(sels) != 1 || sels[0] != pending {
+		t.Fatalf("old key should be retired: %v", sels)
+	}
+
+	// State should persist across restarts.
+	m2 := newRotationTestModifier(t, dir)
+	if sels := selectorsInUse(m2); len(sels) != 1 || sels[0] != pending {
+		t.Fatalf("wrong selectors in use after reload: %v", sels)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+var signingKeyPlaceholderRe = regexp.MustCompile(`{[a-zA-Z0-9_.:-]+?}`)
+
+// defaultSigningKeys are lookup keys used for signing_table by default.
+var defaultSigningKeys = []string{"{sender}", "{sender_domain}"}
+
+// signingRule is the signing_table entry for the message.
+type signingRule struct {
+	// skip is true if the message should not be signed.
+	skip bool
+
+	domain    string
+	selectors []string
+}
+
+// headerFrom returns the normalized address from the From header field.
+func headerFrom(h *textproto.Header) string {
+	addr, err := mail.ParseAddress(h.Get("From"))
+	if err != nil {
+		return ""
+	}
+	norm, err := address.ForLookup(addr.Address)
+	if err != nil {
+		return ""
+	}
+	return norm
+}
+
+func addrDomain(addr string) string {
+	_, domain, err := address.Split(addr)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// expandSigningKey replaces placeholders in the lookup key template. It
+// returns an empty string if any of the placeholders has no value for the
+// message.
+func (s *state) expandSigningKey(tmpl string, h *textproto.Header) string {
+	missing := false
+	key := signingKeyPlaceholderRe.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		var value string
+		switch placeholder {
+		case "{sender}":
+			value, _ = address.ForLookup(s.from)
+		case "{sender_domain}":
+			norm, _ := address.ForLookup(s.from)
+			value = addrDomain(norm)
+		case "{from}":
+			value = headerFrom(h)
+		case "{from_domain}":
+			value = addrDomain(headerFrom(h))
+		case "{auth_user}":
+			if s.meta.Conn != nil {
+				value = s.meta.Conn.AuthUser
+			}
+		default:
+			name := strings.TrimSuffix(strings.TrimPrefix(placeholder, "{"), "}")
+			if !strings.HasPrefix(name, "annotation:") {
+				return placeholder
+			}
+			if s.meta.Annotations != nil {
+				value, _ = s.meta.Annotations.GetString(strings.TrimPrefix(name, "annotation:"))
+			}
+		}
+		if value == "" {
+			missing = true
+		}
+		return value
+	})
+	if missing {
+		return ""
+	}
+	return key
+}
+
+// signingRule looks up the signing_table entry for the message. Lookup keys
+// are tried in the configured order, the first matching one is used.
+func (s *state) signingRule(ctx context.Context, h *textproto.Header) (signingRule, bool, error) {
+	for _, tmpl := range s.m.signingKeys {
+		key := s.expandSigningKey(tmpl, h)
+		if key == "" {
+			continue
+		}
+
+		value, ok, err := s.m.signingTable.Lookup(ctx, key)
+		if err != nil {
+			return signingRule{}, false, err
+		}
+		if !ok {
+			continue
+		}
+
+		s.log.DebugMsg("signing_table match", "key", key, "value", value)
+		fields := strings.Fields(value)
+		if len(fields) == 0 || fields[0] == "off" {
+			return signingRule{skip: true}, true, nil
+		}
+		return signingRule{domain: fields[0], selectors: fields[1:]}, true, nil
+	}
+	return signingRule{}, false, nil
+}
@@ -0,0 +1,305 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// The signer below is used instead of go-msgauth one when options it does
+// not support are enabled (body length limit, no timestamp). It is
+// intentionally minimal and produces signatures in the same format.
+
+// bodyLengthFull is the value of Modifier.bodyLength that requests the l=
+// tag covering the whole body.
+const bodyLengthFull = -1
+
+// rawSignOptions contains parameters of a single signature.
+type rawSignOptions struct {
+	domain     string
+	selector   string
+	identifier string
+	signer     crypto.Signer
+	hash       crypto.Hash
+
+	headerCanon dkim.Canonicalization
+	bodyCanon   dkim.Canonicalization
+	headerKeys  []string
+
+	// bodyLength is the amount of canonicalized body octets covered by the
+	// signature, zero means no l= tag.
+	bodyLength int64
+
+	timestamp  time.Time
+	expiration time.Time
+}
+
+// countingWriter writes at most limit bytes to w and discards the rest.
+// Negative limit means no limit.
+type countingWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if cw.limit >= 0 {
+		left := cw.limit - cw.written
+		if left <= 0 {
+			return n, nil
+		}
+		if int64(len(b)) > left {
+			b = b[:left]
+		}
+	}
+	written, err := cw.w.Write(b)
+	cw.written += int64(written)
+	if err != nil {
+		return written, err
+	}
+	return n, nil
+}
+
+func isWSP(b byte) bool {
+	return b == ' ' || b == '\t'
+}
+
+// collapseWSP replaces sequences of whitespace with a single space.
+func collapseWSP(line []byte) []byte {
+	res := make([]byte, 0, len(line))
+	inWSP := false
+	for _, b := range line {
+		if isWSP(b) {
+			if !inWSP {
+				res = append(res, ' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		res = append(res, b)
+	}
+	return res
+}
+
+// canonBody writes the canonicalized body to w as described in RFC 6376
+// Section 3.4.
+func canonBody(w io.Writer, r io.Reader, canon dkim.Canonicalization) error {
+	br := bufio.NewReader(r)
+	emptyLines := 0
+	wroteAny := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if canon == dkim.CanonicalizationRelaxed {
+			line = bytes.TrimRight(collapseWSP(line), " ")
+		}
+
+		if len(line) == 0 {
+			emptyLines++
+		} else {
+			for ; emptyLines > 0; emptyLines-- {
+				if _, err := io.WriteString(w, "\r\n"); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, "\r\n"); err != nil {
+				return err
+			}
+			wroteAny = true
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if !wroteAny && canon == dkim.CanonicalizationSimple {
+		_, err := io.WriteString(w, "\r\n")
+		return err
+	}
+	return nil
+}
+
+// bodyHash returns the hash of the canonicalized body and the amount of
+// octets hashed. Negative limit means no limit.
+func bodyHash(r io.Reader, canon dkim.Canonicalization, hash crypto.Hash, limit int64) ([]byte, int64, error) {
+	h := hash.New()
+	cw := &countingWriter{w: h, limit: limit}
+	if err := canonBody(cw, r, canon); err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), cw.written, nil
+}
+
+// canonHeaderField returns the canonicalized header field as described in
+// RFC 6376 Section 3.4. raw is the field as it appears in the message,
+// including the trailing CRLF.
+func canonHeaderField(raw []byte, canon dkim.Canonicalization) []byte {
+	if canon == dkim.CanonicalizationSimple {
+		return raw
+	}
+
+	colon := bytes.IndexByte(raw, ':')
+	if colon == -1 {
+		return raw
+	}
+	key := bytes.ToLower(bytes.TrimRight(raw[:colon], " \t"))
+	value := bytes.ReplaceAll(raw[colon+1:], []byte("\r\n"), nil)
+	value = bytes.ReplaceAll(value, []byte("\n"), nil)
+	value = bytes.Trim(collapseWSP(value), " ")
+
+	res := make([]byte, 0, len(key)+len(value)+3)
+	res = append(res, key...)
+	res = append(res, ':')
+	res = append(res, value...)
+	return append(res, '\r', '\n')
+}
+
+// signedFields returns raw header fields covered by the signature in the
+// order they are hashed. Multiple instances of the same field are used from
+// the bottom up, keys listed more times than the field is present
+// (oversigning) contribute nothing.
+func signedFields(h textproto.Header, keys []string) ([][]byte, error) {
+	fields := make(map[string][][]byte)
+	used := make(map[string]int)
+	res := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		lower := strings.ToLower(key)
+		instances, ok := fields[lower]
+		if !ok {
+			for f := h.FieldsByKey(key); f.Next(); {
+				raw, err := f.Raw()
+				if err != nil {
+					return nil, err
+				}
+				instances = append(instances, raw)
+			}
+			fields[lower] = instances
+		}
+
+		idx := len(instances) - 1 - used[lower]
+		used[lower]++
+		if idx < 0 {
+			continue
+		}
+		res = append(res, instances[idx])
+	}
+	return res, nil
+}
+
+func sigAlgorithm(signer crypto.Signer) (string, crypto.SignerOpts, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa", crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return "ed25519", crypto.Hash(0), nil
+	default:
+		return "", nil, fmt.Errorf("unsupported key type: %T", signer.Public())
+	}
+}
+
+// rawSign computes the DKIM-Signature header field for the message with
+// the specified body hash. The returned value includes the trailing CRLF.
+func rawSign(opts rawSignOptions, h textproto.Header, bh []byte) (string, error) {
+	if opts.hash != crypto.SHA256 {
+		return "", errors.New("unsupported hash function")
+	}
+	keyAlgo, signOpts, err := sigAlgorithm(opts.signer)
+	if err != nil {
+		return "", err
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + keyAlgo + "-sha256",
+		"c=" + string(opts.headerCanon) + "/" + string(opts.bodyCanon),
+		"d=" + opts.domain,
+		"s=" + opts.selector,
+	}
+	if opts.identifier != "" {
+		tags = append(tags, "i="+opts.identifier)
+	}
+	if !opts.timestamp.IsZero() {
+		tags = append(tags, "t="+strconv.FormatInt(opts.timestamp.Unix(), 10))
+	}
+	if !opts.expiration.IsZero() {
+		tags = append(tags, "x="+strconv.FormatInt(opts.expiration.Unix(), 10))
+	}
+	if opts.bodyLength != 0 {
+		tags = append(tags, "l="+strconv.FormatInt(opts.bodyLength, 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(opts.headerKeys, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bh),
+		"b=",
+	)
+
+	// Fold after each tag to keep lines reasonably short. The b= value is
+	// not folded so the field can be extended after signing.
+	field := "DKIM-Signature: " + strings.Join(tags, ";\r\n ")
+
+	fields, err := signedFields(h, opts.headerKeys)
+	if err != nil {
+		return "", err
+	}
+	hasher := opts.hash.New()
+	for _, f := range fields {
+		if _, err := hasher.Write(canonHeaderField(f, opts.headerCanon)); err != nil {
+			return "", err
+		}
+	}
+	sigField := canonHeaderField([]byte(field+"\r\n"), opts.headerCanon)
+	if _, err := hasher.Write(bytes.TrimSuffix(sigField, []byte("\r\n"))); err != nil {
+		return "", err
+	}
+
+	sig, err := opts.signer.Sign(rand.Reader, hasher.Sum(nil), signOpts)
+	if err != nil {
+		return "", err
+	}
+	return field + base64.StdEncoding.EncodeToString(sig) + "\r\n", nil
+}
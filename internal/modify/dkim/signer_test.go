@@ -0,0 +1,249 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+func TestCanonBody(t *testing.T) {
+	test := func(body string, canon dkim.Canonicalization, expected string) {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := canonBody(&buf, strings.NewReader(body), canon); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Errorf("%s canonicalization of %q: want %q, got %q", canon, body, expected, buf.String())
+		}
+	}
+
+	// Examples from RFC 6376 Section 3.4.5.
+	test(" C \r\nD \t E\r\n\r\n\r\n", dkim.CanonicalizationRelaxed, " C\r\nD E\r\n")
+	test(" C \r\nD \t E\r\n\r\n\r\n", dkim.CanonicalizationSimple, " C \r\nD \t E\r\n")
+
+	test("", dkim.CanonicalizationRelaxed, "")
+	test("", dkim.CanonicalizationSimple, "\r\n")
+	test("\r\n\r\n", dkim.CanonicalizationSimple, "\r\n")
+	test("a", dkim.CanonicalizationRelaxed, "a\r\n")
+	test("a\nb\n", dkim.CanonicalizationSimple, "a\r\nb\r\n")
+	test("a\r\n \t\r\nb\r\n", dkim.CanonicalizationRelaxed, "a\r\n\r\nb\r\n")
+}
+
+func TestCanonHeaderField(t *testing.T) {
+	test := func(raw, expected string) {
+		t.Helper()
+		res := canonHeaderField([]byte(raw), dkim.CanonicalizationRelaxed)
+		if string(res) != expected {
+			t.Errorf("want %q, got %q", expected, res)
+		}
+	}
+
+	// Examples from RFC 6376 Section 3.4.5.
+	test("A: X\r\n", "a:X\r\n")
+	test("B : Y\t\r\n\tZ  \r\n", "b:Y Z\r\n")
+
+	if res := canonHeaderField([]byte("B : Y\r\n"), dkim.CanonicalizationSimple); string(res) != "B : Y\r\n" {
+		t.Errorf("simple canonicalization changed the field: %q", res)
+	}
+}
+
+func TestBodyHash_Limit(t *testing.T) {
+	body := "hello\r\nworld\r\n"
+	_, n, err := bodyHash(strings.NewReader(body), dkim.CanonicalizationSimple, crypto.SHA256, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 octets hashed, got %d", n)
+	}
+
+	_, n, err = bodyHash(strings.NewReader(body), dkim.CanonicalizationSimple, crypto.SHA256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(body)) {
+		t.Errorf("expected %d octets hashed, got %d", len(body), n)
+	}
+}
+
+// sigTags returns the tags of the DKIM-Signature field value.
+func sigTags(sig string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(sig, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[key] = value
+	}
+	return tags
+}
+
+// verifyBodyLengthSig checks the DKIM signature with the l= tag.
+//
+// go-msgauth verifier refuses such signatures altogether, so the check is
+// done here using the public key from the generated DNS record.
+func verifyBodyLengthSig(t *testing.T, keysPath, domain string, hdr textproto.Header, body []byte) {
+	t.Helper()
+
+	fields := hdr.FieldsByKey("DKIM-Signature")
+	if !fields.Next() {
+		t.Fatal("message is not signed")
+	}
+	raw, err := fields.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := sigTags(fields.Value())
+
+	dnsRecord, err := os.ReadFile(filepath.Join(keysPath, domain+".dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlob, err := base64.StdEncoding.DecodeString(sigTags(string(dnsRecord))["p"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	length, err := strconv.ParseInt(tags["l"], 10, 64)
+	if err != nil {
+		t.Fatal("malformed l= tag:", err)
+	}
+	bh, n, err := bodyHash(bytes.NewReader(body), dkim.Canonicalization(bodyCanon), crypto.SHA256, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != length {
+		t.Fatalf("body is shorter than l=%d", length)
+	}
+	if base64.StdEncoding.EncodeToString(bh) != strings.Join(strings.Fields(tags["bh"]), "") {
+		t.Fatal("body hash mismatch")
+	}
+
+	// b= is the last tag and is never folded by the signer.
+	bIdx := bytes.LastIndex(raw, []byte(";\r\n b="))
+	if bIdx == -1 {
+		t.Fatalf("unexpected DKIM-Signature format: %q", raw)
+	}
+	bIdx += len(";\r\n b=")
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw[bIdx:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signedFields(hdr, strings.Split(tags["h"], ":"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := crypto.SHA256.New()
+	for _, f := range signed {
+		hasher.Write(canonHeaderField(f, dkim.Canonicalization(headerCanon)))
+	}
+	sigField := canonHeaderField(append(raw[:bIdx:bIdx], "\r\n"...), dkim.Canonicalization(headerCanon))
+	hasher.Write(bytes.TrimSuffix(sigField, []byte("\r\n")))
+	hashed := hasher.Sum(nil)
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		pub, err := x509.ParsePKIXPublicKey(keyBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, hashed, sig); err != nil {
+			t.Fatal("signature verification failed:", err)
+		}
+	case "ed25519-sha256":
+		if !ed25519.Verify(ed25519.PublicKey(keyBlob), hashed, sig) {
+			t.Fatal("signature verification failed")
+		}
+	default:
+		t.Fatal("unexpected signature algorithm:", tags["a"])
+	}
+}
+
+func TestSignRaw(t *testing.T) {
+	test := func(keyAlgo string, headerCanon, bodyCanon dkim.Canonicalization, bodyLength int64, timestamp bool) {
+		t.Helper()
+
+		dir := t.TempDir()
+		m := newTestModifier(t, dir, keyAlgo, []string{"maddy.test"})
+		m.headerCanon = headerCanon
+		m.bodyCanon = bodyCanon
+		m.bodyLength = bodyLength
+		m.signTimestamp = timestamp
+
+		testHdr, body := signTestMsg(t, m, "test@maddy.test")
+		sig := testHdr.Get("DKIM-Signature")
+		if sig == "" {
+			t.Fatal("message is not signed")
+		}
+		tags := sigTags(sig)
+		if _, ok := tags["t"]; ok != timestamp {
+			t.Errorf("unexpected t= tag presence: %s", sig)
+		}
+		if _, ok := tags["l"]; ok != (bodyLength != 0) {
+			t.Errorf("unexpected l= tag presence: %s", sig)
+		}
+
+		if bodyLength == 0 {
+			verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+			return
+		}
+		verifyBodyLengthSig(t, dir, "maddy.test", testHdr, body)
+		// Content appended after the signed part does not break
+		// the signature.
+		verifyBodyLengthSig(t, dir, "maddy.test", testHdr, append(body, "-- \r\nfooter\r\n"...))
+	}
+
+	for _, algo := range [2]string{"rsa2048", "ed25519"} {
+		for _, hdrCanon := range [2]dkim.Canonicalization{dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed} {
+			for _, bodyCanon := range [2]dkim.Canonicalization{dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed} {
+				test(algo, hdrCanon, bodyCanon, bodyLengthFull, true)
+				test(algo, hdrCanon, bodyCanon, 5, true)
+				test(algo, hdrCanon, bodyCanon, 0, false)
+			}
+		}
+	}
+}
+
+func TestDomainCanon(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.domainCanon = map[string]canonPair{
+		"maddy.test": {header: dkim.CanonicalizationSimple, body: dkim.CanonicalizationSimple},
+	}
+
+	testHdr, body := signTestMsg(t, m, "test@maddy.test")
+	if sig := testHdr.Get("DKIM-Signature"); sigTags(sig)["c"] != "simple/simple" {
+		t.Errorf("domain canonicalization is not used: %s", sig)
+	}
+	verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+}
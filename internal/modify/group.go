@@ -20,12 +20,14 @@ package modify
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tracing"
 )
 
 type (
@@ -40,6 +42,7 @@ type (
 
 	groupState struct {
 		states []module.ModifierState
+		names  []string
 	}
 )
 
@@ -76,10 +79,18 @@ func (g Group) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata)
 			return nil, err
 		}
 		gs.states = append(gs.states, state)
+		gs.names = append(gs.names, modifierName(modifier))
 	}
 	return gs, nil
 }
 
+func modifierName(modifier module.Modifier) string {
+	if mod, ok := modifier.(module.Module); ok {
+		return mod.Name() + ":" + mod.InstanceName()
+	}
+	return fmt.Sprintf("%T", modifier)
+}
+
 func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
 	var err error
 	for _, state := range gs.states {
@@ -110,8 +121,12 @@ func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string,
 }
 
 func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
-	for _, state := range gs.states {
-		if err := state.RewriteBody(ctx, h, body); err != nil {
+	for i, state := range gs.states {
+		modCtx, span := tracing.Start(ctx, "modifier", "maddy.modifier", gs.names[i])
+		err := state.RewriteBody(modCtx, h, body)
+		span.SetError(err)
+		span.End()
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,96 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package modify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Priority classes supported by target.queue.
+var priorityNames = []string{"low", "normal", "high"}
+
+// priority is a modifier that sets the queue priority class for the message
+// using the "queue.priority" annotation.
+type priority struct {
+	instName string
+	value    string
+}
+
+func NewPriority(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 1 {
+		return nil, fmt.Errorf("modify.priority: exactly one argument is required (%s)", strings.Join(priorityNames, ", "))
+	}
+	valid := false
+	for _, name := range priorityNames {
+		if inlineArgs[0] == name {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("modify.priority: unknown priority: %s", inlineArgs[0])
+	}
+	return &priority{
+		instName: instName,
+		value:    inlineArgs[0],
+	}, nil
+}
+
+func (p *priority) Init(cfg *config.Map) error {
+	_, err := cfg.Process()
+	return err
+}
+
+func (p *priority) Name() string {
+	return "modify.priority"
+}
+
+func (p *priority) InstanceName() string {
+	return p.instName
+}
+
+func (p *priority) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	msgMeta.Annotations.SetString("queue.priority", p.value)
+	return p, nil
+}
+
+func (p *priority) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (p *priority) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (p *priority) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (p *priority) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.priority", NewPriority)
+}
@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// verpDecode is a modifier that decodes VERP-encoded recipient addresses
+// (see address.VERPEncode) used as the return path for outgoing messages.
+//
+// The recipient is replaced with the original sender address and the address
+// of the failed recipient is stored in the "verp.rcpt" annotation.
+type verpDecode struct {
+	instName string
+	log      log.Logger
+
+	delim         string
+	inlineSenders []string
+	senders       map[string]struct{}
+}
+
+func NewVERPDecode(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &verpDecode{
+		instName:      instName,
+		inlineSenders: inlineArgs,
+		log:           log.Logger{Name: "modify.verp_decode"},
+	}, nil
+}
+
+func (v *verpDecode) Init(cfg *config.Map) error {
+	var senders []string
+	cfg.Bool("debug", true, false, &v.log.Debug)
+	cfg.String("delimiter", false, false, "+", &v.delim)
+	cfg.StringList("senders", false, false, nil, &senders)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	senders = append(v.inlineSenders, senders...)
+	if len(senders) != 0 {
+		v.senders = make(map[string]struct{}, len(senders))
+	}
+	for _, sender := range senders {
+		normSender, err := address.ForLookup(sender)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid sender address: %v: %v", sender, err)
+		}
+		v.senders[normSender] = struct{}{}
+	}
+
+	return nil
+}
+
+func (v *verpDecode) Name() string {
+	return "modify.verp_decode"
+}
+
+func (v *verpDecode) InstanceName() string {
+	return v.instName
+}
+
+type verpDecodeState struct {
+	v       *verpDecode
+	msgMeta *module.MsgMetadata
+}
+
+func (v *verpDecode) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return verpDecodeState{v: v, msgMeta: msgMeta}, nil
+}
+
+func (s verpDecodeState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s verpDecodeState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	sender, rcpt, ok := address.VERPDecode(rcptTo, s.v.delim)
+	if !ok {
+		return []string{rcptTo}, nil
+	}
+
+	if s.v.senders != nil {
+		normSender, err := address.ForLookup(sender)
+		if err != nil {
+			return []string{rcptTo}, nil
+		}
+		if _, ok := s.v.senders[normSender]; !ok {
+			return []string{rcptTo}, nil
+		}
+	}
+
+	s.v.log.Debugf("decoded VERP address %s: sender = %s, rcpt = %s", rcptTo, sender, rcpt)
+	s.msgMeta.Annotations.AddString("verp.rcpt", rcpt)
+	return []string{sender}, nil
+}
+
+func (s verpDecodeState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s verpDecodeState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.verp_decode", NewVERPDecode)
+}
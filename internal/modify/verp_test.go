@@ -0,0 +1,66 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestVERPDecode(t *testing.T) {
+	test := func(senders []string, rcpt string, expected []string, expectedAnnotation []string) {
+		t.Helper()
+
+		mod, err := NewVERPDecode("modify.verp_decode", "", nil, senders)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+			t.Fatal(err)
+		}
+
+		msgMeta := &module.MsgMetadata{Annotations: module.NewAnnotations()}
+		state, err := mod.(module.Modifier).ModStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := state.RewriteRcpt(context.Background(), rcpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("want %v, got %v", expected, actual)
+		}
+
+		annotation, _ := msgMeta.Annotations.GetStrings("verp.rcpt")
+		if !reflect.DeepEqual(annotation, expectedAnnotation) {
+			t.Errorf("wrong verp.rcpt annotation: want %v, got %v", expectedAnnotation, annotation)
+		}
+	}
+
+	test(nil, "list+user=example.com@example.org", []string{"list@example.org"}, []string{"user@example.com"})
+	test(nil, "list+tag@example.org", []string{"list+tag@example.org"}, nil)
+	test(nil, "list@example.org", []string{"list@example.org"}, nil)
+	test([]string{"List@example.org"}, "list+user=example.com@example.org", []string{"list@example.org"}, []string{"user@example.com"})
+	test([]string{"other@example.org"}, "list+user=example.com@example.org", []string{"list+user=example.com@example.org"}, nil)
+}
@@ -96,3 +96,27 @@ func BenchmarkMsgPipelineTargets(b *testing.B) {
 	testWithCount(10)
 	testWithCount(15)
 }
+
+func BenchmarkMsgPipelineParallel(b *testing.B) {
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(parallelism), func(b *testing.B) {
+			target := testutils.Target{InstName: "test_target", DiscardMessages: true}
+			d := MsgPipeline{msgpipelineCfg: msgpipelineCfg{
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			}}
+
+			testutils.BenchDeliveryParallel(b, &d, "sender@example.org", []string{"rcpt-X@example.org"},
+				testutils.ParallelBenchOptions{
+					Parallelism: parallelism,
+					BodySizes:   []int{1024, 16 * 1024, testutils.MessageBodySize},
+					Accounts:    16,
+				})
+		})
+	}
+}
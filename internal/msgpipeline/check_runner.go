@@ -20,8 +20,11 @@ package msgpipeline
 
 import (
 	"context"
+	"errors"
+	"net"
 	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -30,7 +33,9 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
 	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/tracing"
 )
 
 // checkRunner runs groups of checks, collects and merges results.
@@ -44,14 +49,36 @@ type checkRunner struct {
 	checkedRcptsPerCheck map[module.CheckState]map[string]struct{}
 	checkedRcptsLock     sync.Mutex
 
-	resolver      dns.Resolver
-	doDMARC       bool
-	didDMARCFetch bool
-	dmarcVerify   *dmarc.Verifier
+	resolver       dns.Resolver
+	doDMARC        bool
+	didDMARCFetch  bool
+	dmarcVerify    *dmarc.Verifier
+	dmarcOverrides dmarc.Overrides
 
 	log log.Logger
 
-	states map[module.Check]module.CheckState
+	states       map[module.Check]module.CheckState
+	stateChecks  map[module.CheckState]module.Check
+	stateNames   map[module.CheckState]string
+	stateReplies map[module.CheckState]*checkReply
+	stateBudgets map[module.CheckState]*checkTimeout
+
+	// replies overrides SMTP status used for rejections by checks.
+	replies checkReplies
+
+	// timeouts overrides checkTimeout for individual checks.
+	timeouts checkTimeouts
+
+	tracer Tracer
+
+	// checkTimeout is the deadline for a single check invocation, zero
+	// means no limit other than the one set by the caller.
+	checkTimeout time.Duration
+
+	// accepted is set when a check requested the message to be accepted
+	// at the connection, sender or body stage. No further checks are run
+	// and DMARC policy is not enforced.
+	accepted bool
 
 	mergedRes module.CheckResult
 }
@@ -64,6 +91,10 @@ func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver)
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
+		stateChecks:          make(map[module.CheckState]module.Check),
+		stateNames:           make(map[module.CheckState]string),
+		stateReplies:         make(map[module.CheckState]*checkReply),
+		stateBudgets:         make(map[module.CheckState]*checkTimeout),
 	}
 }
 
@@ -93,6 +124,14 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 		states = append(states, state)
 		newStates = append(newStates, state)
 		newStatesMap[check] = state
+		cr.stateChecks[state] = check
+		cr.stateNames[state] = objectName(check)
+		if reply := cr.replies.forCheck(check); reply != nil {
+			cr.stateReplies[state] = reply
+		}
+		if budget := cr.timeouts.forCheck(check); budget != nil {
+			cr.stateBudgets[state] = budget
+		}
 	}
 
 	if len(newStates) == 0 {
@@ -105,7 +144,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	// Done outside of check loop above to make sure we can run these for multiple
 	// checks in parallel.
 	if cr.mailFromReceived {
-		err := cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err := cr.runAndMergeResults(ctx, "connection", newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
 			res := s.CheckConnection(ctx)
 			return res
 		})
@@ -113,7 +152,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 			closeStates()
 			return nil, err
 		}
-		err = cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err = cr.runAndMergeResults(ctx, "sender", newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
 			res := s.CheckSender(ctx, cr.mailFrom)
 			return res
 		})
@@ -126,7 +165,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	if len(cr.checkedRcpts) != 0 {
 		for _, rcpt := range cr.checkedRcpts {
 			rcpt := rcpt
-			err := cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+			err := cr.runAndMergeResults(ctx, "rcpt", states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 				// Avoid calling CheckRcpt for the same recipient for the same check
 				// multiple times, even if requested.
 				cr.checkedRcptsLock.Lock()
@@ -159,11 +198,19 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	return states, nil
 }
 
-func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
+func (cr *checkRunner) runAndMergeResults(ctx context.Context, stage string, states []module.CheckState, runner func(context.Context, module.CheckState) module.CheckResult) error {
+	if cr.accepted {
+		return nil
+	}
+
 	data := struct {
 		authResLock sync.Mutex
 		headerLock  sync.Mutex
 
+		accepted    bool
+		acceptCheck string
+		setAccepted sync.Once
+
 		quarantineErr    error
 		quarantineCheck  string
 		setQuarantineErr sync.Once
@@ -187,7 +234,40 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				}
 			}()
 
-			subCheckRes := runner(state)
+			checkCtx, span := tracing.Start(ctx, "check", "maddy.check", cr.stateNames[state], "maddy.check.stage", stage)
+			timeout := cr.checkTimeout
+			budget := cr.stateBudgets[state]
+			if budget != nil {
+				timeout = budget.timeout
+			}
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				checkCtx, cancel = context.WithTimeout(checkCtx, timeout)
+				defer cancel()
+			}
+			subCheckRes := runner(checkCtx, state)
+			// Checks are expected to abort once the deadline passes, what
+			// they return in this case is replaced according to the
+			// configured policy. Deadline of the caller is not our concern.
+			if budget != nil && errors.Is(checkCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+				cr.log.Msg("check timed out", "check", cr.stateNames[state], "stage", stage,
+					"timeout", budget.timeout, "action", budget.action, "check_result_err", subCheckRes.Reason)
+				checkTimedOut.WithLabelValues(cr.stateNames[state], budget.action).Inc()
+				subCheckRes = budget.result(cr.stateNames[state], stage)
+			}
+			switch {
+			case subCheckRes.Accept:
+				span.SetAttrs("maddy.check.action", "accept")
+			case subCheckRes.Reject:
+				span.SetAttrs("maddy.check.action", "reject")
+			case subCheckRes.Quarantine:
+				span.SetAttrs("maddy.check.action", "quarantine")
+			}
+			span.SetError(subCheckRes.Reason)
+			span.End()
+			if cr.tracer != nil {
+				cr.tracer.CheckResult(cr.stateNames[state], stage, subCheckRes)
+			}
 
 			// We check the length because we don't want to take locks
 			// when it is not necessary.
@@ -208,13 +288,24 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				data.headerLock.Unlock()
 			}
 
-			if subCheckRes.Quarantine {
+			if subCheckRes.Reject || subCheckRes.Quarantine {
+				subCheckRes.Reason = cr.stateReplies[state].apply(subCheckRes.Reason)
+			}
+
+			if subCheckRes.Accept {
+				data.setAccepted.Do(func() {
+					data.accepted = true
+					data.acceptCheck = cr.stateNames[state]
+				})
+			} else if subCheckRes.Quarantine {
 				data.setQuarantineErr.Do(func() {
 					data.quarantineErr = subCheckRes.Reason
+					data.quarantineCheck = cr.stateNames[state]
 				})
 			} else if subCheckRes.Reject {
 				data.setRejectErr.Do(func() {
 					data.rejectErr = subCheckRes.Reason
+					data.rejectCheck = cr.stateNames[state]
 				})
 			} else if subCheckRes.Reason != nil {
 				// 'action ignore' case. There is Reason, but action.Apply set
@@ -226,7 +317,16 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 	}
 
 	data.wg.Wait()
+	if data.accepted {
+		cr.log.Debugf("accepted by %s at %s stage, ignoring other checks", data.acceptCheck, stage)
+		if stage != "rcpt" {
+			cr.accepted = true
+		}
+		return nil
+	}
 	if data.rejectErr != nil {
+		cr.auditReject(stage, data.rejectCheck, data.rejectErr)
+		cr.reportOutcome(ctx, stage, module.CheckResult{Reject: true, Reason: data.rejectErr})
 		return data.rejectErr
 	}
 
@@ -238,6 +338,29 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 	return nil
 }
 
+func (cr *checkRunner) auditReject(stage, check string, reason error) {
+	srcIP := ""
+	if cr.msgMeta.Conn != nil && cr.msgMeta.Conn.RemoteAddr != nil {
+		srcIP = cr.msgMeta.Conn.RemoteAddr.String()
+	}
+	audit.Event(audit.PolicyReject,
+		"msg_id", cr.msgMeta.ID,
+		"check", check,
+		"stage", stage,
+		"src_ip", srcIP,
+		"reason", reason.Error())
+}
+
+// reportOutcome passes the combined result to checks implementing
+// module.OutcomeCheckState.
+func (cr *checkRunner) reportOutcome(ctx context.Context, stage string, res module.CheckResult) {
+	for _, state := range cr.states {
+		if obs, ok := state.(module.OutcomeCheckState); ok {
+			obs.CheckOutcome(ctx, stage, res)
+		}
+	}
+}
+
 func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Check, mailFrom string) error {
 	cr.mailFrom = mailFrom
 	cr.mailFromReceived = true
@@ -253,7 +376,7 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 		return err
 	}
 
-	err = cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	err = cr.runAndMergeResults(ctx, "rcpt", states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 		cr.checkedRcptsLock.Lock()
 		if _, ok := cr.checkedRcptsPerCheck[s][rcptTo]; ok {
 			cr.checkedRcptsLock.Unlock()
@@ -273,6 +396,34 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 	return err
 }
 
+func (cr *checkRunner) checkHeader(ctx context.Context, checks []module.Check, header textproto.Header) error {
+	states, err := cr.checkStates(ctx, checks)
+	if err != nil {
+		return err
+	}
+
+	// Start fetching the DMARC record early, it is needed only after the
+	// body is received.
+	if cr.doDMARC && !cr.didDMARCFetch {
+		cr.dmarcVerify.FetchRecord(ctx, header)
+		cr.didDMARCFetch = true
+	}
+
+	headerStates := make([]module.CheckState, 0, len(states))
+	for _, s := range states {
+		if _, ok := s.(module.HeaderCheckState); ok {
+			headerStates = append(headerStates, s)
+		}
+	}
+	if len(headerStates) == 0 {
+		return nil
+	}
+
+	return cr.runAndMergeResults(ctx, "header", headerStates, cr.cached("header", func(ctx context.Context, s module.CheckState) module.CheckResult {
+		return s.(module.HeaderCheckState).CheckHeader(ctx, header)
+	}))
+}
+
 func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, header textproto.Header, body buffer.Buffer) error {
 	states, err := cr.checkStates(ctx, checks)
 	if err != nil {
@@ -284,13 +435,39 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 		cr.didDMARCFetch = true
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	return cr.runAndMergeResults(ctx, "body", states, cr.cached("body", func(ctx context.Context, s module.CheckState) module.CheckResult {
 		res := s.CheckBody(ctx, header, body)
 		return res
-	})
+	}))
+}
+
+// cached wraps the runner to reuse results of the check for the same
+// message if it was already executed by another pipeline, e.g. if a
+// message pipeline is used as a delivery target.
+//
+// Only header and body stages are cached since results of other stages
+// can be used by the check state later. Results are reused only if the
+// check state has seen the same recipients.
+func (cr *checkRunner) cached(stage string, runner func(context.Context, module.CheckState) module.CheckResult) func(context.Context, module.CheckState) module.CheckResult {
+	rcpts := cr.checkedRcpts
+	return func(ctx context.Context, s module.CheckState) module.CheckResult {
+		check := cr.stateChecks[s]
+		if res, ok := cr.msgMeta.CheckCache.Get(check, stage, rcpts); ok {
+			cr.log.Debugf("using cached %s result of %s", stage, cr.stateNames[s])
+			checkCached.WithLabelValues(cr.stateNames[s]).Inc()
+			return res
+		}
+		res := runner(ctx, s)
+		// Result of the check that ran out of time is not worth reusing,
+		// the nested pipeline may have a different time budget.
+		if ctx.Err() == nil {
+			cr.msgMeta.CheckCache.Set(check, stage, rcpts, res)
+		}
+		return res
+	}
 }
 
-func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
+func (cr *checkRunner) applyResults(ctx context.Context, hostname string, header *textproto.Header) error {
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
 	}
@@ -298,6 +475,36 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	if cr.doDMARC {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+		cr.msgMeta.Annotations.SetString("dmarc.result", string(dmarcRes.Authres.Value))
+		if dmarcRes.SPFResult.Value != "" {
+			cr.msgMeta.Annotations.SetString("dmarc.spf_result", string(dmarcRes.SPFResult.Value))
+		}
+
+		var srcIP net.IP
+		if cr.msgMeta.Conn != nil {
+			if tcpAddr, ok := cr.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+				srcIP = tcpAddr.IP
+			}
+		}
+		adjusted, reason, err := cr.dmarcOverrides.Adjust(ctx, dmarcRes.Authres.From, srcIP, policy)
+		if err != nil {
+			cr.log.Error("DMARC override lookup failed", err)
+		} else if adjusted != policy {
+			cr.log.Msg("DMARC policy overridden", "policy", policy, "applied_policy", adjusted, "reason", reason)
+			policy = adjusted
+		}
+		if cr.accepted && policy != dmarc.PolicyNone {
+			cr.log.Msg("DMARC policy ignored for accepted message", "policy", policy)
+			policy = dmarc.PolicyNone
+		}
+
+		if cr.tracer != nil {
+			cr.tracer.CheckResult("dmarc", "body", module.CheckResult{
+				Reject:     policy == dmarc.PolicyReject,
+				Quarantine: policy == dmarc.PolicyQuarantine,
+				AuthResult: []authres.Result{&dmarcRes.Authres},
+			})
+		}
 		switch policy {
 		case dmarc.PolicyReject:
 			code := 550
@@ -306,7 +513,7 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 				code = 450
 				enchCode[0] = 4
 			}
-			return &exterrors.SMTPError{
+			var err error = &exterrors.SMTPError{
 				Code:         code,
 				EnhancedCode: enchCode,
 				Message:      "DMARC check failed",
@@ -319,7 +526,19 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 					"spf_from":    dmarcRes.SPFResult.From,
 				},
 			}
+			err = cr.replies["dmarc"].apply(err)
+			cr.auditReject("body", "dmarc", err)
+			cr.reportOutcome(ctx, "body", module.CheckResult{Reject: true, Reason: err})
+			return err
 		case dmarc.PolicyQuarantine:
+			if cr.dmarcOverrides.QuarantineAction == dmarc.QuarantineSubject {
+				header.Set("Subject", cr.dmarcOverrides.QuarantineArg+" "+header.Get("Subject"))
+				cr.log.Msg("subject tagged", "reason", dmarcRes.Authres.Reason, "check", "dmarc")
+				break
+			}
+			if cr.dmarcOverrides.QuarantineAction == dmarc.QuarantineMailbox {
+				cr.msgMeta.Annotations.SetString("quarantine.mailbox", cr.dmarcOverrides.QuarantineArg)
+			}
 			cr.msgMeta.Quarantine = true
 
 			// Mimick the message structure for regular checks.
@@ -340,6 +559,8 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 		}
 		header.AddRaw(formatted)
 	}
+
+	cr.reportOutcome(ctx, "body", module.CheckResult{Quarantine: cr.msgMeta.Quarantine})
 	return nil
 }
 
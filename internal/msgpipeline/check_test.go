@@ -19,11 +19,18 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
 	"errors"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -446,3 +453,450 @@ func TestMsgPipeline_RcptCheck_Errors(t *testing.T) {
 			check_.UnclosedStates, sourceCheck.UnclosedStates, globalCheck.UnclosedStates)
 	}
 }
+
+type deadlineCheck struct {
+	testutils.Check
+	deadlines []time.Duration
+}
+
+func (c *deadlineCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &deadlineCheckState{c}, nil
+}
+
+type deadlineCheckState struct {
+	c *deadlineCheck
+}
+
+func (s *deadlineCheckState) record(ctx context.Context) module.CheckResult {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		s.c.deadlines = append(s.c.deadlines, 0)
+	} else {
+		s.c.deadlines = append(s.c.deadlines, time.Until(deadline))
+	}
+	return module.CheckResult{}
+}
+
+func (s *deadlineCheckState) CheckConnection(ctx context.Context) module.CheckResult {
+	return s.record(ctx)
+}
+
+func (s *deadlineCheckState) CheckSender(ctx context.Context, _ string) module.CheckResult {
+	return s.record(ctx)
+}
+
+func (s *deadlineCheckState) CheckRcpt(ctx context.Context, _ string) module.CheckResult {
+	return s.record(ctx)
+}
+
+func (s *deadlineCheckState) CheckBody(ctx context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	return s.record(ctx)
+}
+
+func (s *deadlineCheckState) Close() error {
+	return nil
+}
+
+func TestMsgPipeline_CheckTimeout(t *testing.T) {
+	target := testutils.Target{}
+	check := deadlineCheck{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			checkTimeout: 30 * time.Second,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	// connection, sender, rcpt and body stages.
+	if len(check.deadlines) != 4 {
+		t.Fatalf("expected 4 check calls, got %d", len(check.deadlines))
+	}
+	for i, left := range check.deadlines {
+		if left <= 0 || left > 30*time.Second {
+			t.Errorf("call %d: unexpected time left until the deadline: %v", i, left)
+		}
+	}
+}
+
+type slowCheck struct {
+	testutils.Check
+}
+
+func (c *slowCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return slowCheckState{}, nil
+}
+
+// slowCheckState blocks at the body stage until the deadline passes.
+type slowCheckState struct{}
+
+func (slowCheckState) CheckConnection(context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (slowCheckState) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (slowCheckState) CheckRcpt(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (slowCheckState) CheckBody(ctx context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	<-ctx.Done()
+	return module.CheckResult{Reject: true, Reason: ctx.Err()}
+}
+
+func (slowCheckState) Close() error {
+	return nil
+}
+
+func TestMsgPipeline_CheckTimeoutAction(t *testing.T) {
+	check := slowCheck{Check: testutils.Check{InstName: "slow"}}
+
+	test := func(action string) (testutils.Target, error) {
+		t.Helper()
+		target := testutils.Target{}
+		timeouts := checkTimeouts{}
+		err := timeouts.parse(config.Node{Name: "check_timeout", Args: []string{"slow", "10ms", action}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{&check},
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+				checkTimeout:  30 * time.Second,
+				checkTimeouts: timeouts,
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+		_, err = testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+		return target, err
+	}
+
+	t.Run("tempfail", func(t *testing.T) {
+		_, err := test("tempfail")
+		if !exterrors.IsTemporary(err) {
+			t.Fatalf("expected temporary error, got %v", err)
+		}
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+			t.Errorf("expected 451 code, got %v", err)
+		}
+	})
+	t.Run("skip", func(t *testing.T) {
+		target, err := test("skip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(target.Messages) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(target.Messages))
+		}
+		if v := target.Messages[0].Header.Get(timeoutHeader); v != "slow; stage=body" {
+			t.Errorf("wrong %s field: %q", timeoutHeader, v)
+		}
+	})
+	t.Run("neutral", func(t *testing.T) {
+		target, err := test("neutral")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(target.Messages) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(target.Messages))
+		}
+		if target.Messages[0].Header.Has(timeoutHeader) {
+			t.Errorf("unexpected %s field", timeoutHeader)
+		}
+	})
+}
+
+func TestCheckTimeoutsParse(t *testing.T) {
+	for _, args := range [][]string{
+		{"dnsbl"},
+		{"dnsbl", "abc"},
+		{"dnsbl", "0s"},
+		{"dnsbl", "5s", "reject"},
+		{"dnsbl", "5s", "skip", "extra"},
+	} {
+		timeouts := checkTimeouts{}
+		if err := timeouts.parse(config.Node{Name: "check_timeout", Args: args}); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+
+	timeouts := checkTimeouts{}
+	if err := timeouts.parse(config.Node{Name: "check_timeout", Args: []string{"test_check", "5s"}}); err != nil {
+		t.Fatal(err)
+	}
+	budget := timeouts.forCheck(&testutils.Check{InstName: "other"})
+	if budget == nil || budget.timeout != 5*time.Second || budget.action != timeoutTempfail {
+		t.Errorf("wrong budget for the module name: %+v", budget)
+	}
+}
+
+func TestMsgPipeline_CheckAccept(t *testing.T) {
+	target := testutils.Target{}
+	allow := testutils.Check{InstName: "allow"}
+	deny := testutils.Check{
+		InstName:  "deny",
+		SenderRes: module.CheckResult{Reject: true, Reason: errors.New("1")},
+		RcptRes:   module.CheckResult{Reject: true, Reason: errors.New("2")},
+		BodyRes:   module.CheckResult{Reject: true, Reason: errors.New("3")},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&allow, &deny},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	t.Run("rcpt accept", func(t *testing.T) {
+		allow.RcptRes = module.CheckResult{Accept: true}
+		deny.SenderRes.Reject = false
+
+		// Recipient rejection is overridden, body one is not.
+		_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if deny.BodyCalls != 1 {
+			t.Fatalf("expected body check to be called once, got %d", deny.BodyCalls)
+		}
+	})
+
+	t.Run("sender accept", func(t *testing.T) {
+		allow.RcptRes = module.CheckResult{}
+		allow.SenderRes = module.CheckResult{Accept: true}
+		deny.SenderRes.Reject = true
+		deny.RcptCalls = 0
+		deny.BodyCalls = 0
+
+		testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+		if deny.RcptCalls != 0 || deny.BodyCalls != 0 {
+			t.Fatalf("checks called after accept: rcpt %d, body %d", deny.RcptCalls, deny.BodyCalls)
+		}
+	})
+
+	if allow.UnclosedStates != 0 || deny.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, counters: %d, %d", allow.UnclosedStates, deny.UnclosedStates)
+	}
+}
+
+func TestMsgPipeline_CheckReply(t *testing.T) {
+	target := testutils.Target{}
+	check_ := testutils.Check{
+		InstName: "strict",
+		RcptRes: module.CheckResult{Reject: true, Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Rejected",
+			CheckName:    "test_check",
+		}},
+	}
+	replies := checkReplies{}
+	for _, node := range []config.Node{
+		{Name: "check_reply", Args: []string{"strict", "554", "5.7.0", "Contact support, ID {msg_id}"}},
+		{Name: "check_reply", Args: []string{"test_check", "421", "4.7.0", "Later"}},
+	} {
+		if err := replies.parse(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check_},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			checkReplies: replies,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+	testutils.CheckSMTPErr(t, err, 554, exterrors.EnhancedCode{5, 7, 0}, "Contact support, ID {msg_id}")
+	if fields := exterrors.Fields(err); fields["check"] != "test_check" {
+		t.Errorf("check name is not preserved: %v", fields["check"])
+	}
+
+	// Temporary errors are overridden only by 4xx replies.
+	check_.RcptRes.Reason = &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+		Message:      "Try again",
+	}
+	_, err = testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+	testutils.CheckSMTPErr(t, err, 451, exterrors.EnhancedCode{4, 7, 1}, "Try again")
+}
+
+func TestMsgPipeline_CheckCache(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{}
+	inner := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline/inner"),
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&inner},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if check.BodyCalls != 1 {
+		t.Errorf("CheckBody called %d times, want 1", check.BodyCalls)
+	}
+	if check.UnclosedStates != 0 {
+		t.Fatalf("checks state objects leak or double-closed, alive counter: %v", check.UnclosedStates)
+	}
+}
+
+// rcptsCheck adds the list of recipients it has seen to the header at the
+// body stage.
+type rcptsCheck struct {
+	testutils.Check
+
+	lock      sync.Mutex
+	bodyCalls int
+}
+
+func (c *rcptsCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &rcptsCheckState{c: c}, nil
+}
+
+type rcptsCheckState struct {
+	c     *rcptsCheck
+	rcpts []string
+}
+
+func (*rcptsCheckState) CheckConnection(context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*rcptsCheckState) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *rcptsCheckState) CheckRcpt(_ context.Context, rcpt string) module.CheckResult {
+	s.rcpts = append(s.rcpts, rcpt)
+	return module.CheckResult{}
+}
+
+func (s *rcptsCheckState) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
+	s.c.lock.Lock()
+	s.c.bodyCalls++
+	s.c.lock.Unlock()
+
+	hdr := textproto.Header{}
+	hdr.Add("X-Rcpts", strings.Join(s.rcpts, ", "))
+	return module.CheckResult{Header: hdr}
+}
+
+func (*rcptsCheckState) Close() error {
+	return nil
+}
+
+func TestMsgPipeline_CheckCacheRcpts(t *testing.T) {
+	check := rcptsCheck{}
+	innerPipeline := func(target module.DeliveryTarget) *MsgPipeline {
+		return &MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{&check},
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{target},
+					},
+				},
+			},
+			Log: testutils.Logger(t, "msgpipeline/inner"),
+		}
+	}
+	orgTarget, comTarget := testutils.Target{}, testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						targets: []module.DeliveryTarget{innerPipeline(&orgTarget)},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{innerPipeline(&comTarget)},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt@example.org", "rcpt@example.com"})
+
+	if check.bodyCalls != 2 {
+		t.Errorf("CheckBody called %d times, want 2", check.bodyCalls)
+	}
+	for _, tc := range []struct {
+		target *testutils.Target
+		rcpts  string
+	}{
+		{&orgTarget, "rcpt@example.org"},
+		{&comTarget, "rcpt@example.com"},
+	} {
+		if len(tc.target.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(tc.target.Messages))
+		}
+		if v := tc.target.Messages[0].Header.Get("X-Rcpts"); v != tc.rcpts {
+			t.Errorf("wrong check result reused, want X-Rcpts %q, got %q", tc.rcpts, v)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/config"
@@ -29,7 +30,9 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/modify"
+	"github.com/foxcpp/maddy/internal/table"
 )
 
 type sourceIn struct {
@@ -44,11 +47,104 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	dmarcOverrides  dmarc.Overrides
+
+	// deliveryConcurrency is the maximum amount of targets the message body
+	// is passed to in parallel.
+	deliveryConcurrency int
+
+	// alsoTargets receive a copy of each message regardless of the
+	// selected source and destination blocks.
+	alsoTargets []module.DeliveryTarget
+
+	// checkTimeout limits the time a single check can spend processing one
+	// stage of the message (connection, sender, recipient or body).
+	checkTimeout time.Duration
+
+	// tenantPolicy, if set, selects additional checks, modifiers and limits
+	// based on the recipient domain.
+	tenantPolicy *tenantPolicy
+
+	// checkReplies overrides SMTP status used for rejections by checks.
+	checkReplies checkReplies
+
+	// checkTimeouts overrides checkTimeout for individual checks and
+	// specifies what to do when they run out of time.
+	checkTimeouts checkTimeouts
+}
+
+// defaultCheckTimeout is used if check_timeout is not set either in the
+// pipeline or globally.
+const defaultCheckTimeout = 1 * time.Minute
+
+func globalCheckTimeout(globals map[string]interface{}) time.Duration {
+	if timeout, ok := globals["check_timeout"].(time.Duration); ok {
+		return timeout
+	}
+	return defaultCheckTimeout
+}
+
+func parseCheckTimeout(node config.Node) (time.Duration, error) {
+	if len(node.Args) != 1 || len(node.Children) != 0 {
+		return 0, config.NodeErr(node, "expected exactly one argument")
+	}
+	timeout, err := time.ParseDuration(node.Args[0])
+	if err != nil || timeout < 0 {
+		return 0, config.NodeErr(node, "invalid check timeout: %v", node.Args[0])
+	}
+	return timeout, nil
+}
+
+func parseDeliverAlso(globals map[string]interface{}, node config.Node) (module.DeliveryTarget, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "required at least one argument")
+	}
+	return modconfig.DeliveryTarget(globals, node.Args, node)
+}
+
+func parseDMARCOverrides(globals map[string]interface{}, node config.Node) (dmarc.Overrides, error) {
+	var (
+		overrides dmarc.Overrides
+		honorPct  bool
+	)
+
+	cfg := config.NewMap(globals, node)
+	cfg.Custom("exceptions", false, false, nil, modconfig.TableDirective, &overrides.Exceptions)
+	cfg.Custom("trusted_forwarders", false, false, nil, modconfig.TableDirective, &overrides.TrustedForwarders)
+	cfg.Bool("honor_pct", false, true, &honorPct)
+	cfg.Callback("quarantine_action", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "expected at least one argument")
+		}
+		switch node.Args[0] {
+		case dmarc.QuarantineJunk:
+			if len(node.Args) != 1 {
+				return config.NodeErr(node, "unexpected arguments")
+			}
+		case dmarc.QuarantineSubject, dmarc.QuarantineMailbox:
+			if len(node.Args) != 2 || node.Args[1] == "" {
+				return config.NodeErr(node, "expected exactly one non-empty argument for %s", node.Args[0])
+			}
+			overrides.QuarantineArg = node.Args[1]
+		default:
+			return config.NodeErr(node, "unknown quarantine action: %s", node.Args[0])
+		}
+		overrides.QuarantineAction = node.Args[0]
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return dmarc.Overrides{}, err
+	}
+
+	overrides.IgnorePercent = !honorPct
+	return overrides, nil
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
 	cfg := msgpipelineCfg{
-		perSource: map[string]sourceBlock{},
+		perSource:           map[string]sourceBlock{},
+		deliveryConcurrency: 8,
+		checkTimeout:        globalCheckTimeout(globals),
 	}
 	var defaultSrcRaw []config.Node
 	var othersRaw []config.Node
@@ -92,11 +188,19 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			}
 
 			for _, rule := range node.Args {
-				if strings.Contains(rule, "@") {
-					rule, err = address.ForLookup(rule)
-				} else {
-					rule, err = dns.ForLookup(rule)
+				grp, err := addressGroupRule(globals, node, rule)
+				if err != nil {
+					return msgpipelineCfg{}, err
 				}
+				if grp != nil {
+					cfg.sourceIn = append(cfg.sourceIn, sourceIn{
+						t:     grp,
+						block: srcBlock,
+					})
+					continue
+				}
+
+				rule, err = normalizeMatchRule(rule)
 				if err != nil {
 					return msgpipelineCfg{}, config.NodeErr(node, "invalid source match rule: %v: %v", rule, err)
 				}
@@ -129,6 +233,59 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
+			if len(node.Children) != 0 {
+				overrides, err := parseDMARCOverrides(globals, node)
+				if err != nil {
+					return msgpipelineCfg{}, err
+				}
+				cfg.dmarcOverrides = overrides
+			}
+		case "delivery_concurrency":
+			if len(node.Args) != 1 {
+				return msgpipelineCfg{}, config.NodeErr(node, "expected exactly one argument")
+			}
+			concurrency, err := strconv.Atoi(node.Args[0])
+			if err != nil || concurrency < 1 {
+				return msgpipelineCfg{}, config.NodeErr(node, "invalid delivery concurrency: %v", node.Args[0])
+			}
+			cfg.deliveryConcurrency = concurrency
+		case "check_timeout":
+			if len(node.Args) > 1 {
+				if cfg.checkTimeouts == nil {
+					cfg.checkTimeouts = checkTimeouts{}
+				}
+				if err := cfg.checkTimeouts.parse(node); err != nil {
+					return msgpipelineCfg{}, err
+				}
+				break
+			}
+			timeout, err := parseCheckTimeout(node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.checkTimeout = timeout
+		case "deliver_also":
+			tgt, err := parseDeliverAlso(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.alsoTargets = append(cfg.alsoTargets, tgt)
+		case "check_reply":
+			if cfg.checkReplies == nil {
+				cfg.checkReplies = checkReplies{}
+			}
+			if err := cfg.checkReplies.parse(node); err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "tenant_policy":
+			if cfg.tenantPolicy != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'tenant_policy' block")
+			}
+			tp, err := parseTenantPolicy(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.tenantPolicy = tp
 		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
@@ -179,6 +336,12 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 			}
 
 			src.modifiers.Modifiers = append(src.modifiers.Modifiers, modifiers.Modifiers...)
+		case "deliver_also":
+			tgt, err := parseDeliverAlso(globals, node)
+			if err != nil {
+				return sourceBlock{}, err
+			}
+			src.alsoTargets = append(src.alsoTargets, tgt)
 		case "destination_in":
 			var tbl module.Table
 			if err := modconfig.ModuleFromNode("table", node.Args, config.Node{}, globals, &tbl); err != nil {
@@ -203,11 +366,19 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 			}
 
 			for _, rule := range node.Args {
-				if strings.Contains(rule, "@") {
-					rule, err = address.ForLookup(rule)
-				} else {
-					rule, err = dns.ForLookup(rule)
+				grp, err := addressGroupRule(globals, node, rule)
+				if err != nil {
+					return sourceBlock{}, err
 				}
+				if grp != nil {
+					src.rcptIn = append(src.rcptIn, rcptIn{
+						t:     grp,
+						block: rcptBlock,
+					})
+					continue
+				}
+
+				rule, err = normalizeMatchRule(rule)
 				if err != nil {
 					return sourceBlock{}, config.NodeErr(node, "invalid destination match rule: %v: %v", rule, err)
 				}
@@ -392,6 +563,41 @@ func parseModifiersGroup(globals map[string]interface{}, node config.Node) (modi
 	return *mg, nil
 }
 
+// addressGroupRule returns the address group referenced by the match rule
+// in the $name form or nil if the rule is not a group reference.
+func addressGroupRule(globals map[string]interface{}, node config.Node, rule string) (*table.AddressGroup, error) {
+	if !strings.HasPrefix(rule, "$") {
+		return nil, nil
+	}
+	if len(rule) == 1 {
+		return nil, config.NodeErr(node, "missing address group name")
+	}
+
+	// Children of node belong to the pipeline block, not to the group.
+	refNode := config.Node{Name: node.Name, File: node.File, Line: node.Line}
+	var grp *table.AddressGroup
+	if err := modconfig.ModuleFromNode("table", []string{"&" + rule[1:]}, refNode, globals, &grp); err != nil {
+		return nil, err
+	}
+	return grp, nil
+}
+
+// normalizeMatchRule converts the source or destination match rule into
+// the canonical form used for lookups.
+func normalizeMatchRule(rule string) (string, error) {
+	if strings.Contains(rule, "@") {
+		return address.ForLookup(rule)
+	}
+	if strings.HasPrefix(rule, "*.") {
+		domain, err := dns.ForLookup(rule[2:])
+		return "*." + domain, err
+	}
+	return dns.ForLookup(rule)
+}
+
 func validMatchRule(rule string) bool {
+	if strings.HasPrefix(rule, "*.") {
+		return address.ValidDomain(rule[2:])
+	}
 	return address.ValidDomain(rule) || address.Valid(rule)
 }
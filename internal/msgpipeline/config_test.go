@@ -25,6 +25,7 @@ import (
 
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
 )
 
 func policyError(code int) error {
@@ -63,6 +64,8 @@ func TestMsgPipelineCfg(t *testing.T) {
 				  	}
 				}`,
 			value: msgpipelineCfg{
+				deliveryConcurrency: 8,
+				checkTimeout:        defaultCheckTimeout,
 				perSource: map[string]sourceBlock{
 					"example.com": {
 						perRcpt: map[string]*rcptBlock{
@@ -97,6 +100,8 @@ func TestMsgPipelineCfg(t *testing.T) {
 					reject 420
 				}`,
 			value: msgpipelineCfg{
+				deliveryConcurrency: 8,
+				checkTimeout:        defaultCheckTimeout,
 				perSource: map[string]sourceBlock{
 					"example.com": {
 						perRcpt: map[string]*rcptBlock{},
@@ -123,7 +128,9 @@ func TestMsgPipelineCfg(t *testing.T) {
 					reject 420
 				}`,
 			value: msgpipelineCfg{
-				perSource: map[string]sourceBlock{},
+				deliveryConcurrency: 8,
+				checkTimeout:        defaultCheckTimeout,
+				perSource:           map[string]sourceBlock{},
 				defaultSource: sourceBlock{
 					perRcpt: map[string]*rcptBlock{
 						"example.com": {
@@ -439,3 +446,32 @@ func TestMsgPipelineCfg_RcptChecks_Multiple(t *testing.T) {
 		t.Fatalf("wrong amount of test_check's in rcpt checks: %d", len(parsed.defaultSource.perRcpt["example.org"].checks))
 	}
 }
+
+func TestNewFilter(t *testing.T) {
+	str := `
+		check {
+			test_check
+		}
+		deliver_to dummy
+	`
+	cfg, _ := parser.Read(strings.NewReader(str), "literal")
+
+	target := testutils.Target{}
+	if _, err := NewFilter(nil, cfg, &target); err == nil {
+		t.Fatal("expected error for deliver_to directive")
+	}
+
+	d, err := NewFilter(nil, cfg[:1], &target)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if len(d.globalChecks) != 1 {
+		t.Fatalf("wrong amount of checks: %d", len(d.globalChecks))
+	}
+	d.Log = testutils.Logger(t, "msgpipeline")
+
+	testutils.DoTestDelivery(t, d, "whatever@whatever", []string{"whatever@whatever"})
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+}
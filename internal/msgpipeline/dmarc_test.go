@@ -35,6 +35,7 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -222,3 +223,83 @@ func TestDMARC(t *testing.T) {
 		&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
 	}, false, true, authres.ResultFail)
 }
+
+func TestDMARC_Overrides(t *testing.T) {
+	test := func(overrides dmarc.Overrides, txt string, reject, quarantine bool, subject string) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		p := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{
+					&testutils.Check{
+						BodyRes: module.CheckResult{
+							AuthResult: []authres.Result{
+								&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+								&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
+							},
+						},
+					},
+				},
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC:        true,
+				dmarcOverrides: overrides,
+			},
+			Log: testutils.Logger(t, "pipeline"),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_dmarc.example.com.": {
+					TXT: []string{txt},
+				},
+			}},
+		}
+
+		_, err := doTestDelivery(t, &p, "test@example.org", []string{"test@example.com"},
+			"From: hello@example.com\r\nSubject: Hello\r\n\r\n")
+		if reject {
+			if err == nil {
+				t.Errorf("expected message to be rejected")
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v %+v", err, exterrors.Fields(err))
+			return
+		}
+		if len(tgt.Messages) != 1 {
+			t.Errorf("got %d messages", len(tgt.Messages))
+			return
+		}
+		msg := tgt.Messages[0]
+		if msg.MsgMeta.Quarantine != quarantine {
+			t.Errorf("msg.MsgMeta.Quarantine (%v) != quarantine (%v)", msg.MsgMeta.Quarantine, quarantine)
+		}
+		if got := msg.Header.Get("Subject"); got != subject {
+			t.Errorf("wrong subject: %q", got)
+		}
+		if res := dmarcResult(t, msg.Header); res != authres.ResultFail {
+			t.Errorf("expected DMARC result to be 'fail', got '%v'", res)
+		}
+	}
+
+	exceptions := testutils.Table{M: map[string]string{
+		"example.com": "",
+	}}
+	downgrade := testutils.Table{M: map[string]string{
+		"example.com": "quarantine",
+	}}
+
+	test(dmarc.Overrides{}, "v=DMARC1; p=reject", true, false, "")
+	test(dmarc.Overrides{Exceptions: exceptions}, "v=DMARC1; p=reject", false, false, "Hello")
+	test(dmarc.Overrides{Exceptions: downgrade}, "v=DMARC1; p=reject", false, true, "Hello")
+	test(dmarc.Overrides{
+		QuarantineAction: dmarc.QuarantineSubject,
+		QuarantineArg:    "[SPAM]",
+	}, "v=DMARC1; p=quarantine", false, false, "[SPAM] Hello")
+	test(dmarc.Overrides{IgnorePercent: true}, "v=DMARC1; p=reject; pct=0", true, false, "")
+}
@@ -39,9 +39,29 @@ var (
 		},
 		[]string{"check"},
 	)
+	checkCached = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "check",
+			Name:      "cached",
+			Help:      "Number of times a check result was reused instead of running the check again for the same message",
+		},
+		[]string{"check"},
+	)
+	checkTimedOut = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "check",
+			Name:      "timed_out",
+			Help:      "Number of times a check with configured time budget did not finish in time",
+		},
+		[]string{"check", "action"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(checkReject)
 	prometheus.MustRegister(checkQuarantined)
+	prometheus.MustRegister(checkCached)
+	prometheus.MustRegister(checkTimedOut)
 }
@@ -20,6 +20,7 @@ package msgpipeline
 
 import (
 	"context"
+	"sync"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -32,6 +33,7 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tracing"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -61,6 +63,10 @@ type MsgPipeline struct {
 	// exactly in this place.
 	FirstPipeline bool
 
+	// Received controls the format of the Received header field added if
+	// FirstPipeline is set.
+	Received target.ReceivedOptions
+
 	Log log.Logger
 }
 
@@ -76,6 +82,7 @@ type sourceBlock struct {
 	rcptIn      []rcptIn
 	perRcpt     map[string]*rcptBlock
 	defaultRcpt *rcptBlock
+	alsoTargets []module.DeliveryTarget
 }
 
 type rcptBlock struct {
@@ -93,6 +100,79 @@ func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error
 	}, err
 }
 
+// NewFilter creates a MsgPipeline that runs only checks and modifiers
+// defined in cfg and passes all accepted messages to tgt.
+//
+// It is used to apply checks to messages that are not received via SMTP,
+// such as messages added using IMAP APPEND.
+func NewFilter(globals map[string]interface{}, cfg []config.Node, tgt module.DeliveryTarget) (*MsgPipeline, error) {
+	parsedCfg := msgpipelineCfg{
+		perSource: map[string]sourceBlock{},
+		defaultSource: sourceBlock{
+			perRcpt: map[string]*rcptBlock{},
+			defaultRcpt: &rcptBlock{
+				targets: []module.DeliveryTarget{tgt},
+			},
+		},
+		deliveryConcurrency: 1,
+		checkTimeout:        globalCheckTimeout(globals),
+	}
+	for _, node := range cfg {
+		switch node.Name {
+		case "check":
+			checks, err := parseChecksGroup(globals, node)
+			if err != nil {
+				return nil, err
+			}
+			parsedCfg.globalChecks = append(parsedCfg.globalChecks, checks...)
+		case "modify":
+			modifiers, err := parseModifiersGroup(globals, node)
+			if err != nil {
+				return nil, err
+			}
+			parsedCfg.globalModifiers.Modifiers = append(parsedCfg.globalModifiers.Modifiers, modifiers.Modifiers...)
+		case "check_timeout":
+			if len(node.Args) > 1 {
+				if parsedCfg.checkTimeouts == nil {
+					parsedCfg.checkTimeouts = checkTimeouts{}
+				}
+				if err := parsedCfg.checkTimeouts.parse(node); err != nil {
+					return nil, err
+				}
+				break
+			}
+			timeout, err := parseCheckTimeout(node)
+			if err != nil {
+				return nil, err
+			}
+			parsedCfg.checkTimeout = timeout
+		case "check_reply":
+			if parsedCfg.checkReplies == nil {
+				parsedCfg.checkReplies = checkReplies{}
+			}
+			if err := parsedCfg.checkReplies.parse(node); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, config.NodeErr(node, "unexpected directive: %s, only check, modify, check_timeout and check_reply are allowed", node.Name)
+		}
+	}
+
+	return &MsgPipeline{
+		msgpipelineCfg: parsedCfg,
+		Resolver:       dns.DefaultResolver(),
+	}, nil
+}
+
+// targetConcurrency returns the maximum amount of targets to deliver the
+// message to in parallel.
+func (d *MsgPipeline) targetConcurrency() int {
+	if d.deliveryConcurrency < 1 {
+		return 1
+	}
+	return d.deliveryConcurrency
+}
+
 func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *module.ConnState) error {
 	eg, checkCtx := errgroup.WithContext(ctx)
 
@@ -124,13 +204,26 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 		deliveries:         make(map[module.DeliveryTarget]*delivery),
 		msgMeta:            msgMeta,
 		log:                target.DeliveryLogger(d.Log, msgMeta),
+		tracer:             tracerFromContext(ctx),
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.dmarcOverrides = d.dmarcOverrides
+	dd.checkRunner.dmarcVerify.IgnorePercent = d.dmarcOverrides.IgnorePercent
+	dd.checkRunner.tracer = dd.tracer
+	dd.checkRunner.checkTimeout = d.checkTimeout
+	dd.checkRunner.replies = d.checkReplies
+	dd.checkRunner.timeouts = d.checkTimeouts
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
 	}
+	if msgMeta.Annotations == nil {
+		msgMeta.Annotations = module.NewAnnotations()
+	}
+	if msgMeta.CheckCache == nil {
+		msgMeta.CheckCache = module.NewCheckCache()
+	}
 
 	if err := dd.start(ctx, msgMeta, mailFrom); err != nil {
 		dd.close()
@@ -169,10 +262,12 @@ func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMet
 	if err != nil {
 		return err
 	}
-	mailFrom, err = sourceModifiersState.RewriteSender(ctx, mailFrom)
+	newFrom, err := sourceModifiersState.RewriteSender(ctx, mailFrom)
 	if err != nil {
 		return err
 	}
+	dd.traceRewrite("per-source sender", mailFrom, []string{newFrom})
+	mailFrom = newFrom
 	dd.sourceModifiersState = sourceModifiersState
 
 	dd.sourceAddr = mailFrom
@@ -184,13 +279,14 @@ func (dd *msgpipelineDelivery) initRunGlobalModifiers(ctx context.Context, msgMe
 	if err != nil {
 		return "", err
 	}
-	mailFrom, err = globalModifiersState.RewriteSender(ctx, mailFrom)
+	newFrom, err := globalModifiersState.RewriteSender(ctx, mailFrom)
 	if err != nil {
 		globalModifiersState.Close()
 		return "", err
 	}
+	dd.traceRewrite("global sender", mailFrom, []string{newFrom})
 	dd.globalModifiersState = globalModifiersState
-	return mailFrom, nil
+	return newFrom, nil
 }
 
 func (dd *msgpipelineDelivery) srcBlockForAddr(ctx context.Context, mailFrom string) (sourceBlock, error) {
@@ -217,6 +313,7 @@ func (dd *msgpipelineDelivery) srcBlockForAddr(ctx context.Context, mailFrom str
 		if !ok {
 			continue
 		}
+		dd.traceRule("source", mailFrom, "source_in "+objectName(srcIn.t))
 		return srcIn.block, nil
 	}
 
@@ -241,21 +338,36 @@ func (dd *msgpipelineDelivery) srcBlockForAddr(ctx context.Context, mailFrom str
 
 		// domain is already case-folded and normalized by the message source.
 		srcBlock, ok = dd.d.perSource[domain]
+		if !ok {
+			// Then try wildcard rules.
+			for _, wildcard := range dns.WildcardMatches(domain) {
+				srcBlock, ok = dd.d.perSource[wildcard]
+				if ok {
+					domain = wildcard
+					break
+				}
+			}
+		}
 		if !ok {
 			// Fallback to the default source block.
 			srcBlock = dd.d.defaultSource
 			dd.log.Debugf("sender %s matched by default rule", mailFrom)
+			dd.traceRule("source", mailFrom, "default_source")
 		} else {
 			dd.log.Debugf("sender %s matched by domain rule '%s'", mailFrom, domain)
+			dd.traceRule("source", mailFrom, "source "+domain)
 		}
 	} else {
 		dd.log.Debugf("sender %s matched by address rule '%s'", mailFrom, cleanFrom)
+		dd.traceRule("source", mailFrom, "source "+cleanFrom)
 	}
 	return srcBlock, nil
 }
 
 type delivery struct {
 	module.Delivery
+	// Name of the target the delivery object belongs to.
+	target string
 	// Recipient addresses this delivery object is used for, original values (not modified by RewriteRcpt).
 	recipients []string
 }
@@ -272,9 +384,38 @@ type msgpipelineDelivery struct {
 	sourceAddr  string
 	sourceBlock sourceBlock
 
+	// Tenant profile selected by the first recipient, see tenantPolicy.
+	tenantSelected       bool
+	tenantProfile        *tenantProfile
+	tenantDomains        map[string]struct{}
+	tenantModifiersState module.ModifierState
+
 	deliveries  map[module.DeliveryTarget]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
+
+	// headerChecked is set once header-only checks are executed, either by
+	// Header or by Body.
+	headerChecked bool
+
+	// tracer is set if the message is handled in the dry-run mode.
+	tracer Tracer
+}
+
+func (dd *msgpipelineDelivery) traceRule(kind, addr, rule string) {
+	if dd.tracer != nil {
+		dd.tracer.Rule(kind, addr, rule)
+	}
+}
+
+func (dd *msgpipelineDelivery) traceRewrite(stage, from string, to []string) {
+	if dd.tracer == nil {
+		return
+	}
+	if len(to) == 1 && to[0] == from {
+		return
+	}
+	dd.tracer.Rewrite(stage, from, to)
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
@@ -292,6 +433,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		return err
 	}
 	dd.log.Debugln("global rcpt modifiers:", to, "=>", newTo)
+	dd.traceRewrite("global rcpt", to, newTo)
 	resultTo := newTo
 	newTo = []string{}
 
@@ -301,6 +443,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		if err != nil {
 			return err
 		}
+		dd.traceRewrite("per-source rcpt", to, tempTo)
 		newTo = append(newTo, tempTo...)
 	}
 	dd.log.Debugln("per-source rcpt modifiers:", to, "=>", newTo)
@@ -313,6 +456,10 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 			})
 		}
 
+		if err := dd.applyTenantPolicy(ctx, to); err != nil {
+			return wrapErr(err)
+		}
+
 		rcptBlock, err := dd.rcptBlockForAddr(ctx, to)
 		if err != nil {
 			return wrapErr(err)
@@ -337,6 +484,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 			return wrapErr(err)
 		}
 		dd.log.Debugln("per-rcpt modifiers:", to, "=>", newTo)
+		dd.traceRewrite("per-rcpt", to, newTo)
 
 		for _, to = range newTo {
 			wrapErr = func(err error) error {
@@ -372,16 +520,80 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		}
 	}
 
+	// Copies requested using deliver_also get the recipient as it was
+	// presented by the client, once it is accepted by the routing above.
+	if err := dd.addAlsoRcpt(ctx, dd.d.alsoTargets, originalTo); err != nil {
+		return err
+	}
+	return dd.addAlsoRcpt(ctx, dd.sourceBlock.alsoTargets, originalTo)
+}
+
+func (dd *msgpipelineDelivery) addAlsoRcpt(ctx context.Context, targets []module.DeliveryTarget, to string) error {
+	for _, tgt := range targets {
+		delivery, err := dd.getDelivery(ctx, tgt)
+		if err != nil {
+			return err
+		}
+
+		// Do not pass DSN options, the sender should not be notified
+		// about the copy.
+		if err := delivery.AddRcpt(ctx, to, smtp.RcptOptions{}); err != nil {
+			return err
+		}
+		delivery.recipients = append(delivery.recipients, to)
+	}
 	return nil
 }
 
+// Header runs header-only checks before the message body is received.
+func (dd *msgpipelineDelivery) Header(ctx context.Context, header textproto.Header) error {
+	if dd.headerChecked {
+		return nil
+	}
+	dd.headerChecked = true
+
+	if err := dd.checkRunner.checkHeader(ctx, dd.d.globalChecks, header); err != nil {
+		return err
+	}
+	if err := dd.checkRunner.checkHeader(ctx, dd.sourceBlock.checks, header); err != nil {
+		return err
+	}
+	if err := dd.checkRunner.checkHeader(ctx, dd.tenantChecks(), header); err != nil {
+		return err
+	}
+	for blk := range dd.rcptModifiersState {
+		if err := dd.checkRunner.checkHeader(ctx, blk.checks, header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaxMessageSize returns the message size limit of the selected tenant
+// profile, if any.
+func (dd *msgpipelineDelivery) MaxMessageSize() int64 {
+	if dd.tenantProfile == nil {
+		return 0
+	}
+	return dd.tenantProfile.maxMessageSize
+}
+
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if err := dd.Header(ctx, header); err != nil {
+		return err
+	}
 	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
 		return err
 	}
 	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
 		return err
 	}
+	if err := dd.checkTenantSize(body.Len()); err != nil {
+		return err
+	}
+	if err := dd.checkRunner.checkBody(ctx, dd.tenantChecks(), header, body); err != nil {
+		return err
+	}
 	for blk := range dd.rcptModifiersState {
 		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
 			return err
@@ -393,14 +605,14 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		// how we received it BUT place it below any other field that might be
 		// added by applyResults (including Authentication-Results)
 		// per recommendation in RFC 7001, Section 4 (see GH issue #135).
-		received, err := target.GenerateReceived(ctx, dd.msgMeta, dd.d.Hostname, dd.msgMeta.OriginalFrom)
+		received, err := target.GenerateReceivedOpts(ctx, dd.msgMeta, dd.d.Hostname, dd.msgMeta.OriginalFrom, dd.d.Received)
 		if err != nil {
 			return err
 		}
 		header.Add("Received", received)
 	}
 
-	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
+	if err := dd.checkRunner.applyResults(ctx, dd.d.Hostname, &header); err != nil {
 		return err
 	}
 
@@ -417,14 +629,37 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 			return err
 		}
 	}
-
-	for _, delivery := range dd.deliveries {
-		if err := delivery.Body(ctx, header, body); err != nil {
+	if dd.tenantModifiersState != nil {
+		if err := dd.tenantModifiersState.RewriteBody(ctx, &header, body); err != nil {
 			return err
 		}
-		dd.log.Debugf("delivery.Body ok, Delivery object = %T", delivery)
 	}
-	return nil
+
+	// Deliveries are independent, so run them in parallel. Each target gets
+	// its own copy of the header since it may modify it.
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(dd.d.targetConcurrency())
+	for _, delivery := range dd.deliveries {
+		delivery := delivery
+		header := header.Copy()
+		eg.Go(func() error {
+			tgtCtx, span := tracing.Start(egCtx, "target", "maddy.target", delivery.target,
+				"maddy.rcpts", len(delivery.recipients))
+			defer span.End()
+
+			err := delivery.Body(tgtCtx, header, body)
+			span.SetError(err)
+			if err != nil {
+				// Only the first error is returned, others are likely
+				// caused by the cancellation, but log them anyway.
+				dd.log.Debugf("delivery.Body failed, target = %s: %v", delivery.target, err)
+				return err
+			}
+			dd.log.Debugf("delivery.Body ok, Delivery object = %T", delivery)
+			return nil
+		})
+	}
+	return eg.Wait()
 }
 
 // statusCollector wraps StatusCollector and adds reverse translation
@@ -448,6 +683,19 @@ func (sc statusCollector) SetStatus(rcptTo string, err error) {
 	sc.wrapped.SetStatus(rcptTo, err)
 }
 
+// lockedCollector serializes SetStatus calls made by targets running in
+// parallel.
+type lockedCollector struct {
+	lock    sync.Mutex
+	wrapped module.StatusCollector
+}
+
+func (lc *lockedCollector) SetStatus(rcptTo string, err error) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	lc.wrapped.SetStatus(rcptTo, err)
+}
+
 func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
 	setStatusAll := func(err error) {
 		for _, delivery := range dd.deliveries {
@@ -457,6 +705,10 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		}
 	}
 
+	if err := dd.Header(ctx, header); err != nil {
+		setStatusAll(err)
+		return
+	}
 	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
 		setStatusAll(err)
 		return
@@ -465,6 +717,14 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		setStatusAll(err)
 		return
 	}
+	if err := dd.checkTenantSize(body.Len()); err != nil {
+		setStatusAll(err)
+		return
+	}
+	if err := dd.checkRunner.checkBody(ctx, dd.tenantChecks(), header, body); err != nil {
+		setStatusAll(err)
+		return
+	}
 
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
@@ -482,23 +742,53 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 			return
 		}
 	}
+	if dd.tenantModifiersState != nil {
+		if err := dd.tenantModifiersState.RewriteBody(ctx, &header, body); err != nil {
+			setStatusAll(err)
+			return
+		}
+	}
+
+	// Statuses are reported from multiple goroutines.
+	locked := &lockedCollector{wrapped: c}
+	sc := statusCollector{
+		originalRcpts: dd.msgMeta.OriginalRcpts,
+		wrapped:       locked,
+	}
 
+	sem := make(chan struct{}, dd.d.targetConcurrency())
+	var wg sync.WaitGroup
 	for _, delivery := range dd.deliveries {
-		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
-		if ok {
-			partDelivery.BodyNonAtomic(ctx, statusCollector{
-				originalRcpts: dd.msgMeta.OriginalRcpts,
-				wrapped:       c,
-			}, header, body)
-			continue
-		}
+		delivery := delivery
+		header := header.Copy()
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			tgtCtx, span := tracing.Start(ctx, "target", "maddy.target", delivery.target,
+				"maddy.rcpts", len(delivery.recipients))
+			defer span.End()
+
+			partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
+			if ok {
+				partDelivery.BodyNonAtomic(tgtCtx, sc, header, body)
+				return
+			}
 
-		if err := delivery.Body(ctx, header, body); err != nil {
-			for _, rcpt := range delivery.recipients {
-				c.SetStatus(rcpt, err)
+			if err := delivery.Body(tgtCtx, header, body); err != nil {
+				span.SetError(err)
+				for _, rcpt := range delivery.recipients {
+					locked.SetStatus(rcpt, err)
+				}
 			}
-		}
+		}()
 	}
+	wg.Wait()
 }
 
 func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
@@ -525,6 +815,9 @@ func (dd *msgpipelineDelivery) close() {
 	for _, modifiers := range dd.rcptModifiersState {
 		modifiers.Close()
 	}
+	if dd.tenantModifiersState != nil {
+		dd.tenantModifiersState.Close()
+	}
 }
 
 func (dd msgpipelineDelivery) Abort(ctx context.Context) error {
@@ -561,6 +854,7 @@ func (dd *msgpipelineDelivery) rcptBlockForAddr(ctx context.Context, rcptTo stri
 		if !ok {
 			continue
 		}
+		dd.traceRule("destination", rcptTo, "destination_in "+objectName(rcptIn.t))
 		return rcptIn.block, nil
 	}
 
@@ -582,15 +876,28 @@ func (dd *msgpipelineDelivery) rcptBlockForAddr(ctx context.Context, rcptTo stri
 		// domain is already case-folded and normalized because it is a part of
 		// cleanRcpt.
 		rcptBlock, ok = dd.sourceBlock.perRcpt[domain]
+		if !ok {
+			// Then try wildcard rules.
+			for _, wildcard := range dns.WildcardMatches(domain) {
+				rcptBlock, ok = dd.sourceBlock.perRcpt[wildcard]
+				if ok {
+					domain = wildcard
+					break
+				}
+			}
+		}
 		if !ok {
 			// Fallback to the default source block.
 			rcptBlock = dd.sourceBlock.defaultRcpt
 			dd.log.Debugf("recipient %s matched by default rule (clean = %s)", rcptTo, cleanRcpt)
+			dd.traceRule("destination", rcptTo, "default_destination")
 		} else {
 			dd.log.Debugf("recipient %s matched by domain rule '%s'", rcptTo, domain)
+			dd.traceRule("destination", rcptTo, "destination "+domain)
 		}
 	} else {
 		dd.log.Debugf("recipient %s matched by address rule '%s'", rcptTo, cleanRcpt)
+		dd.traceRule("destination", rcptTo, "destination "+cleanRcpt)
 	}
 	return rcptBlock, nil
 }
@@ -622,12 +929,22 @@ func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.Deliv
 		return delivery_, nil
 	}
 
+	if dd.tracer != nil && !isNestedPipeline(tgt) {
+		delivery_ = &delivery{target: objectName(tgt), Delivery: &traceDelivery{
+			tracer:   dd.tracer,
+			target:   objectName(tgt),
+			mailFrom: dd.sourceAddr,
+		}}
+		dd.deliveries[tgt] = delivery_
+		return delivery_, nil
+	}
+
 	deliveryObj, err := tgt.Start(ctx, dd.msgMeta, dd.sourceAddr)
 	if err != nil {
 		dd.log.Debugf("tgt.Start(%s) failure, target = %s: %v", dd.sourceAddr, objectName(tgt), err)
 		return nil, err
 	}
-	delivery_ = &delivery{Delivery: deliveryObj}
+	delivery_ = &delivery{Delivery: deliveryObj, target: objectName(tgt)}
 
 	dd.log.Debugf("tgt.Start(%s) ok, target = %s", dd.sourceAddr, objectName(tgt))
 
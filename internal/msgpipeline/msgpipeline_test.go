@@ -21,7 +21,9 @@ package msgpipeline
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -268,6 +270,45 @@ func TestMsgPipeline_PerRcptDomainSplit(t *testing.T) {
 	testutils.CheckTestMessage(t, &target2, 1, "sender@example.com", []string{"rcpt1@example.org"})
 }
 
+func TestMsgPipeline_PerRcptWildcardDomain(t *testing.T) {
+	target1, target2 := testutils.Target{InstName: "target1"}, testutils.Target{InstName: "target2"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"*.example.org": {
+						targets: []module.DeliveryTarget{&target1},
+					},
+					"*.customers.example.org": {
+						targets: []module.DeliveryTarget{&target2},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					rejectErr: errors.New("defaultRcpt block used"),
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@a.example.org", "rcpt2@acme.customers.example.org"})
+	_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.org"})
+	if err == nil {
+		t.Error("expected the wildcard to not match the parent domain")
+	}
+
+	if len(target1.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for target1, want %d, got %d", 1, len(target1.Messages))
+	}
+	testutils.CheckTestMessage(t, &target1, 0, "sender@example.com", []string{"rcpt1@a.example.org"})
+
+	if len(target2.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for target2, want %d, got %d", 1, len(target2.Messages))
+	}
+	testutils.CheckTestMessage(t, &target2, 0, "sender@example.com", []string{"rcpt2@acme.customers.example.org"})
+}
+
 func TestMsgPipeline_DestInSplit(t *testing.T) {
 	target1, target2 := testutils.Target{InstName: "target1"}, testutils.Target{InstName: "target2"}
 	d := MsgPipeline{
@@ -704,3 +745,139 @@ func TestMsgPipeline_multi_alias(t *testing.T) {
 	}
 	testutils.CheckTestMessage(t, &target2, 0, "sender@example.com", []string{"recipient-2@example.net"})
 }
+
+// barrierTarget is a target that waits in Body until all other targets
+// sharing the barrier are also called.
+type barrierTarget struct {
+	testutils.Target
+	barrier *sync.WaitGroup
+}
+
+type barrierDelivery struct {
+	module.Delivery
+	barrier *sync.WaitGroup
+}
+
+func (bt *barrierTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	delivery, err := bt.Target.Start(ctx, msgMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return barrierDelivery{Delivery: delivery, barrier: bt.barrier}, nil
+}
+
+func (bd barrierDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	bd.barrier.Done()
+
+	done := make(chan struct{})
+	go func() {
+		bd.barrier.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		return errors.New("targets are not called in parallel")
+	}
+
+	return bd.Delivery.Body(ctx, header, body)
+}
+
+func TestMsgPipeline_ParallelTargets(t *testing.T) {
+	barrier := &sync.WaitGroup{}
+	barrier.Add(3)
+	targets := []*barrierTarget{
+		{Target: testutils.Target{InstName: "tgt1"}, barrier: barrier},
+		{Target: testutils.Target{InstName: "tgt2"}, barrier: barrier},
+		{Target: testutils.Target{InstName: "tgt3"}, barrier: barrier},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{targets[0], targets[1], targets[2]},
+				},
+			},
+			deliveryConcurrency: 3,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	for _, tgt := range targets {
+		if len(tgt.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received for %s, want %d, got %d", tgt.InstName, 1, len(tgt.Messages))
+		}
+		testutils.CheckTestMessage(t, &tgt.Target, 0, "sender@example.com", []string{"rcpt1@example.com"})
+	}
+}
+
+func TestMsgPipeline_ParallelTargets_Fail(t *testing.T) {
+	okTarget := testutils.Target{InstName: "ok"}
+	failTarget := testutils.Target{InstName: "fail", BodyErr: errors.New("go away")}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&okTarget, &failTarget},
+				},
+			},
+			deliveryConcurrency: 2,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com"}); err == nil {
+		t.Fatal("expected error from the failed target")
+	}
+	if len(okTarget.Messages) != 0 {
+		t.Fatalf("message should not be committed if any target failed, got %d", len(okTarget.Messages))
+	}
+}
+
+func TestMsgPipeline_DeliverAlso(t *testing.T) {
+	comTarget, orgTarget, archive := testutils.Target{InstName: "comTarget"}, testutils.Target{InstName: "orgTarget"}, testutils.Target{InstName: "archive"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.com": {
+						targets: []module.DeliveryTarget{&comTarget},
+					},
+					"example.org": {
+						targets: []module.DeliveryTarget{&orgTarget},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					rejectErr: errors.New("default rcpt block used"),
+				},
+			},
+			alsoTargets: []module.DeliveryTarget{&archive},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.org"})
+
+	testutils.CheckTestMessage(t, &comTarget, 0, "sender@example.com", []string{"rcpt1@example.com"})
+	testutils.CheckTestMessage(t, &orgTarget, 0, "sender@example.com", []string{"rcpt2@example.org"})
+	if len(archive.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for archive, want %d, got %d", 1, len(archive.Messages))
+	}
+	testutils.CheckTestMessage(t, &archive, 0, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.org"})
+
+	// Rejected recipients should not be passed to the deliver_also target.
+	_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.net"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if len(archive.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for archive, want %d, got %d", 1, len(archive.Messages))
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// checkReply is the SMTP status that should be used instead of the one
+// returned by the check when it rejects or quarantines the message.
+//
+// Temporary and permanent errors are overridden separately so a configured
+// 5xx reply does not turn a transient failure into a permanent one.
+type checkReply struct {
+	temp *exterrors.SMTPError
+	perm *exterrors.SMTPError
+}
+
+// apply returns the error with the SMTP status replaced according to the
+// configured reply. reason is returned as is if there is no reply for its
+// class.
+func (r *checkReply) apply(reason error) error {
+	if r == nil {
+		return reason
+	}
+	override := r.perm
+	if exterrors.IsTemporary(reason) {
+		override = r.temp
+	}
+	if override == nil {
+		return reason
+	}
+	return modconfig.OverrideReason(override, reason)
+}
+
+// checkReplies maps check names to configured replies.
+type checkReplies map[string]*checkReply
+
+func (cr checkReplies) parse(node config.Node) error {
+	if len(node.Children) != 0 {
+		return config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) < 2 {
+		return config.NodeErr(node, "expected at least 2 arguments")
+	}
+	reply, err := modconfig.ParseRejectDirective(node.Args[1:])
+	if err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+
+	r := cr[node.Args[0]]
+	if r == nil {
+		r = &checkReply{}
+		cr[node.Args[0]] = r
+	}
+	dst := &r.perm
+	if reply.Code/100 == 4 {
+		dst = &r.temp
+	}
+	if *dst != nil {
+		return config.NodeErr(node, "duplicate reply for %s", node.Args[0])
+	}
+	*dst = reply
+	return nil
+}
+
+// forCheck returns the reply configured for the check.
+func (cr checkReplies) forCheck(check interface{}) *checkReply {
+	if len(cr) == 0 {
+		return nil
+	}
+	for _, name := range checkConfigNames(check) {
+		if reply := cr[name]; reply != nil {
+			return reply
+		}
+	}
+	return nil
+}
+
+// checkConfigNames returns names that can be used to refer to the check in
+// per-check directives, in the order of precedence. Instance name takes
+// precedence over the module name, the latter can be specified with or
+// without the "check." prefix.
+func checkConfigNames(check interface{}) []string {
+	mod, ok := check.(module.Module)
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, 3)
+	if mod.InstanceName() != "" {
+		names = append(names, mod.InstanceName())
+	}
+	return append(names, mod.Name(), strings.TrimPrefix(mod.Name(), "check."))
+}
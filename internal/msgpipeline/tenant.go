@@ -0,0 +1,298 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+	"github.com/foxcpp/maddy/internal/modify"
+)
+
+// tenantPolicy selects the additional checks, modifiers and limits applied
+// to the message based on the recipient domain.
+//
+// All recipients of a message should belong to the same profile, recipients
+// with a different profile are deferred so the client sends them in a
+// separate transaction. This way the policy of one tenant never affects
+// messages for another.
+type tenantPolicy struct {
+	table          module.Table
+	profiles       map[string]*tenantProfile
+	defaultProfile *tenantProfile
+}
+
+type tenantProfile struct {
+	name           string
+	checks         []module.Check
+	modifiers      modify.Group
+	maxMessageSize int64
+
+	// rate limits the amount of messages accepted per recipient domain.
+	rate *limiters.BucketSet
+}
+
+// rateWait is the maximum time a message waits for the tenant rate
+// limit before it is deferred.
+const rateWait = 1 * time.Second
+
+func parseTenantPolicy(globals map[string]interface{}, node config.Node) (*tenantPolicy, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "expected at least one argument (table)")
+	}
+
+	tp := &tenantPolicy{
+		profiles: map[string]*tenantProfile{},
+	}
+	if err := modconfig.ModuleFromNode("table", node.Args, config.Node{}, globals, &tp.table); err != nil {
+		return nil, err
+	}
+
+	var defaultName string
+	var defaultNode config.Node
+	for _, child := range node.Children {
+		switch child.Name {
+		case "profile":
+			if len(child.Args) != 1 {
+				return nil, config.NodeErr(child, "expected exactly one argument (profile name)")
+			}
+			if _, ok := tp.profiles[child.Args[0]]; ok {
+				return nil, config.NodeErr(child, "duplicate profile: %s", child.Args[0])
+			}
+			profile, err := parseTenantProfile(globals, child)
+			if err != nil {
+				return nil, err
+			}
+			tp.profiles[profile.name] = profile
+		case "default_profile":
+			if len(child.Args) != 1 {
+				return nil, config.NodeErr(child, "expected exactly one argument (profile name)")
+			}
+			defaultName = child.Args[0]
+			defaultNode = child
+		default:
+			return nil, config.NodeErr(child, "unknown tenant_policy directive: %s", child.Name)
+		}
+	}
+
+	if defaultName != "" {
+		tp.defaultProfile = tp.profiles[defaultName]
+		if tp.defaultProfile == nil {
+			return nil, config.NodeErr(defaultNode, "unknown profile: %s", defaultName)
+		}
+	}
+
+	return tp, nil
+}
+
+func parseTenantProfile(globals map[string]interface{}, node config.Node) (*tenantProfile, error) {
+	profile := &tenantProfile{name: node.Args[0]}
+	for _, child := range node.Children {
+		switch child.Name {
+		case "check":
+			checks, err := parseChecksGroup(globals, child)
+			if err != nil {
+				return nil, err
+			}
+			profile.checks = append(profile.checks, checks...)
+		case "modify":
+			modifiers, err := parseModifiersGroup(globals, child)
+			if err != nil {
+				return nil, err
+			}
+			profile.modifiers.Modifiers = append(profile.modifiers.Modifiers, modifiers.Modifiers...)
+		case "max_message_size":
+			if len(child.Args) != 1 {
+				return nil, config.NodeErr(child, "expected exactly one argument")
+			}
+			size, err := config.ParseDataSize(child.Args[0])
+			if err != nil {
+				return nil, config.NodeErr(child, "%v", err)
+			}
+			profile.maxMessageSize = int64(size)
+		case "rate":
+			if len(child.Args) == 0 || len(child.Args) > 2 {
+				return nil, config.NodeErr(child, "expected one or two arguments: <burst> [period]")
+			}
+			burst, err := strconv.Atoi(child.Args[0])
+			if err != nil || burst <= 0 {
+				return nil, config.NodeErr(child, "invalid burst size: %v", child.Args[0])
+			}
+			period := 1 * time.Second
+			if len(child.Args) == 2 {
+				period, err = time.ParseDuration(child.Args[1])
+				if err != nil || period <= 0 {
+					return nil, config.NodeErr(child, "invalid period: %v", child.Args[1])
+				}
+			}
+			profile.rate = limiters.NewBucketSet(func() limiters.L {
+				return limiters.NewRate(burst, period)
+			}, 1*time.Minute, 20010)
+		default:
+			return nil, config.NodeErr(child, "unknown profile directive: %s", child.Name)
+		}
+	}
+	return profile, nil
+}
+
+// profileFor returns the profile for the recipient domain, nil if no
+// profile applies.
+func (tp *tenantPolicy) profileFor(ctx context.Context, domain string) (*tenantProfile, error) {
+	name, ok, err := tp.table.Lookup(ctx, domain)
+	if err != nil {
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during policy lookup",
+			Err:          err,
+		}
+	}
+	if !ok {
+		return tp.defaultProfile, nil
+	}
+	profile := tp.profiles[name]
+	if profile == nil {
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during policy lookup",
+			Reason:       "unknown tenant profile",
+			Misc: map[string]interface{}{
+				"profile": name,
+				"domain":  domain,
+			},
+		}
+	}
+	return profile, nil
+}
+
+// applyTenantPolicy selects the tenant profile for the recipient and runs
+// profile checks for it.
+func (dd *msgpipelineDelivery) applyTenantPolicy(ctx context.Context, rcptTo string) error {
+	if dd.d.tenantPolicy == nil {
+		return nil
+	}
+
+	cleanRcpt, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
+			Message:      "Unable to normalize the recipient address",
+			Err:          err,
+		}
+	}
+	_, domain, err := address.Split(cleanRcpt)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         501,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 3},
+			Message:      "Invalid recipient address",
+			Err:          err,
+			Reason:       "Can't extract local-part and host-part",
+		}
+	}
+
+	profile, err := dd.d.tenantPolicy.profileFor(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	if dd.tenantSelected && profile != dd.tenantProfile {
+		return &exterrors.SMTPError{
+			Code:         452,
+			EnhancedCode: exterrors.EnhancedCode{4, 5, 3},
+			Message:      "Too many recipients, send the rest in a separate transaction",
+			Reason:       "recipient belongs to a different tenant profile",
+		}
+	}
+	if !dd.tenantSelected {
+		dd.tenantSelected = true
+		dd.tenantProfile = profile
+		dd.tenantDomains = map[string]struct{}{}
+
+		if profile != nil {
+			dd.traceRule("tenant", rcptTo, "profile "+profile.name)
+			dd.log.Debugf("recipient %s selected tenant profile %s", rcptTo, profile.name)
+
+			// Connection and sender checks of the profile are run by
+			// checkRcpt below once the check states are created.
+			dd.tenantModifiersState, err = profile.modifiers.ModStateForMsg(ctx, dd.msgMeta)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if profile == nil {
+		return nil
+	}
+
+	if _, ok := dd.tenantDomains[domain]; !ok && profile.rate != nil {
+		rateCtx, cancel := context.WithTimeout(ctx, rateWait)
+		defer cancel()
+		if err := profile.rate.TakeContext(rateCtx, domain); err != nil {
+			return &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Too many messages for the recipient domain, try again later",
+				Err:          err,
+				Misc: map[string]interface{}{
+					"profile": profile.name,
+					"domain":  domain,
+				},
+			}
+		}
+	}
+	dd.tenantDomains[domain] = struct{}{}
+
+	return dd.checkRunner.checkRcpt(ctx, profile.checks, rcptTo)
+}
+
+// checkTenantSize enforces the max_message_size of the selected profile.
+func (dd *msgpipelineDelivery) checkTenantSize(bodyLen int) error {
+	if dd.tenantProfile == nil || dd.tenantProfile.maxMessageSize == 0 {
+		return nil
+	}
+	if int64(bodyLen) <= dd.tenantProfile.maxMessageSize {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+		Message:      "Message size exceeds the limit",
+		Misc: map[string]interface{}{
+			"profile": dd.tenantProfile.name,
+		},
+	}
+}
+
+// tenantChecks returns the checks of the selected profile.
+func (dd *msgpipelineDelivery) tenantChecks() []module.Check {
+	if dd.tenantProfile == nil {
+		return nil
+	}
+	return dd.tenantProfile.checks
+}
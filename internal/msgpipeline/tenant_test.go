@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func tenantPipeline(t *testing.T, target module.DeliveryTarget, tp *tenantPolicy) *MsgPipeline {
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{target},
+				},
+			},
+			tenantPolicy: tp,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+}
+
+func TestMsgPipeline_TenantChecks(t *testing.T) {
+	target := testutils.Target{}
+	strictCheck := testutils.Check{
+		BodyRes: module.CheckResult{Quarantine: true, Reason: errors.New("suspicious")},
+	}
+	relaxedCheck := testutils.Check{}
+	tp := &tenantPolicy{
+		table: testutils.Table{M: map[string]string{
+			"strict.example.org":  "strict",
+			"relaxed.example.org": "relaxed",
+		}},
+		profiles: map[string]*tenantProfile{
+			"strict":  {name: "strict", checks: []module.Check{&strictCheck}},
+			"relaxed": {name: "relaxed", checks: []module.Check{&relaxedCheck}},
+		},
+	}
+	d := tenantPipeline(t, &target, tp)
+
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"a@strict.example.org", "b@strict.example.org"})
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"a@relaxed.example.org"})
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"a@other.example.org"})
+
+	if len(target.Messages) != 3 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 3, len(target.Messages))
+	}
+	if !target.Messages[0].MsgMeta.Quarantine {
+		t.Error("message for the strict tenant is not quarantined")
+	}
+	if target.Messages[1].MsgMeta.Quarantine || target.Messages[2].MsgMeta.Quarantine {
+		t.Error("messages for other tenants are quarantined")
+	}
+	if strictCheck.BodyCalls != 1 || relaxedCheck.BodyCalls != 1 {
+		t.Errorf("wrong amount of body checks: %d, %d", strictCheck.BodyCalls, relaxedCheck.BodyCalls)
+	}
+	if strictCheck.UnclosedStates != 0 || relaxedCheck.UnclosedStates != 0 {
+		t.Error("check states leak or double-closed")
+	}
+}
+
+func TestMsgPipeline_TenantIsolation(t *testing.T) {
+	target := testutils.Target{}
+	tp := &tenantPolicy{
+		table: testutils.Table{M: map[string]string{
+			"strict.example.org": "strict",
+		}},
+		profiles: map[string]*tenantProfile{
+			"strict": {name: "strict"},
+		},
+	}
+	d := tenantPipeline(t, &target, tp)
+
+	// Recipients without a profile and with a profile can't be mixed in
+	// either order.
+	_, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"a@strict.example.org", "a@other.example.org"})
+	testutils.CheckSMTPErr(t, err, 452, exterrors.EnhancedCode{4, 5, 3}, "Too many recipients, send the rest in a separate transaction")
+	_, err = testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"a@other.example.org", "a@strict.example.org"})
+	testutils.CheckSMTPErr(t, err, 452, exterrors.EnhancedCode{4, 5, 3}, "Too many recipients, send the rest in a separate transaction")
+}
+
+func TestMsgPipeline_TenantSizeLimit(t *testing.T) {
+	target := testutils.Target{}
+	tp := &tenantPolicy{
+		table: testutils.Table{},
+		profiles: map[string]*tenantProfile{
+			"small": {name: "small", maxMessageSize: 4},
+		},
+	}
+	tp.defaultProfile = tp.profiles["small"]
+	d := tenantPipeline(t, &target, tp)
+
+	_, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"a@example.org"})
+	testutils.CheckSMTPErr(t, err, 552, exterrors.EnhancedCode{5, 3, 4}, "Message size exceeds the limit")
+	if len(target.Messages) != 0 {
+		t.Fatal("message delivered despite the size limit")
+	}
+}
+
+func TestMsgPipeline_TenantUnknownProfile(t *testing.T) {
+	target := testutils.Target{}
+	tp := &tenantPolicy{
+		table: testutils.Table{M: map[string]string{
+			"example.org": "missing",
+		}},
+		profiles: map[string]*tenantProfile{},
+	}
+	d := tenantPipeline(t, &target, tp)
+
+	_, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"a@example.org"})
+	testutils.CheckSMTPErr(t, err, 451, exterrors.EnhancedCode{4, 3, 0}, "Internal error during policy lookup")
+}
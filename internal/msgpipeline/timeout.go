@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Actions taken when the check does not finish in time.
+const (
+	// timeoutTempfail rejects the message with a temporary error.
+	timeoutTempfail = "tempfail"
+	// timeoutSkip ignores the check and adds a header field noting that.
+	timeoutSkip = "skip"
+	// timeoutNeutral ignores the check silently, as if it had no opinion
+	// about the message.
+	timeoutNeutral = "neutral"
+)
+
+// timeoutHeader is the header field added to messages for which a check was
+// skipped due to timeout.
+const timeoutHeader = "X-Maddy-Check-Timeout"
+
+// checkTimeout is the per-check execution time budget.
+type checkTimeout struct {
+	// name is the check name as specified in the configuration, it is
+	// used in the header field added by the skip action.
+	name    string
+	timeout time.Duration
+	action  string
+}
+
+// result returns the check result to use instead of the one returned by
+// the check that ran out of time.
+func (t *checkTimeout) result(checkName, stage string) module.CheckResult {
+	switch t.action {
+	case timeoutSkip:
+		hdr := textproto.Header{}
+		hdr.Add(timeoutHeader, t.name+"; stage="+stage)
+		return module.CheckResult{Header: hdr}
+	case timeoutNeutral:
+		return module.CheckResult{}
+	default:
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+				Message:      "Message check timed out, try again later",
+				CheckName:    checkName,
+				Misc: map[string]interface{}{
+					"stage":   stage,
+					"timeout": t.timeout.String(),
+				},
+			},
+		}
+	}
+}
+
+// checkTimeouts maps check names to configured time budgets.
+type checkTimeouts map[string]*checkTimeout
+
+// parse parses the per-check form of the check_timeout directive:
+//
+//	check_timeout <check> <duration> [tempfail|skip|neutral]
+func (ct checkTimeouts) parse(node config.Node) error {
+	if len(node.Children) != 0 {
+		return config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) != 2 && len(node.Args) != 3 {
+		return config.NodeErr(node, "expected 2 or 3 arguments")
+	}
+	if _, ok := ct[node.Args[0]]; ok {
+		return config.NodeErr(node, "duplicate timeout for %s", node.Args[0])
+	}
+
+	timeout, err := time.ParseDuration(node.Args[1])
+	if err != nil || timeout <= 0 {
+		return config.NodeErr(node, "invalid check timeout: %v", node.Args[1])
+	}
+	action := timeoutTempfail
+	if len(node.Args) == 3 {
+		action = node.Args[2]
+	}
+	switch action {
+	case timeoutTempfail, timeoutSkip, timeoutNeutral:
+	default:
+		return config.NodeErr(node, "unknown timeout action: %s", action)
+	}
+
+	ct[node.Args[0]] = &checkTimeout{name: node.Args[0], timeout: timeout, action: action}
+	return nil
+}
+
+// forCheck returns the time budget configured for the check.
+func (ct checkTimeouts) forCheck(check interface{}) *checkTimeout {
+	if len(ct) == 0 {
+		return nil
+	}
+	for _, name := range checkConfigNames(check) {
+		if t := ct[name]; t != nil {
+			return t
+		}
+	}
+	return nil
+}
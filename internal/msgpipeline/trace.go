@@ -0,0 +1,103 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Tracer receives notifications about decisions made by the pipeline while
+// handling the message. It is used to explain how the message would be
+// handled without actually delivering it (see 'maddy test-message').
+//
+// If the Tracer is present in the context passed to MsgPipeline.Start,
+// final delivery targets are not used at all, Deliver is called instead.
+// Nested pipelines (reroute, msgpipeline module) are still executed.
+//
+// Methods can be called concurrently.
+type Tracer interface {
+	// CheckResult is called for each result returned by a check. stage is
+	// one of "connection", "sender", "rcpt", "header", "body".
+	CheckResult(check, stage string, res module.CheckResult)
+
+	// Rule is called when the source or destination block is selected for
+	// the address. kind is either "source" or "destination".
+	Rule(kind, addr, rule string)
+
+	// Rewrite is called when modifiers changed the sender or recipient
+	// address.
+	Rewrite(stage, from string, to []string)
+
+	// Deliver is called when the message would be passed to the target.
+	Deliver(target, mailFrom string, rcpts []string, header textproto.Header)
+}
+
+type tracerKey struct{}
+
+// WithTracer returns the context that makes the pipeline report its decisions
+// to t and skip delivery to final targets.
+func WithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+func tracerFromContext(ctx context.Context) Tracer {
+	t, _ := ctx.Value(tracerKey{}).(Tracer)
+	return t
+}
+
+// isNestedPipeline reports whether the target is a pipeline that should be
+// executed even when tracing.
+func isNestedPipeline(tgt module.DeliveryTarget) bool {
+	switch tgt.(type) {
+	case *MsgPipeline, *Module:
+		return true
+	}
+	return false
+}
+
+// traceDelivery is used in place of the actual target delivery when tracing.
+type traceDelivery struct {
+	tracer   Tracer
+	target   string
+	mailFrom string
+	rcpts    []string
+}
+
+func (td *traceDelivery) AddRcpt(_ context.Context, to string, _ smtp.RcptOptions) error {
+	td.rcpts = append(td.rcpts, to)
+	return nil
+}
+
+func (td *traceDelivery) Body(_ context.Context, header textproto.Header, _ buffer.Buffer) error {
+	td.tracer.Deliver(td.target, td.mailFrom, td.rcpts, header.Copy())
+	return nil
+}
+
+func (td *traceDelivery) Abort(context.Context) error {
+	return nil
+}
+
+func (td *traceDelivery) Commit(context.Context) error {
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testTracer struct {
+	lock       sync.Mutex
+	checks     []string
+	rules      []string
+	deliveries map[string][]string
+}
+
+func (tt *testTracer) CheckResult(check, stage string, res module.CheckResult) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	verdict := "pass"
+	if res.Quarantine {
+		verdict = "quarantine"
+	}
+	tt.checks = append(tt.checks, stage+" "+verdict)
+}
+
+func (tt *testTracer) Rule(kind, addr, rule string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.rules = append(tt.rules, kind+" "+addr+" "+rule)
+}
+
+func (tt *testTracer) Rewrite(stage, from string, to []string) {}
+
+func (tt *testTracer) Deliver(target, mailFrom string, rcpts []string, header textproto.Header) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.deliveries[target] = rcpts
+}
+
+func TestMsgPipeline_Trace(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{Quarantine: true, Reason: errors.New("suspicious")},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					rejectErr: errors.New("rejected"),
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	tracer := &testTracer{deliveries: map[string][]string{}}
+	ctx := WithTracer(context.Background(), tracer)
+
+	delivery, err := d.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt@example.net", smtp.RcptOptions{}); err == nil {
+		t.Fatal("expected error for rcpt@example.net")
+	}
+	if err := delivery.Body(ctx, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(target.Messages) != 0 {
+		t.Fatalf("target received %d messages in dry-run mode", len(target.Messages))
+	}
+
+	rcpts := tracer.deliveries[objectName(&target)]
+	if len(rcpts) != 1 || rcpts[0] != "rcpt@example.org" {
+		t.Fatalf("wrong recipients reported for the target: %v", rcpts)
+	}
+
+	wantRules := []string{
+		"source sender@example.com default_source",
+		"destination rcpt@example.org destination example.org",
+		"destination rcpt@example.net default_destination",
+	}
+	if len(tracer.rules) != len(wantRules) {
+		t.Fatalf("wrong rules reported: %v", tracer.rules)
+	}
+	for i := range wantRules {
+		if tracer.rules[i] != wantRules[i] {
+			t.Errorf("rule %d: want %q, got %q", i, wantRules[i], tracer.rules[i])
+		}
+	}
+
+	lastCheck := tracer.checks[len(tracer.checks)-1]
+	if lastCheck != "body quarantine" {
+		t.Errorf("wrong body check result reported: %v", lastCheck)
+	}
+
+	if check.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, alive counter: %v", check.UnclosedStates)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	accessFSExecute    = 1 << 0
+	accessFSWriteFile  = 1 << 1
+	accessFSReadFile   = 1 << 2
+	accessFSReadDir    = 1 << 3
+	accessFSRemoveDir  = 1 << 4
+	accessFSRemoveFile = 1 << 5
+	accessFSMakeChar   = 1 << 6
+	accessFSMakeDir    = 1 << 7
+	accessFSMakeReg    = 1 << 8
+	accessFSMakeSock   = 1 << 9
+	accessFSMakeFifo   = 1 << 10
+	accessFSMakeBlock  = 1 << 11
+	accessFSMakeSym    = 1 << 12
+	accessFSRefer      = 1 << 13 // ABI v2
+	accessFSTruncate   = 1 << 14 // ABI v3
+
+	// Rights that can be granted for a non-directory file.
+	accessFSFile = accessFSExecute | accessFSWriteFile | accessFSReadFile | accessFSTruncate
+
+	accessFSRead = accessFSReadFile | accessFSReadDir
+	accessFSExec = accessFSRead | accessFSExecute
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// landlockHandledAccess returns the set of rights restricted by the ruleset
+// for the specified Landlock ABI version.
+func landlockHandledAccess(abi int) uint64 {
+	access := uint64(accessFSExecute | accessFSWriteFile | accessFSReadFile |
+		accessFSReadDir | accessFSRemoveDir | accessFSRemoveFile | accessFSMakeChar |
+		accessFSMakeDir | accessFSMakeReg | accessFSMakeSock | accessFSMakeFifo |
+		accessFSMakeBlock | accessFSMakeSym)
+	if abi >= 2 {
+		access |= accessFSRefer
+	}
+	if abi >= 3 {
+		access |= accessFSTruncate
+	}
+	return access
+}
+
+// landlockRuleAccess returns the rights to grant for a path given the
+// requested and handled rights.
+func landlockRuleAccess(requested, handled uint64, isDir bool) uint64 {
+	access := requested & handled
+	if !isDir {
+		access &= accessFSFile
+	}
+	return access
+}
+
+func landlockRuleset(cfg Config, l log.Logger) (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+			return -1, errors.New("landlock is not supported or disabled by the kernel")
+		}
+		return -1, fmt.Errorf("landlock: %w", errno)
+	}
+	handled := landlockHandledAccess(int(abi))
+
+	attr := landlockRulesetAttr{handledAccessFS: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("landlock: create ruleset: %w", errno)
+	}
+	rulesetFd := int(fd)
+
+	writeAccess := handled &^ accessFSExecute
+	for _, rule := range []struct {
+		paths  []string
+		access uint64
+	}{
+		{cfg.LandlockRead, accessFSRead},
+		{cfg.LandlockExec, accessFSExec},
+		{cfg.LandlockWrite, writeAccess},
+	} {
+		for _, path := range rule.paths {
+			if err := landlockAddPath(rulesetFd, filepath.Join("/", cfg.Chroot, path), rule.access, handled, l); err != nil {
+				unix.Close(rulesetFd)
+				return -1, err
+			}
+		}
+	}
+
+	return rulesetFd, nil
+}
+
+func landlockAddPath(rulesetFd int, path string, access, handled uint64, l log.Logger) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			l.DebugMsg("landlock: path does not exist, skipping", "path", path)
+			return nil
+		}
+		return fmt.Errorf("landlock: %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("landlock: %s: %w", path, err)
+	}
+
+	rule := landlockPathBeneathAttr{
+		allowedAccess: landlockRuleAccess(access, handled, st.Mode&unix.S_IFMT == unix.S_IFDIR),
+		parentFd:      int32(fd),
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), landlockRulePathBeneath,
+		uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: add rule for %s: %w", path, errno)
+	}
+	return nil
+}
+
+// landlockRestrict enforces the ruleset for all threads of the process.
+// PR_SET_NO_NEW_PRIVS should be set already.
+func landlockRestrict(rulesetFd int) error {
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(rulesetFd), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: restrict self: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sandbox implements dropping of root privileges and confinement of
+// the server process once it is initialized.
+//
+// Initialization is done with full privileges so modules can listen on
+// privileged ports and read files accessible only by root (such as TLS
+// private keys). After that, the process switches to an unprivileged user
+// and optionally restricts itself further using chroot(2), Landlock LSM and
+// seccomp filters.
+package sandbox
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+type Config struct {
+	// User and group to switch to. Group defaults to the primary group of
+	// the user.
+	User  string
+	Group string
+
+	// Directory to use as the new root directory.
+	Chroot string
+
+	// Forbid execution of any programs.
+	NoExec bool
+
+	// Restrict filesystem access using Landlock. Paths are interpreted
+	// relative to the Chroot directory, if it is set.
+	Landlock      bool
+	LandlockRead  []string
+	LandlockWrite []string
+	LandlockExec  []string
+
+	// Directories that should be owned by User. Files created in them by
+	// root during initialization are transferred to User.
+	OwnedDirs []string
+}
+
+// Validate checks whether cfg can be applied by this build. It should be
+// called when the configuration is parsed so unsupported options are reported
+// before any modules are initialized.
+func Validate(cfg Config) error {
+	return validate(cfg)
+}
+
+// Apply drops privileges and restricts the process as specified by cfg.
+//
+// start should be the time initialization started at, it is used to find
+// files that were created during initialization.
+func Apply(cfg Config, start time.Time, l log.Logger) error {
+	// Some system files are loaded lazily on first use. Make sure they are
+	// read while they are still accessible.
+	if _, err := x509.SystemCertPool(); err != nil {
+		l.Error("failed to load system CA certificates", err)
+	}
+	time.Now().Zone()
+
+	return apply(cfg, start, l)
+}
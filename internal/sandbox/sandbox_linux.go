@@ -0,0 +1,267 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"golang.org/x/sys/unix"
+)
+
+func validate(cfg Config) error {
+	// Go can't run syscalls on all threads if cgo is used, see
+	// syscall.AllThreadsSyscall.
+	if cfg.Landlock && cgoEnabled {
+		return errors.New("sandbox: landlock is not supported in builds with cgo enabled, rebuild with CGO_ENABLED=0")
+	}
+	return nil
+}
+
+func apply(cfg Config, start time.Time, l log.Logger) error {
+	if err := validate(cfg); err != nil {
+		return err
+	}
+
+	var (
+		uid, gid int
+		groups   []int
+		switchID bool
+	)
+	if cfg.User != "" {
+		var err error
+		uid, gid, groups, err = lookupIDs(cfg.User, cfg.Group)
+		if err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		switchID = os.Getuid() != uid
+	}
+	if (switchID || cfg.Chroot != "") && os.Geteuid() != 0 {
+		return errors.New("sandbox: root privileges are required to switch user or change root directory")
+	}
+
+	// Set before anything else since it is the part that fails in builds
+	// with cgo.
+	if cfg.Landlock || cfg.NoExec {
+		if err := setNoNewPrivs(cfg.Landlock); err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+	}
+
+	if switchID {
+		for _, dir := range cfg.OwnedDirs {
+			if err := fixOwnership(dir, uid, gid, start); err != nil {
+				return fmt.Errorf("sandbox: %w", err)
+			}
+		}
+	}
+
+	// Ruleset should be created before chroot since Landlock paths are
+	// resolved against the original root.
+	rulesetFd := -1
+	if cfg.Landlock {
+		var err error
+		rulesetFd, err = landlockRuleset(cfg, l)
+		if err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		defer unix.Close(rulesetFd)
+	}
+
+	if cfg.Chroot != "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		if err := unix.Chroot(cfg.Chroot); err != nil {
+			return fmt.Errorf("sandbox: chroot: %w", err)
+		}
+		// Keep the working directory (state directory) if it is available
+		// at the same path in the new root.
+		if err := os.Chdir(wd); err != nil {
+			l.Msg("working directory is not available after chroot, using /", "path", wd)
+			if err := os.Chdir("/"); err != nil {
+				return fmt.Errorf("sandbox: %w", err)
+			}
+		}
+		l.DebugMsg("changed root directory", "path", cfg.Chroot)
+	}
+
+	if switchID {
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("sandbox: setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("sandbox: setgid: %w", err)
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("sandbox: setuid: %w", err)
+		}
+		if err := syscall.Setuid(0); err == nil {
+			return errors.New("sandbox: root privileges can be regained after dropping them")
+		}
+		l.DebugMsg("dropped privileges", "uid", uid, "gid", gid)
+	}
+
+	if cfg.Landlock {
+		if err := landlockRestrict(rulesetFd); err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		l.DebugMsg("filesystem access restricted using Landlock")
+	}
+
+	if cfg.NoExec {
+		if err := installNoExecFilter(); err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		l.DebugMsg("execution of programs is disabled")
+	}
+
+	return nil
+}
+
+func lookupIDs(userName, groupName string) (uid, gid int, groups []int, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("malformed uid for %s: %w", userName, err)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		gidStr = g.Gid
+	}
+	gid, err = strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("malformed gid for %s: %w", userName, err)
+	}
+
+	groups = []int{gid}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("supplementary groups for %s: %w", userName, err)
+	}
+	for _, idStr := range groupIDs {
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id == gid {
+			continue
+		}
+		groups = append(groups, id)
+	}
+
+	return uid, gid, groups, nil
+}
+
+// mtimeGranularity is the allowance for filesystem timestamps that are
+// taken from a coarse clock and can be slightly behind time.Now.
+const mtimeGranularity = time.Second
+
+// fixOwnership transfers files in dir that are owned by root to the
+// specified user.
+//
+// To avoid inspecting every file in large directories (such as message
+// blobs), files are checked only in directories modified since start.
+// Directories themselves are always checked.
+func fixOwnership(dir string, uid, gid int, start time.Time) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := chownRootOwned(dir, info, uid, gid); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	modified := !info.ModTime().Before(start.Add(-mtimeGranularity))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			if err := fixOwnership(path, uid, gid, start); err != nil {
+				return err
+			}
+			continue
+		}
+		if !modified {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if err := chownRootOwned(path, info, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func chownRootOwned(path string, info fs.FileInfo, uid, gid int) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Uid != 0 {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// setNoNewPrivs sets PR_SET_NO_NEW_PRIVS flag. It is required to be set for
+// all threads for Landlock, while seccomp filter installation propagates it
+// from the calling thread.
+func setNoNewPrivs(allThreads bool) error {
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	switch {
+	case errno == 0:
+		return nil
+	case errno == syscall.ENOTSUP && allThreads:
+		return errors.New("landlock is not supported in builds with cgo enabled")
+	case errno == syscall.ENOTSUP:
+		// Called again in installNoExecFilter on the thread that installs
+		// the filter.
+		return nil
+	default:
+		return fmt.Errorf("prctl: %w", errno)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNoExecFilter(t *testing.T) {
+	const arch = unix.AUDIT_ARCH_X86_64
+	filter := noExecFilter(arch)
+
+	// Simple interpreter for the subset of classic BPF used by the filter.
+	run := func(data map[uint32]uint32) uint32 {
+		var acc uint32
+		for pc := 0; pc < len(filter); pc++ {
+			ins := filter[pc]
+			switch ins.Code {
+			case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+				acc = data[ins.K]
+			case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+				if acc == ins.K {
+					pc += int(ins.Jt)
+				} else {
+					pc += int(ins.Jf)
+				}
+			case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+				if acc >= ins.K {
+					pc += int(ins.Jt)
+				} else {
+					pc += int(ins.Jf)
+				}
+			case unix.BPF_RET | unix.BPF_K:
+				return ins.K
+			default:
+				t.Fatalf("unexpected instruction at %d: %+v", pc, ins)
+			}
+		}
+		t.Fatal("filter does not return")
+		return 0
+	}
+
+	deny := uint32(seccompRetErrno | uint32(unix.EPERM))
+	for _, c := range []struct {
+		name string
+		arch uint32
+		nr   uint32
+		want uint32
+	}{
+		{"read", arch, unix.SYS_READ, seccompRetAllow},
+		{"execve", arch, unix.SYS_EXECVE, deny},
+		{"execveat", arch, unix.SYS_EXECVEAT, deny},
+		{"x32 execve", arch, x32SyscallBit | 520, deny},
+		{"foreign arch", unix.AUDIT_ARCH_I386, unix.SYS_READ, deny},
+	} {
+		got := run(map[uint32]uint32{seccompDataArch: c.arch, seccompDataNr: c.nr})
+		if got != c.want {
+			t.Errorf("%s: got %#x, want %#x", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLandlockRuleAccess(t *testing.T) {
+	handled := landlockHandledAccess(1)
+	if handled&(accessFSRefer|accessFSTruncate) != 0 {
+		t.Error("rights not supported by ABI v1 are handled")
+	}
+	if landlockHandledAccess(3)&accessFSTruncate == 0 {
+		t.Error("truncate is not handled for ABI v3")
+	}
+
+	if got := landlockRuleAccess(accessFSExec, handled, false); got != accessFSExecute|accessFSReadFile {
+		t.Errorf("wrong access for file: %#x", got)
+	}
+	if got := landlockRuleAccess(accessFSRead, handled, true); got != accessFSRead {
+		t.Errorf("wrong access for directory: %#x", got)
+	}
+	if got := landlockRuleAccess(accessFSTruncate|accessFSReadFile, handled, true); got != accessFSReadFile {
+		t.Errorf("unhandled rights are granted: %#x", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	err := Validate(Config{Landlock: true})
+	if cgoEnabled && err == nil {
+		t.Error("landlock is accepted in the build with cgo")
+	}
+	if !cgoEnabled && err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if err := Validate(Config{NoExec: true}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestFixOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	dir := t.TempDir()
+	oldFile := filepath.Join(dir, "old")
+	if err := os.WriteFile(oldFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir, oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	newFile := filepath.Join(sub, "new")
+	if err := os.WriteFile(newFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Creating sub updated mtime of dir, make it appear unmodified again.
+	if err := os.Chtimes(dir, oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fixOwnership(dir, 1234, 1234, start); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := func(path string) uint32 {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Uid
+	}
+	for path, want := range map[string]uint32{
+		dir:     1234,
+		sub:     1234,
+		newFile: 1234,
+		oldFile: 0, // not checked since dir is not modified
+	} {
+		if got := owner(path); got != want {
+			t.Errorf("%s: owner is %d, want %d", path, got, want)
+		}
+	}
+}
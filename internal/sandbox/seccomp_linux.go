@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+
+	// Offsets of fields in struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// Set in syscall numbers of x32 ABI on amd64.
+	x32SyscallBit = 0x40000000
+)
+
+func auditArch() (uint32, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return unix.AUDIT_ARCH_X86_64, nil
+	case "386":
+		return unix.AUDIT_ARCH_I386, nil
+	case "arm64":
+		return unix.AUDIT_ARCH_AARCH64, nil
+	case "arm":
+		return unix.AUDIT_ARCH_ARM, nil
+	case "riscv64":
+		return unix.AUDIT_ARCH_RISCV64, nil
+	case "ppc64le":
+		return unix.AUDIT_ARCH_PPC64LE, nil
+	case "s390x":
+		return unix.AUDIT_ARCH_S390X, nil
+	default:
+		return 0, fmt.Errorf("no_exec is not supported on %s", runtime.GOARCH)
+	}
+}
+
+// noExecFilter returns the BPF program that makes execve and execveat fail
+// with EPERM. System calls using a different ABI are rejected as well so the
+// filter can not be bypassed by using them.
+func noExecFilter(arch uint32) []unix.SockFilter {
+	deny := uint32(seccompRetErrno | uint32(unix.EPERM))
+	return []unix.SockFilter{
+		/* 0 */ {Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		/* 1 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: arch},
+		/* 2 */ {Code: unix.BPF_RET | unix.BPF_K, K: deny},
+		/* 3 */ {Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+		/* 4 */ {Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 3, Jf: 0, K: x32SyscallBit},
+		/* 5 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 2, Jf: 0, K: unix.SYS_EXECVE},
+		/* 6 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: unix.SYS_EXECVEAT},
+		/* 7 */ {Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		/* 8 */ {Code: unix.BPF_RET | unix.BPF_K, K: deny},
+	}
+}
+
+// installNoExecFilter installs the seccomp filter from noExecFilter for all
+// threads of the process.
+func installNoExecFilter() error {
+	arch, err := auditArch()
+	if err != nil {
+		return err
+	}
+	filter := noExecFilter(arch)
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	// PR_SET_NO_NEW_PRIVS is checked for the calling thread, make sure it
+	// is the same thread if it was not set for all threads.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl: %w", err)
+	}
+
+	r1, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync,
+		uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+	if r1 != 0 {
+		// With TSYNC, the ID of the thread that could not be synchronized
+		// is returned.
+		return errors.New("seccomp: failed to synchronize filter for all threads")
+	}
+	return nil
+}
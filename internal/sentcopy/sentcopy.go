@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sentcopy contains helpers used to store copies of submitted
+// messages in the Sent mailbox without creating duplicates if the client
+// also stores the message there.
+package sentcopy
+
+import (
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// DefaultMailbox is the name of the mailbox used if there is no mailbox
+// with the \Sent special-use attribute.
+const DefaultMailbox = "Sent"
+
+// DedupWindow is the time interval within which messages with the same
+// Message-ID are considered to be duplicates.
+const DedupWindow = 24 * time.Hour
+
+// Mailbox returns the name of the mailbox with the \Sent special-use
+// attribute or fallback if there is none.
+func Mailbox(u backend.User, fallback string) (string, error) {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return "", err
+	}
+	for _, info := range mboxes {
+		for _, attr := range info.Attributes {
+			if attr == imap.SentAttr {
+				return info.Name, nil
+			}
+		}
+	}
+	return fallback, nil
+}
+
+// IsSent reports whether the mailbox is the one returned by Mailbox.
+func IsSent(u backend.User, name string) (bool, error) {
+	sent, err := Mailbox(u, DefaultMailbox)
+	if err != nil {
+		return false, err
+	}
+	if strings.EqualFold(sent, imap.InboxName) {
+		return strings.EqualFold(name, imap.InboxName), nil
+	}
+	return sent == name, nil
+}
+
+// Contains reports whether the mailbox contains a message with the
+// specified Message-ID stored within DedupWindow.
+//
+// Empty msgID never matches.
+func Contains(u backend.User, mbox, msgID string) (bool, error) {
+	if msgID == "" {
+		return false, nil
+	}
+
+	_, mailbox, err := u.GetMailbox(mbox, true, nil)
+	if err != nil {
+		if err == backend.ErrNoSuchMailbox {
+			return false, nil
+		}
+		return false, err
+	}
+
+	uids, err := mailbox.SearchMessages(true, &imap.SearchCriteria{
+		Since:  time.Now().Add(-DedupWindow),
+		Header: textproto.MIMEHeader{"Message-Id": {msgID}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(uids) != 0, nil
+}
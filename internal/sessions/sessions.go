@@ -0,0 +1,256 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package sessions keeps track of client connections accepted by maddy
+// endpoints so they can be inspected and terminated by the administrator.
+package sessions
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Info is the snapshot of the session state.
+type Info struct {
+	ID         string    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr"`
+	Username   string    `json:"username,omitempty"`
+	Mailbox    string    `json:"mailbox,omitempty"`
+	Started    time.Time `json:"started"`
+	LastActive time.Time `json:"last_active"`
+}
+
+type session struct {
+	id       string
+	protocol string
+	conn     net.Conn
+	started  time.Time
+
+	// Unix time in nanoseconds, updated on each read.
+	lastActive atomic.Int64
+
+	lock     sync.Mutex
+	username string
+	mailbox  string
+}
+
+func (s *session) info() Info {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Info{
+		ID:         s.id,
+		Protocol:   s.protocol,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Username:   s.username,
+		Mailbox:    s.mailbox,
+		Started:    s.started,
+		LastActive: time.Unix(0, s.lastActive.Load()),
+	}
+}
+
+// terminate closes the connection. Endpoint will notice that on the next
+// I/O operation and close its wrapper, so the session is removed from the
+// registry right away to not show it in the meantime.
+func (s *session) terminate() {
+	unregister(s)
+	s.conn.Close()
+}
+
+var (
+	lastID atomic.Uint64
+
+	registryLock sync.RWMutex
+	registry     = map[string]*session{}
+	// Sessions indexed by the remote address, it is what endpoints have
+	// available in most places. Only TCP connections are indexed since
+	// Unix socket peers have no distinct addresses.
+	byAddr = map[string]*session{}
+)
+
+func addrKey(addr net.Addr) string {
+	if _, ok := addr.(*net.TCPAddr); !ok {
+		return ""
+	}
+	return addr.String()
+}
+
+func register(protocol string, conn net.Conn) *session {
+	s := &session{
+		id:       strconv.FormatUint(lastID.Add(1), 10),
+		protocol: protocol,
+		conn:     conn,
+		started:  time.Now(),
+	}
+	s.lastActive.Store(s.started.UnixNano())
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[s.id] = s
+	if key := addrKey(conn.RemoteAddr()); key != "" {
+		byAddr[key] = s
+	}
+	return s
+}
+
+func unregister(s *session) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, s.id)
+	key := addrKey(s.conn.RemoteAddr())
+	if key != "" && byAddr[key] == s {
+		delete(byAddr, key)
+	}
+}
+
+func lookup(remoteAddr net.Addr) *session {
+	if remoteAddr == nil {
+		return nil
+	}
+	key := addrKey(remoteAddr)
+	if key == "" {
+		return nil
+	}
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return byAddr[key]
+}
+
+// SetUser records the authenticated user for the session of the connection
+// with the specified remote address. It is no-op if the connection is not
+// tracked.
+func SetUser(remoteAddr net.Addr, username string) {
+	s := lookup(remoteAddr)
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.username = username
+}
+
+// SetMailbox records the currently selected IMAP mailbox.
+func SetMailbox(remoteAddr net.Addr, mailbox string) {
+	s := lookup(remoteAddr)
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mailbox = mailbox
+}
+
+// List returns all active sessions sorted by start time. If username is not
+// empty, only sessions of that user are returned.
+func List(username string) []Info {
+	registryLock.RLock()
+	infos := make([]Info, 0, len(registry))
+	for _, s := range registry {
+		info := s.info()
+		if username != "" && info.Username != username {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	registryLock.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// Terminate closes the connection of the session with the specified ID.
+// It returns false if there is no such session.
+func Terminate(id string) bool {
+	registryLock.RLock()
+	s, ok := registry[id]
+	registryLock.RUnlock()
+
+	if !ok {
+		return false
+	}
+	s.terminate()
+	return true
+}
+
+// TerminateUser closes all sessions of the user and returns their count.
+func TerminateUser(username string) int {
+	var targets []*session
+	registryLock.RLock()
+	for _, s := range registry {
+		s.lock.Lock()
+		if s.username == username {
+			targets = append(targets, s)
+		}
+		s.lock.Unlock()
+	}
+	registryLock.RUnlock()
+
+	for _, s := range targets {
+		s.terminate()
+	}
+	return len(targets)
+}
+
+type trackedConn struct {
+	net.Conn
+	sess      *session
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n != 0 {
+		c.sess.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		unregister(c.sess)
+	})
+	return c.Conn.Close()
+}
+
+type listener struct {
+	net.Listener
+	protocol string
+}
+
+func (l listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{
+		Conn: conn,
+		sess: register(l.protocol, conn),
+	}, nil
+}
+
+// WrapListener returns the listener that registers all accepted connections
+// as sessions of the specified protocol. It should be applied before the TLS
+// wrapper so the underlying connection is closed on termination.
+func WrapListener(l net.Listener, protocol string) net.Listener {
+	return listener{Listener: l, protocol: protocol}
+}
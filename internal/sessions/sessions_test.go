@@ -0,0 +1,84 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package sessions
+
+import (
+	"net"
+	"testing"
+)
+
+func acceptConn(t *testing.T, l net.Listener) (server, client net.Conn) {
+	t.Helper()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestRegistry(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := WrapListener(raw, "imap")
+	defer l.Close()
+
+	srv1, cl1 := acceptConn(t, l)
+	defer cl1.Close()
+	srv2, cl2 := acceptConn(t, l)
+	defer cl2.Close()
+
+	SetUser(srv1.RemoteAddr(), "foxcpp@example.org")
+	SetMailbox(srv1.RemoteAddr(), "INBOX")
+	SetUser(srv2.RemoteAddr(), "foxcpp@example.org")
+
+	list := List("foxcpp@example.org")
+	if len(list) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(list))
+	}
+	if list[0].Mailbox != "INBOX" || list[0].Protocol != "imap" {
+		t.Fatalf("wrong session info: %+v", list[0])
+	}
+	if len(List("other@example.org")) != 0 {
+		t.Fatal("sessions of other users returned")
+	}
+
+	if !Terminate(list[0].ID) {
+		t.Fatal("Terminate returned false")
+	}
+	if Terminate(list[0].ID) {
+		t.Fatal("Terminate returned true for a closed session")
+	}
+	if _, err := srv1.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is not closed")
+	}
+
+	if n := TerminateUser("foxcpp@example.org"); n != 1 {
+		t.Fatalf("TerminateUser returned %d, expected 1", n)
+	}
+	if len(List("")) != 0 {
+		t.Fatal("closed sessions are still listed")
+	}
+	srv2.Close()
+}
@@ -0,0 +1,239 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sqlmigrate implements versioned schema migrations for SQL tables
+// managed by maddy modules.
+//
+// Each module (component) has its own ordered list of migrations and the
+// current schema version is tracked in the maddy_schema_versions table.
+// Schema of storage.imapsql tables is managed by go-imap-sql separately.
+package sqlmigrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// AutoMigrate controls whether Prepare applies pending migrations
+// automatically. It is set using the sql_auto_migrate global directive.
+var AutoMigrate = true
+
+// ErrOutdated is returned by Prepare if the schema is not up to date and
+// AutoMigrate is not set.
+var ErrOutdated = errors.New("sqlmigrate: database schema is outdated, run 'maddy db migrate'")
+
+// Migration describes a single schema change.
+type Migration struct {
+	// Version of the schema after the migration is applied. Versions start
+	// at 1 and should be consecutive.
+	Version int
+
+	Description string
+
+	// Up contains statements that apply the migration.
+	Up []string
+
+	// Down contains statements that revert the migration. If it is empty,
+	// the migration can not be reverted.
+	Down []string
+}
+
+// Migrator applies migrations for a single component.
+type Migrator struct {
+	DB     *sql.DB
+	Driver string
+
+	// Component is the unique name of the set of tables managed by the
+	// migrations, e.g. "mtasts_cache".
+	Component string
+
+	// Migrations sorted by Version.
+	Migrations []Migration
+}
+
+// Provider is implemented by modules that manage SQL tables using Migrator.
+type Provider interface {
+	Migrators() []*Migrator
+}
+
+func (m *Migrator) placeholder(n int) string {
+	if m.Driver == "mysql" {
+		return "?"
+	}
+	return "$" + strconv.Itoa(n)
+}
+
+func (m *Migrator) initVersionTable(ctx context.Context) error {
+	_, err := m.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS maddy_schema_versions (
+		component VARCHAR(255) PRIMARY KEY NOT NULL,
+		version INTEGER NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`)
+	return err
+}
+
+// Latest returns the version of the schema after all migrations are applied.
+func (m *Migrator) Latest() int {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Current returns the currently applied schema version. 0 is returned if no
+// migrations were applied.
+func (m *Migrator) Current(ctx context.Context) (int, error) {
+	if err := m.initVersionTable(ctx); err != nil {
+		return 0, fmt.Errorf("sqlmigrate: %s: %w", m.Component, err)
+	}
+
+	var version int
+	err := m.DB.QueryRowContext(ctx,
+		`SELECT version FROM maddy_schema_versions WHERE component = `+m.placeholder(1),
+		m.Component).Scan(&version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("sqlmigrate: %s: %w", m.Component, err)
+	}
+	return version, nil
+}
+
+// Pending returns the list of migrations that are not applied yet.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	current, err := m.Current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current > m.Latest() {
+		return nil, fmt.Errorf("sqlmigrate: %s: schema version %d is newer than supported %d, was maddy downgraded?",
+			m.Component, current, m.Latest())
+	}
+
+	var pending []Migration
+	for _, mig := range m.Migrations {
+		if mig.Version > current {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Prepare applies pending migrations if AutoMigrate is set or returns
+// ErrOutdated if there are any.
+func (m *Migrator) Prepare(ctx context.Context) error {
+	if AutoMigrate {
+		return m.Migrate(ctx, m.Latest())
+	}
+
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) != 0 {
+		return fmt.Errorf("%w (%s: %d pending migrations)", ErrOutdated, m.Component, len(pending))
+	}
+	return nil
+}
+
+// Migrate applies migrations up to the specified version.
+func (m *Migrator) Migrate(ctx context.Context, target int) error {
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range pending {
+		if mig.Version > target {
+			break
+		}
+		if err := m.apply(ctx, mig.Up, mig.Version); err != nil {
+			return fmt.Errorf("sqlmigrate: %s: migration %d (%s): %w", m.Component, mig.Version, mig.Description, err)
+		}
+	}
+	return nil
+}
+
+// Rollback reverts migrations down to the specified version.
+func (m *Migrator) Rollback(ctx context.Context, target int) error {
+	current, err := m.Current(ctx)
+	if err != nil {
+		return err
+	}
+	if current > m.Latest() {
+		return fmt.Errorf("sqlmigrate: %s: schema version %d is newer than supported %d", m.Component, current, m.Latest())
+	}
+
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		mig := m.Migrations[i]
+		if mig.Version > current {
+			continue
+		}
+		if mig.Version <= target {
+			break
+		}
+		if len(mig.Down) == 0 {
+			return fmt.Errorf("sqlmigrate: %s: migration %d (%s) can not be reverted", m.Component, mig.Version, mig.Description)
+		}
+		if err := m.apply(ctx, mig.Down, mig.Version-1); err != nil {
+			return fmt.Errorf("sqlmigrate: %s: revert migration %d (%s): %w", m.Component, mig.Version, mig.Description, err)
+		}
+	}
+	return nil
+}
+
+// apply executes the statements and sets the schema version in a single
+// transaction.
+func (m *Migrator) apply(ctx context.Context, stmts []string, version int) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	res, err := tx.ExecContext(ctx,
+		`UPDATE maddy_schema_versions SET version = `+m.placeholder(1)+`, updated_at = `+m.placeholder(2)+
+			` WHERE component = `+m.placeholder(3),
+		version, now, m.Component)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO maddy_schema_versions (component, version, updated_at) VALUES (`+
+				m.placeholder(1)+`, `+m.placeholder(2)+`, `+m.placeholder(3)+`)`,
+			m.Component, version, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
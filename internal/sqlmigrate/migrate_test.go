@@ -0,0 +1,146 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sqlmigrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testMigrator(t *testing.T) *Migrator {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &Migrator{
+		DB:        db,
+		Driver:    "sqlite3",
+		Component: "test",
+		Migrations: []Migration{
+			{
+				Version:     1,
+				Description: "create table",
+				Up:          []string{`CREATE TABLE test (a TEXT)`},
+				Down:        []string{`DROP TABLE test`},
+			},
+			{
+				Version:     2,
+				Description: "add column",
+				Up:          []string{`ALTER TABLE test ADD COLUMN b TEXT`},
+				Down:        []string{`CREATE TABLE test2 (a TEXT)`, `DROP TABLE test`, `ALTER TABLE test2 RENAME TO test`},
+			},
+		},
+	}
+}
+
+func checkVersion(t *testing.T, m *Migrator, expected int) {
+	t.Helper()
+	v, err := m.Current(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != expected {
+		t.Fatalf("schema version = %d, expected %d", v, expected)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	m := testMigrator(t)
+	ctx := context.Background()
+
+	checkVersion(t, m, 0)
+	if err := m.Migrate(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 1)
+
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Version != 2 {
+		t.Fatalf("unexpected pending migrations: %+v", pending)
+	}
+
+	if err := m.Migrate(ctx, m.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 2)
+	if _, err := m.DB.Exec(`INSERT INTO test (a, b) VALUES ('1', '2')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Rollback(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 0)
+	if _, err := m.DB.Exec(`SELECT * FROM test`); err == nil {
+		t.Fatal("table still exists after rollback")
+	}
+}
+
+func TestMigrator_FailedMigration(t *testing.T) {
+	m := testMigrator(t)
+	m.Migrations[1].Up = []string{`ALTER TABLE test ADD COLUMN b TEXT`, `INVALID SQL`}
+
+	if err := m.Migrate(context.Background(), m.Latest()); err == nil {
+		t.Fatal("expected error")
+	}
+	// First migration is applied, second is rolled back entirely.
+	checkVersion(t, m, 1)
+	if _, err := m.DB.Exec(`SELECT b FROM test`); err == nil {
+		t.Fatal("failed migration was partially applied")
+	}
+}
+
+func TestMigrator_Prepare(t *testing.T) {
+	m := testMigrator(t)
+	ctx := context.Background()
+
+	AutoMigrate = false
+	defer func() { AutoMigrate = true }()
+
+	if err := m.Prepare(ctx); !errors.Is(err, ErrOutdated) {
+		t.Fatalf("expected ErrOutdated, got %v", err)
+	}
+
+	AutoMigrate = true
+	if err := m.Prepare(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 2)
+
+	// Schema created by a newer version.
+	m.Migrations = m.Migrations[:1]
+	if err := m.Prepare(ctx); err == nil {
+		t.Fatal("expected error for newer schema version")
+	}
+}
@@ -1,7 +1,10 @@
 package fs
 
 import (
+	"context"
 	"os"
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/foxcpp/maddy/framework/module"
@@ -17,3 +20,30 @@ func TestFS(t *testing.T) {
 		os.RemoveAll(store.(*FSStore).root)
 	})
 }
+
+func TestFS_ListBlobs(t *testing.T) {
+	store := &FSStore{instName: "test", root: testutils.Dir(t)}
+	for _, key := range []string{"a", "b"} {
+		b, err := store.Create(context.Background(), key, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+	}
+
+	blobs, err := store.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(blobs))
+	for _, b := range blobs {
+		if b.ModTime.IsZero() {
+			t.Error("ModTime is not set for", b.Key)
+		}
+		keys = append(keys, b.Key)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatal("Wrong keys listed:", keys)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -190,7 +191,25 @@ func (s *Store) Delete(ctx context.Context, keys []string) error {
 	return lastErr
 }
 
+func (s *Store) ListBlobs(ctx context.Context) ([]module.BlobInfo, error) {
+	var blobs []module.BlobInfo
+	for obj := range s.cl.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+		Prefix:    s.objectPrefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		blobs = append(blobs, module.BlobInfo{
+			Key:     strings.TrimPrefix(obj.Key, s.objectPrefix),
+			ModTime: obj.LastModified,
+		})
+	}
+	return blobs, nil
+}
+
 func init() {
 	var _ module.BlobStore = &Store{}
+	var _ module.BlobLister = &Store{}
 	module.Register(modName, New)
 }
@@ -88,3 +88,38 @@ func BenchmarkStorage_DeliveryZstd(b *testing.B) {
 
 	testutils.BenchDelivery(b, be, "sender@example.org", []string{randomKey})
 }
+
+func BenchmarkStorage_DeliveryParallel(b *testing.B) {
+	bench := func(name string, accounts int) {
+		b.Run(name, func(b *testing.B) {
+			prefix := "rcpt-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-X@example.org"
+
+			be := createTestDB(b, "")
+			testutils.BenchDeliveryParallel(b, be, "sender@example.org", []string{prefix},
+				testutils.ParallelBenchOptions{
+					Parallelism: 4,
+					BodySizes:   []int{1024, 16 * 1024, testutils.MessageBodySize, 1024 * 1024},
+					Accounts:    accounts,
+					Prepare:     be.CreateIMAPAcct,
+				})
+		})
+	}
+
+	// All goroutines deliver to the same mailbox.
+	bench("SameAccount", 1)
+	// Each goroutine is likely to use its own mailbox.
+	bench("DifferentAccounts", 64)
+}
+
+func BenchmarkStorage_DeliveryCorpus(b *testing.B) {
+	prefix := "rcpt-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-X@example.org"
+
+	be := createTestDB(b, "")
+	testutils.BenchDeliveryParallel(b, be, "sender@example.org", []string{prefix},
+		testutils.ParallelBenchOptions{
+			Parallelism: 4,
+			Corpus:      testutils.NewMsgGenerator(1),
+			Accounts:    16,
+			Prepare:     be.CreateIMAPAcct,
+		})
+}
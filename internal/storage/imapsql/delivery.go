@@ -21,6 +21,7 @@ package imapsql
 import (
 	"context"
 	"runtime/trace"
+	"strings"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -99,9 +100,39 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 	return nil
 }
 
+// checkLoops checks whether the message was already delivered to any of the
+// recipients, which indicates a forwarding loop (e.g. two accounts forwarding
+// messages to each other).
+func (d *delivery) checkLoops(header textproto.Header) error {
+	for f := header.FieldsByKey("Delivered-To"); f.Next(); {
+		deliveredTo := strings.TrimSpace(f.Value())
+		for accountName := range d.addedRcpts {
+			if !strings.EqualFold(deliveredTo, accountName) {
+				continue
+			}
+			return &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+				Message:      "Mail loop detected",
+				TargetName:   "imapsql",
+				Misc: map[string]interface{}{
+					"account": accountName,
+				},
+			}
+		}
+	}
+	return nil
+}
+
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
+	if d.store.checkDeliveredTo {
+		if err := d.checkLoops(header); err != nil {
+			return err
+		}
+	}
+
 	if !d.msgMeta.Quarantine && d.store.filters != nil {
 		for rcpt, rcptData := range d.addedRcpts {
 			folder, flags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
@@ -114,7 +145,13 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	}
 
 	if d.msgMeta.Quarantine {
-		if err := d.d.SpecialMailbox(imap.JunkAttr, d.store.junkMbox); err != nil {
+		var err error
+		if mbox, ok := d.msgMeta.Annotations.GetString("quarantine.mailbox"); ok {
+			err = d.d.Mailbox(mbox)
+		} else {
+			err = d.d.SpecialMailbox(imap.JunkAttr, d.store.junkMbox)
+		}
+		if err != nil {
 			if _, ok := err.(imapsql.SerializationError); ok {
 				return &exterrors.SMTPError{
 					Code:         453,
@@ -0,0 +1,52 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package imapsql
+
+import (
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func TestDeliveryCheckLoops(t *testing.T) {
+	d := delivery{
+		store: &Storage{checkDeliveredTo: true},
+		addedRcpts: map[string]addedRcpt{
+			"foxcpp@example.org": {rcptTo: "foxcpp@example.org"},
+		},
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Delivered-To", "other@example.org")
+	if err := d.checkLoops(hdr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	hdr.Add("Delivered-To", " FOXCPP@example.org")
+	err := d.checkLoops(hdr)
+	if err == nil {
+		t.Fatal("expected loop to be detected")
+	}
+	if exterrors.IsTemporaryOrUnspec(err) {
+		t.Error("expected permanent error")
+	}
+	if fields := exterrors.Fields(err); fields["smtp_enchcode"] != (exterrors.EnhancedCode{5, 4, 6}) {
+		t.Errorf("wrong enhanced code: %v", fields["smtp_enchcode"])
+	}
+}
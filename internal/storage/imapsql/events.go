@@ -0,0 +1,441 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Types of storage events.
+const (
+	EventMessageAdded    = "message_added"
+	EventMessageExpunged = "message_expunged"
+	EventFlagAdded       = "flag_added"
+	EventFlagRemoved     = "flag_removed"
+)
+
+// eventsBatchSize is the maximum amount of events sent to the webhook in one
+// request.
+const eventsBatchSize = 500
+
+// Event describes a single change to the message storage recorded in the
+// maddy_events table.
+type Event struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// Account and Mailbox may be empty if the mailbox was removed in the same
+	// transaction, MailboxID can be used to correlate events in this case.
+	Account     string `json:"account"`
+	Mailbox     string `json:"mailbox"`
+	MailboxID   uint64 `json:"mailbox_id"`
+	UIDValidity uint32 `json:"uid_validity"`
+	UID         uint32 `json:"uid"`
+
+	// Blob is the message store key of the message body. Set for
+	// message_added and message_expunged events.
+	Blob string `json:"blob,omitempty"`
+	// Flag is set for flag_added and flag_removed events.
+	Flag string `json:"flag,omitempty"`
+}
+
+type eventsConfig struct {
+	enabled   bool
+	webhook   string
+	interval  time.Duration
+	retention time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// eventsSchema returns statements that create the changelog table and
+// triggers that populate it.
+func (store *Storage) eventsSchema() ([]string, error) {
+	// Account and mailbox are resolved when the event is recorded so they are
+	// known even if the mailbox is removed later.
+	insert := func(typ, row, blob, flag string) string {
+		return `INSERT INTO maddy_events (ts, type, account, mailbox, mbox_id, uidvalidity, uid, blob_key, flag) VALUES (` +
+			store.eventsNow() + `, ` + typ + `,
+			(SELECT users.username FROM mboxes INNER JOIN users ON users.id = mboxes.uid WHERE mboxes.id = ` + row + `.mboxId),
+			(SELECT name FROM mboxes WHERE id = ` + row + `.mboxId),
+			` + row + `.mboxId,
+			(SELECT uidvalidity FROM mboxes WHERE id = ` + row + `.mboxId),
+			` + row + `.msgId, ` + blob + `, ` + flag + `)`
+	}
+	var (
+		added    = insert(`'`+EventMessageAdded+`'`, "NEW", "NEW.extBodyKey", "NULL")
+		expunged = insert(`'`+EventMessageExpunged+`'`, "OLD", "OLD.extBodyKey", "NULL")
+		flagAdd  = insert(`'`+EventFlagAdded+`'`, "NEW", "NULL", "NEW.flag")
+		flagRem  = insert(`'`+EventFlagRemoved+`'`, "OLD", "NULL", "OLD.flag")
+	)
+	// \Seen is stored in the msgs table instead of flags.
+	seen := func(isSet string) string {
+		return insert(`CASE WHEN `+isSet+` THEN '`+EventFlagAdded+`' ELSE '`+EventFlagRemoved+`' END`,
+			"NEW", "NULL", `'\Seen'`)
+	}
+
+	switch store.driver {
+	case "sqlite3", "sqlite":
+		return []string{
+			`CREATE TABLE IF NOT EXISTS maddy_events (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				ts BIGINT NOT NULL,
+				type TEXT NOT NULL,
+				account TEXT,
+				mailbox TEXT,
+				mbox_id BIGINT NOT NULL,
+				uidvalidity BIGINT,
+				uid BIGINT NOT NULL,
+				blob_key TEXT,
+				flag TEXT
+			)`,
+			`CREATE TABLE IF NOT EXISTS maddy_events_cursors (
+				name TEXT PRIMARY KEY,
+				last_id BIGINT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS maddy_events_ts ON maddy_events(ts)`,
+			`CREATE TRIGGER maddy_events_msgs_insert AFTER INSERT ON msgs BEGIN ` + added + `; END`,
+			`CREATE TRIGGER maddy_events_msgs_delete AFTER DELETE ON msgs BEGIN ` + expunged + `; END`,
+			`CREATE TRIGGER maddy_events_msgs_update AFTER UPDATE OF seen ON msgs WHEN NEW.seen <> OLD.seen BEGIN ` + seen("NEW.seen") + `; END`,
+			`CREATE TRIGGER maddy_events_flags_insert AFTER INSERT ON flags BEGIN ` + flagAdd + `; END`,
+			`CREATE TRIGGER maddy_events_flags_delete AFTER DELETE ON flags BEGIN ` + flagRem + `; END`,
+		}, nil
+	case "postgres":
+		return []string{
+			`CREATE TABLE IF NOT EXISTS maddy_events (
+				id BIGSERIAL PRIMARY KEY,
+				ts BIGINT NOT NULL,
+				type TEXT NOT NULL,
+				account TEXT,
+				mailbox TEXT,
+				mbox_id BIGINT NOT NULL,
+				uidvalidity BIGINT,
+				uid BIGINT NOT NULL,
+				blob_key TEXT,
+				flag TEXT
+			)`,
+			`CREATE TABLE IF NOT EXISTS maddy_events_cursors (
+				name TEXT PRIMARY KEY,
+				last_id BIGINT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS maddy_events_ts ON maddy_events(ts)`,
+			`CREATE OR REPLACE FUNCTION maddy_events_msgs() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP = 'INSERT' THEN
+					` + added + `;
+				ELSIF TG_OP = 'DELETE' THEN
+					` + expunged + `;
+				ELSIF NEW.seen IS DISTINCT FROM OLD.seen THEN
+					` + seen("NEW.seen::int = 1") + `;
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`,
+			`CREATE OR REPLACE FUNCTION maddy_events_flags() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP = 'INSERT' THEN
+					` + flagAdd + `;
+				ELSE
+					` + flagRem + `;
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`,
+			`CREATE TRIGGER maddy_events_msgs AFTER INSERT OR UPDATE OR DELETE ON msgs FOR EACH ROW EXECUTE PROCEDURE maddy_events_msgs()`,
+			`CREATE TRIGGER maddy_events_flags AFTER INSERT OR DELETE ON flags FOR EACH ROW EXECUTE PROCEDURE maddy_events_flags()`,
+		}, nil
+	case "mysql":
+		return []string{
+			`CREATE TABLE IF NOT EXISTS maddy_events (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				ts BIGINT NOT NULL,
+				type VARCHAR(32) NOT NULL,
+				account TEXT,
+				mailbox TEXT,
+				mbox_id BIGINT NOT NULL,
+				uidvalidity BIGINT,
+				uid BIGINT NOT NULL,
+				blob_key TEXT,
+				flag TEXT,
+				INDEX maddy_events_ts (ts)
+			)`,
+			`CREATE TABLE IF NOT EXISTS maddy_events_cursors (
+				name VARCHAR(255) PRIMARY KEY,
+				last_id BIGINT NOT NULL
+			)`,
+			`CREATE TRIGGER maddy_events_msgs_insert AFTER INSERT ON msgs FOR EACH ROW ` + added,
+			`CREATE TRIGGER maddy_events_msgs_delete AFTER DELETE ON msgs FOR EACH ROW ` + expunged,
+			`CREATE TRIGGER maddy_events_msgs_update AFTER UPDATE ON msgs FOR EACH ROW IF NEW.seen <> OLD.seen THEN ` + seen("NEW.seen") + `; END IF`,
+			`CREATE TRIGGER maddy_events_flags_insert AFTER INSERT ON flags FOR EACH ROW ` + flagAdd,
+			`CREATE TRIGGER maddy_events_flags_delete AFTER DELETE ON flags FOR EACH ROW ` + flagRem,
+		}, nil
+	default:
+		return nil, fmt.Errorf("events are not supported for %s driver", store.driver)
+	}
+}
+
+func (store *Storage) eventsNow() string {
+	switch store.driver {
+	case "postgres":
+		return `CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT)`
+	case "mysql":
+		return `UNIX_TIMESTAMP()`
+	default:
+		return `CAST(strftime('%s', 'now') AS INTEGER)`
+	}
+}
+
+// dropEventTriggers removes triggers created by setupEvents. The changelog
+// table itself is kept.
+func (store *Storage) dropEventTriggers(ctx context.Context, db execer) error {
+	var queries []string
+	switch store.driver {
+	case "postgres":
+		queries = []string{
+			`DROP TRIGGER IF EXISTS maddy_events_msgs ON msgs`,
+			`DROP TRIGGER IF EXISTS maddy_events_flags ON flags`,
+		}
+	default:
+		for _, name := range []string{
+			"maddy_events_msgs_insert", "maddy_events_msgs_delete", "maddy_events_msgs_update",
+			"maddy_events_flags_insert", "maddy_events_flags_delete",
+		} {
+			queries = append(queries, `DROP TRIGGER IF EXISTS `+name)
+		}
+	}
+	for _, q := range queries {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// setupEvents creates the changelog table and (re-)creates triggers so they
+// match the current version of maddy.
+//
+// This is done in a transaction so no events are lost if messages are
+// changed concurrently. Note that MySQL does not support transactional DDL.
+func (store *Storage) setupEvents(ctx context.Context) error {
+	schema, err := store.eventsSchema()
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.Back.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err := store.dropEventTriggers(ctx, tx); err != nil {
+		return err
+	}
+	for _, q := range schema {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Events returns up to limit recorded storage events with ID greater than
+// afterID, ordered by ID.
+func (store *Storage) Events(ctx context.Context, afterID int64, limit int) ([]Event, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, `
+		SELECT id, ts, type, account, mailbox, mbox_id, uidvalidity, uid, blob_key, flag
+		FROM maddy_events
+		WHERE id > `+store.placeholder(1)+`
+		ORDER BY id
+		LIMIT `+store.placeholder(2), afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var (
+			ev            Event
+			ts            int64
+			account, mbox sql.NullString
+			uidValidity   sql.NullInt64
+			blob, flag    sql.NullString
+		)
+		if err := rows.Scan(&ev.ID, &ts, &ev.Type, &account, &mbox, &ev.MailboxID, &uidValidity, &ev.UID, &blob, &flag); err != nil {
+			return nil, err
+		}
+		ev.Time = time.Unix(ts, 0)
+		ev.Account = account.String
+		ev.Mailbox = mbox.String
+		ev.UIDValidity = uint32(uidValidity.Int64)
+		ev.Blob = blob.String
+		ev.Flag = flag.String
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// PruneEvents removes events recorded before the cutoff time.
+func (store *Storage) PruneEvents(ctx context.Context, cutoff time.Time) error {
+	_, err := store.Back.DB.ExecContext(ctx, `DELETE FROM maddy_events WHERE ts < `+store.placeholder(1), cutoff.Unix())
+	return err
+}
+
+func (store *Storage) eventsCursor(ctx context.Context) (int64, error) {
+	var lastID int64
+	err := store.Back.DB.QueryRowContext(ctx,
+		`SELECT last_id FROM maddy_events_cursors WHERE name = `+store.placeholder(1),
+		store.eventsCursorName()).Scan(&lastID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return lastID, err
+}
+
+func (store *Storage) setEventsCursor(ctx context.Context, lastID int64) error {
+	name := store.eventsCursorName()
+	res, err := store.Back.DB.ExecContext(ctx,
+		`UPDATE maddy_events_cursors SET last_id = `+store.placeholder(1)+` WHERE name = `+store.placeholder(2),
+		lastID, name)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected != 0 {
+		return nil
+	}
+	_, err = store.Back.DB.ExecContext(ctx,
+		`INSERT INTO maddy_events_cursors (name, last_id) VALUES (`+store.placeholder(1)+`, `+store.placeholder(2)+`)`,
+		name, lastID)
+	return err
+}
+
+// eventsCursorName identifies the position of the webhook in the changelog,
+// it changes if the webhook URL is changed.
+func (store *Storage) eventsCursorName() string {
+	return "webhook:" + store.events.webhook
+}
+
+type eventsPayload struct {
+	Event   string  `json:"event"`
+	Storage string  `json:"storage"`
+	Events  []Event `json:"events"`
+}
+
+// sendEvents sends all events after the webhook cursor. It returns
+// the amount of events sent.
+func (store *Storage) sendEvents(ctx context.Context) (int, error) {
+	lastID, err := store.eventsCursor(ctx)
+	if err != nil {
+		return 0, err
+	}
+	events, err := store.Events(ctx, lastID, eventsBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	blob, err := json.Marshal(eventsPayload{
+		Event:   "storage.changes",
+		Storage: store.instName,
+		Events:  events,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, store.events.webhook, bytes.NewReader(blob))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return len(events), store.setEventsCursor(ctx, events[len(events)-1].ID)
+}
+
+func (store *Storage) eventsLoop() {
+	defer close(store.events.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-store.events.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(store.events.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if store.events.retention != 0 {
+			if err := store.PruneEvents(ctx, time.Now().Add(-store.events.retention)); err != nil {
+				store.Log.Error("failed to prune storage events", err)
+			}
+		}
+
+		if store.events.webhook == "" {
+			continue
+		}
+		for {
+			sent, err := store.sendEvents(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					store.Log.Error("failed to send storage events", err)
+				}
+				break
+			}
+			if sent < eventsBatchSize {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestStorageEvents(t *testing.T) {
+	store := createTestDB(t, "")
+	store.driver = testDB
+	ctx := context.Background()
+
+	if err := store.setupEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.dropEventTriggers(ctx, store.Back.DB) //nolint:errcheck
+
+	// Skip events left by previous runs.
+	var lastID int64
+	for {
+		events, err := store.Events(ctx, lastID, eventsBatchSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		lastID = events[len(events)-1].ID
+	}
+
+	username := "events-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@example.org"
+	if err := store.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Logout()
+
+	msg := []byte("Subject: test\r\n\r\nHello\r\n")
+	if err := u.CreateMessage("INBOX", []string{"$Important"}, time.Now(), bytes.NewReader(msg), nil); err != nil {
+		t.Fatal(err)
+	}
+	_, mbox, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.SeenFlag, imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.Events(ctx, lastID, eventsBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, ev := range events {
+		if ev.Account != username {
+			continue
+		}
+		if ev.Mailbox != "INBOX" {
+			t.Errorf("wrong mailbox: %+v", ev)
+		}
+		if ev.UID != 1 {
+			t.Errorf("wrong UID: %+v", ev)
+		}
+		switch ev.Type {
+		case EventMessageAdded, EventMessageExpunged:
+			if ev.Blob == "" {
+				t.Errorf("missing blob key: %+v", ev)
+			}
+			seen[ev.Type] = true
+		case EventFlagAdded:
+			seen[ev.Type+" "+ev.Flag] = true
+		}
+	}
+	for _, expected := range []string{
+		EventMessageAdded,
+		EventFlagAdded + " $Important",
+		EventFlagAdded + " " + imap.SeenFlag,
+		EventFlagAdded + " " + imap.DeletedFlag,
+		EventMessageExpunged,
+	} {
+		if !seen[expected] {
+			t.Errorf("missing event: %s", expected)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Kinds of inconsistencies reported by Fsck.
+const (
+	FsckMissingBody   = "missing_body"
+	FsckOrphanedBlob  = "orphaned_blob"
+	FsckUIDNext       = "uidnext"
+	FsckDanglingFlags = "dangling_flags"
+	FsckRefs          = "refs"
+)
+
+// FsckIssue describes an inconsistency found by Fsck.
+type FsckIssue struct {
+	Kind   string
+	Detail string
+	// Repaired is set if the issue was fixed. Some issues are not fixed
+	// even in repair mode, e.g. recently created orphaned blobs that may
+	// belong to a delivery in progress.
+	Repaired bool
+}
+
+// Fsck cross-checks the database against the message store and reports
+// found inconsistencies via the report callback.
+//
+// If repair is true, issues are fixed where possible: messages with missing
+// bodies are removed, orphaned blobs are deleted, mailbox UIDNEXT values and
+// blob reference counters are corrected and flags of non-existent messages
+// are removed.
+//
+// Repair changes the database directly without notifying IMAP clients so
+// it should be done while the server is stopped.
+func (store *Storage) Fsck(ctx context.Context, repair bool, report func(FsckIssue)) error {
+	store.maintLock.Lock()
+	defer store.maintLock.Unlock()
+
+	checks := []func(context.Context, bool, func(FsckIssue)) error{
+		store.fsckBodies,
+		store.fsckRefs,
+		store.fsckUIDNext,
+		store.fsckFlags,
+	}
+	for _, check := range checks {
+		if err := check(ctx, repair, report); err != nil {
+			return fmt.Errorf("imapsql: fsck: %w", err)
+		}
+	}
+	return nil
+}
+
+func (store *Storage) placeholder(n int) string {
+	if store.driver == "mysql" {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// fsckBodies checks that each message body referenced by the database exists
+// in the message store and vice versa.
+func (store *Storage) fsckBodies(ctx context.Context, repair bool, report func(FsckIssue)) error {
+	var (
+		stored map[string]time.Time
+		err    error
+	)
+	lister, canList := store.blobStore.(module.BlobLister)
+	if canList {
+		blobs, err := lister.ListBlobs(ctx)
+		if err != nil {
+			return err
+		}
+		stored = make(map[string]time.Time, len(blobs))
+		for _, b := range blobs {
+			stored[b.Key] = b.ModTime
+		}
+	}
+
+	referenced, err := store.referencedBlobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for key := range referenced {
+		var exists bool
+		if canList {
+			_, exists = stored[key]
+		} else {
+			exists, err = store.blobExists(ctx, key)
+			if err != nil {
+				return err
+			}
+		}
+		if exists {
+			continue
+		}
+
+		issue := FsckIssue{
+			Kind:   FsckMissingBody,
+			Detail: fmt.Sprintf("body %s is missing from message store", key),
+		}
+		if repair {
+			if err := store.removeMsgsByKey(ctx, key); err != nil {
+				return err
+			}
+			issue.Repaired = true
+		}
+		report(issue)
+	}
+
+	if !canList {
+		store.Log.Msg("message store does not support listing, skipping orphaned blobs check")
+		return nil
+	}
+
+	cutoff := time.Now().Add(-blobGCGrace)
+	var toDelete []string
+	for key, modTime := range stored {
+		if _, ok := referenced[key]; ok {
+			continue
+		}
+		issue := FsckIssue{
+			Kind:   FsckOrphanedBlob,
+			Detail: fmt.Sprintf("blob %s is not referenced by any message", key),
+		}
+		if repair && modTime.Before(cutoff) {
+			toDelete = append(toDelete, key)
+			issue.Repaired = true
+		}
+		report(issue)
+	}
+	if len(toDelete) != 0 {
+		return store.blobStore.Delete(ctx, toDelete)
+	}
+	return nil
+}
+
+func (store *Storage) blobExists(ctx context.Context, key string) (bool, error) {
+	r, err := store.blobStore.Open(ctx, key)
+	if err != nil {
+		if err == module.ErrNoSuchBlob {
+			return false, nil
+		}
+		return false, err
+	}
+	r.Close()
+	return true, nil
+}
+
+// removeMsgsByKey removes all messages using the specified body key along
+// with the key itself.
+func (store *Storage) removeMsgsByKey(ctx context.Context, key string) error {
+	tx, err := store.Back.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	queries := []string{
+		`DELETE FROM flags WHERE EXISTS (SELECT 1 FROM msgs WHERE msgs.mboxId = flags.mboxId AND msgs.msgId = flags.msgId AND msgs.extBodyKey = ` + store.placeholder(1) + `)`,
+		`DELETE FROM msgs WHERE extBodyKey = ` + store.placeholder(1),
+		`DELETE FROM extKeys WHERE id = ` + store.placeholder(1),
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// fsckRefs checks that reference counters of message bodies match the
+// amount of messages using them.
+func (store *Storage) fsckRefs(ctx context.Context, repair bool, report func(FsckIssue)) error {
+	rows, err := store.Back.DB.QueryContext(ctx, `
+		SELECT extKeys.id, extKeys.refs, (SELECT COUNT(*) FROM msgs WHERE msgs.extBodyKey = extKeys.id)
+		FROM extKeys`)
+	if err != nil {
+		return err
+	}
+
+	type mismatch struct {
+		key          string
+		refs, actual int
+	}
+	var found []mismatch
+	for rows.Next() {
+		var m mismatch
+		if err := rows.Scan(&m.key, &m.refs, &m.actual); err != nil {
+			rows.Close()
+			return err
+		}
+		if m.refs != m.actual {
+			found = append(found, m)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range found {
+		issue := FsckIssue{
+			Kind:   FsckRefs,
+			Detail: fmt.Sprintf("body %s has %d references recorded, %d actual", m.key, m.refs, m.actual),
+		}
+		if repair {
+			if m.actual == 0 {
+				if err := store.removeMsgsByKey(ctx, m.key); err != nil {
+					return err
+				}
+				if err := store.blobStore.Delete(ctx, []string{m.key}); err != nil {
+					return err
+				}
+			} else {
+				_, err := store.Back.DB.ExecContext(ctx,
+					`UPDATE extKeys SET refs = `+store.placeholder(1)+` WHERE id = `+store.placeholder(2),
+					m.actual, m.key)
+				if err != nil {
+					return err
+				}
+			}
+			issue.Repaired = true
+		}
+		report(issue)
+	}
+	return nil
+}
+
+// fsckUIDNext checks that UIDNEXT of each mailbox is greater than UIDs of all
+// messages in it. Otherwise, new messages would get duplicate UIDs.
+func (store *Storage) fsckUIDNext(ctx context.Context, repair bool, report func(FsckIssue)) error {
+	rows, err := store.Back.DB.QueryContext(ctx, `
+		SELECT mboxes.id, users.username, mboxes.name, mboxes.uidnext, MAX(msgs.msgId)
+		FROM mboxes
+		INNER JOIN users ON users.id = mboxes.uid
+		INNER JOIN msgs ON msgs.mboxId = mboxes.id
+		GROUP BY mboxes.id, users.username, mboxes.name, mboxes.uidnext
+		HAVING MAX(msgs.msgId) >= mboxes.uidnext`)
+	if err != nil {
+		return err
+	}
+
+	type broken struct {
+		id              int64
+		user, name      string
+		uidNext, maxUID int64
+	}
+	var found []broken
+	for rows.Next() {
+		var b broken
+		if err := rows.Scan(&b.id, &b.user, &b.name, &b.uidNext, &b.maxUID); err != nil {
+			rows.Close()
+			return err
+		}
+		found = append(found, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, b := range found {
+		issue := FsckIssue{
+			Kind:   FsckUIDNext,
+			Detail: fmt.Sprintf("mailbox %s of %s has UIDNEXT %d, but contains UID %d", b.name, b.user, b.uidNext, b.maxUID),
+		}
+		if repair {
+			_, err := store.Back.DB.ExecContext(ctx,
+				`UPDATE mboxes SET uidnext = `+store.placeholder(1)+` WHERE id = `+store.placeholder(2),
+				b.maxUID+1, b.id)
+			if err != nil {
+				return err
+			}
+			issue.Repaired = true
+		}
+		report(issue)
+	}
+	return nil
+}
+
+// fsckFlags checks for flags of messages that do not exist.
+func (store *Storage) fsckFlags(ctx context.Context, repair bool, report func(FsckIssue)) error {
+	const cond = `NOT EXISTS (SELECT 1 FROM msgs WHERE msgs.mboxId = flags.mboxId AND msgs.msgId = flags.msgId)`
+
+	var count int
+	row := store.Back.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM flags WHERE `+cond)
+	if err := row.Scan(&count); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	issue := FsckIssue{
+		Kind:   FsckDanglingFlags,
+		Detail: fmt.Sprintf("%d flags are set on non-existent messages", count),
+	}
+	if repair {
+		if _, err := store.Back.DB.ExecContext(ctx, `DELETE FROM flags WHERE `+cond); err != nil {
+			return err
+		}
+		issue.Repaired = true
+	}
+	report(issue)
+	return nil
+}
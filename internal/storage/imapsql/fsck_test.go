@@ -0,0 +1,199 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func runFsck(t *testing.T, store *Storage, repair bool) map[string][]FsckIssue {
+	t.Helper()
+
+	issues := make(map[string][]FsckIssue)
+	err := store.Fsck(context.Background(), repair, func(issue FsckIssue) {
+		issues[issue.Kind] = append(issues[issue.Kind], issue)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issues
+}
+
+func checkFsckIssues(t *testing.T, issues map[string][]FsckIssue, kind string, count, repaired int) {
+	t.Helper()
+
+	actualRepaired := 0
+	for _, issue := range issues[kind] {
+		if issue.Repaired {
+			actualRepaired++
+		}
+	}
+	if len(issues[kind]) != count || actualRepaired != repaired {
+		t.Errorf("%s: expected %d issues (%d repaired), got %d (%d repaired): %+v",
+			kind, count, repaired, len(issues[kind]), actualRepaired, issues[kind])
+	}
+}
+
+func TestStorage_Fsck(t *testing.T) {
+	dir := t.TempDir()
+	store := initSQLiteStorage(t, dir)
+	defer store.Close()
+
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	appendTestMsg(t, store, "test@example.org", "first")
+	appendTestMsg(t, store, "test@example.org", "second")
+	appendTestMsg(t, store, "test@example.org", "third")
+
+	if issues := runFsck(t, store, false); len(issues) != 0 {
+		t.Fatalf("issues found in consistent storage: %+v", issues)
+	}
+
+	rows, err := store.Back.DB.Query(`SELECT extBodyKey FROM msgs ORDER BY msgId`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 body keys, got %v", keys)
+	}
+
+	// Corrupt the storage in all ways fsck knows about.
+	msgsDir := filepath.Join(dir, "messages")
+	if err := os.Remove(filepath.Join(msgsDir, keys[0])); err != nil {
+		t.Fatal(err)
+	}
+	// Foreign keys are disabled to insert flags for a non-existent message,
+	// use a dedicated connection so the pragma does not leak into the pool.
+	conn, err := store.Back.DB.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruption := []string{
+		`PRAGMA foreign_keys = OFF`,
+		`UPDATE extKeys SET refs = 5 WHERE id = '` + keys[1] + `'`,
+		`UPDATE mboxes SET uidnext = 1`,
+		`INSERT INTO flags (mboxId, msgId, flag) SELECT mboxId, 100, '\Flagged' FROM msgs LIMIT 1`,
+		`PRAGMA foreign_keys = ON`,
+	}
+	for _, q := range corruption {
+		if _, err := conn.ExecContext(context.Background(), q); err != nil {
+			t.Fatal(q, err)
+		}
+	}
+	conn.Close()
+	for _, name := range []string{"old-orphan", "new-orphan"} {
+		if err := os.WriteFile(filepath.Join(msgsDir, name), []byte("orphan"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * blobGCGrace)
+	if err := os.Chtimes(filepath.Join(msgsDir, "old-orphan"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	issues := runFsck(t, store, false)
+	checkFsckIssues(t, issues, FsckMissingBody, 1, 0)
+	checkFsckIssues(t, issues, FsckOrphanedBlob, 2, 0)
+	checkFsckIssues(t, issues, FsckRefs, 1, 0)
+	checkFsckIssues(t, issues, FsckUIDNext, 1, 0)
+	checkFsckIssues(t, issues, FsckDanglingFlags, 1, 0)
+
+	// Check-only mode should not change anything.
+	if again := runFsck(t, store, false); len(again) != len(issues) {
+		t.Fatalf("check-only fsck changed storage: %+v -> %+v", issues, again)
+	}
+
+	issues = runFsck(t, store, true)
+	checkFsckIssues(t, issues, FsckMissingBody, 1, 1)
+	// Recent orphaned blob may belong to a delivery in progress and should
+	// be kept.
+	checkFsckIssues(t, issues, FsckOrphanedBlob, 2, 1)
+	checkFsckIssues(t, issues, FsckRefs, 1, 1)
+	checkFsckIssues(t, issues, FsckUIDNext, 1, 1)
+	checkFsckIssues(t, issues, FsckDanglingFlags, 1, 1)
+
+	issues = runFsck(t, store, false)
+	if len(issues) != 1 {
+		t.Errorf("issues left after repair: %+v", issues)
+	}
+	checkFsckIssues(t, issues, FsckOrphanedBlob, 1, 0)
+
+	blobs, err := os.ReadDir(msgsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, b := range blobs {
+		names = append(names, b.Name())
+	}
+	sort.Strings(names)
+	expected := []string{keys[1], keys[2], "new-orphan"}
+	sort.Strings(expected)
+	checkStrings(t, "blobs", names, expected)
+
+	// Message with the missing body is removed and new messages get UIDs
+	// after the existing ones.
+	appendTestMsg(t, store, "test@example.org", "fourth")
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Logout()
+	_, mbox, err := u.GetMailbox("INBOX", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	checkUIDs(t, "FETCH", fetchUIDs(t, mbox, imap.FetchEnvelope), 2, 3, 4)
+}
+
+func checkStrings(t *testing.T, what string, actual, expected []string) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Errorf("%s: expected %v, got %v", what, expected, actual)
+		return
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Errorf("%s: expected %v, got %v", what, expected, actual)
+			return
+		}
+	}
+}
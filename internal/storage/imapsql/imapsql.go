@@ -35,6 +35,8 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -47,6 +49,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
 
@@ -59,7 +62,17 @@ type Storage struct {
 	instName string
 	Log      log.Logger
 
-	junkMbox string
+	junkMbox    string
+	sentMbox    string
+	draftsMbox  string
+	trashMbox   string
+	archiveMbox string
+	// Create mailboxes with SPECIAL-USE attributes for new accounts.
+	createSpecial bool
+
+	// Reject messages that already have Delivered-To field for one of the
+	// recipients.
+	checkDeliveredTo bool
 
 	driver string
 	dsn    []string
@@ -76,6 +89,16 @@ type Storage struct {
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
 	authNormalize     func(context.Context, string) (string, error)
+
+	blobStore module.BlobStore
+	maint     maintConfig
+	maintLock sync.Mutex
+	maintStop chan struct{}
+	maintDone chan struct{}
+
+	events eventsConfig
+
+	metadata metadataConfig
 }
 
 func (store *Storage) Name() string {
@@ -112,7 +135,15 @@ func (store *Storage) Init(cfg *config.Map) error {
 		authNormalize     string
 		deliveryNormalize string
 
+		maxOpenConns    int
+		maxIdleConns    int
+		connMaxLifetime time.Duration
+		connMaxIdleTime time.Duration
+
 		blobStore module.BlobStore
+
+		sqliteJournalMode string
+		sqliteSynchronous string
 	)
 
 	opts := imapsql.Opts{}
@@ -139,8 +170,18 @@ func (store *Storage) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &store.Log.Debug)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
+	cfg.Enum("sqlite3_journal_mode", false, false,
+		[]string{"wal", "delete", "truncate", "persist", "memory", "off"}, "wal", &sqliteJournalMode)
+	cfg.Enum("sqlite3_synchronous", false, false,
+		[]string{"off", "normal", "full", "extra"}, "full", &sqliteSynchronous)
 	cfg.Bool("disable_recent", false, true, &opts.DisableRecent)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.String("sent_mailbox", false, false, "Sent", &store.sentMbox)
+	cfg.String("drafts_mailbox", false, false, "Drafts", &store.draftsMbox)
+	cfg.String("trash_mailbox", false, false, "Trash", &store.trashMbox)
+	cfg.String("archive_mailbox", false, false, "Archive", &store.archiveMbox)
+	cfg.Bool("create_special_mailboxes", false, true, &store.createSpecial)
+	cfg.Bool("delivered_to_loop_check", false, true, &store.checkDeliveredTo)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -156,6 +197,22 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.Int("max_open_conns", false, false, 0, &maxOpenConns)
+	cfg.Int("max_idle_conns", false, false, 2, &maxIdleConns)
+	cfg.Duration("conn_max_lifetime", false, false, 0, &connMaxLifetime)
+	cfg.Duration("conn_max_idle_time", false, false, 0, &connMaxIdleTime)
+	cfg.Duration("maintenance_interval", false, false, 0, &store.maint.interval)
+	cfg.Duration("maintenance_jitter", false, false, 1*time.Hour, &store.maint.jitter)
+	cfg.Float("maintenance_max_load", false, false, 0, &store.maint.maxLoad)
+	cfg.EnumList("maintenance_jobs", false, false, MaintenanceJobs, MaintenanceJobs, &store.maint.jobs)
+	cfg.Duration("retention_period", false, false, 0, &store.maint.retention)
+	cfg.StringList("retention_mailboxes", false, false, []string{"Trash", "Junk"}, &store.maint.retentionMboxes)
+	cfg.Bool("events", false, false, &store.events.enabled)
+	cfg.String("events_webhook", false, false, "", &store.events.webhook)
+	cfg.Duration("events_interval", false, false, 5*time.Second, &store.events.interval)
+	cfg.Duration("events_retention", false, false, 7*24*time.Hour, &store.events.retention)
+	cfg.DataSize("metadata_max_size", false, false, 64*1024, &store.metadata.maxSize)
+	cfg.Int("metadata_max_entries", false, false, 100, &store.metadata.maxEntries)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -241,6 +298,17 @@ func (store *Storage) Init(cfg *config.Map) error {
 	var err error
 
 	dsnStr := strings.Join(dsn, " ")
+	if driver == "sqlite3" || driver == "sqlite" {
+		dsnStr = withDSNParams(dsnStr,
+			sqlitePragmaParams("journal_mode", sqliteJournalMode),
+			sqlitePragmaParams("synchronous", sqliteSynchronous))
+	}
+	if driver == "mysql" {
+		dsnStr, err = mysqlDSN(dsnStr)
+		if err != nil {
+			return err
+		}
+	}
 
 	if len(compression) != 0 {
 		switch compression[0] {
@@ -271,12 +339,76 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
+	// go-imap-sql prepares all statements on each connection it uses, so
+	// keeping connections idle in the pool avoids re-preparing them.
+	sqlDB := store.Back.DB
+	sqlDB.SetMaxOpenConns(maxOpenConns)
+	sqlDB.SetMaxIdleConns(maxIdleConns)
+	sqlDB.SetConnMaxLifetime(connMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(connMaxIdleTime)
+
 	store.driver = driver
 	store.dsn = dsn
+	store.blobStore = blobStore
+
+	store.metadata.migrator = &sqlmigrate.Migrator{
+		DB:         sqlDB,
+		Driver:     driver,
+		Component:  "imap_metadata",
+		Migrations: metadataMigrations,
+	}
+	// Schema is managed using 'maddy db' commands in this case.
+	if !module.NoRun {
+		if err := store.metadata.migrator.Prepare(context.Background()); err != nil {
+			return fmt.Errorf("imapsql: metadata: %w", err)
+		}
+	}
+
+	if store.events.webhook != "" && !store.events.enabled {
+		return errors.New("imapsql: events_webhook requires events to be enabled")
+	}
+	// Triggers are managed only by the server process so maddy subcommands
+	// do not recreate them while the server is running.
+	if !module.NoRun {
+		if store.events.enabled {
+			err = store.setupEvents(context.Background())
+		} else {
+			err = store.dropEventTriggers(context.Background(), store.Back.DB)
+		}
+		if err != nil {
+			return fmt.Errorf("imapsql: events: %w", err)
+		}
+		if store.events.enabled {
+			store.events.stop = make(chan struct{})
+			store.events.done = make(chan struct{})
+			go store.eventsLoop()
+		}
+	}
+
+	if store.maint.interval != 0 && !module.NoRun {
+		store.maintStop = make(chan struct{})
+		store.maintDone = make(chan struct{})
+		go store.maintenanceLoop()
+	}
 
 	return nil
 }
 
+// withDSNParams adds URL query parameters to the file path or URI.
+func withDSNParams(dsn string, params ...string) string {
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		if strings.Contains(dsn, "?") {
+			dsn += "&" + param
+		} else {
+			dsn += "?" + param
+		}
+	}
+	return dsn
+}
+
 func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 	if store.updPipe != nil {
 		return nil
@@ -384,7 +516,23 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	if !store.createSpecial {
+		return store.Back.GetOrCreateUser(accountName)
+	}
+
+	u, err := store.Back.GetUser(accountName)
+	if err == nil {
+		return u, nil
+	}
+	if !errors.Is(err, imapsql.ErrUserDoesntExists) {
+		return nil, err
+	}
+	u, err = store.Back.GetOrCreateUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	store.createSpecialMailboxes(accountName, u)
+	return u, nil
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -407,7 +555,25 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 	return "", true, nil
 }
 
+// CheckHealth implements module.HealthChecker. It checks whether the
+// database is reachable.
+func (store *Storage) CheckHealth(ctx context.Context) error {
+	if err := store.Back.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	return nil
+}
+
 func (store *Storage) Close() error {
+	if store.maintStop != nil {
+		close(store.maintStop)
+		<-store.maintDone
+	}
+	if store.events.stop != nil {
+		close(store.events.stop)
+		<-store.events.done
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -0,0 +1,96 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/config"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+)
+
+func initSQLiteStorage(t *testing.T, dir string, directives ...config.Node) *Storage {
+	t.Helper()
+
+	mod, err := New("storage.imapsql", "", nil, []string{"sqlite3", filepath.Join(dir, "maddy.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	directives = append(directives, config.Node{
+		Name: "msg_store",
+		Args: []string{"fs", filepath.Join(dir, "messages")},
+	})
+	if err := store.Init(config.NewMap(nil, config.Node{Children: directives})); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func appendTestMsg(t *testing.T, store *Storage, username, subject string) {
+	t.Helper()
+
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Logout()
+
+	msg := []byte("Subject: " + subject + "\r\n\r\nHello\r\n")
+	if err := u.CreateMessage("INBOX", nil, time.Now(), bytes.NewReader(msg), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fetchUIDs(t *testing.T, mbox backend.Mailbox, items ...imap.FetchItem) []uint32 {
+	t.Helper()
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(true, seq, append(items, imap.FetchUid), ch); err != nil {
+		t.Fatal(err)
+	}
+	var uids []uint32
+	for msg := range ch {
+		uids = append(uids, msg.Uid)
+	}
+	return uids
+}
+
+func checkUIDs(t *testing.T, what string, actual []uint32, expected ...uint32) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Errorf("%s: expected UIDs %v, got %v", what, expected, actual)
+		return
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Errorf("%s: expected UIDs %v, got %v", what, expected, actual)
+			return
+		}
+	}
+}
@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imapsql
 
 import (
+	"context"
+
 	"github.com/emersion/go-imap/backend"
 )
 
@@ -34,7 +36,10 @@ func (store *Storage) CreateIMAPAcct(accountName string) error {
 }
 
 func (store *Storage) DeleteIMAPAcct(accountName string) error {
-	return store.Back.DeleteUser(accountName)
+	if err := store.Back.DeleteUser(accountName); err != nil {
+		return err
+	}
+	return store.deleteMetadata(context.Background(), accountName)
 }
 
 func (store *Storage) GetIMAPAcct(accountName string) (backend.User, error) {
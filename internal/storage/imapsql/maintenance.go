@@ -0,0 +1,300 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	JobBlobGC    = "blob_gc"
+	JobVacuum    = "vacuum"
+	JobRetention = "retention"
+)
+
+// MaintenanceJobs lists all jobs that can be passed to RunMaintenance.
+var MaintenanceJobs = []string{JobBlobGC, JobVacuum, JobRetention}
+
+// blobGCGrace is the minimal age of an unreferenced blob for it to be
+// removed. Blobs are written before the message is added to the database,
+// so young unreferenced blobs may belong to a delivery in progress.
+const blobGCGrace = 24 * time.Hour
+
+type maintConfig struct {
+	interval time.Duration
+	jitter   time.Duration
+	maxLoad  float64
+	jobs     []string
+
+	retention       time.Duration
+	retentionMboxes []string
+}
+
+func (store *Storage) maintenanceLoop() {
+	defer close(store.maintDone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-store.maintStop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		delay := store.maint.interval
+		if store.maint.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(store.maint.jitter)))
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		if err := store.runMaintenance(ctx, store.maint.jobs, true); err != nil {
+			store.Log.Error("maintenance failed", err)
+		}
+	}
+}
+
+// RunMaintenance runs the specified housekeeping jobs immediately.
+//
+// It is used by 'maddy imap-maint' to trigger jobs on demand. Load limit
+// is not applied.
+func (store *Storage) RunMaintenance(ctx context.Context, jobs []string) error {
+	return store.runMaintenance(ctx, jobs, false)
+}
+
+func (store *Storage) runMaintenance(ctx context.Context, jobs []string, checkLoad bool) error {
+	store.maintLock.Lock()
+	defer store.maintLock.Unlock()
+
+	for _, job := range jobs {
+		if checkLoad && store.maint.maxLoad > 0 {
+			if load, ok := loadAverage(); ok && load > store.maint.maxLoad {
+				store.Log.Msg("system load is too high, postponing maintenance", "load", load, "max_load", store.maint.maxLoad)
+				return nil
+			}
+		}
+
+		start := time.Now()
+		var err error
+		switch job {
+		case JobBlobGC:
+			err = store.blobGC(ctx)
+		case JobVacuum:
+			err = store.vacuum(ctx)
+		case JobRetention:
+			err = store.expungeExpired(ctx)
+		default:
+			err = fmt.Errorf("unknown job: %s", job)
+		}
+		if err != nil {
+			return fmt.Errorf("imapsql: %s: %w", job, err)
+		}
+		store.Log.DebugMsg("maintenance job done", "job", job, "duration", time.Since(start))
+	}
+	return nil
+}
+
+// blobGC removes objects from the message store that are not referenced by
+// any message.
+func (store *Storage) blobGC(ctx context.Context) error {
+	lister, ok := store.blobStore.(module.BlobLister)
+	if !ok {
+		store.Log.Msg("message store does not support listing, skipping blob_gc")
+		return nil
+	}
+
+	// Note that the listing is done before fetching the set of referenced
+	// keys so messages added in between are not considered to be orphaned.
+	blobs, err := lister.ListBlobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	referenced, err := store.referencedBlobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-blobGCGrace)
+	var orphaned []string
+	for _, b := range blobs {
+		if _, ok := referenced[b.Key]; ok {
+			continue
+		}
+		if b.ModTime.After(cutoff) {
+			continue
+		}
+		orphaned = append(orphaned, b.Key)
+	}
+	if len(orphaned) == 0 {
+		return nil
+	}
+
+	store.Log.Msg("removing orphaned blobs", "count", len(orphaned))
+	return store.blobStore.Delete(ctx, orphaned)
+}
+
+// referencedBlobs returns the set of message store keys known to the
+// database.
+func (store *Storage) referencedBlobs(ctx context.Context) (map[string]struct{}, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, `SELECT id FROM extKeys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	referenced := make(map[string]struct{})
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		referenced[key] = struct{}{}
+	}
+	return referenced, rows.Err()
+}
+
+// vacuum rebuilds the database file and refreshes query planner
+// statistics. It is a no-op for server-based databases that do this
+// automatically.
+func (store *Storage) vacuum(ctx context.Context) error {
+	switch store.driver {
+	case "sqlite3", "sqlite":
+		if _, err := store.Back.DB.ExecContext(ctx, `VACUUM`); err != nil {
+			return err
+		}
+		_, err := store.Back.DB.ExecContext(ctx, `ANALYZE`)
+		return err
+	default:
+		store.Log.DebugMsg("vacuum is not needed for the driver, skipping", "driver", store.driver)
+		return nil
+	}
+}
+
+// expungeExpired removes messages older than the retention period from the
+// configured mailboxes of all accounts.
+func (store *Storage) expungeExpired(ctx context.Context) error {
+	if store.maint.retention == 0 || len(store.maint.retentionMboxes) == 0 {
+		return nil
+	}
+
+	users, err := store.Back.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-store.maint.retention)
+	for _, username := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := store.expungeUserExpired(username, cutoff); err != nil {
+			return fmt.Errorf("%s: %w", username, err)
+		}
+	}
+	return nil
+}
+
+func (store *Storage) expungeUserExpired(username string, cutoff time.Time) error {
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return err
+	}
+	defer u.Logout()
+
+	for _, name := range store.maint.retentionMboxes {
+		_, mbox, err := u.GetMailbox(name, false, nil)
+		if err != nil {
+			if errors.Is(err, backend.ErrNoSuchMailbox) {
+				continue
+			}
+			return err
+		}
+
+		uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{Before: cutoff})
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			continue
+		}
+
+		seq := &imap.SeqSet{}
+		seq.AddNum(uids...)
+		if err := mbox.(*imapsql.Mailbox).DelMessages(true, seq); err != nil {
+			return err
+		}
+		store.Log.DebugMsg("expunged expired messages", "username", username, "mailbox", name, "count", len(uids))
+	}
+	return nil
+}
+
+// BackupDB writes a consistent copy of the database to the file at path
+// without stopping the server. Only SQLite databases are supported, server
+// databases have their own tools for that (pg_dump, mysqldump).
+func (store *Storage) BackupDB(ctx context.Context, path string) error {
+	if store.driver != "sqlite3" && store.driver != "sqlite" {
+		return fmt.Errorf("imapsql: backup is not supported for %s driver, use database tools instead", store.driver)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("imapsql: backup: %s already exists", path)
+	}
+	if err := sqliteBackup(ctx, store.Back.DB, path); err != nil {
+		return fmt.Errorf("imapsql: backup: %w", err)
+	}
+	return nil
+}
+
+// loadAverage returns the 1-minute system load average. ok is false if it is
+// not available on the system.
+func loadAverage() (load float64, ok bool) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return load, true
+}
@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+)
+
+// IMAP METADATA (RFC 5464) annotations are stored in a separate table
+// managed by maddy since go-imap-sql has no support for them.
+var metadataMigrations = []sqlmigrate.Migration{
+	{
+		Version:     1,
+		Description: "create imap_metadata table",
+		Up: []string{`CREATE TABLE imap_metadata (
+			account VARCHAR(255) NOT NULL,
+			mailbox VARCHAR(255) NOT NULL,
+			entry VARCHAR(255) NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (account, mailbox, entry)
+		)`},
+		Down: []string{`DROP TABLE imap_metadata`},
+	},
+}
+
+type metadataConfig struct {
+	migrator   *sqlmigrate.Migrator
+	maxSize    int64
+	maxEntries int
+}
+
+// Migrators implements sqlmigrate.Provider.
+func (store *Storage) Migrators() []*sqlmigrate.Migrator {
+	return []*sqlmigrate.Migrator{store.metadata.migrator}
+}
+
+// Metadata implements module.MetadataStorage.
+func (store *Storage) Metadata(ctx context.Context, username, mailbox string) (map[string]string, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, `SELECT entry, value FROM imap_metadata
+		WHERE account = `+store.placeholder(1)+` AND mailbox = `+store.placeholder(2), username, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]string)
+	for rows.Next() {
+		var entry, value string
+		if err := rows.Scan(&entry, &value); err != nil {
+			return nil, err
+		}
+		res[entry] = value
+	}
+	return res, rows.Err()
+}
+
+// SetMetadata implements module.MetadataStorage.
+func (store *Storage) SetMetadata(ctx context.Context, username, mailbox string, values map[string]*string) error {
+	for _, value := range values {
+		if value != nil && store.metadata.maxSize > 0 && int64(len(*value)) > store.metadata.maxSize {
+			return module.MetadataTooLargeError{MaxSize: store.metadata.maxSize}
+		}
+	}
+
+	tx, err := store.Back.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for entry, value := range values {
+		_, err := tx.ExecContext(ctx, `DELETE FROM imap_metadata
+			WHERE account = `+store.placeholder(1)+` AND mailbox = `+store.placeholder(2)+` AND entry = `+store.placeholder(3),
+			username, mailbox, entry)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO imap_metadata(account, mailbox, entry, value)
+			VALUES (`+store.placeholder(1)+`, `+store.placeholder(2)+`, `+store.placeholder(3)+`, `+store.placeholder(4)+`)`,
+			username, mailbox, entry, *value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if store.metadata.maxEntries > 0 {
+		var count int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM imap_metadata WHERE account = `+store.placeholder(1),
+			username).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > store.metadata.maxEntries {
+			return module.ErrMetadataTooMany
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deleteMetadata removes all annotations of the account.
+func (store *Storage) deleteMetadata(ctx context.Context, username string) error {
+	// The table may be not created yet if the server was not started
+	// after the upgrade.
+	version, err := store.metadata.migrator.Current(ctx)
+	if err != nil || version == 0 {
+		return err
+	}
+	_, err = store.Back.DB.ExecContext(ctx, `DELETE FROM imap_metadata WHERE account = `+store.placeholder(1), username)
+	return err
+}
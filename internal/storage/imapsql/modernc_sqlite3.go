@@ -21,6 +21,27 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package imapsql
 
-import _ "modernc.org/sqlite"
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
 
 const sqliteImpl = "modernc"
+
+// sqlitePragmaParams returns DSN parameters that set the PRAGMA for each
+// new connection.
+func sqlitePragmaParams(name, value string) string {
+	return "_pragma=" + name + "(" + strings.ToUpper(value) + ")"
+}
+
+// sqliteBackup copies the database to the file at path. Online backup API
+// is not exposed by modernc.org/sqlite via database/sql, VACUUM INTO is used
+// instead. It also produces a consistent snapshot without stopping
+// the server.
+func sqliteBackup(ctx context.Context, db *sql.DB, path string) error {
+	_, err := db.ExecContext(ctx, `VACUUM INTO ?`, path)
+	return err
+}
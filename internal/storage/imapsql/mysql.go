@@ -0,0 +1,70 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlDSN adjusts the MySQL DSN for use with the storage.
+//
+// Timestamps are scanned into time.Time so parseTime is always enabled.
+// Unless overridden by the user, the connection charset is set to utf8mb4 to
+// allow arbitrary Unicode in mailbox names and transactions use READ
+// COMMITTED isolation level. The InnoDB default (REPEATABLE READ) uses gap
+// locks which causes spurious deadlocks on concurrent deliveries to the
+// same mailbox and makes UID assignment behave differently from PostgreSQL.
+func mysqlDSN(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", fmt.Errorf("imapsql: malformed MySQL DSN: %w", err)
+	}
+
+	cfg.ParseTime = true
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	if _, ok := cfg.Params["charset"]; !ok && !hasDSNParam(dsn, "collation") {
+		cfg.Collation = "utf8mb4_unicode_ci"
+	}
+	if _, ok := cfg.Params["transaction_isolation"]; !ok {
+		cfg.Params["transaction_isolation"] = "'READ-COMMITTED'"
+	}
+
+	return cfg.FormatDSN(), nil
+}
+
+// hasDSNParam checks whether the parameter is set explicitly in the DSN.
+// ParseDSN fills in the default collation so it cannot be used for that.
+func hasDSNParam(dsn, name string) bool {
+	idx := strings.LastIndex(dsn, "?")
+	if idx == -1 {
+		return false
+	}
+	params, err := url.ParseQuery(dsn[idx+1:])
+	if err != nil {
+		return false
+	}
+	_, ok := params[name]
+	return ok
+}
@@ -0,0 +1,76 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestMySQLDSN(t *testing.T) {
+	dsn, err := mysqlDSN("maddy:secret@tcp(db.example.org:3306)/maddy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.ParseTime {
+		t.Error("parseTime is not enabled")
+	}
+	if cfg.Collation != "utf8mb4_unicode_ci" {
+		t.Error("Wrong collation:", cfg.Collation)
+	}
+	if v := cfg.Params["transaction_isolation"]; v != "'READ-COMMITTED'" {
+		t.Error("Wrong transaction_isolation:", v)
+	}
+	if cfg.User != "maddy" || cfg.Passwd != "secret" || cfg.Addr != "db.example.org:3306" || cfg.DBName != "maddy" {
+		t.Error("Connection parameters are not preserved:", dsn)
+	}
+
+	dsn, err = mysqlDSN("maddy@unix(/run/mysqld/mysqld.sock)/maddy?transaction_isolation=%27SERIALIZABLE%27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cfg.Params["transaction_isolation"]; v != "'SERIALIZABLE'" {
+		t.Error("User-specified transaction_isolation is overridden:", v)
+	}
+
+	dsn, err = mysqlDSN("maddy@tcp(db.example.org)/maddy?collation=utf8mb4_bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Collation != "utf8mb4_bin" {
+		t.Error("User-specified collation is overridden:", cfg.Collation)
+	}
+
+	if _, err := mysqlDSN("not a dsn"); err == nil {
+		t.Error("Expected an error for malformed DSN")
+	}
+}
@@ -21,4 +21,18 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package imapsql
 
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
 const sqliteImpl = "missing"
+
+func sqlitePragmaParams(name, value string) string {
+	return ""
+}
+
+func sqliteBackup(ctx context.Context, db *sql.DB, path string) error {
+	return errors.New("SQLite is not supported")
+}
@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+type specialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+// specialMailboxes returns names of mailboxes created for new accounts along
+// with their SPECIAL-USE attributes.
+func (store *Storage) specialMailboxes() [][2]string {
+	var mboxes [][2]string
+	for _, mbox := range [][2]string{
+		{store.sentMbox, imap.SentAttr},
+		{store.draftsMbox, imap.DraftsAttr},
+		{store.trashMbox, imap.TrashAttr},
+		{store.junkMbox, imap.JunkAttr},
+		{store.archiveMbox, imap.ArchiveAttr},
+	} {
+		if mbox[0] != "" {
+			mboxes = append(mboxes, mbox)
+		}
+	}
+	return mboxes
+}
+
+// createSpecialMailboxes creates the default set of mailboxes with
+// SPECIAL-USE attributes for the account so clients know where to store sent
+// and deleted messages. Errors are logged and do not prevent access to
+// the account.
+func (store *Storage) createSpecialMailboxes(accountName string, u backend.User) {
+	suu, ok := u.(specialUseUser)
+	if !ok {
+		return
+	}
+	for _, mbox := range store.specialMailboxes() {
+		if err := suu.CreateMailboxSpecial(mbox[0], mbox[1]); err != nil {
+			store.Log.Error("failed to create mailbox", err, "username", accountName, "mailbox", mbox[0])
+		}
+	}
+}
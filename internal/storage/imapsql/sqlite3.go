@@ -21,6 +21,78 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package imapsql
 
-import _ "github.com/mattn/go-sqlite3"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
 
 const sqliteImpl = "cgo"
+
+// sqlitePragmaParams returns DSN parameters that set the PRAGMA for each
+// new connection.
+func sqlitePragmaParams(name, value string) string {
+	return "_" + name + "=" + strings.ToUpper(value)
+}
+
+// sqliteBackupPages is the amount of pages copied at once during backup.
+// The database is locked only while the batch is copied so the server can
+// continue working during the backup.
+const sqliteBackupPages = 1024
+
+// sqliteBackup copies the database to the file at path using the SQLite
+// online backup API.
+func sqliteBackup(ctx context.Context, db *sql.DB, path string) error {
+	destDB, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			dest, ok := destRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("unexpected connection type")
+			}
+			src, ok := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("unexpected connection type")
+			}
+
+			b, err := dest.Backup("main", src, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				if err := ctx.Err(); err != nil {
+					b.Finish()
+					return err
+				}
+				done, err := b.Step(sqliteBackupPages)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+			}
+			return b.Finish()
+		})
+	})
+}
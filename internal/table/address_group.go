@@ -0,0 +1,166 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// AddressGroup is a named set of addresses and domains that can be
+// referenced in pipeline rules as $name and used as a table anywhere.
+//
+// Lookup reports whether the address or domain is a member of the group.
+// An address is a member if it is listed explicitly or its domain is a
+// member, including wildcard matches (*.example.org).
+type AddressGroup struct {
+	modName  string
+	instName string
+
+	entries map[string]struct{}
+	tables  []module.Table
+}
+
+func NewAddressGroup(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	g := &AddressGroup{
+		modName:  modName,
+		instName: instName,
+		entries:  map[string]struct{}{},
+	}
+	if err := g.addEntries(inlineArgs); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *AddressGroup) addEntries(entries []string) error {
+	for _, entry := range entries {
+		var (
+			norm string
+			err  error
+		)
+		switch {
+		case strings.Contains(entry, "@"):
+			norm, err = address.ForLookup(entry)
+		case strings.HasPrefix(entry, "*."):
+			norm, err = dns.ForLookup(entry[2:])
+			norm = "*." + norm
+		default:
+			norm, err = dns.ForLookup(entry)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: invalid entry: %v: %w", g.modName, entry, err)
+		}
+		g.entries[norm] = struct{}{}
+	}
+	return nil
+}
+
+func (g *AddressGroup) Init(cfg *config.Map) error {
+	cfg.Callback("entries", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "expected at least one entry")
+		}
+		if err := g.addEntries(node.Args); err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		return nil
+	})
+	cfg.Callback("table", func(m *config.Map, node config.Node) error {
+		var tbl module.Table
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+			return err
+		}
+		g.tables = append(g.tables, tbl)
+		return nil
+	})
+	_, err := cfg.Process()
+	return err
+}
+
+func (g *AddressGroup) Name() string {
+	return g.modName
+}
+
+func (g *AddressGroup) InstanceName() string {
+	return g.instName
+}
+
+func (g *AddressGroup) has(ctx context.Context, key string) (bool, error) {
+	if _, ok := g.entries[key]; ok {
+		return true, nil
+	}
+	for _, tbl := range g.tables {
+		_, ok, err := tbl.Lookup(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Contains reports whether the address or domain is a member of the group.
+// addr should be normalized using address.ForLookup.
+func (g *AddressGroup) Contains(ctx context.Context, addr string) (bool, error) {
+	ok, err := g.has(ctx, addr)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	domain := addr
+	if strings.Contains(addr, "@") {
+		_, domain, err = address.Split(addr)
+		if err != nil {
+			return false, nil
+		}
+		ok, err = g.has(ctx, domain)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	for _, wildcard := range dns.WildcardMatches(domain) {
+		if _, ok := g.entries[wildcard]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (g *AddressGroup) Lookup(ctx context.Context, key string) (string, bool, error) {
+	ok, err := g.Contains(ctx, key)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return key, true, nil
+}
+
+func init() {
+	module.Register("table.address_group", NewAddressGroup)
+}
@@ -0,0 +1,75 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestAddressGroup(t *testing.T) {
+	mod, err := NewAddressGroup("table.address_group", "staff", nil, []string{"Boss@Example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "entries", Args: []string{"alice@example.org", "staff.example.org"}},
+			{Name: "entries", Args: []string{"*.partners.example.org"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := mod.(*AddressGroup)
+	g.tables = []module.Table{testutils.Table{
+		M: map[string]string{
+			"bob@example.com": "",
+			"example.net":     "",
+		},
+	}}
+
+	test := func(key string, expected bool) {
+		t.Helper()
+		_, ok, err := g.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok != expected {
+			t.Errorf("%s: expected %v, got %v", key, expected, ok)
+		}
+	}
+
+	test("alice@example.org", true)
+	test("boss@example.org", true)
+	test("mallory@example.org", false)
+	test("anyone@staff.example.org", true)
+	test("staff.example.org", true)
+	test("anyone@sub.staff.example.org", false)
+	test("anyone@acme.partners.example.org", true)
+	test("partners.example.org", false)
+	test("bob@example.com", true)
+	test("carol@example.com", false)
+	test("anyone@example.net", true)
+	test("", false)
+}
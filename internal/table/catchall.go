@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package table
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// CatchAll maps any address in the configured (possibly wildcard) domains to
+// a single account.
+type CatchAll struct {
+	modName  string
+	instName string
+
+	entries     map[string]string
+	domainTable module.Table
+}
+
+func NewCatchAll(modName, instName string, _, _ []string) (module.Module, error) {
+	return &CatchAll{
+		modName:  modName,
+		instName: instName,
+		entries:  map[string]string{},
+	}, nil
+}
+
+func (c *CatchAll) Init(cfg *config.Map) error {
+	cfg.Callback("entry", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected exactly two arguments")
+		}
+
+		domain, wildcard := node.Args[0], false
+		if strings.HasPrefix(domain, "*.") {
+			domain, wildcard = domain[2:], true
+		}
+		if !address.ValidDomain(domain) {
+			return config.NodeErr(node, "invalid domain: %s", node.Args[0])
+		}
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return config.NodeErr(node, "invalid domain: %s: %v", node.Args[0], err)
+		}
+		if wildcard {
+			domain = "*." + domain
+		}
+
+		c.entries[domain] = node.Args[1]
+		return nil
+	})
+	modconfig.Table(cfg, "domain_table", false, false, nil, &c.domainTable)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(c.entries) == 0 && c.domainTable == nil {
+		return fmt.Errorf("%s: at least one entry or domain_table is required", c.modName)
+	}
+	return nil
+}
+
+func (c *CatchAll) Name() string {
+	return c.modName
+}
+
+func (c *CatchAll) InstanceName() string {
+	return c.instName
+}
+
+func (c *CatchAll) Lookup(ctx context.Context, key string) (string, bool, error) {
+	_, domain, err := address.Split(key)
+	if err != nil || domain == "" {
+		return "", false, nil
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return "", false, nil
+	}
+
+	// Exact domain first, then wildcards from the most specific one.
+	candidates := append([]string{domain}, dns.WildcardMatches(domain)...)
+	for _, cand := range candidates {
+		if val, ok := c.entries[cand]; ok {
+			return val, true, nil
+		}
+		if c.domainTable == nil {
+			continue
+		}
+		val, ok, err := c.domainTable.Lookup(ctx, cand)
+		if err != nil {
+			return "", false, fmt.Errorf("%s: domain_table lookup: %w", c.modName, err)
+		}
+		if ok {
+			return val, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func init() {
+	module.Register("table.catchall", NewCatchAll)
+}
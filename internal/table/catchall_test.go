@@ -0,0 +1,81 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package table
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCatchAll(t *testing.T) {
+	mod, err := NewCatchAll("table.catchall", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "entry", Args: []string{"example.org", "postmaster@example.org"}},
+			{Name: "entry", Args: []string{"*.customers.example.org", "customers@example.org"}},
+			{Name: "entry", Args: []string{"*.VIP.customers.example.org", "vip@example.org"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*CatchAll)
+	c.domainTable = testutils.Table{
+		M: map[string]string{
+			"acme.customers.example.org": "acme@example.org",
+		},
+	}
+
+	test := func(key, expected string) {
+		t.Helper()
+		val, ok, err := c.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected == "" {
+			if ok {
+				t.Errorf("expected no match for %s, got %s", key, val)
+			}
+			return
+		}
+		if !ok {
+			t.Errorf("expected %s for %s, got no match", expected, key)
+			return
+		}
+		if val != expected {
+			t.Errorf("expected %s for %s, got %s", expected, key, val)
+		}
+	}
+
+	test("anything@example.org", "postmaster@example.org")
+	test("anything@EXAMPLE.org", "postmaster@example.org")
+	test("anything@sub.example.org", "")
+	test("anything@foo.customers.example.org", "customers@example.org")
+	test("anything@a.b.customers.example.org", "customers@example.org")
+	test("anything@a.vip.customers.example.org", "vip@example.org")
+	test("anything@acme.customers.example.org", "acme@example.org")
+	test("anything@customers.example.org", "")
+	test("anything@example.com", "")
+	test("postmaster", "")
+}
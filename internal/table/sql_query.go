@@ -23,9 +23,11 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 )
 
@@ -33,7 +35,8 @@ type SQL struct {
 	modName  string
 	instName string
 
-	namedArgs bool
+	namedArgs    bool
+	queryTimeout time.Duration
 
 	db     *sql.DB
 	lookup *sql.Stmt
@@ -74,6 +77,7 @@ func (s *SQL) Init(cfg *config.Map) error {
 	cfg.String("driver", false, true, "", &driver)
 	cfg.StringList("dsn", false, true, nil, &dsnParts)
 	cfg.Bool("named_args", false, false, &s.namedArgs)
+	cfg.Duration("query_timeout", true, false, 30*time.Second, &s.queryTimeout)
 
 	cfg.String("lookup", false, true, "", &lookupQuery)
 
@@ -88,6 +92,9 @@ func (s *SQL) Init(cfg *config.Map) error {
 	if driver == "postgres" && s.namedArgs {
 		return config.NodeErr(cfg.Block, "PostgreSQL driver does not support named_args")
 	}
+	if driver == "mysql" && s.namedArgs {
+		return config.NodeErr(cfg.Block, "MySQL driver does not support named_args")
+	}
 
 	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
 	if err != nil {
@@ -138,11 +145,21 @@ func (s *SQL) Close() error {
 	return s.db.Close()
 }
 
+// queryCtx returns the context bounded by query_timeout.
+func (s *SQL) queryCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
 func (s *SQL) Lookup(ctx context.Context, val string) (string, bool, error) {
 	var (
 		repl string
 		row  *sql.Row
 	)
+	ctx, cancel := s.queryCtx(ctx)
+	defer cancel()
 	if s.namedArgs {
 		row = s.lookup.QueryRowContext(ctx, sql.Named("key", val))
 	} else {
@@ -163,6 +180,8 @@ func (s *SQL) LookupMulti(ctx context.Context, val string) ([]string, error) {
 		rows *sql.Rows
 		err  error
 	)
+	ctx, cancel := s.queryCtx(ctx)
+	defer cancel()
 	if s.namedArgs {
 		rows, err = s.lookup.QueryContext(ctx, sql.Named("key", val))
 	} else {
@@ -189,7 +208,9 @@ func (s *SQL) Keys() ([]string, error) {
 		return nil, fmt.Errorf("%s: table is not mutable (no 'list' query)", s.modName)
 	}
 
-	rows, err := s.list.Query()
+	ctx, cancel := s.queryCtx(context.Background())
+	defer cancel()
+	rows, err := s.list.QueryContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("%s: list: %w", s.modName, err)
 	}
@@ -210,11 +231,14 @@ func (s *SQL) RemoveKey(k string) error {
 		return fmt.Errorf("%s: table is not mutable (no 'del' query)", s.modName)
 	}
 
+	ctx, cancel := s.queryCtx(context.Background())
+	defer cancel()
+
 	var err error
 	if s.namedArgs {
-		_, err = s.del.Exec(sql.Named("key", k))
+		_, err = s.del.ExecContext(ctx, sql.Named("key", k))
 	} else {
-		_, err = s.del.Exec(k)
+		_, err = s.del.ExecContext(ctx, k)
 	}
 	if err != nil {
 		return fmt.Errorf("%s: del %s: %w", s.modName, k, err)
@@ -237,8 +261,11 @@ func (s *SQL) SetKey(k, v string) error {
 		args = []interface{}{k, v}
 	}
 
-	if _, err := s.add.Exec(args...); err != nil {
-		if _, err := s.set.Exec(args...); err != nil {
+	ctx, cancel := s.queryCtx(context.Background())
+	defer cancel()
+
+	if _, err := s.add.ExecContext(ctx, args...); err != nil {
+		if _, err := s.set.ExecContext(ctx, args...); err != nil {
 			return fmt.Errorf("%s: add %s: %w", s.modName, k, err)
 		}
 		return nil
@@ -73,31 +73,7 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 
 	// sql_table module literally wraps the sql_query module by generating a
 	// configuration block for it.
-
-	var (
-		useNamedArgs string
-
-		lookupQuery string
-		addQuery    string
-		listQuery   string
-		setQuery    string
-		delQuery    string
-	)
-	if driver == "sqlite3" {
-		useNamedArgs = "yes"
-		lookupQuery = fmt.Sprintf("SELECT %s FROM %s WHERE %s = :key", valueColumn, tableName, keyColumn)
-		addQuery = fmt.Sprintf("INSERT INTO %s(%s, %s) VALUES(:key, :value)", tableName, keyColumn, valueColumn)
-		listQuery = fmt.Sprintf("SELECT %s from %s", keyColumn, tableName)
-		setQuery = fmt.Sprintf("UPDATE %s SET %s = :value WHERE %s = :key", tableName, valueColumn, keyColumn)
-		delQuery = fmt.Sprintf("DELETE FROM %s WHERE %s = :key", tableName, keyColumn)
-	} else {
-		useNamedArgs = "no"
-		lookupQuery = fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", valueColumn, tableName, keyColumn)
-		addQuery = fmt.Sprintf("INSERT INTO %s(%s, %s) VALUES($1, $2)", tableName, keyColumn, valueColumn)
-		listQuery = fmt.Sprintf("SELECT %s from %s", keyColumn, tableName)
-		setQuery = fmt.Sprintf("UPDATE %s SET %s = $2 WHERE %s = $1", tableName, valueColumn, keyColumn)
-		delQuery = fmt.Sprintf("DELETE FROM %s WHERE %s = $1", tableName, keyColumn)
-	}
+	q := sqlTableQueries(driver, tableName, keyColumn, valueColumn)
 
 	return s.wrapped.Init(config.NewMap(cfg.Globals, config.Node{
 		Children: []config.Node{
@@ -111,39 +87,101 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 			},
 			{
 				Name: "named_args",
-				Args: []string{useNamedArgs},
+				Args: []string{q.namedArgs},
 			},
 			{
 				Name: "lookup",
-				Args: []string{lookupQuery},
+				Args: []string{q.lookup},
 			},
 			{
 				Name: "add",
-				Args: []string{addQuery},
+				Args: []string{q.add},
 			},
 			{
 				Name: "list",
-				Args: []string{listQuery},
+				Args: []string{q.list},
 			},
 			{
 				Name: "set",
-				Args: []string{setQuery},
+				Args: []string{q.set},
 			},
 			{
 				Name: "del",
-				Args: []string{delQuery},
+				Args: []string{q.del},
 			},
 			{
 				Name: "init",
-				Args: []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
-					%s TEXT PRIMARY KEY NOT NULL,
-					%s TEXT NOT NULL
-				)`, tableName, keyColumn, valueColumn)},
+				Args: []string{q.init},
 			},
 		},
 	}))
 }
 
+type sqlTableQuerySet struct {
+	namedArgs string
+
+	init   string
+	lookup string
+	add    string
+	list   string
+	set    string
+	del    string
+}
+
+// sqlTableQueries generates queries for the key-value table in the dialect
+// of the driver.
+func sqlTableQueries(driver, tableName, keyColumn, valueColumn string) sqlTableQuerySet {
+	switch driver {
+	case "sqlite3":
+		return sqlTableQuerySet{
+			namedArgs: "yes",
+			init: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+				%s TEXT PRIMARY KEY NOT NULL,
+				%s TEXT NOT NULL
+			)`, tableName, keyColumn, valueColumn),
+			lookup: fmt.Sprintf("SELECT %s FROM %s WHERE %s = :key", valueColumn, tableName, keyColumn),
+			add:    fmt.Sprintf("INSERT INTO %s(%s, %s) VALUES(:key, :value)", tableName, keyColumn, valueColumn),
+			list:   fmt.Sprintf("SELECT %s from %s", keyColumn, tableName),
+			set:    fmt.Sprintf("UPDATE %s SET %s = :value WHERE %s = :key", tableName, valueColumn, keyColumn),
+			del:    fmt.Sprintf("DELETE FROM %s WHERE %s = :key", tableName, keyColumn),
+		}
+	case "mysql":
+		// MySQL driver supports only positional '?' parameters, so 'set'
+		// is an upsert that takes the key first, like 'add'. Identifiers are
+		// quoted since the default column name 'key' is a reserved word.
+		// TEXT columns can't be primary keys without the prefix length.
+		tableName = "`" + tableName + "`"
+		keyColumn = "`" + keyColumn + "`"
+		valueColumn = "`" + valueColumn + "`"
+		return sqlTableQuerySet{
+			namedArgs: "no",
+			init: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+				%s VARCHAR(255) PRIMARY KEY NOT NULL,
+				%s TEXT NOT NULL
+			) DEFAULT CHARSET=utf8mb4`, tableName, keyColumn, valueColumn),
+			lookup: fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", valueColumn, tableName, keyColumn),
+			add:    fmt.Sprintf("INSERT INTO %s(%s, %s) VALUES(?, ?)", tableName, keyColumn, valueColumn),
+			list:   fmt.Sprintf("SELECT %s from %s", keyColumn, tableName),
+			set: fmt.Sprintf("INSERT INTO %s(%s, %s) VALUES(?, ?) ON DUPLICATE KEY UPDATE %s = VALUES(%s)",
+				tableName, keyColumn, valueColumn, valueColumn, valueColumn),
+			del: fmt.Sprintf("DELETE FROM %s WHERE %s = ?", tableName, keyColumn),
+		}
+	default:
+		return sqlTableQuerySet{
+			namedArgs: "no",
+			init: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+				%s TEXT PRIMARY KEY NOT NULL,
+				%s TEXT NOT NULL
+			)`, tableName, keyColumn, valueColumn),
+			lookup: fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", valueColumn, tableName, keyColumn),
+			add:    fmt.Sprintf("INSERT INTO %s(%s, %s) VALUES($1, $2)", tableName, keyColumn, valueColumn),
+			list:   fmt.Sprintf("SELECT %s from %s", keyColumn, tableName),
+			set:    fmt.Sprintf("UPDATE %s SET %s = $2 WHERE %s = $1", tableName, valueColumn, keyColumn),
+			del:    fmt.Sprintf("DELETE FROM %s WHERE %s = $1", tableName, keyColumn),
+		}
+	}
+}
+
 func (s *SQLTable) Close() error {
 	return s.wrapped.Close()
 }
@@ -0,0 +1,51 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSQLTableQueries_MySQL(t *testing.T) {
+	q := sqlTableQueries("mysql", "passwords", "key", "value")
+
+	if q.namedArgs != "no" {
+		t.Error("named_args should be disabled for MySQL")
+	}
+	for name, query := range map[string]string{
+		"lookup": q.lookup, "add": q.add, "set": q.set, "del": q.del,
+	} {
+		if strings.Contains(query, "$") || strings.Contains(query, ":key") {
+			t.Errorf("%s query uses placeholders not supported by MySQL: %s", name, query)
+		}
+		if !strings.Contains(query, "`key`") {
+			t.Errorf("%s query does not quote the key column: %s", name, query)
+		}
+	}
+	if strings.Contains(q.init, "TEXT PRIMARY KEY") {
+		t.Error("TEXT column cannot be a primary key in MySQL:", q.init)
+	}
+
+	// SetKey passes the key first, so 'set' should bind it before the value.
+	want := "INSERT INTO `passwords`(`key`, `value`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)"
+	if q.set != want {
+		t.Errorf("Wrong set query:\n%s\nwant:\n%s", q.set, want)
+	}
+}
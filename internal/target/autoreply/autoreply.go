@@ -0,0 +1,479 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package autoreply implements the target.autoreply module that handles
+// messages for decommissioned addresses by either rejecting them with a
+// custom message or accepting them and replying to the sender.
+package autoreply
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const modName = "target.autoreply"
+
+const (
+	modeReply  = "reply"
+	modeReject = "reject"
+)
+
+var repliesCnt = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "autoreply",
+		Name:      "replies",
+		Help:      "Automatic replies by result (sent, suppressed, rate_limited, failed)",
+	},
+	[]string{"module", "result"},
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	mode      string
+	movedTo   module.Table
+	rejectMsg string
+	replyText string
+	subject   string
+	interval  time.Duration
+	target    module.DeliveryTarget
+	store     store
+
+	stopExpire chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName:   instName,
+		log:        log.Logger{Name: modName},
+		stopExpire: make(chan struct{}),
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var (
+		tbl           module.Table
+		replyTextPath string
+	)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Enum("mode", false, false, []string{modeReply, modeReject}, modeReply, &t.mode)
+	cfg.Custom("moved_to", false, false, nil, modconfig.TableDirective, &t.movedTo)
+	cfg.String("reject_message", false, false, "", &t.rejectMsg)
+	cfg.String("reply_text", false, false, "", &replyTextPath)
+	cfg.String("subject", false, false, "Auto: {subject}", &t.subject)
+	cfg.Duration("interval", false, false, 7*24*time.Hour, &t.interval)
+	cfg.Custom("table", false, false, nil, modconfig.TableDirective, &tbl)
+	cfg.Custom("target", false, false, nil, modconfig.DeliveryDirective, &t.target)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.mode == modeReject {
+		return nil
+	}
+
+	if t.target == nil {
+		return fmt.Errorf("%s: target is required for mode %s", modName, modeReply)
+	}
+	if t.interval <= 0 {
+		return fmt.Errorf("%s: interval should be positive", modName)
+	}
+	if replyTextPath != "" {
+		if !filepath.IsAbs(replyTextPath) {
+			replyTextPath = filepath.Join(config.StateDirectory, replyTextPath)
+		}
+		text, err := os.ReadFile(replyTextPath)
+		if err != nil {
+			return fmt.Errorf("%s: reply_text: %w", modName, err)
+		}
+		t.replyText = string(text)
+	}
+
+	if tbl != nil {
+		mtbl, ok := tbl.(module.MutableTable)
+		if !ok {
+			return fmt.Errorf("%s: table should be mutable", modName)
+		}
+		t.store = tableStore{tbl: mtbl}
+	} else {
+		t.store = newMemoryStore()
+	}
+
+	if !module.NoRun {
+		go t.expireLoop()
+	}
+
+	return nil
+}
+
+func (t *Target) expireLoop() {
+	interval := t.interval / 4
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.store.expire(time.Now().Add(-t.interval)); err != nil {
+				t.log.Error("failed to remove expired entries", err)
+			}
+		case <-t.stopExpire:
+			return
+		}
+	}
+}
+
+func (t *Target) Close() error {
+	close(t.stopExpire)
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+// newAddress returns the new address of the recipient from the moved_to
+// table or an empty string if it is not known.
+func (t *Target) newAddress(ctx context.Context, rcpt string) (string, error) {
+	if t.movedTo == nil {
+		return "", nil
+	}
+	key, err := address.ForLookup(rcpt)
+	if err != nil {
+		return "", nil
+	}
+	val, ok, err := t.movedTo.Lookup(ctx, key)
+	if err != nil || !ok {
+		return "", err
+	}
+	return val, nil
+}
+
+type delivery struct {
+	t        *Target
+	mailFrom string
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+
+	rcpts   []string
+	replies []reply
+}
+
+type reply struct {
+	key    string
+	header textproto.Header
+	body   []byte
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	if d.t.mode == modeReply {
+		d.rcpts = append(d.rcpts, rcptTo)
+		return nil
+	}
+
+	newAddr, err := d.t.newAddress(ctx, rcptTo)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"target": modName})
+	}
+
+	msg := d.t.rejectMsg
+	switch {
+	case msg != "":
+		msg = strings.TrimSpace(expand(msg, rcptTo, d.mailFrom, newAddr, ""))
+	case newAddr != "":
+		msg = "User has moved, please try <" + newAddr + ">"
+	default:
+		msg = "Mailbox is no longer in use"
+	}
+
+	// 551 is "User not local; please try <forward-path>", RFC 5321.
+	code := 550
+	if newAddr != "" {
+		code = 551
+	}
+	return &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 6},
+		Message:      msg,
+		TargetName:   modName,
+		Misc: map[string]interface{}{
+			"rcpt": rcptTo,
+		},
+	}
+}
+
+func expand(tmpl, rcpt, sender, newAddr, subject string) string {
+	return strings.NewReplacer(
+		"{rcpt}", rcpt,
+		"{sender}", sender,
+		"{moved_to}", newAddr,
+		"{subject}", subject,
+	).Replace(tmpl)
+}
+
+// Local-parts of addresses used by mailing lists and automated systems,
+// see RFC 3834, Section 2.
+var (
+	autoSenderNames    = []string{"mailer-daemon", "postmaster", "listserv", "majordomo", "noreply", "no-reply", "do-not-reply", "donotreply"}
+	autoSenderPrefixes = []string{"owner-"}
+	autoSenderSuffixes = []string{"-request", "-owner", "-bounces"}
+)
+
+// suppressReason returns the reason to not send an automatic reply to the
+// message or an empty string if a reply can be sent.
+func suppressReason(mailFrom string, header textproto.Header) string {
+	if mailFrom == "" {
+		return "null sender"
+	}
+	mbox, _, err := address.Split(mailFrom)
+	if err != nil || mbox == "" {
+		return "malformed sender"
+	}
+	mbox = strings.ToLower(mbox)
+	for _, name := range autoSenderNames {
+		if mbox == name {
+			return "automated sender"
+		}
+	}
+	for _, prefix := range autoSenderPrefixes {
+		if strings.HasPrefix(mbox, prefix) {
+			return "automated sender"
+		}
+	}
+	for _, suffix := range autoSenderSuffixes {
+		if strings.HasSuffix(mbox, suffix) {
+			return "automated sender"
+		}
+	}
+
+	if v := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return "Auto-Submitted"
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "Precedence"
+	}
+	if header.Has("List-Id") || header.Has("List-Unsubscribe") {
+		return "mailing list"
+	}
+	// Set by Microsoft Exchange and Outlook.
+	for _, v := range strings.Split(header.Get("X-Auto-Response-Suppress"), ",") {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "all", "oof", "autoreply":
+			return "X-Auto-Response-Suppress"
+		}
+	}
+	return ""
+}
+
+func replyKey(rcpt, sender string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(rcpt) + "\x00" + strings.ToLower(sender)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if reason := suppressReason(d.mailFrom, header); reason != "" {
+		repliesCnt.WithLabelValues(d.t.instName, "suppressed").Add(float64(len(d.rcpts)))
+		d.log.Msg("not replying", "reason", reason, "rcpts", d.rcpts)
+		return nil
+	}
+
+	notBefore := time.Now().Add(-d.t.interval)
+	for _, rcpt := range d.rcpts {
+		key := replyKey(rcpt, d.mailFrom)
+		ts, ok, err := d.t.store.lookup(ctx, key)
+		if err != nil {
+			// Not replying is better than replying to every message
+			// if the store is broken.
+			d.log.Error("lookup failed, not replying", err, "rcpt", rcpt)
+			continue
+		}
+		if ok && !ts.Before(notBefore) {
+			repliesCnt.WithLabelValues(d.t.instName, "rate_limited").Inc()
+			d.log.DebugMsg("already replied recently", "rcpt", rcpt, "last_reply", ts)
+			continue
+		}
+
+		newAddr, err := d.t.newAddress(ctx, rcpt)
+		if err != nil {
+			return exterrors.WithFields(err, map[string]interface{}{"target": modName})
+		}
+		replyHdr, replyBody, err := d.t.buildReply(rcpt, d.mailFrom, newAddr, header)
+		if err != nil {
+			return exterrors.WithFields(err, map[string]interface{}{"target": modName})
+		}
+		d.replies = append(d.replies, reply{key: key, header: replyHdr, body: replyBody})
+	}
+	return nil
+}
+
+// buildReply generates the reply message following RFC 3834
+// recommendations.
+func (t *Target) buildReply(rcpt, sender, newAddr string, header textproto.Header) (textproto.Header, []byte, error) {
+	_, domain, err := address.Split(rcpt)
+	if err != nil || domain == "" {
+		return textproto.Header{}, nil, fmt.Errorf("malformed recipient address: %s", rcpt)
+	}
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	origSubject := strings.TrimSpace(header.Get("Subject"))
+	h := message.Header{Header: header}
+	if decoded, err := h.Text("Subject"); err == nil {
+		origSubject = strings.TrimSpace(decoded)
+	}
+
+	text := t.replyText
+	if text == "" {
+		text = "This is an automatic reply.\n\nThe address {rcpt} is no longer in use, your message was not delivered.\n"
+		if newAddr != "" {
+			text += "Please use {moved_to} instead.\n"
+		}
+	}
+	text = expand(text, rcpt, sender, newAddr, origSubject)
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+
+	subject := strings.TrimSpace(expand(t.subject, rcpt, sender, newAddr, origSubject))
+	subject = strings.NewReplacer("\r", "", "\n", "").Replace(subject)
+
+	var replyHdr textproto.Header
+	replyHdr.Add("Content-Transfer-Encoding", "8bit")
+	replyHdr.Add("Content-Type", "text/plain; charset=utf-8")
+	replyHdr.Add("MIME-Version", "1.0")
+	if origID := strings.TrimSpace(header.Get("Message-Id")); origID != "" {
+		refs := strings.TrimSpace(header.Get("References"))
+		if refs != "" {
+			refs += " "
+		}
+		replyHdr.Add("References", target.SanitizeForHeader(refs+origID))
+		replyHdr.Add("In-Reply-To", target.SanitizeForHeader(origID))
+	}
+	replyHdr.Add("Auto-Submitted", "auto-replied")
+	replyHdr.Add("Subject", mime.QEncoding.Encode("utf-8", subject))
+	replyHdr.Add("Message-Id", "<"+msgID+"@"+domain+">")
+	replyHdr.Add("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	replyHdr.Add("To", "<"+target.SanitizeForHeader(sender)+">")
+	replyHdr.Add("From", "<"+target.SanitizeForHeader(rcpt)+">")
+
+	return replyHdr, []byte(text), nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	d.replies = nil
+	return nil
+}
+
+// Commit sends the prepared replies. Failures are logged and do not affect
+// the original message.
+func (d *delivery) Commit(ctx context.Context) error {
+	for _, r := range d.replies {
+		if err := d.sendReply(ctx, r); err != nil {
+			repliesCnt.WithLabelValues(d.t.instName, "failed").Inc()
+			d.log.Error("failed to send the reply", err, "rcpt", r.header.Get("From"))
+			continue
+		}
+		repliesCnt.WithLabelValues(d.t.instName, "sent").Inc()
+		if err := d.t.store.record(ctx, r.key, time.Now()); err != nil {
+			d.log.Error("failed to record the reply", err)
+		}
+	}
+	return nil
+}
+
+func (d *delivery) sendReply(ctx context.Context, r reply) error {
+	replyID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	replyMeta := &module.MsgMetadata{
+		ID: replyID,
+		SMTPOpts: smtp.MailOptions{
+			UTF8: d.msgMeta.SMTPOpts.UTF8,
+		},
+	}
+
+	// Null return-path prevents the reply from being replied to or bounced
+	// back, RFC 3834 Section 3.3.
+	delivery, err := d.t.target.Start(ctx, replyMeta, "")
+	if err != nil {
+		return err
+	}
+	err = delivery.AddRcpt(ctx, d.mailFrom, smtp.RcptOptions{})
+	if err == nil {
+		err = delivery.Body(ctx, r.header, buffer.MemoryBuffer{Slice: r.body})
+	}
+	if err == nil {
+		err = delivery.Commit(ctx)
+	}
+	if err != nil {
+		if abortErr := delivery.Abort(ctx); abortErr != nil {
+			d.log.Error("failed to abort the reply delivery", abortErr)
+		}
+		return err
+	}
+	d.log.Msg("automatic reply sent", "rcpt", r.header.Get("From"), "reply_id", replyID)
+	return nil
+}
+
+func init() {
+	prometheus.MustRegister(repliesCnt)
+	module.Register(modName, New)
+}
@@ -0,0 +1,169 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoreply
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testAutoreply(t *testing.T, mode string, tgt module.DeliveryTarget) *Target {
+	return &Target{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		mode:     mode,
+		movedTo: testutils.Table{M: map[string]string{
+			"old@example.org": "new@example.com",
+		}},
+		subject:  "Auto: {subject}",
+		interval: time.Hour,
+		target:   tgt,
+		store:    newMemoryStore(),
+	}
+}
+
+func deliver(t *testing.T, a *Target, sender string, hdr textproto.Header, rcpts ...string) error {
+	t.Helper()
+	ctx := context.Background()
+
+	delivery, err := a.Start(ctx, &module.MsgMetadata{ID: "test"}, sender)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			delivery.Abort(ctx)
+			return err
+		}
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func TestAutoreply_Reply(t *testing.T) {
+	tgt := testutils.Target{}
+	a := testAutoreply(t, modeReply, &tgt)
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Question")
+	hdr.Add("Message-Id", "<1@example.net>")
+	if err := deliver(t, a, "sender@example.net", hdr, "old@example.org", "other@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("expected 2 replies, got %d", len(tgt.Messages))
+	}
+
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "" {
+		t.Errorf("reply should use the null sender, got %q", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "sender@example.net" {
+		t.Errorf("wrong reply recipients: %v", msg.RcptTo)
+	}
+	if v := msg.Header.Get("Auto-Submitted"); v != "auto-replied" {
+		t.Errorf("wrong Auto-Submitted: %q", v)
+	}
+	if v := msg.Header.Get("In-Reply-To"); v != "<1@example.net>" {
+		t.Errorf("wrong In-Reply-To: %q", v)
+	}
+	if v := msg.Header.Get("Subject"); v != "Auto: Question" {
+		t.Errorf("wrong Subject: %q", v)
+	}
+	if v := msg.Header.Get("From"); v != "<old@example.org>" {
+		t.Errorf("wrong From: %q", v)
+	}
+	if !strings.Contains(string(msg.Body), "Please use new@example.com instead.\r\n") {
+		t.Errorf("new address is missing from the reply: %q", msg.Body)
+	}
+	if strings.Contains(string(tgt.Messages[1].Body), "Please use") {
+		t.Errorf("unexpected new address in the reply: %q", tgt.Messages[1].Body)
+	}
+
+	// Second message from the same sender is not replied to.
+	if err := deliver(t, a, "sender@example.net", hdr, "old@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("expected no new replies, got %d", len(tgt.Messages)-2)
+	}
+
+	// But a different sender gets one.
+	if err := deliver(t, a, "another@example.net", hdr, "old@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 3 {
+		t.Fatalf("expected a new reply, got %d", len(tgt.Messages)-2)
+	}
+}
+
+func TestAutoreply_Reject(t *testing.T) {
+	a := testAutoreply(t, modeReject, nil)
+
+	err := deliver(t, a, "sender@example.net", textproto.Header{}, "old@example.org")
+	testutils.CheckSMTPErr(t, err, 551, exterrors.EnhancedCode{5, 1, 6}, "User has moved, please try <new@example.com>")
+
+	err = deliver(t, a, "sender@example.net", textproto.Header{}, "gone@example.org")
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 6}, "Mailbox is no longer in use")
+
+	a.rejectMsg = "{rcpt} is gone, write to {moved_to}"
+	err = deliver(t, a, "sender@example.net", textproto.Header{}, "old@example.org")
+	testutils.CheckSMTPErr(t, err, 551, exterrors.EnhancedCode{5, 1, 6}, "old@example.org is gone, write to new@example.com")
+}
+
+func TestSuppressReason(t *testing.T) {
+	test := func(sender string, fields map[string]string, suppress bool) {
+		t.Helper()
+		hdr := textproto.Header{}
+		for k, v := range fields {
+			hdr.Add(k, v)
+		}
+		reason := suppressReason(sender, hdr)
+		if suppress && reason == "" {
+			t.Errorf("expected %s %v to be suppressed", sender, fields)
+		}
+		if !suppress && reason != "" {
+			t.Errorf("unexpected suppression of %s %v: %s", sender, fields, reason)
+		}
+	}
+
+	test("user@example.org", nil, false)
+	test("", nil, true)
+	test("MAILER-DAEMON@example.org", nil, true)
+	test("owner-list@example.org", nil, true)
+	test("list-request@example.org", nil, true)
+	test("user@example.org", map[string]string{"Auto-Submitted": "no"}, false)
+	test("user@example.org", map[string]string{"Auto-Submitted": "auto-replied"}, true)
+	test("user@example.org", map[string]string{"Precedence": "bulk"}, true)
+	test("user@example.org", map[string]string{"List-Id": "<list.example.org>"}, true)
+	test("user@example.org", map[string]string{"X-Auto-Response-Suppress": "DR, OOF"}, true)
+	test("user@example.org", map[string]string{"X-Auto-Response-Suppress": "DR"}, false)
+}
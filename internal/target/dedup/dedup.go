@@ -0,0 +1,405 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package dedup implements a delivery target wrapper that suppresses
+// duplicate copies of the same message delivered to the same recipient.
+//
+// Copies are considered duplicate if they have the same Message-ID and
+// body. This is common with misconfigured forwarders and SMTP clients that
+// retry the delivery after a timeout while the first attempt succeeded.
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const modName = "target.dedup"
+
+var suppressedCnt = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "dedup",
+		Name:      "suppressed",
+		Help:      "Duplicate copies of messages not delivered to recipients",
+	},
+	[]string{"module"},
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	window time.Duration
+	target module.DeliveryTarget
+	store  store
+
+	stopExpire chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName:   instName,
+		log:        log.Logger{Name: modName},
+		stopExpire: make(chan struct{}),
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var tbl module.Table
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Duration("window", false, false, 24*time.Hour, &t.window)
+	cfg.Custom("table", false, false, nil, modconfig.TableDirective, &tbl)
+	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &t.target)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.window <= 0 {
+		return fmt.Errorf("%s: window should be positive", modName)
+	}
+
+	if tbl != nil {
+		mtbl, ok := tbl.(module.MutableTable)
+		if !ok {
+			return fmt.Errorf("%s: table should be mutable", modName)
+		}
+		t.store = tableStore{tbl: mtbl}
+	} else {
+		t.store = newMemoryStore()
+	}
+
+	if !module.NoRun {
+		go t.expireLoop()
+	}
+
+	return nil
+}
+
+func (t *Target) expireLoop() {
+	interval := t.window / 4
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.store.expire(time.Now().Add(-t.window)); err != nil {
+				t.log.Error("failed to remove expired entries", err)
+			}
+		case <-t.stopExpire:
+			return
+		}
+	}
+}
+
+func (t *Target) Close() error {
+	close(t.stopExpire)
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+type rcptEntry struct {
+	addr string
+	opts smtp.RcptOptions
+}
+
+type delivery struct {
+	t        *Target
+	mailFrom string
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+
+	rcpts []rcptEntry
+	inner module.Delivery
+
+	// Keys to record for recipients the message is delivered to, once
+	// the delivery is committed.
+	pending []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	inner, err := t.target.Start(ctx, msgMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		inner:    inner,
+	}, nil
+}
+
+// AddRcpt passes the recipient to the wrapped target right away, so
+// recipients it can not accept are rejected before the message body is
+// received.
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, opts smtp.RcptOptions) error {
+	if err := d.inner.AddRcpt(ctx, rcptTo, opts); err != nil {
+		return err
+	}
+	d.rcpts = append(d.rcpts, rcptEntry{addr: rcptTo, opts: opts})
+	return nil
+}
+
+// messageKey returns the string identifying the message contents or an empty
+// string if the message has no Message-ID.
+func messageKey(header textproto.Header, body buffer.Buffer) (string, error) {
+	msgID := strings.TrimSpace(header.Get("Message-Id"))
+	if msgID == "" {
+		return "", nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	h.Write([]byte(msgID))
+	h.Write([]byte{0})
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func rcptKey(msgKey, rcpt string) string {
+	sum := sha256.Sum256([]byte(msgKey + "\x00" + rcpt))
+	return hex.EncodeToString(sum[:])
+}
+
+// findDuplicates returns the set of recipients that already got the message
+// and keys to record for the rest.
+//
+// Lookup failures are logged and the message is delivered to all
+// recipients, since losing a message is worse than delivering it twice.
+func (d *delivery) findDuplicates(ctx context.Context, header textproto.Header, body buffer.Buffer) (map[string]struct{}, map[string]string) {
+	msgKey, err := messageKey(header, body)
+	if err != nil {
+		d.log.Error("failed to hash the message", err)
+		return nil, nil
+	}
+	if msgKey == "" {
+		d.log.Debugln("no Message-ID, not checking for duplicates")
+		return nil, nil
+	}
+
+	dups := make(map[string]struct{})
+	keys := make(map[string]string, len(d.rcpts))
+	notBefore := time.Now().Add(-d.t.window)
+	for _, rcpt := range d.rcpts {
+		key := rcptKey(msgKey, rcpt.addr)
+		keys[rcpt.addr] = key
+
+		ts, ok, err := d.t.store.lookup(ctx, key)
+		if err != nil {
+			d.log.Error("lookup failed, delivering the message", err, "rcpt", rcpt.addr)
+			continue
+		}
+		if !ok || ts.Before(notBefore) {
+			continue
+		}
+
+		dups[rcpt.addr] = struct{}{}
+		suppressedCnt.WithLabelValues(d.t.instName).Inc()
+		d.log.Msg("duplicate message suppressed", "rcpt", rcpt.addr,
+			"message_id", strings.TrimSpace(header.Get("Message-Id")), "first_delivered", ts)
+	}
+
+	return dups, keys
+}
+
+// restart replaces the inner delivery with the one that does not include
+// the duplicate recipients. d.inner is set to nil if all recipients got
+// the message already.
+func (d *delivery) restart(ctx context.Context, dups map[string]struct{}) error {
+	if len(dups) == 0 {
+		return nil
+	}
+
+	if err := d.inner.Abort(ctx); err != nil {
+		d.log.Error("failed to abort the delivery", err)
+	}
+	d.inner = nil
+
+	if len(dups) == len(d.rcpts) {
+		return nil
+	}
+
+	inner, err := d.t.target.Start(ctx, d.msgMeta, d.mailFrom)
+	if err != nil {
+		return err
+	}
+	d.inner = inner
+	for _, rcpt := range d.rcpts {
+		if _, ok := dups[rcpt.addr]; ok {
+			continue
+		}
+		if err := inner.AddRcpt(ctx, rcpt.addr, rcpt.opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	dups, keys := d.findDuplicates(ctx, header, body)
+	if err := d.restart(ctx, dups); err != nil {
+		return d.wrapErr(err)
+	}
+	if d.inner == nil {
+		return nil
+	}
+
+	if err := d.inner.Body(ctx, header, body); err != nil {
+		return d.wrapErr(err)
+	}
+	for _, rcpt := range d.rcpts {
+		if _, ok := dups[rcpt.addr]; !ok && keys[rcpt.addr] != "" {
+			d.pending = append(d.pending, keys[rcpt.addr])
+		}
+	}
+	return nil
+}
+
+type statusCollector struct {
+	module.StatusCollector
+	failed map[string]struct{}
+}
+
+func (c statusCollector) SetStatus(rcptTo string, err error) {
+	if err != nil {
+		c.failed[rcptTo] = struct{}{}
+	}
+	c.StatusCollector.SetStatus(rcptTo, err)
+}
+
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	dups, keys := d.findDuplicates(ctx, header, body)
+	setStatusRest := func(err error) {
+		for _, rcpt := range d.rcpts {
+			if _, ok := dups[rcpt.addr]; !ok {
+				c.SetStatus(rcpt.addr, err)
+			}
+		}
+	}
+
+	for rcpt := range dups {
+		c.SetStatus(rcpt, nil)
+	}
+	if err := d.restart(ctx, dups); err != nil {
+		setStatusRest(d.wrapErr(err))
+		return
+	}
+	if d.inner == nil {
+		return
+	}
+
+	failed := make(map[string]struct{})
+	if partial, ok := d.inner.(module.PartialDelivery); ok {
+		partial.BodyNonAtomic(ctx, statusCollector{StatusCollector: c, failed: failed}, header, body)
+	} else {
+		err := d.wrapErr(d.inner.Body(ctx, header, body))
+		setStatusRest(err)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, rcpt := range d.rcpts {
+		if _, ok := dups[rcpt.addr]; ok {
+			continue
+		}
+		if _, ok := failed[rcpt.addr]; ok {
+			continue
+		}
+		if keys[rcpt.addr] != "" {
+			d.pending = append(d.pending, keys[rcpt.addr])
+		}
+	}
+}
+
+func (d *delivery) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return exterrors.WithFields(err, map[string]interface{}{
+		"target": modName,
+	})
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	if d.inner == nil {
+		return nil
+	}
+	return d.inner.Abort(ctx)
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.inner == nil {
+		return nil
+	}
+	if err := d.inner.Commit(ctx); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range d.pending {
+		if err := d.t.store.record(ctx, key, now); err != nil {
+			d.log.Error("failed to record the delivery", err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	prometheus.MustRegister(suppressedCnt)
+	module.Register(modName, New)
+}
@@ -0,0 +1,158 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dedup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testDedup(t *testing.T, tgt module.DeliveryTarget) *Target {
+	return &Target{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		window:   time.Hour,
+		target:   tgt,
+		store:    newMemoryStore(),
+	}
+}
+
+func deliver(t *testing.T, d *Target, msgID, body string, rcpts ...string) error {
+	t.Helper()
+	ctx := context.Background()
+
+	delivery, err := d.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			delivery.Abort(ctx)
+			return err
+		}
+	}
+
+	hdr := textproto.Header{}
+	if msgID != "" {
+		hdr.Add("Message-Id", msgID)
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte(body)}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func TestDedup(t *testing.T) {
+	tgt := testutils.Target{}
+	d := testDedup(t, &tgt)
+
+	if err := deliver(t, d, "<a@example.org>", "foobar\r\n", "rcpt1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// Same message for rcpt1 and a new recipient.
+	if err := deliver(t, d, "<a@example.org>", "foobar\r\n", "rcpt1@example.org", "rcpt2@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// Fully duplicate.
+	if err := deliver(t, d, "<a@example.org>", "foobar\r\n", "rcpt2@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// Same Message-ID, different body.
+	if err := deliver(t, d, "<a@example.org>", "changed\r\n", "rcpt1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// No Message-ID, never deduplicated.
+	for i := 0; i < 2; i++ {
+		if err := deliver(t, d, "", "foobar\r\n", "rcpt1@example.org"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := [][]string{
+		{"rcpt1@example.org"},
+		{"rcpt2@example.org"},
+		{"rcpt1@example.org"},
+		{"rcpt1@example.org"},
+		{"rcpt1@example.org"},
+	}
+	if len(tgt.Messages) != len(want) {
+		t.Fatalf("wrong amount of messages delivered: %d, want %d", len(tgt.Messages), len(want))
+	}
+	for i, rcpts := range want {
+		got := tgt.Messages[i].RcptTo
+		if len(got) != len(rcpts) || got[0] != rcpts[0] {
+			t.Errorf("message %d: wrong recipients: %v, want %v", i, got, rcpts)
+		}
+	}
+}
+
+func TestDedup_Window(t *testing.T) {
+	tgt := testutils.Target{}
+	d := testDedup(t, &tgt)
+
+	if err := deliver(t, d, "<a@example.org>", "foobar\r\n", "rcpt@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the first copy was delivered long ago.
+	mem := d.store.(*memoryStore)
+	for key := range mem.seen {
+		mem.seen[key] = time.Now().Add(-2 * time.Hour)
+	}
+
+	if err := deliver(t, d, "<a@example.org>", "foobar\r\n", "rcpt@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("copy outside of the window is not delivered")
+	}
+
+	if err := d.store.expire(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(mem.seen) != 1 {
+		t.Errorf("wrong amount of entries after expire: %d", len(mem.seen))
+	}
+}
+
+func TestDedup_FailedNotRecorded(t *testing.T) {
+	tgt := testutils.Target{CommitErr: errors.New("no")}
+	d := testDedup(t, &tgt)
+
+	if err := deliver(t, d, "<a@example.org>", "foobar\r\n", "rcpt@example.org"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	tgt.CommitErr = nil
+	if err := deliver(t, d, "<a@example.org>", "foobar\r\n", "rcpt@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("retry after failed delivery is suppressed")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dedup
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// store keeps track of delivered messages.
+type store interface {
+	lookup(ctx context.Context, key string) (time.Time, bool, error)
+	record(ctx context.Context, key string, ts time.Time) error
+	// expire removes entries recorded before the specified time.
+	expire(before time.Time) error
+}
+
+type memoryStore struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{seen: make(map[string]time.Time)}
+}
+
+func (s *memoryStore) lookup(_ context.Context, key string) (time.Time, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ts, ok := s.seen[key]
+	return ts, ok, nil
+}
+
+func (s *memoryStore) record(_ context.Context, key string, ts time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seen[key] = ts
+	return nil
+}
+
+func (s *memoryStore) expire(before time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, ts := range s.seen {
+		if ts.Before(before) {
+			delete(s.seen, key)
+		}
+	}
+	return nil
+}
+
+// tableStore keeps entries in the mutable table, values are Unix timestamps.
+type tableStore struct {
+	tbl module.MutableTable
+}
+
+func (s tableStore) lookup(ctx context.Context, key string) (time.Time, bool, error) {
+	val, ok, err := s.tbl.Lookup(ctx, key)
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	unix, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		// Treat malformed entries as missing, they are removed by expire.
+		return time.Time{}, false, nil
+	}
+	return time.Unix(unix, 0), true, nil
+}
+
+func (s tableStore) record(_ context.Context, key string, ts time.Time) error {
+	return s.tbl.SetKey(key, strconv.FormatInt(ts.Unix(), 10))
+}
+
+func (s tableStore) expire(before time.Time) error {
+	keys, err := s.tbl.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		ts, ok, err := s.lookup(context.Background(), key)
+		if err != nil {
+			return err
+		}
+		if ok && !ts.Before(before) {
+			continue
+		}
+		if err := s.tbl.RemoveKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
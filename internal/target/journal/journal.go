@@ -0,0 +1,199 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package journal implements a delivery target that passes a copy of each
+// message to another target for archival, recording the envelope information
+// in the message header.
+//
+// It is meant to be used together with the 'deliver_also' pipeline directive
+// for compliance archiving (so-called "envelope journaling").
+package journal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.journal"
+
+const (
+	envelopeFromField = "X-Envelope-From"
+	envelopeToField   = "X-Envelope-To"
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	rcpts  []string
+	sender string
+	target module.DeliveryTarget
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Target{
+		instName: instName,
+		rcpts:    inlineArgs,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var rcpts []string
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.StringList("rcpt", false, false, nil, &rcpts)
+	cfg.String("sender", false, false, "", &t.sender)
+	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &t.target)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	t.rcpts = append(t.rcpts, rcpts...)
+	if len(t.rcpts) == 0 {
+		return fmt.Errorf("%s: at least one journal recipient is required", modName)
+	}
+
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+type delivery struct {
+	t        *Target
+	mailFrom string
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+
+	rcpts []string
+	inner module.Delivery
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+	}, nil
+}
+
+// AddRcpt records the recipient for the envelope header. The journal copy
+// itself is always sent to the configured journal recipients.
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) envelopeHeader(header textproto.Header) textproto.Header {
+	header = header.Copy()
+
+	// Drop any fields set by the sender, archive consumers should be able to
+	// trust these.
+	header.Del(envelopeFromField)
+	header.Del(envelopeToField)
+
+	// Add prepends the field, so go in reverse to keep the original recipient
+	// order.
+	for i := len(d.rcpts) - 1; i >= 0; i-- {
+		rcpt := d.rcpts[i]
+		value := "<" + target.SanitizeForHeader(rcpt) + ">"
+		if original, ok := d.msgMeta.OriginalRcpts[rcpt]; ok && original != rcpt {
+			value += " (original <" + target.SanitizeForHeader(original) + ">)"
+		}
+		header.Add(envelopeToField, value)
+	}
+	header.Add(envelopeFromField, "<"+target.SanitizeForHeader(d.mailFrom)+">")
+
+	return header
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if len(d.rcpts) == 0 {
+		return nil
+	}
+
+	msgMeta := d.msgMeta.DeepCopy()
+	// Use a separate ID so the copy does not clash with the original message
+	// if both are passed to the same queue.
+	msgMeta.ID = d.msgMeta.ID + "-journal"
+
+	sender := d.t.sender
+	if sender == "" {
+		sender = d.mailFrom
+	}
+
+	inner, err := d.t.target.Start(ctx, msgMeta, sender)
+	if err != nil {
+		return d.wrapErr(err)
+	}
+	d.inner = inner
+
+	for _, rcpt := range d.t.rcpts {
+		if err := inner.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			return d.wrapErr(err)
+		}
+	}
+
+	d.log.Debugf("journaling message for %s to %s", strings.Join(d.rcpts, ", "), strings.Join(d.t.rcpts, ", "))
+
+	return d.wrapErr(inner.Body(ctx, d.envelopeHeader(header), body))
+}
+
+func (d *delivery) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return exterrors.WithFields(err, map[string]interface{}{
+		"target": modName,
+	})
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	if d.inner == nil {
+		return nil
+	}
+	return d.inner.Abort(ctx)
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.inner == nil {
+		return nil
+	}
+	return d.inner.Commit(ctx)
+}
+
+func init() {
+	module.Register(modName, New)
+}
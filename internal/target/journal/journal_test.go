@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package journal
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestJournal(t *testing.T) {
+	tgt := testutils.Target{}
+	j := &Target{
+		rcpts:  []string{"archive@example.org"},
+		target: &tgt,
+		log:    testutils.Logger(t, modName),
+	}
+
+	id := testutils.DoTestDeliveryMeta(t, j, "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"}, &module.MsgMetadata{
+		OriginalRcpts: map[string]string{"rcpt2@example.com": "alias@example.com"},
+	})
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("wrong amount of messages delivered: %d", len(tgt.Messages))
+	}
+	testutils.CheckMsgID(t, &tgt.Messages[0], "sender@example.org", []string{"archive@example.org"}, id+"-journal")
+
+	hdr := tgt.Messages[0].Header
+	if from := hdr.Get("X-Envelope-From"); from != "<sender@example.org>" {
+		t.Errorf("wrong X-Envelope-From: %q", from)
+	}
+	var to []string
+	for fields := hdr.FieldsByKey("X-Envelope-To"); fields.Next(); {
+		to = append(to, fields.Value())
+	}
+	want := []string{"<rcpt1@example.com>", "<rcpt2@example.com> (original <alias@example.com>)"}
+	if len(to) != len(want) || to[0] != want[0] || to[1] != want[1] {
+		t.Errorf("wrong X-Envelope-To: %q", to)
+	}
+}
+
+func TestJournal_Sender(t *testing.T) {
+	tgt := testutils.Target{}
+	j := &Target{
+		rcpts:  []string{"archive@example.org"},
+		sender: "journal@example.org",
+		target: &tgt,
+		log:    testutils.Logger(t, modName),
+	}
+
+	testutils.DoTestDelivery(t, j, "sender@example.org", []string{"rcpt@example.com"})
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("wrong amount of messages delivered: %d", len(tgt.Messages))
+	}
+	testutils.CheckMsgID(t, &tgt.Messages[0], "journal@example.org", []string{"archive@example.org"}, "")
+}
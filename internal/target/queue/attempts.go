@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// maxAttemptsHistory is the amount of the most recent attempts kept in the
+// meta-data.
+const maxAttemptsHistory = 100
+
+// Attempt describes the result of the delivery attempt for a recipient.
+type Attempt struct {
+	Time time.Time
+	Rcpt string
+
+	// Server the attempt was made to, if known. For messages delivered
+	// via target.remote this is the MX hostname.
+	RemoteServer string `json:",omitempty"`
+
+	Code         int
+	EnhancedCode smtp.EnhancedCode
+	Message      string
+}
+
+func newAttempt(t time.Time, rcpt string, err error) Attempt {
+	if err == nil {
+		return Attempt{
+			Time:         t,
+			Rcpt:         rcpt,
+			Code:         250,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      "OK",
+		}
+	}
+
+	smtpErr := toSMTPErr(err)
+	a := Attempt{
+		Time:         t,
+		Rcpt:         rcpt,
+		Code:         smtpErr.Code,
+		EnhancedCode: smtpErr.EnhancedCode,
+		Message:      smtpErr.Message,
+	}
+	if srv, ok := exterrors.Fields(err)["remote_server"]; ok && srv != nil {
+		a.RemoteServer = fmt.Sprint(srv)
+	}
+	return a
+}
+
+func (meta *QueueMetadata) recordAttempts(attempts []Attempt) {
+	meta.Attempts = append(meta.Attempts, attempts...)
+	if extra := len(meta.Attempts) - maxAttemptsHistory; extra > 0 {
+		meta.Attempts = append([]Attempt(nil), meta.Attempts[extra:]...)
+	}
+}
+
+type attemptEvent struct {
+	Event    string    `json:"event"`
+	Queue    string    `json:"queue"`
+	MsgID    string    `json:"msg_id"`
+	From     string    `json:"from"`
+	Attempts []Attempt `json:"attempts"`
+	// Recipients that will be tried again.
+	Pending []string `json:"pending"`
+}
+
+// notifyAttempt sends the results of the delivery attempt to the configured
+// webhook, if any. The request is made asynchronously.
+func (q *Queue) notifyAttempt(meta *QueueMetadata, attempts []Attempt, pending []string) {
+	if q.attemptWebhook == "" {
+		return
+	}
+
+	blob, err := json.Marshal(attemptEvent{
+		Event:    "queue.delivery_attempt",
+		Queue:    q.name,
+		MsgID:    meta.MsgMeta.ID,
+		From:     meta.From,
+		Attempts: attempts,
+		Pending:  pending,
+	})
+	if err != nil {
+		q.Log.Error("failed to serialize webhook payload", err)
+		return
+	}
+
+	q.deliveryWg.Add(1)
+	go func() {
+		defer q.deliveryWg.Done()
+
+		ctx, cancel := context.WithTimeout(q.shutdownCtx, 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, q.attemptWebhook, bytes.NewReader(blob))
+		if err != nil {
+			q.Log.Error("failed to create webhook request", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			q.Log.Error("webhook request failed", err, "msg_id", meta.MsgMeta.ID)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			q.Log.Msg("webhook request failed", "status", resp.StatusCode, "msg_id", meta.MsgMeta.ID)
+		}
+	}()
+}
+
+// Entry reads the meta-data of the queued message, including the history of
+// delivery attempts.
+func (q *Queue) Entry(id string) (*QueueMetadata, error) {
+	return q.readMessageMeta(id)
+}
@@ -0,0 +1,166 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/cluster"
+)
+
+func clusterLockDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) < 2 {
+		return nil, config.NodeErr(node, "expected at least 2 arguments: backend and its configuration")
+	}
+
+	switch backend := node.Args[0]; backend {
+	case "postgres":
+		l, err := cluster.NewPostgresLocker(strings.Join(node.Args[1:], " "))
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		return cluster.Locker(l), nil
+	default:
+		return nil, config.NodeErr(node, "unknown lock backend: %s", backend)
+	}
+}
+
+// schedule adds the message to the time wheel to be attempted at the
+// specified time.
+func (q *Queue) schedule(t time.Time, slot queueSlot) {
+	q.scheduledLock.Lock()
+	q.scheduled[slot.ID] = struct{}{}
+	q.scheduledLock.Unlock()
+
+	q.wheel.Add(t, slot)
+}
+
+// nextTryTime calculates the time of the next delivery attempt based on the
+// message meta-data stored on disk.
+func (q *Queue) nextTryTime(meta *QueueMetadata) time.Time {
+	if len(meta.TriesCount) == 0 {
+		if meta.ReleaseAt.After(meta.LastAttempt) {
+			return meta.ReleaseAt
+		}
+		return meta.LastAttempt
+	}
+
+	smallestTriesCount := math.MaxInt32
+	for _, count := range meta.TriesCount {
+		if smallestTriesCount > count {
+			smallestTriesCount = count
+		}
+	}
+	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
+	next := meta.LastAttempt.Add(q.initialRetryTime * scaleFactor)
+	if deadline := q.deadline(meta); !deadline.IsZero() && next.After(deadline) {
+		return deadline
+	}
+	return next
+}
+
+// deadline returns the time after which temporary failures are considered
+// permanent for the message. Zero value means there is no deadline.
+func (q *Queue) deadline(meta *QueueMetadata) time.Time {
+	lifetime := q.maxLifetime
+	if meta.From == "" && q.bounceMaxLifetime != 0 {
+		lifetime = q.bounceMaxLifetime
+	}
+	if lifetime == 0 {
+		return time.Time{}
+	}
+	// Scheduled messages are not delivered before the release time, so it
+	// should not count against the lifetime.
+	if meta.ReleaseAt.After(meta.FirstAttempt) {
+		return meta.ReleaseAt.Add(lifetime)
+	}
+	return meta.FirstAttempt.Add(lifetime)
+}
+
+// lockMessage acquires the cluster lock for the message. If the lock can't
+// be acquired, the message is left for the instance holding it.
+func (q *Queue) lockMessage(id string) (unlock func(), ok bool) {
+	unlock, ok, err := q.locker.TryLock(q.shutdownCtx, "maddy/queue/"+q.name+"/"+id)
+	if err != nil {
+		// Try again later instead of risking duplicate delivery.
+		q.Log.Error("failed to acquire message lock", err, id)
+		q.schedule(time.Now().Add(q.rescanInterval), queueSlot{ID: id})
+		return nil, false
+	}
+	if !ok {
+		q.Log.Debugln("message is locked by another instance:", id)
+		return nil, false
+	}
+	return unlock, true
+}
+
+func (q *Queue) rescanLoop() {
+	defer close(q.rescanDone)
+
+	t := time.NewTicker(q.rescanInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			q.rescan()
+		case <-q.rescanStop:
+			return
+		}
+	}
+}
+
+// rescan schedules messages stored in the queue directory by other instances
+// or left by instances that stopped processing them.
+func (q *Queue) rescan() {
+	dirInfo, err := os.ReadDir(q.location)
+	if err != nil {
+		q.Log.Error("queue directory rescan failed", err)
+		return
+	}
+
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".meta")
+
+		q.scheduledLock.Lock()
+		_, ok := q.scheduled[id]
+		q.scheduledLock.Unlock()
+		if ok {
+			continue
+		}
+
+		meta, err := q.readMessageMeta(id)
+		if err != nil {
+			// Message might be removed by another instance in the meantime.
+			if !os.IsNotExist(err) {
+				q.Log.Error("failed to read meta-data", err, id)
+			}
+			continue
+		}
+
+		q.Log.Debugln("picked up message from the shared directory:", id)
+		q.schedule(q.nextTryTime(meta), queueSlot{ID: id, Priority: meta.Priority})
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// holdFile is the name of the file in the queue directory that contains
+// the runtime hold state changed using maddyctl. It is re-read by the running
+// server when it changes.
+const holdFile = "hold.json"
+
+// HoldState describes destinations deliveries to which are paused.
+//
+// Messages for held recipients are kept in the queue and delivery attempts
+// are not counted against max_tries.
+type HoldState struct {
+	// All pauses deliveries to all destinations.
+	All bool `json:"all,omitempty"`
+
+	// Domains pauses deliveries to the listed domains. Domains are stored
+	// in the normalized form.
+	Domains []string `json:"domains,omitempty"`
+}
+
+func (hs HoldState) held(domain string) bool {
+	if hs.All {
+		return true
+	}
+	for _, d := range hs.Domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// holdTracker merges the hold state from the configuration and from the
+// hold file.
+type holdTracker struct {
+	path   string
+	config HoldState
+
+	lock     sync.Mutex
+	runtime  HoldState
+	modTime  time.Time
+	fileSize int64
+}
+
+// refresh re-reads the hold file if it was modified since the last call.
+func (ht *holdTracker) refresh() error {
+	if ht.path == "" {
+		return nil
+	}
+
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+
+	info, err := os.Stat(ht.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			ht.runtime = HoldState{}
+			ht.modTime = time.Time{}
+			ht.fileSize = 0
+			return nil
+		}
+		return err
+	}
+	if info.ModTime().Equal(ht.modTime) && info.Size() == ht.fileSize {
+		return nil
+	}
+
+	st, err := readHoldFile(ht.path)
+	if err != nil {
+		return err
+	}
+	ht.runtime = st
+	ht.modTime = info.ModTime()
+	ht.fileSize = info.Size()
+	return nil
+}
+
+// held reports whether the delivery to the recipient is paused.
+func (ht *holdTracker) held(rcpt string) bool {
+	domain := ""
+	if _, d, err := address.Split(rcpt); err == nil {
+		domain, _ = dns.ForLookup(d)
+	}
+
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	return ht.config.held(domain) || ht.runtime.held(domain)
+}
+
+func readHoldFile(path string) (HoldState, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return HoldState{}, nil
+		}
+		return HoldState{}, err
+	}
+	var st HoldState
+	if err := json.Unmarshal(blob, &st); err != nil {
+		return HoldState{}, fmt.Errorf("malformed hold file %s: %w", path, err)
+	}
+	return st, nil
+}
+
+func writeHoldFile(path string, st HoldState) error {
+	blob, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// splitHeld splits the list of recipients into ones that should be attempted
+// now and ones that are held.
+func (q *Queue) splitHeld(rcpts []string) (active, held []string) {
+	if err := q.hold.refresh(); err != nil {
+		q.Log.Error("failed to read hold state", err)
+	}
+
+	active = make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		if q.hold.held(rcpt) {
+			held = append(held, rcpt)
+			continue
+		}
+		active = append(active, rcpt)
+	}
+	return active, held
+}
+
+// HoldState returns the runtime hold state, as changed using Hold and
+// Release. Holds defined in the configuration are not included.
+func (q *Queue) HoldState() (HoldState, error) {
+	return readHoldFile(filepath.Join(q.location, holdFile))
+}
+
+// Hold pauses deliveries to the domain. If the domain is empty, all
+// deliveries are paused.
+//
+// The change is picked up by the running server on the next delivery
+// attempt.
+func (q *Queue) Hold(domain string) error {
+	return q.updateHold(func(st *HoldState) error {
+		if domain == "" {
+			st.All = true
+			return nil
+		}
+
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return err
+		}
+		for _, d := range st.Domains {
+			if d == domain {
+				return nil
+			}
+		}
+		st.Domains = append(st.Domains, domain)
+		sort.Strings(st.Domains)
+		return nil
+	})
+}
+
+// Release resumes deliveries to the domain paused using Hold. If the domain
+// is empty, all runtime holds are removed.
+//
+// Held messages are attempted again within hold_recheck_interval.
+func (q *Queue) Release(domain string) error {
+	return q.updateHold(func(st *HoldState) error {
+		if domain == "" {
+			*st = HoldState{}
+			return nil
+		}
+
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return err
+		}
+		domains := st.Domains[:0]
+		for _, d := range st.Domains {
+			if d != domain {
+				domains = append(domains, d)
+			}
+		}
+		st.Domains = domains
+		return nil
+	})
+}
+
+func (q *Queue) updateHold(f func(*HoldState) error) error {
+	path := filepath.Join(q.location, holdFile)
+	st, err := readHoldFile(path)
+	if err != nil {
+		return err
+	}
+	if err := f(&st); err != nil {
+		return err
+	}
+	return writeHoldFile(path, st)
+}
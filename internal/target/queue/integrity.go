@@ -0,0 +1,353 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	// metaSumPrefix starts the last line of the meta-data file that
+	// contains the checksum of the JSON document before it. Files written
+	// by older versions do not have it.
+	metaSumPrefix = "sha256:"
+
+	// quarantineSuffix is appended to extensions of files belonging to the
+	// damaged queue entry.
+	quarantineSuffix = "_quarantined"
+
+	// tmpSuffix is used for files that are being written and are renamed
+	// once complete. Leftovers are removed on start-up.
+	tmpSuffix = ".tmp"
+)
+
+var entryExts = []string{".meta", ".header", ".body"}
+
+// ErrChecksum is returned if the queue file content does not match the
+// checksum recorded for it.
+var ErrChecksum = errors.New("checksum mismatch")
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic writes the file using write callback to the temporary
+// file and renames it to path once it is synced to disk. Checksum of the
+// written data is returned.
+func writeFileAtomic(path string, write func(w io.Writer) error) (string, error) {
+	tmpPath := path + tmpSuffix
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	bufW := bufio.NewWriter(io.MultiWriter(f, h))
+	if err := write(bufW); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := bufW.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncDir makes sure renames in the directory are persisted.
+func syncDir(dir string) error {
+	// Directories can't be opened for fsync on Windows.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// encodeMeta serializes the meta-data followed by the checksum line.
+func encodeMeta(meta *QueueMetadata) ([]byte, error) {
+	metaCopy := *meta
+	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
+	metaCopy.MsgMeta.Conn = nil
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(metaCopy); err != nil {
+		return nil, err
+	}
+	sum := checksum(buf.Bytes())
+	buf.WriteString(metaSumPrefix + sum + "\n")
+	return buf.Bytes(), nil
+}
+
+// decodeMeta parses the meta-data file contents verifying the checksum,
+// if it is present.
+func decodeMeta(data []byte) (*QueueMetadata, error) {
+	if idx := bytes.LastIndex(data, []byte("\n"+metaSumPrefix)); idx != -1 {
+		payload := data[:idx+1]
+		sum := strings.TrimSpace(string(data[idx+1+len(metaSumPrefix):]))
+		if checksum(payload) != sum {
+			return nil, fmt.Errorf("meta-data: %w", ErrChecksum)
+		}
+		data = payload
+	}
+
+	meta := &QueueMetadata{}
+
+	meta.MsgMeta = &module.MsgMetadata{}
+
+	// There is a couple of problems we have to solve before we would be able to
+	// serialize ConnState.
+	// 1. future.Future can't be serialized.
+	// 2. net.Addr can't be deserialized because we don't know the concrete type.
+
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("meta-data: %w", err)
+	}
+	return meta, nil
+}
+
+func readMetaFile(path string) (*QueueMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMeta(data)
+}
+
+// verifyFiles checks the integrity of the queue entry stored using the
+// specified file extension suffix ("" or quarantineSuffix).
+func (q *Queue) verifyFiles(id, suffix string) (*QueueMetadata, error) {
+	meta, err := readMetaFile(filepath.Join(q.location, id+".meta"+suffix))
+	if err != nil {
+		return nil, err
+	}
+
+	headerPath := filepath.Join(q.location, id+".header"+suffix)
+	headerBlob, err := os.ReadFile(headerPath)
+	if err != nil {
+		return meta, err
+	}
+	if meta.HeaderSum != "" && checksum(headerBlob) != meta.HeaderSum {
+		return meta, fmt.Errorf("header: %w", ErrChecksum)
+	}
+	if _, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(headerBlob))); err != nil {
+		return meta, fmt.Errorf("header: %w", err)
+	}
+
+	bodySum, err := fileChecksum(filepath.Join(q.location, id+".body"+suffix))
+	if err != nil {
+		return meta, err
+	}
+	if meta.BodySum != "" && bodySum != meta.BodySum {
+		return meta, fmt.Errorf("body: %w", ErrChecksum)
+	}
+
+	return meta, nil
+}
+
+// quarantine renames files of the damaged queue entry so they are no longer
+// picked up by the queue but are kept for inspection using
+// 'maddy queue damaged'.
+func (q *Queue) quarantine(id string, reason error) {
+	q.Log.Error("queue entry is damaged, quarantining", reason, "msg_id", id)
+	for _, ext := range entryExts {
+		path := filepath.Join(q.location, id+ext)
+		if err := os.Rename(path, path+quarantineSuffix); err != nil && !os.IsNotExist(err) {
+			q.Log.Error("failed to quarantine the file", err, "msg_id", id, "path", path)
+		}
+	}
+}
+
+// removeTempFiles removes files left by interrupted writes.
+func (q *Queue) removeTempFiles() error {
+	dirInfo, err := os.ReadDir(q.location)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirInfo {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), tmpSuffix) || strings.HasSuffix(entry.Name(), ".meta.new") {
+			q.tryRemoveDanglingFile(entry.Name())
+		}
+	}
+	return nil
+}
+
+// DamagedEntry describes the queue entry that failed the integrity check.
+type DamagedEntry struct {
+	ID          string
+	Quarantined bool
+	Err         error
+}
+
+// Verify checks the integrity of all entries in the queue, including
+// quarantined ones, and returns the list of damaged entries.
+//
+// Quarantined entries that pass the check are reported with nil Err, they
+// can be restored using Restore.
+func (q *Queue) Verify() ([]DamagedEntry, error) {
+	dirInfo, err := os.ReadDir(q.location)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []DamagedEntry
+	seenQuarantined := make(map[string]struct{})
+	for _, entry := range dirInfo {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".meta"):
+			id := strings.TrimSuffix(name, ".meta")
+			if _, err := q.verifyFiles(id, ""); err != nil {
+				res = append(res, DamagedEntry{ID: id, Err: err})
+			}
+		case strings.HasSuffix(name, quarantineSuffix):
+			id := name[:strings.IndexByte(name, '.')]
+			if _, ok := seenQuarantined[id]; ok {
+				continue
+			}
+			seenQuarantined[id] = struct{}{}
+			_, err := q.verifyFiles(id, quarantineSuffix)
+			res = append(res, DamagedEntry{ID: id, Quarantined: true, Err: err})
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// Restore moves the quarantined entry back to the queue. If rehash is true,
+// checksums are recomputed from the current files content, otherwise the
+// entry should pass the integrity check.
+//
+// Meta-data and header should be readable in both cases.
+//
+// The running server picks up the restored entry after restart.
+func (q *Queue) Restore(id string, rehash bool) error {
+	meta, err := q.verifyFiles(id, quarantineSuffix)
+	if err != nil {
+		if !rehash || meta == nil || !errors.Is(err, ErrChecksum) {
+			return err
+		}
+	}
+
+	if rehash {
+		meta.HeaderSum, err = fileChecksum(filepath.Join(q.location, id+".header"+quarantineSuffix))
+		if err != nil {
+			return err
+		}
+		meta.BodySum, err = fileChecksum(filepath.Join(q.location, id+".body"+quarantineSuffix))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ext := range []string{".header", ".body"} {
+		path := filepath.Join(q.location, id+ext)
+		if err := os.Rename(path+quarantineSuffix, path); err != nil {
+			return err
+		}
+	}
+	if rehash {
+		if err := q.updateMetadataOnDisk(meta); err != nil {
+			return err
+		}
+		return os.Remove(filepath.Join(q.location, id+".meta"+quarantineSuffix))
+	}
+	metaPath := filepath.Join(q.location, id+".meta")
+	return os.Rename(metaPath+quarantineSuffix, metaPath)
+}
+
+// Drop removes the queue entry (quarantined or not) from disk.
+func (q *Queue) Drop(id string) error {
+	removed := false
+	for _, ext := range entryExts {
+		for _, suffix := range []string{"", quarantineSuffix} {
+			err := os.Remove(filepath.Join(q.location, id+ext+suffix))
+			if err == nil {
+				removed = true
+				continue
+			}
+			if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if !removed {
+		return fmt.Errorf("no such queue entry: %s", id)
+	}
+	return nil
+}
@@ -30,6 +30,17 @@ var queuedMsgs = prometheus.NewGaugeVec(
 	[]string{"module", "location"},
 )
 
+var bouncesCnt = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "bounces",
+		Help:      "Recipients that failed permanently, by failure category",
+	},
+	[]string{"module", "category"},
+)
+
 func init() {
 	prometheus.MustRegister(queuedMsgs)
+	prometheus.MustRegister(bouncesCnt)
 }
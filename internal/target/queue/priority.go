@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"sync"
+)
+
+// Priority is the message priority class. Messages with higher priority are
+// picked first when all delivery slots (max_parallelism) are busy.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// PriorityNames lists values accepted by ParsePriority.
+var PriorityNames = []string{"low", "normal", "high"}
+
+func ParsePriority(s string) (Priority, bool) {
+	switch s {
+	case "low":
+		return PriorityLow, true
+	case "normal":
+		return PriorityNormal, true
+	case "high":
+		return PriorityHigh, true
+	}
+	return PriorityNormal, false
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// priorityFor determines the priority class of the message.
+//
+// The "queue.priority" annotation (set by modify.priority) takes precedence,
+// then messages from authenticated users get auth_priority.
+func (q *Queue) priorityFor(meta *QueueMetadata) Priority {
+	if val, ok := meta.MsgMeta.Annotations.GetString("queue.priority"); ok {
+		if p, ok := ParsePriority(val); ok {
+			return p
+		}
+	}
+	if meta.MsgMeta.Conn != nil && meta.MsgMeta.Conn.AuthUser != "" {
+		return q.authPriority
+	}
+	return PriorityNormal
+}
+
+// prioritySemaphore limits the amount of concurrent deliveries, waiting
+// deliveries with higher priority acquire freed slots first.
+type prioritySemaphore struct {
+	lock    sync.Mutex
+	free    int
+	waiters map[Priority][]chan struct{}
+}
+
+func newPrioritySemaphore(size int) *prioritySemaphore {
+	return &prioritySemaphore{
+		free:    size,
+		waiters: make(map[Priority][]chan struct{}),
+	}
+}
+
+func (s *prioritySemaphore) Acquire(p Priority) {
+	s.lock.Lock()
+	if s.free > 0 {
+		s.free--
+		s.lock.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	s.waiters[p] = append(s.waiters[p], ch)
+	s.lock.Unlock()
+
+	<-ch
+}
+
+func (s *prioritySemaphore) Release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, p := range [...]Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		waiters := s.waiters[p]
+		if len(waiters) == 0 {
+			continue
+		}
+		// Pass the slot directly to the waiter.
+		close(waiters[0])
+		s.waiters[p] = waiters[1:]
+		return
+	}
+	s.free++
+}
@@ -0,0 +1,59 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrioritySemaphore(t *testing.T) {
+	s := newPrioritySemaphore(1)
+	s.Acquire(PriorityNormal)
+
+	order := make(chan Priority, 3)
+	start := func(p Priority) {
+		go func() {
+			s.Acquire(p)
+			order <- p
+			s.Release()
+		}()
+		// Make sure waiters are queued in the specified order.
+		time.Sleep(50 * time.Millisecond)
+	}
+	start(PriorityLow)
+	start(PriorityNormal)
+	start(PriorityHigh)
+
+	s.Release()
+
+	var got []Priority
+	for i := 0; i < 3; i++ {
+		select {
+		case p := <-order:
+			got = append(got, p)
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter was not woken up")
+		}
+	}
+	want := []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong order: want %v, got %v", want, got)
+	}
+}
@@ -59,7 +59,6 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -76,15 +75,21 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/cluster"
 	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tracing"
+	"github.com/foxcpp/maddy/internal/vdomain"
 )
 
 // partialError describes state of partially successful message delivery.
@@ -127,6 +132,21 @@ type Queue struct {
 
 	dsnPipeline module.DeliveryTarget
 
+	// Bounce generation policy.
+	bounceReturn         dsn.Return
+	bounceMaxSize        int64
+	bounceSuppressForged bool
+	bounceRateLimit      int
+	bounceRate           limiters.Rate
+	// Template for the human-readable DSN text, see bounceText.
+	bounceText string
+
+	// URL results of delivery attempts are sent to, see notifyAttempt.
+	attemptWebhook string
+
+	// If set, permanent failures are recorded there, see check.suppression.
+	suppression BounceRecorder
+
 	// Retry delay is calculated using the following formula:
 	// initialRetryTime * retryTimeScale ^ (TriesCount - 1)
 
@@ -134,6 +154,17 @@ type Queue struct {
 	retryTimeScale   float64
 	maxTries         int
 
+	// Max. time messages are kept in the queue, zero means no limit.
+	// bounceMaxLifetime is used instead for messages with null return-path
+	// (DSNs), if set.
+	maxLifetime       time.Duration
+	bounceMaxLifetime time.Duration
+
+	// If set, the message is sent separately to each recipient with
+	// the recipient address encoded in the envelope sender.
+	verp      bool
+	verpDelim string
+
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
 	//
@@ -146,13 +177,46 @@ type Queue struct {
 	// after start-up for whatever reason it will not affect the queue.
 	postInitDelay time.Duration
 
+	// Deliveries to held recipients are paused, messages are checked
+	// again each holdRecheck.
+	hold        holdTracker
+	holdRecheck time.Duration
+
+	// If set, the amount of recipients per destination group is limited
+	// per day.
+	warmup *warmupSchedule
+
+	// If set, authenticated senders can request delivery at the later time
+	// using X-Release-At header field, see releaseTime.
+	allowScheduled   bool
+	maxScheduleDelay time.Duration
+
 	Log    log.Logger
 	Target module.DeliveryTarget
 
 	deliveryWg sync.WaitGroup
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
-	deliverySemaphore chan struct{}
+	deliverySemaphore *prioritySemaphore
+	authPriority      Priority
+
+	// shutdownCtx is cancelled on Close to abort in-flight delivery attempts,
+	// they are retried after restart.
+	shutdownCtx context.Context
+	shutdown    context.CancelFunc
+
+	// IDs of messages currently in the wheel, used by rescan to find
+	// messages added by other instances sharing the queue directory.
+	scheduledLock sync.Mutex
+	scheduled     map[string]struct{}
+
+	// If set, the queue directory is shared with other instances
+	// and locker is used to make sure each message is handled by only one
+	// of them at a time.
+	locker         cluster.Locker
+	rescanInterval time.Duration
+	rescanStop     chan struct{}
+	rescanDone     chan struct{}
 }
 
 type QueueMetadata struct {
@@ -176,6 +240,22 @@ type QueueMetadata struct {
 
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// Priority class of the message, determined when the message is
+	// enqueued.
+	Priority Priority
+
+	// Results of the most recent delivery attempts, see maxAttemptsHistory.
+	Attempts []Attempt
+
+	// SHA-256 checksums of the header and body files, hex-encoded.
+	// Empty for messages stored by older versions.
+	HeaderSum string
+	BodySum   string
+
+	// Time the message should not be delivered before, as requested by the
+	// sender. Zero if the message should be delivered right away.
+	ReleaseAt time.Time `json:",omitempty"`
 }
 
 type queueSlot struct {
@@ -186,6 +266,9 @@ type queueSlot struct {
 	Meta *QueueMetadata
 	Hdr  *textproto.Header
 	Body buffer.Buffer
+
+	// Priority used to acquire delivery slot.
+	Priority Priority
 }
 
 func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -194,8 +277,10 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 		initialRetryTime: 15 * time.Minute,
 		retryTimeScale:   1.25,
 		postInitDelay:    10 * time.Second,
+		holdRecheck:      1 * time.Minute,
 		Log:              log.Logger{Name: "queue"},
 	}
+	q.shutdownCtx, q.shutdown = context.WithCancel(context.Background())
 	switch len(inlineArgs) {
 	case 0:
 		// Not inline definition.
@@ -208,21 +293,73 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 }
 
 func (q *Queue) Init(cfg *config.Map) error {
-	var maxParallelism int
+	var (
+		maxParallelism int
+		bounceReturn   string
+		bounceTextPath string
+		authPriority   string
+	)
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
+	cfg.Duration("max_lifetime", false, false, 0, &q.maxLifetime)
+	cfg.Duration("bounce_max_lifetime", false, false, 0, &q.bounceMaxLifetime)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
 	cfg.String("location", false, false, q.location, &q.location)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
 	cfg.String("hostname", true, true, "", &q.hostname)
 	cfg.String("autogenerated_msg_domain", true, false, "", &q.autogenMsgDomain)
+	cfg.Enum("auth_priority", false, false, PriorityNames, "high", &authPriority)
+	cfg.Bool("verp", false, false, &q.verp)
+	cfg.String("verp_delimiter", false, false, "+", &q.verpDelim)
+	cfg.Bool("hold_all", false, false, &q.hold.config.All)
+	cfg.StringList("hold_domains", false, false, nil, &q.hold.config.Domains)
+	cfg.Duration("hold_recheck_interval", false, false, 1*time.Minute, &q.holdRecheck)
+	cfg.Custom("warmup", false, false, nil, warmupDirective, &q.warmup)
+	cfg.Bool("allow_scheduled", false, false, &q.allowScheduled)
+	cfg.Duration("max_schedule_delay", false, false, 30*24*time.Hour, &q.maxScheduleDelay)
+	cfg.Custom("cluster_lock", false, false, nil, clusterLockDirective, &q.locker)
+	cfg.Duration("cluster_rescan_interval", false, false, 1*time.Minute, &q.rescanInterval)
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
+	cfg.Enum("bounce_return", false, false, []string{"full", "headers", "none"}, "headers", &bounceReturn)
+	cfg.DataSize("bounce_max_size", false, false, 128*1024, &q.bounceMaxSize)
+	cfg.Bool("bounce_suppress_forged", false, false, &q.bounceSuppressForged)
+	cfg.String("bounce_text", false, false, "", &bounceTextPath)
+	cfg.Int("bounce_rate_limit", false, false, 0, &q.bounceRateLimit)
+	cfg.String("attempt_webhook", false, false, "", &q.attemptWebhook)
+	cfg.Custom("bounce_suppression", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var rec BounceRecorder
+		err := modconfig.ModuleFromNode("check", node.Args, node, m.Globals, &rec)
+		return rec, err
+	}, &q.suppression)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	switch bounceReturn {
+	case "full":
+		q.bounceReturn = dsn.ReturnFull
+	case "headers":
+		q.bounceReturn = dsn.ReturnHeaders
+	case "none":
+		q.bounceReturn = dsn.ReturnNone
+	}
+	if bounceTextPath != "" {
+		if !filepath.IsAbs(bounceTextPath) {
+			bounceTextPath = filepath.Join(config.StateDirectory, bounceTextPath)
+		}
+		text, err := os.ReadFile(bounceTextPath)
+		if err != nil {
+			return fmt.Errorf("queue: bounce_text: %w", err)
+		}
+		q.bounceText = string(text)
+	}
+	q.authPriority, _ = ParsePriority(authPriority)
+	if q.bounceRateLimit < 0 {
+		return errors.New("queue: bounce_rate_limit can't be negative")
+	}
+
 	if q.dsnPipeline != nil {
 		if q.autogenMsgDomain == "" {
 			return errors.New("queue: autogenerated_msg_domain is required if bounce {} is specified")
@@ -231,38 +368,111 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
 	}
+	if q.verp && q.verpDelim == "" {
+		return errors.New("queue: verp_delimiter can't be empty")
+	}
 	if q.location == "" && q.name == "" {
 		return errors.New("queue: need explicit location directive or inline argument if defined inline")
 	}
 	if q.location == "" {
 		q.location = filepath.Join(config.StateDirectory, q.name)
 	}
+	if q.locker != nil && q.rescanInterval <= 0 {
+		return errors.New("queue: cluster_rescan_interval should be positive")
+	}
+	if q.holdRecheck <= 0 {
+		return errors.New("queue: hold_recheck_interval should be positive")
+	}
+	for i, domain := range q.hold.config.Domains {
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("queue: invalid domain in hold_domains: %w", err)
+		}
+		q.hold.config.Domains[i] = domain
+	}
 
 	// TODO: Check location write permissions.
 	if err := os.MkdirAll(q.location, os.ModePerm); err != nil {
 		return err
 	}
 
+	if module.NoRun {
+		return nil
+	}
+
 	return q.start(maxParallelism)
 }
 
 func (q *Queue) start(maxParallelism int) error {
 	q.wheel = NewTimeWheel(q.dispatch)
-	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.hold.path = filepath.Join(q.location, holdFile)
+	if q.warmup != nil {
+		if err := q.warmup.load(filepath.Join(q.location, warmupFile)); err != nil {
+			return err
+		}
+	}
+	q.deliverySemaphore = newPrioritySemaphore(maxParallelism)
+	q.scheduled = make(map[string]struct{})
+	if q.bounceRateLimit != 0 {
+		q.bounceRate = limiters.NewRate(q.bounceRateLimit, time.Hour)
+	}
 
 	if err := q.readDiskQueue(); err != nil {
 		return err
 	}
 
+	if q.locker != nil {
+		q.rescanStop = make(chan struct{})
+		q.rescanDone = make(chan struct{})
+		go q.rescanLoop()
+	}
+
 	q.Log.Debugf("delivery target: %T", q.Target)
 
 	return nil
 }
 
 func (q *Queue) Close() error {
+	if q.wheel == nil {
+		if q.locker != nil {
+			return q.locker.Close()
+		}
+		return nil
+	}
+	if q.rescanStop != nil {
+		close(q.rescanStop)
+		<-q.rescanDone
+	}
 	q.wheel.Close()
+	q.shutdown()
 	q.deliveryWg.Wait()
+	if q.bounceRateLimit != 0 {
+		q.bounceRate.Close()
+	}
 
+	if q.locker != nil {
+		return q.locker.Close()
+	}
+	return nil
+}
+
+// CheckHealth implements module.HealthChecker. It checks whether the queue
+// directory is writable.
+func (q *Queue) CheckHealth(ctx context.Context) error {
+	f, err := os.CreateTemp(q.location, ".health-*.tmp")
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
 	return nil
 }
 
@@ -284,14 +494,18 @@ func (q *Queue) discardBroken(id string) {
 func (q *Queue) dispatch(value TimeSlot) {
 	slot := value.Value.(queueSlot)
 
+	q.scheduledLock.Lock()
+	delete(q.scheduled, slot.ID)
+	q.scheduledLock.Unlock()
+
 	q.Log.Debugln("starting delivery for", slot.ID)
 
 	q.deliveryWg.Add(1)
 	go func() {
-		q.Log.Debugln("waiting on delivery semaphore for", slot.ID)
-		q.deliverySemaphore <- struct{}{}
+		q.Log.Debugln("waiting on delivery semaphore for", slot.ID, "priority", slot.Priority)
+		q.deliverySemaphore.Acquire(slot.Priority)
 		defer func() {
-			<-q.deliverySemaphore
+			q.deliverySemaphore.Release()
 			q.deliveryWg.Done()
 
 			if dontRecover {
@@ -306,6 +520,19 @@ func (q *Queue) dispatch(value TimeSlot) {
 		}()
 
 		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
+
+		if q.locker != nil {
+			unlock, ok := q.lockMessage(slot.ID)
+			if !ok {
+				return
+			}
+			defer unlock()
+
+			// The message could be changed by another instance, so
+			// in-memory state can't be used.
+			slot.Meta = nil
+		}
+
 		var (
 			meta *QueueMetadata
 			hdr  textproto.Header
@@ -315,12 +542,34 @@ func (q *Queue) dispatch(value TimeSlot) {
 			var err error
 			meta, hdr, body, err = q.openMessage(slot.ID)
 			if err != nil {
+				if q.locker != nil && errors.Is(err, os.ErrNotExist) {
+					q.Log.Debugln("message is already processed by another instance:", slot.ID)
+					return
+				}
+				if errors.Is(err, os.ErrNotExist) {
+					// Scheduled message cancelled using maddy queue cancel.
+					q.Log.Debugln("message is removed from the queue:", slot.ID)
+					return
+				}
+				if errors.Is(err, ErrChecksum) {
+					q.quarantine(slot.ID, err)
+					return
+				}
 				q.Log.Error("read message", err, slot.ID)
 				return
 			}
 			if meta == nil {
 				panic("wtf")
 			}
+
+			if q.locker != nil {
+				// Another instance might have attempted the delivery
+				// already.
+				if next := q.nextTryTime(meta); time.Now().Before(next) {
+					q.schedule(next, queueSlot{ID: slot.ID})
+					return
+				}
+			}
 		} else {
 			meta = slot.Meta
 			hdr = *slot.Hdr
@@ -374,6 +623,26 @@ func toSMTPErr(err error) *smtp.SMTPError {
 func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 
+	active, held := q.splitHeld(meta.To)
+	active, deferred := q.splitWarmup(active)
+	if len(deferred) != 0 {
+		dl.DebugMsg("warm-up limit reached, deferring", "rcpts", deferred)
+		// Deferred recipients are handled the same way as held ones.
+		held = append(held, deferred...)
+	}
+	if len(active) == 0 {
+		dl.Debugf("all recipients are held, checking again in %v", q.holdRecheck)
+		q.schedule(time.Now().Add(q.holdRecheck), queueSlot{
+			ID:       meta.MsgMeta.ID,
+			Priority: meta.Priority,
+		})
+		return
+	}
+	if len(held) != 0 {
+		dl.Msg("some recipients are held", "rcpts", held)
+	}
+	meta.To = active
+
 	partialErr := q.deliver(meta, header, body)
 	dl.Debugf("errors: %v", partialErr.Errs)
 
@@ -390,8 +659,13 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	// and recipients DSN will be generated for.
 	newRcpts := make([]string, 0, len(partialErr.Errs))
 	failedRcpts := make([]string, 0, len(partialErr.Errs))
+	deadline := q.deadline(meta)
+	expired := !deadline.IsZero() && !time.Now().Before(deadline)
+	attemptTime := time.Now()
+	attempts := make([]Attempt, 0, len(meta.To))
 	for _, rcpt := range meta.To {
 		rcptErr, ok := partialErr.Errs[rcpt]
+		attempts = append(attempts, newAttempt(attemptTime, rcpt, rcptErr))
 		if !ok {
 			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
 			continue
@@ -402,9 +676,18 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
-		if !temporary || meta.TriesCount[rcpt]+1 >= q.maxTries {
+		if temporary && expired {
+			dl.Msg("not delivered, max. queue lifetime exceeded", "rcpt", rcpt)
+			meta.RcptErrs[rcpt].Code = 554
+			meta.RcptErrs[rcpt].EnhancedCode = smtp.EnhancedCode{5, 4, 7}
+		}
+		if !temporary || expired || meta.TriesCount[rcpt]+1 >= q.maxTries {
 			delete(meta.TriesCount, rcpt)
-			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
+			smtpErr := meta.RcptErrs[rcpt]
+			category := dsn.Classify(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			dl.Msg("not delivered, permanent error", "rcpt", rcpt, "category", category)
+			bouncesCnt.WithLabelValues(q.name, string(category)).Inc()
+			q.recordBounce(meta, rcpt, category, smtpErr.Message)
 			failedRcpts = append(failedRcpts, rcpt)
 			continue
 		}
@@ -421,8 +704,15 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 
 	// Generate DSN for recipients that failed permanently this time.
 	if len(failedRcpts) != 0 {
-		q.emitDSN(meta, header, failedRcpts)
+		q.emitDSN(meta, header, body, failedRcpts)
 	}
+	// Held recipients are kept in the queue without increasing the tries
+	// counter.
+	newRcpts = append(newRcpts, held...)
+
+	meta.recordAttempts(attempts)
+	q.notifyAttempt(meta, attempts, newRcpts)
+
 	// No recipients to try, either all failed or all succeeded.
 	if len(newRcpts) == 0 {
 		q.removeFromDisk(meta.MsgMeta)
@@ -442,12 +732,20 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
 	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
 	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	if !deadline.IsZero() && nextTryTime.After(deadline) {
+		// Make the last attempt right at the deadline.
+		nextTryTime = deadline
+	}
+	if len(newRcpts) == len(held) {
+		// Only held recipients are left.
+		nextTryTime = time.Now().Add(q.holdRecheck)
+	}
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
 		"rcpts", meta.To)
 
-	q.wheel.Add(nextTryTime, queueSlot{
+	q.schedule(nextTryTime, queueSlot{
 		ID: meta.MsgMeta.ID,
 
 		// Do not keep (meta-)data in memory to reduce usage.  At this point,
@@ -455,6 +753,8 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		Meta: nil,
 		Hdr:  nil,
 		Body: nil,
+
+		Priority: meta.Priority,
 	})
 }
 
@@ -469,23 +769,59 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	msgMeta.ID = msgMeta.ID + "-" + strconv.FormatInt(time.Now().Unix(), 16)
 	dl.Debugf("using message ID = %s", msgMeta.ID)
 
-	msgCtx, msgTask := trace.NewTask(context.Background(), "Queue delivery")
+	msgCtx, msgTask := trace.NewTask(q.shutdownCtx, "Queue delivery")
 	defer msgTask.End()
 
+	// Attempts are linked to the trace of the original message, not
+	// the per-attempt ID.
+	msgCtx, span := tracing.ResumeMessage(msgCtx, meta.MsgMeta.ID, "queue.attempt",
+		"maddy.queue", q.name,
+		"maddy.attempt_msg_id", msgMeta.ID,
+		"maddy.rcpts", len(meta.To))
+	defer func() {
+		failed := 0
+		for _, err := range perr.Errs {
+			if err != nil {
+				failed++
+			}
+		}
+		span.SetAttrs("maddy.failed_rcpts", failed)
+		span.End()
+	}()
+
+	if !q.verp || meta.From == "" {
+		q.deliverTo(msgCtx, dl, msgMeta, meta.From, meta.To, header, body, &perr)
+		return perr
+	}
+
+	// Each recipient gets its own transaction since the envelope sender
+	// is different.
+	for _, rcpt := range meta.To {
+		from, err := address.VERPEncode(meta.From, rcpt, q.verpDelim)
+		if err != nil {
+			dl.Debugf("VERP encoding failed for %s, using original sender: %v", rcpt, err)
+			from = meta.From
+		}
+		q.deliverTo(msgCtx, dl, msgMeta, from, []string{rcpt}, header, body, &perr)
+	}
+	return perr
+}
+
+func (q *Queue) deliverTo(msgCtx context.Context, dl log.Logger, msgMeta *module.MsgMetadata, from string, rcpts []string, header textproto.Header, body buffer.Buffer, perr *partialError) {
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
-	delivery, err := q.Target.Start(mailCtx, msgMeta, meta.From)
+	delivery, err := q.Target.Start(mailCtx, msgMeta, from)
 	mailTask.End()
 	if err != nil {
 		dl.Debugf("target.Start failed: %v", err)
-		for _, rcpt := range meta.To {
+		for _, rcpt := range rcpts {
 			perr.Errs[rcpt] = err
 		}
-		return perr
+		return
 	}
 	dl.Debugf("target.Start OK")
 
 	var acceptedRcpts []string
-	for _, rcpt := range meta.To {
+	for _, rcpt := range rcpts {
 		rcptCtx, rcptTask := trace.NewTask(msgCtx, "RCPT TO")
 		if err := delivery.AddRcpt(rcptCtx, rcpt, smtp.RcptOptions{} /* TODO: DSN support */); err != nil {
 			dl.Debugf("delivery.AddRcpt %s failed: %v", rcpt, err)
@@ -502,7 +838,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 		if err := delivery.Abort(msgCtx); err != nil {
 			dl.Error("delivery.Abort failed", err)
 		}
-		return perr
+		return
 	}
 
 	expandToPartialErr := func(err error) {
@@ -517,7 +853,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	partDelivery, ok := delivery.(module.PartialDelivery)
 	if ok {
 		dl.Debugf("using delivery.BodyNonAtomic")
-		partDelivery.BodyNonAtomic(bodyCtx, &perr, header, body)
+		partDelivery.BodyNonAtomic(bodyCtx, perr, header, body)
 	} else {
 		if err := delivery.Body(bodyCtx, header, body); err != nil {
 			dl.Debugf("delivery.Body failed: %v", err)
@@ -538,7 +874,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 		if err := delivery.Abort(bodyCtx); err != nil {
 			dl.Msg("delivery.Abort failed", err)
 		}
-		return perr
+		return
 	}
 
 	if err := delivery.Commit(bodyCtx); err != nil {
@@ -546,8 +882,6 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 		expandToPartialErr(err)
 	}
 	dl.Debugf("delivery.Commit OK")
-
-	return perr
 }
 
 type queueDelivery struct {
@@ -566,6 +900,15 @@ func (qd *queueDelivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.Rcpt
 func (qd *queueDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "queue/Body").End()
 
+	qd.meta.Priority = qd.q.priorityFor(qd.meta)
+
+	header = header.Copy()
+	releaseAt, err := qd.q.releaseTime(qd.meta.MsgMeta, &header, time.Now())
+	if err != nil {
+		return err
+	}
+	qd.meta.ReleaseAt = releaseAt
+
 	// Body buffer initially passed to us may not be valid after "delivery" to queue completes.
 	// storeNewMessage returns a new buffer object created from message blob stored on disk.
 	storedBody, err := qd.q.storeNewMessage(qd.meta, header, body)
@@ -594,12 +937,23 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
-		ID:   qd.meta.MsgMeta.ID,
-		Meta: qd.meta,
-		Hdr:  &qd.header,
-		Body: qd.body,
-	})
+	if !qd.meta.ReleaseAt.IsZero() {
+		// The message is read from disk on release, so it can be cancelled
+		// using maddy queue cancel meanwhile.
+		target.DeliveryLogger(qd.q.Log, qd.meta.MsgMeta).Msg("message is scheduled", "release_at", qd.meta.ReleaseAt)
+		qd.q.schedule(qd.meta.ReleaseAt, queueSlot{
+			ID:       qd.meta.MsgMeta.ID,
+			Priority: qd.meta.Priority,
+		})
+	} else {
+		qd.q.schedule(time.Time{}, queueSlot{
+			ID:       qd.meta.MsgMeta.ID,
+			Meta:     qd.meta,
+			Hdr:      &qd.header,
+			Body:     qd.body,
+			Priority: qd.meta.Priority,
+		})
+	}
 	qd.meta = nil
 	qd.body = nil
 	return nil
@@ -644,6 +998,10 @@ func (q *Queue) readDiskQueue() error {
 		return err
 	}
 
+	if err := q.removeTempFiles(); err != nil {
+		return err
+	}
+
 	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
 
 	loadedCount := 0
@@ -655,12 +1013,6 @@ func (q *Queue) readDiskQueue() error {
 		}
 		id := entry.Name()[:len(entry.Name())-5]
 
-		meta, err := q.readMessageMeta(id)
-		if err != nil {
-			q.Log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
-			continue
-		}
-
 		// Check header file existence.
 		if _, err := os.Stat(filepath.Join(q.location, id+".header")); err != nil {
 			if os.IsNotExist(err) {
@@ -685,23 +1037,21 @@ func (q *Queue) readDiskQueue() error {
 			continue
 		}
 
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
-			}
+		meta, err := q.verifyFiles(id, "")
+		if err != nil {
+			q.quarantine(id, err)
+			continue
 		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
 
+		nextTryTime := q.nextTryTime(meta)
 		if time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
 		}
 
 		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
-		q.wheel.Add(nextTryTime, queueSlot{
-			ID: id,
+		q.schedule(nextTryTime, queueSlot{
+			ID:       id,
+			Priority: meta.Priority,
 		})
 		loadedCount++
 	}
@@ -716,17 +1066,15 @@ func (q *Queue) readDiskQueue() error {
 func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
 	id := meta.MsgMeta.ID
 
+	// Header and body are written first, meta-data file is the commit
+	// point: entries without it are not picked up by readDiskQueue.
 	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Create(headerPath)
+	headerSum, err := writeFileAtomic(headerPath, func(w io.Writer) error {
+		return textproto.WriteHeader(w, header)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer headerFile.Close()
-
-	if err := textproto.WriteHeader(headerFile, header); err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
 
 	bodyReader, err := body.Open()
 	if err != nil {
@@ -736,96 +1084,57 @@ func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, bo
 	defer bodyReader.Close()
 
 	bodyPath := filepath.Join(q.location, id+".body")
-	bodyFile, err := os.Create(bodyPath)
+	bodySum, err := writeFileAtomic(bodyPath, func(w io.Writer) error {
+		_, err := io.Copy(w, bodyReader)
+		return err
+	})
 	if err != nil {
-		return nil, err
-	}
-	defer bodyFile.Close()
-
-	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
 		q.tryRemoveDanglingFile(id + ".header")
 		return nil, err
 	}
 
+	meta.HeaderSum = headerSum
+	meta.BodySum = bodySum
 	if err := q.updateMetadataOnDisk(meta); err != nil {
 		q.tryRemoveDanglingFile(id + ".body")
 		q.tryRemoveDanglingFile(id + ".header")
 		return nil, err
 	}
 
-	if err := headerFile.Sync(); err != nil {
-		return nil, err
-	}
-
-	if err := bodyFile.Sync(); err != nil {
-		return nil, err
-	}
-
 	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
 }
 
 func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
 	metaPath := filepath.Join(q.location, meta.MsgMeta.ID+".meta")
 
-	var file *os.File
-	var err error
+	blob, err := encodeMeta(meta)
+	if err != nil {
+		return err
+	}
+
 	if runtime.GOOS == "windows" {
-		file, err = os.Create(metaPath)
+		file, err := os.Create(metaPath)
 		if err != nil {
 			return err
 		}
-	} else {
-		file, err = os.Create(metaPath + ".new")
-		if err != nil {
+		defer file.Close()
+		if _, err := file.Write(blob); err != nil {
 			return err
 		}
+		return file.Sync()
 	}
-	defer file.Close()
-
-	metaCopy := *meta
-	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
-	metaCopy.MsgMeta.Conn = nil
 
-	if err := json.NewEncoder(file).Encode(metaCopy); err != nil {
+	if _, err := writeFileAtomic(metaPath, func(w io.Writer) error {
+		_, err := w.Write(blob)
 		return err
-	}
-
-	if err := file.Sync(); err != nil {
+	}); err != nil {
 		return err
 	}
-
-	if runtime.GOOS != "windows" {
-		if err := os.Rename(metaPath+".new", metaPath); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return syncDir(q.location)
 }
 
 func (q *Queue) readMessageMeta(id string) (*QueueMetadata, error) {
-	metaPath := filepath.Join(q.location, id+".meta")
-	file, err := os.Open(metaPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	meta := &QueueMetadata{}
-
-	meta.MsgMeta = &module.MsgMetadata{}
-
-	// There is a couple of problems we have to solve before we would be able to
-	// serialize ConnState.
-	// 1. future.Future can't be serialized.
-	// 2. net.Addr can't be deserialized because we don't know the concrete type.
-
-	if err := json.NewDecoder(file).Decode(meta); err != nil {
-		return nil, err
-	}
-
-	return meta, nil
+	return readMetaFile(filepath.Join(q.location, id+".meta"))
 }
 
 type BufferedReadCloser struct {
@@ -857,8 +1166,10 @@ func (q *Queue) openMessage(id string) (*QueueMetadata, textproto.Header, buffer
 	}
 	body := buffer.FileBuffer{Path: bodyPath}
 
+	// Body checksum is verified only on start-up since it is expensive to
+	// do on each delivery attempt.
 	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Open(headerPath)
+	headerBlob, err := os.ReadFile(headerPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			q.tryRemoveDanglingFile(id + ".meta")
@@ -866,9 +1177,11 @@ func (q *Queue) openMessage(id string) (*QueueMetadata, textproto.Header, buffer
 		}
 		return nil, textproto.Header{}, nil, err
 	}
+	if meta.HeaderSum != "" && checksum(headerBlob) != meta.HeaderSum {
+		return nil, textproto.Header{}, nil, fmt.Errorf("header: %w", ErrChecksum)
+	}
 
-	bufferedHeader := bufio.NewReader(headerFile)
-	header, err := textproto.ReadHeader(bufferedHeader)
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(headerBlob)))
 	if err != nil {
 		return nil, textproto.Header{}, nil, err
 	}
@@ -884,7 +1197,60 @@ func (q *Queue) Name() string {
 	return "queue"
 }
 
-func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
+// BounceRecorder is implemented by modules that track permanent delivery
+// failures, such as check.suppression.
+type BounceRecorder interface {
+	RecordBounce(ctx context.Context, rcpt string, category dsn.Category, reason string) error
+}
+
+func (q *Queue) recordBounce(meta *QueueMetadata, rcpt string, category dsn.Category, reason string) {
+	if q.suppression == nil {
+		return
+	}
+
+	// Record the address as it was specified by the sender so it matches
+	// future submissions.
+	if originalRcpt := meta.MsgMeta.OriginalRcpts[rcpt]; originalRcpt != "" {
+		rcpt = originalRcpt
+	}
+	if err := q.suppression.RecordBounce(q.shutdownCtx, rcpt, category, reason); err != nil {
+		target.DeliveryLogger(q.Log, meta.MsgMeta).Error("failed to record bounce", err, "rcpt", rcpt)
+	}
+}
+
+// likelyForged reports whether the sender address of the message is likely
+// forged, that is both SPF and DMARC checks failed when the message was
+// received.
+func likelyForged(msgMeta *module.MsgMetadata) bool {
+	dmarcRes, _ := msgMeta.Annotations.GetString("dmarc.result")
+	spfRes, _ := msgMeta.Annotations.GetString("dmarc.spf_result")
+	return dmarcRes == "fail" && spfRes == "fail"
+}
+
+// expandBounceText returns the bounce_text contents with placeholders
+// replaced by the message details.
+func (q *Queue) expandBounceText(meta *QueueMetadata) string {
+	var senderDomain, brand string
+	if _, domain, err := address.Split(meta.MsgMeta.OriginalFrom); err == nil {
+		senderDomain = domain
+		brand = vdomain.Brand(domain)
+	}
+	if brand == "" {
+		brand = q.hostname
+	}
+
+	return strings.NewReplacer(
+		"{hostname}", q.hostname,
+		"{sender}", meta.MsgMeta.OriginalFrom,
+		"{sender_domain}", senderDomain,
+		"{brand}", brand,
+		"{msg_id}", meta.MsgMeta.ID,
+		"{arrival}", meta.FirstAttempt.Truncate(time.Second).String(),
+		"{last_attempt}", meta.LastAttempt.Truncate(time.Second).String(),
+	).Replace(q.bounceText)
+}
+
+func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, body buffer.Buffer, failedRcpts []string) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
 		return
@@ -895,6 +1261,17 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		return
 	}
 
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+
+	if q.bounceSuppressForged && likelyForged(meta.MsgMeta) {
+		dl.Msg("DSN suppressed, sender is likely forged", "rcpts", failedRcpts)
+		return
+	}
+	if !q.bounceRate.TryTake() {
+		dl.Msg("DSN suppressed, bounce_rate_limit exceeded", "rcpts", failedRcpts)
+		return
+	}
+
 	dsnID, err := module.GenerateMsgID()
 	if err != nil {
 		q.Log.Error("rand.Rand error", err)
@@ -916,6 +1293,9 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 	if !meta.MsgMeta.DontTraceSender && meta.MsgMeta.Conn != nil {
 		mtaInfo.ReceivedFromMTA = meta.MsgMeta.Conn.Hostname
 	}
+	if q.bounceText != "" {
+		mtaInfo.Text = q.expandBounceText(meta)
+	}
 
 	rcptInfo := make([]dsn.RecipientInfo, 0, len(meta.RcptErrs))
 	for _, rcpt := range failedRcpts {
@@ -936,9 +1316,25 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		})
 	}
 
+	ret := q.bounceReturn
+	var bodyReader io.Reader
+	if ret == dsn.ReturnFull {
+		// Include only headers if the message is too big.
+		if q.bounceMaxSize != 0 && int64(body.Len()) > q.bounceMaxSize {
+			ret = dsn.ReturnHeaders
+		} else {
+			r, err := body.Open()
+			if err != nil {
+				dl.Error("failed to open body for DSN", err)
+				return
+			}
+			defer r.Close()
+			bodyReader = r
+		}
+	}
+
 	var dsnBodyBlob bytes.Buffer
-	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
-	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
+	dsnHeader, err := dsn.GenerateDSNReturn(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, ret, header, bodyReader, &dsnBodyBlob)
 	if err != nil {
 		dl.Error("failed to generate fail DSN", err)
 		return
@@ -954,7 +1350,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 	}
 	dl.Msg("generated failed DSN", "dsn_id", dsnID)
 
-	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
+	msgCtx, msgTask := trace.NewTask(q.shutdownCtx, "DSN Delivery")
 	defer msgTask.End()
 
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
@@ -23,12 +23,16 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -38,6 +42,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dsn"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -253,6 +258,124 @@ func TestQueueDelivery(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_VERP(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.verp = true
+	q.verpDelim = "+"
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+
+	// Each recipient is delivered in a separate transaction.
+	msg1 := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	msg2 := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	q.Close()
+
+	if msg1.RcptTo[0] == "tester2@example.org" {
+		msg1, msg2 = msg2, msg1
+	}
+	testutils.CheckMsgID(t, msg1, "tester+tester1=example.org@example.com", []string{"tester1@example.org"}, "")
+	testutils.CheckMsgID(t, msg2, "tester+tester2=example.org@example.com", []string{"tester2@example.org"}, "")
+
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_Hold(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.holdRecheck = 50 * time.Millisecond
+	defer cleanQueue(t, q)
+
+	if err := q.Hold("EXAMPLE.net"); err != nil {
+		t.Fatal(err)
+	}
+	st, err := q.HoldState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.All || len(st.Domains) != 1 || st.Domains[0] != "example.net" {
+		t.Fatalf("unexpected hold state: %+v", st)
+	}
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.net"})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	// Held recipient should not be attempted.
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("held recipient delivered: %v", msg.RcptTo)
+	default:
+	}
+
+	if err := q.Release("example.net"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.net"}, "")
+}
+
+// denyingLocker is a cluster.Locker implementation that simulates locks
+// held by another instance.
+type denyingLocker struct {
+	lock sync.Mutex
+	deny bool
+}
+
+func (l *denyingLocker) setDeny(deny bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.deny = deny
+}
+
+func (l *denyingLocker) TryLock(_ context.Context, _ string) (func(), bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.deny {
+		return nil, false, nil
+	}
+	return func() {}, true, nil
+}
+
+func (l *denyingLocker) Close() error {
+	return nil
+}
+
+func TestQueueDelivery_ClusterLock(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	locker := &denyingLocker{deny: true}
+	q.locker = locker
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	// Message is locked by "another instance".
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("locked message delivered: %v", msg.RcptTo)
+	default:
+	}
+
+	// Message is not in the wheel anymore, rescan should pick it up.
+	locker.setDeny(false)
+	q.rescan()
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+}
+
 func TestQueueDelivery_PermanentFail_NonPartial(t *testing.T) {
 	t.Parallel()
 
@@ -400,6 +523,34 @@ func TestQueueDelivery_MultipleAttempts(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_Faults(t *testing.T) {
+	t.Parallel()
+
+	dt := &testutils.FaultyTarget{
+		Faults: testutils.Faults{
+			Seed:         1,
+			TempFailRate: 0.3,
+			RcptFailRate: 0.3,
+			Jitter:       5 * time.Millisecond,
+		},
+	}
+	q := newTestQueue(t, dt)
+	q.maxTries = 50
+	defer cleanQueue(t, q)
+
+	rcpts := []string{"tester1@example.org", "tester2@example.org", "tester3@example.org", "tester4@example.org"}
+	testutils.DoTestDelivery(t, q, "tester@example.com", rcpts)
+
+	testutils.WaitDelivered(t, dt, rcpts, 10*time.Second)
+	q.Close()
+
+	testutils.CheckDeliveredOnce(t, dt, rcpts)
+	if stats := dt.Stats(); stats.TempFailures+stats.RcptFailures == 0 {
+		t.Error("no faults were injected, test is not effective")
+	}
+	checkQueueDir(t, q, []string{})
+}
+
 func TestQueueDelivery_PermanentRcptReject(t *testing.T) {
 	t.Parallel()
 
@@ -506,6 +657,58 @@ func TestQueueDelivery_SerializationRoundtrip(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_AnnotationsRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.initialRetryTime = 1 * time.Second
+
+	annotations := module.NewAnnotations()
+	annotations.SetStrings("rspamd.symbols", []string{"BAYES_HAM", "R_SPF_ALLOW"})
+	annotations.SetInt("greylist.delay", 300)
+	annotations.SetFloat("rspamd.score", -1.5)
+	annotations.SetBool("greylist.passed", true)
+
+	deliveryID := testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		Annotations:  annotations,
+	})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	q.Close()
+	checkQueueDir(t, q, []string{deliveryID})
+	q = newTestQueueDir(t, &dt, q.location)
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	got := msg.MsgMeta.Annotations
+	if syms, _ := got.GetStrings("rspamd.symbols"); !reflect.DeepEqual(syms, []string{"BAYES_HAM", "R_SPF_ALLOW"}) {
+		t.Errorf("wrong rspamd.symbols: %v", syms)
+	}
+	if delay, ok := got.GetInt("greylist.delay"); !ok || delay != 300 {
+		t.Errorf("wrong greylist.delay: %v (%v)", delay, ok)
+	}
+	if score, ok := got.GetFloat("rspamd.score"); !ok || score != -1.5 {
+		t.Errorf("wrong rspamd.score: %v (%v)", score, ok)
+	}
+	if !got.Match("greylist.passed", "true") {
+		t.Errorf("greylist.passed does not match")
+	}
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
 func TestQueueDelivery_DeserlizationCleanUp(t *testing.T) {
 	t.Parallel()
 
@@ -561,6 +764,139 @@ func TestQueueDelivery_DeserlizationCleanUp(t *testing.T) {
 	})
 }
 
+func TestQueueDelivery_Quarantine(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.initialRetryTime = 1 * time.Second
+	q.postInitDelay = 0
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	q.Close()
+
+	bodyPath := filepath.Join(q.location, deliveryID+".body")
+	f, err := os.OpenFile(bodyPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("garbage"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Damaged entry should be quarantined during load.
+	q = newTestQueueDir(t, &dt, q.location)
+	q.Close()
+	if _, err := os.Stat(bodyPath + quarantineSuffix); err != nil {
+		t.Fatal("body is not quarantined:", err)
+	}
+
+	damaged, err := q.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damaged) != 1 || damaged[0].ID != deliveryID || !damaged[0].Quarantined || !errors.Is(damaged[0].Err, ErrChecksum) {
+		t.Fatalf("unexpected Verify result: %+v", damaged)
+	}
+
+	if err := q.Restore(deliveryID, false); err == nil {
+		t.Fatal("Restore without rehash should fail for damaged entry")
+	}
+	if err := q.Restore(deliveryID, true); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueDir(t, q, []string{deliveryID})
+
+	// Restored entry is delivered as is, damage included.
+	q = newTestQueueDir(t, &dt, q.location)
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if msg.MailFrom != "tester@example.com" || !reflect.DeepEqual(msg.RcptTo, []string{"tester1@example.org"}) {
+		t.Errorf("wrong envelope of the restored message: %s, %v", msg.MailFrom, msg.RcptTo)
+	}
+	if string(msg.Body) != "foobar\r\ngarbage" {
+		t.Errorf("wrong body of the restored message: %q", msg.Body)
+	}
+	q.Close()
+}
+
+func TestQueueDelivery_AttemptHistory(t *testing.T) {
+	t.Parallel()
+
+	events := make(chan attemptEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev attemptEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		events <- ev
+	}))
+	defer srv.Close()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.initialRetryTime = 1 * time.Second
+	q.attemptWebhook = srv.URL
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	var ev attemptEvent
+	select {
+	case ev = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook is not called")
+	}
+	if ev.Event != "queue.delivery_attempt" || ev.MsgID != deliveryID || len(ev.Attempts) != 2 {
+		t.Errorf("unexpected webhook payload: %+v", ev)
+	}
+	if !reflect.DeepEqual(ev.Pending, []string{"tester1@example.org"}) {
+		t.Errorf("wrong pending recipients: %v", ev.Pending)
+	}
+
+	// Wait for the meta-data update.
+	q.Close()
+
+	meta, err := q.Entry(deliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %+v", meta.Attempts)
+	}
+	for _, a := range meta.Attempts {
+		switch a.Rcpt {
+		case "tester1@example.org":
+			if a.Code != 451 {
+				t.Errorf("wrong code for failed attempt: %+v", a)
+			}
+		case "tester2@example.org":
+			if a.Code != 250 {
+				t.Errorf("wrong code for successful attempt: %+v", a)
+			}
+		default:
+			t.Errorf("unexpected recipient: %+v", a)
+		}
+	}
+}
+
 func TestQueueDelivery_AbortIfNoRecipients(t *testing.T) {
 	t.Parallel()
 
@@ -823,6 +1159,166 @@ func TestQueueDSN_RcptRewrite(t *testing.T) {
 	}
 }
 
+func TestQueueDSN_ReturnFull(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.bounceReturn = dsn.ReturnFull
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+
+	if !bytes.Contains(msg.Body, []byte("message/rfc822")) {
+		t.Errorf("DSN does not contain the original message part")
+	}
+	if !bytes.Contains(msg.Body, []byte("foobar")) {
+		t.Errorf("DSN does not contain the original message body")
+	}
+}
+
+func TestQueueDSN_BounceText(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.bounceText = "This is {brand}, contact support@{sender_domain}.\n"
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+
+	if !bytes.Contains(msg.Body, []byte("This is mx.example.org, contact support@example.com.")) {
+		t.Errorf("DSN does not contain the bounce_text: %s", msg.Body)
+	}
+	if bytes.Contains(msg.Body, []byte("This is the mail delivery system")) {
+		t.Errorf("DSN contains the default text")
+	}
+}
+
+func TestQueueDSN_SuppressForged(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.bounceSuppressForged = true
+	defer cleanQueue(t, q)
+
+	annotations := module.NewAnnotations()
+	annotations.SetString("dmarc.result", "fail")
+	annotations.SetString("dmarc.spf_result", "fail")
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		Annotations:  annotations,
+	})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	time.Sleep(1 * time.Second)
+
+	// There should be no DSN for it.
+	if dsnTarget.passedMessages != 0 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueMaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxLifetime = time.Nanosecond
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	// Wait for message delivery attempt to complete (aborted because all recipients fail).
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// Temporary failure is handled as permanent one since the message
+	// expired already.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("5.4.7")) {
+		t.Errorf("DSN does not contain 5.4.7 status code")
+	}
+
+	time.Sleep(1 * time.Second)
+	if dt.passedMessages != 1 {
+		t.Errorf("wrong amount of delivery attempts: %d", dt.passedMessages)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
 func init() {
 	dontRecover = true
 }
@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// releaseAtField is the header field used by submission clients to request
+// delivery of the message at the specified time.
+const releaseAtField = "X-Release-At"
+
+// parseReleaseAt parses the value of X-Release-At field. Both RFC 3339 and
+// RFC 5322 date formats are accepted.
+func parseReleaseAt(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := mail.ParseDate(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed %s value: %s", releaseAtField, value)
+	}
+	return t, nil
+}
+
+// releaseTime returns the release time requested for the message, if any,
+// and removes the request from the header.
+//
+// Only requests from authenticated senders are honored. The field is
+// removed from other messages too so it does not leak to recipients.
+func (q *Queue) releaseTime(msgMeta *module.MsgMetadata, header *textproto.Header, now time.Time) (time.Time, error) {
+	if !q.allowScheduled || !header.Has(releaseAtField) {
+		return time.Time{}, nil
+	}
+	value := header.Get(releaseAtField)
+	header.Del(releaseAtField)
+
+	if msgMeta.Conn == nil || msgMeta.Conn.AuthUser == "" {
+		return time.Time{}, nil
+	}
+
+	releaseAt, err := parseReleaseAt(value)
+	if err != nil {
+		return time.Time{}, &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "Malformed " + releaseAtField + " header field",
+			TargetName:   "queue",
+			Err:          err,
+		}
+	}
+	if !releaseAt.After(now) {
+		return time.Time{}, nil
+	}
+	if releaseAt.Sub(now) > q.maxScheduleDelay {
+		return time.Time{}, &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "Release time is too far in the future",
+			TargetName:   "queue",
+		}
+	}
+	return releaseAt.UTC(), nil
+}
+
+// ScheduledEntry describes the message held in the queue until the release
+// time requested by the sender.
+type ScheduledEntry struct {
+	ID        string
+	From      string
+	To        []string
+	ReleaseAt time.Time
+}
+
+// Scheduled returns messages in the queue with release time in the future,
+// sorted by the release time.
+func (q *Queue) Scheduled() ([]ScheduledEntry, error) {
+	dirInfo, err := os.ReadDir(q.location)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var res []ScheduledEntry
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".meta")
+		meta, err := q.readMessageMeta(id)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		if !meta.ReleaseAt.After(now) {
+			continue
+		}
+		res = append(res, ScheduledEntry{
+			ID:        id,
+			From:      meta.From,
+			To:        meta.To,
+			ReleaseAt: meta.ReleaseAt,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ReleaseAt.Before(res[j].ReleaseAt)
+	})
+	return res, nil
+}
+
+// Cancel removes the scheduled message from the queue before it is
+// released. No bounce message is sent.
+func (q *Queue) Cancel(id string) error {
+	meta, err := q.readMessageMeta(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no such queue entry: %s", id)
+		}
+		return err
+	}
+	if !meta.ReleaseAt.After(time.Now()) {
+		return fmt.Errorf("message %s is not scheduled or is already released", id)
+	}
+	return q.Drop(id)
+}
@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestQueueReleaseTime(t *testing.T) {
+	q := &Queue{allowScheduled: true, maxScheduleDelay: 24 * time.Hour}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	authMeta := &module.MsgMetadata{Conn: &module.ConnState{AuthUser: "user"}}
+
+	test := func(meta *module.MsgMetadata, value string, want time.Time, fail bool) {
+		t.Helper()
+		var hdr textproto.Header
+		hdr.Add(releaseAtField, value)
+		got, err := q.releaseTime(meta, &hdr, now)
+		if fail {
+			if err == nil {
+				t.Errorf("%q: expected an error", value)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", value, err)
+			return
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q: want %v, got %v", value, want, got)
+		}
+		if hdr.Has(releaseAtField) {
+			t.Errorf("%q: field is not removed", value)
+		}
+	}
+
+	test(authMeta, "2024-06-01T15:00:00+02:00", now.Add(1*time.Hour), false)
+	test(authMeta, "Sat, 01 Jun 2024 14:00:00 +0000", now.Add(2*time.Hour), false)
+	test(authMeta, "2024-06-01T11:00:00Z", time.Time{}, false)
+	test(authMeta, "2024-06-03T12:00:00Z", time.Time{}, true)
+	test(authMeta, "tomorrow", time.Time{}, true)
+	test(&module.MsgMetadata{Conn: &module.ConnState{}}, "2024-06-01T15:00:00Z", time.Time{}, false)
+	test(&module.MsgMetadata{}, "2024-06-01T15:00:00Z", time.Time{}, false)
+}
+
+func TestQueueNextTryTime_Scheduled(t *testing.T) {
+	q := &Queue{}
+	now := time.Now()
+	meta := &QueueMetadata{
+		FirstAttempt: now,
+		LastAttempt:  now,
+		ReleaseAt:    now.Add(time.Hour),
+	}
+	if got := q.nextTryTime(meta); !got.Equal(meta.ReleaseAt) {
+		t.Errorf("want %v, got %v", meta.ReleaseAt, got)
+	}
+}
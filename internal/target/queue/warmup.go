@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// warmupFile is the name of the file in the queue directory that contains
+// per-group counters of the current warm-up day.
+const warmupFile = "warmup.json"
+
+// warmupSchedule limits the amount of recipients messages are sent to per
+// day for each destination group, the limit increases each day.
+type warmupSchedule struct {
+	start  time.Time
+	limits []int
+	// Normalized domain -> group name. Domains not listed are in the group
+	// of their own.
+	groups map[string]string
+
+	path  string
+	lock  sync.Mutex
+	state warmupState
+}
+
+type warmupState struct {
+	Day    int            `json:"day"`
+	Counts map[string]int `json:"counts"`
+}
+
+func warmupDirective(m *config.Map, node config.Node) (interface{}, error) {
+	ws := &warmupSchedule{
+		groups: make(map[string]string),
+	}
+
+	var start string
+	child := config.NewMap(m.Globals, node)
+	child.String("start", false, true, "", &start)
+	child.Callback("schedule", func(_ *config.Map, n config.Node) error {
+		if len(n.Args) == 0 {
+			return config.NodeErr(n, "at least one limit is required")
+		}
+		for _, arg := range n.Args {
+			limit, err := strconv.Atoi(arg)
+			if err != nil || limit <= 0 {
+				return config.NodeErr(n, "invalid limit: %s", arg)
+			}
+			ws.limits = append(ws.limits, limit)
+		}
+		return nil
+	})
+	child.Callback("group", func(_ *config.Map, n config.Node) error {
+		if len(n.Args) < 2 {
+			return config.NodeErr(n, "expected group name and at least one domain")
+		}
+		for _, d := range n.Args[1:] {
+			domain, err := dns.ForLookup(d)
+			if err != nil {
+				return config.NodeErr(n, "invalid domain: %s", d)
+			}
+			if g, ok := ws.groups[domain]; ok {
+				return config.NodeErr(n, "domain %s is already in group %s", domain, g)
+			}
+			ws.groups[domain] = n.Args[0]
+		}
+		return nil
+	})
+	if _, err := child.Process(); err != nil {
+		return nil, err
+	}
+
+	if len(ws.limits) == 0 {
+		return nil, config.NodeErr(node, "schedule is required")
+	}
+	var err error
+	ws.start, err = time.ParseInLocation("2006-01-02", start, time.UTC)
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid start date, expected YYYY-MM-DD: %v", err)
+	}
+
+	return ws, nil
+}
+
+// day returns the number of the warm-up day, starting from 0.
+func (ws *warmupSchedule) day(now time.Time) int {
+	if now.Before(ws.start) {
+		return 0
+	}
+	return int(now.Sub(ws.start) / (24 * time.Hour))
+}
+
+// limit returns the limit for the specified day, -1 means no limit.
+func (ws *warmupSchedule) limit(day int) int {
+	if day >= len(ws.limits) {
+		return -1
+	}
+	return ws.limits[day]
+}
+
+func (ws *warmupSchedule) group(rcpt string) string {
+	_, d, err := address.Split(rcpt)
+	if err != nil {
+		return ""
+	}
+	domain, err := dns.ForLookup(d)
+	if err != nil {
+		return d
+	}
+	if g, ok := ws.groups[domain]; ok {
+		return g
+	}
+	return domain
+}
+
+func (ws *warmupSchedule) load(path string) error {
+	ws.path = path
+	ws.state = warmupState{Counts: map[string]int{}}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(blob, &ws.state); err != nil {
+		return fmt.Errorf("malformed warm-up state file %s: %w", path, err)
+	}
+	if ws.state.Counts == nil {
+		ws.state.Counts = map[string]int{}
+	}
+	return nil
+}
+
+func (ws *warmupSchedule) save() error {
+	blob, err := json.Marshal(ws.state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ws.path+".tmp", blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(ws.path+".tmp", ws.path)
+}
+
+// take splits the list of recipients into ones that can be attempted now
+// and ones that exceed the daily limit of their group. Counters are
+// increased for returned active recipients.
+func (ws *warmupSchedule) take(now time.Time, rcpts []string) (active, deferred []string, err error) {
+	day := ws.day(now)
+	limit := ws.limit(day)
+	if limit == -1 {
+		return rcpts, nil, nil
+	}
+
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	if ws.state.Day != day {
+		ws.state = warmupState{Day: day, Counts: map[string]int{}}
+	}
+
+	active = make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		g := ws.group(rcpt)
+		if ws.state.Counts[g] >= limit {
+			deferred = append(deferred, rcpt)
+			continue
+		}
+		ws.state.Counts[g]++
+		active = append(active, rcpt)
+	}
+
+	if len(active) != 0 && ws.path != "" {
+		err = ws.save()
+	}
+	return active, deferred, err
+}
+
+// splitWarmup splits the list of recipients into ones that should be
+// attempted now and ones that are deferred due to warm-up limits.
+func (q *Queue) splitWarmup(rcpts []string) (active, deferred []string) {
+	if q.warmup == nil {
+		return rcpts, nil
+	}
+
+	active, deferred, err := q.warmup.take(time.Now(), rcpts)
+	if err != nil {
+		q.Log.Error("failed to save warm-up state", err)
+	}
+	return active, deferred
+}
@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestWarmupSchedule(t *testing.T) {
+	v, err := warmupDirective(config.NewMap(nil, config.Node{}), config.Node{
+		Name: "warmup",
+		Children: []config.Node{
+			{Name: "start", Args: []string{"2024-01-01"}},
+			{Name: "schedule", Args: []string{"1", "2"}},
+			{Name: "group", Args: []string{"big", "example.org", "example.net"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := v.(*warmupSchedule)
+	path := filepath.Join(t.TempDir(), warmupFile)
+	if err := ws.load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	day0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	active, deferred, err := ws.take(day0, []string{"a@example.org", "b@example.net", "c@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(active, []string{"a@example.org", "c@example.com"}) {
+		t.Errorf("wrong active recipients: %v", active)
+	}
+	if !reflect.DeepEqual(deferred, []string{"b@example.net"}) {
+		t.Errorf("wrong deferred recipients: %v", deferred)
+	}
+
+	// State is persisted.
+	ws2 := &warmupSchedule{start: ws.start, limits: ws.limits, groups: ws.groups}
+	if err := ws2.load(path); err != nil {
+		t.Fatal(err)
+	}
+	_, deferred, _ = ws2.take(day0, []string{"d@example.org"})
+	if len(deferred) != 1 {
+		t.Errorf("counters are not restored: %v", ws2.state)
+	}
+
+	// Next day - higher limit.
+	day1 := day0.Add(24 * time.Hour)
+	active, _, _ = ws.take(day1, []string{"a@example.org", "b@example.net", "c@example.org"})
+	if len(active) != 2 {
+		t.Errorf("wrong limit for the second day: %v", active)
+	}
+
+	// Schedule is over.
+	day2 := day0.Add(48 * time.Hour)
+	active, _, _ = ws.take(day2, []string{"a@example.org", "b@example.net", "c@example.org"})
+	if len(active) != 3 {
+		t.Errorf("limit is applied after the schedule end: %v", active)
+	}
+}
@@ -28,80 +28,190 @@ import (
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/vdomain"
 )
 
 func SanitizeForHeader(raw string) string {
 	return strings.Replace(raw, "\n", "", -1)
 }
 
+// Values for ReceivedOptions.AuthClient.
+const (
+	// ReceivedFull includes the client hostname and IP address.
+	ReceivedFull = "full"
+
+	// ReceivedRedact hides the client hostname and includes only the
+	// network part of the IP address.
+	ReceivedRedact = "redact"
+
+	// ReceivedOmit does not include any client information.
+	ReceivedOmit = "omit"
+)
+
+// ReceivedOptions controls the format of the Received header field generated
+// by GenerateReceivedOpts.
+type ReceivedOptions struct {
+	// Template is the field value with placeholders replaced by the message
+	// details. If it is empty, the default format is used.
+	//
+	// Supported placeholders: {client}, {helo}, {rdns}, {ip}, {by},
+	// {sender}, {sender_domain}, {brand}, {proto}, {id}, {date}.
+	//
+	// {brand} is the brand name of the sender domain if it is declared
+	// using virtual_domain.
+	Template string
+
+	// AuthClient is one of Received* constants and controls how the client
+	// information is included for authenticated sessions. Empty value is
+	// equivalent to ReceivedFull.
+	AuthClient string
+}
+
+// redactIP returns the IP address with the host part zeroed, /24 is used for
+// IPv4 and /48 is used for IPv6.
+func redactIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
 func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostname, mailFrom string) (string, error) {
+	return GenerateReceivedOpts(ctx, msgMeta, ourHostname, mailFrom, ReceivedOptions{})
+}
+
+func GenerateReceivedOpts(ctx context.Context, msgMeta *module.MsgMetadata, ourHostname, mailFrom string, opts ReceivedOptions) (string, error) {
 	if msgMeta.Conn == nil {
 		return "", errors.New("can't generate Received for a locally generated message")
 	}
 
-	builder := strings.Builder{}
-
-	// Empirically guessed value that should be enough to fit
-	// the entire value in most cases.
-	builder.Grow(256 + len(msgMeta.Conn.Hostname))
-
-	if !msgMeta.DontTraceSender && (strings.Contains(msgMeta.Conn.Proto, "SMTP") ||
+	mode := ReceivedFull
+	if msgMeta.Conn.AuthUser != "" && opts.AuthClient != "" {
+		mode = opts.AuthClient
+	}
+	if msgMeta.DontTraceSender || !(strings.Contains(msgMeta.Conn.Proto, "SMTP") ||
 		strings.Contains(msgMeta.Conn.Proto, "LMTP")) {
+		mode = ReceivedOmit
+	}
+
+	var helo, rdns, ip string
+	switch mode {
+	case ReceivedFull:
 		// INTERNATIONALIZATION: See RFC 6531 Section 3.7.3.
 		hostname, err := dns.SelectIDNA(msgMeta.SMTPOpts.UTF8, msgMeta.Conn.Hostname)
 		if err == nil {
-			builder.WriteString("from ")
-			builder.WriteString(hostname)
+			helo = SanitizeForHeader(hostname)
 		}
 
 		if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
-			builder.WriteString(" (")
 			if msgMeta.Conn.RDNSName != nil {
 				rdnsName, err := msgMeta.Conn.RDNSName.GetContext(ctx)
 				if err == nil && rdnsName != nil && rdnsName.(string) != "" {
 					// INTERNATIONALIZATION: See RFC 6531 Section 3.7.3.
 					encoded, err := dns.SelectIDNA(msgMeta.SMTPOpts.UTF8, rdnsName.(string))
 					if err == nil {
-						builder.WriteString(encoded)
-						builder.WriteRune(' ')
+						rdns = SanitizeForHeader(encoded)
 					}
 				}
 			}
-			builder.WriteRune('[')
-			builder.WriteString(tcpAddr.IP.String())
-			builder.WriteString("])")
+			ip = tcpAddr.IP.String()
+		}
+	case ReceivedRedact:
+		helo = "redacted"
+		if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+			ip = redactIP(tcpAddr.IP).String()
 		}
 	}
 
+	var by string
 	if ourHostname != "" {
 		ourHostname, err := dns.SelectIDNA(msgMeta.SMTPOpts.UTF8, ourHostname)
 		if err == nil {
-			builder.WriteString(" by ")
-			builder.WriteString(SanitizeForHeader(ourHostname))
+			by = SanitizeForHeader(ourHostname)
 		}
 	}
 
+	var sender, senderDomain, brand string
 	if mailFrom != "" {
 		// INTERNATIONALIZATION: See RFC 6531 Section 3.7.3.
 		mailFrom, err := address.SelectIDNA(msgMeta.SMTPOpts.UTF8, mailFrom)
 		if err == nil {
-			builder.WriteString(" (envelope-sender <")
-			builder.WriteString(SanitizeForHeader(mailFrom))
-			builder.WriteString(">)")
+			sender = SanitizeForHeader(mailFrom)
+		}
+		if _, domain, err := address.Split(sender); err == nil {
+			senderDomain = domain
+			brand = SanitizeForHeader(vdomain.Brand(domain))
 		}
 	}
 
+	var proto string
 	if msgMeta.Conn.Proto != "" {
-		builder.WriteString(" with ")
 		if msgMeta.SMTPOpts.UTF8 {
-			builder.WriteString("UTF8")
+			proto = "UTF8"
 		}
-		builder.WriteString(msgMeta.Conn.Proto)
+		proto += msgMeta.Conn.Proto
+	}
+
+	date := time.Now().Format(time.RFC1123Z)
+
+	client := strings.Builder{}
+	if helo != "" {
+		client.WriteString("from ")
+		client.WriteString(helo)
+	}
+	if ip != "" {
+		client.WriteString(" (")
+		if rdns != "" {
+			client.WriteString(rdns)
+			client.WriteRune(' ')
+		}
+		client.WriteRune('[')
+		client.WriteString(ip)
+		client.WriteString("])")
+	}
+
+	if opts.Template != "" {
+		expanded := strings.NewReplacer(
+			"{client}", client.String(),
+			"{helo}", helo,
+			"{rdns}", rdns,
+			"{ip}", ip,
+			"{by}", by,
+			"{sender}", sender,
+			"{sender_domain}", senderDomain,
+			"{brand}", brand,
+			"{proto}", proto,
+			"{id}", msgMeta.ID,
+			"{date}", date,
+		).Replace(opts.Template)
+		// Collapse whitespace left by empty values.
+		return SanitizeForHeader(strings.Join(strings.Fields(expanded), " ")), nil
+	}
+
+	builder := strings.Builder{}
+
+	// Empirically guessed value that should be enough to fit
+	// the entire value in most cases.
+	builder.Grow(256 + len(msgMeta.Conn.Hostname))
+
+	builder.WriteString(client.String())
+	if by != "" {
+		builder.WriteString(" by ")
+		builder.WriteString(by)
+	}
+	if sender != "" {
+		builder.WriteString(" (envelope-sender <")
+		builder.WriteString(sender)
+		builder.WriteString(">)")
+	}
+	if proto != "" {
+		builder.WriteString(" with ")
+		builder.WriteString(proto)
 	}
 	builder.WriteString(" id ")
 	builder.WriteString(msgMeta.ID)
 	builder.WriteString("; ")
-	builder.WriteString(time.Now().Format(time.RFC1123Z))
+	builder.WriteString(date)
 
 	return strings.TrimSpace(builder.String()), nil
 }
@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package target
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/vdomain"
+)
+
+func TestGenerateReceivedOpts(t *testing.T) {
+	test := func(authUser string, opts ReceivedOptions, expectedPrefix string) {
+		t.Helper()
+
+		msgMeta := &module.MsgMetadata{
+			ID: "msgid",
+			Conn: &module.ConnState{
+				Hostname:   "client.example.org",
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 34), Port: 1234},
+				Proto:      "ESMTPS",
+				AuthUser:   authUser,
+			},
+		}
+		received, err := GenerateReceivedOpts(context.Background(), msgMeta, "mx.example.com", "test@example.org", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(received, expectedPrefix) {
+			t.Errorf("wrong Received value: %q, expected prefix %q", received, expectedPrefix)
+		}
+	}
+
+	full := "from client.example.org ([192.0.2.34]) by mx.example.com (envelope-sender <test@example.org>) with ESMTPS id msgid; "
+
+	test("", ReceivedOptions{}, full)
+	test("", ReceivedOptions{AuthClient: ReceivedOmit}, full)
+	test("user", ReceivedOptions{}, full)
+	test("user", ReceivedOptions{AuthClient: ReceivedOmit},
+		"by mx.example.com (envelope-sender <test@example.org>) with ESMTPS id msgid; ")
+	test("user", ReceivedOptions{AuthClient: ReceivedRedact},
+		"from redacted ([192.0.2.0]) by mx.example.com (envelope-sender <test@example.org>) with ESMTPS id msgid; ")
+	test("", ReceivedOptions{Template: "{client} by {by} with {proto} id {id}"},
+		"from client.example.org ([192.0.2.34]) by mx.example.com with ESMTPS id msgid")
+	test("user", ReceivedOptions{Template: "{client} by {by} id {id}", AuthClient: ReceivedOmit},
+		"by mx.example.com id msgid")
+
+	if err := vdomain.Set([]vdomain.Domain{{Name: "example.org", Brand: "Example Mail"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer vdomain.Set(nil)
+	test("user", ReceivedOptions{Template: "by {by} ({brand}, {sender_domain}) id {id}"},
+		"by mx.example.com (Example Mail, example.org) id msgid")
+}
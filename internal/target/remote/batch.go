@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func sameHost(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// sharedConnection returns the connection already used in this transaction
+// for another domain if it goes to one of the most preferred MXs of the
+// domain and satisfies security policies for it. nil is returned otherwise,
+// errors are not reported since the regular connection attempt will report
+// them.
+//
+// This allows to deliver the message to recipients in different domains
+// hosted by the same provider using a single SMTP transaction.
+func (rd *remoteDelivery) sharedConnection(ctx context.Context, domain string) *mxConn {
+	if !rd.rt.batchByMX || len(rd.connections) == 0 {
+		return nil
+	}
+
+	dnssecOk, records, err := rd.lookupMX(ctx, domain)
+	if err != nil || len(records) == 0 {
+		return nil
+	}
+
+	for _, conn := range rd.uniqueConns() {
+		if conn.errored || conn.Client() == nil {
+			continue
+		}
+		for _, record := range records {
+			if record.Pref != records[0].Pref {
+				break
+			}
+			if !sameHost(record.Host, conn.mx) {
+				continue
+			}
+			if !rd.policiesAllow(ctx, conn, domain, record.Host, dnssecOk) {
+				continue
+			}
+			return conn
+		}
+	}
+	return nil
+}
+
+// policiesAllow checks whether the existing connection could be used to
+// deliver messages to the domain according to MX authentication policies.
+func (rd *remoteDelivery) policiesAllow(ctx context.Context, conn *mxConn, domain, mx string, dnssecOk bool) bool {
+	for _, p := range rd.policies {
+		p.PrepareDomain(ctx, domain)
+	}
+
+	mxLevel := module.MXNone
+	for _, p := range rd.policies {
+		policyLevel, err := p.CheckMX(ctx, mxLevel, domain, mx, dnssecOk)
+		if err != nil {
+			rd.Log.DebugMsg("connection can't be shared", "reason", err, "domain", domain, "remote_server", mx)
+			return false
+		}
+		if policyLevel > mxLevel {
+			mxLevel = policyLevel
+		}
+		p.PrepareConn(ctx, mx)
+	}
+
+	tlsLevel := conn.connTLSLevel
+	tlsState, _ := conn.Client().TLSConnectionState()
+	for _, p := range rd.policies {
+		policyLevel, err := p.CheckConn(ctx, mxLevel, tlsLevel, domain, mx, tlsState)
+		if err != nil {
+			rd.Log.DebugMsg("connection can't be shared", "reason", err, "domain", domain, "remote_server", mx)
+			return false
+		}
+		if policyLevel > tlsLevel {
+			tlsLevel = policyLevel
+		}
+	}
+
+	// REQUIRETLS checks in connectionForDomain are done only for the
+	// first domain.
+	if rd.msgMeta.SMTPOpts.RequireTLS && (tlsLevel < module.TLSAuthenticated || mxLevel < module.MX_MTASTS) {
+		return false
+	}
+	return true
+}
+
+// uniqueConns returns the list of connections used in this transaction,
+// each connection is listed once even if it is used for multiple domains.
+func (rd *remoteDelivery) uniqueConns() []*mxConn {
+	res := make([]*mxConn, 0, len(rd.connections))
+	seen := make(map[*mxConn]struct{}, len(rd.connections))
+	for _, conn := range rd.connections {
+		if _, ok := seen[conn]; ok {
+			continue
+		}
+		seen[conn] = struct{}{}
+		res = append(res, conn)
+	}
+	return res
+}
@@ -32,14 +32,23 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
 	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
+	"github.com/foxcpp/maddy/internal/tracing"
 )
 
 type mxConn struct {
 	*smtpconn.C
 
 	// Domain this MX belongs to.
-	domain   string
+	domain  string
+	poolKey string
+	// Other domains delivered to using this connection in the current
+	// transaction, see sharedConnection.
+	extraDomains []string
+	// MX hostname the connection is established to.
+	mx       string
 	dnssecOk bool
 
 	// Errors occurred previously on this connection.
@@ -54,6 +63,8 @@ type mxConn struct {
 	// MX/TLS security level established for this connection.
 	mxLevel  module.MXLevel
 	tlsLevel module.TLSLevel
+	// TLS security level before application of MX authentication policies.
+	connTLSLevel module.TLSLevel
 }
 
 func (c *mxConn) Usable() bool {
@@ -96,8 +107,8 @@ func isVerifyError(err error) bool {
 // - tlsErr      Error that prevented TLS from working if tlsLevel != TLSAuthenticated
 func (rd *remoteDelivery) connect(ctx context.Context, conn mxConn, host string, tlsCfg *tls.Config) (tlsLevel module.TLSLevel, tlsErr, err error) {
 	tlsLevel = module.TLSAuthenticated
-	if rd.rt.tlsConfig != nil {
-		tlsCfg = rd.rt.tlsConfig.Clone()
+	if rd.tlsConfig != nil {
+		tlsCfg = rd.tlsConfig.Clone()
 		tlsCfg.ServerName = host
 	}
 
@@ -111,8 +122,10 @@ retry:
 		Port: smtpPort,
 	}, false, nil)
 	if err != nil {
+		rd.rt.mxHealth.failed(host)
 		return module.TLSNone, nil, err
 	}
+	rd.rt.mxHealth.succeeded(host)
 
 	starttlsOk, _ := conn.Client().Extension("STARTTLS")
 	if starttlsOk && tlsCfg != nil {
@@ -127,7 +140,14 @@ retry:
 			// error happens with InsecureSkipVerify too (e.g. certificate is
 			// *too* broken).
 			if isVerifyError(err) && tlsLevel == module.TLSAuthenticated {
+				tlsrpt.RecordFailure(conn.domain, tlsResultType(err), host, err.Error())
 				rd.Log.Error("TLS verify error, trying without authentication", err, "remote_server", host, "domain", conn.domain)
+				audit.Event(audit.TLSDowngrade,
+					"direction", "outbound",
+					"remote_server", host,
+					"domain", conn.domain,
+					"tls_level", module.TLSEncrypted.String(),
+					"reason", err.Error())
 				tlsCfg.InsecureSkipVerify = true
 				tlsLevel = module.TLSEncrypted
 
@@ -139,6 +159,10 @@ retry:
 			}
 
 			rd.Log.Error("TLS error, trying plaintext", err, "remote_server", host, "domain", conn.domain)
+			if tlsLevel == module.TLSAuthenticated {
+				tlsrpt.RecordFailure(conn.domain, tlsrpt.ValidationFailure, host, err.Error())
+			}
+			rd.downgrade(conn.domain, host, "handshake_failed", err.Error())
 			tlsCfg = nil
 			tlsLevel = module.TLSNone
 			conn.DirectClose()
@@ -146,9 +170,30 @@ retry:
 			goto retry
 		}
 	} else {
+		if tlsCfg != nil {
+			tlsrpt.RecordFailure(conn.domain, tlsrpt.STARTTLSNotSupported, host, "")
+			// The domain used TLS before, STARTTLS is likely stripped by
+			// an active attacker.
+			if rd.rt.tlsHistory.seenTLS(conn.domain) {
+				rd.Log.Msg("STARTTLS is not offered while it was used before", "remote_server", host, "domain", conn.domain)
+				rd.downgrade(conn.domain, host, "starttls_stripped", "STARTTLS is not offered while it was used before")
+			}
+		}
 		tlsLevel = module.TLSNone
 	}
 
+	if tlsLevel == module.TLSNone {
+		if err := rd.downgradeBlocked(conn.domain); err != nil {
+			conn.Close()
+			return module.TLSNone, tlsErr, err
+		}
+	} else {
+		rd.rt.tlsHistory.markTLS(conn.domain)
+		if tlsLevel == module.TLSAuthenticated {
+			tlsrpt.RecordSuccess(conn.domain)
+		}
+	}
+
 	return tlsLevel, tlsErr, nil
 }
 
@@ -171,10 +216,11 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 		p.PrepareConn(ctx, record.Host)
 	}
 
-	tlsLevel, tlsErr, err := rd.connect(connCtx, *conn, record.Host, rd.rt.tlsConfig)
+	tlsLevel, tlsErr, err := rd.connect(connCtx, *conn, record.Host, rd.tlsConfig)
 	if err != nil {
 		return err
 	}
+	connTLSLevel := tlsLevel
 
 	// Make decision based on the policy and connection state.
 	//
@@ -193,8 +239,10 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 		}
 	}
 
+	conn.mx = record.Host
 	conn.mxLevel = mxLevel
 	conn.tlsLevel = tlsLevel
+	conn.connTLSLevel = connTLSLevel
 
 	mxLevelCnt.WithLabelValues(rd.rt.Name(), mxLevel.String()).Inc()
 	tlsLevelCnt.WithLabelValues(rd.rt.Name(), tlsLevel.String()).Inc()
@@ -207,7 +255,21 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 		return c, nil
 	}
 
-	pooledConn, err := rd.rt.pool.Get(ctx, domain)
+	if c := rd.sharedConnection(ctx, domain); c != nil {
+		region := trace.StartRegion(ctx, "remote/limits.TakeDest")
+		err := rd.rt.limits.TakeDest(ctx, domain)
+		region.End()
+		if err != nil {
+			return nil, err
+		}
+
+		rd.Log.DebugMsg("sharing connection", "domain", domain, "conn_domain", c.domain, "remote_server", c.mx)
+		c.extraDomains = append(c.extraDomains, domain)
+		rd.connections[domain] = c
+		return c, nil
+	}
+
+	pooledConn, err := rd.rt.pool.Get(ctx, rd.poolKey(domain))
 	if err != nil {
 		return nil, err
 	}
@@ -288,12 +350,13 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 		reuseLimit: rd.rt.connReuseLimit,
 		C:          smtpconn.New(),
 		domain:     domain,
+		poolKey:    rd.poolKey(domain),
 		lastUseAt:  time.Now(),
 	}
 
 	conn.Dialer = rd.rt.dialer
 	conn.Log = rd.Log
-	conn.Hostname = rd.rt.hostname
+	conn.Hostname = rd.hostname
 	conn.AddrInSMTPMsg = true
 	if rd.rt.connectTimeout != 0 {
 		conn.ConnectTimeout = rd.rt.connectTimeout
@@ -310,12 +373,17 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	}
 
 	region := trace.StartRegion(ctx, "remote/LookupMX")
+	_, span := tracing.Start(ctx, "remote.lookup_mx", "maddy.domain", domain)
 	dnssecOk, records, err := rd.lookupMX(ctx, domain)
+	span.SetAttrs("maddy.mx_count", len(records), "maddy.dnssec", dnssecOk)
+	span.SetError(err)
+	span.End()
 	region.End()
 	if err != nil {
 		return nil, err
 	}
 	conn.dnssecOk = dnssecOk
+	rd.rt.mxHealth.order(records)
 
 	var lastErr error
 	region = trace.StartRegion(ctx, "remote/Connect+TLS")
@@ -328,7 +396,12 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 			}
 		}
 
-		if err := rd.attemptMX(ctx, &conn, record); err != nil {
+		mxCtx, span := tracing.Start(ctx, "remote.connect", "maddy.domain", domain, "net.peer.name", record.Host)
+		span.SetKind(tracing.KindClient)
+		err := rd.attemptMX(mxCtx, &conn, record)
+		span.SetError(err)
+		span.End()
+		if err != nil {
 			if len(records) != 0 {
 				rd.Log.Error("cannot use MX", err, "remote_server", record.Host, "domain", domain)
 			}
@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/audit"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
+)
+
+const (
+	// tlsHistoryTTL is how long the successful use of TLS with a domain is
+	// remembered for STARTTLS stripping detection.
+	tlsHistoryTTL = 7 * 24 * time.Hour
+
+	// tlsHistoryMax is the amount of entries after which expired ones are
+	// pruned.
+	tlsHistoryMax = 5000
+)
+
+// tlsHistory keeps track of domains that were seen using TLS and domains
+// that were recently seen downgrading to plaintext.
+type tlsHistory struct {
+	lck        sync.Mutex
+	seen       map[string]time.Time
+	downgraded map[string]time.Time
+}
+
+func prune(m map[string]time.Time, ttl time.Duration) {
+	if len(m) < tlsHistoryMax {
+		return
+	}
+	for k, v := range m {
+		if time.Since(v) > ttl {
+			delete(m, k)
+		}
+	}
+}
+
+func (h *tlsHistory) markTLS(domain string) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	if h.seen == nil {
+		h.seen = make(map[string]time.Time)
+	}
+	prune(h.seen, tlsHistoryTTL)
+	h.seen[domain] = time.Now()
+}
+
+func (h *tlsHistory) seenTLS(domain string) bool {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	t, ok := h.seen[domain]
+	return ok && time.Since(t) < tlsHistoryTTL
+}
+
+func (h *tlsHistory) markDowngrade(domain string) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	if h.downgraded == nil {
+		h.downgraded = make(map[string]time.Time)
+	}
+	prune(h.downgraded, tlsHistoryTTL)
+	h.downgraded[domain] = time.Now()
+}
+
+func (h *tlsHistory) downgradedWithin(domain string, d time.Duration) bool {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	t, ok := h.downgraded[domain]
+	return ok && time.Since(t) < d
+}
+
+// tlsResultType maps the TLS handshake error to the RFC 8460 result type.
+func tlsResultType(err error) string {
+	var certInvalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &x509.HostnameError{}):
+		return tlsrpt.CertificateHostMismatch
+	case errors.As(err, &certInvalid) && certInvalid.Reason == x509.Expired:
+		return tlsrpt.CertificateExpired
+	case errors.As(err, &x509.UnknownAuthorityError{}):
+		return tlsrpt.CertificateNotTrusted
+	default:
+		return tlsrpt.ValidationFailure
+	}
+}
+
+// downgrade records the outbound session ending up in plaintext while TLS
+// was expected. kind is used as a metric label, reason is a human-readable
+// description for the audit log.
+func (rd *remoteDelivery) downgrade(domain, host, kind, reason string) {
+	rd.rt.tlsHistory.markDowngrade(domain)
+	tlsDowngradeCnt.WithLabelValues(rd.rt.Name(), kind).Inc()
+
+	audit.Event(audit.TLSDowngrade,
+		"direction", "outbound",
+		"remote_server", host,
+		"domain", domain,
+		"tls_level", module.TLSNone.String(),
+		"kind", kind,
+		"reason", reason)
+}
+
+// downgradeBlocked returns the error that should be used to refuse the
+// plaintext delivery to the domain, or nil if it is allowed.
+func (rd *remoteDelivery) downgradeBlocked(domain string) error {
+	if rd.rt.downgradeBlock == 0 || !rd.rt.tlsHistory.downgradedWithin(domain, rd.rt.downgradeBlock) {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+		Message:      "TLS downgrade was recently detected for the domain, refusing plaintext delivery",
+		TargetName:   "remote",
+		Misc: map[string]interface{}{
+			"domain": domain,
+		},
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// identity is the EHLO hostname and client certificate presented to remote
+// servers for messages from a certain sender domain.
+type identity struct {
+	hostname string
+	cert     *tls.Certificate
+}
+
+// parseIdentity parses the sender_identity value of the form
+// "HOSTNAME [CERT_PATH KEY_PATH]".
+func parseIdentity(value string) (identity, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 1 && len(fields) != 3 {
+		return identity{}, fmt.Errorf("malformed sender_identity entry, expected hostname and optional certificate and key paths")
+	}
+
+	hostname, err := idna.ToASCII(fields[0])
+	if err != nil {
+		return identity{}, fmt.Errorf("malformed sender_identity entry: cannot represent the hostname as an A-label name: %w", err)
+	}
+
+	id := identity{hostname: hostname}
+	if len(fields) == 3 {
+		cert, err := tls.LoadX509KeyPair(fields[1], fields[2])
+		if err != nil {
+			return identity{}, fmt.Errorf("malformed sender_identity entry: %w", err)
+		}
+		id.cert = &cert
+	}
+	return id, nil
+}
+
+// senderIdentity looks up the identity to use for messages from the
+// specified domain. Parsed entries are cached to avoid reading certificate
+// files for each message, key is the raw table value so changes to the
+// table are picked up.
+//
+// ok is false if there is no matching entry.
+func (rt *Target) senderIdentity(ctx context.Context, domain string) (id identity, key string, ok bool, err error) {
+	if rt.identityTable == nil || domain == "" {
+		return identity{}, "", false, nil
+	}
+
+	value, ok, err := rt.identityTable.Lookup(ctx, domain)
+	if err != nil {
+		return identity{}, "", false, fmt.Errorf("sender_identity lookup failed: %w", err)
+	}
+	if !ok {
+		return identity{}, "", false, nil
+	}
+	value = strings.Join(strings.Fields(value), " ")
+
+	rt.identitiesLck.Lock()
+	defer rt.identitiesLck.Unlock()
+
+	if id, ok := rt.identities[value]; ok {
+		return id, value, true, nil
+	}
+	id, err = parseIdentity(value)
+	if err != nil {
+		return identity{}, "", false, err
+	}
+	if rt.identities == nil {
+		rt.identities = make(map[string]identity)
+	}
+	rt.identities[value] = id
+	return id, value, true, nil
+}
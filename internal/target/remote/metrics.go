@@ -40,7 +40,18 @@ var tlsLevelCnt = prometheus.NewCounterVec(
 	[]string{"module", "level"},
 )
 
+var tlsDowngradeCnt = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "remote",
+		Name:      "tls_downgrades",
+		Help:      "Outbound connections that ended up in plaintext while TLS was expected",
+	},
+	[]string{"module", "kind"},
+)
+
 func init() {
 	prometheus.MustRegister(mxLevelCnt)
 	prometheus.MustRegister(tlsLevelCnt)
+	prometheus.MustRegister(tlsDowngradeCnt)
 }
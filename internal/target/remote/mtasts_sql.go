@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+)
+
+// mtastsSQLStore is the mtasts.Store implementation that keeps policies in
+// the SQL database so they survive restarts and can be shared between
+// multiple server instances.
+type mtastsSQLStore struct {
+	db       *sql.DB
+	migrator *sqlmigrate.Migrator
+}
+
+var mtastsSQLMigrations = []sqlmigrate.Migration{
+	{
+		Version:     1,
+		Description: "create mtasts_policies table",
+		// IF NOT EXISTS is used since the table was created without
+		// migrations before.
+		Up: []string{`CREATE TABLE IF NOT EXISTS mtasts_policies (
+			domain TEXT PRIMARY KEY NOT NULL,
+			id TEXT NOT NULL,
+			fetch_time BIGINT NOT NULL,
+			policy TEXT NOT NULL
+		)`},
+		Down: []string{`DROP TABLE mtasts_policies`},
+	},
+}
+
+func newMTASTSSQLStore(driver, dsn string) (*mtastsSQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &mtastsSQLStore{
+		db: db,
+		migrator: &sqlmigrate.Migrator{
+			DB:         db,
+			Driver:     driver,
+			Component:  "mtasts_cache",
+			Migrations: mtastsSQLMigrations,
+		},
+	}
+
+	// Schema is managed using 'maddy db' commands in this case.
+	if module.NoRun {
+		return s, nil
+	}
+	if err := s.migrator.Prepare(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("schema init: %w", err)
+	}
+	return s, nil
+}
+
+func (s *mtastsSQLStore) List() ([]string, error) {
+	rows, err := s.db.Query(`SELECT domain FROM mtasts_policies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+func (s *mtastsSQLStore) Store(key, id string, fetchTime time.Time, policy *mtasts.Policy) error {
+	blob, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO mtasts_policies (domain, id, fetch_time, policy)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (domain) DO UPDATE SET id = $2, fetch_time = $3, policy = $4`,
+		key, id, fetchTime.Unix(), string(blob))
+	return err
+}
+
+func (s *mtastsSQLStore) Load(key string) (id string, fetchTime time.Time, policy *mtasts.Policy, err error) {
+	var (
+		fetchUnix int64
+		blob      string
+	)
+	err = s.db.QueryRow(`SELECT id, fetch_time, policy FROM mtasts_policies WHERE domain = $1`, key).
+		Scan(&id, &fetchUnix, &blob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", time.Time{}, nil, mtasts.ErrNoPolicy
+		}
+		return "", time.Time{}, nil, err
+	}
+
+	policy = &mtasts.Policy{}
+	if err := json.Unmarshal([]byte(blob), policy); err != nil {
+		return "", time.Time{}, nil, fmt.Errorf("malformed policy for %s: %w", key, err)
+	}
+	return id, time.Unix(fetchUnix, 0), policy, nil
+}
+
+func (s *mtastsSQLStore) Remove(key string) error {
+	_, err := s.db.Exec(`DELETE FROM mtasts_policies WHERE domain = $1`, key)
+	return err
+}
+
+func (s *mtastsSQLStore) Close() error {
+	return s.db.Close()
+}
@@ -25,6 +25,7 @@ import (
 	"net"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/go-mockdns"
@@ -288,6 +289,36 @@ func TestRemoteDelivery_AuthMX_MTASTS_NoPolicy(t *testing.T) {
 	}
 }
 
+func TestMTASTS_CachedOnTempError(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"_mta-sts.example.invalid.": {
+			Err: &net.DNSError{
+				Err:         "the dns server is going insane, temporary",
+				IsTemporary: true,
+			},
+		},
+	}
+	p := testSTSPolicy(t, zones, nil)
+	defer p.Close()
+
+	err := p.cache.Store.Store("example.invalid", "test", time.Now(), &mtasts.Policy{
+		Mode:   mtasts.ModeEnforce,
+		MX:     []string{"mx.example.invalid"},
+		MaxAge: 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := p.get(context.Background(), "example.invalid")
+	if err != nil {
+		t.Fatal("expected cached policy to be used, got", err)
+	}
+	if policy.Mode != mtasts.ModeEnforce {
+		t.Fatal("wrong policy returned:", policy)
+	}
+}
+
 func TestRemoteDelivery_AuthMX_DNSSEC(t *testing.T) {
 	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
 	defer srv.Close()
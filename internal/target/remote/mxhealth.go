@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Initial time the MX is de-prioritized for after a connection failure.
+	// It is doubled for each consecutive failure up to mxPenaltyMax.
+	mxPenaltyBase = 1 * time.Minute
+	mxPenaltyMax  = 1 * time.Hour
+)
+
+type mxHealthEntry struct {
+	failures int
+	until    time.Time
+}
+
+// mxHealth tracks recent connection failures per MX host to try hosts
+// that are known to be working first.
+type mxHealth struct {
+	lck   sync.Mutex
+	hosts map[string]*mxHealthEntry
+}
+
+func mxKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// failed records the connection failure. The host is de-prioritized for
+// the time that grows exponentially with the amount of consecutive failures.
+func (h *mxHealth) failed(host string) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	if h.hosts == nil {
+		h.hosts = make(map[string]*mxHealthEntry)
+	}
+	e, ok := h.hosts[mxKey(host)]
+	if !ok {
+		e = &mxHealthEntry{}
+		h.hosts[mxKey(host)] = e
+	}
+	e.failures++
+
+	penalty := mxPenaltyBase
+	for i := 1; i < e.failures && penalty < mxPenaltyMax; i++ {
+		penalty *= 2
+	}
+	if penalty > mxPenaltyMax {
+		penalty = mxPenaltyMax
+	}
+	e.until = time.Now().Add(penalty)
+}
+
+// succeeded resets the failure counter for the host.
+func (h *mxHealth) succeeded(host string) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	delete(h.hosts, mxKey(host))
+}
+
+func (h *mxHealth) penalized(host string, now time.Time) bool {
+	e, ok := h.hosts[mxKey(host)]
+	return ok && now.Before(e.until)
+}
+
+// order moves recently failing hosts to the end of their preference group.
+// records should be sorted by preference.
+//
+// Hosts are never removed from the list, so if all of them are failing
+// they are still tried in the original order.
+func (h *mxHealth) order(records []*net.MX) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	if len(h.hosts) == 0 {
+		return
+	}
+
+	now := time.Now()
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Pref != records[j].Pref {
+			return records[i].Pref < records[j].Pref
+		}
+		return !h.penalized(records[i].Host, now) && h.penalized(records[j].Host, now)
+	})
+
+	// Cleanup expired entries once in a while to not grow the map forever.
+	if len(h.hosts) > 1000 {
+		for k, e := range h.hosts {
+			if now.Sub(e.until) > mxPenaltyMax {
+				delete(h.hosts, k)
+			}
+		}
+	}
+}
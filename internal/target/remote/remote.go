@@ -47,6 +47,7 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
 )
@@ -77,6 +78,16 @@ type Target struct {
 
 	pool           *pool.P
 	connReuseLimit int
+	batchByMX      bool
+
+	identityTable module.Table
+	identitiesLck sync.Mutex
+	identities    map[string]identity
+
+	tlsHistory     tlsHistory
+	downgradeBlock time.Duration
+
+	mxHealth mxHealth
 
 	Log log.Logger
 
@@ -135,12 +146,15 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &rt.limits)
+	cfg.Custom("sender_identity", false, false, nil, modconfig.TableDirective, &rt.identityTable)
 	cfg.Bool("requiretls_override", false, true, &rt.allowSecOverride)
 	cfg.Bool("relaxed_requiretls", false, true, &rt.relaxedREQUIRETLS)
+	cfg.Duration("downgrade_block", false, false, 0, &rt.downgradeBlock)
+	cfg.Bool("batch_by_mx", false, true, &rt.batchByMX)
 	cfg.Int("conn_reuse_limit", false, false, 10, &rt.connReuseLimit)
-	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &rt.connectTimeout)
-	cfg.Duration("command_timeout", false, false, 5*time.Minute, &rt.commandTimeout)
-	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &rt.submissionTimeout)
+	cfg.Duration("connect_timeout", true, false, 5*time.Minute, &rt.connectTimeout)
+	cfg.Duration("command_timeout", true, false, 5*time.Minute, &rt.commandTimeout)
+	cfg.Duration("submission_timeout", true, false, 5*time.Minute, &rt.submissionTimeout)
 
 	poolCfg := pool.Config{
 		MaxKeys:             5000,
@@ -190,6 +204,18 @@ func (rt *Target) Close() error {
 	return nil
 }
 
+// Migrators implements sqlmigrate.Provider for SQL-based caches used by
+// the MX authentication policies.
+func (rt *Target) Migrators() []*sqlmigrate.Migrator {
+	var res []*sqlmigrate.Migrator
+	for _, p := range rt.policies {
+		if prov, ok := p.(sqlmigrate.Provider); ok {
+			res = append(res, prov.Migrators()...)
+		}
+	}
+	return res
+}
+
 func (rt *Target) Name() string {
 	return "remote"
 }
@@ -207,6 +233,13 @@ type remoteDelivery struct {
 	recipients  []string
 	connections map[string]*mxConn
 
+	// EHLO hostname and TLS configuration used for this message, may differ
+	// from the Target ones if sender_identity is used.
+	hostname  string
+	tlsConfig *tls.Config
+	// Raw sender_identity value, empty if the default identity is used.
+	identity string
+
 	policies []module.DeliveryMXAuthPolicy
 }
 
@@ -260,14 +293,54 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 	}
 	region.End()
 
-	return &remoteDelivery{
+	rd := &remoteDelivery{
 		rt:          rt,
 		mailFrom:    mailFrom,
 		msgMeta:     msgMeta,
 		Log:         target.DeliveryLogger(rt.Log, msgMeta),
 		connections: map[string]*mxConn{},
 		policies:    policies,
-	}, nil
+		hostname:    rt.hostname,
+		tlsConfig:   rt.tlsConfig,
+	}
+
+	id, idKey, ok, err := rt.senderIdentity(ctx, ratelimitDomain)
+	if err != nil {
+		rt.limits.ReleaseMsg(addr, ratelimitDomain)
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error",
+			TargetName:   "remote",
+			Err:          err,
+		}
+	}
+	if ok {
+		rd.identity = idKey
+		rd.hostname = id.hostname
+		if id.cert != nil {
+			if rd.tlsConfig != nil {
+				rd.tlsConfig = rd.tlsConfig.Clone()
+			} else {
+				rd.tlsConfig = &tls.Config{}
+			}
+			rd.tlsConfig.Certificates = []tls.Certificate{*id.cert}
+		}
+		rd.Log.DebugMsg("using sender identity", "hostname", id.hostname, "client_cert", id.cert != nil)
+	}
+
+	return rd, nil
+}
+
+// poolKey returns the connection pool key for connections to the specified
+// domain. Connections established using a different sender identity
+// must not be reused since they announce a different EHLO hostname and
+// client certificate.
+func (rd *remoteDelivery) poolKey(domain string) string {
+	if rd.identity == "" {
+		return domain
+	}
+	return domain + " " + rd.identity
 }
 
 func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
@@ -405,8 +478,7 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 
 	var wg sync.WaitGroup
 
-	for i, conn := range rd.connections {
-		i := i
+	for _, conn := range rd.uniqueConns() {
 		conn := conn
 		wg.Add(1)
 		go func() {
@@ -425,7 +497,7 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 			for _, rcpt := range conn.Rcpts() {
 				c.SetStatus(rcpt, err)
 			}
-			rd.connections[i].errored = err != nil
+			conn.errored = err != nil
 			conn.lastUseAt = time.Now()
 		}()
 	}
@@ -444,8 +516,12 @@ func (rd *remoteDelivery) Commit(ctx context.Context) error {
 }
 
 func (rd *remoteDelivery) Close() error {
-	for _, conn := range rd.connections {
+	for _, conn := range rd.uniqueConns() {
 		rd.rt.limits.ReleaseDest(conn.domain)
+		for _, domain := range conn.extraDomains {
+			rd.rt.limits.ReleaseDest(domain)
+		}
+		conn.extraDomains = nil
 		conn.transactions++
 
 		if !conn.Usable() {
@@ -454,7 +530,7 @@ func (rd *remoteDelivery) Close() error {
 			conn.Close()
 		} else {
 			rd.Log.Debugf("returning connection %v for %s to pool", conn.LocalAddr(), conn.ServerName())
-			rd.rt.pool.Return(conn.domain, conn)
+			rd.rt.pool.Return(conn.poolKey, conn)
 		}
 	}
 
@@ -25,6 +25,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -84,6 +85,11 @@ func testSTSPolicy(t *testing.T, zones map[string]mockdns.Zone, mtastsGet func(c
 				Name: "cache",
 				Args: []string{"ram"},
 			},
+			{
+				// Updater is started below, after mocks are set.
+				Name: "refresh_interval",
+				Args: []string{"0"},
+			},
 		},
 	}))
 	if err != nil {
@@ -93,6 +99,7 @@ func testSTSPolicy(t *testing.T, zones map[string]mockdns.Zone, mtastsGet func(c
 	p.mtastsGet = mtastsGet
 	p.log = testutils.Logger(t, "remote/mtasts")
 	p.cache.Resolver = &mockdns.Resolver{Zones: zones}
+	p.refreshInterval = 12 * time.Hour
 	p.StartUpdater()
 
 	return p
@@ -136,6 +143,72 @@ func TestRemoteDelivery(t *testing.T) {
 	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
 }
 
+func TestRemoteDelivery_SenderIdentity(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.identityTable = testutils.Table{M: map[string]string{
+		"customer.example": "mx.customer.example",
+	}}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@customer.example", []string{"test@example.invalid"})
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+
+	be.CheckMsg(t, 0, "test@customer.example", []string{"test@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.com", []string{"test@example.invalid"})
+
+	if h := be.Messages[0].Conn.Hostname(); h != "mx.customer.example" {
+		t.Errorf("wrong EHLO hostname for the customer domain: %s", h)
+	}
+	if h := be.Messages[1].Conn.Hostname(); h != "mx.example.com" {
+		t.Errorf("wrong EHLO hostname for the default identity: %s", h)
+	}
+	if be.SessionCounter != 2 {
+		t.Errorf("connection should not be reused across identities, got %d sessions", be.SessionCounter)
+	}
+}
+
+func TestRemoteDelivery_DowngradeBlock(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.downgradeBlock = time.Hour
+	defer tgt.Close()
+
+	// Plaintext is fine as long as no downgrade was seen.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+
+	// Server used to support TLS, missing STARTTLS is a downgrade.
+	tgt.tlsHistory.markTLS("example.invalid")
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"}); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if !tgt.tlsHistory.downgradedWithin("example.invalid", time.Minute) {
+		t.Fatal("Downgrade is not recorded")
+	}
+}
+
 func TestRemoteDelivery_NoMXFallback(t *testing.T) {
 	tarpit := testutils.FailOnConn(t, "127.0.0.1:"+smtpPort)
 	defer tarpit.Close()
@@ -621,6 +694,37 @@ func TestRemoteDelivery_Split(t *testing.T) {
 	be2.CheckMsg(t, 0, "test@example.com", []string{"test@example2.invalid"})
 }
 
+func TestRemoteDelivery_BatchByMX(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"example2.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.batchByMX = true
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid", "test@example2.invalid"})
+
+	if len(be.Messages) != 1 {
+		t.Fatalf("expected a single transaction, got %d", len(be.Messages))
+	}
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid", "test@example2.invalid"})
+	if be.SessionCounter != 1 {
+		t.Errorf("expected a single connection, got %d", be.SessionCounter)
+	}
+}
+
 func TestRemoteDelivery_Split_Fail(t *testing.T) {
 	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
 	defer srv1.Close()
@@ -1054,3 +1158,50 @@ func TestRemoteDelivery_ConnReuse(t *testing.T) {
 		t.Fatal("Only one session should be used, found", be.SourceEndpoints)
 	}
 }
+
+func TestMXHealth_Order(t *testing.T) {
+	var h mxHealth
+	records := func() []*net.MX {
+		return []*net.MX{
+			{Host: "mx1.example.invalid.", Pref: 10},
+			{Host: "mx2.example.invalid.", Pref: 10},
+			{Host: "mx3.example.invalid.", Pref: 20},
+		}
+	}
+	hosts := func(recs []*net.MX) []string {
+		res := make([]string, 0, len(recs))
+		for _, r := range recs {
+			res = append(res, r.Host)
+		}
+		return res
+	}
+
+	h.failed("MX1.example.invalid")
+	recs := records()
+	h.order(recs)
+	if got := hosts(recs); !reflect.DeepEqual(got, []string{"mx2.example.invalid.", "mx1.example.invalid.", "mx3.example.invalid."}) {
+		t.Errorf("failing MX is not de-prioritized: %v", got)
+	}
+
+	// Never moved to the lower preference group.
+	h.failed("mx2.example.invalid.")
+	recs = records()
+	h.order(recs)
+	if got := hosts(recs); got[2] != "mx3.example.invalid." {
+		t.Errorf("MX moved out of its preference group: %v", got)
+	}
+
+	// Penalty grows exponentially.
+	h.failed("mx1.example.invalid.")
+	if d := time.Until(h.hosts["mx1.example.invalid"].until); d <= mxPenaltyBase {
+		t.Errorf("penalty is not increased: %v", d)
+	}
+
+	h.succeeded("mx1.example.invalid.")
+	h.succeeded("mx2.example.invalid.")
+	recs = records()
+	h.order(recs)
+	if got := hosts(recs); !reflect.DeepEqual(got, hosts(records())) {
+		t.Errorf("order is not restored after success: %v", got)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"errors"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/foxcpp/go-mtasts"
@@ -33,16 +34,19 @@ import (
 	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
 type (
 	mtastsPolicy struct {
-		cache       *mtasts.Cache
-		mtastsGet   func(context.Context, string) (*mtasts.Policy, error)
-		updaterStop chan struct{}
-		log         log.Logger
-		instName    string
+		cache           *mtasts.Cache
+		sqlStore        *mtastsSQLStore
+		mtastsGet       func(context.Context, string) (*mtasts.Policy, error)
+		refreshInterval time.Duration
+		updaterStop     chan struct{}
+		log             log.Logger
+		instName        string
 	}
 	mtastsDelivery struct {
 		c         *mtastsPolicy
@@ -75,9 +79,14 @@ func (c *mtastsPolicy) Init(cfg *config.Map) error {
 	var (
 		storeType string
 		storeDir  string
+		sqlDriver string
+		sqlDSN    []string
 	)
-	cfg.Enum("cache", false, false, []string{"ram", "fs"}, "fs", &storeType)
+	cfg.Enum("cache", false, false, []string{"ram", "fs", "sql"}, "fs", &storeType)
 	cfg.String("fs_dir", false, false, "mtasts_cache", &storeDir)
+	cfg.String("sql_driver", false, false, "", &sqlDriver)
+	cfg.StringList("sql_dsn", false, false, nil, &sqlDSN)
+	cfg.Duration("refresh_interval", false, false, 12*time.Hour, &c.refreshInterval)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -90,20 +99,58 @@ func (c *mtastsPolicy) Init(cfg *config.Map) error {
 		c.cache = mtasts.NewFSCache(storeDir)
 	case "ram":
 		c.cache = mtasts.NewRAMCache()
+	case "sql":
+		if sqlDriver == "" || len(sqlDSN) == 0 {
+			return config.NodeErr(cfg.Block, "sql_driver and sql_dsn are required for sql cache")
+		}
+		store, err := newMTASTSSQLStore(sqlDriver, strings.Join(sqlDSN, " "))
+		if err != nil {
+			return config.NodeErr(cfg.Block, "failed to open MTA-STS cache db: %v", err)
+		}
+		c.sqlStore = store
+		c.cache = &mtasts.Cache{Store: store}
 	default:
 		panic("mtasts policy init: unknown cache type")
 	}
 	c.cache.Resolver = dns.DefaultResolver()
-	c.mtastsGet = c.cache.Get
+	c.mtastsGet = c.get
+
+	if !module.NoRun {
+		c.StartUpdater()
+	}
 
 	return nil
 }
 
+// get returns the policy for the domain. If the policy cannot be fetched due
+// to a temporary error (e.g. DNS outage), the cached policy is used if it
+// is not expired yet so enforcement does not stop.
+func (c *mtastsPolicy) get(ctx context.Context, domain string) (*mtasts.Policy, error) {
+	policy, err := c.cache.Get(ctx, domain)
+	if err == nil || !exterrors.IsTemporary(err) {
+		return policy, err
+	}
+
+	_, fetchTime, cached, loadErr := c.cache.Store.Load(domain)
+	if loadErr != nil || cached == nil {
+		return nil, err
+	}
+	if time.Since(fetchTime) > time.Duration(cached.MaxAge)*time.Second {
+		return nil, err
+	}
+	c.log.Msg("using cached MTA-STS policy due to a fetch error", "domain", domain, "reason", err)
+	return cached, nil
+}
+
 // StartUpdater starts a goroutine to update MTA-STS cache periodically until
 // Close is called.
 //
-// It can be called only once per mtastsPolicy instance.
+// It can be called only once per mtastsPolicy instance. It does nothing if
+// refresh_interval is 0.
 func (c *mtastsPolicy) StartUpdater() {
+	if c.refreshInterval <= 0 {
+		return
+	}
 	c.updaterStop = make(chan struct{})
 	go c.updater()
 }
@@ -126,7 +173,7 @@ func (c *mtastsPolicy) updater() {
 	}
 	c.log.Debugln("updating MTA-STS cache... done!")
 
-	t := time.NewTicker(12 * time.Hour)
+	t := time.NewTicker(c.refreshInterval)
 	for {
 		select {
 		case <-t.C:
@@ -149,12 +196,23 @@ func (c *mtastsPolicy) Start(msgMeta *module.MsgMetadata) module.DeliveryMXAuthP
 	}
 }
 
+// Migrators implements sqlmigrate.Provider.
+func (c *mtastsPolicy) Migrators() []*sqlmigrate.Migrator {
+	if c.sqlStore == nil {
+		return nil
+	}
+	return []*sqlmigrate.Migrator{c.sqlStore.migrator}
+}
+
 func (c *mtastsPolicy) Close() error {
 	if c.updaterStop != nil {
 		c.updaterStop <- struct{}{}
 		<-c.updaterStop
 		c.updaterStop = nil
 	}
+	if c.sqlStore != nil {
+		return c.sqlStore.Close()
+	}
 	return nil
 }
 
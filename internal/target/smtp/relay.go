@@ -0,0 +1,90 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp_downstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// relay is the upstream server selected for the message using relay_table.
+type relay struct {
+	endpoint    config.Endpoint
+	saslFactory saslClientFactory
+}
+
+// parseRelay parses the relay_table value of the form
+// "ENDPOINT [USERNAME PASSWORD]".
+func parseRelay(value string) (relay, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 1 && len(fields) != 3 {
+		return relay{}, fmt.Errorf("malformed relay_table entry, expected endpoint and optional username and password")
+	}
+
+	endp, err := config.ParseEndpoint(fields[0])
+	if err != nil {
+		return relay{}, fmt.Errorf("malformed relay_table entry: %w", err)
+	}
+
+	r := relay{endpoint: endp}
+	if len(fields) == 3 {
+		username, password := fields[1], fields[2]
+		r.saslFactory = func(*module.MsgMetadata) (sasl.Client, error) {
+			return sasl.NewPlainClient("", username, password), nil
+		}
+	}
+	return r, nil
+}
+
+// senderRelay looks up the relay to use for the message. Authenticated user
+// name is checked first, then the sender address and then its domain.
+// ok is false if there is no matching entry.
+func (u *Downstream) senderRelay(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (r relay, ok bool, err error) {
+	keys := make([]string, 0, 3)
+	if msgMeta.Conn != nil && msgMeta.Conn.AuthUser != "" {
+		keys = append(keys, msgMeta.Conn.AuthUser)
+	}
+	if mailFrom != "" {
+		keys = append(keys, mailFrom)
+		if _, domain, err := address.Split(mailFrom); err == nil && domain != "" {
+			keys = append(keys, domain)
+		}
+	}
+
+	for _, key := range keys {
+		value, ok, err := u.relayTable.Lookup(ctx, key)
+		if err != nil {
+			return relay{}, false, fmt.Errorf("relay_table lookup failed: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		r, err := parseRelay(value)
+		if err != nil {
+			return relay{}, false, err
+		}
+		return r, true, nil
+	}
+	return relay{}, false, nil
+}
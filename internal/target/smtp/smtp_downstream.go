@@ -39,6 +39,7 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -61,6 +62,10 @@ type Downstream struct {
 	saslFactory     saslClientFactory
 	tlsConfig       tls.Config
 
+	// relayTable selects the upstream server and credentials based on the
+	// sender, see senderRelay.
+	relayTable module.Table
+
 	connectTimeout    time.Duration
 	commandTimeout    time.Duration
 	submissionTimeout time.Duration
@@ -98,12 +103,13 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	cfg.Custom("auth", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, saslAuthDirective, &u.saslFactory)
+	cfg.Custom("relay_table", false, false, nil, modconfig.TableDirective, &u.relayTable)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &u.tlsConfig)
-	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &u.connectTimeout)
-	cfg.Duration("command_timeout", false, false, 5*time.Minute, &u.commandTimeout)
-	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &u.submissionTimeout)
+	cfg.Duration("connect_timeout", true, false, 5*time.Minute, &u.connectTimeout)
+	cfg.Duration("command_timeout", true, false, 5*time.Minute, &u.commandTimeout)
+	cfg.Duration("submission_timeout", true, false, 5*time.Minute, &u.submissionTimeout)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -126,7 +132,7 @@ func (u *Downstream) Init(cfg *config.Map) error {
 		u.endpoints = append(u.endpoints, endp)
 	}
 
-	if len(u.endpoints) == 0 {
+	if len(u.endpoints) == 0 && u.relayTable == nil {
 		return fmt.Errorf("%s: at least one target endpoint is required", u.modName)
 	}
 
@@ -200,7 +206,30 @@ func (d *delivery) connect(ctx context.Context) error {
 		conn.SubmissionTimeout = d.u.submissionTimeout
 	}
 
-	for _, endp := range d.u.endpoints {
+	endpoints, saslFactory := d.u.endpoints, d.u.saslFactory
+	if d.u.relayTable != nil {
+		r, ok, err := d.u.senderRelay(ctx, d.msgMeta, d.mailFrom)
+		if err != nil {
+			return d.u.moduleError(err)
+		}
+		if ok {
+			d.log.DebugMsg("using sender-dependent relay", "relay", r.endpoint.String())
+			endpoints = []config.Endpoint{r.endpoint}
+			if r.saslFactory != nil {
+				saslFactory = r.saslFactory
+			}
+		} else if len(endpoints) == 0 {
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "No relay configured for the sender",
+				TargetName:   d.u.modName,
+				Reason:       "No relay_table entry for the sender and no default targets",
+			}
+		}
+	}
+
+	for _, endp := range endpoints {
 		var (
 			didTLS bool
 			err    error
@@ -211,7 +240,7 @@ func (d *delivery) connect(ctx context.Context) error {
 			didTLS, err = conn.Connect(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
 		}
 		if err != nil {
-			if len(d.u.endpoints) != 1 {
+			if len(endpoints) != 1 {
 				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
 			}
 			lastErr = err
@@ -233,8 +262,8 @@ func (d *delivery) connect(ctx context.Context) error {
 		return d.u.moduleError(lastErr)
 	}
 
-	if d.u.saslFactory != nil {
-		saslClient, err := d.u.saslFactory(d.msgMeta)
+	if saslFactory != nil {
+		saslClient, err := saslFactory(d.msgMeta)
 		if err != nil {
 			conn.Close()
 			return err
@@ -181,6 +181,68 @@ func TestDownstreamDelivery_Fallback(t *testing.T) {
 	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
 }
 
+func TestDownstreamDelivery_RelayTable(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	tarpit := testutils.FailOnConn(t, "127.0.0.1:"+testPort)
+	defer tarpit.Close()
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		relayTable: testutils.Table{M: map[string]string{
+			"example.invalid": "tcp://127.0.0.2:" + testPort,
+		}},
+		log: testutils.Logger(t, "target.smtp"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstreamDelivery_RelayTable_NoMatch(t *testing.T) {
+	mod := &Downstream{
+		hostname:   "mx.example.invalid",
+		relayTable: testutils.Table{M: map[string]string{}},
+		log:        testutils.Logger(t, "target.smtp"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
+
+func TestParseRelay(t *testing.T) {
+	r, err := parseRelay("tcp://relay.example.invalid:587 user pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.endpoint.Host != "relay.example.invalid" || r.endpoint.Port != "587" || r.saslFactory == nil {
+		t.Errorf("wrong relay: %+v", r)
+	}
+
+	r, err = parseRelay("tls://relay.example.invalid:465")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.saslFactory != nil {
+		t.Error("unexpected credentials")
+	}
+
+	if _, err := parseRelay("tcp://relay.example.invalid:587 user"); err == nil {
+		t.Error("entry with a username but no password accepted")
+	}
+}
+
 func TestDownstreamDelivery_MAILErr(t *testing.T) {
 	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
 	defer srv.Close()
@@ -26,6 +26,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/emersion/go-message/textproto"
@@ -93,10 +94,20 @@ const testBodyString = "--message-boundary\r\n" +
 var testMailString = testHeaderString + testBodyString + strings.Repeat("A", MessageBodySize)
 
 func RandomMsg(b *testing.B) (module.MsgMetadata, textproto.Header, buffer.Buffer) {
+	return randomMsg(b, testMailString)
+}
+
+// RandomMsgSize is similar to RandomMsg but allows to specify the amount of
+// filler data appended to the body.
+func RandomMsgSize(b *testing.B, bodySize int) (module.MsgMetadata, textproto.Header, buffer.Buffer) {
+	return randomMsg(b, testHeaderString+testBodyString+strings.Repeat("A", bodySize))
+}
+
+func randomMsg(b *testing.B, msg string) (module.MsgMetadata, textproto.Header, buffer.Buffer) {
 	IDRaw := sha1.Sum([]byte(b.Name()))
 	encodedID := hex.EncodeToString(IDRaw[:])
 
-	body := bufio.NewReader(strings.NewReader(testMailString))
+	body := bufio.NewReader(strings.NewReader(msg))
 	hdr, _ := textproto.ReadHeader(body)
 	for i := 0; i < ExtraMessageHeaderFields; i++ {
 		hdr.Add("AAAAAAAAAAAA-"+strconv.Itoa(i), strings.Repeat("A", ExtraMessageHeaderFieldSize))
@@ -139,3 +150,128 @@ func BenchDelivery(b *testing.B, target module.DeliveryTarget, sender string, re
 		}
 	}
 }
+
+// ParallelBenchOptions controls the load generated by BenchDeliveryParallel.
+type ParallelBenchOptions struct {
+	// Parallelism is passed to b.SetParallelism, the amount of delivering
+	// goroutines is Parallelism * GOMAXPROCS. Defaults to 1.
+	Parallelism int
+
+	// BodySizes lists the amounts of filler data in message bodies.
+	// Deliveries cycle through the list so the result reflects the mix.
+	// Defaults to MessageBodySize.
+	BodySizes []int
+
+	// Accounts is the amount of distinct recipient sets. Goroutines are
+	// spread evenly between them. Set to 1 to make all goroutines deliver
+	// to the same recipients, maximizing contention. Defaults to 1.
+	Accounts int
+
+	// Corpus, if set, is used to generate messages instead of the
+	// fixed-structure ones with BodySizes filler.
+	Corpus *MsgGenerator
+
+	// CorpusSize is the amount of messages generated using Corpus.
+	// Defaults to 64.
+	CorpusSize int
+
+	// Prepare is called for each recipient address before the benchmark
+	// starts, e.g. to create storage accounts.
+	Prepare func(rcpt string) error
+}
+
+// BenchDeliveryParallel is a concurrent variant of BenchDelivery.
+//
+// "X" in recipientTemplates is replaced with the account number and
+// recipient index, so templates without it produce the same recipients
+// for all accounts.
+func BenchDeliveryParallel(b *testing.B, target module.DeliveryTarget, sender string, recipientTemplates []string, opts ParallelBenchOptions) {
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = 1
+	}
+	if len(opts.BodySizes) == 0 {
+		opts.BodySizes = []int{MessageBodySize}
+	}
+	if opts.Accounts <= 0 {
+		opts.Accounts = 1
+	}
+
+	type msg struct {
+		meta   module.MsgMetadata
+		header textproto.Header
+		body   buffer.Buffer
+	}
+	var (
+		msgs      []msg
+		totalSize int64
+	)
+	if opts.Corpus != nil {
+		if opts.CorpusSize <= 0 {
+			opts.CorpusSize = 64
+		}
+		for i := 0; i < opts.CorpusSize; i++ {
+			meta, header, body := opts.Corpus.NextMsg()
+			msgs = append(msgs, msg{meta, header, body})
+			totalSize += int64(body.Len())
+		}
+	} else {
+		for _, size := range opts.BodySizes {
+			meta, header, body := RandomMsgSize(b, size)
+			msgs = append(msgs, msg{meta, header, body})
+			totalSize += int64(body.Len())
+		}
+	}
+
+	accounts := make([][]string, opts.Accounts)
+	for acct := range accounts {
+		for i, rcptTemplate := range recipientTemplates {
+			rcpt := strings.Replace(rcptTemplate, "X", strconv.Itoa(acct)+"-"+strconv.Itoa(i), -1)
+			if opts.Prepare != nil {
+				if err := opts.Prepare(rcpt); err != nil {
+					b.Fatal(err)
+				}
+			}
+			accounts[acct] = append(accounts[acct], rcpt)
+		}
+	}
+
+	benchCtx := context.Background()
+	var goroutineCounter int64
+
+	b.SetBytes(totalSize / int64(len(msgs)))
+	b.SetParallelism(opts.Parallelism)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := int(atomic.AddInt64(&goroutineCounter, 1) - 1)
+		rcpts := accounts[id%len(accounts)]
+
+		for i := 0; pb.Next(); i++ {
+			m := msgs[(id+i)%len(msgs)]
+			// Targets are allowed to modify both, make sure goroutines
+			// do not share them.
+			meta := m.meta
+			header := m.header.Copy()
+
+			delivery, err := target.Start(benchCtx, &meta, sender)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			for _, rcpt := range rcpts {
+				if err := delivery.AddRcpt(benchCtx, rcpt, smtp.RcptOptions{}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+			if err := delivery.Body(benchCtx, header, m.body); err != nil {
+				b.Error(err)
+				return
+			}
+			if err := delivery.Commit(benchCtx); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
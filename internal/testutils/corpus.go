@@ -0,0 +1,341 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// MsgGenerator produces varied messages resembling real-world mail: plain
+// text and HTML bodies, multipart messages with attachments, international
+// headers and some commonly seen formatting errors.
+//
+// Output is fully determined by the seed passed to NewMsgGenerator and the
+// settings. MsgGenerator is not safe for concurrent use.
+type MsgGenerator struct {
+	// TextSize is the approximate size of text parts.
+	TextSize int
+
+	// AttachmentRate is the probability of a message having attachments.
+	// Up to MaxAttachments attachments are added, each of a random size in
+	// the [MinAttachmentSize, MaxAttachmentSize] range.
+	AttachmentRate    float64
+	MaxAttachments    int
+	MinAttachmentSize int
+	MaxAttachmentSize int
+
+	// HTMLRate is the probability of a message having an HTML alternative.
+	HTMLRate float64
+
+	// InternationalRate is the probability of a message using non-ASCII
+	// text in the header and body.
+	InternationalRate float64
+
+	// BrokenRate is the probability of a message having a formatting
+	// error commonly produced by real mail software.
+	BrokenRate float64
+
+	rnd *rand.Rand
+	n   int
+}
+
+// NewMsgGenerator creates the MsgGenerator with the default settings.
+func NewMsgGenerator(seed int64) *MsgGenerator {
+	return &MsgGenerator{
+		TextSize:          2 * 1024,
+		AttachmentRate:    0.3,
+		MaxAttachments:    3,
+		MinAttachmentSize: 4 * 1024,
+		MaxAttachmentSize: 512 * 1024,
+		HTMLRate:          0.6,
+		InternationalRate: 0.3,
+		BrokenRate:        0.1,
+		rnd:               rand.New(rand.NewSource(seed)),
+	}
+}
+
+var (
+	corpusWordsASCII = strings.Fields(`the of and to in is you that it he was for on are as with his they
+		at be this have from or one had by word but not what all were we when your can said there use
+		an each which she do how their if will up other about out many then them these so some her would
+		meeting invoice report attached please review schedule update project thanks regards`)
+	corpusWordsIntl = strings.Fields(`привет встреча отчёт счёт пожалуйста спасибо こんにちは 会議 報告書
+		请求 发票 谢谢 grüße straße übermorgen café naïve résumé 안녕하세요 회의 שלום مرحبا`)
+	corpusNames     = []string{"Alice Smith", "Bob Johnson", "Carol Williams", "Dave Brown", "Mallory"}
+	corpusNamesIntl = []string{"Иван Петров", "山田太郎", "José Müller", "김민수", "Zoë Çelik"}
+	corpusDomains   = []string{"example.org", "example.com", "mail.example.net", "example.co.uk"}
+	corpusMailers   = []string{"Mozilla Thunderbird", "Microsoft Outlook 16.0", "Apple Mail (2.3654)", "Roundcube Webmail/1.6.0"}
+	corpusFileTypes = []struct{ name, ctype string }{
+		{"report.pdf", "application/pdf"},
+		{"photo.jpg", "image/jpeg"},
+		{"data.xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"archive.zip", "application/zip"},
+		{"notes.txt", "text/plain"},
+	}
+)
+
+func (g *MsgGenerator) chance(p float64) bool {
+	return g.rnd.Float64() < p
+}
+
+func (g *MsgGenerator) pick(s []string) string {
+	return s[g.rnd.Intn(len(s))]
+}
+
+func (g *MsgGenerator) text(size int, intl bool) string {
+	var sb strings.Builder
+	lineLen := 0
+	for sb.Len() < size {
+		word := g.pick(corpusWordsASCII)
+		if intl && g.chance(0.3) {
+			word = g.pick(corpusWordsIntl)
+		}
+		if lineLen+len(word) > 72 {
+			sb.WriteString("\r\n")
+			lineLen = 0
+			if g.chance(0.1) {
+				sb.WriteString("\r\n")
+			}
+		} else if lineLen != 0 {
+			sb.WriteByte(' ')
+			lineLen++
+		}
+		sb.WriteString(word)
+		lineLen += len(word)
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+func (g *MsgGenerator) address(intl bool) string {
+	names := corpusNames
+	if intl {
+		names = corpusNamesIntl
+	}
+	name := g.pick(names)
+	local := strings.ToLower(strings.Fields(corpusNames[g.rnd.Intn(len(corpusNames))])[0])
+	addr := local + "@" + g.pick(corpusDomains)
+	if intl {
+		return mime.QEncoding.Encode("utf-8", name) + " <" + addr + ">"
+	}
+	return name + " <" + addr + ">"
+}
+
+func (g *MsgGenerator) boundary() string {
+	return fmt.Sprintf("----=_Part_%d_%d", g.n, g.rnd.Int63())
+}
+
+func (g *MsgGenerator) textPart(intl bool) (textproto.Header, []byte) {
+	var h textproto.Header
+	body := g.text(g.TextSize/2+g.rnd.Intn(g.TextSize+1), intl)
+	if !intl {
+		h.Set("Content-Type", "text/plain; charset=us-ascii")
+		h.Set("Content-Transfer-Encoding", "7bit")
+		return h, []byte(body)
+	}
+
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(body)) //nolint:errcheck
+	w.Close()
+	return h, buf.Bytes()
+}
+
+func (g *MsgGenerator) htmlPart(text []byte) (textproto.Header, []byte) {
+	var h textproto.Header
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "8bit")
+
+	var buf bytes.Buffer
+	buf.WriteString("<html><head><meta charset=\"utf-8\"></head><body>\r\n")
+	for _, para := range strings.Split(string(text), "\r\n\r\n") {
+		buf.WriteString("<p>")
+		buf.WriteString(strings.ReplaceAll(para, "\r\n", "<br>\r\n"))
+		buf.WriteString("</p>\r\n")
+	}
+	buf.WriteString("</body></html>\r\n")
+	return h, buf.Bytes()
+}
+
+func (g *MsgGenerator) attachment() (textproto.Header, []byte) {
+	ft := corpusFileTypes[g.rnd.Intn(len(corpusFileTypes))]
+	size := g.MinAttachmentSize
+	if g.MaxAttachmentSize > g.MinAttachmentSize {
+		size += g.rnd.Intn(g.MaxAttachmentSize - g.MinAttachmentSize + 1)
+	}
+
+	var h textproto.Header
+	h.Set("Content-Type", ft.ctype+"; name=\""+ft.name+"\"")
+	h.Set("Content-Disposition", "attachment; filename=\""+ft.name+"\"")
+	h.Set("Content-Transfer-Encoding", "base64")
+
+	blob := make([]byte, size)
+	g.rnd.Read(blob) //nolint:errcheck
+	encoded := base64.StdEncoding.EncodeToString(blob)
+
+	var buf bytes.Buffer
+	buf.Grow(len(encoded) + len(encoded)/76*2 + 2)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76])
+		buf.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteString("\r\n")
+	return h, buf.Bytes()
+}
+
+func writeMultipart(buf *bytes.Buffer, boundary string, parts []textproto.Header, bodies [][]byte, terminate bool) {
+	buf.WriteString("This is a multi-part message in MIME format.\r\n")
+	for i := range parts {
+		buf.WriteString("\r\n--" + boundary + "\r\n")
+		textproto.WriteHeader(buf, parts[i]) //nolint:errcheck
+		buf.Write(bodies[i])
+	}
+	if terminate {
+		buf.WriteString("\r\n--" + boundary + "--\r\n")
+	}
+}
+
+// Next generates the next message and returns its header and body.
+func (g *MsgGenerator) Next() (textproto.Header, []byte) {
+	g.n++
+	intl := g.chance(g.InternationalRate)
+	broken := g.chance(g.BrokenRate)
+
+	var h textproto.Header
+	subject := strings.TrimSpace(g.text(20+g.rnd.Intn(40), intl))
+	if intl {
+		subject = mime.QEncoding.Encode("utf-8", subject)
+	}
+	h.Add("Received", fmt.Sprintf("from mx%d.%s (mx%d.%s [192.0.2.%d]) by mx.example.org with ESMTPS id %x; %s",
+		g.n%10, g.pick(corpusDomains), g.n%10, g.pick(corpusDomains), g.rnd.Intn(254)+1, g.rnd.Int63(),
+		time.Unix(1600000000+int64(g.n)*60, 0).UTC().Format(time.RFC1123Z)))
+	h.Add("Date", time.Unix(1600000000+int64(g.n)*60, 0).UTC().Format(time.RFC1123Z))
+	h.Add("From", g.address(intl))
+	to := g.address(intl)
+	for i := g.rnd.Intn(3); i > 0; i-- {
+		to += ", " + g.address(intl)
+	}
+	h.Add("To", to)
+	h.Add("Subject", subject)
+	h.Add("Message-Id", fmt.Sprintf("<%d.%x@%s>", g.n, g.rnd.Int63(), g.pick(corpusDomains)))
+	h.Add("X-Mailer", g.pick(corpusMailers))
+	h.Add("MIME-Version", "1.0")
+
+	textHdr, textBody := g.textPart(intl)
+	parts := []textproto.Header{textHdr}
+	bodies := [][]byte{textBody}
+	ctype := ""
+
+	if g.chance(g.HTMLRate) {
+		htmlHdr, htmlBody := g.htmlPart([]byte(g.text(g.TextSize, intl)))
+		var alt bytes.Buffer
+		boundary := g.boundary()
+		writeMultipart(&alt, boundary, []textproto.Header{textHdr, htmlHdr}, [][]byte{textBody, htmlBody}, true)
+
+		var altHdr textproto.Header
+		altHdr.Set("Content-Type", "multipart/alternative; boundary=\""+boundary+"\"")
+		parts, bodies = []textproto.Header{altHdr}, [][]byte{alt.Bytes()}
+		ctype = altHdr.Get("Content-Type")
+	}
+
+	if g.MaxAttachments > 0 && g.chance(g.AttachmentRate) {
+		for i := g.rnd.Intn(g.MaxAttachments) + 1; i > 0; i-- {
+			attHdr, attBody := g.attachment()
+			parts = append(parts, attHdr)
+			bodies = append(bodies, attBody)
+		}
+	}
+
+	var body bytes.Buffer
+	switch {
+	case len(parts) > 1:
+		boundary := g.boundary()
+		h.Add("Content-Type", "multipart/mixed; boundary=\""+boundary+"\"")
+		writeMultipart(&body, boundary, parts, bodies, !broken || g.chance(0.5))
+	case ctype != "":
+		h.Add("Content-Type", ctype)
+		body.Write(bodies[0])
+	default:
+		for f := parts[0].Fields(); f.Next(); {
+			h.Add(f.Key(), f.Value())
+		}
+		body.Write(bodies[0])
+	}
+
+	if broken {
+		g.breakMsg(&h, &body)
+	}
+
+	return h, body.Bytes()
+}
+
+// breakMsg introduces one of the formatting errors commonly seen in the wild.
+func (g *MsgGenerator) breakMsg(h *textproto.Header, body *bytes.Buffer) {
+	switch g.rnd.Intn(6) {
+	case 0:
+		// Raw 8-bit header without SMTPUTF8 or encoded-words.
+		h.Set("Subject", strings.TrimSpace(g.text(40, true)))
+	case 1:
+		// Missing Date and Message-Id.
+		h.Del("Date")
+		h.Del("Message-Id")
+	case 2:
+		// Very long unfolded header field.
+		h.Add("X-Tracking", strings.Repeat("a", 1200))
+	case 3:
+		// Mismatched charset declaration.
+		if h.Has("Content-Type") && strings.HasPrefix(h.Get("Content-Type"), "text/plain") {
+			h.Set("Content-Type", "text/plain; charset=iso-8859-1")
+		}
+	case 4:
+		// Bare LF line endings in the body.
+		b := bytes.ReplaceAll(body.Bytes(), []byte("\r\n"), []byte("\n"))
+		body.Reset()
+		body.Write(b)
+	case 5:
+		// Lowercase and duplicated fields.
+		h.Add("mime-version", "1.0")
+		h.Add("subject", h.Get("Subject"))
+	}
+}
+
+// NextMsg is a convenience wrapper for Next that returns values in the
+// form accepted by delivery targets.
+func (g *MsgGenerator) NextMsg() (module.MsgMetadata, textproto.Header, buffer.Buffer) {
+	h, body := g.Next()
+	return module.MsgMetadata{
+		DontTraceSender: true,
+		ID:              fmt.Sprintf("corpus-%d", g.n),
+	}, h, buffer.MemoryBuffer{Slice: body}
+}
@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestMsgGenerator_Deterministic(t *testing.T) {
+	a, b := NewMsgGenerator(42), NewMsgGenerator(42)
+	for i := 0; i < 50; i++ {
+		hdrA, bodyA := a.Next()
+		hdrB, bodyB := b.Next()
+
+		var bufA, bufB bytes.Buffer
+		if err := textproto.WriteHeader(&bufA, hdrA); err != nil {
+			t.Fatal(err)
+		}
+		if err := textproto.WriteHeader(&bufB, hdrB); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bufA.Bytes(), bufB.Bytes()) || !bytes.Equal(bodyA, bodyB) {
+			t.Fatalf("message %d differs for the same seed", i)
+		}
+	}
+}
+
+func TestMsgGenerator_Parseable(t *testing.T) {
+	g := NewMsgGenerator(1)
+	g.BrokenRate = 0
+	g.AttachmentRate = 0.5
+	g.MaxAttachmentSize = 8 * 1024
+
+	var multipart, intl int
+	for i := 0; i < 200; i++ {
+		hdr, body := g.Next()
+		if hdr.Get("Message-Id") == "" || hdr.Get("From") == "" {
+			t.Fatalf("message %d: missing required fields", i)
+		}
+
+		ent, err := message.New(message.Header{Header: hdr}, bytes.NewReader(body))
+		if err != nil && !message.IsUnknownCharset(err) {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		err = ent.Walk(func(_ []int, part *message.Entity, err error) error {
+			if err != nil {
+				return err
+			}
+			// Body of multipart entities is read by Walk itself.
+			if mediaType, _, _ := part.Header.ContentType(); strings.HasPrefix(mediaType, "multipart/") {
+				return nil
+			}
+			_, err = io.Copy(io.Discard, part.Body)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if strings.HasPrefix(hdr.Get("Content-Type"), "multipart/") {
+			multipart++
+		}
+		if strings.Contains(hdr.Get("Subject"), "=?utf-8?") {
+			intl++
+		}
+	}
+
+	if multipart == 0 || intl == 0 {
+		t.Errorf("not enough variety: %d multipart, %d international", multipart, intl)
+	}
+}
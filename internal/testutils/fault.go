@@ -0,0 +1,526 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Faults describes failures injected by FaultyTarget and FaultyCheck.
+//
+// All rates are probabilities in the [0, 1] range and are evaluated
+// independently for each operation. The zero value injects nothing.
+type Faults struct {
+	// Seed for the pseudo-random generator. The same seed produces the same
+	// sequence of faults as long as operations are called in the same order.
+	Seed int64
+
+	// TempFailRate is the probability of an operation failing with
+	// a temporary (4xx) error.
+	TempFailRate float64
+	// PermFailRate is the probability of an operation failing with
+	// a permanent (5xx) error.
+	PermFailRate float64
+	// RcptFailRate is the probability of a single recipient failing with
+	// a temporary error during BodyNonAtomic, while others succeed.
+	// FaultyTarget implements module.PartialDelivery only if it is non-zero.
+	RcptFailRate float64
+	// PanicRate is the probability of an operation panicking.
+	PanicRate float64
+
+	// Latency is added before each operation. If Jitter is non-zero, a random
+	// value in the [0, Jitter) range is added on top of it. The delay is
+	// interrupted if the context is cancelled.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Stages restricts fault injection to the listed operations. For
+	// FaultyTarget these are "start", "rcpt", "body" and "commit". For
+	// FaultyCheck - "connection", "sender", "rcpt" and "body". If empty,
+	// faults are injected into all operations.
+	Stages []string
+}
+
+// FaultStats contains counters of operations performed by FaultyTarget or
+// FaultyCheck and faults injected into them.
+type FaultStats struct {
+	Calls        int
+	TempFailures int
+	PermFailures int
+	RcptFailures int
+	Panics       int
+	Timeouts     int
+}
+
+type faultInjector struct {
+	initOnce sync.Once
+	name     string
+	check    bool
+
+	mu    sync.Mutex
+	rnd   *rand.Rand
+	stats FaultStats
+}
+
+func (fi *faultInjector) init(name string, check bool) *faultInjector {
+	fi.initOnce.Do(func() {
+		fi.name = name
+		fi.check = check
+	})
+	return fi
+}
+
+func (fi *faultInjector) float(f *Faults) float64 {
+	if fi.rnd == nil {
+		fi.rnd = rand.New(rand.NewSource(f.Seed))
+	}
+	return fi.rnd.Float64()
+}
+
+func (fi *faultInjector) delay(ctx context.Context, f *Faults) error {
+	d := f.Latency
+	if f.Jitter > 0 {
+		fi.mu.Lock()
+		d += time.Duration(fi.float(f) * float64(f.Jitter))
+		fi.mu.Unlock()
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		fi.mu.Lock()
+		fi.stats.Timeouts++
+		fi.mu.Unlock()
+		return exterrors.WithTemporary(ctx.Err(), true)
+	}
+}
+
+// inject applies latency and randomly selected fault to the operation
+// called stage. It panics or returns a non-nil error if fault was
+// selected.
+func (fi *faultInjector) inject(ctx context.Context, f *Faults, stage string) error {
+	fi.mu.Lock()
+	fi.stats.Calls++
+	fi.mu.Unlock()
+
+	if !f.appliesTo(stage) {
+		return nil
+	}
+
+	if err := fi.delay(ctx, f); err != nil {
+		return err
+	}
+
+	fi.mu.Lock()
+	roll := fi.float(f)
+	switch {
+	case roll < f.PanicRate:
+		fi.stats.Panics++
+		fi.mu.Unlock()
+		panic(fmt.Sprintf("%s: injected panic during %s", fi.name, stage))
+	case roll < f.PanicRate+f.PermFailRate:
+		fi.stats.PermFailures++
+		fi.mu.Unlock()
+		return fi.err(stage, false)
+	case roll < f.PanicRate+f.PermFailRate+f.TempFailRate:
+		fi.stats.TempFailures++
+		fi.mu.Unlock()
+		return fi.err(stage, true)
+	}
+	fi.mu.Unlock()
+	return nil
+}
+
+// rcptFails reports whether the single recipient should fail during partial
+// delivery.
+func (fi *faultInjector) rcptFails(f *Faults) bool {
+	if !f.appliesTo("body") || f.RcptFailRate == 0 {
+		return false
+	}
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.float(f) < f.RcptFailRate {
+		fi.stats.RcptFailures++
+		return true
+	}
+	return false
+}
+
+func (fi *faultInjector) err(stage string, temporary bool) error {
+	code, enchCode := 550, exterrors.EnhancedCode{5, 0, 0}
+	if temporary {
+		code, enchCode = 451, exterrors.EnhancedCode{4, 0, 0}
+	}
+	err := &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: enchCode,
+		Message:      "Injected failure",
+		Err:          errors.New("injected failure"),
+		Misc: map[string]interface{}{
+			"stage": stage,
+		},
+	}
+	if fi.check {
+		err.CheckName = fi.name
+	} else {
+		err.TargetName = fi.name
+	}
+	return err
+}
+
+func (fi *faultInjector) Stats() FaultStats {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.stats
+}
+
+func (f *Faults) appliesTo(stage string) bool {
+	if len(f.Stages) == 0 {
+		return true
+	}
+	for _, s := range f.Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultyTarget is a module.DeliveryTarget implementation that randomly
+// fails deliveries as described by Faults. Successfully committed messages
+// are recorded and can be inspected using Messages and Delivered.
+//
+// Unlike Target, it is safe for concurrent use.
+type FaultyTarget struct {
+	Faults
+
+	// Committed, if not nil, receives a copy of each committed message.
+	// Make sure it is buffered or read from it, otherwise Commit blocks.
+	Committed chan Msg
+
+	InstName string
+
+	fi faultInjector
+
+	msgsLck   sync.Mutex
+	msgs      []Msg
+	delivered map[string]int
+}
+
+func (ft *FaultyTarget) Init(*config.Map) error {
+	return nil
+}
+
+func (ft *FaultyTarget) Name() string {
+	return "faulty_target"
+}
+
+func (ft *FaultyTarget) InstanceName() string {
+	if ft.InstName != "" {
+		return ft.InstName
+	}
+	return "faulty_target"
+}
+
+func (ft *FaultyTarget) injector() *faultInjector {
+	return ft.fi.init(ft.InstanceName(), false)
+}
+
+// Stats returns counters of performed operations and injected faults.
+func (ft *FaultyTarget) Stats() FaultStats {
+	return ft.fi.Stats()
+}
+
+// Messages returns the copy of the committed messages list.
+func (ft *FaultyTarget) Messages() []Msg {
+	ft.msgsLck.Lock()
+	defer ft.msgsLck.Unlock()
+	return append([]Msg(nil), ft.msgs...)
+}
+
+// Delivered returns how many times the message was successfully delivered
+// to the recipient.
+func (ft *FaultyTarget) Delivered(rcpt string) int {
+	ft.msgsLck.Lock()
+	defer ft.msgsLck.Unlock()
+	return ft.delivered[rcpt]
+}
+
+func (ft *FaultyTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	if err := ft.injector().inject(ctx, &ft.Faults, "start"); err != nil {
+		return nil, err
+	}
+
+	d := &faultyDelivery{
+		ft:  ft,
+		msg: Msg{MsgMeta: msgMeta, MailFrom: mailFrom},
+	}
+	if ft.RcptFailRate != 0 {
+		return &faultyDeliveryPartial{d}, nil
+	}
+	return d, nil
+}
+
+type faultyDelivery struct {
+	ft     *FaultyTarget
+	msg    Msg
+	failed map[string]struct{}
+}
+
+type faultyDeliveryPartial struct {
+	*faultyDelivery
+}
+
+func (fd *faultyDelivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	if err := fd.ft.fi.inject(ctx, &fd.ft.Faults, "rcpt"); err != nil {
+		return err
+	}
+	fd.msg.RcptTo = append(fd.msg.RcptTo, rcptTo)
+	return nil
+}
+
+func (fd *faultyDelivery) readBody(header textproto.Header, buf buffer.Buffer) error {
+	fd.msg.Header = header
+	r, err := buf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fd.msg.Body, err = io.ReadAll(r)
+	return err
+}
+
+func (fd *faultyDelivery) Body(ctx context.Context, header textproto.Header, buf buffer.Buffer) error {
+	if err := fd.ft.fi.inject(ctx, &fd.ft.Faults, "body"); err != nil {
+		return err
+	}
+	return fd.readBody(header, buf)
+}
+
+func (fd *faultyDeliveryPartial) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, buf buffer.Buffer) {
+	setAll := func(err error) {
+		for _, rcpt := range fd.msg.RcptTo {
+			c.SetStatus(rcpt, err)
+		}
+	}
+
+	if err := fd.ft.fi.inject(ctx, &fd.ft.Faults, "body"); err != nil {
+		setAll(err)
+		return
+	}
+	if err := fd.readBody(header, buf); err != nil {
+		setAll(err)
+		return
+	}
+
+	fd.failed = make(map[string]struct{})
+	for _, rcpt := range fd.msg.RcptTo {
+		if fd.ft.fi.rcptFails(&fd.ft.Faults) {
+			fd.failed[rcpt] = struct{}{}
+			c.SetStatus(rcpt, fd.ft.fi.err("body", true))
+		}
+	}
+}
+
+func (fd *faultyDelivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (fd *faultyDelivery) Commit(ctx context.Context) error {
+	if err := fd.ft.fi.inject(ctx, &fd.ft.Faults, "commit"); err != nil {
+		return err
+	}
+
+	fd.ft.msgsLck.Lock()
+	if fd.ft.delivered == nil {
+		fd.ft.delivered = make(map[string]int)
+	}
+	for _, rcpt := range fd.msg.RcptTo {
+		if _, failed := fd.failed[rcpt]; failed {
+			continue
+		}
+		fd.ft.delivered[rcpt]++
+	}
+	fd.ft.msgs = append(fd.ft.msgs, fd.msg)
+	fd.ft.msgsLck.Unlock()
+
+	if fd.ft.Committed != nil {
+		fd.ft.Committed <- fd.msg
+	}
+	return nil
+}
+
+// FaultyCheck is a module.Check implementation that randomly rejects or
+// quarantines messages as described by Faults. Temporary and permanent
+// failures are reported as rejections with the corresponding error codes.
+//
+// Unlike Check, it is safe for concurrent use.
+type FaultyCheck struct {
+	Faults
+
+	// Quarantine makes the check quarantine the message instead of
+	// rejecting it.
+	Quarantine bool
+
+	InstName string
+
+	fi faultInjector
+}
+
+func (fc *FaultyCheck) Init(*config.Map) error {
+	return nil
+}
+
+func (fc *FaultyCheck) Name() string {
+	return "faulty_check"
+}
+
+func (fc *FaultyCheck) InstanceName() string {
+	if fc.InstName != "" {
+		return fc.InstName
+	}
+	return "faulty_check"
+}
+
+func (fc *FaultyCheck) injector() *faultInjector {
+	return fc.fi.init(fc.InstanceName(), true)
+}
+
+// Stats returns counters of performed checks and injected faults.
+func (fc *FaultyCheck) Stats() FaultStats {
+	return fc.fi.Stats()
+}
+
+func (fc *FaultyCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	fc.injector()
+	return faultyCheckState{fc}, nil
+}
+
+type faultyCheckState struct {
+	fc *FaultyCheck
+}
+
+func (s faultyCheckState) result(ctx context.Context, stage string) module.CheckResult {
+	err := s.fc.fi.inject(ctx, &s.fc.Faults, stage)
+	if err == nil {
+		return module.CheckResult{}
+	}
+	return module.CheckResult{
+		Reason:     err,
+		Reject:     !s.fc.Quarantine,
+		Quarantine: s.fc.Quarantine,
+	}
+}
+
+func (s faultyCheckState) CheckConnection(ctx context.Context) module.CheckResult {
+	return s.result(ctx, "connection")
+}
+
+func (s faultyCheckState) CheckSender(ctx context.Context, _ string) module.CheckResult {
+	return s.result(ctx, "sender")
+}
+
+func (s faultyCheckState) CheckRcpt(ctx context.Context, _ string) module.CheckResult {
+	return s.result(ctx, "rcpt")
+}
+
+func (s faultyCheckState) CheckBody(ctx context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	return s.result(ctx, "body")
+}
+
+func (s faultyCheckState) Close() error {
+	return nil
+}
+
+// WaitDelivered waits until the message is delivered to each of rcpts at
+// least once or fails the test after timeout.
+//
+// It is intended for testing of components that retry deliveries in
+// background, such as the queue.
+func WaitDelivered(t *testing.T, ft *FaultyTarget, rcpts []string, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var missing []string
+		for _, rcpt := range rcpts {
+			if ft.Delivered(rcpt) == 0 {
+				missing = append(missing, rcpt)
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message is not delivered to %v in %v, stats: %+v", missing, timeout, ft.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// CheckDeliveredOnce checks that the message was delivered to each of rcpts
+// exactly once and was not delivered to anybody else. Retries of partially
+// failed deliveries should not produce duplicates.
+func CheckDeliveredOnce(t *testing.T, ft *FaultyTarget, rcpts []string) {
+	t.Helper()
+
+	ft.msgsLck.Lock()
+	defer ft.msgsLck.Unlock()
+
+	expected := make(map[string]struct{}, len(rcpts))
+	for _, rcpt := range rcpts {
+		expected[rcpt] = struct{}{}
+		if n := ft.delivered[rcpt]; n != 1 {
+			t.Errorf("message delivered to %s %d times, want 1", rcpt, n)
+		}
+	}
+
+	var unexpected []string
+	for rcpt := range ft.delivered {
+		if _, ok := expected[rcpt]; !ok {
+			unexpected = append(unexpected, rcpt)
+		}
+	}
+	if len(unexpected) != 0 {
+		sort.Strings(unexpected)
+		t.Errorf("message delivered to unexpected recipients: %v", unexpected)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// AddSeeds adds each of seeds to the seed corpus of the fuzz target.
+func AddSeeds(f *testing.F, seeds ...string) {
+	for _, s := range seeds {
+		f.Add(s)
+	}
+}
+
+// AddSeedFiles adds contents of files matching the glob pattern to the seed
+// corpus of the fuzz target. Pattern is relative to the package directory.
+func AddSeedFiles(f *testing.F, pattern string) {
+	f.Helper()
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		blob, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(blob))
+	}
+}
+
+// NoHang runs fn and fails the test if it does not return in timeout.
+//
+// Native fuzzing only reports hangs when the whole run times out, so fuzz
+// targets for parsers that loop over the input should use it to catch
+// infinite loops at the input that caused them.
+func NoHang(t *testing.T, timeout time.Duration, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		t.Fatalf("function did not return in %v", timeout)
+	}
+}
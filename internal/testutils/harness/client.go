@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package harness
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// SMTP connects to the SMTP endpoint listening on the named port and sends
+// EHLO. The connection is closed when the test completes.
+func (i *Instance) SMTP(portName string) *smtp.Client {
+	i.t.Helper()
+
+	cl, err := smtp.Dial(i.Addr(portName))
+	if err != nil {
+		i.t.Fatal("harness: smtp dial:", err)
+	}
+	i.t.Cleanup(func() { cl.Close() })
+
+	if err := cl.Hello("client.maddy.test"); err != nil {
+		i.t.Fatal("harness: smtp EHLO:", err)
+	}
+	return cl
+}
+
+// SendMail sends the message over a new SMTP connection and returns the
+// error reported by the server, if any. If username is not empty, the
+// client authenticates using AUTH PLAIN first.
+//
+// msg should use LF or CRLF line endings and include the header.
+func (i *Instance) SendMail(portName, username, password, from string, to []string, msg string) error {
+	i.t.Helper()
+
+	cl := i.SMTP(portName)
+	defer cl.Close()
+
+	if username != "" {
+		if err := cl.Auth(sasl.NewPlainClient("", username, password)); err != nil {
+			return err
+		}
+	}
+	if err := cl.Mail(from, nil); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := cl.Rcpt(rcpt, nil); err != nil {
+			return err
+		}
+	}
+
+	wc, err := cl.Data()
+	if err != nil {
+		return err
+	}
+	msg = strings.ReplaceAll(strings.ReplaceAll(msg, "\r\n", "\n"), "\n", "\r\n")
+	if _, err := io.WriteString(wc, msg); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return cl.Quit()
+}
+
+// IMAP connects to the IMAP endpoint listening on the named port and logs
+// in. The connection is closed when the test completes.
+func (i *Instance) IMAP(portName, username, password string) *imapclient.Client {
+	i.t.Helper()
+
+	cl, err := imapclient.Dial(i.Addr(portName))
+	if err != nil {
+		i.t.Fatal("harness: imap dial:", err)
+	}
+	i.t.Cleanup(func() { cl.Terminate() }) //nolint:errcheck
+
+	if err := cl.Login(username, password); err != nil {
+		i.t.Fatal("harness: imap login:", err)
+	}
+	return cl
+}
+
+// FetchAll returns full contents of all messages in the mailbox.
+func (i *Instance) FetchAll(cl *imapclient.Client, mailbox string) []string {
+	i.t.Helper()
+
+	status, err := cl.Select(mailbox, true)
+	if err != nil {
+		i.t.Fatal("harness: imap select:", err)
+	}
+	if status.Messages == 0 {
+		return nil
+	}
+
+	seq := &imap.SeqSet{}
+	seq.AddRange(1, status.Messages)
+	section := &imap.BodySectionName{Peek: true}
+
+	ch := make(chan *imap.Message, status.Messages)
+	if err := cl.Fetch(seq, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		i.t.Fatal("harness: imap fetch:", err)
+	}
+
+	msgs := make([]string, 0, status.Messages)
+	for msg := range ch {
+		body := msg.GetBody(section)
+		if body == nil {
+			i.t.Fatal("harness: server did not return message body")
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			i.t.Fatal("harness:", err)
+		}
+		msgs = append(msgs, string(b))
+	}
+	return msgs
+}
+
+// WaitMessages polls the mailbox until it contains at least n messages and
+// returns their contents. The test fails if that does not happen within
+// timeout.
+//
+// It is useful if messages are delivered asynchronously, e.g. via the
+// queue.
+func (i *Instance) WaitMessages(cl *imapclient.Client, mailbox string, n int, timeout time.Duration) []string {
+	i.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		msgs := i.FetchAll(cl, mailbox)
+		if len(msgs) >= n {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			i.t.Fatalf("harness: expected %d messages in %s, got %d after %v", n, mailbox, len(msgs), timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package harness runs a complete maddy instance inside the test process
+// and provides SMTP and IMAP client helpers for end-to-end tests.
+//
+// Unlike the tests package, it does not need a compiled server binary, so
+// features spanning multiple modules can be tested using plain go test.
+// Since modules rely on global state, only one instance can be running at
+// a time and tests using it should not call t.Parallel.
+package harness
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// DefaultConfig is a configuration with SMTP, Submission and IMAP endpoints
+// backed by SQLite storage and credentials database. Messages accepted
+// on both SMTP endpoints are delivered to local mailboxes.
+//
+// Use CreateUser to add accounts.
+const DefaultConfig = `
+hostname mx.maddy.test
+
+auth.pass_table local_authdb {
+	table sql_table {
+		driver sqlite3
+		dsn credentials.db
+		table_name passwords
+	}
+}
+
+storage.imapsql local_mailboxes {
+	driver sqlite3
+	dsn imapsql.db
+}
+
+smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+	tls off
+	deliver_to &local_mailboxes
+}
+
+submission tcp://127.0.0.1:{env:TEST_PORT_submission} {
+	tls off
+	auth &local_authdb
+	deliver_to &local_mailboxes
+}
+
+imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+	tls off
+	auth &local_authdb
+	storage &local_mailboxes
+}
+`
+
+var portPlaceholder = regexp.MustCompile(`{env:TEST_PORT_([a-zA-Z0-9_]+)}`)
+
+// Instance is a maddy server running inside the test process.
+type Instance struct {
+	t *testing.T
+
+	dir   string
+	ports map[string]uint16
+
+	stop       func()
+	prevWd     string
+	prevLogOut log.Output
+}
+
+// New creates the Instance using temporary directory of t for the state.
+// The server is not started until Run is called.
+func New(t *testing.T) *Instance {
+	return &Instance{
+		t:     t,
+		dir:   t.TempDir(),
+		ports: map[string]uint16{},
+	}
+}
+
+// Port allocates the free TCP port and makes it available in the
+// configuration as {env:TEST_PORT_name}. Ports referenced by the
+// configuration are allocated automatically by Run.
+func (i *Instance) Port(name string) uint16 {
+	i.t.Helper()
+
+	if port, ok := i.ports[name]; ok {
+		return port
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		i.t.Fatal("harness: failed to allocate port:", err)
+	}
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	i.ports[name] = port
+	i.t.Setenv("TEST_PORT_"+name, strconv.Itoa(int(port)))
+	return port
+}
+
+// Addr returns the address of the port allocated using Port.
+func (i *Instance) Addr(portName string) string {
+	i.t.Helper()
+
+	port, ok := i.ports[portName]
+	if !ok {
+		i.t.Fatalf("harness: port %s is not allocated", portName)
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+}
+
+// StateDir returns the state directory of the server. Relative paths in
+// the configuration are resolved against it.
+func (i *Instance) StateDir() string {
+	return filepath.Join(i.dir, "state")
+}
+
+// Run starts the server using the specified configuration. state_dir,
+// runtime_dir and log directives are set by the harness and should not be
+// included in cfg.
+//
+// The server is stopped automatically when the test completes.
+func (i *Instance) Run(cfg string) {
+	i.t.Helper()
+
+	if i.stop != nil {
+		i.t.Fatal("harness: Run called twice")
+	}
+
+	for _, match := range portPlaceholder.FindAllStringSubmatch(cfg, -1) {
+		i.Port(match[1])
+	}
+
+	logTarget := "off"
+	if testing.Verbose() {
+		logTarget = "stderr"
+	}
+	fullCfg := fmt.Sprintf("state_dir %q\nruntime_dir %q\nlog %s\n%s",
+		i.StateDir(), filepath.Join(i.dir, "run"), logTarget, cfg)
+
+	nodes, err := parser.Read(strings.NewReader(fullCfg), i.t.Name()+".conf")
+	if err != nil {
+		i.t.Fatal("harness: config parse:", err)
+	}
+
+	i.prevWd, err = os.Getwd()
+	if err != nil {
+		i.t.Fatal("harness:", err)
+	}
+	i.prevLogOut = log.DefaultLogger.Out
+
+	i.stop, err = maddy.StartInProcess(nodes)
+	if err != nil {
+		i.restore()
+		i.t.Fatal("harness: server start:", err)
+	}
+	i.t.Cleanup(i.Close)
+}
+
+func (i *Instance) restore() {
+	log.DefaultLogger.Out = i.prevLogOut
+	if err := os.Chdir(i.prevWd); err != nil {
+		i.t.Error("harness:", err)
+	}
+}
+
+// Close stops the server. It is called automatically when the test
+// completes.
+func (i *Instance) Close() {
+	if i.stop == nil {
+		return
+	}
+	i.stop()
+	i.stop = nil
+	i.restore()
+}
+
+// Module returns the instance of the configuration block with the
+// specified name.
+func (i *Instance) Module(name string) module.Module {
+	i.t.Helper()
+
+	mod, err := module.GetInstance(name)
+	if err != nil {
+		i.t.Fatal("harness:", err)
+	}
+	return mod
+}
+
+// CreateUser creates the credentials entry in the authDB module and the
+// account in the storage module. Use "local_authdb" and "local_mailboxes"
+// for DefaultConfig.
+func (i *Instance) CreateUser(authDB, storage, username, password string) {
+	i.t.Helper()
+
+	db, ok := i.Module(authDB).(module.PlainUserDB)
+	if !ok {
+		i.t.Fatalf("harness: %s is not a local credentials store", authDB)
+	}
+	if err := db.CreateUser(username, password); err != nil {
+		i.t.Fatal("harness: create user:", err)
+	}
+
+	st, ok := i.Module(storage).(module.ManageableStorage)
+	if !ok {
+		i.t.Fatalf("harness: %s does not support account management", storage)
+	}
+	if err := st.CreateIMAPAcct(username); err != nil {
+		i.t.Fatal("harness: create account:", err)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !nosqlite3 && cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package harness
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHarness_SubmitAndFetch(t *testing.T) {
+	srv := New(t)
+	srv.Run(DefaultConfig)
+	srv.CreateUser("local_authdb", "local_mailboxes", "alice@maddy.test", "1234")
+	srv.CreateUser("local_authdb", "local_mailboxes", "bob@maddy.test", "5678")
+
+	err := srv.SendMail("submission", "alice@maddy.test", "1234",
+		"alice@maddy.test", []string{"bob@maddy.test"},
+		"From: <alice@maddy.test>\nTo: <bob@maddy.test>\nSubject: Hi!\n\nHello!\n")
+	if err != nil {
+		t.Fatal("SendMail:", err)
+	}
+
+	cl := srv.IMAP("imap", "bob@maddy.test", "5678")
+	msgs := srv.WaitMessages(cl, "INBOX", 1, 5*time.Second)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if !strings.Contains(msgs[0], "Subject: Hi!") || !strings.Contains(msgs[0], "Hello!") {
+		t.Errorf("unexpected message contents:\n%s", msgs[0])
+	}
+}
+
+func TestHarness_Restart(t *testing.T) {
+	// Instances should be able to run one after another in the same process.
+	for i := 0; i < 2; i++ {
+		srv := New(t)
+		srv.Run(DefaultConfig)
+		srv.SMTP("smtp").Quit() //nolint:errcheck
+		srv.Close()
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sync"
 	"time"
@@ -30,6 +31,7 @@ import (
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/secrets"
 )
 
 type FileLoader struct {
@@ -75,6 +77,9 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 	}
 
 	for _, certPath := range f.certPaths {
+		if secrets.IsInlinePEM(certPath) {
+			continue
+		}
 		if !filepath.IsAbs(certPath) {
 			return fmt.Errorf("tls.loader.file: only absolute paths allowed in certificate paths: sorry :(")
 		}
@@ -139,9 +144,18 @@ func (f *FileLoader) loadCerts() error {
 		certPath := f.certPaths[i]
 		keyPath := f.keyPaths[i]
 
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		certPEM, certName, err := readPEM(certPath, "inline certificate")
+		if err != nil {
+			return err
+		}
+		keyPEM, keyName, err := readPEM(keyPath, "inline key")
+		if err != nil {
+			return err
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
 		if err != nil {
-			return fmt.Errorf("failed to load %s and %s: %v", certPath, keyPath, err)
+			return fmt.Errorf("failed to load %s and %s: %v", certName, keyName, err)
 		}
 		certs = append(certs, cert)
 	}
@@ -153,6 +167,20 @@ func (f *FileLoader) loadCerts() error {
 	return nil
 }
 
+// readPEM reads the PEM file at path. path can also contain the PEM blob
+// itself (e.g. if the secret reference was used in the configuration), the
+// returned name is then inlineName so the key is not leaked into logs.
+func readPEM(path, inlineName string) (blob []byte, name string, err error) {
+	if secrets.IsInlinePEM(path) {
+		return []byte(path), inlineName, nil
+	}
+	blob, err = os.ReadFile(path)
+	if err != nil {
+		return nil, path, fmt.Errorf("failed to load %s: %v", path, err)
+	}
+	return blob, path, nil
+}
+
 func (f *FileLoader) ConfigureTLS(c *tls.Config) error {
 	// Loader function replaces only the whole slice.
 	f.certsLock.RLock()
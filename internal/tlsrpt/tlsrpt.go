@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tlsrpt aggregates outbound TLS session results in the format
+// defined by RFC 8460 (SMTP TLS Reporting).
+//
+// Results are collected globally by delivery targets and exported using
+// the admin endpoint. Delivering reports to the addresses published by
+// recipient domains is not done by maddy.
+package tlsrpt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Result types defined in RFC 8460 Section 4.3.
+const (
+	STARTTLSNotSupported    = "starttls-not-supported"
+	CertificateHostMismatch = "certificate-host-mismatch"
+	CertificateExpired      = "certificate-expired"
+	CertificateNotTrusted   = "certificate-not-trusted"
+	ValidationFailure       = "validation-failure"
+)
+
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+type PolicyResult struct {
+	Policy         Policy          `json:"policy"`
+	Summary        Summary         `json:"summary"`
+	FailureDetails []FailureDetail `json:"failure-details,omitempty"`
+}
+
+type Policy struct {
+	Type   string `json:"policy-type"`
+	Domain string `json:"policy-domain"`
+}
+
+type Summary struct {
+	Successful int `json:"total-successful-session-count"`
+	Failed     int `json:"total-failure-session-count"`
+}
+
+type FailureDetail struct {
+	ResultType     string `json:"result-type"`
+	ReceivingMX    string `json:"receiving-mx-hostname,omitempty"`
+	FailedSessions int    `json:"failed-session-count"`
+	AdditionalInfo string `json:"additional-information,omitempty"`
+}
+
+type failureKey struct {
+	resultType string
+	mx         string
+}
+
+type domainStats struct {
+	successful int
+	failures   map[failureKey]int
+	lastReason map[failureKey]string
+}
+
+var (
+	lock   sync.Mutex
+	start  = time.Now()
+	stats  = map[string]*domainStats{}
+	serial int
+)
+
+func statsFor(domain string) *domainStats {
+	s, ok := stats[domain]
+	if !ok {
+		s = &domainStats{
+			failures:   map[failureKey]int{},
+			lastReason: map[failureKey]string{},
+		}
+		stats[domain] = s
+	}
+	return s
+}
+
+// RecordSuccess records a session to the domain MX that negotiated TLS
+// successfully.
+func RecordSuccess(domain string) {
+	lock.Lock()
+	defer lock.Unlock()
+	statsFor(domain).successful++
+}
+
+// RecordFailure records a session to the domain MX that failed to negotiate
+// TLS. reason is a human-readable description included in the
+// additional-information field.
+func RecordFailure(domain, resultType, mx, reason string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	s := statsFor(domain)
+	key := failureKey{resultType: resultType, mx: mx}
+	s.failures[key]++
+	s.lastReason[key] = reason
+}
+
+// Collect returns the report for all results recorded since the previous
+// Collect call and resets the counters.
+func Collect(orgName, contact string) Report {
+	lock.Lock()
+	defer lock.Unlock()
+
+	now := time.Now()
+	serial++
+	rep := Report{
+		OrganizationName: orgName,
+		DateRange:        DateRange{Start: start.UTC(), End: now.UTC()},
+		ContactInfo:      contact,
+		ReportID:         fmt.Sprintf("%d.%d@%s", now.Unix(), serial, orgName),
+		Policies:         make([]PolicyResult, 0, len(stats)),
+	}
+
+	for domain, s := range stats {
+		res := PolicyResult{
+			// Results are not attributed to MTA-STS or DANE policies, so
+			// everything is reported as if no policy was found.
+			Policy:  Policy{Type: "no-policy-found", Domain: domain},
+			Summary: Summary{Successful: s.successful},
+		}
+		for key, count := range s.failures {
+			res.Summary.Failed += count
+			res.FailureDetails = append(res.FailureDetails, FailureDetail{
+				ResultType:     key.resultType,
+				ReceivingMX:    key.mx,
+				FailedSessions: count,
+				AdditionalInfo: s.lastReason[key],
+			})
+		}
+		sort.Slice(res.FailureDetails, func(i, j int) bool {
+			a, b := res.FailureDetails[i], res.FailureDetails[j]
+			if a.ResultType != b.ResultType {
+				return a.ResultType < b.ResultType
+			}
+			return a.ReceivingMX < b.ReceivingMX
+		})
+		rep.Policies = append(rep.Policies, res)
+	}
+	sort.Slice(rep.Policies, func(i, j int) bool {
+		return rep.Policies[i].Policy.Domain < rep.Policies[j].Policy.Domain
+	})
+
+	stats = map[string]*domainStats{}
+	start = now
+	return rep
+}
@@ -0,0 +1,60 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"testing"
+)
+
+func TestCollect(t *testing.T) {
+	Collect("", "")
+
+	RecordSuccess("example.org")
+	RecordSuccess("example.org")
+	RecordFailure("example.org", STARTTLSNotSupported, "mx.example.org", "")
+	RecordFailure("example.com", CertificateExpired, "mx1.example.com", "expired")
+	RecordFailure("example.com", CertificateExpired, "mx1.example.com", "expired")
+
+	rep := Collect("mx.example.net", "postmaster@example.net")
+	if rep.OrganizationName != "mx.example.net" || rep.ContactInfo != "postmaster@example.net" {
+		t.Errorf("wrong report metadata: %+v", rep)
+	}
+	if len(rep.Policies) != 2 {
+		t.Fatalf("expected 2 policies, got %d", len(rep.Policies))
+	}
+
+	com, org := rep.Policies[0], rep.Policies[1]
+	if com.Policy.Domain != "example.com" || org.Policy.Domain != "example.org" {
+		t.Fatalf("wrong policy order: %v, %v", com.Policy.Domain, org.Policy.Domain)
+	}
+	if com.Summary.Successful != 0 || com.Summary.Failed != 2 {
+		t.Errorf("wrong summary for example.com: %+v", com.Summary)
+	}
+	if len(com.FailureDetails) != 1 || com.FailureDetails[0].FailedSessions != 2 ||
+		com.FailureDetails[0].ResultType != CertificateExpired {
+		t.Errorf("wrong failure details for example.com: %+v", com.FailureDetails)
+	}
+	if org.Summary.Successful != 2 || org.Summary.Failed != 1 {
+		t.Errorf("wrong summary for example.org: %+v", org.Summary)
+	}
+
+	if rep := Collect("", ""); len(rep.Policies) != 0 {
+		t.Errorf("counters are not reset: %+v", rep.Policies)
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+const (
+	// maxBatch is the maximum amount of spans sent in a single request.
+	maxBatch = 512
+
+	// queueSize is the maximum amount of spans waiting for export. Spans
+	// are dropped if the queue is full, tracing should never block message
+	// processing.
+	queueSize = 4096
+
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+// Exporter sends finished spans to the OTLP/HTTP collector.
+type Exporter struct {
+	Endpoint    string
+	ServiceName string
+	Headers     map[string]string
+	SampleRatio float64
+	Log         log.Logger
+
+	client *http.Client
+	queue  chan *Span
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewExporter creates the Exporter and starts the background goroutine
+// sending spans to the endpoint.
+//
+// endpoint is the full URL of the traces collector, e.g.
+// http://127.0.0.1:4318/v1/traces.
+func NewExporter(endpoint, serviceName string, headers map[string]string, sampleRatio float64, logger log.Logger) *Exporter {
+	e := &Exporter{
+		Endpoint:    endpoint,
+		ServiceName: serviceName,
+		Headers:     headers,
+		SampleRatio: sampleRatio,
+		Log:         logger,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, queueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *Exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.Log.DebugMsg("span queue is full, dropping span", "span", s.name)
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			e.Log.Error("span export failed", err, "spans", len(batch))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= maxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+					if len(batch) >= maxBatch {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close sends all pending spans and stops the background goroutine.
+func (e *Exporter) Close() error {
+	close(e.stop)
+	<-e.done
+	return nil
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func attrValue(val interface{}) otlpValue {
+	switch val := val.(type) {
+	case string:
+		return otlpValue{StringValue: &val}
+	case bool:
+		return otlpValue{BoolValue: &val}
+	case int:
+		s := strconv.FormatInt(int64(val), 10)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(val, 10)
+		return otlpValue{IntValue: &s}
+	case uint32:
+		s := strconv.FormatUint(uint64(val), 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &val}
+	case time.Duration:
+		s := val.String()
+		return otlpValue{StringValue: &s}
+	case error:
+		s := val.Error()
+		return otlpValue{StringValue: &s}
+	case fmt.Stringer:
+		s := val.String()
+		return otlpValue{StringValue: &s}
+	default:
+		s := fmt.Sprint(val)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              int(s.kind),
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        make([]otlpAttr, 0, len(s.attrs)),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, a := range s.attrs {
+		span.Attributes = append(span.Attributes, otlpAttr{Key: a.key, Value: attrValue(a.val)})
+	}
+	if s.err != "" {
+		span.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return span
+}
+
+func (e *Exporter) encode(spans []*Span) ([]byte, error) {
+	scope := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/foxcpp/maddy"},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttr{{Key: "service.name", Value: attrValue(e.ServiceName)}},
+			},
+			ScopeSpans: []otlpScopeSpans{scope},
+		}},
+	})
+}
+
+func (e *Exporter) export(spans []*Span) error {
+	blob, err := e.encode(spans)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("tracing: collector returned %s", resp.Status)
+	}
+	return nil
+}
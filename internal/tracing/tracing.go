@@ -0,0 +1,244 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tracing implements distributed tracing of the message flow.
+//
+// Each message is represented by a trace with the ID derived from the
+// internal message ID. This allows to correlate spans created at different
+// times (e.g. queue delivery attempts) without storing any additional state.
+// Spans are exported using OTLP/HTTP (JSON encoding).
+//
+// All functions are no-op if no exporter is configured or the message is
+// not sampled. Methods of Span are safe to call on the nil value.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type attr struct {
+	key string
+	val interface{}
+}
+
+// Span represents a single operation within the message trace.
+type Span struct {
+	exp *Exporter
+
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+
+	name  string
+	kind  Kind
+	start time.Time
+	end   time.Time
+
+	lock  sync.Mutex
+	attrs []attr
+	err   string
+	ended bool
+}
+
+type spanKey struct{}
+
+var current atomic.Value // *Exporter
+
+// SetExporter sets the Exporter used for all new spans. nil disables
+// tracing.
+func SetExporter(e *Exporter) {
+	current.Store(e)
+}
+
+func exporter() *Exporter {
+	e, _ := current.Load().(*Exporter)
+	return e
+}
+
+// messageIDs returns the trace ID and the root span ID for the message.
+func messageIDs(msgID string) (traceID [16]byte, spanID [8]byte) {
+	sum := sha256.Sum256([]byte(msgID))
+	copy(traceID[:], sum[:16])
+	copy(spanID[:], sum[16:24])
+	return
+}
+
+func sampled(traceID [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(traceID[8:]) < uint64(ratio*math.MaxUint64)
+}
+
+func newSpan(exp *Exporter, traceID [16]byte, parentID [8]byte, name string, attrs []interface{}) *Span {
+	s := &Span{
+		exp:      exp,
+		traceID:  traceID,
+		parentID: parentID,
+		name:     name,
+		kind:     KindInternal,
+		start:    time.Now(),
+	}
+	if _, err := rand.Read(s.spanID[:]); err != nil {
+		return nil
+	}
+	s.SetAttrs(attrs...)
+	return s
+}
+
+// StartMessage creates the root span for the message with the specified
+// internal ID.
+//
+// attrs should contain key strings followed by corresponding values.
+func StartMessage(ctx context.Context, msgID, name string, attrs ...interface{}) (context.Context, *Span) {
+	exp := exporter()
+	if exp == nil {
+		return ctx, nil
+	}
+	traceID, spanID := messageIDs(msgID)
+	if !sampled(traceID, exp.SampleRatio) {
+		return ctx, nil
+	}
+
+	s := newSpan(exp, traceID, [8]byte{}, name, attrs)
+	if s == nil {
+		return ctx, nil
+	}
+	s.spanID = spanID
+	s.kind = KindServer
+	s.SetAttrs("maddy.msg_id", msgID)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// ResumeMessage creates the span for the message that was started
+// previously (possibly by a different process run), e.g. a queue delivery
+// attempt. The span is a child of the message root span.
+func ResumeMessage(ctx context.Context, msgID, name string, attrs ...interface{}) (context.Context, *Span) {
+	exp := exporter()
+	if exp == nil {
+		return ctx, nil
+	}
+	traceID, rootID := messageIDs(msgID)
+	if !sampled(traceID, exp.SampleRatio) {
+		return ctx, nil
+	}
+
+	s := newSpan(exp, traceID, rootID, name, attrs)
+	if s == nil {
+		return ctx, nil
+	}
+	s.SetAttrs("maddy.msg_id", msgID)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Start creates the child of the span stored in the context. If there is no
+// such span, Start does nothing and returns nil.
+func Start(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	s := newSpan(parent.exp, parent.traceID, parent.spanID, name, attrs)
+	if s == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span stored in the context, if any.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SetKind changes the kind of the span. Spans are created with KindInternal
+// unless specified otherwise.
+func (s *Span) SetKind(k Kind) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.kind = k
+}
+
+// SetAttrs adds attributes to the span. Arguments should contain key
+// strings followed by corresponding values.
+func (s *Span) SetAttrs(attrs ...interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key, ok := attrs[i].(string)
+		if !ok {
+			continue
+		}
+		s.attrs = append(s.attrs, attr{key: key, val: attrs[i+1]})
+	}
+}
+
+// SetError marks the operation represented by the span as failed. It is
+// no-op if err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and passes it to the exporter. Calls after the
+// first one are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.lock.Unlock()
+
+	s.exp.enqueue(s)
+}
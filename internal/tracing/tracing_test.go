@@ -0,0 +1,136 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+func TestMessageTrace(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		spans []otlpSpan
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("wrong Content-Type: %v", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("X-Token") != "secret" {
+			t.Errorf("missing custom header")
+		}
+
+		req := otlpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	exp := NewExporter(srv.URL, "maddy-test", map[string]string{"X-Token": "secret"}, 1, log.Logger{Name: "tracing"})
+	SetExporter(exp)
+	defer SetExporter(nil)
+
+	ctx, root := StartMessage(context.Background(), "msg1", "smtp.message")
+	_, child := Start(ctx, "check", "check", "check.spf")
+	child.SetError(errors.New("failed"))
+	child.End()
+	root.End()
+	root.End() // no-op
+
+	_, attempt := ResumeMessage(context.Background(), "msg1", "queue.attempt")
+	attempt.End()
+
+	if err := exp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	byName := make(map[string]otlpSpan)
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+
+	r, c, a := byName["smtp.message"], byName["check"], byName["queue.attempt"]
+	if r.TraceID != c.TraceID || r.TraceID != a.TraceID {
+		t.Error("spans belong to different traces")
+	}
+	if r.ParentSpanID != "" {
+		t.Error("root span has a parent")
+	}
+	if c.ParentSpanID != r.SpanID {
+		t.Error("wrong parent for the child span")
+	}
+	if a.ParentSpanID != r.SpanID {
+		t.Error("resumed span is not linked to the message root")
+	}
+	if c.Status.Code != 2 || c.Status.Message != "failed" {
+		t.Error("error status is not set:", c.Status)
+	}
+	if r.Kind != int(KindServer) {
+		t.Error("wrong root span kind:", r.Kind)
+	}
+}
+
+func TestNoExporter(t *testing.T) {
+	SetExporter(nil)
+
+	ctx, s := StartMessage(context.Background(), "msg1", "smtp.message")
+	if s != nil {
+		t.Fatal("span created without exporter")
+	}
+	_, child := Start(ctx, "check")
+	if child != nil {
+		t.Fatal("child span created without parent")
+	}
+
+	// Should not panic.
+	child.SetAttrs("a", "b")
+	child.SetError(errors.New("a"))
+	child.End()
+}
+
+func TestSampling(t *testing.T) {
+	traceID, _ := messageIDs("msg1")
+	if sampled(traceID, 0) {
+		t.Error("sampled with zero ratio")
+	}
+	if !sampled(traceID, 1) {
+		t.Error("not sampled with ratio 1")
+	}
+}
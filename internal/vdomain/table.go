@@ -0,0 +1,166 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package vdomain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// keyDomain returns the normalized domain for the table key that is either
+// a domain or an email address.
+func keyDomain(key string) (string, bool) {
+	if strings.Contains(key, "@") {
+		_, domain, err := address.Split(key)
+		if err != nil || domain == "" {
+			return "", false
+		}
+		key = domain
+	}
+	domain, err := dns.ForLookup(key)
+	if err != nil {
+		return "", false
+	}
+	return domain, true
+}
+
+// DomainsTable contains all virtual domains. Keys can be either domains or
+// addresses, values are space-separated lists of DKIM selectors so the table
+// can be used as selector_table for modify.dkim.
+type DomainsTable struct {
+	modName  string
+	instName string
+}
+
+func NewDomainsTable(modName, instName string, _, _ []string) (module.Module, error) {
+	return &DomainsTable{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (t *DomainsTable) Init(cfg *config.Map) error {
+	_, err := cfg.Process()
+	return err
+}
+
+func (t *DomainsTable) Name() string {
+	return t.modName
+}
+
+func (t *DomainsTable) InstanceName() string {
+	return t.instName
+}
+
+func (t *DomainsTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	domain, ok := keyDomain(key)
+	if !ok {
+		return "", false, nil
+	}
+	d, ok := Get(domain)
+	if !ok {
+		return "", false, nil
+	}
+	return strings.Join(d.DKIMSelectors, " "), true, nil
+}
+
+// AliasesTable dispatches lookups to the aliases table of the virtual domain
+// the address belongs to.
+type AliasesTable struct {
+	modName  string
+	instName string
+
+	tables map[string]module.Table
+}
+
+func NewAliasesTable(modName, instName string, _, _ []string) (module.Module, error) {
+	return &AliasesTable{
+		modName:  modName,
+		instName: instName,
+		tables:   map[string]module.Table{},
+	}, nil
+}
+
+func (t *AliasesTable) Init(cfg *config.Map) error {
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, d := range List() {
+		if d.Aliases == nil {
+			continue
+		}
+		var tbl module.Table
+		if err := modconfig.ModuleFromNode("table", d.Aliases.Args, *d.Aliases, cfg.Globals, &tbl); err != nil {
+			return fmt.Errorf("%s: aliases for %s: %w", t.modName, d.Name, err)
+		}
+		t.tables[d.Name] = tbl
+	}
+	return nil
+}
+
+func (t *AliasesTable) Name() string {
+	return t.modName
+}
+
+func (t *AliasesTable) InstanceName() string {
+	return t.instName
+}
+
+func (t *AliasesTable) Lookup(ctx context.Context, key string) (string, bool, error) {
+	domain, ok := keyDomain(key)
+	if !ok {
+		return "", false, nil
+	}
+	tbl, ok := t.tables[domain]
+	if !ok {
+		return "", false, nil
+	}
+	return tbl.Lookup(ctx, key)
+}
+
+func (t *AliasesTable) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	domain, ok := keyDomain(key)
+	if !ok {
+		return nil, nil
+	}
+	tbl, ok := t.tables[domain]
+	if !ok {
+		return nil, nil
+	}
+	if multi, ok := tbl.(module.MultiTable); ok {
+		return multi.LookupMulti(ctx, key)
+	}
+	val, ok, err := tbl.Lookup(ctx, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{val}, nil
+}
+
+func init() {
+	module.Register("table.virtual_domains", NewDomainsTable)
+	module.Register("table.virtual_aliases", NewAliasesTable)
+}
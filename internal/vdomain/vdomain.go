@@ -0,0 +1,157 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package vdomain implements the virtual_domain global directive that
+// declares hosted domains with their DKIM, aliases and MTA-STS settings in
+// one place.
+//
+// Declared domains are used by table.virtual_domains, table.virtual_aliases
+// and the mta_sts endpoint.
+package vdomain
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+type Domain struct {
+	// Name is the normalized domain name.
+	Name string
+
+	// Brand is the human-readable name used in generated texts, such as
+	// Received fields and DSNs.
+	Brand string
+
+	DKIMSelectors []string
+
+	// Aliases is the table definition directive, nil if not set.
+	Aliases *config.Node
+
+	// MTASTSMode is the MTA-STS policy mode, empty if the policy is not
+	// served for the domain.
+	MTASTSMode string
+	MTASTSMX   []string
+
+	TLSRPTRUA []string
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     map[string]Domain
+)
+
+// ParseBlock parses the virtual_domain directive. Multiple domains can be
+// specified as arguments, they get the same settings.
+func ParseBlock(node config.Node) ([]Domain, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one domain is required")
+	}
+
+	var tmpl Domain
+	cfg := config.NewMap(nil, node)
+	cfg.String("brand", false, false, "", &tmpl.Brand)
+	cfg.StringList("dkim_selector", false, false, []string{"default"}, &tmpl.DKIMSelectors)
+	cfg.Callback("aliases", func(_ *config.Map, n config.Node) error {
+		if len(n.Args) == 0 {
+			return config.NodeErr(n, "table definition is required")
+		}
+		tmpl.Aliases = &n
+		return nil
+	})
+	cfg.String("mta_sts_mode", false, false, "", &tmpl.MTASTSMode)
+	cfg.StringList("mta_sts_mx", false, false, nil, &tmpl.MTASTSMX)
+	cfg.StringList("tlsrpt_rua", false, false, nil, &tmpl.TLSRPTRUA)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	switch tmpl.MTASTSMode {
+	case "", "enforce", "testing", "none":
+	default:
+		return nil, config.NodeErr(node, "mta_sts_mode should be one of: enforce, testing, none")
+	}
+
+	domains := make([]Domain, 0, len(node.Args))
+	for _, arg := range node.Args {
+		name, err := dns.ForLookup(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "malformed domain %s: %v", arg, err)
+		}
+		d := tmpl
+		d.Name = name
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// Set replaces the list of declared domains.
+func Set(domains []Domain) error {
+	m := make(map[string]Domain, len(domains))
+	for _, d := range domains {
+		if _, ok := m[d.Name]; ok {
+			return fmt.Errorf("virtual_domain: %s is declared multiple times", d.Name)
+		}
+		m[d.Name] = d
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = m
+	return nil
+}
+
+// Get returns the declared domain. The name should be normalized using
+// dns.ForLookup.
+func Get(name string) (Domain, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	d, ok := registry[name]
+	return d, ok
+}
+
+// Brand returns the brand name of the domain or an empty string if it is not
+// a virtual domain or has no brand set.
+func Brand(domain string) string {
+	domain, err := dns.ForLookup(domain)
+	if err != nil {
+		return ""
+	}
+	d, ok := Get(domain)
+	if !ok {
+		return ""
+	}
+	return d.Brand
+}
+
+// List returns all declared domains sorted by name.
+func List() []Domain {
+	registryLock.RLock()
+	domains := make([]Domain, 0, len(registry))
+	for _, d := range registry {
+		domains = append(domains, d)
+	}
+	registryLock.RUnlock()
+
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+	return domains
+}
@@ -0,0 +1,102 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package vdomain
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestParseBlock(t *testing.T) {
+	domains, err := ParseBlock(config.Node{
+		Name: "virtual_domain",
+		Args: []string{"Example.org", "example.com."},
+		Children: []config.Node{
+			{Name: "dkim_selector", Args: []string{"s1", "s2"}},
+			{Name: "aliases", Args: []string{"file", "/etc/maddy/aliases"}},
+			{Name: "mta_sts_mode", Args: []string{"testing"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 || domains[0].Name != "example.org" || domains[1].Name != "example.com" {
+		t.Fatalf("wrong domains: %+v", domains)
+	}
+	if !reflect.DeepEqual(domains[1].DKIMSelectors, []string{"s1", "s2"}) {
+		t.Errorf("wrong selectors: %v", domains[1].DKIMSelectors)
+	}
+	if domains[1].Aliases == nil || domains[1].Aliases.Args[1] != "/etc/maddy/aliases" {
+		t.Errorf("wrong aliases: %v", domains[1].Aliases)
+	}
+	if domains[1].MTASTSMode != "testing" {
+		t.Errorf("wrong MTA-STS mode: %v", domains[1].MTASTSMode)
+	}
+
+	_, err = ParseBlock(config.Node{
+		Name:     "virtual_domain",
+		Args:     []string{"example.org"},
+		Children: []config.Node{{Name: "mta_sts_mode", Args: []string{"on"}}},
+	})
+	if err == nil {
+		t.Error("invalid mta_sts_mode accepted")
+	}
+
+	if err := Set(append(domains, domains[0])); err == nil {
+		t.Error("duplicate domains accepted")
+	}
+}
+
+func TestDomainsTable(t *testing.T) {
+	domains, err := ParseBlock(config.Node{Name: "virtual_domain", Args: []string{"example.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(domains); err != nil {
+		t.Fatal(err)
+	}
+	defer Set(nil)
+
+	mod, err := NewDomainsTable("table.virtual_domains", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mod.(*DomainsTable)
+
+	for _, key := range []string{"example.org", "EXAMPLE.org", "foxcpp@example.org"} {
+		val, ok, err := tbl.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || val != "default" {
+			t.Errorf("%s: expected selector default, got %v %v", key, val, ok)
+		}
+	}
+	for _, key := range []string{"example.com", "foxcpp@example.com", "postmaster"} {
+		_, ok, err := tbl.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("%s: unexpected match", key)
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
@@ -38,6 +39,8 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/authz"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/sqlmigrate"
+	"github.com/foxcpp/maddy/internal/vdomain"
 	"github.com/urfave/cli/v2"
 
 	// Import packages for side-effect of module registration.
@@ -49,28 +52,46 @@ import (
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/check/access"
+	_ "github.com/foxcpp/maddy/internal/check/annotation"
 	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
 	_ "github.com/foxcpp/maddy/internal/check/command"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
+	_ "github.com/foxcpp/maddy/internal/check/preflight"
+	_ "github.com/foxcpp/maddy/internal/check/reputation"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/check/suppression"
+	_ "github.com/foxcpp/maddy/internal/check/verify_rcpt"
+	_ "github.com/foxcpp/maddy/internal/check/wasm"
+	_ "github.com/foxcpp/maddy/internal/endpoint/admin"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
+	_ "github.com/foxcpp/maddy/internal/endpoint/health"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
+	_ "github.com/foxcpp/maddy/internal/endpoint/mtasts"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
+	_ "github.com/foxcpp/maddy/internal/endpoint/passwd"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
+	_ "github.com/foxcpp/maddy/internal/external"
+	_ "github.com/foxcpp/maddy/internal/grpcfilter"
 	_ "github.com/foxcpp/maddy/internal/imap_filter"
 	_ "github.com/foxcpp/maddy/internal/imap_filter/command"
+	_ "github.com/foxcpp/maddy/internal/imap_filter/rules"
 	_ "github.com/foxcpp/maddy/internal/libdns"
 	_ "github.com/foxcpp/maddy/internal/modify"
+	_ "github.com/foxcpp/maddy/internal/modify/bimi"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/s3"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
 	_ "github.com/foxcpp/maddy/internal/table"
+	_ "github.com/foxcpp/maddy/internal/target/autoreply"
+	_ "github.com/foxcpp/maddy/internal/target/dedup"
+	_ "github.com/foxcpp/maddy/internal/target/journal"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"
 	_ "github.com/foxcpp/maddy/internal/target/smtp"
@@ -293,6 +314,7 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.String("runtime_dir", false, false, DefaultRuntimeDirectory, &config.RuntimeDirectory)
 	globals.String("hostname", false, false, "", nil)
 	globals.String("autogenerated_msg_domain", false, false, "", nil)
+	globals.String("support_url", false, false, "", nil)
 	globals.Custom("tls", false, false, nil, tls.TLSDirective, nil)
 	globals.Custom("tls_client", false, false, nil, tls.TLSClientBlock, nil)
 	globals.Bool("storage_perdomain", false, false, nil)
@@ -300,14 +322,64 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.StringList("auth_domains", false, false, nil, nil)
 	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
+	globals.Custom("log_level", false, false, nil, logLevels, nil)
+	globals.Custom("audit_log", false, false, nil, auditLogOutput, nil)
+	globals.Custom("tracing", false, false, nil, tracingDirective, nil)
+	globals.Custom("sandbox", false, false, nil, sandboxDirective, nil)
+	globals.Bool("debug_buffers", false, false, nil)
+	globals.Custom("dns_cache", false, false, nil, dnsCacheDirective, nil)
+	globals.Duration("dns_timeout", false, false, 0, nil)
+	globals.Duration("connect_timeout", false, false, 0, nil)
+	globals.Duration("command_timeout", false, false, 0, nil)
+	globals.Duration("submission_timeout", false, false, 0, nil)
+	globals.Duration("check_timeout", false, false, 0, nil)
+	globals.Duration("query_timeout", false, false, 0, nil)
+	globals.Bool("sql_auto_migrate", false, true, &sqlmigrate.AutoMigrate)
 	config.EnumMapped(globals, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto, nil)
 	modconfig.Table(globals, "auth_map", true, false, nil, nil)
+	modconfig.Table(globals, "account_protocols", true, false, nil, nil)
+	modconfig.Table(globals, "master_users", true, false, nil, nil)
+	globals.String("master_separator", false, false, "", nil)
+	var vdomains []vdomain.Domain
+	globals.Callback("virtual_domain", func(_ *config.Map, node config.Node) error {
+		domains, err := vdomain.ParseBlock(node)
+		if err != nil {
+			return err
+		}
+		vdomains = append(vdomains, domains...)
+		return nil
+	})
+	globals.Callback("plugin", loadGoPlugin)
 	globals.AllowUnknown()
 	unknown, err := globals.Process()
-	return globals.Values, unknown, err
+	if err != nil {
+		return globals.Values, unknown, err
+	}
+	return globals.Values, unknown, vdomain.Set(vdomains)
 }
 
 func moduleMain(cfg []config.Node) error {
+	if err := startModules(cfg); err != nil {
+		return err
+	}
+
+	systemdStatus(SDReady, "Listening for incoming connections...")
+
+	handleSignals()
+
+	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
+
+	hooks.RunHooks(hooks.EventShutdown)
+
+	return nil
+}
+
+// startModules reads the global configuration, creates and initializes all
+// modules defined in cfg. Endpoints start accepting connections once it
+// returns.
+func startModules(cfg []config.Node) error {
+	start := time.Now()
+
 	globals, modBlocks, err := ReadGlobals(cfg)
 	if err != nil {
 		return err
@@ -318,26 +390,21 @@ func moduleMain(cfg []config.Node) error {
 	}
 
 	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
+	initTracing(globals)
+	initBufferDebug(globals)
+	initDNSTimeout(globals)
+	initDNSCache(globals)
 
 	endpoints, mods, err := RegisterModules(globals, modBlocks)
 	if err != nil {
 		return err
 	}
 
-	err = initModules(globals, endpoints, mods)
-	if err != nil {
+	if err := initModules(globals, endpoints, mods); err != nil {
 		return err
 	}
 
-	systemdStatus(SDReady, "Listening for incoming connections...")
-
-	handleSignals()
-
-	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
-
-	hooks.RunHooks(hooks.EventShutdown)
-
-	return nil
+	return initSandbox(globals, start)
 }
 
 type ModInfo struct {
@@ -431,5 +498,14 @@ func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) erro
 			inst.Cfg.File, inst.Cfg.Line, inst.Instance.InstanceName(), inst.Instance.Name())
 	}
 
+	running := make([]module.Module, 0, len(endpoints)+len(mods))
+	for _, endp := range endpoints {
+		running = append(running, endp.Instance)
+	}
+	for _, inst := range mods {
+		running = append(running, inst.Instance)
+	}
+	module.SetRunning(running)
+
 	return nil
 }
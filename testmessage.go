@@ -0,0 +1,331 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(&cli.Command{
+		Name:  "test-message",
+		Usage: "Show how the message would be handled by the configured pipeline",
+		Description: `Runs the message through the pipeline of the specified endpoint
+as if it was received by it and prints results of all checks,
+changes made by modifiers and selected delivery targets.
+
+The message is not delivered anywhere. Nested pipelines (reroute, msgpipeline
+module) are executed, final delivery targets are only reported. Note that
+checks and modifiers are run for real, e.g. DNS lookups are performed.
+
+Read the message from the standard input if FILE is "-".
+`,
+		ArgsUsage: "FILE",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "endpoint",
+				Usage: "name of the endpoint whose pipeline to use (smtp, submission or lmtp)",
+				Value: "smtp",
+			},
+			&cli.StringFlag{
+				Name:  "from",
+				Usage: "envelope sender (MAIL FROM), null sender is used if not set",
+			},
+			&cli.StringSliceFlag{
+				Name:     "rcpt",
+				Usage:    "envelope recipient (RCPT TO), can be specified multiple times",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "ip",
+				Usage: "client IP address",
+				Value: "127.0.0.1",
+			},
+			&cli.StringFlag{
+				Name:  "helo",
+				Usage: "hostname sent by the client in EHLO",
+				Value: "localhost",
+			},
+			&cli.StringFlag{
+				Name:  "auth-user",
+				Usage: "pretend the client authenticated as the specified user",
+			},
+			&cli.BoolFlag{
+				Name:  "tls",
+				Usage: "pretend the client used TLS",
+			},
+		},
+		Action: testMessage,
+	})
+}
+
+// messageTracer prints pipeline decisions as they are made.
+type messageTracer struct {
+	hostname string
+	lock     sync.Mutex
+	out      io.Writer
+}
+
+func (mt *messageTracer) CheckResult(check, stage string, res module.CheckResult) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	verdict := "pass"
+	switch {
+	case res.Accept:
+		verdict = "accept"
+	case res.Reject:
+		verdict = "reject"
+	case res.Quarantine:
+		verdict = "quarantine"
+	case res.Reason != nil:
+		verdict = "no action"
+	}
+	if res.Reason != nil {
+		verdict += ": " + res.Reason.Error()
+	}
+	fmt.Fprintf(mt.out, "check %s (%s): %s\n", check, stage, verdict)
+
+	if len(res.AuthResult) != 0 {
+		fmt.Fprintf(mt.out, "    Authentication-Results: %s\n", authres.Format(mt.hostname, res.AuthResult))
+	}
+	for field := res.Header.Fields(); field.Next(); {
+		fmt.Fprintf(mt.out, "    %s: %s\n", field.Key(), field.Value())
+	}
+}
+
+func (mt *messageTracer) Rule(kind, addr, rule string) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	fmt.Fprintf(mt.out, "%s %s: matched by '%s'\n", kind, addr, rule)
+}
+
+func (mt *messageTracer) Rewrite(stage, from string, to []string) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	fmt.Fprintf(mt.out, "modifiers (%s): %s => %s\n", stage, from, strings.Join(to, ", "))
+}
+
+func (mt *messageTracer) Deliver(target, mailFrom string, rcpts []string, header textproto.Header) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	fmt.Fprintf(mt.out, "deliver to %s: from <%s> to %s\n", target, mailFrom, strings.Join(rcpts, ", "))
+	for field := header.Fields(); field.Next(); {
+		fmt.Fprintf(mt.out, "    %s: %s\n", field.Key(), field.Value())
+	}
+}
+
+func readTestMessage(path string) (textproto.Header, buffer.Buffer, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return textproto.Header{}, nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	bufr := bufio.NewReader(r)
+	header, err := textproto.ReadHeader(bufr)
+	if err != nil {
+		return textproto.Header{}, nil, fmt.Errorf("malformed message header: %w", err)
+	}
+	body, err := buffer.BufferInMemory(bufr)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return header, body, nil
+}
+
+func findPipelineEndpoint(globals map[string]interface{}, endpoints []ModInfo, name string) (*msgpipeline.MsgPipeline, error) {
+	type pipelineEndpoint interface {
+		Pipeline() *msgpipeline.MsgPipeline
+	}
+
+	for _, endp := range endpoints {
+		if endp.Instance.Name() != name {
+			continue
+		}
+		pe, ok := endp.Instance.(pipelineEndpoint)
+		if !ok {
+			return nil, fmt.Errorf("endpoint %s does not use a message pipeline", name)
+		}
+		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+			return nil, err
+		}
+		if closer, ok := endp.Instance.(io.Closer); ok {
+			hooks.AddHook(hooks.EventShutdown, func() {
+				closer.Close()
+			})
+		}
+		return pe.Pipeline(), nil
+	}
+	return nil, fmt.Errorf("no %s endpoint is configured", name)
+}
+
+func testMessage(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("Error: FILE is required", 2)
+	}
+
+	remoteIP := net.ParseIP(c.String("ip"))
+	if remoteIP == nil {
+		return cli.Exit("Error: malformed IP address: "+c.String("ip"), 2)
+	}
+
+	header, body, err := readTestMessage(c.Args().First())
+	if err != nil {
+		return cli.Exit("Error: "+err.Error(), 2)
+	}
+
+	globals, endpoints, _, err := registerDryRun(c)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+
+	pipeline, err := findPipelineEndpoint(globals, endpoints, c.String("endpoint"))
+	if err != nil {
+		return cli.Exit("Error: "+err.Error(), 1)
+	}
+
+	connState := &module.ConnState{
+		Proto:      "ESMTP",
+		Hostname:   c.String("helo"),
+		LocalAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25},
+		RemoteAddr: &net.TCPAddr{IP: remoteIP, Port: 12345},
+		RDNSName:   future.New(),
+		AuthUser:   c.String("auth-user"),
+	}
+	if c.Bool("tls") {
+		connState.Proto = "ESMTPS"
+		connState.TLS.HandshakeComplete = true
+	}
+	if connState.AuthUser != "" {
+		connState.Proto += "A"
+	}
+	if c.String("endpoint") == "lmtp" {
+		connState.Proto = "LMTP"
+	}
+
+	rdnsCtx, cancelRDNS := context.WithCancel(context.Background())
+	defer cancelRDNS()
+	go func() {
+		name, err := dns.LookupAddr(rdnsCtx, dns.DefaultResolver(), remoteIP)
+		if err != nil || name == "" {
+			connState.RDNSName.Set(nil, err)
+			return
+		}
+		connState.RDNSName.Set(name, nil)
+	}()
+
+	msgMeta := &module.MsgMetadata{
+		Conn:         connState,
+		OriginalFrom: c.String("from"),
+	}
+	msgMeta.ID, err = module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := globals["hostname"].(string)
+	ctx := msgpipeline.WithTracer(context.Background(), &messageTracer{
+		hostname: hostname,
+		out:      os.Stdout,
+	})
+
+	if err := runTestMessage(ctx, pipeline, msgMeta, c.String("from"), c.StringSlice("rcpt"), header, body); err != nil {
+		fmt.Println("result: rejected:", formatTestError(err))
+		return cli.Exit("", 1)
+	}
+	if msgMeta.Quarantine {
+		fmt.Println("result: accepted, quarantined")
+	} else {
+		fmt.Println("result: accepted")
+	}
+	return nil
+}
+
+func runTestMessage(ctx context.Context, pipeline *msgpipeline.MsgPipeline, msgMeta *module.MsgMetadata, from string, rcpts []string, header textproto.Header, body buffer.Buffer) error {
+	if err := pipeline.RunEarlyChecks(ctx, msgMeta.Conn); err != nil {
+		return fmt.Errorf("connection: %w", err)
+	}
+
+	cleanFrom := from
+	if from != "" {
+		var err error
+		cleanFrom, err = address.CleanDomain(from)
+		if err != nil {
+			return fmt.Errorf("MAIL FROM: %w", err)
+		}
+	}
+
+	delivery, err := pipeline.Start(ctx, msgMeta, cleanFrom)
+	if err != nil {
+		return fmt.Errorf("MAIL FROM: %w", err)
+	}
+	for _, rcpt := range rcpts {
+		cleanRcpt, err := address.CleanDomain(rcpt)
+		if err == nil {
+			err = delivery.AddRcpt(ctx, cleanRcpt, smtp.RcptOptions{})
+		}
+		if err != nil {
+			delivery.Abort(ctx)
+			return fmt.Errorf("RCPT TO %s: %w", rcpt, err)
+		}
+	}
+	if err := delivery.Body(ctx, header, body); err != nil {
+		delivery.Abort(ctx)
+		return fmt.Errorf("DATA: %w", err)
+	}
+	return delivery.Abort(ctx)
+}
+
+func formatTestError(err error) string {
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) {
+		return fmt.Sprintf("%v (%d %d.%d.%d %s)", err, smtpErr.Code,
+			smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2], smtpErr.Message)
+	}
+	return err.Error()
+}